@@ -1,13 +1,21 @@
 package main
 
 import (
+	"os"
+
 	"github.com/ropnop/go-windapsearch/pkg/windapsearch"
 )
 
+// exitIncomplete is the exit code when the run finished, but some module failed or only got partial results
+const exitIncomplete = 2
+
 func main() {
 	w := windapsearch.NewSession()
 	err := w.Run()
 	if err != nil {
 		w.Log.Fatalf(err.Error())
 	}
+	if w.Incomplete() {
+		os.Exit(exitIncomplete)
+	}
 }
@@ -42,3 +42,12 @@ package adschema
 //	Name:    "Object(Access-Point)",
 //	Convert: ParseObject,
 //}
+
+// RegisterAttribute adds syntax info for an attribute that isn't part of the AD schema, e.g. one computed by a
+// module, so it gets converted properly when marshaling to JSON. Attributes that are already known are left alone
+func RegisterAttribute(name, syntax string, isSingleValue bool) {
+	if _, ok := AttributeMap[name]; ok {
+		return
+	}
+	AttributeMap[name] = &ADAttributeInfo{Syntax: syntax, IsSingleValue: isSingleValue}
+}
@@ -0,0 +1,119 @@
+package adschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// CSVValueSeparator joins the values of a multi-valued attribute in a single CSV cell
+const CSVValueSeparator = ";"
+
+// StringValues returns the attribute's values converted the same way they are for JSON (SIDs, GUIDs, timestamps,
+// flags, etc), as plain strings. Values that convert to something other than a string (numbers, lists of flags,
+// parsed structures) are given as their compact JSON
+func (e *ADAttribute) StringValues() ([]string, error) {
+	b, err := e.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var list []json.RawMessage
+	if len(b) > 0 && b[0] == '[' {
+		if err := json.Unmarshal(b, &list); err != nil {
+			return nil, err
+		}
+	} else {
+		list = []json.RawMessage{b}
+	}
+	vals := make([]string, 0, len(list))
+	for _, v := range list {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil {
+			vals = append(vals, s)
+			continue
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, v); err != nil {
+			return nil, err
+		}
+		vals = append(vals, compact.String())
+	}
+	return vals, nil
+}
+
+// CSVRecord returns the entry as one CSV row with the given columns. "dn" and "domain" are the entry's DN and
+// domain, every other column is the attribute of that name (matched case insensitively, since the DC returns the
+// names as they are in the schema and not as they were asked for). Missing attributes are empty cells
+func (e *ADEntry) CSVRecord(columns []string) ([]string, error) {
+	attrs := make(map[string]*ADAttribute, len(e.Attributes))
+	for _, a := range e.Attributes {
+		attrs[strings.ToLower(a.Name)] = &ADAttribute{a}
+	}
+	record := make([]string, len(columns))
+	for i, col := range columns {
+		switch strings.ToLower(col) {
+		case "dn":
+			record[i] = e.DN
+			continue
+		case "domain":
+			if e.Domain != "" {
+				record[i] = e.Domain
+				continue
+			}
+		}
+		a, ok := attrs[strings.ToLower(col)]
+		if !ok {
+			continue
+		}
+		vals, err := a.StringValues()
+		if err != nil {
+			return nil, err
+		}
+		record[i] = strings.Join(vals, CSVValueSeparator)
+	}
+	return record, nil
+}
+
+// CSVColumns returns the columns an entry has values for: its DN, domain (if set) and attribute names
+func (e *ADEntry) CSVColumns() []string {
+	columns := []string{"dn"}
+	if e.Domain != "" {
+		columns = append(columns, "domain")
+	}
+	for _, a := range e.Attributes {
+		columns = append(columns, a.Name)
+	}
+	return columns
+}
+
+// CSVRecords is like CSVRecord, but gives one row for every value of the explode column, each with the other columns
+// repeated, e.g. a group's row for each of its members. Entries without a value for it get a single row
+func (e *ADEntry) CSVRecords(columns []string, explode string) ([][]string, error) {
+	record, err := e.CSVRecord(columns)
+	if err != nil || explode == "" {
+		return [][]string{record}, err
+	}
+	column := -1
+	for i, col := range columns {
+		if strings.EqualFold(col, explode) {
+			column = i
+		}
+	}
+	var vals []string
+	for _, a := range e.Attributes {
+		if column >= 0 && strings.EqualFold(a.Name, explode) {
+			if vals, err = (&ADAttribute{a}).StringValues(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(vals) == 0 {
+		return [][]string{record}, nil
+	}
+	records := make([][]string, len(vals))
+	for i, v := range vals {
+		records[i] = append([]string(nil), record...)
+		records[i][column] = v
+	}
+	return records, nil
+}
@@ -0,0 +1,107 @@
+package adschema
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DNS record types used in dnsRecord values
+const (
+	DNSTypeZero uint16 = 0x0000
+	DNSTypeA    uint16 = 0x0001
+	DNSTypeSOA  uint16 = 0x0006
+	DNSTypeAAAA uint16 = 0x001c
+)
+
+const (
+	dnsRecordVersion = 5
+	dnsRankZone      = 0xf0
+)
+
+// DNSRecord is a single value of a dnsNode's dnsRecord attribute (MS-DNSP 2.3.2.2)
+type DNSRecord struct {
+	Type   uint16
+	Rank   byte
+	Flags  uint16
+	Serial uint32
+	TTL    uint32
+	// Timestamp is the number of hours since 1601 the record was last refreshed, or 0 for a static record
+	Timestamp uint32
+	Data      []byte
+	// Raw is the value the record was parsed from, which Bytes doesn't always give back (it leaves out the reserved
+	// field, and whatever follows the data), so a value read from the directory can be deleted exactly
+	Raw []byte
+}
+
+// NewAddressRecord builds a static A or AAAA record for an IP address
+func NewAddressRecord(ip net.IP, ttl, serial uint32) (*DNSRecord, error) {
+	r := &DNSRecord{Rank: dnsRankZone, Serial: serial, TTL: ttl}
+	if v4 := ip.To4(); v4 != nil {
+		r.Type, r.Data = DNSTypeA, v4
+	} else if v6 := ip.To16(); v6 != nil {
+		r.Type, r.Data = DNSTypeAAAA, v6
+	} else {
+		return nil, fmt.Errorf("invalid IP address %q", ip)
+	}
+	return r, nil
+}
+
+// NewTombstoneRecord builds the record the DNS server leaves behind when a node is deleted
+func NewTombstoneRecord(serial uint32, t time.Time) *DNSRecord {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(t.UnixNano()/100+116444736000000000))
+	return &DNSRecord{Type: DNSTypeZero, Rank: dnsRankZone, Serial: serial, Data: data}
+}
+
+// ParseDNSRecord decodes a dnsRecord value
+func ParseDNSRecord(b []byte) (*DNSRecord, error) {
+	if len(b) < 24 {
+		return nil, fmt.Errorf("dnsRecord too short")
+	}
+	length := int(binary.LittleEndian.Uint16(b[0:2]))
+	if len(b) < 24+length {
+		return nil, fmt.Errorf("dnsRecord data truncated")
+	}
+	return &DNSRecord{
+		Type:      binary.LittleEndian.Uint16(b[2:4]),
+		Rank:      b[5],
+		Flags:     binary.LittleEndian.Uint16(b[6:8]),
+		Serial:    binary.LittleEndian.Uint32(b[8:12]),
+		TTL:       binary.BigEndian.Uint32(b[12:16]),
+		Timestamp: binary.LittleEndian.Uint32(b[20:24]),
+		Data:      b[24 : 24+length],
+		Raw:       b,
+	}, nil
+}
+
+// Bytes encodes the record. Note the TTL is big endian, unlike every other field
+func (r *DNSRecord) Bytes() []byte {
+	b := make([]byte, 24, 24+len(r.Data))
+	binary.LittleEndian.PutUint16(b[0:2], uint16(len(r.Data)))
+	binary.LittleEndian.PutUint16(b[2:4], r.Type)
+	b[4] = dnsRecordVersion
+	b[5] = r.Rank
+	binary.LittleEndian.PutUint16(b[6:8], r.Flags)
+	binary.LittleEndian.PutUint32(b[8:12], r.Serial)
+	binary.BigEndian.PutUint32(b[12:16], r.TTL)
+	binary.LittleEndian.PutUint32(b[20:24], r.Timestamp)
+	return append(b, r.Data...)
+}
+
+// IP returns the address of an A or AAAA record
+func (r *DNSRecord) IP() net.IP {
+	if (r.Type == DNSTypeA && len(r.Data) == 4) || (r.Type == DNSTypeAAAA && len(r.Data) == 16) {
+		return net.IP(r.Data)
+	}
+	return nil
+}
+
+// SOASerial returns the zone serial number of an SOA record
+func (r *DNSRecord) SOASerial() (uint32, bool) {
+	if r.Type != DNSTypeSOA || len(r.Data) < 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(r.Data[0:4]), true
+}
@@ -11,6 +11,8 @@ import (
 
 type ADEntry struct {
 	*ldap.Entry
+	// Domain is set when results from more than one domain are combined (e.g. forest mode), to tag where the entry came from
+	Domain string
 }
 
 func (e *ADEntry) String() string {
@@ -19,18 +21,79 @@ func (e *ADEntry) String() string {
 
 func (e *ADEntry) LDAPFormat() string {
 	var sb strings.Builder
+	if e.Domain != "" {
+		sb.WriteString(fmt.Sprintf("# domain: %s\n", e.Domain))
+	}
 	if e.DN != "" {
-		sb.WriteString(fmt.Sprintf("dn: %s\n", e.DN))
+		sb.WriteString(ldifLine("dn", []byte(e.DN)))
 	}
 	for _, attribute := range e.Attributes {
 		for _, value := range attribute.ByteValues {
 			//valueString := HandleLDAPBytes(attribute.Name, value)
-			sb.WriteString(fmt.Sprintf("%s: %v\n", attribute.Name, printable(value)))
+			sb.WriteString(ldifLine(attribute.Name, value))
 		}
 	}
 	return sb.String()
 }
 
+// DecodedFormat is LDAPFormat with the values converted the same way they are for JSON: SIDs and GUIDs in their
+// string forms, timestamps as RFC 3339, flags by name and security descriptors as SDDL. A value that can't be
+// converted is written as it is
+func (e *ADEntry) DecodedFormat() string {
+	var sb strings.Builder
+	if e.Domain != "" {
+		sb.WriteString(fmt.Sprintf("# domain: %s\n", e.Domain))
+	}
+	if e.DN != "" {
+		sb.WriteString(ldifLine("dn", []byte(e.DN)))
+	}
+	for _, attribute := range e.Attributes {
+		vals, err := (&ADAttribute{attribute}).StringValues()
+		if err != nil {
+			for _, value := range attribute.ByteValues {
+				sb.WriteString(ldifLine(attribute.Name, value))
+			}
+			continue
+		}
+		for _, value := range vals {
+			sb.WriteString(ldifLine(attribute.Name, []byte(value)))
+		}
+	}
+	return sb.String()
+}
+
+// ldifLine writes an attribute value the way ldapsearch does: as is if it's text (international characters
+// included), or base64 after a double colon if it's binary or wouldn't survive being read back (leading space,
+// colon or <, trailing space, line breaks)
+func ldifLine(name string, value []byte) string {
+	if ldifSafe(value) {
+		return fmt.Sprintf("%s: %s\n", name, value)
+	}
+	return fmt.Sprintf("%s:: %s\n", name, base64.StdEncoding.EncodeToString(value))
+}
+
+func ldifSafe(value []byte) bool {
+	if !utf8.Valid(value) {
+		return false
+	}
+	if len(value) == 0 {
+		return true
+	}
+	switch value[0] {
+	case ' ', ':', '<':
+		return false
+	}
+	if value[len(value)-1] == ' ' {
+		return false
+	}
+	for _, c := range value {
+		if c == '\r' || c == '\n' || c == 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // HandleLDAPBytes takes a byte slice from a raw attribute value and returns either a UTF8 string (if it's a string),
 // or GUID or timestamp
 func HandleLDAPBytes(name string, b []byte) interface{} {
@@ -0,0 +1,46 @@
+package adschema
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestLDIFLine(t *testing.T) {
+	for _, tc := range []struct {
+		value  []byte
+		base64 bool
+	}{
+		{[]byte("Jörg Müller"), false},
+		{[]byte("Ærøskøbing"), false},
+		{[]byte("Łódź"), false},
+		{[]byte("渡辺 健太"), false},
+		{[]byte("Иванов Пётр"), false},
+		{[]byte("محمد"), false},
+		{[]byte("Müller (IT)"), false},
+		{[]byte("a:b <c>"), false},
+		{[]byte(""), false},
+		{[]byte(" leading space"), true},
+		{[]byte("trailing space "), true},
+		{[]byte(":colon"), true},
+		{[]byte("<file:///etc/passwd"), true},
+		{[]byte("two\nlines"), true},
+		{[]byte("cr\r"), true},
+		{[]byte("nul\x00"), true},
+		// objectGUID and objectSid bytes aren't valid UTF-8
+		{[]byte{0x01, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0x15, 0xff}, true},
+		// Latin-1 rather than UTF-8
+		{[]byte("J\xf6rg"), true},
+	} {
+		got := ldifLine("cn", tc.value)
+		want := "cn: " + string(tc.value) + "\n"
+		if tc.base64 {
+			want = "cn:: " + base64.StdEncoding.EncodeToString(tc.value) + "\n"
+		}
+		if got != want {
+			t.Errorf("ldifLine(%q) = %q, want %q", tc.value, got, want)
+		}
+		if ldifSafe(tc.value) == tc.base64 {
+			t.Errorf("ldifSafe(%q) = %v, want %v", tc.value, tc.base64, !tc.base64)
+		}
+	}
+}
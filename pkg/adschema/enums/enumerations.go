@@ -15,6 +15,12 @@ var EnumFuncs = map[string]ConvertEnum{
 		return val
 	},
 	"userAccountControl": ConvertUAC,
+	"msPKI-Certificate-Name-Flag": func(i int64) interface{} {
+		return FlagNames(i, CertificateNameFlags)
+	},
+	"msPKI-Enrollment-Flag": func(i int64) interface{} {
+		return FlagNames(i, EnrollmentFlags)
+	},
 }
 
 // SAM-Account-Type
@@ -40,3 +46,63 @@ func ConvertUAC(i int64) interface{} {
 	}
 	return flags
 }
+
+// Flag is one bit of a flags attribute and its name
+type Flag struct {
+	Value int64
+	Name  string
+}
+
+// msPKI-Certificate-Name-Flag
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-crtd/1192823c-d839-4bc3-9b6b-fa8c53507ae1
+var CertificateNameFlags = []Flag{
+	{0x1, "ENROLLEE_SUPPLIES_SUBJECT"},
+	{0x8, "OLD_CERT_SUPPLIES_SUBJECT_AND_ALT_NAME"},
+	{0x10000, "ENROLLEE_SUPPLIES_SUBJECT_ALT_NAME"},
+	{0x400000, "SUBJECT_ALT_REQUIRE_DOMAIN_DNS"},
+	{0x800000, "SUBJECT_ALT_REQUIRE_SPN"},
+	{0x1000000, "SUBJECT_ALT_REQUIRE_DIRECTORY_GUID"},
+	{0x2000000, "SUBJECT_ALT_REQUIRE_UPN"},
+	{0x4000000, "SUBJECT_ALT_REQUIRE_EMAIL"},
+	{0x8000000, "SUBJECT_ALT_REQUIRE_DNS"},
+	{0x10000000, "SUBJECT_REQUIRE_DNS_AS_CN"},
+	{0x20000000, "SUBJECT_REQUIRE_EMAIL"},
+	{0x40000000, "SUBJECT_REQUIRE_COMMON_NAME"},
+	{0x80000000, "SUBJECT_REQUIRE_DIRECTORY_PATH"},
+}
+
+// msPKI-Enrollment-Flag
+// https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-crtd/ec71fd43-61c2-407b-83c9-b52272dec8a1
+var EnrollmentFlags = []Flag{
+	{0x1, "INCLUDE_SYMMETRIC_ALGORITHMS"},
+	{0x2, "PEND_ALL_REQUESTS"},
+	{0x4, "PUBLISH_TO_KRA_CONTAINER"},
+	{0x8, "PUBLISH_TO_DS"},
+	{0x10, "AUTO_ENROLLMENT_CHECK_USER_DS_CERTIFICATE"},
+	{0x20, "AUTO_ENROLLMENT"},
+	{0x40, "PREVIOUS_APPROVAL_VALIDATE_REENROLLMENT"},
+	{0x100, "USER_INTERACTION_REQUIRED"},
+	{0x400, "REMOVE_INVALID_CERTIFICATE_FROM_PERSONAL_STORE"},
+	{0x800, "ALLOW_ENROLL_ON_BEHALF_OF"},
+	{0x1000, "ADD_OCSP_NOCHECK"},
+	{0x2000, "ENABLE_KEY_REUSE_ON_NT_TOKEN_KEYSET_STORAGE_FULL"},
+	{0x4000, "NOREVOCATIONINFOINISSUEDCERTS"},
+	{0x8000, "INCLUDE_BASIC_CONSTRAINTS_FOR_EE_CERTS"},
+	{0x10000, "ALLOW_PREVIOUS_APPROVAL_KEYBASEDRENEWAL_VALIDATE_REENROLLMENT"},
+	{0x20000, "ISSUANCE_POLICIES_FROM_REQUEST"},
+	{0x40000, "SKIP_AUTO_RENEWAL"},
+	{0x80000, "NO_SECURITY_EXTENSION"},
+}
+
+// FlagNames names the flags set in a flags attribute. Values are read as unsigned 32 bit, since AD returns flags
+// with the top bit set as negative numbers. Bits without a name are left out
+func FlagNames(i int64, flags []Flag) []string {
+	i &= 0xffffffff
+	names := []string{}
+	for _, f := range flags {
+		if i&f.Value != 0 {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,104 @@
+package adschema
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Forest trust record types
+const (
+	ForestTrustTopLevelName   = 0
+	ForestTrustTopLevelNameEx = 1
+	ForestTrustDomainInfo     = 2
+)
+
+// Forest trust record flags. The LSA_TLN flags apply to top level names, the LSA_SID and LSA_NB flags to domain info
+const (
+	ForestTrustTLNDisabledNew      = 0x1
+	ForestTrustTLNDisabledAdmin    = 0x2
+	ForestTrustTLNDisabledConflict = 0x4
+	ForestTrustSIDDisabledAdmin    = 0x1
+	ForestTrustSIDDisabledConflict = 0x2
+	ForestTrustNBDisabledAdmin     = 0x4
+	ForestTrustNBDisabledConflict  = 0x8
+)
+
+// ForestTrustRecord is a record of msDS-TrustForestTrustInfo: a name suffix the trusted forest claims (the name is
+// routed to it unless the record is disabled), one excluded from that, or one of its domains
+type ForestTrustRecord struct {
+	Type  int
+	Flags uint32
+	// Name is the top level name, or the DNS name of the domain
+	Name        string
+	NetBIOSName string
+}
+
+// Disabled is true if the record is disabled, i.e. names under it aren't routed to the trusted forest
+func (r ForestTrustRecord) Disabled() bool {
+	if r.Type == ForestTrustDomainInfo {
+		return r.Flags&(ForestTrustSIDDisabledAdmin|ForestTrustSIDDisabledConflict) != 0
+	}
+	return r.Flags&(ForestTrustTLNDisabledNew|ForestTrustTLNDisabledAdmin|ForestTrustTLNDisabledConflict) != 0
+}
+
+// ParseForestTrustInfo decodes msDS-TrustForestTrustInfo (MS-ADTS 6.1.6.9.3): a version, a record count, then each
+// record prefixed with its length. Integers are little endian, and names are UTF-8 prefixed with their length
+func ParseForestTrustInfo(b []byte) ([]ForestTrustRecord, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("forest trust info is too short")
+	}
+	if version := binary.LittleEndian.Uint32(b); version != 1 {
+		return nil, fmt.Errorf("unknown forest trust info version %d", version)
+	}
+	count := binary.LittleEndian.Uint32(b[4:])
+	b = b[8:]
+	var records []ForestTrustRecord
+	for i := uint32(0); i < count; i++ {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("forest trust record %d is truncated", i)
+		}
+		size := binary.LittleEndian.Uint32(b)
+		if uint64(len(b)-4) < uint64(size) || size < 13 {
+			return nil, fmt.Errorf("forest trust record %d is truncated", i)
+		}
+		rec := b[4 : 4+size]
+		data := rec[13:]
+		b = b[4+size:]
+
+		// flags, then an 8 byte timestamp, then the type
+		r := ForestTrustRecord{Type: int(rec[12]), Flags: binary.LittleEndian.Uint32(rec)}
+		var err error
+		switch r.Type {
+		case ForestTrustTopLevelName, ForestTrustTopLevelNameEx:
+			r.Name, _, err = forestTrustString(data)
+		case ForestTrustDomainInfo:
+			if len(data) < 4 || uint64(len(data)-4) < uint64(binary.LittleEndian.Uint32(data)) {
+				return nil, fmt.Errorf("forest trust record %d is truncated", i)
+			}
+			data = data[4+binary.LittleEndian.Uint32(data):]
+			if r.Name, data, err = forestTrustString(data); err == nil {
+				r.NetBIOSName, _, err = forestTrustString(data)
+			}
+		default:
+			// newer record types (e.g. scanner info) are skipped
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("forest trust record %d: %s", i, err)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// forestTrustString reads a length prefixed UTF-8 string, returning what follows it
+func forestTrustString(b []byte) (string, []byte, error) {
+	if len(b) < 4 {
+		return "", nil, fmt.Errorf("name is truncated")
+	}
+	n := binary.LittleEndian.Uint32(b)
+	if uint64(len(b)-4) < uint64(n) {
+		return "", nil, fmt.Errorf("name is truncated")
+	}
+	return string(b[4 : 4+n]), b[4+n:], nil
+}
@@ -36,6 +36,9 @@ func (e *ADEntry) MarshalJSON() ([]byte, error) {
 	if e.DN != "" {
 		jEntry["dn"] = e.DN
 	}
+	if e.Domain != "" {
+		jEntry["domain"] = e.Domain
+	}
 	for _, attribute := range e.Attributes {
 		jEntry[attribute.Name] = &ADAttribute{attribute}
 	}
@@ -0,0 +1,153 @@
+package adschema
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+)
+
+// KeyCredential entry identifiers (MS-ADTS 2.2.20.6)
+const (
+	KeyCredentialKeyID                byte   = 0x01
+	KeyCredentialKeyHash              byte   = 0x02
+	KeyCredentialKeyMaterial          byte   = 0x03
+	KeyCredentialKeyUsage             byte   = 0x04
+	KeyCredentialKeySource            byte   = 0x05
+	KeyCredentialDeviceID             byte   = 0x06
+	KeyCredentialCustomKeyInformation byte   = 0x07
+	KeyCredentialApproximateLastLogon byte   = 0x08
+	KeyCredentialCreationTime         byte   = 0x09
+	keyCredentialVersion2             uint32 = 0x200
+	keyUsageNGC                       byte   = 0x01
+	keySourceAD                       byte   = 0x00
+	bcryptRSAPublicMagic              uint32 = 0x31415352 // "RSA1"
+)
+
+// KeyCredential is a single value of msDS-KeyCredentialLink, as written by Windows Hello for Business
+type KeyCredential struct {
+	KeyID        []byte
+	KeyMaterial  []byte
+	DeviceID     secdesc.GUID
+	CreationTime time.Time
+	// Owner is the DN the value is linked to, i.e. the object it is stored on
+	Owner string
+}
+
+// NewKeyCredential builds a KeyCredential for an RSA public key, owned by the object with the given DN
+func NewKeyCredential(key *rsa.PublicKey, deviceID secdesc.GUID, owner string) *KeyCredential {
+	material := bcryptRSAPublicBlob(key)
+	id := sha256.Sum256(material)
+	return &KeyCredential{
+		KeyID:        id[:],
+		KeyMaterial:  material,
+		DeviceID:     deviceID,
+		CreationTime: time.Now(),
+		Owner:        owner,
+	}
+}
+
+// bcryptRSAPublicBlob encodes a public key as a BCRYPT_RSAKEY_BLOB
+func bcryptRSAPublicBlob(key *rsa.PublicKey) []byte {
+	exponent := big.NewInt(int64(key.E)).Bytes()
+	modulus := key.N.Bytes()
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b[0:], bcryptRSAPublicMagic)
+	binary.LittleEndian.PutUint32(b[4:], uint32(key.N.BitLen()))
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(exponent)))
+	binary.LittleEndian.PutUint32(b[12:], uint32(len(modulus)))
+	b = append(b, exponent...)
+	return append(b, modulus...)
+}
+
+// Bytes encodes the KeyCredential blob. The key hash covers every entry after it
+func (k *KeyCredential) Bytes() []byte {
+	filetime := func(t time.Time) []byte {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, uint64(t.UnixNano()/100+116444736000000000))
+		return b
+	}
+	var tail []byte
+	tail = appendKeyCredentialEntry(tail, KeyCredentialKeyMaterial, k.KeyMaterial)
+	tail = appendKeyCredentialEntry(tail, KeyCredentialKeyUsage, []byte{keyUsageNGC})
+	tail = appendKeyCredentialEntry(tail, KeyCredentialKeySource, []byte{keySourceAD})
+	tail = appendKeyCredentialEntry(tail, KeyCredentialDeviceID, k.DeviceID[:])
+	tail = appendKeyCredentialEntry(tail, KeyCredentialCustomKeyInformation, []byte{0x01, 0x00})
+	tail = appendKeyCredentialEntry(tail, KeyCredentialApproximateLastLogon, filetime(k.CreationTime))
+	tail = appendKeyCredentialEntry(tail, KeyCredentialCreationTime, filetime(k.CreationTime))
+	hash := sha256.Sum256(tail)
+
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, keyCredentialVersion2)
+	b = appendKeyCredentialEntry(b, KeyCredentialKeyID, k.KeyID)
+	b = appendKeyCredentialEntry(b, KeyCredentialKeyHash, hash[:])
+	return append(b, tail...)
+}
+
+func appendKeyCredentialEntry(b []byte, id byte, value []byte) []byte {
+	header := make([]byte, 3)
+	binary.LittleEndian.PutUint16(header, uint16(len(value)))
+	header[2] = id
+	b = append(b, header...)
+	return append(b, value...)
+}
+
+// DNBinary formats the KeyCredential as an Object(DN-Binary) value for msDS-KeyCredentialLink
+func (k *KeyCredential) DNBinary() string {
+	h := strings.ToUpper(hex.EncodeToString(k.Bytes()))
+	return fmt.Sprintf("B:%d:%s:%s", len(h), h, k.Owner)
+}
+
+// ParseKeyCredential decodes an msDS-KeyCredentialLink value in its DN-Binary form
+func ParseKeyCredential(value string) (*KeyCredential, error) {
+	parts := strings.SplitN(value, ":", 4)
+	if len(parts) != 4 || parts[0] != "B" {
+		return nil, fmt.Errorf("invalid DN-Binary value")
+	}
+	length, err := strconv.Atoi(parts[1])
+	if err != nil || length != len(parts[2]) {
+		return nil, fmt.Errorf("invalid DN-Binary length")
+	}
+	b, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid DN-Binary value: %s", err)
+	}
+	if len(b) < 4 || binary.LittleEndian.Uint32(b) != keyCredentialVersion2 {
+		return nil, fmt.Errorf("unsupported KeyCredential version")
+	}
+	k := &KeyCredential{Owner: parts[3]}
+	for offset := 4; offset < len(b); {
+		if offset+3 > len(b) {
+			return nil, fmt.Errorf("truncated KeyCredential entry")
+		}
+		size := int(binary.LittleEndian.Uint16(b[offset:]))
+		id := b[offset+2]
+		offset += 3
+		if offset+size > len(b) {
+			return nil, fmt.Errorf("truncated KeyCredential entry")
+		}
+		value := b[offset : offset+size]
+		offset += size
+		switch id {
+		case KeyCredentialKeyID:
+			k.KeyID = value
+		case KeyCredentialKeyMaterial:
+			k.KeyMaterial = value
+		case KeyCredentialDeviceID:
+			copy(k.DeviceID[:], value)
+		case KeyCredentialCreationTime:
+			if len(value) == 8 {
+				ticks := int64(binary.LittleEndian.Uint64(value)) - 116444736000000000
+				k.CreationTime = time.Unix(0, ticks*100)
+			}
+		}
+	}
+	return k, nil
+}
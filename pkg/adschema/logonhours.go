@@ -0,0 +1,72 @@
+package adschema
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HoursPerWeek is the number of hours a logonHours value has a bit for
+const HoursPerWeek = 7 * 24
+
+var weekdays = []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+
+// LogonHours is a decoded logonHours value (MS-ADA1 2.363): whether logon is allowed in each hour of the week, in
+// UTC, starting Sunday 00:00
+type LogonHours [HoursPerWeek]bool
+
+// ParseLogonHours decodes a logonHours value: 21 bytes, one bit per hour, the lowest bit of the first byte being
+// Sunday 00:00-01:00 UTC
+func ParseLogonHours(b []byte) (LogonHours, error) {
+	var h LogonHours
+	if len(b) != HoursPerWeek/8 {
+		return h, fmt.Errorf("logonHours is %d bytes, expected %d", len(b), HoursPerWeek/8)
+	}
+	for i := range h {
+		h[i] = b[i/8]&(1<<uint(i%8)) != 0
+	}
+	return h, nil
+}
+
+// Allowed is the number of hours in the week logon is allowed
+func (h LogonHours) Allowed() int {
+	n := 0
+	for _, allowed := range h {
+		if allowed {
+			n++
+		}
+	}
+	return n
+}
+
+// Shift moves the hours by offset hours, e.g. to show them in a time zone other than UTC
+func (h LogonHours) Shift(offset int) LogonHours {
+	var shifted LogonHours
+	for i, allowed := range h {
+		shifted[((i+offset)%HoursPerWeek+HoursPerWeek)%HoursPerWeek] = allowed
+	}
+	return shifted
+}
+
+// Days describes the allowed hours of each day, e.g. "Mon 08:00-18:00", or "Sun none"
+func (h LogonHours) Days() []string {
+	days := make([]string, 7)
+	for d := range days {
+		var ranges []string
+		start := -1
+		for hour := 0; hour <= 24; hour++ {
+			allowed := hour < 24 && h[d*24+hour]
+			switch {
+			case allowed && start < 0:
+				start = hour
+			case !allowed && start >= 0:
+				ranges = append(ranges, fmt.Sprintf("%02d:00-%02d:00", start, hour))
+				start = -1
+			}
+		}
+		if len(ranges) == 0 {
+			ranges = []string{"none"}
+		}
+		days[d] = weekdays[d] + " " + strings.Join(ranges, ", ")
+	}
+	return days
+}
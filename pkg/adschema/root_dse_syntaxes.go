@@ -15,12 +15,15 @@ var RootDSEAttributeMap = map[string]bool{
 	"forestFunctionality":           true,
 	"domainControllerFunctionality": true,
 	"rootDomainNamingContext":       true,
+	"configurationNamingContext":    true,
+	"schemaNamingContext":           true,
+	"namingContexts":                true,
 	"currentTime":                   true,
 }
 
 func marshalRootDSEAttribute(e *ADAttribute) ([]byte, error) {
 	switch e.Name {
-	case "defaultNamingContext", "dnsHostName", "rootDomainNamingContext":
+	case "defaultNamingContext", "dnsHostName", "rootDomainNamingContext", "configurationNamingContext", "schemaNamingContext":
 		return json.Marshal(string(e.ByteValues[0]))
 	case "domainFunctionality", "forestFunctionality", "domainControllerFunctionality":
 		level, ok := FunctionalityLevelsMapping[string(e.ByteValues[0])]
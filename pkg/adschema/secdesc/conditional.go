@@ -0,0 +1,198 @@
+package secdesc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Callback ACE types, which carry a conditional expression (MS-DTYP 2.4.4.17). Authentication policies use them to
+// say who can authenticate from or to what
+const (
+	AccessAllowedCallbackACEType byte = 0x09
+	AccessDeniedCallbackACEType  byte = 0x0A
+)
+
+// conditionalSignature starts the application data of a callback ACE holding a conditional expression
+var conditionalSignature = []byte("artx")
+
+// CallbackACE is the body of a callback ACE, with its condition in SDDL form, e.g.
+// (Member_of_any {SID(S-1-5-21-...-1105)})
+type CallbackACE struct {
+	Mask      uint32
+	SID       SID
+	Condition string
+}
+
+// IsCallbackACE is true for the allowed and denied callback ACE types
+func (a ACE) IsCallbackACE() bool {
+	return a.Type == AccessAllowedCallbackACEType || a.Type == AccessDeniedCallbackACEType
+}
+
+// Callback decodes the body of a callback ACE, which is kept in Raw since it isn't an ACE type parsed otherwise
+func (a ACE) Callback() (CallbackACE, error) {
+	var c CallbackACE
+	if !a.IsCallbackACE() {
+		return c, fmt.Errorf("not a callback ACE")
+	}
+	if len(a.Raw) < 4 {
+		return c, fmt.Errorf("callback ACE too short")
+	}
+	c.Mask = binary.LittleEndian.Uint32(a.Raw)
+	sid, n, err := DecodeSID(a.Raw[4:])
+	if err != nil {
+		return c, err
+	}
+	c.SID = sid
+	data := a.Raw[4+n:]
+	if len(data) == 0 {
+		return c, nil
+	}
+	if !bytes.HasPrefix(data, conditionalSignature) {
+		return c, fmt.Errorf("application data isn't a conditional expression")
+	}
+	c.Condition, err = decodeCondition(data[len(conditionalSignature):])
+	return c, err
+}
+
+// Conditional expression tokens
+const (
+	condInt8         = 0x01
+	condInt64        = 0x04
+	condUnicode      = 0x10
+	condOctets       = 0x18
+	condComposite    = 0x50
+	condSID          = 0x51
+	condLocalAttr    = 0xf8
+	condUserAttr     = 0xf9
+	condResourceAttr = 0xfa
+	condDeviceAttr   = 0xfb
+	condLogicalAnd   = 0xa0
+	condLogicalOr    = 0xa1
+	condLogicalNot   = 0xa2
+	condExists       = 0x87
+	condNotExists    = 0x8d
+)
+
+// condIntegerLength is the length of an integer literal after its token: the value, its sign and its base
+const condIntegerLength = 8 + 1 + 1
+
+// condBinary are the operators that take two operands, written between them
+var condBinary = map[byte]string{
+	0x80: "==", 0x81: "!=", 0x82: "<", 0x83: "<=", 0x84: ">", 0x85: ">=",
+	0x86: "Contains", 0x88: "Any_of", 0x8e: "Not_Contains", 0x8f: "Not_Any_of",
+	condLogicalAnd: "&&", condLogicalOr: "||",
+}
+
+// condUnary are the operators that take one operand, written before it
+var condUnary = map[byte]string{
+	0x89: "Member_of", 0x8a: "Device_Member_of", 0x8b: "Member_of_any", 0x8c: "Device_Member_of_any",
+	0x90: "Not_Member_of", 0x91: "Not_Device_Member_of", 0x92: "Not_Member_of_any", 0x93: "Not_Device_Member_of_any",
+	condExists: "Exists", condNotExists: "Not_Exists", condLogicalNot: "!",
+}
+
+// decodeCondition turns the postfix tokens of a conditional expression into the infix SDDL form
+func decodeCondition(b []byte) (string, error) {
+	var stack []string
+	for len(b) > 0 {
+		token := b[0]
+		if token == 0 {
+			// padding to a multiple of 4 bytes
+			b = b[1:]
+			continue
+		}
+		if op, ok := condBinary[token]; ok {
+			if len(stack) < 2 {
+				return "", fmt.Errorf("operator %s is missing operands", op)
+			}
+			left, right := stack[len(stack)-2], stack[len(stack)-1]
+			stack = append(stack[:len(stack)-2], fmt.Sprintf("(%s %s %s)", left, op, right))
+			b = b[1:]
+			continue
+		}
+		if op, ok := condUnary[token]; ok {
+			if len(stack) < 1 {
+				return "", fmt.Errorf("operator %s is missing its operand", op)
+			}
+			format := "(%s %s)"
+			if token == condLogicalNot {
+				format = "(%s%s)"
+			}
+			stack[len(stack)-1] = fmt.Sprintf(format, op, stack[len(stack)-1])
+			b = b[1:]
+			continue
+		}
+		operand, n, err := decodeOperand(b)
+		if err != nil {
+			return "", err
+		}
+		stack = append(stack, operand)
+		b = b[n:]
+	}
+	if len(stack) != 1 {
+		return "", fmt.Errorf("conditional expression doesn't reduce to one value")
+	}
+	return stack[0], nil
+}
+
+// decodeOperand decodes a literal or attribute name token, returning its length
+func decodeOperand(b []byte) (string, int, error) {
+	token := b[0]
+	if token >= condInt8 && token <= condInt64 {
+		if len(b) < 1+condIntegerLength {
+			return "", 0, fmt.Errorf("integer is truncated")
+		}
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(b[1:])), 10), 1 + condIntegerLength, nil
+	}
+	if len(b) < 5 {
+		return "", 0, fmt.Errorf("token 0x%02x is truncated", token)
+	}
+	size := int(binary.LittleEndian.Uint32(b[1:]))
+	if size < 0 || len(b) < 5+size {
+		return "", 0, fmt.Errorf("token 0x%02x is truncated", token)
+	}
+	value, n := b[5:5+size], 5+size
+	switch token {
+	case condUnicode:
+		return strconv.Quote(decodeUTF16(value)), n, nil
+	case condOctets:
+		return fmt.Sprintf("#%x", value), n, nil
+	case condSID:
+		sid, _, err := DecodeSID(value)
+		if err != nil {
+			return "", 0, err
+		}
+		return fmt.Sprintf("SID(%s)", sid), n, nil
+	case condComposite:
+		var items []string
+		for len(value) > 0 {
+			item, m, err := decodeOperand(value)
+			if err != nil {
+				return "", 0, err
+			}
+			items = append(items, item)
+			value = value[m:]
+		}
+		return "{" + strings.Join(items, ", ") + "}", n, nil
+	case condLocalAttr:
+		return decodeUTF16(value), n, nil
+	case condUserAttr:
+		return "@User." + decodeUTF16(value), n, nil
+	case condResourceAttr:
+		return "@Resource." + decodeUTF16(value), n, nil
+	case condDeviceAttr:
+		return "@Device." + decodeUTF16(value), n, nil
+	}
+	return "", 0, fmt.Errorf("unknown conditional expression token 0x%02x", token)
+}
+
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,50 @@
+package secdesc
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// GUID is a Windows GUID, stored in its mixed-endian binary form
+type GUID [16]byte
+
+// ParseGUID parses a GUID in its string form (bf967aba-0de6-11d0-a285-00aa003049e2)
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	s = strings.Trim(s, "{}")
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil || len(b) != 16 || len(s) != 36 {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	binary.LittleEndian.PutUint32(g[0:4], binary.BigEndian.Uint32(b[0:4]))
+	binary.LittleEndian.PutUint16(g[4:6], binary.BigEndian.Uint16(b[4:6]))
+	binary.LittleEndian.PutUint16(g[6:8], binary.BigEndian.Uint16(b[6:8]))
+	copy(g[8:], b[8:])
+	return g, nil
+}
+
+// MustParseGUID is like ParseGUID but panics on error, for well-known GUIDs
+func MustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+func (g GUID) String() string {
+	return fmt.Sprintf(
+		"%08x-%04x-%04x-%04x-%012x",
+		binary.LittleEndian.Uint32(g[:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10],
+		g[10:])
+}
+
+// IsZero is true for the all zero (unset) GUID
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
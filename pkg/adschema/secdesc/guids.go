@@ -0,0 +1,244 @@
+package secdesc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// rightNames are the control access rights (extended rights and validated writes) an object ACE can grant, keyed by
+// their rightsGuid. These are the ones every forest has; RegisterRight adds any others read from the DC
+var rightNames = map[string]string{
+	"ab721a53-1e2f-11d0-9819-00aa0040529b": "User-Change-Password",
+	"00299570-246d-11d0-a768-00aa006e0529": "User-Force-Change-Password",
+	"ab721a54-1e2f-11d0-9819-00aa0040529b": "Send-As",
+	"ab721a55-1e2f-11d0-9819-00aa0040529b": "Send-To",
+	"ab721a56-1e2f-11d0-9819-00aa0040529b": "Receive-As",
+	"1131f6aa-9c07-11d1-f79f-00c04fc2dcd2": "DS-Replication-Get-Changes",
+	"1131f6ad-9c07-11d1-f79f-00c04fc2dcd2": "DS-Replication-Get-Changes-All",
+	"89e95b76-444d-4c62-991a-0facbeda640c": "DS-Replication-Get-Changes-In-Filtered-Set",
+	"1131f6ab-9c07-11d1-f79f-00c04fc2dcd2": "DS-Replication-Synchronize",
+	"1131f6ac-9c07-11d1-f79f-00c04fc2dcd2": "DS-Replication-Manage-Topology",
+	"1131f6ae-9c07-11d1-f79f-00c04fc2dcd2": "Read-Only-Replication-Secret-Synchronization",
+	"9923a32a-3607-11d2-b9be-0000f87a36b2": "DS-Install-Replica",
+	"3e0f7e18-2c7a-4c10-ba82-4d926db99a3e": "DS-Clone-Domain-Controller",
+	"084c93a2-620d-4879-a836-f0ae47de0e89": "DS-Read-Partition-Secrets",
+	"94825a8d-b171-4116-8146-1e34d8f54401": "DS-Write-Partition-Secrets",
+	"ee914b82-0a98-11d1-adbb-00c04fd8d5cd": "Abandon-Replication",
+	"0e10c968-78fb-11d2-90d4-00c04f79dc55": "Certificate-Enrollment",
+	"a05b8cc2-17bc-4802-a710-e7c15ab866a2": "Certificate-AutoEnrollment",
+	"45ec5156-db7e-47bb-b53f-dbeb2d03c40f": "Reanimate-Tombstones",
+	"ba33815a-4f93-4c76-87f3-57574bff8109": "Migrate-SID-History",
+	"440820ad-65b4-11d1-a3da-0000f875ae0d": "Add-GUID",
+	"1abd7cf8-0a99-11d1-adbb-00c04fd8d5cd": "Allocate-Rids",
+	"68b1d179-0d15-4d4f-ab71-46152e79a7bc": "Allowed-To-Authenticate",
+	"edacfd8f-ffb3-11d1-b41d-00a0c968f939": "Apply-Group-Policy",
+	"014bf69c-7b3b-11d1-85f6-08002be74fab": "Change-Domain-Master",
+	"cc17b1fb-33d9-11d2-97d4-00c04fd8d5cd": "Change-Infrastructure-Master",
+	"bae50096-4752-11d1-9052-00c04fc2d4cf": "Change-PDC",
+	"d58d5f36-0a98-11d1-adbb-00c04fd8d5cd": "Change-Rid-Master",
+	"e12b56b6-0a95-11d1-adbb-00c04fd8d5cd": "Change-Schema-Master",
+	"e2a36dc9-ae17-47c3-b58b-be34c55ba633": "Create-Inbound-Forest-Trust",
+	"fec364e0-0a98-11d1-adbb-00c04fd8d5cd": "Do-Garbage-Collection",
+	"69ae6200-7f46-11d2-b9ad-00c04f79f805": "DS-Check-Stale-Phantoms",
+	"2f16c4a5-b98e-432c-952a-cb388ba33f2e": "DS-Execute-Intentions-Script",
+	"4ecc03fe-ffc0-4947-b630-eb672a8a9dbc": "DS-Query-Self-Quota",
+	"05c74c5e-4deb-43b4-bd9f-86664c2a7fd5": "Enable-Per-User-Reversibly-Encrypted-Password",
+	"b7b1b3de-ab09-4242-9e30-9980e5d322f7": "Generate-RSoP-Logging",
+	"b7b1b3dd-ab09-4242-9e30-9980e5d322f7": "Generate-RSoP-Planning",
+	"62dd28a8-7f46-11d2-b9ad-00c04f79f805": "Recalculate-Security-Inheritance",
+	"0bc1554e-0a99-11d1-adbb-00c04fd8d5cd": "Recalculate-Hierarchy",
+	"9432c620-033c-4db7-8b58-14ef6d0bf477": "Refresh-Group-Cache",
+	"1a60ea8d-58a6-4b20-bcdc-fb71eb8a9ff8": "Reload-SSL-Certificate",
+	"7726b9d5-a4b4-4288-a6b2-dce952e80a7f": "Run-Protect-Admin-Groups-Task",
+	"ccc2dc7d-a6ad-4a7a-8846-c04e3cc53501": "Unexpire-Password",
+	"280f369c-67c7-438e-ae98-1d46f3c6f541": "Update-Password-Not-Required-Bit",
+	"be2bb760-7f46-11d2-b9ad-00c04f79f805": "Update-Schema-Cache",
+	// validated writes
+	"bf9679c0-0de6-11d0-a285-00aa003049e2": "Self-Membership",
+	"72e39547-7b18-11d1-adef-00c04fd8d5cd": "Validated-DNS-Host-Name",
+	"f3a64788-5306-11d1-a9c5-0000f80367c1": "Validated-SPN",
+	"80863791-dbe9-4eb8-837e-7f0ab55d9ac7": "Validated-MS-DS-Additional-DNS-Host-Name",
+	"d31a8757-2447-4545-8081-3bb610cacbf2": "Validated-MS-DS-Behavior-Version",
+	"9b026da6-0d3c-465c-8bee-5199d7165cba": "DS-Validated-Write-Computer",
+}
+
+// schemaNames are the property sets, classes and attributes an object ACE can apply to, keyed by their rightsGuid
+// (property sets) or schemaIDGUID. Only the ones that commonly show up in ACLs are listed; RegisterSchemaObject adds
+// the whole schema, including extensions like LAPS whose GUIDs differ in every forest
+var schemaNames = map[string]string{
+	// property sets
+	"4c164200-20c0-11d0-a768-00aa006e0529": "User-Account-Restrictions",
+	"5f202010-79a5-11d0-9020-00c04fc2d4cf": "User-Logon",
+	"bc0ac240-79a9-11d0-9020-00c04fc2d4cf": "Membership",
+	"59ba2f42-79a2-11d0-9020-00c04fc2d3cf": "General-Information",
+	"77b5b886-944a-11d1-aebd-0000f80367c1": "Personal-Information",
+	"e45795b2-9455-11d1-aebd-0000f80367c1": "Email-Information",
+	"e45795b3-9455-11d1-aebd-0000f80367c1": "Web-Information",
+	"e48d0154-bcf8-11d1-8702-00c04fb96050": "Public-Information",
+	"037088f8-0ae1-11d2-b422-00a0c968f939": "RAS-Information",
+	"91e647de-d96f-4b70-9557-d63ff4f3ccd8": "Private-Information",
+	"b8119fd0-04f6-4762-ab7a-4986c76b3f9a": "Domain-Other-Parameters",
+	"c7407360-20bf-11d0-a768-00aa006e0529": "Domain-Password",
+	"ffa6f046-ca4b-4feb-b40d-04dfee722543": "MS-TS-GatewayAccess",
+	"5805bc62-bdc9-4428-a5e2-856a0f4c185e": "Terminal-Server-License-Server",
+	"6db69a1c-9422-11d1-aebd-0000f80367c1": "Terminal-Server",
+	"46a9b11d-60ae-405a-b7e8-ff8a58d456d2": "Token-Groups-Global-And-Universal",
+	// classes
+	"bf967aba-0de6-11d0-a285-00aa003049e2": "user",
+	"bf967a86-0de6-11d0-a285-00aa003049e2": "computer",
+	"bf967a9c-0de6-11d0-a285-00aa003049e2": "group",
+	"5cb41ed0-0e4c-11d0-a286-00aa003049e2": "contact",
+	"4828cc14-1437-45bc-9b07-ad6f015e5f28": "inetOrgPerson",
+	"ce206244-5827-4a86-ba1c-1c0c386c1b64": "msDS-ManagedServiceAccount",
+	"7b8b558a-93a5-4af7-adca-c017e67f1057": "msDS-GroupManagedServiceAccount",
+	"bf967aa5-0de6-11d0-a285-00aa003049e2": "organizationalUnit",
+	"bf967a8b-0de6-11d0-a285-00aa003049e2": "container",
+	"19195a5b-6da0-11d0-afd3-00c04fd930c9": "domainDNS",
+	"f30e3bc2-9ff0-11d1-b603-0000f80367c1": "groupPolicyContainer",
+	"89e31c12-8530-11d0-afda-00c04fd930c9": "foreignSecurityPrincipal",
+	"bf967ab8-0de6-11d0-a285-00aa003049e2": "trustedDomain",
+	"bf967aa8-0de6-11d0-a285-00aa003049e2": "printQueue",
+	"e0fa1e8c-9b45-11d0-afdd-00c04fd930c9": "dnsZone",
+	"e0fa1e8b-9b45-11d0-afdd-00c04fd930c9": "dnsNode",
+	"e5209ca2-3bba-11d2-90cc-00c04fd91ab1": "pKICertificateTemplate",
+	"ee4aa692-3bba-11d2-90cc-00c04fd91ab1": "pKIEnrollmentService",
+	// attributes
+	"bf967a68-0de6-11d0-a285-00aa003049e2": "userAccountControl",
+	"bf967a0a-0de6-11d0-a285-00aa003049e2": "pwdLastSet",
+	"bf9679a8-0de6-11d0-a285-00aa003049e2": "scriptPath",
+	"bf967950-0de6-11d0-a285-00aa003049e2": "description",
+	"bf967953-0de6-11d0-a285-00aa003049e2": "displayName",
+	"00fbf30c-91fe-11d1-aebc-0000f80367c1": "altSecurityIdentities",
+	"3f78c3e5-f79a-46bd-a0b8-9d18116ddc79": "msDS-AllowedToActOnBehalfOfOtherIdentity",
+	"800d94d7-b7a1-42a1-b14d-7cae1423d07f": "msDS-AllowedToDelegateTo",
+	"5b47d60f-6090-40b2-9f37-2a4de88f3063": "msDS-KeyCredentialLink",
+	"888eedd6-ce04-df40-b462-b8a50e41ba38": "msDS-GroupMSAMembership",
+	"e362ed86-b728-0842-b27d-2dea7a9df218": "msDS-ManagedPassword",
+	"20119867-1d04-4ab7-9371-cfc3d5df0afd": "msDS-SupportedEncryptionTypes",
+	"f30e3bbe-9ff0-11d1-b603-0000f80367c1": "gPLink",
+	"f30e3bbf-9ff0-11d1-b603-0000f80367c1": "gPOptions",
+	"ea1dddc4-60ff-416e-8cc0-17cee534bce7": "msPKI-Certificate-Name-Flag",
+	"d15ef7d8-f226-46db-ae79-b34e560bd12c": "msPKI-Enrollment-Flag",
+}
+
+// guidNamesMu guards rightNames and schemaNames, which can be added to while results are being rendered
+var guidNamesMu sync.RWMutex
+
+// RegisterRight names a control access right by its rightsGuid, e.g. one read from the Extended-Rights container
+func RegisterRight(g GUID, name string) {
+	guidNamesMu.Lock()
+	defer guidNamesMu.Unlock()
+	rightNames[g.String()] = name
+}
+
+// RegisterSchemaObject names a property set, class or attribute by its GUID, e.g. one read from the schema partition
+func RegisterSchemaObject(g GUID, name string) {
+	guidNamesMu.Lock()
+	defer guidNamesMu.Unlock()
+	schemaNames[g.String()] = name
+}
+
+// GUIDName returns the name of a right, property set, class or attribute. Some GUIDs are both a validated write and
+// an attribute (Self-Membership is the member attribute's GUID), so rights are preferred when right is set
+func GUIDName(g GUID, right bool) (string, bool) {
+	guidNamesMu.RLock()
+	defer guidNamesMu.RUnlock()
+	first, second := schemaNames, rightNames
+	if right {
+		first, second = rightNames, schemaNames
+	}
+	if name, ok := first[g.String()]; ok {
+		return name, true
+	}
+	name, ok := second[g.String()]
+	return name, ok
+}
+
+// ObjectTypeName returns the name of the right, property set or attribute the ACE applies to, the GUID itself if it
+// isn't known, or "" if the ACE applies to the whole object
+func (a ACE) ObjectTypeName() string {
+	if !a.IsObjectACE() || a.ObjectType.IsZero() {
+		return ""
+	}
+	right := a.Mask&(RightControlAccess|RightSelf) != 0 && a.Mask&(RightReadProperty|RightWriteProperty) == 0
+	if name, ok := GUIDName(a.ObjectType, right); ok {
+		return name
+	}
+	return a.ObjectType.String()
+}
+
+// InheritedObjectTypeName returns the class of the objects that inherit the ACE, the GUID itself if it isn't known,
+// or "" if every object inherits it
+func (a ACE) InheritedObjectTypeName() string {
+	if !a.IsObjectACE() || a.InheritedObjectType.IsZero() {
+		return ""
+	}
+	if name, ok := GUIDName(a.InheritedObjectType, false); ok {
+		return name
+	}
+	return a.InheritedObjectType.String()
+}
+
+// rightAliases are the names of access rights for display, with the generic rights first so they're matched before
+// the rights they're made of
+var rightAliases = []struct {
+	Mask uint32
+	Name string
+}{
+	{RightGenericAll, "GenericAll"},
+	{RightGenericWrite, "GenericWrite"},
+	{RightGenericRead, "GenericRead"},
+	{RightCreateChild, "CreateChild"},
+	{RightDeleteChild, "DeleteChild"},
+	{RightListChildren, "ListChildren"},
+	{RightSelf, "Self"},
+	{RightReadProperty, "ReadProperty"},
+	{RightWriteProperty, "WriteProperty"},
+	{RightDeleteTree, "DeleteTree"},
+	{RightListObject, "ListObject"},
+	{RightControlAccess, "ControlAccess"},
+	{RightDelete, "Delete"},
+	{RightReadControl, "ReadControl"},
+	{RightWriteDACL, "WriteDACL"},
+	{RightWriteOwner, "WriteOwner"},
+}
+
+// RightNames lists the access rights in mask by name, using the generic rights where the whole set is present
+func RightNames(mask uint32) []string {
+	var names []string
+	for _, r := range rightAliases {
+		if mask&r.Mask == r.Mask {
+			names = append(names, r.Name)
+			mask &^= r.Mask
+		}
+	}
+	if mask != 0 {
+		names = append(names, fmt.Sprintf("0x%x", mask))
+	}
+	return names
+}
+
+// Describe renders the ACE for people, e.g. "Allow ControlAccess User-Force-Change-Password (inherited by user)".
+// The trustee is left out, since naming it takes a directory lookup
+func (a ACE) Describe() string {
+	var kind string
+	switch a.Type {
+	case AccessAllowedACEType, AccessAllowedObjectACEType:
+		kind = "Allow"
+	case AccessDeniedACEType, AccessDeniedObjectACEType:
+		kind = "Deny"
+	case SystemAuditACEType, SystemAuditObjectACEType:
+		kind = "Audit"
+	default:
+		return fmt.Sprintf("ACE type 0x%x", a.Type)
+	}
+	parts := []string{kind, strings.Join(RightNames(a.Mask), "|")}
+	if name := a.ObjectTypeName(); name != "" {
+		parts = append(parts, name)
+	}
+	if name := a.InheritedObjectTypeName(); name != "" {
+		parts = append(parts, fmt.Sprintf("(inherited by %s)", name))
+	}
+	return strings.Join(parts, " ")
+}
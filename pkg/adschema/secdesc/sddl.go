@@ -0,0 +1,185 @@
+package secdesc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Access rights, as used in directory service ACEs
+const (
+	RightCreateChild    uint32 = 0x00000001
+	RightDeleteChild    uint32 = 0x00000002
+	RightListChildren   uint32 = 0x00000004
+	RightSelf           uint32 = 0x00000008
+	RightReadProperty   uint32 = 0x00000010
+	RightWriteProperty  uint32 = 0x00000020
+	RightDeleteTree     uint32 = 0x00000040
+	RightListObject     uint32 = 0x00000080
+	RightControlAccess  uint32 = 0x00000100
+	RightDelete         uint32 = 0x00010000
+	RightReadControl    uint32 = 0x00020000
+	RightWriteDACL      uint32 = 0x00040000
+	RightWriteOwner     uint32 = 0x00080000
+	RightGenericAll     uint32 = 0x000f01ff
+	RightGenericWrite   uint32 = 0x00020028
+	RightGenericRead    uint32 = 0x00020094
+	RightGenericExecute uint32 = 0x00020004
+)
+
+// sddlRights are the SDDL abbreviations for access rights, in the order Windows prints them
+var sddlRights = []struct {
+	Mask  uint32
+	Alias string
+}{
+	{RightCreateChild, "CC"},
+	{RightDeleteChild, "DC"},
+	{RightListChildren, "LC"},
+	{RightSelf, "SW"},
+	{RightReadProperty, "RP"},
+	{RightWriteProperty, "WP"},
+	{RightDeleteTree, "DT"},
+	{RightListObject, "LO"},
+	{RightControlAccess, "CR"},
+	{RightDelete, "SD"},
+	{RightReadControl, "RC"},
+	{RightWriteDACL, "WD"},
+	{RightWriteOwner, "WO"},
+	{0x10000000, "GA"},
+	{0x20000000, "GX"},
+	{0x40000000, "GW"},
+	{0x80000000, "GR"},
+}
+
+var sddlACETypes = map[byte]string{
+	AccessAllowedACEType:       "A",
+	AccessDeniedACEType:        "D",
+	SystemAuditACEType:         "AU",
+	AccessAllowedObjectACEType: "OA",
+	AccessDeniedObjectACEType:  "OD",
+	SystemAuditObjectACEType:   "OU",
+}
+
+var sddlACEFlags = []struct {
+	Flag  byte
+	Alias string
+}{
+	{ObjectInheritACE, "OI"},
+	{ContainerInheritACE, "CI"},
+	{NoPropagateInheritACE, "NP"},
+	{InheritOnlyACE, "IO"},
+	{InheritedACE, "ID"},
+	{SuccessfulAccessACEFlag, "SA"},
+	{FailedAccessACEFlag, "FA"},
+}
+
+// sddlSIDs are the SDDL aliases for well-known SIDs that don't depend on the domain
+var sddlSIDs = map[string]string{
+	"S-1-1-0":      "WD",
+	"S-1-3-0":      "CO",
+	"S-1-3-1":      "CG",
+	"S-1-5-7":      "AN",
+	"S-1-5-9":      "ED",
+	"S-1-5-10":     "PS",
+	"S-1-5-11":     "AU",
+	"S-1-5-18":     "SY",
+	"S-1-5-32-544": "BA",
+	"S-1-5-32-545": "BU",
+	"S-1-5-32-548": "AO",
+	"S-1-5-32-549": "SO",
+	"S-1-5-32-550": "PO",
+	"S-1-5-32-551": "BO",
+	"S-1-5-32-554": "RU",
+}
+
+// SDDL formats the security descriptor in Security Descriptor Definition Language
+func (sd *SecurityDescriptor) SDDL() string {
+	var sb strings.Builder
+	if sd.Owner != nil {
+		sb.WriteString("O:" + sddlSID(*sd.Owner))
+	}
+	if sd.Group != nil {
+		sb.WriteString("G:" + sddlSID(*sd.Group))
+	}
+	if sd.DACL != nil {
+		sb.WriteString("D:" + sddlACLFlags(sd.Control, ControlDACLProtected, ControlDACLAutoInherit) + sd.DACL.SDDL())
+	}
+	if sd.SACL != nil {
+		sb.WriteString("S:" + sddlACLFlags(sd.Control, ControlSACLProtected, ControlSACLAutoInherit) + sd.SACL.SDDL())
+	}
+	return sb.String()
+}
+
+func sddlACLFlags(control, protected, autoInherit uint16) string {
+	var flags string
+	if control&protected != 0 {
+		flags += "P"
+	}
+	if control&autoInherit != 0 {
+		flags += "AI"
+	}
+	return flags
+}
+
+// SDDL formats the ACEs of the ACL
+func (acl *ACL) SDDL() string {
+	var sb strings.Builder
+	for _, ace := range acl.ACEs {
+		sb.WriteString(ace.SDDL())
+	}
+	return sb.String()
+}
+
+// SDDL formats the ACE as an SDDL ace string: (type;flags;rights;object guid;inherit object guid;sid)
+func (a ACE) SDDL() string {
+	var flags string
+	for _, f := range sddlACEFlags {
+		if a.Flags&f.Flag != 0 {
+			flags += f.Alias
+		}
+	}
+	if a.IsCallbackACE() {
+		// conditional ACEs add the condition as a seventh field
+		if c, err := a.Callback(); err == nil {
+			aceType := "XA"
+			if a.Type == AccessDeniedCallbackACEType {
+				aceType = "XD"
+			}
+			return fmt.Sprintf("(%s;%s;%s;;;%s;%s)", aceType, flags, sddlMask(c.Mask), sddlSID(c.SID), c.Condition)
+		}
+	}
+	aceType, ok := sddlACETypes[a.Type]
+	if !ok {
+		return fmt.Sprintf("(0x%02x;;;;;)", a.Type)
+	}
+	var objectType, inheritedObjectType string
+	if !a.ObjectType.IsZero() {
+		objectType = a.ObjectType.String()
+	}
+	if !a.InheritedObjectType.IsZero() {
+		inheritedObjectType = a.InheritedObjectType.String()
+	}
+	return fmt.Sprintf("(%s;%s;%s;%s;%s;%s)", aceType, flags, sddlMask(a.Mask), objectType, inheritedObjectType, sddlSID(a.SID))
+}
+
+// sddlMask spells out an access mask with SDDL abbreviations, falling back to hex if some bits have none
+func sddlMask(mask uint32) string {
+	var rights string
+	remaining := mask
+	for _, r := range sddlRights {
+		if mask&r.Mask == r.Mask {
+			rights += r.Alias
+			remaining &^= r.Mask
+		}
+	}
+	if remaining != 0 {
+		return fmt.Sprintf("0x%x", mask)
+	}
+	return rights
+}
+
+func sddlSID(sid SID) string {
+	if alias, ok := sddlSIDs[sid.String()]; ok {
+		return alias
+	}
+	return sid.String()
+}
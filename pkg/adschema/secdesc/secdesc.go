@@ -0,0 +1,307 @@
+// Package secdesc parses and builds Windows security descriptors (MS-DTYP 2.4.6), as stored in attributes like
+// nTSecurityDescriptor and msDS-AllowedToActOnBehalfOfOtherIdentity
+package secdesc
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Security descriptor control flags
+const (
+	ControlOwnerDefaulted  uint16 = 0x0001
+	ControlGroupDefaulted  uint16 = 0x0002
+	ControlDACLPresent     uint16 = 0x0004
+	ControlDACLDefaulted   uint16 = 0x0008
+	ControlSACLPresent     uint16 = 0x0010
+	ControlSACLDefaulted   uint16 = 0x0020
+	ControlDACLAutoInherit uint16 = 0x0400
+	ControlSACLAutoInherit uint16 = 0x0800
+	ControlDACLProtected   uint16 = 0x1000
+	ControlSACLProtected   uint16 = 0x2000
+	ControlSelfRelative    uint16 = 0x8000
+)
+
+// securityDescriptorSize is the length of the fixed security descriptor header
+const securityDescriptorSize = 20
+
+// ACE types
+const (
+	AccessAllowedACEType       byte = 0x00
+	AccessDeniedACEType        byte = 0x01
+	SystemAuditACEType         byte = 0x02
+	AccessAllowedObjectACEType byte = 0x05
+	AccessDeniedObjectACEType  byte = 0x06
+	SystemAuditObjectACEType   byte = 0x07
+)
+
+// ACE flags
+const (
+	ObjectInheritACE        byte = 0x01
+	ContainerInheritACE     byte = 0x02
+	NoPropagateInheritACE   byte = 0x04
+	InheritOnlyACE          byte = 0x08
+	InheritedACE            byte = 0x10
+	SuccessfulAccessACEFlag byte = 0x40
+	FailedAccessACEFlag     byte = 0x80
+)
+
+// Object ACE flags, saying which of the GUIDs are present
+const (
+	ObjectTypePresent          uint32 = 0x1
+	InheritedObjectTypePresent uint32 = 0x2
+)
+
+// SecurityDescriptor is a self-relative security descriptor
+type SecurityDescriptor struct {
+	Revision byte
+	Control  uint16
+	Owner    *SID
+	Group    *SID
+	SACL     *ACL
+	DACL     *ACL
+}
+
+// ACL is an access control list
+type ACL struct {
+	Revision byte
+	ACEs     []ACE
+}
+
+// ACE is an access control entry. ObjectType and InheritedObjectType are only used by object ACEs. ACE types that
+// aren't understood keep their body in Raw so they survive being re-encoded
+type ACE struct {
+	Type                byte
+	Flags               byte
+	Mask                uint32
+	ObjectType          GUID
+	InheritedObjectType GUID
+	SID                 SID
+	Raw                 []byte
+}
+
+// NewSecurityDescriptor returns an empty self-relative security descriptor with the given owner and an empty DACL
+func NewSecurityDescriptor(owner SID) *SecurityDescriptor {
+	return &SecurityDescriptor{
+		Revision: 1,
+		Control:  ControlSelfRelative | ControlDACLPresent,
+		Owner:    &owner,
+		DACL:     &ACL{Revision: 2},
+	}
+}
+
+// IsObjectACE is true for the object specific ACE types, which can carry GUIDs
+func (a ACE) IsObjectACE() bool {
+	return a.Type == AccessAllowedObjectACEType || a.Type == AccessDeniedObjectACEType || a.Type == SystemAuditObjectACEType
+}
+
+func (a ACE) known() bool {
+	switch a.Type {
+	case AccessAllowedACEType, AccessDeniedACEType, SystemAuditACEType:
+		return true
+	}
+	return a.IsObjectACE()
+}
+
+// Parse decodes a self-relative security descriptor
+func Parse(b []byte) (*SecurityDescriptor, error) {
+	if len(b) < securityDescriptorSize {
+		return nil, fmt.Errorf("security descriptor too short")
+	}
+	sd := &SecurityDescriptor{
+		Revision: b[0],
+		Control:  binary.LittleEndian.Uint16(b[2:4]),
+	}
+	offsets := []uint32{
+		binary.LittleEndian.Uint32(b[4:8]),
+		binary.LittleEndian.Uint32(b[8:12]),
+		binary.LittleEndian.Uint32(b[12:16]),
+		binary.LittleEndian.Uint32(b[16:20]),
+	}
+	for _, off := range offsets {
+		if off != 0 && int(off) >= len(b) {
+			return nil, fmt.Errorf("invalid security descriptor offset %d", off)
+		}
+	}
+	if offsets[0] != 0 {
+		sid, _, err := DecodeSID(b[offsets[0]:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid owner: %s", err)
+		}
+		sd.Owner = &sid
+	}
+	if offsets[1] != 0 {
+		sid, _, err := DecodeSID(b[offsets[1]:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid group: %s", err)
+		}
+		sd.Group = &sid
+	}
+	var err error
+	if offsets[2] != 0 {
+		if sd.SACL, err = parseACL(b[offsets[2]:]); err != nil {
+			return nil, fmt.Errorf("invalid SACL: %s", err)
+		}
+	}
+	if offsets[3] != 0 {
+		if sd.DACL, err = parseACL(b[offsets[3]:]); err != nil {
+			return nil, fmt.Errorf("invalid DACL: %s", err)
+		}
+	}
+	return sd, nil
+}
+
+func parseACL(b []byte) (*ACL, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("ACL too short")
+	}
+	size := int(binary.LittleEndian.Uint16(b[2:4]))
+	count := int(binary.LittleEndian.Uint16(b[4:6]))
+	if size > len(b) || size < 8 {
+		return nil, fmt.Errorf("invalid ACL size %d", size)
+	}
+	acl := &ACL{Revision: b[0]}
+	offset := 8
+	for i := 0; i < count; i++ {
+		if offset+4 > size {
+			return nil, fmt.Errorf("ACE %d out of bounds", i)
+		}
+		aceSize := int(binary.LittleEndian.Uint16(b[offset+2 : offset+4]))
+		if aceSize < 4 || offset+aceSize > size {
+			return nil, fmt.Errorf("invalid size for ACE %d", i)
+		}
+		ace, err := parseACE(b[offset : offset+aceSize])
+		if err != nil {
+			return nil, fmt.Errorf("ACE %d: %s", i, err)
+		}
+		acl.ACEs = append(acl.ACEs, ace)
+		offset += aceSize
+	}
+	return acl, nil
+}
+
+func parseACE(b []byte) (ACE, error) {
+	ace := ACE{Type: b[0], Flags: b[1]}
+	if !ace.known() {
+		ace.Raw = append([]byte(nil), b[4:]...)
+		return ace, nil
+	}
+	if len(b) < 8 {
+		return ace, fmt.Errorf("ACE too short")
+	}
+	ace.Mask = binary.LittleEndian.Uint32(b[4:8])
+	body := b[8:]
+	if ace.IsObjectACE() {
+		if len(body) < 4 {
+			return ace, fmt.Errorf("object ACE too short")
+		}
+		flags := binary.LittleEndian.Uint32(body[0:4])
+		body = body[4:]
+		if flags&ObjectTypePresent != 0 {
+			if len(body) < 16 {
+				return ace, fmt.Errorf("object ACE too short")
+			}
+			copy(ace.ObjectType[:], body[:16])
+			body = body[16:]
+		}
+		if flags&InheritedObjectTypePresent != 0 {
+			if len(body) < 16 {
+				return ace, fmt.Errorf("object ACE too short")
+			}
+			copy(ace.InheritedObjectType[:], body[:16])
+			body = body[16:]
+		}
+	}
+	sid, _, err := DecodeSID(body)
+	if err != nil {
+		return ace, err
+	}
+	ace.SID = sid
+	return ace, nil
+}
+
+// Bytes encodes the security descriptor in self-relative form
+func (sd *SecurityDescriptor) Bytes() []byte {
+	control := sd.Control | ControlSelfRelative
+	if sd.DACL != nil {
+		control |= ControlDACLPresent
+	}
+	if sd.SACL != nil {
+		control |= ControlSACLPresent
+	}
+	revision := sd.Revision
+	if revision == 0 {
+		revision = 1
+	}
+
+	b := make([]byte, securityDescriptorSize)
+	b[0] = revision
+	binary.LittleEndian.PutUint16(b[2:4], control)
+	put := func(field int, data []byte) {
+		binary.LittleEndian.PutUint32(b[4+4*field:], uint32(len(b)))
+		b = append(b, data...)
+	}
+	if sd.SACL != nil {
+		put(2, sd.SACL.Bytes())
+	}
+	if sd.DACL != nil {
+		put(3, sd.DACL.Bytes())
+	}
+	if sd.Owner != nil {
+		put(0, sd.Owner.Bytes())
+	}
+	if sd.Group != nil {
+		put(1, sd.Group.Bytes())
+	}
+	return b
+}
+
+// Bytes encodes the ACL. The revision is raised to ACL_REVISION_DS if it holds object ACEs
+func (acl *ACL) Bytes() []byte {
+	revision := acl.Revision
+	if revision < 2 {
+		revision = 2
+	}
+	var aces []byte
+	for _, ace := range acl.ACEs {
+		if ace.IsObjectACE() {
+			revision = 4
+		}
+		aces = append(aces, ace.Bytes()...)
+	}
+	b := make([]byte, 8, 8+len(aces))
+	b[0] = revision
+	binary.LittleEndian.PutUint16(b[2:4], uint16(8+len(aces)))
+	binary.LittleEndian.PutUint16(b[4:6], uint16(len(acl.ACEs)))
+	return append(b, aces...)
+}
+
+// Bytes encodes the ACE
+func (a ACE) Bytes() []byte {
+	b := []byte{a.Type, a.Flags, 0, 0}
+	if !a.known() {
+		b = append(b, a.Raw...)
+	} else {
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[4:8], a.Mask)
+		if a.IsObjectACE() {
+			var flags uint32
+			var guids []byte
+			if !a.ObjectType.IsZero() {
+				flags |= ObjectTypePresent
+				guids = append(guids, a.ObjectType[:]...)
+			}
+			if !a.InheritedObjectType.IsZero() {
+				flags |= InheritedObjectTypePresent
+				guids = append(guids, a.InheritedObjectType[:]...)
+			}
+			f := make([]byte, 4)
+			binary.LittleEndian.PutUint32(f, flags)
+			b = append(b, f...)
+			b = append(b, guids...)
+		}
+		b = append(b, a.SID.Bytes()...)
+	}
+	binary.LittleEndian.PutUint16(b[2:4], uint16(len(b)))
+	return b
+}
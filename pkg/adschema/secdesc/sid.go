@@ -0,0 +1,116 @@
+package secdesc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SID is a Windows security identifier
+type SID struct {
+	Revision       byte
+	Authority      uint64
+	SubAuthorities []uint32
+}
+
+// ParseSID parses a SID in its string form (S-1-5-21-...)
+func ParseSID(s string) (SID, error) {
+	parts := strings.Split(strings.ToUpper(strings.TrimSpace(s)), "-")
+	if len(parts) < 3 || parts[0] != "S" {
+		return SID{}, fmt.Errorf("invalid SID %q", s)
+	}
+	revision, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil {
+		return SID{}, fmt.Errorf("invalid SID %q", s)
+	}
+	authority, err := strconv.ParseUint(parts[2], 10, 48)
+	if err != nil {
+		return SID{}, fmt.Errorf("invalid SID %q", s)
+	}
+	sid := SID{Revision: byte(revision), Authority: authority}
+	for _, p := range parts[3:] {
+		sub, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return SID{}, fmt.Errorf("invalid SID %q", s)
+		}
+		sid.SubAuthorities = append(sid.SubAuthorities, uint32(sub))
+	}
+	if len(sid.SubAuthorities) > 15 {
+		return SID{}, fmt.Errorf("invalid SID %q: too many sub authorities", s)
+	}
+	return sid, nil
+}
+
+// MustParseSID is like ParseSID but panics on error, for well-known SIDs
+func MustParseSID(s string) SID {
+	sid, err := ParseSID(s)
+	if err != nil {
+		panic(err)
+	}
+	return sid
+}
+
+// DecodeSID reads a binary SID from the start of b, returning it and its length in bytes
+func DecodeSID(b []byte) (SID, int, error) {
+	if len(b) < 8 {
+		return SID{}, 0, fmt.Errorf("SID too short")
+	}
+	count := int(b[1])
+	length := 8 + 4*count
+	if len(b) < length {
+		return SID{}, 0, fmt.Errorf("SID too short")
+	}
+	sid := SID{Revision: b[0]}
+	for _, a := range b[2:8] {
+		sid.Authority = sid.Authority<<8 | uint64(a)
+	}
+	for i := 0; i < count; i++ {
+		sid.SubAuthorities = append(sid.SubAuthorities, binary.LittleEndian.Uint32(b[8+4*i:]))
+	}
+	return sid, length, nil
+}
+
+// Bytes encodes the SID in its binary form
+func (s SID) Bytes() []byte {
+	b := make([]byte, 8+4*len(s.SubAuthorities))
+	b[0] = s.Revision
+	b[1] = byte(len(s.SubAuthorities))
+	for i := 0; i < 6; i++ {
+		b[7-i] = byte(s.Authority >> (8 * uint(i)))
+	}
+	for i, sub := range s.SubAuthorities {
+		binary.LittleEndian.PutUint32(b[8+4*i:], sub)
+	}
+	return b
+}
+
+func (s SID) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "S-%d-%d", s.Revision, s.Authority)
+	for _, sub := range s.SubAuthorities {
+		fmt.Fprintf(&sb, "-%d", sub)
+	}
+	return sb.String()
+}
+
+// Equal is true if both SIDs are the same
+func (s SID) Equal(other SID) bool {
+	return s.String() == other.String()
+}
+
+// RID returns the last sub authority, e.g. 512 for Domain Admins
+func (s SID) RID() uint32 {
+	if len(s.SubAuthorities) == 0 {
+		return 0
+	}
+	return s.SubAuthorities[len(s.SubAuthorities)-1]
+}
+
+// DomainSID returns the domain part of a domain account's SID (S-1-5-21-x-y-z), or false if it's not a domain SID
+func (s SID) DomainSID() (SID, bool) {
+	if s.Authority != 5 || len(s.SubAuthorities) != 5 || s.SubAuthorities[0] != 21 {
+		return SID{}, false
+	}
+	return SID{Revision: s.Revision, Authority: s.Authority, SubAuthorities: s.SubAuthorities[:4]}, true
+}
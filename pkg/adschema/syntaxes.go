@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/bwmarrin/go-objectsid"
 	"github.com/ropnop/go-windapsearch/pkg/adschema/enums"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
 	"strconv"
 	"time"
 )
@@ -38,6 +39,7 @@ var SyntaxFunctions = map[string]ConvertBytes{
 	"String(Sid)":              ConvertSid,
 	"Object(Replica-Link)":     ConvertObjectReplicaLink,
 	"Enumeration":              ConvertEnumeration,
+	"String(NT-Sec-Desc)":      ConvertSecurityDescriptor,
 }
 
 func DefaultPrint(name string, b []byte) (interface{}, error) {
@@ -64,6 +66,9 @@ var NTFiletimeAttributes = map[string]bool{
 	"lastSetTime":        true,
 	"lockoutTime":        true,
 	"pwdLastSet":         true,
+	// LAPS schema extensions
+	"ms-Mcs-AdmPwdExpirationTime":   true,
+	"msLAPS-PasswordExpirationTime": true,
 }
 
 func ConvertInterval(name string, b []byte) (interface{}, error) {
@@ -112,3 +117,13 @@ func ConvertEnumeration(name string, b []byte) (interface{}, error) {
 	}
 	return val, nil
 }
+
+// ConvertSecurityDescriptor converts a security descriptor (nTSecurityDescriptor, msDS-AllowedToActOnBehalfOfOtherIdentity,
+// ...) to SDDL. One that can't be parsed is left as base64
+func ConvertSecurityDescriptor(name string, b []byte) (interface{}, error) {
+	sd, err := secdesc.Parse(b)
+	if err != nil {
+		return printable(b), nil
+	}
+	return sd.SDDL(), nil
+}
@@ -11,15 +11,16 @@ import (
 )
 
 var FunctionalityLevelsMapping = map[string]string{
-	"0": "2000",
-	"1": "2003 Interim",
-	"2": "2003",
-	"3": "2008",
-	"4": "2008 R2",
-	"5": "2012",
-	"6": "2012 R2",
-	"7": "2016",
-	"":  "Unknown",
+	"0":  "2000",
+	"1":  "2003 Interim",
+	"2":  "2003",
+	"3":  "2008",
+	"4":  "2008 R2",
+	"5":  "2012",
+	"6":  "2012 R2",
+	"7":  "2016",
+	"10": "2025",
+	"":   "Unknown",
 }
 
 var NTFileTimeRegex *regexp.Regexp
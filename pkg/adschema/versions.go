@@ -0,0 +1,108 @@
+package adschema
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// behaviorVersions names the Windows release of each msDS-Behavior-Version. Later releases that didn't add a
+// functional level (2019, 2022) run at the 2016 one
+var behaviorVersions = map[int]string{
+	0:  "Windows 2000",
+	1:  "Windows Server 2003 interim",
+	2:  "Windows Server 2003",
+	3:  "Windows Server 2008",
+	4:  "Windows Server 2008 R2",
+	5:  "Windows Server 2012",
+	6:  "Windows Server 2012 R2",
+	7:  "Windows Server 2016",
+	10: "Windows Server 2025",
+}
+
+// schemaVersions names the Windows release that brought each objectVersion of the schema
+var schemaVersions = map[int]string{
+	13: "Windows 2000",
+	30: "Windows Server 2003",
+	31: "Windows Server 2003 R2",
+	44: "Windows Server 2008",
+	47: "Windows Server 2008 R2",
+	56: "Windows Server 2012",
+	69: "Windows Server 2012 R2",
+	87: "Windows Server 2016",
+	88: "Windows Server 2019/2022",
+	91: "Windows Server 2025",
+}
+
+// exchangeSchemaVersions names the Exchange releases that set each rangeUpper of ms-Exch-Schema-Version-Pt. Most
+// cumulative updates don't change the schema, so a version covers a range of them
+var exchangeSchemaVersions = map[int]string{
+	4397:  "Exchange 2000 RTM",
+	4406:  "Exchange 2000 SP3",
+	6870:  "Exchange 2003 RTM",
+	6936:  "Exchange 2003 SP3",
+	10637: "Exchange 2007 RTM",
+	11116: "Exchange 2007 SP1",
+	14622: "Exchange 2007 SP2 or Exchange 2010 RTM",
+	14625: "Exchange 2007 SP3",
+	14726: "Exchange 2010 SP1",
+	14732: "Exchange 2010 SP2",
+	14734: "Exchange 2010 SP3",
+	15137: "Exchange 2013 RTM",
+	15254: "Exchange 2013 CU1",
+	15281: "Exchange 2013 CU2",
+	15283: "Exchange 2013 CU3",
+	15292: "Exchange 2013 SP1",
+	15300: "Exchange 2013 CU5",
+	15303: "Exchange 2013 CU6",
+	15312: "Exchange 2013 CU7-CU23",
+	15317: "Exchange 2016 RTM",
+	15323: "Exchange 2016 CU1",
+	15325: "Exchange 2016 CU2",
+	15326: "Exchange 2016 CU3-CU5",
+	15330: "Exchange 2016 CU6",
+	15332: "Exchange 2016 CU7-CU18",
+	15333: "Exchange 2016 CU19-CU20",
+	15334: "Exchange 2016 CU21-CU23",
+	17000: "Exchange 2019 RTM-CU1",
+	17001: "Exchange 2019 CU2-CU7",
+	17002: "Exchange 2019 CU8-CU9",
+	17003: "Exchange 2019 CU10-CU15",
+}
+
+// BehaviorVersionName names a msDS-Behavior-Version (or domainFunctionality, forestFunctionality) as a functional
+// level of the kind given, e.g. "Windows Server 2016 forest level"
+func BehaviorVersionName(v string, kind string) string {
+	return versionName(behaviorVersions, v, " "+kind+" level")
+}
+
+// SchemaVersionName names the objectVersion of the schema, e.g. "87 (Windows Server 2016 schema)"
+func SchemaVersionName(v string) string {
+	return v + " (" + versionName(schemaVersions, v, " schema") + ")"
+}
+
+// ExchangeSchemaVersionName names the rangeUpper of ms-Exch-Schema-Version-Pt, e.g. "17003 (Exchange 2019 CU10-CU15
+// schema)"
+func ExchangeSchemaVersionName(v string) string {
+	return v + " (" + versionName(exchangeSchemaVersions, v, " schema") + ")"
+}
+
+func versionName(names map[int]string, v, suffix string) string {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Sprintf("unknown version %q", v)
+	}
+	if name, ok := names[n]; ok {
+		return name + suffix
+	}
+	// a version that isn't known is most likely from a later release or update than the known one before it
+	newest := -1
+	for known := range names {
+		if known < n && known > newest {
+			newest = known
+		}
+	}
+	if newest >= 0 {
+		return fmt.Sprintf("newer than %s%s", names[newest], suffix)
+	}
+	return fmt.Sprintf("unknown version %d", n)
+}
@@ -0,0 +1,138 @@
+// Package cldap implements the connectionless LDAP (LDAP over UDP) "LDAP ping" used by Windows clients to locate and
+// validate domain controllers. See MS-ADTS 6.3.3
+package cldap
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/dns"
+)
+
+// DefaultTimeout is how long to wait for a DC to answer a ping
+const DefaultTimeout = 2 * time.Second
+
+// ntVersion asks for a NETLOGON_SAM_LOGON_RESPONSE_EX (NETLOGON_NT_VERSION_5 | NETLOGON_NT_VERSION_5EX)
+const ntVersion = `\06\00\00\00`
+
+// Account type bits for the AAC (allowable account control) field of a user ping. The DC only reports a user as
+// existing if its account type is one of the ones asked for
+const (
+	AccountNormal      uint32 = 0x00000010
+	AccountWorkstation uint32 = 0x00000080
+	AccountServer      uint32 = 0x00000100
+)
+
+// Ping sends an LDAP ping for a domain to a DC (host or host:port, default port 389) and returns its Netlogon response.
+// A hostname is looked up with resolver, or the system resolver if it's nil
+func Ping(resolver *dns.Resolver, address, domain string, timeout time.Duration) (*NetlogonResponse, error) {
+	return ping(resolver, address, fmt.Sprintf("(&(DnsDomain=%s)(NtVer=%s))", ldap.EscapeFilter(domain), ntVersion), timeout)
+}
+
+// PingUser sends an LDAP ping that also asks about an account. The response opcode is LogonSAMLogonResponseEx if the
+// account exists (with one of the aac account types) and LogonSAMUserUnknownEx if it doesn't. No credentials are
+// involved, so this doesn't touch the account's bad password count
+func PingUser(resolver *dns.Resolver, address, domain, user string, aac uint32, timeout time.Duration) (*NetlogonResponse, error) {
+	filter := fmt.Sprintf("(&(DnsDomain=%s)(User=%s)(AAC=%s)(NtVer=%s))", ldap.EscapeFilter(domain), ldap.EscapeFilter(user), escapeUint32(aac), ntVersion)
+	return ping(resolver, address, filter, timeout)
+}
+
+// escapeUint32 encodes a little endian DWORD as an escaped filter value, like ntVersion
+func escapeUint32(v uint32) string {
+	return fmt.Sprintf(`\%02x\%02x\%02x\%02x`, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// ping sends a CLDAP search with a Netlogon filter and decodes the response
+func ping(resolver *dns.Resolver, address, filter string, timeout time.Duration) (*NetlogonResponse, error) {
+	packet, err := searchPacket(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), strconv.Itoa(389))
+	}
+	if resolver == nil {
+		resolver = dns.DefaultResolver
+	}
+	conn, err := resolver.Dialer(timeout).Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err = conn.Write(packet.Bytes()); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	value, err := netlogonValue(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	return ParseNetlogonResponse(value)
+}
+
+// searchPacket builds a base search of the rootDSE for the Netlogon attribute
+func searchPacket(filter string) (*ber.Packet, error) {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "MessageID"))
+
+	pkt := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchRequest, nil, "Search Request")
+	pkt.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Base DN"))
+	pkt.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(ldap.ScopeBaseObject), "Scope"))
+	pkt.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(ldap.NeverDerefAliases), "Deref Aliases"))
+	pkt.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Size Limit"))
+	pkt.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Time Limit"))
+	pkt.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "Types Only"))
+	filterPacket, err := ldap.CompileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	pkt.AppendChild(filterPacket)
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	attributes.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "Netlogon", "Attribute"))
+	pkt.AppendChild(attributes)
+
+	envelope.AppendChild(pkt)
+	return envelope, nil
+}
+
+// netlogonValue pulls the Netlogon attribute value out of the search result entry in a CLDAP response
+func netlogonValue(b []byte) ([]byte, error) {
+	packet, err := ber.DecodePacketErr(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CLDAP response: %s", err)
+	}
+	if len(packet.Children) < 2 {
+		return nil, fmt.Errorf("invalid CLDAP response")
+	}
+	op := packet.Children[1]
+	if op.Tag != ldap.ApplicationSearchResultEntry {
+		return nil, fmt.Errorf("DC did not return a Netlogon response")
+	}
+	if len(op.Children) < 2 {
+		return nil, fmt.Errorf("invalid CLDAP search result entry")
+	}
+	for _, attr := range op.Children[1].Children {
+		if len(attr.Children) < 2 {
+			continue
+		}
+		if name, ok := attr.Children[0].Value.(string); !ok || !strings.EqualFold(name, "Netlogon") {
+			continue
+		}
+		if len(attr.Children[1].Children) > 0 {
+			return attr.Children[1].Children[0].ByteValue, nil
+		}
+	}
+	return nil, fmt.Errorf("no Netlogon attribute in CLDAP response")
+}
@@ -0,0 +1,145 @@
+package cldap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Netlogon response opcodes
+const (
+	LogonSAMLogonResponseEx = 23
+	LogonSAMPauseResponseEx = 24
+	LogonSAMUserUnknownEx   = 25
+)
+
+// DS_FLAG values describing what the DC is capable of (MS-ADTS 6.3.1.2)
+var DSFlags = map[uint32]string{
+	0x00000001: "PDC",
+	0x00000004: "GC",
+	0x00000008: "LDAP",
+	0x00000010: "DS",
+	0x00000020: "KDC",
+	0x00000040: "TIMESERV",
+	0x00000080: "CLOSEST",
+	0x00000100: "WRITABLE",
+	0x00000200: "GOOD_TIMESERV",
+	0x00000400: "NDNC",
+	0x00000800: "SELECT_SECRET_DOMAIN_6",
+	0x00001000: "FULL_SECRET_DOMAIN_6",
+	0x00002000: "WS",
+	0x00004000: "DS_8",
+	0x00008000: "DS_9",
+	0x00010000: "DS_10",
+	0x20000000: "DNS_CONTROLLER",
+	0x40000000: "DNS_DOMAIN",
+	0x80000000: "DNS_FOREST",
+}
+
+// NetlogonResponse is a decoded NETLOGON_SAM_LOGON_RESPONSE_EX (MS-ADTS 6.3.1.9)
+type NetlogonResponse struct {
+	Opcode              uint16
+	Flags               uint32
+	DomainGUID          [16]byte
+	DNSForestName       string
+	DNSDomainName       string
+	DNSHostName         string
+	NetBIOSDomainName   string
+	NetBIOSComputerName string
+	UserName            string
+	DCSiteName          string
+	ClientSiteName      string
+}
+
+// FlagNames returns the names of the DS_FLAG bits set in the response
+func (r *NetlogonResponse) FlagNames() []string {
+	var names []string
+	for bit := uint32(1); bit != 0; bit <<= 1 {
+		if r.Flags&bit != 0 {
+			if name, ok := DSFlags[bit]; ok {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// UserExists is true if the DC recognised the account asked about in a user ping
+func (r *NetlogonResponse) UserExists() bool {
+	return r.Opcode == LogonSAMLogonResponseEx
+}
+
+// ServesDomain is true if the DC answered for the DNS or NetBIOS domain name given
+func (r *NetlogonResponse) ServesDomain(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	return strings.EqualFold(r.DNSDomainName, domain) || strings.EqualFold(r.NetBIOSDomainName, domain)
+}
+
+// ParseNetlogonResponse decodes a Netlogon attribute value
+func ParseNetlogonResponse(b []byte) (*NetlogonResponse, error) {
+	if len(b) < 24 {
+		return nil, fmt.Errorf("netlogon response too short")
+	}
+	r := &NetlogonResponse{
+		Opcode: binary.LittleEndian.Uint16(b[0:2]),
+		Flags:  binary.LittleEndian.Uint32(b[4:8]),
+	}
+	if r.Opcode != LogonSAMLogonResponseEx && r.Opcode != LogonSAMUserUnknownEx && r.Opcode != LogonSAMPauseResponseEx {
+		return nil, fmt.Errorf("unexpected netlogon response opcode %d", r.Opcode)
+	}
+	copy(r.DomainGUID[:], b[8:24])
+
+	offset := 24
+	for _, field := range []*string{
+		&r.DNSForestName,
+		&r.DNSDomainName,
+		&r.DNSHostName,
+		&r.NetBIOSDomainName,
+		&r.NetBIOSComputerName,
+		&r.UserName,
+		&r.DCSiteName,
+		&r.ClientSiteName,
+	} {
+		name, next, err := readName(b, offset)
+		if err != nil {
+			return nil, err
+		}
+		*field = name
+		offset = next
+	}
+	return r, nil
+}
+
+// readName reads an RFC 1035 compressed name starting at offset, and returns it along with the offset just past it.
+// Compression pointers are relative to the start of the response
+func readName(b []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; jumps++ {
+		if offset >= len(b) || jumps > 64 {
+			return "", 0, fmt.Errorf("invalid name in netlogon response")
+		}
+		length := int(b[offset])
+		switch {
+		case length == 0:
+			if next == -1 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(b) {
+				return "", 0, fmt.Errorf("invalid name pointer in netlogon response")
+			}
+			if next == -1 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(b[offset:offset+2]) & 0x3fff)
+		default:
+			if offset+1+length > len(b) {
+				return "", 0, fmt.Errorf("invalid label in netlogon response")
+			}
+			labels = append(labels, string(b[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
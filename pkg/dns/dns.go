@@ -1,31 +1,223 @@
 package dns
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
 )
 
+// DefaultTimeout is how long to wait for a nameserver when using a custom resolver
+const DefaultTimeout = 5 * time.Second
+
+// Resolver performs the DNS lookups used to find domain controllers. The zero value uses the system resolver
+type Resolver struct {
+	// Server is a nameserver (ip or ip:port) to query instead of the system configured ones
+	Server string
+	// TCP sends queries over TCP instead of UDP
+	TCP bool
+	// Proxy is a SOCKS5 proxy (host:port) to send queries through. SOCKS can only carry TCP, so this implies TCP
+	Proxy string
+}
+
+// DefaultResolver uses the system resolver
+var DefaultResolver = &Resolver{}
+
+// Custom is true when the resolver doesn't just use the system resolver
+func (r *Resolver) Custom() bool {
+	return r != nil && (r.Server != "" || r.TCP || r.Proxy != "")
+}
+
+// ServerAddress returns the nameserver with the default port added if needed
+func (r *Resolver) ServerAddress() string {
+	if r.Server == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(r.Server); err == nil {
+		return r.Server
+	}
+	return net.JoinHostPort(strings.Trim(r.Server, "[]"), "53")
+}
+
+func (r *Resolver) resolver() *net.Resolver {
+	if !r.Custom() {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if r.Server != "" {
+				address = r.ServerAddress()
+			}
+			d := &net.Dialer{Timeout: DefaultTimeout}
+			if r.Proxy != "" {
+				pDialer, err := proxy.SOCKS5("tcp", r.Proxy, nil, d)
+				if err != nil {
+					return nil, err
+				}
+				return pDialer.Dial("tcp", address)
+			}
+			if r.TCP {
+				// the Go resolver speaks TCP framing to any conn that isn't a net.PacketConn
+				network = "tcp"
+			}
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+func (r *Resolver) describe() string {
+	if !r.Custom() {
+		return "the system resolver"
+	}
+	proto := "udp"
+	if r.TCP {
+		proto = "tcp"
+	}
+	if r.Proxy != "" {
+		proto = "tcp via socks proxy " + r.Proxy
+	}
+	if r.Server == "" {
+		return fmt.Sprintf("the system nameservers (%s)", proto)
+	}
+	return fmt.Sprintf("%s (%s)", r.ServerAddress(), proto)
+}
+
+// Dialer returns a dialer that looks hostnames up with the resolver
+func (r *Resolver) Dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, Resolver: r.resolver()}
+}
+
+// LookupHost resolves a hostname to its addresses
+func (r *Resolver) LookupHost(host string) ([]string, error) {
+	return r.resolver().LookupHost(context.Background(), host)
+}
+
+// SelectAddresses resolves servers (hostnames or IPs) to the addresses of one IP version, "4" or "6", keeping the
+// order they were given in (i.e. SRV priority). Any other version returns the servers unchanged
+func (r *Resolver) SelectAddresses(servers []string, version string) ([]string, error) {
+	if version != "4" && version != "6" {
+		return servers, nil
+	}
+	var selected []string
+	seen := make(map[string]bool)
+	for _, server := range servers {
+		addrs := []string{server}
+		if net.ParseIP(server) == nil {
+			var err error
+			if addrs, err = r.LookupHost(server); err != nil {
+				continue
+			}
+		}
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil || seen[addr] || (ip.To4() != nil) != (version == "4") {
+				continue
+			}
+			seen[addr] = true
+			selected = append(selected, addr)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("none of the LDAP servers found have an IPv%s address", version)
+	}
+	return selected, nil
+}
+
 // FindLDAPServers attempts to find LDAP servers in a domain via DNS. First it attempts looking up LDAP via SRV records,
 // if that fails, it will just resolve the domain to an IP and return that.
 func FindLDAPServers(domain string) (servers []string, err error) {
-	_, srvs, err := net.LookupSRV("ldap", "tcp", domain)
-	if err != nil {
-		if strings.Contains(err.Error(), "No records found") {
-			return net.LookupHost(domain)
-		}
-	}
+	return DefaultResolver.FindLDAPServers(domain)
+}
+
+// FindLDAPServers attempts to find LDAP servers in a domain via DNS. First it attempts looking up LDAP via SRV records,
+// if that fails, it will just resolve the domain to an IP and return that. SRV targets come first, ordered by
+// priority and randomized by weight as RFC 2782 says to pick them, so they're in the order to try them in
+func (r *Resolver) FindLDAPServers(domain string) (servers []string, err error) {
+	res := r.resolver()
+	_, srvs, srvErr := res.LookupSRV(context.Background(), "ldap", "tcp", domain)
 
 	for _, s := range srvs {
-		servers = append(servers, s.Target)
+		servers = append(servers, strings.TrimSuffix(s.Target, "."))
 	}
 	// also resolve the domain itself and return that IP
-	domain_ips, _ := net.LookupHost(domain)
-	servers = append(servers, domain_ips...)
+	domainIPs, hostErr := res.LookupHost(context.Background(), domain)
+	servers = append(servers, domainIPs...)
 
 	if len(servers) == 0 {
-		err = fmt.Errorf("no LDAP servers found for domain: %s", domain)
+		lookupErr := srvErr
+		if lookupErr == nil {
+			lookupErr = hostErr
+		}
+		err = fmt.Errorf("no LDAP servers found for domain %s using %s (%v). Try specifying a nameserver with --dns-server or the DC with --dc", domain, r.describe(), lookupErr)
 		return
 	}
 	return servers, nil
 }
+
+// ServiceRecord is a single SRV record found for a domain service
+type ServiceRecord struct {
+	Name     string
+	Target   string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+}
+
+// DomainServiceNames returns the SRV record names a DC registers for a domain. forest is the forest root domain (used
+// for the global catalog records) and sites are optional AD site names to look up site specific records for
+func DomainServiceNames(domain, forest string, sites []string) []string {
+	if forest == "" {
+		forest = domain
+	}
+	names := []string{
+		"_ldap._tcp." + domain,
+		"_gc._tcp." + forest,
+		"_kerberos._tcp." + domain,
+		"_kerberos._udp." + domain,
+		"_kpasswd._tcp." + domain,
+		"_kpasswd._udp." + domain,
+		"_ldap._tcp.dc._msdcs." + domain,
+		"_ldap._tcp.pdc._msdcs." + domain,
+		"_ldap._tcp.gc._msdcs." + forest,
+		"_kerberos._tcp.dc._msdcs." + domain,
+	}
+	for _, site := range sites {
+		names = append(names,
+			fmt.Sprintf("_ldap._tcp.%s._sites.%s", site, domain),
+			fmt.Sprintf("_kerberos._tcp.%s._sites.%s", site, domain),
+			fmt.Sprintf("_gc._tcp.%s._sites.%s", site, forest),
+			fmt.Sprintf("_ldap._tcp.%s._sites.dc._msdcs.%s", site, domain),
+			fmt.Sprintf("_kerberos._tcp.%s._sites.dc._msdcs.%s", site, domain),
+		)
+	}
+	return names
+}
+
+// FindServiceRecords resolves every SRV record name given. Names that don't resolve are skipped, so it only returns an
+// error if nothing at all was found
+func (r *Resolver) FindServiceRecords(names []string) (records []ServiceRecord, err error) {
+	res := r.resolver()
+	for _, name := range names {
+		_, srvs, lookupErr := res.LookupSRV(context.Background(), "", "", name)
+		if lookupErr != nil {
+			continue
+		}
+		for _, s := range srvs {
+			records = append(records, ServiceRecord{
+				Name:     name,
+				Target:   strings.TrimSuffix(s.Target, "."),
+				Port:     s.Port,
+				Priority: s.Priority,
+				Weight:   s.Weight,
+			})
+		}
+	}
+	if len(records) == 0 {
+		err = fmt.Errorf("no SRV records found using %s", r.describe())
+	}
+	return
+}
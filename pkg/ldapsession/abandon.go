@@ -0,0 +1,73 @@
+package ldapsession
+
+import (
+	"math"
+	"net"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// trackedSearches is how many of the latest searches a connection keeps the message IDs of
+const trackedSearches = 64
+
+// abandonMessageID is the message ID Abandon requests are sent with. An Abandon gets no response, so it only has to
+// stay clear of the IDs go-ldap hands out, which count up from 1
+const abandonMessageID = math.MaxInt32
+
+// wireConn is the network connection under an LDAP connection, which notes the message IDs of the searches sent on
+// it. go-ldap (v3.4.8) has no Abandon operation and keeps its message IDs to itself, so this is how a cancelled
+// search can be abandoned: the IDs are read off the wire, and the Abandon written to it directly. go-ldap writes
+// every request with a single Write, so it can be decoded as it goes out
+type wireConn struct {
+	net.Conn
+
+	mu sync.Mutex
+	// searches is a ring of the latest search message IDs, the last at searches[(sent-1)%trackedSearches]
+	searches [trackedSearches]int64
+	sent     int
+}
+
+func (c *wireConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if p, err := ber.DecodePacketErr(b); err == nil && len(p.Children) >= 2 && p.Children[1].Tag == ldap.ApplicationSearchRequest {
+		if id, ok := p.Children[0].Value.(int64); ok {
+			c.searches[c.sent%trackedSearches] = id
+			c.sent++
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// mark is how many searches have been sent so far, to abandon the ones sent after it
+func (c *wireConn) mark() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sent
+}
+
+// abandonSince sends an Abandon for every search sent since mark, as far as they're still tracked, so the DC stops
+// working on them. Searches that have already finished are ignored by the DC
+func (c *wireConn) abandonSince(mark int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sent-mark > trackedSearches {
+		mark = c.sent - trackedSearches
+	}
+	for i := mark; i < c.sent; i++ {
+		packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+		packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(abandonMessageID), "MessageID"))
+		packet.AppendChild(ber.NewInteger(ber.ClassApplication, ber.TypePrimitive, ldap.ApplicationAbandonRequest, c.searches[i%trackedSearches], "Abandon Request"))
+		if _, err := c.Conn.Write(packet.Bytes()); err != nil {
+			return
+		}
+	}
+}
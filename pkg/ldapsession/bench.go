@@ -0,0 +1,78 @@
+package ldapsession
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// PageTiming is how long a run of paged search requests took
+type PageTiming struct {
+	PageSize uint32
+	Pages    int
+	Entries  int
+	Elapsed  time.Duration
+}
+
+// PagesPerSecond is the rate pages were returned at
+func (p PageTiming) PagesPerSecond() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Pages) / p.Elapsed.Seconds()
+}
+
+// EntriesPerSecond is the rate entries were returned at
+func (p PageTiming) EntriesPerSecond() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Entries) / p.Elapsed.Seconds()
+}
+
+// TimeSearch runs a search and returns how long it took and how many entries came back. The search goes straight
+// to the DC, skipping the lookup cache, so the time is the DC's and the link's
+func (w *LDAPSession) TimeSearch(sr *ldap.SearchRequest) (time.Duration, int, error) {
+	start := time.Now()
+	res, err := w.conn().Search(sr)
+	elapsed := time.Since(start)
+	if err != nil {
+		return elapsed, 0, err
+	}
+	return elapsed, len(res.Entries), nil
+}
+
+// TimePages times up to maxPages pages of a subtree search of the default naming context with the given page size,
+// abandoning the rest of the search. Like TimeSearch, it skips the lookup cache
+func (w *LDAPSession) TimePages(filter string, attrs []string, pageSize uint32, maxPages int) (PageTiming, error) {
+	timing := PageTiming{PageSize: pageSize}
+	paging := ldap.NewControlPaging(pageSize)
+	sr := ldap.NewSearchRequest(w.NamingContexts.Default, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter, attrs, []ldap.Control{paging})
+
+	start := time.Now()
+	for timing.Pages < maxPages {
+		res, err := w.conn().Search(sr)
+		if err != nil {
+			return timing, err
+		}
+		if res == nil {
+			return timing, ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: packet not received"))
+		}
+		timing.Pages++
+		timing.Entries += len(res.Entries)
+		control, ok := ldap.FindControl(res.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+		if !ok || len(control.Cookie) == 0 {
+			timing.Elapsed = time.Since(start)
+			return timing, nil
+		}
+		paging.SetCookie(control.Cookie)
+	}
+	timing.Elapsed = time.Since(start)
+
+	// a page size of 0 tells the DC to drop the rest of the results
+	paging.PagingSize = 0
+	w.conn().Search(sr)
+	return timing, nil
+}
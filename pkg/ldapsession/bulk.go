@@ -0,0 +1,97 @@
+package ldapsession
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// DefaultMaxFilterLength is the longest OR filter BulkSearch sends in one request. AD's own limits (MaxReceiveBuffer,
+// MaxQueryDuration) are well above this, but long filters are slow to evaluate and some DCs and proxies refuse them
+// well before the limits are reached
+const DefaultMaxFilterLength = 16 * 1024
+
+// BulkSearch finds every object whose attr equals one of values (e.g. many sAMAccountNames or objectSids from an
+// input file). The values are ORed together in as many requests as it takes to keep each filter under
+// DefaultMaxFilterLength, and a request the server refuses as too large or complex is split in half and retried.
+// filter, if set, is ANDed with every request. The whole subtree under baseDN is searched, and the merged results
+// have one entry per DN
+func (w *LDAPSession) BulkSearch(baseDN, attr string, values []string, filter string, attrs []string) (*ldap.SearchResult, error) {
+	result := &ldap.SearchResult{}
+	seen := make(map[string]bool)
+	for _, chunk := range chunkValues(attr, values, DefaultMaxFilterLength) {
+		if err := w.bulkSearchChunk(baseDN, attr, chunk, filter, attrs, result, seen); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// bulkSearchChunk runs the search for one chunk of values, splitting it if the server refuses it
+func (w *LDAPSession) bulkSearchChunk(baseDN, attr string, values []string, filter string, attrs []string, result *ldap.SearchResult, seen map[string]bool) error {
+	sr := w.MakeSimpleSearchRequest(orFilter(attr, values, filter), attrs)
+	sr.BaseDN = baseDN
+	res, err := w.GetPagedSearchResults(sr)
+	if err != nil {
+		if filterTooLarge(err) && len(values) > 1 {
+			w.Log.Infof("server refused a filter with %d values, splitting it: %s", len(values), err)
+			half := len(values) / 2
+			if err = w.bulkSearchChunk(baseDN, attr, values[:half], filter, attrs, result, seen); err != nil {
+				return err
+			}
+			return w.bulkSearchChunk(baseDN, attr, values[half:], filter, attrs, result, seen)
+		}
+		return err
+	}
+	for _, entry := range res.Entries {
+		if key := strings.ToLower(entry.DN); !seen[key] {
+			seen[key] = true
+			result.Entries = append(result.Entries, entry)
+		}
+	}
+	result.Referrals = append(result.Referrals, res.Referrals...)
+	return nil
+}
+
+// chunkValues groups values so each group's OR filter stays under max characters. A single value longer than max
+// still gets a group of its own
+func chunkValues(attr string, values []string, max int) [][]string {
+	var chunks [][]string
+	var chunk []string
+	length := len("(|)")
+	for _, v := range values {
+		term := len(attr) + len(ldap.EscapeFilter(v)) + len("(=)")
+		if len(chunk) > 0 && length+term > max {
+			chunks = append(chunks, chunk)
+			chunk, length = nil, len("(|)")
+		}
+		chunk = append(chunk, v)
+		length += term
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// orFilter builds (|(attr=v1)(attr=v2)...), ANDed with filter if it's set
+func orFilter(attr string, values []string, filter string) string {
+	var sb strings.Builder
+	sb.WriteString("(|")
+	for _, v := range values {
+		sb.WriteString(fmt.Sprintf("(%s=%s)", attr, ldap.EscapeFilter(v)))
+	}
+	sb.WriteString(")")
+	if filter == "" {
+		return sb.String()
+	}
+	return fmt.Sprintf("(&%s%s)", filter, sb.String())
+}
+
+// filterTooLarge is true for the errors AD returns when a filter is too long or too expensive to evaluate
+func filterTooLarge(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.LDAPResultAdminLimitExceeded) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultTimeLimitExceeded)
+}
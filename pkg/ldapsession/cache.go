@@ -0,0 +1,205 @@
+package ldapsession
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// DefaultCacheTTL is how long cached search results are used for
+const DefaultCacheTTL = 15 * time.Minute
+
+// Cache stores the results of synchronous searches (GetSearchResults and GetPagedSearchResults) on disk, so lookups
+// repeated across modules and runs don't go back to the DC. Results are keyed by the server, bound identity, base,
+// scope, filter, attributes and controls of the search, and are used until they are TTL old. Streamed module searches
+// (ExecuteSearchRequest) are never cached, and neither are searches that ask for a ConfidentialAttribute (or for every
+// attribute) or return one: a cached copy without the secrets would look like they can't be read
+type Cache struct {
+	Dir string
+	TTL time.Duration
+}
+
+// cachedResult is the on-disk form of a search result
+type cachedResult struct {
+	Time      time.Time     `json:"time"`
+	Entries   []cachedEntry `json:"entries"`
+	Referrals []string      `json:"referrals,omitempty"`
+}
+
+type cachedEntry struct {
+	DN         string            `json:"dn"`
+	Attributes []cachedAttribute `json:"attributes"`
+}
+
+type cachedAttribute struct {
+	Name   string   `json:"name"`
+	Values [][]byte `json:"values"`
+}
+
+// DefaultCacheDir returns the windapsearch directory in the user's cache directory (e.g. ~/.cache/windapsearch)
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "windapsearch"), nil
+}
+
+// NewCache creates the cache directory if needed, and removes the results in it that have expired. Cached results can
+// include anything the bound user can read, so the directory and files are only accessible to the current user
+func NewCache(dir string, ttl time.Duration) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create cache directory: %s", err)
+	}
+	c := &Cache{Dir: dir, TTL: ttl}
+	c.sweep()
+	return c, nil
+}
+
+// sweep removes the cached results that are older than the TTL, going by when they were written
+func (c *Cache) sweep() {
+	files, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") && time.Since(f.ModTime()) > c.TTL {
+			os.Remove(filepath.Join(c.Dir, f.Name()))
+		}
+	}
+}
+
+// key identifies a search by everything that can change its results
+func (c *Cache) key(w *LDAPSession, sr *ldap.SearchRequest) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s:%d\x00%s\x00%s\x00%d\x00%d\x00%s\x00%s", w.server, w.port, w.boundIdentity(),
+		strings.ToLower(sr.BaseDN), sr.Scope, sr.SizeLimit, sr.Filter, strings.Join(sr.Attributes, ","))
+	for _, control := range sr.Controls {
+		fmt.Fprintf(h, "\x00%s", control.String())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// boundIdentity names who the session is bound as, for keying the cache. Binds with a ccache, keytab, certificate
+// or the logged on user may have no username, so they're told apart by the ccache's principal or the file used
+func (w *LDAPSession) boundIdentity() string {
+	w.identityOnce.Do(func() {
+		o := w.options
+		parts := []string{strings.ToLower(o.Username)}
+		switch {
+		case o.CCachePath != "":
+			principal, _ := CCacheTGT(o.CCachePath)
+			parts = append(parts, "ccache", strings.ToLower(principal), o.CCachePath)
+		case o.Keytab != "":
+			parts = append(parts, "keytab", o.Keytab)
+		case o.ClientCert != "":
+			parts = append(parts, "cert", o.ClientCert)
+		case o.CurrentUser:
+			parts = append(parts, "sspi")
+			if u, err := user.Current(); err == nil {
+				parts = append(parts, strings.ToLower(u.Username))
+			}
+		}
+		w.identity = strings.Join(parts, "\x00")
+	})
+	return w.identity
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+// get returns a cached result if there is one that hasn't expired
+func (c *Cache) get(key string) (*ldap.SearchResult, bool) {
+	b, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var cached cachedResult
+	if err = json.Unmarshal(b, &cached); err != nil || time.Since(cached.Time) > c.TTL {
+		os.Remove(c.path(key))
+		return nil, false
+	}
+	result := &ldap.SearchResult{Referrals: cached.Referrals}
+	for _, e := range cached.Entries {
+		entry := &ldap.Entry{DN: e.DN}
+		for _, a := range e.Attributes {
+			attr := &ldap.EntryAttribute{Name: a.Name, ByteValues: a.Values}
+			for _, v := range a.Values {
+				attr.Values = append(attr.Values, string(v))
+			}
+			entry.Attributes = append(entry.Attributes, attr)
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+	return result, true
+}
+
+// put saves a result. Failing to save only means the next lookup goes to the DC, so errors are returned for
+// logging rather than failing the search
+func (c *Cache) put(key string, result *ldap.SearchResult) error {
+	cached := cachedResult{Time: time.Now(), Referrals: result.Referrals}
+	for _, entry := range result.Entries {
+		e := cachedEntry{DN: entry.DN}
+		for _, attr := range entry.Attributes {
+			e.Attributes = append(e.Attributes, cachedAttribute{Name: attr.Name, Values: attr.ByteValues})
+		}
+		cached.Entries = append(cached.Entries, e)
+	}
+	b, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path(key), b, 0600)
+}
+
+// cachedSearch runs search, or returns its cached result
+func (w *LDAPSession) cachedSearch(sr *ldap.SearchRequest, search func() (*ldap.SearchResult, error)) (*ldap.SearchResult, error) {
+	c := w.options.Cache
+	if c == nil || !cacheable(sr.Attributes) {
+		return search()
+	}
+	key := c.key(w, sr)
+	if result, ok := c.get(key); ok {
+		w.Log.Debugf("using cached results for %q", sr.Filter)
+		return result, nil
+	}
+	result, err := search()
+	if err != nil {
+		return result, err
+	}
+	for _, entry := range result.Entries {
+		for _, attr := range entry.Attributes {
+			if IsConfidentialAttribute(attr.Name) {
+				return result, nil
+			}
+		}
+	}
+	if err = c.put(key, result); err != nil {
+		w.Log.Debugf("unable to cache search results: %s", err)
+	}
+	return result, nil
+}
+
+// cacheable reports whether a search for attrs can be cached: not if it asks for a confidential attribute, or for
+// every attribute (none named, or *), which would include any the bind can read
+func cacheable(attrs []string) bool {
+	if len(attrs) == 0 {
+		return false
+	}
+	for _, a := range attrs {
+		if a == "*" || IsConfidentialAttribute(a) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package ldapsession
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// countingSession is a session with a cache, whose server returns a computer with a LAPS password to every search,
+// with the attributes asked for, and counts them
+func countingSession(t *testing.T) (w *LDAPSession, searches func() int) {
+	t.Helper()
+	cache, err := NewCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	count := 0
+	client, server := net.Pipe()
+	serveFake(server, func(id int64, req *ber.Packet) ([]*ber.Packet, bool) {
+		op := req.Children[1].Tag
+		if op != ldap.ApplicationSearchRequest {
+			return []*ber.Packet{response(id, resultDone(op+1))}, false
+		}
+		mu.Lock()
+		count++
+		mu.Unlock()
+		computer := fakeEntry{dn: "CN=WS01,CN=Computers,DC=lab,DC=local"}
+		for _, a := range req.Children[1].Children[7].Children {
+			switch name := a.Data.String(); name {
+			case "*":
+				computer.attrs = append(computer.attrs, [2]string{"cn", "WS01"}, [2]string{"ms-Mcs-AdmPwd", "hunter2"})
+			case "cn":
+				computer.attrs = append(computer.attrs, [2]string{"cn", "WS01"})
+			case "ms-Mcs-AdmPwd":
+				computer.attrs = append(computer.attrs, [2]string{name, "hunter2"})
+			}
+		}
+		return []*ber.Packet{
+			response(id, searchEntry(computer)),
+			response(id, resultDone(ldap.ApplicationSearchResultDone)),
+		}, false
+	})
+	w = pipeSession(t, context.Background(), client, nil)
+	w.options.Cache = cache
+	return w, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return count
+	}
+}
+
+func TestCacheSkipsConfidentialAttributes(t *testing.T) {
+	for _, attrs := range [][]string{{"cn", "ms-Mcs-AdmPwd"}, {"*"}} {
+		w, searches := countingSession(t)
+		for i := 0; i < 2; i++ {
+			res, err := w.GetSearchResults(w.MakeSimpleSearchRequest("(ms-Mcs-AdmPwd=*)", attrs))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Entries) != 1 || res.Entries[0].GetAttributeValue("ms-Mcs-AdmPwd") != "hunter2" {
+				t.Fatalf("%v: search %d didn't return the password", attrs, i+1)
+			}
+		}
+		if got := searches(); got != 2 {
+			t.Errorf("%v: the server got %d searches, want 2 (nothing cached)", attrs, got)
+		}
+	}
+}
+
+func TestCacheKeepsOtherSearches(t *testing.T) {
+	w, searches := countingSession(t)
+	for i := 0; i < 2; i++ {
+		res, err := w.GetSearchResults(w.MakeSimpleSearchRequest("(ms-Mcs-AdmPwd=*)", []string{"cn"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Entries) != 1 || res.Entries[0].GetAttributeValue("cn") != "WS01" {
+			t.Fatalf("search %d returned %v", i+1, res.Entries)
+		}
+	}
+	if got := searches(); got != 1 {
+		t.Errorf("the server got %d searches, want 1 (the second cached)", got)
+	}
+}
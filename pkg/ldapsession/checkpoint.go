@@ -0,0 +1,235 @@
+package ldapsession
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// PagingState is how far a paged search has got: the cookie the DC gave for the next page, and how much has been
+// received before it. It can be saved (it marshals to JSON) and passed to ResumePagedSearch to carry on later, but a
+// cookie is only honored by the DC that issued it, on a connection bound as the same account, and only while the DC
+// keeps the search's results. AD drops them after its MaxResultSetSize or a few minutes without a request, after
+// which resuming fails and the search has to start over
+type PagingState struct {
+	Cookie  []byte `json:"cookie,omitempty"`
+	Pages   int    `json:"pages"`
+	Entries int    `json:"entries"`
+	Done    bool   `json:"done"`
+}
+
+// PagedSearch is a paged search stepped through a page at a time by the caller, for applications embedding
+// windapsearch that schedule or checkpoint searches themselves instead of having ExecuteSearchRequest stream every
+// page. Next must not be called from more than one goroutine at a time, but State, Pause and Resume can be called
+// from any
+type PagedSearch struct {
+	session *LDAPSession
+	request *ldap.SearchRequest
+	paging  *ldap.ControlPaging
+	tuner   *pageTuner
+	// err is why the search can't be sent at all, e.g. the session's search quota
+	err error
+
+	// seen is what's been returned, to skip if a reconnect makes the search start over
+	seen seenEntries
+
+	mu    sync.Mutex
+	state PagingState
+	// resumed is made by Pause and closed by Resume, nil while the search isn't paused
+	resumed chan struct{}
+	// inFlight is made when Next starts a page and closed when it's finished, nil between pages
+	inFlight chan struct{}
+}
+
+// NewPagedSearch starts a paged search with the session's page size. Nothing is sent until Next is called
+func (w *LDAPSession) NewPagedSearch(request *ldap.SearchRequest) *PagedSearch {
+	return w.ResumePagedSearch(request, PagingState{})
+}
+
+// ResumePagedSearch carries on a paged search from a state returned by State or Pause, which must be for the same
+// request. The counts in the state carry on from where they were
+func (w *LDAPSession) ResumePagedSearch(request *ldap.SearchRequest, state PagingState) *PagedSearch {
+	// the search has its own copy of the request, so a paging control in it isn't shared with the caller's
+	r := *request
+	r.Controls = nil
+	for _, c := range request.Controls {
+		if c.GetControlType() != ldap.ControlTypePaging {
+			r.Controls = append(r.Controls, c)
+		}
+	}
+	paging := ldap.NewControlPaging(w.PageSize)
+	r.Controls = append(r.Controls, paging)
+	w.addControls(&r)
+	err := w.recordSearch(&r)
+	p := &PagedSearch{session: w, request: &r, paging: paging, tuner: w.newPageTuner(), state: state, err: err}
+	// what was returned before a saved state isn't known, so only a search from the start can start over
+	if w.options.Reconnect && len(state.Cookie) == 0 {
+		p.seen = make(seenEntries)
+	}
+	return p
+}
+
+// Next gets the next page of results. Referrals and response controls are in the result rather than sent to the
+// session's channels. Once the last page has been received Done is true and Next returns an empty result. A failed
+// page leaves the state as it was, so Next can be called again to retry it. While the search is paused Next waits for
+// Resume, returning an error if the session is cancelled first
+func (p *PagedSearch) Next() (*ldap.SearchResult, error) {
+	w := p.session
+	if p.err != nil {
+		return nil, p.err
+	}
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	defer p.finish()
+	state := p.State()
+	if state.Done {
+		return &ldap.SearchResult{}, nil
+	}
+	p.paging.SetCookie(state.Cookie)
+	var result *ldap.SearchResult
+	var err error
+	for {
+		p.paging.PagingSize = p.tuner.size
+		start := time.Now()
+		conn := w.conn()
+		result, err = w.withRetries(p.request, func() (*ldap.SearchResult, error) {
+			return w.cancellable(func() (*ldap.SearchResult, error) { return w.conn().Search(p.request) })
+		})
+		elapsed := time.Since(start)
+		if err != nil && w.ctx.Err() == nil && pageRefused(err) && p.tuner.shrink() {
+			w.Log.WithField("page", state.Pages+1).Infof("page %d refused (%s), asking again with page size %d", state.Pages+1, err, p.tuner.size)
+			continue
+		}
+		if p.seen != nil && w.cookieRejected(err, w.conn() != conn, p.paging.Cookie) {
+			w.Log.WithField("page", state.Pages+1).Warnf("the new connection refused the search's paging cookie (%s), starting the search over", err)
+			p.paging.SetCookie(nil)
+			continue
+		}
+		if err == nil {
+			p.tuner.observe(elapsed)
+		}
+		break
+	}
+	if err != nil {
+		if w.ctx.Err() != nil {
+			return nil, w.ctx.Err()
+		}
+		return nil, err
+	}
+	if result == nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: packet not received"))
+	}
+	result.Entries = p.seen.fresh(result.Entries)
+	w.countPage(len(result.Entries))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.state.Pages++
+	p.state.Entries += len(result.Entries)
+	w.Log.WithField("page", p.state.Pages).Infof("Received page %d with %d LDAP entries...", p.state.Pages, len(result.Entries))
+	p.state.Cookie = nil
+	if control, ok := ldap.FindControl(result.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging); ok && len(control.Cookie) > 0 {
+		p.state.Cookie = append([]byte(nil), control.Cookie...)
+	}
+	p.state.Done = len(p.state.Cookie) == 0
+	return result, nil
+}
+
+// start waits while the search is paused, then marks a page in flight until finish
+func (p *PagedSearch) start() error {
+	for {
+		p.mu.Lock()
+		resumed := p.resumed
+		if resumed == nil {
+			p.inFlight = make(chan struct{})
+			p.mu.Unlock()
+			return nil
+		}
+		p.mu.Unlock()
+		select {
+		case <-resumed:
+		case <-p.session.ctx.Done():
+			return p.session.ctx.Err()
+		}
+	}
+}
+
+func (p *PagedSearch) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	close(p.inFlight)
+	p.inFlight = nil
+}
+
+// settle waits for a page in flight to finish. It's called with p.mu held, which it releases while it waits
+func (p *PagedSearch) settle() {
+	for p.inFlight != nil {
+		inFlight := p.inFlight
+		p.mu.Unlock()
+		<-inFlight
+		p.mu.Lock()
+	}
+}
+
+// Done reports whether the last page has been received (or the search abandoned)
+func (p *PagedSearch) Done() bool {
+	return p.State().Done
+}
+
+// State is how far the search has got, to resume it from later
+func (p *PagedSearch) State() PagingState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state := p.state
+	state.Cookie = append([]byte(nil), p.state.Cookie...)
+	return state
+}
+
+// Pause stops the search between pages: a call to Next in progress finishes its page, which Pause waits for, and
+// later calls wait for Resume. The DC keeps the results it's holding, so the returned state can also be saved to
+// resume the search with ResumePagedSearch, as long as that's before the DC gives up on it
+func (p *PagedSearch) Pause() PagingState {
+	p.mu.Lock()
+	if p.resumed == nil {
+		p.resumed = make(chan struct{})
+	}
+	p.settle()
+	p.mu.Unlock()
+	return p.State()
+}
+
+// Resume lets a paused search carry on
+func (p *PagedSearch) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+	}
+}
+
+// Abandon tells the DC to drop the rest of the results, for a search that won't be carried on. A page in flight is
+// finished first, and a call to Next waiting on a pause returns as if the search was done. It does nothing once the
+// search is done
+func (p *PagedSearch) Abandon() {
+	p.mu.Lock()
+	p.settle()
+	cookie, pages := p.state.Cookie, p.state.Pages
+	p.state.Cookie = nil
+	p.state.Done = true
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+	}
+	p.mu.Unlock()
+
+	// the search is done, so Next won't touch the request again, and nothing waits on the DC with the lock held
+	if len(cookie) > 0 {
+		p.paging.SetCookie(cookie)
+		p.session.abandonPaging(p.request, p.paging)
+		p.session.warnIncomplete("search %q abandoned after %d page(s)", p.request.Filter, pages)
+	}
+}
@@ -0,0 +1,95 @@
+package ldapsession
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// slowServer answers the first page of a search with alice and bob once firstPage is closed, and a request for the
+// second page (including the one abandoning the search) once secondPage is closed. received gets each search as it
+// arrives
+func slowServer(t *testing.T) (p *PagedSearch, received chan []byte, firstPage, secondPage chan struct{}) {
+	t.Helper()
+	received = make(chan []byte, 4)
+	firstPage, secondPage = make(chan struct{}), make(chan struct{})
+	client, server := net.Pipe()
+	serveFake(server, func(id int64, req *ber.Packet) ([]*ber.Packet, bool) {
+		op := req.Children[1].Tag
+		if op != ldap.ApplicationSearchRequest {
+			return []*ber.Packet{response(id, resultDone(op+1))}, false
+		}
+		cookie := requestCookie(req)
+		received <- cookie
+		if cookie == nil {
+			<-firstPage
+			page := ldap.NewControlPaging(2)
+			page.SetCookie([]byte("page2"))
+			return []*ber.Packet{
+				response(id, searchEntry(userEntry("alice"))),
+				response(id, searchEntry(userEntry("bob"))),
+				response(id, resultDone(ldap.ApplicationSearchResultDone), page),
+			}, false
+		}
+		<-secondPage
+		return []*ber.Packet{response(id, resultDone(ldap.ApplicationSearchResultDone))}, false
+	})
+	w := pipeSession(t, context.Background(), client, nil)
+	w.PageSize = 2
+	return w.NewPagedSearch(w.MakeSimpleSearchRequest("(objectClass=user)", []string{"cn"})), received, firstPage, secondPage
+}
+
+func TestPauseWaitsForPageInFlight(t *testing.T) {
+	p, received, firstPage, secondPage := slowServer(t)
+	defer close(secondPage)
+
+	go p.Next()
+	<-received
+	paused := make(chan PagingState)
+	go func() { paused <- p.Pause() }()
+	select {
+	case state := <-paused:
+		t.Fatalf("Pause returned %+v while the first page was in flight", state)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(firstPage)
+	state := <-paused
+	if state.Pages != 1 || state.Entries != 2 || string(state.Cookie) != "page2" {
+		t.Errorf("Pause returned %+v, want the state after the first page", state)
+	}
+}
+
+func TestAbandonDoesNotHoldLockOnTheWire(t *testing.T) {
+	p, received, firstPage, secondPage := slowServer(t)
+	close(firstPage)
+	if _, err := p.Next(); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+
+	abandoned := make(chan struct{})
+	go func() {
+		p.Abandon()
+		close(abandoned)
+	}()
+	if cookie := <-received; string(cookie) != "page2" {
+		t.Fatalf("abandoned with cookie %q, want page2", cookie)
+	}
+	// the DC hasn't answered the abandon yet, but the state can still be read
+	stated := make(chan PagingState)
+	go func() { stated <- p.State() }()
+	select {
+	case state := <-stated:
+		if !state.Done {
+			t.Errorf("state %+v isn't done after Abandon", state)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("State blocked while Abandon was waiting on the DC")
+	}
+	close(secondPage)
+	<-abandoned
+}
@@ -0,0 +1,49 @@
+package ldapsession
+
+import (
+	"sync"
+
+	"github.com/ropnop/go-windapsearch/pkg/cldap"
+)
+
+// validateDCs sends a CLDAP ping to every candidate DC and returns the ones that answered for the domain, in their
+// original order. If no DC answers at all (e.g. UDP is filtered) the candidates are returned unchanged
+func (w *LDAPSession) validateDCs(dcs []string, domain string) []string {
+	responses := make([]*cldap.NetlogonResponse, len(dcs))
+	errs := make([]error, len(dcs))
+	var wg sync.WaitGroup
+	for i, dc := range dcs {
+		wg.Add(1)
+		go func(i int, dc string) {
+			defer wg.Done()
+			responses[i], errs[i] = cldap.Ping(w.Resolver(), dc, domain, cldap.DefaultTimeout)
+		}(i, dc)
+	}
+	wg.Wait()
+
+	var alive []string
+	answered := false
+	for i, dc := range dcs {
+		if errs[i] != nil {
+			w.Log.Warnf("DC %s did not answer CLDAP ping: %s", dc, errs[i])
+			continue
+		}
+		answered = true
+		r := responses[i]
+		if !r.ServesDomain(domain) {
+			w.Log.Warnf("DC %s (%s) serves domain %q, not %q, skipping", dc, r.DNSHostName, r.DNSDomainName, domain)
+			continue
+		}
+		w.Log.Debugf("DC %s (%s) answered CLDAP ping for %s, site %q, flags %v", dc, r.DNSHostName, r.DNSDomainName, r.DCSiteName, r.FlagNames())
+		alive = append(alive, dc)
+	}
+	if !answered {
+		w.Log.Warnf("no DC answered a CLDAP ping, UDP/389 may be filtered. Trying discovered DCs anyway")
+		return dcs
+	}
+	if len(alive) == 0 {
+		w.Log.Warnf("no DC answered CLDAP pings for %s. Trying discovered DCs anyway", domain)
+		return dcs
+	}
+	return alive
+}
@@ -0,0 +1,60 @@
+package ldapsession
+
+import (
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// MaxClockSkew is how far apart Kerberos lets the clocks of a client and a DC be (the default of both AD and MIT)
+const MaxClockSkew = 5 * time.Minute
+
+// checkClockSkew reads the DC's clock (currentTime from the RootDSE, which can be read before binding) and warns when
+// it's further from this machine's than Kerberos allows. Kerberos binds fail then, with errors that don't say why
+func (w *LDAPSession) checkClockSkew() {
+	sr := ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)",
+		[]string{"currentTime"}, nil)
+	start := time.Now()
+	res, err := w.conn().Search(sr)
+	if err != nil || len(res.Entries) == 0 {
+		w.Log.Debugf("couldn't read the DC's clock: %v", err)
+		return
+	}
+	rtt := time.Since(start)
+	current, err := time.Parse("20060102150405.0Z0700", res.Entries[0].GetAttributeValue("currentTime"))
+	if err != nil {
+		w.Log.Debugf("couldn't read the DC's clock: %s", err)
+		return
+	}
+	// the DC read its clock somewhere during the round trip
+	w.clockSkew = current.Sub(start.Add(rtt / 2))
+	w.Log.Debugf("DC clock is %s off from this machine's", w.clockSkew)
+	if w.clockSkewed() {
+		w.Log.Warnf("the DC's clock is %s, more than Kerberos allows (%s): Kerberos binds will fail, and times worked out on this machine won't match the DC's",
+			describeSkew(w.clockSkew), MaxClockSkew)
+	}
+}
+
+// clockSkewed reports whether the DC's clock is too far off for Kerberos
+func (w *LDAPSession) clockSkewed() bool {
+	return w.clockSkew > MaxClockSkew || w.clockSkew < -MaxClockSkew
+}
+
+// ClockSkew is how far the DC's clock was ahead of this machine's (negative if behind) when the session was opened,
+// to about a second
+func (w *LDAPSession) ClockSkew() time.Duration {
+	return w.clockSkew
+}
+
+// ServerTime is the time on the DC's clock now, for working out times relative to it (e.g. accounts that haven't
+// logged on in 90 days) that a skewed local clock would get wrong
+func (w *LDAPSession) ServerTime() time.Time {
+	return time.Now().Add(w.clockSkew)
+}
+
+func describeSkew(skew time.Duration) string {
+	if skew < 0 {
+		return (-skew).Round(time.Second).String() + " behind this machine's"
+	}
+	return skew.Round(time.Second).String() + " ahead of this machine's"
+}
@@ -0,0 +1,124 @@
+package ldapsession
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/redact"
+)
+
+// confidentialAttributes hold secrets rather than just information: passwords and their hashes, LAPS and gMSA
+// passwords, and BitLocker and TPM recovery information. Their values are never cached, and are redacted from wire
+// debugging output
+var confidentialAttributes = map[string]bool{
+	"unicodepwd":                          true,
+	"userpassword":                        true,
+	"unixuserpassword":                    true,
+	"os400password":                       true,
+	"dbcspwd":                             true,
+	"ntpwdhistory":                        true,
+	"lmpwdhistory":                        true,
+	"supplementalcredentials":             true,
+	"ms-mcs-admpwd":                       true,
+	"mslaps-password":                     true,
+	"mslaps-encryptedpassword":            true,
+	"mslaps-encryptedpasswordhistory":     true,
+	"mslaps-encrypteddsrmpassword":        true,
+	"mslaps-encrypteddsrmpasswordhistory": true,
+	"msds-managedpassword":                true,
+	"msfve-recoverypassword":              true,
+	"msfve-keypackage":                    true,
+	"mstpm-ownerinformation":              true,
+	"mspki-credentialroamingtokens":       true,
+}
+
+// IsConfidentialAttribute is true for attributes whose values are secrets, like ms-Mcs-AdmPwd. Attribute options
+// (e.g. ;range=0-1499 or ;binary) are ignored
+func IsConfidentialAttribute(name string) bool {
+	if i := strings.Index(name, ";"); i >= 0 {
+		name = name[:i]
+	}
+	return confidentialAttributes[strings.ToLower(name)]
+}
+
+// registerSecrets registers the values of the confidential attributes in a result with redact as soon as it arrives,
+// so they're masked in anything later logged about the entries, not only by the modules that know to
+func registerSecrets(result *ldap.SearchResult) {
+	if result == nil {
+		return
+	}
+	for _, entry := range result.Entries {
+		for _, attr := range entry.Attributes {
+			if IsConfidentialAttribute(attr.Name) {
+				redact.Add(attr.Values...)
+			}
+		}
+	}
+}
+
+// confidentialWriter masks the values of confidential attributes in go-ldap's packet dumps, which are printed as the
+// packets are decoded, before anything could register them with redact. A dump prints a packet a line per element,
+// indented by depth, as:
+//
+//	Attribute Name: (Universal, Primitive, Octet String) Len=13 "ms-Mcs-AdmPwd"
+//	Attribute Values: (Universal, Constructed, Set and Set OF) Len=9 "<nil>"
+//	 Attribute Value: (Universal, Primitive, Octet String) Len=7 "S3cr3t!"
+//
+// so once a line names a confidential attribute, the lines after it are masked until the dump leaves the attribute
+func confidentialWriter(w io.Writer) io.Writer {
+	return &packetRedactor{out: w, indent: -1}
+}
+
+type packetRedactor struct {
+	mu  sync.Mutex
+	out io.Writer
+	buf bytes.Buffer
+	// indent is how deep the attribute being masked was named, or -1 when not masking
+	indent int
+}
+
+// dumpValue matches the end of a packet dump line, the element's length and quoted value
+var dumpValue = regexp.MustCompile(`( Len=\d+ )"(.*)"$`)
+
+func (p *packetRedactor) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf.Write(b)
+	for {
+		i := bytes.IndexByte(p.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		line := string(p.buf.Next(i + 1))
+		if _, err := io.WriteString(p.out, p.redactLine(strings.TrimSuffix(line, "\n"))+"\n"); err != nil {
+			return len(b), err
+		}
+	}
+}
+
+func (p *packetRedactor) redactLine(line string) string {
+	m := dumpValue.FindStringSubmatch(line)
+	if m == nil {
+		// log lines between packets
+		p.indent = -1
+		return line
+	}
+	indent := len(line) - len(strings.TrimLeft(line, " "))
+	if p.indent >= 0 {
+		if indent >= p.indent {
+			return dumpValue.ReplaceAllString(line, `${1}"`+redact.Mask+`"`)
+		}
+		p.indent = -1
+	}
+	// attribute names are the first element of an attribute in results, and of a change in add and modify requests
+	if value, err := strconv.Unquote(`"` + m[2] + `"`); err == nil && IsConfidentialAttribute(value) &&
+		(strings.Contains(line, "Attribute Name:") || strings.Contains(line, "Type:")) {
+		p.indent = indent
+	}
+	return line
+}
@@ -0,0 +1,93 @@
+package ldapsession
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ropnop/go-windapsearch/pkg/redact"
+	"github.com/sirupsen/logrus"
+)
+
+// lapsEntry is a computer with both legacy and Windows LAPS passwords readable
+var lapsEntry = fakeEntry{
+	dn: "CN=WS01,OU=Workstations,DC=lab,DC=local",
+	attrs: [][2]string{
+		{"cn", "WS01"},
+		{"ms-Mcs-AdmPwd", "Leg4cy-LAPS-pw!"},
+		{"msLAPS-Password", `{"n":"Administrator","t":"1d8b8a1c2e3f4a5","p":"W1ndows-LAPS-pw\"x"}`},
+		{"ms-Mcs-AdmPwdExpirationTime", "133497498000000000"},
+	},
+}
+
+var lapsSecrets = []string{"Leg4cy-LAPS-pw!", "W1ndows-LAPS-pw"}
+
+func assertNoSecrets(t *testing.T, what, out string) {
+	t.Helper()
+	for _, s := range lapsSecrets {
+		if strings.Contains(out, s) {
+			t.Errorf("%s shows the LAPS password %q:\n%s", what, s, out)
+		}
+	}
+}
+
+func TestWireDebugRedactsConfidentialAttributes(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	wireDebugLogger(logger)
+	w := fakeSession(t, []fakeEntry{lapsEntry}, logger)
+	w.LConn.Debug.Enable(true)
+
+	res, err := w.GetSearchResults(w.MakeSimpleSearchRequest("(cn=WS01)", []string{"cn", "ms-Mcs-AdmPwd", "msLAPS-Password"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Entries[0].GetAttributeValue("ms-Mcs-AdmPwd"); got != "Leg4cy-LAPS-pw!" {
+		t.Fatalf("the result itself should be untouched, got ms-Mcs-AdmPwd %q", got)
+	}
+	dump := out.String()
+	assertNoSecrets(t, "the packet dump", dump)
+	if !strings.Contains(dump, `"ms-Mcs-AdmPwd"`) || !strings.Contains(dump, `"`+redact.Mask+`"`) {
+		t.Errorf("expected the attribute named and its value masked in the dump:\n%s", dump)
+	}
+	// attributes after a confidential one are dumped as usual
+	if !strings.Contains(dump, `"133497498000000000"`) || !strings.Contains(dump, `"WS01"`) {
+		t.Errorf("expected the other attributes' values in the dump:\n%s", dump)
+	}
+}
+
+func TestVerboseLoggingRedactsConfidentialAttributes(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	logger.SetLevel(logrus.DebugLevel)
+	logger.SetFormatter(&redact.Formatter{Formatter: &logrus.JSONFormatter{}})
+	w := fakeSession(t, []fakeEntry{lapsEntry}, logger)
+
+	res, err := w.GetSearchResults(w.MakeSimpleSearchRequest("(cn=WS01)", []string{"ms-Mcs-AdmPwd", "msLAPS-Password"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := res.Entries[0]
+	w.Log.WithField("values", entry.GetAttributeValues("ms-Mcs-AdmPwd")).Debugf("entry %s: %v", entry.DN, entry.GetAttributeValue("msLAPS-Password"))
+	w.Log.Error(redact.Error(fmt.Errorf("unable to parse %q", entry.GetAttributeValue("msLAPS-Password"))))
+	assertNoSecrets(t, "the debug log", out.String())
+}
+
+func TestIsConfidentialAttribute(t *testing.T) {
+	for name, want := range map[string]bool{
+		"ms-Mcs-AdmPwd":                 true,
+		"MSLAPS-PASSWORD":               true,
+		"msLAPS-EncryptedPassword":      true,
+		"unicodePwd;binary":             true,
+		"ms-Mcs-AdmPwdExpirationTime":   false,
+		"msLAPS-PasswordExpirationTime": false,
+		"member;range=0-1499":           false,
+	} {
+		if got := IsConfidentialAttribute(name); got != want {
+			t.Errorf("IsConfidentialAttribute(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package ldapsession
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ControlTypeSDFlags is LDAP_SERVER_SD_FLAGS_OID, which picks the parts of nTSecurityDescriptor to read or write
+const ControlTypeSDFlags = "1.2.840.113556.1.4.801"
+
+// Security information flags for the SD flags control
+const (
+	OwnerSecurityInformation = 0x1
+	GroupSecurityInformation = 0x2
+	DACLSecurityInformation  = 0x4
+	SACLSecurityInformation  = 0x8
+)
+
+// NewSDFlagsControl returns an SD flags control for the given security information flags. Without it, reading
+// nTSecurityDescriptor asks for the SACL too, which fails for anyone but admins
+func NewSDFlagsControl(flags int) ldap.Control {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SDFlagsRequestValue")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, flags, "Flags"))
+	return ldap.NewControlString(ControlTypeSDFlags, true, string(value.Bytes()))
+}
+
+// ParseControl parses a control given as OID[:critical[:base64value]], e.g. 1.2.840.113556.1.4.417 (show deleted
+// objects) or 1.2.840.113556.1.4.801:true:MAMCAQc=, for controls windapsearch has no option for
+func ParseControl(s string) (ldap.Control, error) {
+	parts := strings.SplitN(s, ":", 3)
+	oid := strings.TrimSpace(parts[0])
+	for _, arc := range strings.Split(oid, ".") {
+		if _, err := strconv.ParseUint(arc, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid control %q: %q isn't an OID", s, oid)
+		}
+	}
+	critical := false
+	if len(parts) > 1 && parts[1] != "" {
+		var err error
+		if critical, err = strconv.ParseBool(parts[1]); err != nil {
+			return nil, fmt.Errorf("invalid control %q: criticality must be true or false", s)
+		}
+	}
+	value := ""
+	if len(parts) > 2 {
+		b, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid control %q: value isn't base64: %s", s, err)
+		}
+		value = string(b)
+	}
+	return ldap.NewControlString(oid, critical, value), nil
+}
+
+// SearchWithControls runs a search with extra controls attached, for controls that aren't wrapped by a function of
+// their own. A control of the same type already in the request is replaced. The search is paged with the session's
+// page size, unless one of the controls is a paging control, in which case the request is sent as it is and only the
+// page it asks for comes back. Response controls are in the result
+func (w *LDAPSession) SearchWithControls(request *ldap.SearchRequest, controls ...ldap.Control) (*ldap.SearchResult, error) {
+	r := *request
+	r.Controls = mergeControls(request.Controls, controls)
+	w.Log.Infof("sending LDAP search request %q with %d extra controls", r.Filter, len(controls))
+	if err := w.recordSearch(&r); err != nil {
+		return nil, err
+	}
+	return w.withRetries(&r, func() (*ldap.SearchResult, error) {
+		return w.cancellable(func() (*ldap.SearchResult, error) {
+			if ldap.FindControl(r.Controls, ldap.ControlTypePaging) != nil {
+				return w.conn().Search(&r)
+			}
+			return w.conn().SearchWithPaging(&r, w.PageSize)
+		})
+	})
+}
+
+// mergeControls returns the request's controls with extra added, replacing the ones of the same type
+func mergeControls(controls, extra []ldap.Control) []ldap.Control {
+	var merged []ldap.Control
+	for _, c := range controls {
+		if ldap.FindControl(extra, c.GetControlType()) == nil {
+			merged = append(merged, c)
+		}
+	}
+	return append(merged, extra...)
+}
+
+// addControls attaches the controls given in the session's options to a request, so every search made through the
+// session carries them. Paging is the session's own to do, so a paging control among them is left out
+func (w *LDAPSession) addControls(request *ldap.SearchRequest) {
+	var extra []ldap.Control
+	for _, c := range w.options.Controls {
+		if c.GetControlType() != ldap.ControlTypePaging {
+			extra = append(extra, c)
+		}
+	}
+	if len(extra) > 0 {
+		request.Controls = mergeControls(request.Controls, extra)
+	}
+}
@@ -1 +1,239 @@
 package ldapsession
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Partition identifies one of the naming contexts a module can search in
+type Partition int
+
+const (
+	DomainPartition Partition = iota
+	ConfigurationPartition
+	SchemaPartition
+	DomainDNSPartition
+	ForestDNSPartition
+)
+
+var partitionNames = map[Partition]string{
+	DomainPartition:        "domain",
+	ConfigurationPartition: "configuration",
+	SchemaPartition:        "schema",
+	DomainDNSPartition:     "domaindns",
+	ForestDNSPartition:     "forestdns",
+}
+
+func (p Partition) String() string {
+	if name, ok := partitionNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Partition(%d)", int(p))
+}
+
+// ParsePartition converts a partition name (e.g. "configuration") to a Partition
+func ParsePartition(s string) (Partition, error) {
+	for p, name := range partitionNames {
+		if strings.EqualFold(s, name) {
+			return p, nil
+		}
+	}
+	return DomainPartition, fmt.Errorf("unknown partition %q (must be one of domain, configuration, schema, domaindns, forestdns)", s)
+}
+
+// NamingContexts holds the naming contexts advertised in the rootDSE
+type NamingContexts struct {
+	Default       string
+	Configuration string
+	Schema        string
+	RootDomain    string
+	DomainDNS     string
+	ForestDNS     string
+	All           []string
+}
+
+// DN returns the distinguished name of a partition, or an error if the server didn't advertise it
+func (n NamingContexts) DN(p Partition) (string, error) {
+	var dn string
+	switch p {
+	case DomainPartition:
+		dn = n.Default
+	case ConfigurationPartition:
+		dn = n.Configuration
+	case SchemaPartition:
+		dn = n.Schema
+	case DomainDNSPartition:
+		dn = n.DomainDNS
+	case ForestDNSPartition:
+		dn = n.ForestDNS
+	}
+	if dn == "" {
+		return "", fmt.Errorf("the server does not advertise a naming context for the %s partition", p)
+	}
+	return dn, nil
+}
+
+// GetNamingContexts reads every naming context from the rootDSE and stores them on the session. It also sets the BaseDN
+// to the default naming context if it isn't already set
+func (w *LDAPSession) GetNamingContexts() (NamingContexts, error) {
+	sr := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0, 0, false,
+		"(objectClass=*)",
+		[]string{"namingContexts", "defaultNamingContext", "configurationNamingContext", "schemaNamingContext", "rootDomainNamingContext"},
+		nil)
+	res, err := w.conn().Search(sr)
+	if err != nil {
+		return w.NamingContexts, err
+	}
+	if len(res.Entries) == 0 {
+		return w.NamingContexts, fmt.Errorf("error getting metadata: No LDAP responses from server")
+	}
+	entry := res.Entries[0]
+	nc := NamingContexts{
+		Default:       entry.GetAttributeValue("defaultNamingContext"),
+		Configuration: entry.GetAttributeValue("configurationNamingContext"),
+		Schema:        entry.GetAttributeValue("schemaNamingContext"),
+		RootDomain:    entry.GetAttributeValue("rootDomainNamingContext"),
+		All:           entry.GetAttributeValues("namingContexts"),
+	}
+	if nc.Default == "" {
+		return w.NamingContexts, fmt.Errorf("error getting metadata: attribute defaultNamingContext missing")
+	}
+	// the DNS application partitions don't have their own rootDSE attribute, so find them by name
+	for _, dn := range nc.All {
+		switch {
+		case strings.EqualFold(dn, "DC=DomainDnsZones,"+nc.Default):
+			nc.DomainDNS = dn
+		case nc.RootDomain != "" && strings.EqualFold(dn, "DC=ForestDnsZones,"+nc.RootDomain):
+			nc.ForestDNS = dn
+		}
+	}
+
+	w.NamingContexts = nc
+	if w.BaseDN == "" {
+		w.BaseDN = nc.Default
+	}
+	return nc, nil
+}
+
+// PartitionDN returns the base DN to use to search a partition
+func (w *LDAPSession) PartitionDN(p Partition) (string, error) {
+	return w.NamingContexts.DN(p)
+}
+
+// ForestDomain is a domain discovered in the current forest
+type ForestDomain struct {
+	DNSName     string
+	DN          string
+	NetBIOSName string
+}
+
+// GetForestDomains discovers every domain in the forest. Domains are read from the crossRef objects in the Partitions
+// container, and supplemented by any intra-forest trustedDomain objects in case the Configuration partition isn't readable
+func (w *LDAPSession) GetForestDomains() ([]ForestDomain, error) {
+	var domains []ForestDomain
+	seen := make(map[string]bool)
+	add := func(d ForestDomain) {
+		key := strings.ToLower(d.DNSName)
+		if key == "" || seen[key] {
+			return
+		}
+		seen[key] = true
+		domains = append(domains, d)
+	}
+
+	if w.NamingContexts.Configuration != "" {
+		sr := ldap.NewSearchRequest(
+			"CN=Partitions,"+w.NamingContexts.Configuration,
+			ldap.ScopeSingleLevel,
+			ldap.NeverDerefAliases,
+			0, 0, false,
+			"(&(objectClass=crossRef)(systemFlags:1.2.840.113556.1.4.803:=2))", // FLAG_CR_NTDS_DOMAIN
+			[]string{"dnsRoot", "nCName", "nETBIOSName"},
+			nil)
+		res, err := w.GetSearchResults(sr)
+		if err != nil {
+			w.Log.Warnf("unable to read partitions container: %s", err)
+		} else {
+			for _, entry := range res.Entries {
+				add(ForestDomain{
+					DNSName:     entry.GetAttributeValue("dnsRoot"),
+					DN:          entry.GetAttributeValue("nCName"),
+					NetBIOSName: entry.GetAttributeValue("nETBIOSName"),
+				})
+			}
+		}
+	}
+
+	sr := w.MakeSimpleSearchRequest("(&(objectClass=trustedDomain)(trustAttributes:1.2.840.113556.1.4.803:=32))", // TRUST_ATTRIBUTE_WITHIN_FOREST
+		[]string{"trustPartner", "flatName"})
+	res, err := w.GetPagedSearchResults(sr)
+	if err != nil {
+		w.Log.Warnf("unable to read trustedDomain objects: %s", err)
+	} else {
+		for _, entry := range res.Entries {
+			name := entry.GetAttributeValue("trustPartner")
+			add(ForestDomain{
+				DNSName:     name,
+				DN:          domainToDN(name),
+				NetBIOSName: entry.GetAttributeValue("flatName"),
+			})
+		}
+	}
+
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("unable to discover any domains in the forest")
+	}
+	return domains, nil
+}
+
+// domainToDN converts a DNS domain name (lab.example.com) to a DN (DC=lab,DC=example,DC=com)
+func domainToDN(domain string) string {
+	var parts []string
+	for _, label := range strings.Split(strings.Trim(domain, "."), ".") {
+		parts = append(parts, "DC="+label)
+	}
+	return strings.Join(parts, ",")
+}
+
+// DNToDomain converts a domain DN (DC=lab,DC=example,DC=com) to its DNS name (lab.example.com)
+func DNToDomain(dn string) string {
+	var labels []string
+	for _, rdn := range strings.Split(dn, ",") {
+		kv := strings.SplitN(strings.TrimSpace(rdn), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "DC") {
+			labels = append(labels, kv[1])
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// EqualDN reports whether two DNs name the same object. AD compares attribute types and values without regard to
+// case, international characters included (CN=Jörg and cn=JÖRG are the same user), which DN.Equal doesn't
+func EqualDN(a, b string) bool {
+	da, errA := ldap.ParseDN(a)
+	db, errB := ldap.ParseDN(b)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(a, b)
+	}
+	if len(da.RDNs) != len(db.RDNs) {
+		return false
+	}
+	for i := range da.RDNs {
+		ra, rb := da.RDNs[i].Attributes, db.RDNs[i].Attributes
+		if len(ra) != len(rb) {
+			return false
+		}
+		for j := range ra {
+			if !strings.EqualFold(ra[j].Type, rb[j].Type) || !strings.EqualFold(ra[j].Value, rb[j].Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package ldapsession
+
+import "testing"
+
+func TestEqualDN(t *testing.T) {
+	for _, tc := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{"CN=Jörg Müller,OU=Vertrieb,DC=lab,DC=local", "cn=JÖRG MÜLLER,ou=vertrieb,dc=LAB,dc=Local", true},
+		{"CN=Ærøskøbing,DC=lab,DC=local", "CN=ÆRØSKØBING,DC=lab,DC=local", true},
+		{"CN=Łukasz Żółć,DC=lab,DC=local", "CN=łukasz żółć,dc=lab,dc=local", true},
+		{"CN=Иванов Пётр,DC=lab,DC=local", "CN=ИВАНОВ ПЁТР,DC=lab,DC=local", true},
+		{"CN=渡辺 健太,DC=lab,DC=local", "cn=渡辺 健太,dc=lab,dc=local", true},
+		// spacing around separators and escaped characters don't change the DN
+		{"CN=Müller\\, Jörg,OU=IT,DC=lab,DC=local", "CN=müller\\, jörg, OU=it, DC=lab, DC=local", true},
+		{"CN=Müller\\2C Jörg,DC=lab,DC=local", "CN=Müller\\, Jörg,DC=lab,DC=local", true},
+		{"CN=Jörg Müller,DC=lab,DC=local", "CN=Jorg Muller,DC=lab,DC=local", false},
+		{"CN=Jörg,OU=IT,DC=lab,DC=local", "CN=Jörg,DC=lab,DC=local", false},
+		{"CN=Jörg+UID=1,DC=lab,DC=local", "CN=Jörg,DC=lab,DC=local", false},
+		{"OU=Vertrieb,DC=lab,DC=local", "CN=Vertrieb,DC=lab,DC=local", false},
+		// DNs that don't parse are compared as text
+		{"not a dn", "NOT A DN", true},
+		{"not a dn", "CN=not a dn", false},
+	} {
+		if got := EqualDN(tc.a, tc.b); got != tc.equal {
+			t.Errorf("EqualDN(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.equal)
+		}
+		if got := EqualDN(tc.b, tc.a); got != tc.equal {
+			t.Errorf("EqualDN(%q, %q) = %v, want %v", tc.b, tc.a, got, tc.equal)
+		}
+	}
+}
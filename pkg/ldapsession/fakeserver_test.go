@@ -0,0 +1,155 @@
+package ldapsession
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeEntry is an entry a fake server returns, with its attributes in order
+type fakeEntry struct {
+	dn    string
+	attrs [][2]string
+}
+
+// fakeHandler answers the request with message ID id with the responses to send back, or hangs up on the client
+type fakeHandler func(id int64, req *ber.Packet) (responses []*ber.Packet, hangUp bool)
+
+// serveFake answers the requests on a connection with handle until the client or handle hangs up. Unbind and
+// abandon requests get no response
+func serveFake(conn net.Conn, handle fakeHandler) {
+	go func() {
+		defer conn.Close()
+		for {
+			req, err := ber.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			id := req.Children[0].Value.(int64)
+			switch req.Children[1].Tag {
+			case ldap.ApplicationUnbindRequest, ldap.ApplicationAbandonRequest:
+				continue
+			}
+			responses, hangUp := handle(id, req)
+			if hangUp {
+				return
+			}
+			for _, r := range responses {
+				conn.Write(r.Bytes())
+			}
+		}
+	}()
+}
+
+// fakeServer answers every search on a connection with entries, and anything else with success
+func fakeServer(t *testing.T, conn net.Conn, entries []fakeEntry) {
+	t.Helper()
+	serveFake(conn, func(id int64, req *ber.Packet) ([]*ber.Packet, bool) {
+		op := req.Children[1].Tag
+		if op != ldap.ApplicationSearchRequest {
+			return []*ber.Packet{response(id, resultDone(op+1))}, false
+		}
+		var responses []*ber.Packet
+		for _, e := range entries {
+			responses = append(responses, response(id, searchEntry(e)))
+		}
+		return append(responses, response(id, resultDone(ldap.ApplicationSearchResultDone))), false
+	})
+}
+
+// response wraps a protocol op in an LDAP message answering the request with message ID id
+func response(id int64, op *ber.Packet, controls ...ldap.Control) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	if len(controls) > 0 {
+		c := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "")
+		for _, control := range controls {
+			c.AppendChild(control.Encode())
+		}
+		p.AppendChild(c)
+	}
+	return p
+}
+
+// requestCookie is the paging cookie a search request carries, if any
+func requestCookie(req *ber.Packet) []byte {
+	if len(req.Children) < 3 {
+		return nil
+	}
+	for _, child := range req.Children[2].Children {
+		if c, err := ldap.DecodeControl(child); err == nil {
+			if paging, ok := c.(*ldap.ControlPaging); ok {
+				return paging.Cookie
+			}
+		}
+	}
+	return nil
+}
+
+func searchEntry(e fakeEntry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for _, a := range e.attrs {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, a[0], ""))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, a[1], ""))
+		attr.AppendChild(values)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return op
+}
+
+func resultDone(tag ber.Tag) *ber.Packet {
+	return resultCode(tag, ldap.LDAPResultSuccess)
+}
+
+func resultCode(tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return op
+}
+
+// fakeSession returns a session connected to a fake server that returns entries
+func fakeSession(t *testing.T, entries []fakeEntry, logger *logrus.Logger) *LDAPSession {
+	t.Helper()
+	client, server := net.Pipe()
+	fakeServer(t, server, entries)
+	return pipeSession(t, context.Background(), client, logger)
+}
+
+// pipeSession returns a session on the client end of a pipe, whatever is serving the other end
+func pipeSession(t *testing.T, ctx context.Context, client net.Conn, logger *logrus.Logger) *LDAPSession {
+	t.Helper()
+	wire := &wireConn{Conn: client}
+	conn := ldap.NewConn(wire, false)
+	conn.Start()
+	t.Cleanup(func() { conn.Close() })
+	if logger == nil {
+		logger = logrus.New()
+		logger.Out = ioutil.Discard
+	}
+	return &LDAPSession{
+		LConn:     conn,
+		wire:      wire,
+		PageSize:  1000,
+		BaseDN:    "DC=lab,DC=local",
+		Log:       logger.WithField("package", "ldapsession"),
+		baseLog:   logger.WithField("package", "ldapsession"),
+		ctx:       ctx,
+		stats:     &searchStats{},
+		server:    "dc01.lab.local",
+		port:      389,
+		logFields: logrus.Fields{},
+	}
+}
@@ -0,0 +1,128 @@
+package ldapsession
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DumpedHash is an account's hashes from a secretsdump style dump
+type DumpedHash struct {
+	// Domain is the domain the account was prefixed with (DOMAIN\account), if it was
+	Domain  string
+	Account string
+	RID     uint32
+	// Hash is the hashes as LM:NT
+	Hash string
+}
+
+// Name is the account as it appears in the dump
+func (d DumpedHash) Name() string {
+	if d.Domain == "" {
+		return d.Account
+	}
+	return d.Domain + `\` + d.Account
+}
+
+// historyAccount matches the names secretsdump gives previous passwords' hashes (with -history)
+var historyAccount = regexp.MustCompile(`_history\d+$`)
+
+// ReadHashesFile reads the account hashes from a secretsdump style dump, lines of [DOMAIN\]account:RID:LM:NT:::
+// as secretsdump, pwdump and hashcat's --username format write them. Everything else in the dump (banners,
+// Kerberos keys, cleartext passwords, LSA secrets) and the hashes of previous passwords are skipped
+func ReadHashesFile(path string) ([]DumpedHash, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return ParseHashes(fp)
+}
+
+// ParseHashes reads the account hashes from a secretsdump style dump. See ReadHashesFile
+func ParseHashes(r io.Reader) ([]DumpedHash, error) {
+	var hashes []DumpedHash
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) < 4 || !isHashHex(fields[2]) || !isHashHex(fields[3]) {
+			continue
+		}
+		rid, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		d := DumpedHash{Account: fields[0], RID: uint32(rid), Hash: strings.ToLower(fields[2] + ":" + fields[3])}
+		if i := strings.LastIndex(d.Account, `\`); i >= 0 {
+			d.Domain, d.Account = d.Account[:i], d.Account[i+1:]
+		}
+		if d.Account == "" || historyAccount.MatchString(d.Account) {
+			continue
+		}
+		hashes = append(hashes, d)
+	}
+	return hashes, scanner.Err()
+}
+
+// SelectHash picks an account out of a dump, by RID or by name: sAMAccountName, DOMAIN\name or name@domain, in any
+// case. A machine account can be picked by its hostname, without the trailing $, unless there's an account with
+// that exact name. It's an error for the selector to match more than one account, e.g. when a dump has both the SAM
+// and NTDS.dit
+func SelectHash(hashes []DumpedHash, selector string) (DumpedHash, error) {
+	selector = strings.TrimSpace(selector)
+	var exact, host []DumpedHash
+	if rid, err := strconv.ParseUint(selector, 10, 32); err == nil {
+		for _, d := range hashes {
+			if d.RID == uint32(rid) {
+				exact = append(exact, d)
+			}
+		}
+	} else {
+		account, domain := selector, ""
+		if i := strings.LastIndex(account, `\`); i >= 0 {
+			domain, account = account[:i], account[i+1:]
+		} else if i := strings.LastIndex(account, "@"); i >= 0 {
+			account, domain = account[:i], account[i+1:]
+		}
+		for _, d := range hashes {
+			if domain != "" && !sameDomain(d.Domain, domain) {
+				continue
+			}
+			if strings.EqualFold(d.Account, account) {
+				exact = append(exact, d)
+			} else if strings.EqualFold(d.Account, account+"$") {
+				host = append(host, d)
+			}
+		}
+	}
+	found := exact
+	if len(found) == 0 {
+		found = host
+	}
+	switch len(found) {
+	case 0:
+		return DumpedHash{}, fmt.Errorf("no account matching %q in the dump", selector)
+	case 1:
+		return found[0], nil
+	}
+	names := make([]string, len(found))
+	for i, d := range found {
+		names[i] = fmt.Sprintf("%s (RID %d)", d.Name(), d.RID)
+	}
+	return DumpedHash{}, fmt.Errorf("%q matches more than one account in the dump: %s", selector, strings.Join(names, ", "))
+}
+
+// sameDomain compares the domain a dump prefixes an account with, which may be the NetBIOS name or the FQDN, with
+// the one in a selector, which may be either too. secretsdump only prefixes NTDS.dit accounts that have a UPN, so
+// accounts without a domain match any
+func sameDomain(dumped, domain string) bool {
+	if dumped == "" || strings.EqualFold(dumped, domain) {
+		return true
+	}
+	short := func(s string) string { return strings.SplitN(s, ".", 2)[0] }
+	return strings.EqualFold(short(dumped), short(domain))
+}
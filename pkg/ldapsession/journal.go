@@ -0,0 +1,339 @@
+package ldapsession
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// JournalEntry records a single change made to the directory, with what is needed to revert it
+type JournalEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	DN        string    `json:"dn"`
+	// Change is the LDIF of the change, with passwords redacted
+	Change string `json:"change"`
+	// Undo is the inverse of each modification, in the order they revert it. Values the change added are deleted
+	// and ones it removed are added back, so changes made to the same attributes by others since are kept
+	Undo []JournalChange `json:"undo,omitempty"`
+	// SDFlags is set if the change used the SD flags control, which the revert has to use too
+	SDFlags int `json:"sdFlags,omitempty"`
+	// Irreversible lists modified attributes whose original values can't be read back (e.g. unicodePwd)
+	Irreversible []string `json:"irreversible,omitempty"`
+}
+
+// JournalChange is a modification that reverts part of a change: deleting or adding back exact values, or replacing
+// a single valued attribute with the value it had
+type JournalChange struct {
+	Operation string `json:"operation"`
+	Attribute string `json:"attribute"`
+	// Values are base64 encoded. A replace without values clears the attribute
+	Values []string `json:"values,omitempty"`
+}
+
+// Journal is a JSON file of every change made through write mode. It is rewritten after each change, so it stays
+// valid even if windapsearch is interrupted
+type Journal struct {
+	Path    string         `json:"-"`
+	Domain  string         `json:"domain"`
+	Entries []JournalEntry `json:"entries"`
+	mu      sync.Mutex
+}
+
+// NewJournal returns an empty journal that will be saved to path once the first change is recorded
+func NewJournal(path string) *Journal {
+	return &Journal{Path: path}
+}
+
+// LoadJournal reads a journal written by a previous run
+func LoadJournal(path string) (*Journal, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{Path: path}
+	if err = json.Unmarshal(b, j); err != nil {
+		return nil, fmt.Errorf("invalid journal %q: %s", path, err)
+	}
+	return j, nil
+}
+
+// Len returns the number of changes recorded
+func (j *Journal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.Entries)
+}
+
+func (j *Journal) record(domain string, entry JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// a journal is undone through a single session, so it can only hold changes to one domain
+	if j.Domain == "" {
+		j.Domain = domain
+	} else if !strings.EqualFold(j.Domain, domain) {
+		return fmt.Errorf("journal %s is for %s, not recording change to %s", j.Path, j.Domain, domain)
+	}
+	j.Entries = append(j.Entries, entry)
+	b, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(j.Path, b, 0600)
+}
+
+// journalModify works out the inverse of each modification a modify request makes, so the change can be undone.
+// Adding and deleting values is undone with the same values, and only deleting a whole attribute or replacing it
+// needs the values it has now read first
+func (w *LDAPSession) journalModify(req *ldap.ModifyRequest) (JournalEntry, error) {
+	entry := JournalEntry{Time: time.Now(), Operation: "modify", DN: req.DN, Change: FormatModify(req)}
+	var controls []ldap.Control
+	for _, c := range req.Controls {
+		if c.GetControlType() == ControlTypeSDFlags {
+			entry.SDFlags = sdFlags(c)
+			controls = append(controls, NewSDFlagsControl(OwnerSecurityInformation|GroupSecurityInformation|DACLSecurityInformation))
+		}
+	}
+	current := make(map[string][][]byte)
+	for _, change := range req.Changes {
+		attr := change.Modification.Type
+		if secretAttributes[strings.ToLower(attr)] {
+			entry.Irreversible = append(entry.Irreversible, attr)
+			continue
+		}
+		if change.Operation == ldap.AddAttribute || (change.Operation == ldap.DeleteAttribute && len(change.Modification.Vals) > 0) {
+			continue
+		}
+		key := strings.ToLower(attr)
+		if _, ok := current[key]; ok {
+			continue
+		}
+		values, err := w.attributeValues(req.DN, attr, controls)
+		if err != nil {
+			return entry, err
+		}
+		current[key] = values
+	}
+
+	var undo []JournalChange
+	for _, change := range req.Changes {
+		attr := change.Modification.Type
+		if secretAttributes[strings.ToLower(attr)] {
+			continue
+		}
+		values := stringsToBytes(change.Modification.Vals)
+		var inverse []JournalChange
+		switch change.Operation {
+		case ldap.AddAttribute:
+			inverse = append(inverse, journalChange("delete", attr, values))
+		case ldap.DeleteAttribute:
+			if len(values) == 0 {
+				values = current[strings.ToLower(attr)]
+			}
+			if len(values) > 0 {
+				inverse = append(inverse, journalChange("add", attr, values))
+			}
+		case ldap.ReplaceAttribute:
+			old := current[strings.ToLower(attr)]
+			if len(old) <= 1 && len(values) <= 1 {
+				// a single value (or none) is put back as it was, which is the only way to revert a single valued
+				// attribute like nTSecurityDescriptor that can't have its value deleted
+				inverse = append(inverse, journalChange("replace", attr, old))
+				break
+			}
+			if added := missingValues(values, old); len(added) > 0 {
+				inverse = append(inverse, journalChange("delete", attr, added))
+			}
+			if removed := missingValues(old, values); len(removed) > 0 {
+				inverse = append(inverse, journalChange("add", attr, removed))
+			}
+		}
+		// later modifications are reverted first
+		undo = append(inverse, undo...)
+	}
+	entry.Undo = undo
+	return entry, nil
+}
+
+// attributeValues reads every value of an attribute of an object. Large multi-valued attributes (e.g. the member of
+// a big group) are returned in ranges, as member;range=0-1499, and are read range by range until the last one
+func (w *LDAPSession) attributeValues(dn, attr string, controls []ldap.Control) ([][]byte, error) {
+	var values [][]byte
+	requested := attr
+	for {
+		sr := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)", []string{requested}, controls)
+		res, err := w.conn().Search(sr)
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Entries) == 0 {
+			return nil, fmt.Errorf("%q not found", dn)
+		}
+		next := ""
+		for _, a := range res.Entries[0].Attributes {
+			name := a.Name
+			options := ""
+			if i := strings.Index(name, ";"); i >= 0 {
+				name, options = name[:i], name[i+1:]
+			}
+			if !strings.EqualFold(name, attr) {
+				continue
+			}
+			values = append(values, a.ByteValues...)
+			// the range the server returned ends in * once there are no more values
+			if strings.HasPrefix(strings.ToLower(options), "range=") {
+				var low, high int
+				if n, _ := fmt.Sscanf(options[len("range="):], "%d-%d", &low, &high); n == 2 {
+					next = fmt.Sprintf("%s;range=%d-*", attr, high+1)
+				}
+			}
+		}
+		if next == "" {
+			return values, nil
+		}
+		requested = next
+	}
+}
+
+// journalChange encodes the values of an inverse modification for the journal
+func journalChange(op, attr string, values [][]byte) JournalChange {
+	c := JournalChange{Operation: op, Attribute: attr}
+	for _, v := range values {
+		c.Values = append(c.Values, base64.StdEncoding.EncodeToString(v))
+	}
+	return c
+}
+
+// missingValues returns the values that aren't in other
+func missingValues(values, other [][]byte) [][]byte {
+	have := make(map[string]bool, len(other))
+	for _, v := range other {
+		have[string(v)] = true
+	}
+	var missing [][]byte
+	for _, v := range values {
+		if !have[string(v)] {
+			missing = append(missing, v)
+		}
+	}
+	return missing
+}
+
+func stringsToBytes(values []string) [][]byte {
+	b := make([][]byte, len(values))
+	for i, v := range values {
+		b[i] = []byte(v)
+	}
+	return b
+}
+
+// sdFlags reads the flags back out of an SD flags control
+func sdFlags(c ldap.Control) int {
+	cs, ok := c.(*ldap.ControlString)
+	if !ok {
+		return DACLSecurityInformation
+	}
+	packet, err := ber.DecodePacketErr([]byte(cs.ControlValue))
+	if err != nil || len(packet.Children) == 0 {
+		return DACLSecurityInformation
+	}
+	if flags, ok := packet.Children[0].Value.(int64); ok {
+		return int(flags)
+	}
+	return DACLSecurityInformation
+}
+
+// saveJournal records a change that was just applied. The change has already been made at this point, so a failure
+// to save it is logged rather than returned
+func (w *LDAPSession) saveJournal(entry JournalEntry) {
+	if w.options.Journal == nil {
+		return
+	}
+	if err := w.options.Journal.record(DNToDomain(w.NamingContexts.Default), entry); err != nil {
+		w.Log.Errorf("change applied, but unable to save it to the journal %s: %s", w.options.Journal.Path, err)
+	}
+}
+
+// Undo reverts every change in a journal, most recent first. Changes made while undoing aren't journaled. Like any
+// other write, nothing is sent on a dry run
+func (w *LDAPSession) Undo(j *Journal) error {
+	if domain := DNToDomain(w.NamingContexts.Default); j.Domain != "" && !strings.EqualFold(j.Domain, domain) {
+		return fmt.Errorf("journal is for %s, but connected to %s", j.Domain, domain)
+	}
+	journal := w.options.Journal
+	w.options.Journal = nil
+	defer func() { w.options.Journal = journal }()
+
+	failed := 0
+	for i := len(j.Entries) - 1; i >= 0; i-- {
+		entry := j.Entries[i]
+		if len(entry.Irreversible) > 0 {
+			fmt.Fprintf(os.Stderr, "[!] Can't undo the change to %s on %s, it has to be reverted by hand\n", strings.Join(entry.Irreversible, ", "), entry.DN)
+		}
+		if err := w.undoEntry(entry); err != nil {
+			w.Log.Errorf("unable to undo %s of %q: %s", entry.Operation, entry.DN, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d change(s) could not be undone", failed, len(j.Entries))
+	}
+	return nil
+}
+
+// undoEntry reverts a change. The inverse modifications of a modify are sent one at a time, and one that has
+// nothing left to do, because the values it deletes are already gone or the ones it adds are back, is skipped
+func (w *LDAPSession) undoEntry(entry JournalEntry) error {
+	switch entry.Operation {
+	case "add":
+		_, err := w.Delete(ldap.NewDelRequest(entry.DN, nil))
+		return err
+	case "delete":
+		return fmt.Errorf("deleted objects can't be restored")
+	case "modify":
+		var controls []ldap.Control
+		if entry.SDFlags != 0 {
+			controls = append(controls, NewSDFlagsControl(entry.SDFlags))
+		}
+		for _, change := range entry.Undo {
+			var values []string
+			for _, e := range change.Values {
+				v, err := base64.StdEncoding.DecodeString(e)
+				if err != nil {
+					return fmt.Errorf("invalid journal value for %s: %s", change.Attribute, err)
+				}
+				values = append(values, string(v))
+			}
+			req := ldap.NewModifyRequest(entry.DN, controls)
+			switch change.Operation {
+			case "add":
+				req.Add(change.Attribute, values)
+			case "delete":
+				req.Delete(change.Attribute, values)
+			case "replace":
+				req.Replace(change.Attribute, values)
+			default:
+				return fmt.Errorf("unknown journal change %q", change.Operation)
+			}
+			_, err := w.Modify(req)
+			switch {
+			case change.Operation == "delete" && ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchAttribute),
+				change.Operation == "add" && ldap.IsErrorWithCode(err, ldap.LDAPResultAttributeOrValueExists):
+				w.Log.Debugf("%s of %s on %q already reverted", change.Operation, change.Attribute, entry.DN)
+			case err != nil:
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown operation %q", entry.Operation)
+}
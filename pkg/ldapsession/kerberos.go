@@ -0,0 +1,185 @@
+package ldapsession
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/go-ldap/ldap/v3/gssapi"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+)
+
+// KerberosBind binds with a ticket for the DC's LDAP service (SASL GSSAPI), for domains that have NTLM turned off.
+// The TGT comes from the ccache if one is given, else it's requested with the keytab or password. The KDC is the DC
+// itself unless --kdc or a krb5.conf says otherwise. No SASL security layer is negotiated, so DCs that require LDAP
+// signing need LDAPS or StartTLS as well
+func (w *LDAPSession) KerberosBind() error {
+	cl, err := w.kerberosClient()
+	if err != nil {
+		return err
+	}
+	defer cl.Destroy()
+	if err = cl.AffirmLogin(); err != nil {
+		if w.clockSkewed() {
+			return fmt.Errorf("kerberos: %s (the DC's clock is %s)", err, describeSkew(w.clockSkew))
+		}
+		return fmt.Errorf("kerberos: %s", err)
+	}
+	host, err := w.serverHostName()
+	if err != nil {
+		return err
+	}
+	principal := fmt.Sprintf("%s@%s", cl.Credentials.UserName(), cl.Credentials.Domain())
+	spn := "ldap/" + host
+	w.Log.Infof("attempting Kerberos bind for %q to %s", principal, spn)
+	if err = w.conn().GSSAPIBind(&gssapi.Client{Client: cl}, spn, ""); err != nil {
+		if w.clockSkewed() {
+			return fmt.Errorf("%s (the DC's clock is %s)", err, describeSkew(w.clockSkew))
+		}
+		return err
+	}
+	// the ccache decides who a session is bound as, so other connections and the lookup cache use the same name
+	if w.options.Username == "" {
+		w.options.Username = principal
+	}
+	return nil
+}
+
+// kerberosClient makes a Kerberos client from the session's credentials
+func (w *LDAPSession) kerberosClient() (*client.Client, error) {
+	options := w.options
+	if options.CCachePath != "" {
+		cc, err := credentials.LoadCCache(strings.TrimPrefix(options.CCachePath, "FILE:"))
+		if err != nil {
+			return nil, fmt.Errorf("error loading ccache %q: %s", options.CCachePath, err)
+		}
+		cfg, err := w.krb5Config(cc.DefaultPrincipal.Realm)
+		if err != nil {
+			return nil, err
+		}
+		return client.NewFromCCache(cc, cfg, client.DisablePAFXFAST(true))
+	}
+
+	user, realm := kerberosPrincipal(options.Username)
+	if options.Realm != "" {
+		realm = options.Realm
+	}
+	if realm == "" {
+		realm = options.Domain
+	}
+	if user == "" || realm == "" {
+		return nil, fmt.Errorf("kerberos needs a ccache, or a username with a realm (user@realm or --realm)")
+	}
+	realm = strings.ToUpper(realm)
+	cfg, err := w.krb5Config(realm)
+	if err != nil {
+		return nil, err
+	}
+	if options.Keytab != "" {
+		kt, err := keytab.Load(options.Keytab)
+		if err != nil {
+			return nil, fmt.Errorf("error loading keytab %q: %s", options.Keytab, err)
+		}
+		return client.NewWithKeytab(user, realm, kt, cfg, client.DisablePAFXFAST(true)), nil
+	}
+	return client.NewWithPassword(user, realm, options.Password, cfg, client.DisablePAFXFAST(true)), nil
+}
+
+// krb5Config loads the krb5.conf given in the options, or makes one that sends requests for the domain's realm to
+// the DC the session is connected to (or the KDC option for the user's realm), so there's nothing to set up on the
+// machine windapsearch runs on. KDCs of other realms, e.g. the user's in forest mode, are found through DNS
+func (w *LDAPSession) krb5Config(realm string) (*config.Config, error) {
+	if w.options.KRB5Config != "" {
+		cfg, err := config.Load(w.options.KRB5Config)
+		if err != nil {
+			return nil, fmt.Errorf("error loading krb5.conf %q: %s", w.options.KRB5Config, err)
+		}
+		return cfg, nil
+	}
+	cfg := config.New()
+	cfg.LibDefaults.DefaultRealm = realm
+	cfg.LibDefaults.DNSLookupKDC = true
+	// AD tickets are often too big for UDP
+	cfg.LibDefaults.UDPPreferenceLimit = 1
+	addRealm := func(realm, kdc string) {
+		if _, _, err := net.SplitHostPort(kdc); err != nil {
+			kdc = net.JoinHostPort(strings.Trim(kdc, "[]"), "88")
+		}
+		cfg.Realms = append(cfg.Realms, config.Realm{Realm: realm, KDC: []string{kdc}})
+	}
+	domain := strings.ToLower(w.options.Domain)
+	domainRealm := strings.ToUpper(domain)
+	switch {
+	case w.options.KDC != "":
+		addRealm(realm, w.options.KDC)
+	case domainRealm == "" || domainRealm == realm:
+		addRealm(realm, w.server)
+	}
+	if domainRealm != "" && domainRealm != realm {
+		addRealm(domainRealm, w.server)
+		// so the ticket for the DC is asked for in its own realm
+		cfg.DomainRealm[domain] = domainRealm
+		cfg.DomainRealm["."+domain] = domainRealm
+	}
+	if w.options.Proxy != "" {
+		w.Log.Warn("Kerberos requests to the KDC don't go through the SOCKS proxy")
+	}
+	return cfg, nil
+}
+
+// serverHostName is the DNS name of the DC the session is connected to, which the LDAP service principal is named
+// after. When connected by address, it's read from the RootDSE, which can be read before binding
+func (w *LDAPSession) serverHostName() (string, error) {
+	if net.ParseIP(w.server) == nil {
+		return w.server, nil
+	}
+	sr := ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)",
+		[]string{"dnsHostName"}, nil)
+	res, err := w.conn().Search(sr)
+	if err != nil {
+		return "", fmt.Errorf("error reading the DC's hostname for Kerberos: %s", err)
+	}
+	if len(res.Entries) == 0 || res.Entries[0].GetAttributeValue("dnsHostName") == "" {
+		return "", fmt.Errorf("couldn't read the DC's hostname for Kerberos, give it as --dc instead of its address")
+	}
+	return res.Entries[0].GetAttributeValue("dnsHostName"), nil
+}
+
+// kerberosPrincipal splits a username (user@realm or DOMAIN\user) into its user and realm
+func kerberosPrincipal(username string) (user, realm string) {
+	if i := strings.Index(username, "\\"); i >= 0 {
+		// the NetBIOS domain isn't the realm
+		username = username[i+1:]
+	}
+	if i := strings.LastIndex(username, "@"); i >= 0 {
+		return username[:i], username[i+1:]
+	}
+	return username, ""
+}
+
+// DefaultCCache is the ccache named by KRB5CCNAME, which is where kinit and impacket's tools leave tickets
+func DefaultCCache() string {
+	return os.Getenv("KRB5CCNAME")
+}
+
+// CCacheTGT reads who a ccache's tickets are for (user@REALM), and whether it holds a TGT that hasn't expired yet
+func CCacheTGT(path string) (string, bool) {
+	cc, err := credentials.LoadCCache(path)
+	if err != nil {
+		return "", false
+	}
+	principal := fmt.Sprintf("%s@%s", cc.GetClientPrincipalName().PrincipalNameString(), cc.GetClientRealm())
+	for _, cred := range cc.GetEntries() {
+		names := cred.Server.PrincipalName.NameString
+		if len(names) > 0 && names[0] == "krbtgt" && cred.EndTime.After(time.Now()) {
+			return principal, true
+		}
+	}
+	return principal, false
+}
@@ -0,0 +1,63 @@
+//go:build linux
+// +build linux
+
+package ldapsession
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SSOCCache is the ccache MIT Kerberos (and so ldapsearch -Y GSSAPI) uses when none is given: KRB5CCNAME, else
+// default_ccache_name from krb5.conf, else /tmp/krb5cc_<uid>. Only file ccaches can be read, so it's empty when the
+// default is a KEYRING:, KCM: or other kind of ccache
+func SSOCCache() string {
+	name := DefaultCCache()
+	if name == "" {
+		name = krb5ConfCCacheName()
+	}
+	if name == "" {
+		name = "FILE:/tmp/krb5cc_%{uid}"
+	}
+	name = strings.NewReplacer("%{uid}", strconv.Itoa(os.Getuid()), "%{euid}", strconv.Itoa(os.Geteuid())).Replace(name)
+	if strings.HasPrefix(name, "FILE:") {
+		return strings.TrimPrefix(name, "FILE:")
+	}
+	if strings.Contains(name, ":") {
+		return ""
+	}
+	return name
+}
+
+// krb5ConfCCacheName reads default_ccache_name from the [libdefaults] of the krb5.conf files MIT Kerberos reads
+// (KRB5_CONFIG, or /etc/krb5.conf)
+func krb5ConfCCacheName() string {
+	paths := "/etc/krb5.conf"
+	if env := os.Getenv("KRB5_CONFIG"); env != "" {
+		paths = env
+	}
+	for _, path := range strings.Split(paths, ":") {
+		fp, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		libdefaults := false
+		scanner := bufio.NewScanner(fp)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(line, "[") {
+				libdefaults = line == "[libdefaults]"
+				continue
+			}
+			kv := strings.SplitN(line, "=", 2)
+			if libdefaults && len(kv) == 2 && strings.TrimSpace(kv[0]) == "default_ccache_name" {
+				fp.Close()
+				return strings.TrimSpace(kv[1])
+			}
+		}
+		fp.Close()
+	}
+	return ""
+}
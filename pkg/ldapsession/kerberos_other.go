@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package ldapsession
+
+// SSOCCache is only looked for on Linux, where kinit leaves tickets in a file ccache by default
+func SSOCCache() string {
+	return ""
+}
@@ -0,0 +1,45 @@
+package ldapsession
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTHash is the NT hash of a password (MD4 of its UTF-16LE encoding) in lowercase hex
+func NTHash(password string) string {
+	h := md4.New()
+	for _, u := range utf16.Encode([]rune(password)) {
+		h.Write([]byte{byte(u), byte(u >> 8)})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// NormalizeHash checks a hash given as an NT hash, LM:NT (as secretsdump writes them) or :NT, and returns the NT
+// hash in lowercase hex, which is all NTLMv2 uses
+func NormalizeHash(hash string) (string, error) {
+	hash = strings.TrimSpace(hash)
+	nt := hash
+	if i := strings.Index(hash, ":"); i >= 0 {
+		lm := hash[:i]
+		nt = hash[i+1:]
+		if lm != "" && !isHashHex(lm) {
+			return "", fmt.Errorf("invalid LM hash in LM:NT, expected 32 hex characters")
+		}
+	}
+	if !isHashHex(nt) {
+		return "", fmt.Errorf("invalid NT hash, expected 32 hex characters (NT, LM:NT or :NT), got %d characters", len(nt))
+	}
+	return strings.ToLower(nt), nil
+}
+
+func isHashHex(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
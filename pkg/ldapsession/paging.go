@@ -0,0 +1,109 @@
+package ldapsession
+
+import (
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	// adaptiveStartPageSize is the first page size used with adaptive paging, small enough for a busy DC
+	adaptiveStartPageSize = 100
+	// adaptiveMinPageSize is as small as adaptive paging will go before giving up on a refused page
+	adaptiveMinPageSize = 10
+	// pages faster than adaptiveFastPage grow the page size, slower than adaptiveSlowPage shrink it
+	adaptiveFastPage = 500 * time.Millisecond
+	adaptiveSlowPage = 5 * time.Second
+)
+
+// pageTuner picks the size of each page of a streamed search. With a fixed page size it always returns the session's
+// PageSize. With adaptive paging it starts small, doubles while pages come back quickly (up to PageSize), halves when
+// they're slow, and halves before a page the DC refused as too expensive is asked for again
+type pageTuner struct {
+	size     uint32
+	max      uint32
+	adaptive bool
+}
+
+func (w *LDAPSession) newPageTuner() *pageTuner {
+	t := &pageTuner{size: w.PageSize, max: w.PageSize, adaptive: w.options.AdaptivePaging}
+	if t.adaptive && t.size > adaptiveStartPageSize {
+		t.size = adaptiveStartPageSize
+	}
+	return t
+}
+
+// observe adjusts the page size after a page took d to come back
+func (t *pageTuner) observe(d time.Duration) {
+	if !t.adaptive {
+		return
+	}
+	switch {
+	case d < adaptiveFastPage && t.size < t.max:
+		t.size *= 2
+		if t.size > t.max {
+			t.size = t.max
+		}
+	case d > adaptiveSlowPage && t.size > adaptiveMinPageSize:
+		t.shrink()
+	}
+}
+
+// shrink halves the page size, returning false if it can't get any smaller
+func (t *pageTuner) shrink() bool {
+	if !t.adaptive || t.size <= adaptiveMinPageSize {
+		return false
+	}
+	t.size /= 2
+	if t.size < adaptiveMinPageSize {
+		t.size = adaptiveMinPageSize
+	}
+	return true
+}
+
+// pageRefused is true for the errors a DC returns when a page is too expensive to build right now, which a smaller
+// page may get past
+func pageRefused(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.LDAPResultBusy) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultAdminLimitExceeded)
+}
+
+// abandonPaging sends a request for a page of size 0 with the last cookie, which is how RFC 2696 has a client give up
+// on a paged search so the DC frees the results it's holding. Nothing is sent if the connection was already closed
+func (w *LDAPSession) abandonPaging(searchRequest *ldap.SearchRequest, pagingControl *ldap.ControlPaging) {
+	if w.conn().IsClosing() {
+		return
+	}
+	w.Log.Debugf("Abandoning Paging...")
+	pagingControl.PagingSize = 0
+	if _, err := w.conn().Search(searchRequest); err != nil {
+		w.Log.Debugf("error abandoning paged search: %s", err)
+	}
+}
+
+// cancellable runs a search, abandoning it and closing the connection if the session is cancelled while the search
+// is in flight. The Abandon stops the DC working on the search. go-ldap (v3.4.8) only gives up on a search when its
+// connection closes, so closing it is what unblocks the search, which then returns the session's context error, and
+// nothing later can read a stray response meant for it
+func (w *LDAPSession) cancellable(search func() (*ldap.SearchResult, error)) (*ldap.SearchResult, error) {
+	conn, wire := w.connections()
+	mark := wire.mark()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-w.ctx.Done():
+			w.Log.Warn("cancel received during a search, abandoning it and closing the connection")
+			wire.abandonSince(mark)
+			conn.Close()
+		case <-done:
+		}
+	}()
+	result, err := search()
+	registerSecrets(result)
+	if err != nil && w.ctx.Err() != nil {
+		// the search failed because the connection was closed under it, which isn't the DC's doing
+		err = w.ctx.Err()
+	}
+	return result, err
+}
@@ -0,0 +1,52 @@
+package ldapsession
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestCancelledSearchIsAbandoned(t *testing.T) {
+	client, server := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	searched := make(chan int64, 1)
+	abandoned := make(chan int64, 1)
+	// a DC that's slow to answer searches, which are cancelled while it works on them
+	go func() {
+		defer server.Close()
+		for {
+			req, err := ber.ReadPacket(server)
+			if err != nil {
+				return
+			}
+			switch op := req.Children[1]; op.Tag {
+			case ldap.ApplicationSearchRequest:
+				searched <- req.Children[0].Value.(int64)
+				cancel()
+			case ldap.ApplicationAbandonRequest:
+				id, _ := ber.ParseInt64(op.Data.Bytes())
+				abandoned <- id
+			}
+		}
+	}()
+	w := pipeSession(t, ctx, client, nil)
+
+	_, err := w.GetSearchResults(w.MakeSimpleSearchRequest("(objectClass=user)", []string{"cn"}))
+	if err != context.Canceled {
+		t.Errorf("expected the search to fail with %v, got %v", context.Canceled, err)
+	}
+	id := <-searched
+	select {
+	case got := <-abandoned:
+		if got != id {
+			t.Errorf("abandoned message %d, the search was %d", got, id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cancelled search wasn't abandoned")
+	}
+}
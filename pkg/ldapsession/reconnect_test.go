@@ -0,0 +1,159 @@
+package ldapsession
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/sirupsen/logrus"
+)
+
+func userEntry(cn string) fakeEntry {
+	return fakeEntry{dn: "CN=" + cn + ",CN=Users,DC=lab,DC=local", attrs: [][2]string{{"cn", cn}}}
+}
+
+// droppingServer is a DC that hangs up when asked for the second page on its first connection, and on later ones
+// refuses the cookie from it (as a DC does for a paged search it isn't holding) and answers a search from the start
+// with every entry
+func droppingServer(t *testing.T) (host string, port int, connections func() int) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var mu sync.Mutex
+	accepted := 0
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			first := accepted == 0
+			accepted++
+			mu.Unlock()
+			serveFake(conn, func(id int64, req *ber.Packet) ([]*ber.Packet, bool) {
+				op := req.Children[1].Tag
+				if op != ldap.ApplicationSearchRequest {
+					return []*ber.Packet{response(id, resultDone(op+1))}, false
+				}
+				if req.Children[1].Children[0].Value.(string) == "" {
+					// the RootDSE, read for the DC's clock
+					return []*ber.Packet{response(id, resultDone(ldap.ApplicationSearchResultDone))}, false
+				}
+				cookie := requestCookie(req)
+				switch {
+				case first && cookie == nil:
+					page := ldap.NewControlPaging(2)
+					page.SetCookie([]byte("page2"))
+					return []*ber.Packet{
+						response(id, searchEntry(userEntry("alice"))),
+						response(id, searchEntry(userEntry("bob"))),
+						response(id, resultDone(ldap.ApplicationSearchResultDone), page),
+					}, false
+				case first:
+					return nil, true
+				case cookie != nil:
+					return []*ber.Packet{response(id, resultCode(ldap.ApplicationSearchResultDone, ldap.LDAPResultUnwillingToPerform))}, false
+				}
+				return []*ber.Packet{
+					response(id, searchEntry(userEntry("alice"))),
+					response(id, searchEntry(userEntry("bob"))),
+					response(id, searchEntry(userEntry("carol"))),
+					response(id, resultDone(ldap.ApplicationSearchResultDone), ldap.NewControlPaging(0)),
+				}, false
+			})
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return accepted
+	}
+}
+
+func reconnectingSession(t *testing.T, host string, port int) *LDAPSession {
+	t.Helper()
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	w := &LDAPSession{
+		BaseDN:    "DC=lab,DC=local",
+		Log:       logger.WithField("package", "ldapsession"),
+		baseLog:   logger.WithField("package", "ldapsession"),
+		logFields: logrus.Fields{},
+		ctx:       context.Background(),
+		stats:     &searchStats{},
+		options:   LDAPSessionOptions{PageSize: 2, Retries: 2, Reconnect: true},
+	}
+	if err := w.connect(host, port); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.conn().Close() })
+	return w
+}
+
+func assertUsers(t *testing.T, got []string, connections int) {
+	t.Helper()
+	want := []string{"alice", "bob", "carol"}
+	if len(got) != len(want) {
+		t.Fatalf("got entries %v, want %v once each", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got entries %v, want %v once each", got, want)
+		}
+	}
+	if connections != 2 {
+		t.Errorf("expected one reconnect, the server saw %d connections", connections)
+	}
+}
+
+func TestReconnectStartsOverWhenCookieRefused(t *testing.T) {
+	host, port, connections := droppingServer(t)
+	w := reconnectingSession(t, host, port)
+	w.NewChannels(context.Background())
+
+	var got []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range w.Channels.Entries {
+			got = append(got, e.GetAttributeValue("cn"))
+		}
+	}()
+	go func() {
+		for range w.Channels.Controls {
+		}
+	}()
+	err := w.ExecuteSearchRequest(w.MakeSimpleSearchRequest("(objectClass=user)", []string{"cn"}))
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertUsers(t, got, connections())
+}
+
+func TestPagedSearchStartsOverWhenCookieRefused(t *testing.T) {
+	host, port, connections := droppingServer(t)
+	w := reconnectingSession(t, host, port)
+
+	p := w.NewPagedSearch(w.MakeSimpleSearchRequest("(objectClass=user)", []string{"cn"}))
+	var got []string
+	for !p.Done() {
+		res, err := p.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range res.Entries {
+			got = append(got, e.GetAttributeValue("cn"))
+		}
+	}
+	assertUsers(t, got, connections())
+}
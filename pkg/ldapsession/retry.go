@@ -0,0 +1,101 @@
+package ldapsession
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	// DefaultRetries is how many times a search or page is retried after a transient error
+	DefaultRetries = 3
+	// retryBaseDelay is the wait before the first retry, doubled for each one after it up to retryMaxDelay
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 30 * time.Second
+)
+
+// transient is true for the result codes a DC returns when it can't answer right now but may in a moment: busy,
+// unavailable, and timeLimitExceeded (the DC gave up on the search while under load)
+func transient(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.LDAPResultBusy) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultUnavailable) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultTimeLimitExceeded)
+}
+
+// unreachable is true for the errors connecting to a DC fails with when another DC (or the same one, a moment
+// later) may work: it couldn't be reached, dropped the connection, or is busy. Errors like invalid credentials fail
+// the same way everywhere, so they aren't
+func unreachable(err error) bool {
+	var netErr net.Error
+	return transient(err) || ldap.IsErrorWithCode(err, ldap.ErrorNetwork) || errors.As(err, &netErr)
+}
+
+// dropped is true when a search failed because the connection was lost, and the session should reconnect. The
+// LDAP library reports a connection the DC closed with a plain error, so it's told by the connection having closed.
+// A cancelled session closes the connection itself, so that isn't
+func (w *LDAPSession) dropped(err error) bool {
+	return err != nil && w.options.Reconnect && w.ctx.Err() == nil &&
+		(ldap.IsErrorWithCode(err, ldap.ErrorNetwork) || w.conn().IsClosing())
+}
+
+// cookieRejected is true when a page asked for with a paging cookie on a new connection failed with an LDAP error.
+// A DC keeps a paged search's state per connection, and another DC never had it, so the cookie from the lost
+// connection may well be refused
+func (w *LDAPSession) cookieRejected(err error, reconnected bool, cookie []byte) bool {
+	return err != nil && reconnected && len(cookie) > 0 && !transient(err) && !w.dropped(err) && w.ctx.Err() == nil
+}
+
+// seenEntries are the DNs a paged search has returned, for a session that reconnects. A search whose cookie a new
+// connection refuses starts over, and skips the entries it already returned
+type seenEntries map[string]bool
+
+// fresh records entries as seen, returning the ones that weren't already
+func (s seenEntries) fresh(entries []*ldap.Entry) []*ldap.Entry {
+	if s == nil {
+		return entries
+	}
+	out := entries[:0:0]
+	for _, e := range entries {
+		if dn := strings.ToLower(e.DN); !s[dn] {
+			s[dn] = true
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// backoff waits before retry number attempt (starting at 1), returning early if the session is cancelled
+func (w *LDAPSession) backoff(attempt int) {
+	delay := retryBaseDelay << uint(attempt-1)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	select {
+	case <-time.After(delay):
+	case <-w.ctx.Done():
+	}
+}
+
+// withRetries runs a synchronous search, retrying it with exponential backoff while it fails with a transient error,
+// or reconnecting first if the connection dropped and the session reconnects. The request's controls are put back
+// before every attempt, so a paging cookie left by a failed attempt isn't reused
+func (w *LDAPSession) withRetries(request *ldap.SearchRequest, search func() (*ldap.SearchResult, error)) (*ldap.SearchResult, error) {
+	controls := request.Controls
+	for attempt := 1; ; attempt++ {
+		request.Controls = controls
+		result, err := search()
+		if err == nil || !(transient(err) || w.dropped(err)) || attempt > w.options.Retries || w.ctx.Err() != nil {
+			return result, err
+		}
+		w.Log.Warnf("search %q failed (%s), retrying (%d/%d)", request.Filter, err, attempt, w.options.Retries)
+		w.backoff(attempt)
+		if w.dropped(err) {
+			if rerr := w.Reconnect(); rerr != nil {
+				w.Log.Warnf("unable to reconnect: %s", rerr)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package ldapsession
+
+import (
+	"fmt"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+)
+
+// validAccesses value of a controlAccessRight that is a property set (read and write property)
+const propertySetAccesses = "48"
+
+// LoadSchemaGUIDs reads the name of every class and attribute in the schema partition, and of every extended right,
+// validated write and property set in the Extended-Rights container, so ACEs that refer to them are rendered by name.
+// This picks up schema extensions (e.g. LAPS, Exchange) that the built in list can't know the GUIDs of. It returns
+// the number of names read
+func (w *LDAPSession) LoadSchemaGUIDs() (int, error) {
+	if w.NamingContexts.Schema == "" || w.NamingContexts.Configuration == "" {
+		return 0, fmt.Errorf("schema and configuration partitions are unknown")
+	}
+	count := 0
+
+	sr := w.MakeSimpleSearchRequest("(schemaIDGUID=*)", []string{"schemaIDGUID", "lDAPDisplayName"})
+	sr.BaseDN = w.NamingContexts.Schema
+	res, err := w.GetPagedSearchResults(sr)
+	if err != nil {
+		return count, fmt.Errorf("unable to read schema: %s", err)
+	}
+	for _, entry := range res.Entries {
+		b := entry.GetRawAttributeValue("schemaIDGUID")
+		if len(b) != 16 {
+			continue
+		}
+		var g secdesc.GUID
+		copy(g[:], b)
+		secdesc.RegisterSchemaObject(g, entry.GetAttributeValue("lDAPDisplayName"))
+		count++
+	}
+
+	sr = ldap.NewSearchRequest("CN=Extended-Rights,"+w.NamingContexts.Configuration, ldap.ScopeSingleLevel,
+		ldap.NeverDerefAliases, 0, 0, false, "(objectClass=controlAccessRight)",
+		[]string{"rightsGuid", "cn", "validAccesses"}, nil)
+	res, err = w.GetPagedSearchResults(sr)
+	if err != nil {
+		return count, fmt.Errorf("unable to read extended rights: %s", err)
+	}
+	for _, entry := range res.Entries {
+		// rightsGuid is stored as a string, unlike schemaIDGUID
+		g, err := secdesc.ParseGUID(entry.GetAttributeValue("rightsGuid"))
+		if err != nil {
+			continue
+		}
+		if entry.GetAttributeValue("validAccesses") == propertySetAccesses {
+			secdesc.RegisterSchemaObject(g, entry.GetAttributeValue("cn"))
+		} else {
+			secdesc.RegisterRight(g, entry.GetAttributeValue("cn"))
+		}
+		count++
+	}
+	return count, nil
+}
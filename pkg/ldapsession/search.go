@@ -3,11 +3,25 @@ package ldapsession
 import (
 	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/go-ldap/ldap/v3"
 	"github.com/sirupsen/logrus"
 )
 
+// MakeSimpleSearchRequest returns a subtree search of the BaseDN. If nTSecurityDescriptor is requested, the SD flags
+// control is added so it's returned (without the SACL) to accounts that can't read SACLs
 func (w *LDAPSession) MakeSimpleSearchRequest(filter string, attrs []string) *ldap.SearchRequest {
+	var controls []ldap.Control
+	for _, a := range attrs {
+		if strings.EqualFold(a, "nTSecurityDescriptor") {
+			controls = append(controls, NewSDFlagsControl(OwnerSecurityInformation|GroupSecurityInformation|DACLSecurityInformation))
+			break
+		}
+	}
 	return ldap.NewSearchRequest(
 		w.BaseDN,
 		ldap.ScopeWholeSubtree,
@@ -15,24 +29,81 @@ func (w *LDAPSession) MakeSimpleSearchRequest(filter string, attrs []string) *ld
 		0, 0, false,
 		filter,
 		attrs,
-		nil)
+		controls)
 }
 
 // GetPagedSearchResults is a synchronous operation that will populate and return an ldap.SearchResult object
 func (w *LDAPSession) GetPagedSearchResults(request *ldap.SearchRequest) (result *ldap.SearchResult, err error) {
 	w.Log.WithFields(logrus.Fields{"filter": request.Filter, "attributes": request.Attributes}).Infof("sending LDAP search request")
-	return w.LConn.SearchWithPaging(request, 1000)
+	w.addControls(request)
+	if err := w.recordSearch(request); err != nil {
+		return nil, err
+	}
+	return w.cachedSearch(request, func() (*ldap.SearchResult, error) {
+		return w.withRetries(request, func() (*ldap.SearchResult, error) {
+			return w.cancellable(func() (*ldap.SearchResult, error) { return w.conn().SearchWithPaging(request, 1000) })
+		})
+	})
 }
 
 func (w *LDAPSession) GetSearchResults(request *ldap.SearchRequest) (result *ldap.SearchResult, err error) {
 	w.Log.WithFields(logrus.Fields{"filter": request.Filter, "attributes": request.Attributes}).Infof("sending LDAP search request")
-	return w.LConn.Search(request)
+	w.addControls(request)
+	if err := w.recordSearch(request); err != nil {
+		return nil, err
+	}
+	return w.cachedSearch(request, func() (*ldap.SearchResult, error) {
+		return w.withRetries(request, func() (*ldap.SearchResult, error) {
+			return w.cancellable(func() (*ldap.SearchResult, error) { return w.conn().Search(request) })
+		})
+	})
 }
 
-func (w *LDAPSession) ManualWriteSearchResultsToChan(results *ldap.SearchResult) {
-	w.Log.Debugf("received search results, writing %d entries to channel", len(results.Entries))
+// GetSampledSearchResults returns only the first limit results of a search. It pages through them itself, and
+// abandons the search once it has enough, so the DC doesn't go on to build the rest of a large result set
+func (w *LDAPSession) GetSampledSearchResults(request *ldap.SearchRequest, limit int) (*ldap.SearchResult, error) {
+	w.Log.WithFields(logrus.Fields{"filter": request.Filter, "attributes": request.Attributes, "limit": limit}).Infof("sending sampled LDAP search request")
+	w.addControls(request)
+	if err := w.recordSearch(request); err != nil {
+		return nil, err
+	}
+	size := uint32(1000)
+	if limit < int(size) {
+		size = uint32(limit)
+	}
+	paging := ldap.NewControlPaging(size)
+	sampled := *request
+	sampled.Controls = append(append([]ldap.Control(nil), request.Controls...), paging)
+	result := &ldap.SearchResult{}
+	for len(result.Entries) < limit {
+		res, err := w.cancellable(func() (*ldap.SearchResult, error) { return w.conn().Search(&sampled) })
+		if err != nil {
+			return nil, err
+		}
+		result.Entries = append(result.Entries, res.Entries...)
+		result.Referrals = append(result.Referrals, res.Referrals...)
+		control, ok := ldap.FindControl(res.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+		if !ok || len(control.Cookie) == 0 {
+			return result, nil
+		}
+		paging.SetCookie(control.Cookie)
+	}
+	w.abandonPaging(&sampled, paging)
+	result.Entries = result.Entries[:limit]
+	return result, nil
+}
 
+// ManualWriteSearchResultsToChan writes a module's results to the channels and closes them, for modules that send
+// all their results at once
+func (w *LDAPSession) ManualWriteSearchResultsToChan(results *ldap.SearchResult) {
 	defer w.CloseChannels()
+	w.WriteSearchResultsToChan(results)
+}
+
+// WriteSearchResultsToChan writes results to the channels without closing them, for modules that send their results
+// a batch at a time (e.g. a page at a time). The channels are closed once the module returns
+func (w *LDAPSession) WriteSearchResultsToChan(results *ldap.SearchResult) {
+	w.Log.Debugf("received search results, writing %d entries to channel", len(results.Entries))
 
 	for _, entry := range results.Entries {
 		w.Channels.Entries <- entry
@@ -60,6 +131,19 @@ func (w *LDAPSession) ExecuteSearchRequest(searchRequest *ldap.SearchRequest) er
 		w.CloseChannels()
 	}()
 
+	referrals, err := w.executePagedSearch(searchRequest)
+	if err != nil {
+		return err
+	}
+	if w.options.Referrals == ReferralsFollow {
+		w.followReferrals(searchRequest, referrals)
+	}
+	return nil
+}
+
+// executePagedSearch does the actual paging for ExecuteSearchRequest, without closing the channels when it's done.
+// If the session is following referrals, they are returned instead of being written to the Referrals channel
+func (w *LDAPSession) executePagedSearch(searchRequest *ldap.SearchRequest) (referrals []string, err error) {
 	// basically a re-implementation of the standard function: https://github.com/go-ldap/ldap/blob/master/v3/search.go#L253
 	// but writes entries to a channel as it gets them instead of waiting for all pages to complete
 
@@ -71,40 +155,115 @@ func (w *LDAPSession) ExecuteSearchRequest(searchRequest *ldap.SearchRequest) er
 	} else {
 		castControl, ok := control.(*ldap.ControlPaging)
 		if !ok {
-			return fmt.Errorf("expected paging control to be of type *ControlPaging, got %v", control)
+			return nil, fmt.Errorf("expected paging control to be of type *ControlPaging, got %v", control)
 		}
 		if castControl.PagingSize != w.PageSize {
-			return fmt.Errorf("paging size given in search request (%d) conflicts with size given in search call (%d)", castControl.PagingSize, w.PageSize)
+			return nil, fmt.Errorf("paging size given in search request (%d) conflicts with size given in search call (%d)", castControl.PagingSize, w.PageSize)
 		}
 		pagingControl = castControl
 	}
 	pageNumber := 0
+	retries := 0
+	// reconnected is set while the page after a reconnect hasn't come back yet
+	reconnected := false
+	var seen seenEntries
+	if w.options.Reconnect {
+		seen = make(seenEntries)
+	}
+	tuner := w.newPageTuner()
+	w.addControls(searchRequest)
+	if err := w.recordSearch(searchRequest); err != nil {
+		return nil, err
+	}
+	// if the search stops early (cancelled, or an error after the first page), tell the DC to drop the rest of the
+	// results instead of holding them for a cookie that will never come back
+	defer func() {
+		if pagingControl != nil && len(pagingControl.Cookie) > 0 {
+			w.abandonPaging(searchRequest, pagingControl)
+		}
+	}()
 
 PagedSearch:
 	for {
 		select {
 		case <-w.ctx.Done():
 			w.Log.Warn("cancel received. aborting remaining pages")
-			return nil
+			w.warnIncomplete("search %q cancelled after %d page(s)", searchRequest.Filter, pageNumber)
+			return referrals, nil
 		default:
 			w.Log.Debugf("making paged request...\n")
-			result, err := w.LConn.Search(searchRequest)
+			pagingControl.PagingSize = tuner.size
+			start := time.Now()
+			result, err := w.cancellable(func() (*ldap.SearchResult, error) { return w.conn().Search(searchRequest) })
+			elapsed := time.Since(start)
+			if err != nil && w.ctx.Err() != nil {
+				w.Log.Warn("cancel received. aborting remaining pages")
+				w.warnIncomplete("search %q cancelled on page %d", searchRequest.Filter, pageNumber+1)
+				return referrals, nil
+			}
 			w.Log.Debugf("Looking for Paging Control...\n")
 			pageNumber++
+			if err != nil && pageRefused(err) && tuner.shrink() {
+				w.Log.WithField("page", pageNumber).Infof("page %d refused (%s), asking again with page size %d", pageNumber, err, tuner.size)
+				pageNumber--
+				continue
+			}
+			if err != nil && transient(err) && retries < w.options.Retries {
+				// the cookie is unchanged, so this asks for the same page again
+				retries++
+				w.Log.WithField("page", pageNumber).Warnf("page %d failed (%s), retrying (%d/%d)", pageNumber, err, retries, w.options.Retries)
+				w.backoff(retries)
+				pageNumber--
+				continue
+			}
+			if err != nil && w.dropped(err) && retries < w.options.Retries {
+				// the page is asked for again on the new connection with the same cookie, which may or may not be
+				// honored there
+				retries++
+				w.Log.WithField("page", pageNumber).Warnf("connection lost on page %d (%s), reconnecting (%d/%d)", pageNumber, err, retries, w.options.Retries)
+				w.backoff(retries)
+				if rerr := w.Reconnect(); rerr != nil {
+					w.Log.Warnf("unable to reconnect: %s", rerr)
+				}
+				reconnected = true
+				pageNumber--
+				continue
+			}
+			if w.cookieRejected(err, reconnected, pagingControl.Cookie) {
+				w.Log.WithField("page", pageNumber).Warnf("the new connection refused the search's paging cookie (%s), starting the search over", err)
+				pagingControl.SetCookie(nil)
+				reconnected = false
+				pageNumber = 0
+				continue
+			}
 			if err != nil {
-				return err
+				// entries from earlier pages have already been sent, so the results are partial rather than missing
+				if truncated(err) || pageNumber > 1 {
+					w.warnIncomplete("search %q stopped on page %d: %s", searchRequest.Filter, pageNumber, err)
+				}
+				return referrals, err
 			}
 			if result == nil {
-				return ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: packet not received"))
+				return referrals, ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: packet not received"))
 			}
 
+			// after starting over, the entries sent before the connection was lost come round again
+			result.Entries = seen.fresh(result.Entries)
 			for _, entry := range result.Entries {
 				w.Channels.Entries <- entry
 			}
 
-			w.Log.Infof("Received page %d with %d LDAP entries...", pageNumber, len(result.Entries))
+			w.Log.WithField("page", pageNumber).Infof("Received page %d with %d LDAP entries...", pageNumber, len(result.Entries))
+			w.countPage(len(result.Entries))
+			tuner.observe(elapsed)
+			retries = 0
+			reconnected = false
 
 			for _, referral := range result.Referrals {
+				if w.options.Referrals == ReferralsFollow {
+					referrals = append(referrals, referral)
+					continue
+				}
 				w.Channels.Referrals <- referral
 			}
 
@@ -129,11 +288,88 @@ PagedSearch:
 			pagingControl.SetCookie(cookie)
 		}
 	}
+	return referrals, nil
+}
 
-	if pagingControl != nil {
-		w.Log.Debugf("Abandoning Paging...")
-		pagingControl.PagingSize = 0
-		w.LConn.Search(searchRequest)
+// followReferrals repeats a search against every referred server and naming context, writing entries to the
+// current session's channels. Referrals that can't be followed are logged and skipped so the rest of the results still come through
+func (w *LDAPSession) followReferrals(searchRequest *ldap.SearchRequest, referrals []string) {
+	seen := make(map[string]bool)
+	for _, referral := range referrals {
+		if seen[referral] {
+			continue
+		}
+		seen[referral] = true
+		log := w.Log.WithField("referral", referral)
+
+		host, port, secure, baseDN, err := parseReferral(referral)
+		if err != nil {
+			log.Warnf("unable to parse referral: %s", err)
+			continue
+		}
+		if baseDN == "" {
+			baseDN = searchRequest.BaseDN
+		}
+
+		log.Infof("following referral to %s", host)
+		child, err := w.NewSessionForServer(host, port, secure)
+		if err != nil {
+			log.Warnf("unable to connect to referred server: %s", err)
+			w.warnIncomplete("referral to %s not followed: %s", host, err)
+			continue
+		}
+		child.SetChannels(w.Channels, w.ctx)
+		child.stats = w.stats
+
+		var controls []ldap.Control
+		for _, c := range searchRequest.Controls {
+			if c.GetControlType() != ldap.ControlTypePaging {
+				controls = append(controls, c)
+			}
+		}
+		req := ldap.NewSearchRequest(
+			baseDN,
+			searchRequest.Scope,
+			searchRequest.DerefAliases,
+			searchRequest.SizeLimit, searchRequest.TimeLimit, searchRequest.TypesOnly,
+			searchRequest.Filter,
+			searchRequest.Attributes,
+			controls)
+		if _, err = child.executePagedSearch(req); err != nil {
+			log.Warnf("error searching referred server: %s", err)
+			w.warnIncomplete("referral to %s failed: %s", host, err)
+		}
+		child.Close()
 	}
-	return nil
+}
+
+// parseReferral splits an LDAP URL (e.g. ldap://ForestDnsZones.lab.local/DC=ForestDnsZones,DC=lab,DC=local) into
+// the parts needed to open a new session
+func parseReferral(referral string) (host string, port int, secure bool, baseDN string, err error) {
+	u, err := url.Parse(referral)
+	if err != nil {
+		return
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "ldap":
+		port = 389
+	case "ldaps":
+		port = 636
+		secure = true
+	default:
+		err = fmt.Errorf("unsupported referral scheme %q", u.Scheme)
+		return
+	}
+	host = u.Hostname()
+	if host == "" {
+		err = fmt.Errorf("referral has no host")
+		return
+	}
+	if p := u.Port(); p != "" {
+		if port, err = strconv.Atoi(p); err != nil {
+			return
+		}
+	}
+	baseDN = strings.TrimPrefix(u.Path, "/")
+	return
 }
@@ -3,14 +3,21 @@ package ldapsession
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/net/proxy"
 
 	"github.com/go-ldap/ldap/v3"
 	"github.com/ropnop/go-windapsearch/pkg/dns"
+	"github.com/ropnop/go-windapsearch/pkg/redact"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,26 +30,123 @@ type LDAPSessionOptions struct {
 	UseNTLM          bool
 	Port             int
 	Secure           bool
+	StartTLS         bool
 	Proxy            string
 	PageSize         int
-	Logger           *logrus.Logger
+	Referrals        ReferralPolicy
+	Resolver         *dns.Resolver
+	IPVersion        string
+	SkipCLDAP        bool
+	Writes           WriteMode
+	Journal          *Journal
+	Cache            *Cache
+	AdaptivePaging   bool
+	Retries          int
+	// Reconnect opens a new connection, to the same DC or the next one found, when the one a search is using drops,
+	// and carries on the search without repeating entries, up to Retries times
+	Reconnect bool
+	// TLSVerify checks the DC's certificate against the system's CAs, or CACert's if one is given (which implies
+	// it), for TLSServerName (default: the DC's name). ClientCert and ClientKey are a certificate to present, which
+	// binds as the account it's mapped to when there's no username
+	TLSVerify     bool
+	CACert        string
+	TLSServerName string
+	ClientCert    string
+	ClientKey     string
+	// CurrentUser binds as the logged on user through SSPI instead (Windows only), without any credentials
+	CurrentUser bool
+	// UseKerberos binds with Kerberos (SASL GSSAPI) instead, with a TGT from CCachePath, or one requested with the
+	// Keytab or Password. Realm defaults to the username's domain, and KDC to the DC. KRB5Config is a krb5.conf to
+	// use instead of those
+	UseKerberos bool
+	CCachePath  string
+	Keytab      string
+	Realm       string
+	KDC         string
+	KRB5Config  string
+	// Controls are attached to every search made through the session, replacing any of the same type it would
+	// otherwise send
+	Controls []ldap.Control
+	// IgnorePrimaryGroup leaves accounts' primary group (primaryGroupID) out of group membership, as member and
+	// memberOf do, instead of adding it
+	IgnorePrimaryGroup bool
+	// WireDebug dumps every packet sent and received on the connection to the Logger's output, with the
+	// credentials redacted
+	WireDebug bool
+	Logger    *logrus.Logger
+}
+
+// ReferralPolicy controls what happens to search result references (referrals) returned by the server
+type ReferralPolicy string
+
+const (
+	// ReferralsIgnore silently drops referrals (default)
+	ReferralsIgnore ReferralPolicy = "ignore"
+	// ReferralsFollow opens a new authenticated connection to each referred server and repeats the search there
+	ReferralsFollow ReferralPolicy = "follow"
+	// ReferralsReport passes referrals through on the Referrals channel so the caller can display them
+	ReferralsReport ReferralPolicy = "report"
+)
+
+// ParseIPVersion validates an IP version preference from the command line: 4, 6 or auto
+func ParseIPVersion(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "4", "6":
+		return s, nil
+	case "auto", "":
+		return "auto", nil
+	}
+	return "", fmt.Errorf("invalid IP version %q (must be one of 4, 6, auto)", s)
+}
+
+// ParseReferralPolicy validates a referral policy string from the command line
+func ParseReferralPolicy(s string) (ReferralPolicy, error) {
+	switch p := ReferralPolicy(strings.ToLower(s)); p {
+	case ReferralsIgnore, ReferralsFollow, ReferralsReport:
+		return p, nil
+	case "":
+		return ReferralsIgnore, nil
+	}
+	return "", fmt.Errorf("invalid referral policy %q (must be one of follow, ignore, report)", s)
 }
 
 type LDAPSession struct {
-	LConn       *ldap.Conn
-	PageSize    uint32
-	BaseDN      string
-	DomainInfo  DomainInfo
-	Log         *logrus.Entry
-	resultsChan chan *ldap.Entry
-	ctx         context.Context
-	Channels    *ResultChannels
+	// LConn is the connection to the DC. Reconnect replaces it, so it's read through conn() inside the package
+	LConn          *ldap.Conn
+	PageSize       uint32
+	BaseDN         string
+	NamingContexts NamingContexts
+	DomainInfo     DomainInfo
+	Log            *logrus.Entry
+	baseLog        *logrus.Entry
+	logFields      logrus.Fields
+	resultsChan    chan *ldap.Entry
+	ctx            context.Context
+	Channels       *ResultChannels
+	options        LDAPSessionOptions
+	server         string
+	port           int
+	// wire is the network connection under LConn, to abandon searches on
+	wire *wireConn
+	// connMu guards LConn, wire and server while Reconnect replaces them, and reconnectMu stops two searches that lost
+	// the same connection reconnecting twice
+	connMu      sync.RWMutex
+	reconnectMu sync.Mutex
+	// candidates are the DCs found for the domain, in the order they're tried
+	candidates   []string
+	sids         *SIDResolver
+	sidsOnce     sync.Once
+	identity     string
+	identityOnce sync.Once
+	stats        *searchStats
+	clockSkew    time.Duration
 }
 
 type ResultChannels struct {
 	Entries   chan *ldap.Entry
 	Referrals chan string
 	Controls  chan ldap.Control
+	closeOnce sync.Once
 }
 
 type DomainInfo struct {
@@ -53,15 +157,33 @@ type DomainInfo struct {
 	ServerDNSName                      string
 }
 
+// wireDebugOnce points the LDAP library's logger, which is global, at the first wire debugging session's output
+var wireDebugOnce sync.Once
+
+// wireDebugLogger sends the LDAP library's packet dumps to logger's output, through redact, since they hold the bind
+// requests and whatever passwords are set, with the values of confidential attributes masked
+func wireDebugLogger(logger *logrus.Logger) {
+	wireDebugOnce.Do(func() {
+		ldap.Logger(log.New(confidentialWriter(redact.Writer(logger.Out)), "", log.LstdFlags))
+	})
+}
+
 func NewLDAPSession(options *LDAPSessionOptions, ctx context.Context) (sess *LDAPSession, err error) {
 	logger := logrus.New()
+	logger.SetFormatter(&redact.Formatter{Formatter: logger.Formatter})
 	if options.Logger != nil {
 		logger = options.Logger
 	}
-	sess = &LDAPSession{Log: logger.WithFields(logrus.Fields{"package": "ldapsession"})}
+	redact.Add(options.Password, options.Hash)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// searches made while setting up the session can be cancelled too
+	sess = &LDAPSession{Log: logger.WithFields(logrus.Fields{"package": "ldapsession"}), options: *options, stats: &searchStats{}, ctx: ctx}
 
 	port := options.Port
-	dc := options.DomainController
+	// IPv6 literals may be given bracketed, but they're joined with the port later
+	dc := strings.Trim(options.DomainController, "[]")
 	if port == 0 {
 		if options.Secure {
 			port = 636
@@ -69,76 +191,362 @@ func NewLDAPSession(options *LDAPSessionOptions, ctx context.Context) (sess *LDA
 			port = 389
 		}
 	}
+	candidates := []string{dc}
 	if dc == "" {
-		dcs, err := dns.FindLDAPServers(options.Domain)
+		dcs, err := sess.Resolver().FindLDAPServers(options.Domain)
 		if err != nil {
 			return sess, err
 		}
-		dc = dcs[0]
-		sess.Log.Infof("Found LDAP server via DNS: %s", dc)
+		if dcs, err = sess.Resolver().SelectAddresses(dcs, options.IPVersion); err != nil {
+			return sess, err
+		}
+		if !options.SkipCLDAP && options.Proxy == "" {
+			dcs = sess.validateDCs(dcs, options.Domain)
+		}
+		candidates = dcs
+		sess.Log.Infof("Found LDAP server(s) via DNS: %s", strings.Join(dcs, ", "))
 	}
+
+	// DCs are tried in the order they were found (SRV priority, then weight), moving on to the next one when a DC
+	// can't be reached. If none can, they're all tried again after a backoff, up to the number of retries
+	base := sess.Log
+	for attempt := 0; ; attempt++ {
+		for i, candidate := range candidates {
+			// sessions to different DCs log at the same time in forest and targets mode
+			sess.Log = base.WithField("dc", candidate)
+			sess.baseLog = sess.Log
+			if err = sess.connect(candidate, port); err == nil || !unreachable(err) || ctx.Err() != nil {
+				break
+			}
+			if i < len(candidates)-1 {
+				sess.Log.Warnf("unable to connect to %s (%s), trying the next DC", candidate, err)
+			}
+		}
+		if err == nil || !unreachable(err) || attempt >= options.Retries || ctx.Err() != nil {
+			break
+		}
+		if len(candidates) > 1 {
+			sess.Log.Warnf("unable to connect to any of the DCs found (%s), retrying (%d/%d)", err, attempt+1, options.Retries)
+		} else {
+			sess.Log.Warnf("unable to connect (%s), retrying (%d/%d)", err, attempt+1, options.Retries)
+		}
+		sess.backoff(attempt + 1)
+	}
+	if err != nil {
+		return
+	}
+	sess.candidates = candidates
+	_, err = sess.GetNamingContexts()
+	if err != nil {
+		return
+	}
+	sess.Log.Infof("retrieved default naming context: %q", sess.BaseDN)
+	sess.Log.Debugf("server naming contexts: %q", sess.NamingContexts.All)
+
+	sess.NewChannels(ctx)
+	return sess, nil
+}
+
+// connect opens a connection to dc, with TLS if the session uses it, and binds. It sets the session's connection
+// without locking, so it's only used on a session nothing else has yet
+func (w *LDAPSession) connect(dc string, port int) (err error) {
+	options := &w.options
 	var url string
+	if options.Secure {
+		url = fmt.Sprintf("ldaps://%s", net.JoinHostPort(dc, strconv.Itoa(port)))
+	} else {
+		url = fmt.Sprintf("ldap://%s", net.JoinHostPort(dc, strconv.Itoa(port)))
+	}
 
+	conn, err := dial(options, dc, port, ldap.DefaultTimeout)
+	if err != nil {
+		return
+	}
+	if options.Proxy != "" {
+		w.Log.Debugf("established connection through socks proxy at %s", options.Proxy)
+	}
+	w.Log.Debugf("tcp connection established to %s", conn.RemoteAddr())
+
+	var tlsConfig *tls.Config
+	if options.Secure || options.StartTLS {
+		if tlsConfig, err = options.TLSConfig(dc); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	var lConn *ldap.Conn
+	// searches are tracked above TLS, so they can be abandoned. StartTLS puts TLS under go-ldap's reads and writes too,
+	// which leaves nothing to track them with
+	var wire *wireConn
 	if options.Secure {
-		url = fmt.Sprintf("ldaps://%s:%d", dc, port)
+		tlsConn := tls.Client(conn, tlsConfig)
+		// handshake now, so untrusted certificates fail here rather than as a network error on the first request
+		tlsConn.SetDeadline(time.Now().Add(ldap.DefaultTimeout))
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return fmt.Errorf("TLS with %s failed: %s", dc, err)
+		}
+		tlsConn.SetDeadline(time.Time{})
+		wire = &wireConn{Conn: tlsConn}
+		lConn = ldap.NewConn(wire, options.Secure)
+		w.Log.Debug("TLS connection established")
+	} else if options.StartTLS {
+		lConn = ldap.NewConn(conn, options.Secure)
 	} else {
-		url = fmt.Sprintf("ldap://%s:%d", dc, port)
+		wire = &wireConn{Conn: conn}
+		lConn = ldap.NewConn(wire, options.Secure)
 	}
 
-	var conn net.Conn
-	defaultDailer := &net.Dialer{Timeout: ldap.DefaultTimeout}
+	lConn.Start()
+	if options.StartTLS && !options.Secure {
+		if err = lConn.StartTLS(tlsConfig); err != nil {
+			lConn.Close()
+			return fmt.Errorf("StartTLS with %s failed: %s", dc, err)
+		}
+		w.Log.Debug("TLS connection established with StartTLS")
+	}
 
-	// Use socks proxy if specified
-	if options.Proxy != "" {
-		pDialer, err := proxy.SOCKS5("tcp", options.Proxy, nil, defaultDailer)
+	if options.WireDebug {
+		wireDebugLogger(w.baseLog.Logger)
+		lConn.Debug.Enable(true)
+	}
+	w.LConn, w.wire = lConn, wire
+	w.server, w.port = dc, port
+	w.PageSize = uint32(options.PageSize)
+	w.checkClockSkew()
+
+	if options.CurrentUser {
+		err = w.SSPIBind()
+	} else if options.UseKerberos {
+		err = w.KerberosBind()
+	} else if options.UseNTLM || options.Hash != "" {
+		err = w.NTLMBind(options.Username, options.Password, options.Hash)
+	} else if options.ClientCert != "" && options.Username == "" {
+		err = w.ExternalBind()
+	} else {
+		err = w.SimpleBind(options.Username, options.Password)
+	}
+	if err != nil {
+		lConn.Close()
+		return
+	}
+	w.Log.Infof("successful bind to %q as %q", url, options.Username)
+	return nil
+}
+
+// TLSConfig is the TLS configuration for LDAPS and StartTLS connections to a server. Its certificate is only verified
+// with TLSVerify or a CACert, since DCs' certificates usually come from an internal CA this machine doesn't trust
+func (o LDAPSessionOptions) TLSConfig(server string) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: !o.TLSVerify && o.CACert == "", ServerName: o.TLSServerName}
+	if config.ServerName == "" {
+		config.ServerName = strings.Trim(server, "[]")
+	}
+	if o.CACert != "" {
+		b, err := ioutil.ReadFile(o.CACert)
 		if err != nil {
 			return nil, err
 		}
-		conn, err = pDialer.Dial("tcp", fmt.Sprintf("%s:%d", dc, port))
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no PEM certificates found in %q", o.CACert)
+		}
+	}
+	if o.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(o.ClientCert, o.ClientKey)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("error loading client certificate: %s", err)
 		}
-		sess.Log.Debugf("establishing connection through socks proxy at %s", options.Proxy)
-	} else {
-		conn, err = defaultDailer.Dial("tcp", fmt.Sprintf("%s:%d", dc, port))
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// dial opens a TCP connection to the domain controller, going through the SOCKS proxy if one is configured
+func dial(options *LDAPSessionOptions, dc string, port int, timeout time.Duration) (net.Conn, error) {
+	address := net.JoinHostPort(dc, strconv.Itoa(port))
+	// hostnames are looked up with the session's resolver, so --dns-server is used for them as well as for SRV records
+	resolver := options.Resolver
+	if resolver == nil {
+		resolver = dns.DefaultResolver
+	}
+	defaultDailer := resolver.Dialer(timeout)
+	network := "tcp"
+	switch options.IPVersion {
+	case "4":
+		network = "tcp4"
+	case "6":
+		network = "tcp6"
+	}
+
+	// Use socks proxy if specified
+	if options.Proxy != "" {
+		// the proxy looks hostnames up itself unless there is a resolver to use instead
+		if resolver.Custom() && net.ParseIP(dc) == nil {
+			addrs, err := resolver.LookupHost(dc)
+			if err == nil {
+				addrs, err = resolver.SelectAddresses(addrs, options.IPVersion)
+			}
+			if err != nil {
+				return nil, err
+			}
+			address = net.JoinHostPort(addrs[0], strconv.Itoa(port))
+		}
+		pDialer, err := proxy.SOCKS5("tcp", options.Proxy, nil, &net.Dialer{Timeout: timeout})
 		if err != nil {
-			return
+			return nil, err
 		}
+		return pDialer.Dial(network, address)
 	}
-	sess.Log.Debugf("tcp connection established to %s:%d", dc, port)
+	return defaultDailer.Dial(network, address)
+}
 
+// DialTCP opens a TCP connection to host:port using the session's proxy and IP version settings, e.g. to check a
+// port on a host found in the results is reachable. The caller is responsible for closing it
+func (w *LDAPSession) DialTCP(host string, port int, timeout time.Duration) (net.Conn, error) {
+	return dial(&w.options, strings.Trim(host, "[]"), port, timeout)
+}
+
+// DialServer opens an unbound LDAP connection to a server using the session's proxy and IP version settings, e.g. to
+// probe a DC without disturbing the session's own connection. The caller is responsible for closing it
+func (w *LDAPSession) DialServer(host string, port int, secure bool, timeout time.Duration) (*ldap.Conn, error) {
+	conn, err := dial(&w.options, strings.Trim(host, "[]"), port, timeout)
+	if err != nil {
+		return nil, err
+	}
 	var lConn *ldap.Conn
-	if options.Secure {
-		tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
-		lConn = ldap.NewConn(tlsConn, options.Secure)
-		sess.Log.Debug("TLS connection established")
+	if secure {
+		config, err := w.options.TLSConfig(host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		lConn = ldap.NewConn(tlsConn, secure)
 	} else {
-		lConn = ldap.NewConn(conn, options.Secure)
+		lConn = ldap.NewConn(conn, secure)
 	}
-
+	lConn.SetTimeout(timeout)
 	lConn.Start()
+	return lConn, nil
+}
 
-	sess.LConn = lConn
-	sess.PageSize = uint32(options.PageSize)
+// NewSessionForServer opens a new session to a different server, re-using the credentials, proxy and page size
+// of the current session. The new session does not follow referrals itself, to avoid referral loops
+func (w *LDAPSession) NewSessionForServer(dc string, port int, secure bool) (*LDAPSession, error) {
+	options := w.options
+	options.DomainController = dc
+	options.Port = port
+	options.Secure = secure
+	options.Referrals = ReferralsIgnore
+	sess, err := NewLDAPSession(&options, w.ctx)
+	if err == nil {
+		sess.SetLogFields(w.logFields)
+	}
+	return sess, err
+}
 
-	if options.UseNTLM || options.Hash != "" {
-		err = sess.NTLMBind(options.Username, options.Password, options.Hash)
-	} else {
-		err = sess.SimpleBind(options.Username, options.Password)
+// SetLogFields adds fields to everything the session logs from now on, e.g. the module it's running for, so
+// messages from sessions logging at the same time can be told apart. They replace the fields set before (nil removes
+// them), and are passed on to sessions opened from this one, e.g. to follow referrals
+func (w *LDAPSession) SetLogFields(fields logrus.Fields) {
+	w.logFields = fields
+	w.Log = w.baseLog.WithFields(fields)
+}
+
+// GlobalCatalog opens a new session to the global catalog port of the session's DC, which can search every domain
+// of the forest from the root (a BaseDN of ""). Not every DC is a GC, so this can fail where the session works
+func (w *LDAPSession) GlobalCatalog() (*LDAPSession, error) {
+	port := 3268
+	if w.options.Secure {
+		port = 3269
 	}
+	return w.NewSessionForServer(w.server, port, w.options.Secure)
+}
 
-	if err != nil {
-		return
+// Options returns a copy of the options the session was created with, e.g. to open a session to another domain
+// with the same credentials
+func (w *LDAPSession) Options() LDAPSessionOptions {
+	return w.options
+}
+
+// Server returns the address and port of the DC the session is connected to, which may have been discovered via DNS
+func (w *LDAPSession) Server() (string, int) {
+	w.connMu.RLock()
+	defer w.connMu.RUnlock()
+	return w.server, w.port
+}
+
+// Resolver returns the DNS resolver to use for lookups related to the session
+func (w *LDAPSession) Resolver() *dns.Resolver {
+	if w.options.Resolver == nil {
+		return dns.DefaultResolver
 	}
-	sess.Log.Infof("successful bind to %q as %q", url, options.Username)
-	_, err = sess.GetDefaultNamingContext()
-	if err != nil {
-		return
+	return w.options.Resolver
+}
+
+// Context returns the context the session was created with
+func (w *LDAPSession) Context() context.Context {
+	return w.ctx
+}
+
+// Reconnect replaces the session's connection if it was closed, e.g. by the DC, or to stop a search that was cancelled
+// while in flight, so the session can be used again. The DC it was connected to is tried first, then the other DCs
+// found for the domain, once each, since waiting and trying again is up to the caller's retries. Only the connection
+// is replaced, bound the same way as before: the naming contexts and channels stay as they are
+func (w *LDAPSession) Reconnect() error {
+	w.reconnectMu.Lock()
+	defer w.reconnectMu.Unlock()
+	if !w.conn().IsClosing() {
+		// another search that lost the connection has already reconnected
+		return nil
 	}
-	sess.Log.Infof("retrieved default naming context: %q", sess.BaseDN)
+	server, port := w.Server()
+	candidates := []string{server}
+	for _, dc := range w.candidates {
+		if dc != server {
+			candidates = append(candidates, dc)
+		}
+	}
+	var err error
+	for _, dc := range candidates {
+		w.Log.Infof("reconnecting to %s:%d", dc, port)
+		fresh := &LDAPSession{Log: w.Log, baseLog: w.baseLog, options: w.options, ctx: w.ctx, stats: w.stats}
+		if err = fresh.connect(dc, port); err == nil {
+			w.connMu.Lock()
+			w.LConn, w.wire, w.server, w.clockSkew = fresh.LConn, fresh.wire, dc, fresh.clockSkew
+			w.connMu.Unlock()
+			if dc != server {
+				w.Log.Warnf("unable to reconnect to %s, carrying on with %s", server, dc)
+			}
+			return nil
+		}
+		if !unreachable(err) || w.ctx.Err() != nil {
+			return err
+		}
+		w.Log.Warnf("unable to reconnect to %s: %s", dc, err)
+	}
+	return err
+}
 
-	sess.NewChannels(ctx)
-	return sess, nil
+// conn is the session's current connection, which Reconnect may have replaced
+func (w *LDAPSession) conn() *ldap.Conn {
+	w.connMu.RLock()
+	defer w.connMu.RUnlock()
+	return w.LConn
+}
+
+// connections is the session's current connection and the network connection under it, nil if its searches can't
+// be abandoned
+func (w *LDAPSession) connections() (*ldap.Conn, *wireConn) {
+	w.connMu.RLock()
+	defer w.connMu.RUnlock()
+	return w.LConn, w.wire
 }
 
 func (w *LDAPSession) SetChannels(chs *ResultChannels, ctx context.Context) {
@@ -156,18 +564,20 @@ func (w *LDAPSession) NewChannels(ctx context.Context) {
 	w.ctx = ctx
 }
 
+// CloseChannels closes the result channels to signal there are no more results. It is safe to call more than once
 func (w *LDAPSession) CloseChannels() {
-	if w.Channels.Entries != nil {
-		close(w.Channels.Entries)
-	}
-	if w.Channels.Controls != nil {
-		close(w.Channels.Controls)
-	}
-	if w.Channels.Referrals != nil {
-		close(w.Channels.Referrals)
-	}
-	w.Log.Debugf("closing ldapsession channels")
-
+	w.Channels.closeOnce.Do(func() {
+		if w.Channels.Entries != nil {
+			close(w.Channels.Entries)
+		}
+		if w.Channels.Controls != nil {
+			close(w.Channels.Controls)
+		}
+		if w.Channels.Referrals != nil {
+			close(w.Channels.Referrals)
+		}
+		w.Log.Debugf("closing ldapsession channels")
+	})
 }
 
 //func (w *LDAPSession) SetResultsChannel(ch chan *ldap.Entry, ctx context.Context) {
@@ -177,9 +587,9 @@ func (w *LDAPSession) CloseChannels() {
 
 func (w *LDAPSession) SimpleBind(username, password string) (err error) {
 	if username == "" {
-		err = w.LConn.UnauthenticatedBind("")
+		err = w.conn().UnauthenticatedBind("")
 	} else {
-		err = w.LConn.Bind(username, password)
+		err = w.conn().Bind(username, password)
 	}
 	if err != nil {
 		return
@@ -187,21 +597,47 @@ func (w *LDAPSession) SimpleBind(username, password string) (err error) {
 	return
 }
 
+// ExternalBind binds as the account the TLS client certificate is mapped to (SASL EXTERNAL), finding out which one
+// with a Who Am I request
+func (w *LDAPSession) ExternalBind() error {
+	w.Log.Infof("attempting SASL EXTERNAL bind with the client certificate")
+	if err := w.conn().ExternalBind(); err != nil {
+		return err
+	}
+	if res, err := w.conn().WhoAmI(nil); err == nil {
+		w.options.Username = strings.TrimPrefix(res.AuthzID, "u:")
+	}
+	return nil
+}
+
+// NTLMBind binds with NTLM, always with a hash: the one given, or the NT hash of the password, which is derived
+// locally so both go through the same code
 func (w *LDAPSession) NTLMBind(username, password, hash string) (err error) {
 	userParts := strings.Split(username, "@")
 	user := userParts[0]
 	domain := strings.Join(userParts[1:], "")
 
 	if hash != "" {
+		if hash, err = NormalizeHash(hash); err != nil {
+			return err
+		}
 		w.Log.Infof("attempting PtH NTLM bind for %q", user)
-		return w.LConn.NTLMBindWithHash(domain, user, hash)
+	} else {
+		if password == "" {
+			return fmt.Errorf("NTLM bind needs a password or hash")
+		}
+		hash = NTHash(password)
+		w.Log.Infof("attempting NTLM bind for %q with the NT hash of the password", user)
 	}
-	w.Log.Infof("attempting NTLM bind for %q", user)
-	return w.LConn.NTLMBind(domain, user, password)
+	redact.Add(hash)
+	return w.conn().NTLMBindWithHash(domain, user, hash)
 }
 
 func (w *LDAPSession) Close() {
-	w.LConn.Close()
+	if w.sids != nil {
+		w.sids.close()
+	}
+	w.conn().Close()
 }
 
 func (w *LDAPSession) GetDefaultNamingContext() (string, error) {
@@ -216,7 +652,7 @@ func (w *LDAPSession) GetDefaultNamingContext() (string, error) {
 		"(objectClass=*)",
 		[]string{"defaultNamingContext"},
 		nil)
-	res, err := w.LConn.Search(sr)
+	res, err := w.conn().Search(sr)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,249 @@
+package ldapsession
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+)
+
+// SIDResolver translates SIDs to DOMAIN\name strings for display. Well-known SIDs come from a built in table, the
+// rest are looked up in the session's domain, then in the global catalog for SIDs from other domains in the forest.
+// SIDs from trusted domains outside the forest can only be named if they're a well-known RID (e.g. EXT\Domain Admins).
+// Every answer, including SIDs that couldn't be resolved, is remembered for the life of the session
+type SIDResolver struct {
+	session *LDAPSession
+	mu      sync.Mutex
+	names   map[string]string
+	// dns maps the SIDs found as objects to their DNs, and the BUILTIN SIDs looked for that weren't to ""
+	dns    map[string]string
+	loaded bool
+	// domainSID is the session's own domain SID
+	domainSID string
+	// domainNames maps lower case domain DNs in the forest to their NetBIOS names
+	domainNames map[string]string
+	// trustNames maps the SIDs of trusted domains to their NetBIOS names
+	trustNames map[string]string
+	gc         *LDAPSession
+	gcTried    bool
+}
+
+// SIDResolver returns the session's SID resolver. Resolvers for sessions opened from this one (e.g. in forest mode)
+// are separate, since each one looks in its own domain first
+func (w *LDAPSession) SIDResolver() *SIDResolver {
+	w.sidsOnce.Do(func() {
+		w.sids = &SIDResolver{session: w, names: make(map[string]string), dns: make(map[string]string)}
+	})
+	return w.sids
+}
+
+// Name returns the DOMAIN\name for a SID, or the SID itself if it can't be resolved
+func (r *SIDResolver) Name(sid string) string {
+	return r.Resolve([]string{sid})[sid]
+}
+
+// Resolve names a batch of SIDs at once, which takes far fewer searches than naming them one by one. Every SID given
+// is in the returned map, mapped to itself if it couldn't be resolved
+func (r *SIDResolver) Resolve(sids []string) map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.load()
+
+	var pending []string
+	for _, s := range sids {
+		if _, ok := r.names[s]; ok {
+			continue
+		}
+		sid, err := secdesc.ParseSID(s)
+		if err != nil {
+			r.names[s] = s
+			continue
+		}
+		if name, ok := secdesc.WellKnownName(sid); ok {
+			r.names[s] = name
+			continue
+		}
+		r.names[s] = s
+		pending = append(pending, s)
+	}
+
+	if len(pending) > 0 {
+		pending = r.lookup(r.session, r.session.NamingContexts.Default, pending)
+	}
+	var foreign []string
+	for _, s := range pending {
+		if domain, ok := secdesc.MustParseSID(s).DomainSID(); ok && domain.String() != r.domainSID {
+			foreign = append(foreign, s)
+		}
+	}
+	if len(foreign) > 0 {
+		if gc := r.globalCatalog(); gc != nil {
+			foreign = r.lookup(gc, "", foreign)
+		}
+	}
+	for _, s := range foreign {
+		sid := secdesc.MustParseSID(s)
+		domain, _ := sid.DomainSID()
+		if trust, ok := r.trustNames[domain.String()]; ok {
+			if name, ok := secdesc.DomainRIDs[sid.RID()]; ok {
+				r.names[s] = fmt.Sprintf("%s\\%s", trust, name)
+			}
+		}
+	}
+
+	names := make(map[string]string, len(sids))
+	for _, s := range sids {
+		names[s] = r.names[s]
+	}
+	return names
+}
+
+// DNs returns the DNs of the objects with the given SIDs, for the SIDs found in the forest. SIDs that aren't objects
+// (Everyone, SELF...) or couldn't be found are left out. BUILTIN groups are named from the built in table, so they're
+// looked for in the session's domain separately
+func (r *SIDResolver) DNs(sids []string) map[string]string {
+	r.Resolve(sids)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var builtin []string
+	for _, s := range sids {
+		if _, ok := r.dns[s]; !ok && strings.HasPrefix(s, "S-1-5-32-") {
+			builtin = append(builtin, s)
+			r.dns[s] = ""
+		}
+	}
+	if len(builtin) > 0 {
+		res, err := r.session.BulkSearch(r.session.NamingContexts.Default, "objectSid", builtin, "", []string{"objectSid"})
+		if err != nil {
+			r.session.Log.Infof("unable to look up BUILTIN SIDs: %s", err)
+		} else {
+			for _, entry := range res.Entries {
+				if sid, _, err := secdesc.DecodeSID(entry.GetRawAttributeValue("objectSid")); err == nil {
+					r.dns[sid.String()] = entry.DN
+				}
+			}
+		}
+	}
+	dns := make(map[string]string, len(sids))
+	for _, s := range sids {
+		if dn := r.dns[s]; dn != "" {
+			dns[s] = dn
+		}
+	}
+	return dns
+}
+
+// DomainSID returns the SID of the session's domain, or "" if it couldn't be read
+func (r *SIDResolver) DomainSID() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.load()
+	return r.domainSID
+}
+
+// lookup searches for objects with the given SIDs under base, naming the ones it finds. Foreign security principals
+// are placeholders for SIDs from other domains, so they're skipped. The SIDs that weren't found are returned
+func (r *SIDResolver) lookup(session *LDAPSession, base string, sids []string) []string {
+	res, err := session.BulkSearch(base, "objectSid", sids, "(!(objectClass=foreignSecurityPrincipal))", []string{"objectSid", "sAMAccountName", "name"})
+	if err != nil {
+		r.session.Log.Infof("unable to look up SIDs: %s", err)
+		return sids
+	}
+	found := make(map[string]bool)
+	for _, entry := range res.Entries {
+		sid, _, err := secdesc.DecodeSID(entry.GetRawAttributeValue("objectSid"))
+		if err != nil {
+			continue
+		}
+		name := entry.GetAttributeValue("sAMAccountName")
+		if name == "" {
+			name = entry.GetAttributeValue("name")
+		}
+		r.names[sid.String()] = fmt.Sprintf("%s\\%s", r.netbiosName(entry.DN), name)
+		r.dns[sid.String()] = entry.DN
+		found[sid.String()] = true
+	}
+	var missing []string
+	for _, s := range sids {
+		if !found[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// load reads the session's domain SID, the forest's domain names, and the trusted domains the first time it's needed
+func (r *SIDResolver) load() {
+	if r.loaded {
+		return
+	}
+	r.loaded = true
+	r.domainNames = make(map[string]string)
+	r.trustNames = make(map[string]string)
+	w := r.session
+
+	sr := ldap.NewSearchRequest(w.NamingContexts.Default, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"objectSid"}, nil)
+	if res, err := w.GetSearchResults(sr); err == nil && len(res.Entries) > 0 {
+		if sid, _, err := secdesc.DecodeSID(res.Entries[0].GetRawAttributeValue("objectSid")); err == nil {
+			r.domainSID = sid.String()
+		}
+	}
+	if domains, err := w.GetForestDomains(); err == nil {
+		for _, d := range domains {
+			if d.NetBIOSName != "" {
+				r.domainNames[strings.ToLower(d.DN)] = d.NetBIOSName
+			}
+		}
+	}
+	sr = w.MakeSimpleSearchRequest("(objectClass=trustedDomain)", []string{"securityIdentifier", "flatName"})
+	if res, err := w.GetPagedSearchResults(sr); err == nil {
+		for _, entry := range res.Entries {
+			if sid, _, err := secdesc.DecodeSID(entry.GetRawAttributeValue("securityIdentifier")); err == nil {
+				r.trustNames[sid.String()] = entry.GetAttributeValue("flatName")
+			}
+		}
+	}
+}
+
+// netbiosName returns the NetBIOS name of the domain an object is in, falling back to the first label of its DNS name
+func (r *SIDResolver) netbiosName(dn string) string {
+	lower := strings.ToLower(dn)
+	var best, name string
+	for domainDN, netbios := range r.domainNames {
+		if strings.HasSuffix(lower, domainDN) && len(domainDN) > len(best) {
+			best, name = domainDN, netbios
+		}
+	}
+	if name != "" {
+		return name
+	}
+	return strings.ToUpper(strings.SplitN(DNToDomain(dn), ".", 2)[0])
+}
+
+// globalCatalog opens a session to the global catalog port of the session's DC the first time it's needed. Not every
+// DC is a GC, so if it fails SIDs from other domains just stay unresolved
+func (r *SIDResolver) globalCatalog() *LDAPSession {
+	if r.gcTried {
+		return r.gc
+	}
+	r.gcTried = true
+	gc, err := r.session.GlobalCatalog()
+	if err != nil {
+		r.session.Log.Infof("unable to connect to the global catalog on %s, SIDs from other domains won't be resolved: %s", r.session.server, err)
+		return nil
+	}
+	r.gc = gc
+	return gc
+}
+
+// close closes the global catalog session, if one was opened
+func (r *SIDResolver) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.gc != nil {
+		r.gc.Close()
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package ldapsession
+
+import "fmt"
+
+// SSPISupported is whether sessions can bind as the logged on user (CurrentUser) on this platform
+const SSPISupported = false
+
+// SSPIBind is only implemented on Windows
+func (w *LDAPSession) SSPIBind() error {
+	return fmt.Errorf("binding as the current user is only supported on Windows")
+}
+
+// CurrentUserDomain is only known on Windows
+func CurrentUserDomain() string {
+	return ""
+}
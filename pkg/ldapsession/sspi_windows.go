@@ -0,0 +1,48 @@
+//go:build windows
+// +build windows
+
+package ldapsession
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3/gssapi"
+)
+
+// SSPISupported is whether sessions can bind as the logged on user (CurrentUser) on this platform
+const SSPISupported = true
+
+// SSPIBind binds as the logged on user (SASL GSSAPI), with a Kerberos ticket for the DC's LDAP service that SSPI gets
+// from the logon session, so no credentials are needed. Like KerberosBind, no SASL security layer is negotiated,
+// so DCs that require LDAP signing need LDAPS or StartTLS as well
+func (w *LDAPSession) SSPIBind() error {
+	cl, err := gssapi.NewSSPIClient()
+	if err != nil {
+		return fmt.Errorf("sspi: unable to get the current user's credentials: %s", err)
+	}
+	defer cl.Close()
+	host, err := w.serverHostName()
+	if err != nil {
+		return err
+	}
+	spn := "ldap/" + host
+	w.Log.Infof("attempting SSPI bind as the current user to %s", spn)
+	if err = w.conn().GSSAPIBind(cl, spn, ""); err != nil {
+		if w.clockSkewed() {
+			return fmt.Errorf("sspi: %s (the DC's clock is %s)", err, describeSkew(w.clockSkew))
+		}
+		return fmt.Errorf("sspi: %s", err)
+	}
+	// the logon session decides who the session is bound as, so other connections and the lookup cache use its name
+	if res, err := w.conn().WhoAmI(nil); err == nil {
+		w.options.Username = strings.TrimPrefix(res.AuthzID, "u:")
+	}
+	return nil
+}
+
+// CurrentUserDomain is the DNS domain the logged on user belongs to, empty if it isn't a domain account
+func CurrentUserDomain() string {
+	return os.Getenv("USERDNSDOMAIN")
+}
@@ -0,0 +1,135 @@
+package ldapsession
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// SearchStats counts the searches a session made, and what the streamed ones (ExecuteSearchRequest) returned, so
+// callers can check a collection finished. Warnings say why results may be incomplete, e.g. a size limit or a
+// cancelled search. Filters are the distinct searches made, up to MaxRecordedFilters, with MoreFilters counting the
+// rest. QuotaReached is set once a search was refused for going over the SetSearchQuota limit
+type SearchStats struct {
+	Searches     int
+	Pages        int
+	Entries      int
+	Warnings     []string
+	Filters      []string
+	MoreFilters  int
+	QuotaReached bool
+}
+
+// MaxRecordedFilters is how many distinct searches SearchStats keeps. Modules that search once per object would
+// otherwise keep every one of them
+const MaxRecordedFilters = 100
+
+// searchStats guards a session's SearchStats, which are added to by referral sessions too. maxSearches is the
+// session's search quota, 0 for none
+type searchStats struct {
+	mu          sync.Mutex
+	stats       SearchStats
+	maxSearches int
+}
+
+func (s *searchStats) add(f func(*SearchStats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(&s.stats)
+}
+
+// TakeSearchStats returns the stats collected since the last call, and starts counting again from zero
+func (w *LDAPSession) TakeSearchStats() SearchStats {
+	w.stats.mu.Lock()
+	defer w.stats.mu.Unlock()
+	stats := w.stats.stats
+	w.stats.stats = SearchStats{}
+	return stats
+}
+
+// SetSearchQuota limits how many searches the session makes until the next TakeSearchStats, e.g. to cap a module
+// that searches once per object. Searches past the quota fail with a *QuotaError without being sent, and the first
+// one refused adds a warning, so results it cut short are reported as incomplete. 0 removes the limit
+func (w *LDAPSession) SetSearchQuota(max int) {
+	w.stats.mu.Lock()
+	defer w.stats.mu.Unlock()
+	w.stats.maxSearches = max
+}
+
+// QuotaError is returned by searches the session's search quota doesn't leave room for
+type QuotaError struct {
+	Limit int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("search quota of %d reached", e.Limit)
+}
+
+// quotaMessage matches a QuotaError's message
+var quotaMessage = regexp.MustCompile(`search quota of \d+ reached`)
+
+// IsQuotaError is true for an error a search quota caused, including one passed on as text in another error
+func IsQuotaError(err error) bool {
+	var quotaErr *QuotaError
+	return errors.As(err, &quotaErr) || (err != nil && quotaMessage.MatchString(err.Error()))
+}
+
+// recordSearch counts a search, and keeps its filter, scope and base if it hasn't been made before. It returns a
+// *QuotaError instead if the search would go over the session's search quota
+func (w *LDAPSession) recordSearch(sr *ldap.SearchRequest) error {
+	search := fmt.Sprintf("%s (%s of %q)", sr.Filter, scopeName(sr.Scope), sr.BaseDN)
+	w.stats.mu.Lock()
+	defer w.stats.mu.Unlock()
+	s := &w.stats.stats
+	if max := w.stats.maxSearches; max > 0 && s.Searches >= max {
+		if !s.QuotaReached {
+			s.QuotaReached = true
+			s.Warnings = append(s.Warnings, fmt.Sprintf("search quota of %d reached, later searches weren't sent", max))
+		}
+		return &QuotaError{Limit: max}
+	}
+	s.Searches++
+	for _, f := range s.Filters {
+		if f == search {
+			return nil
+		}
+	}
+	if len(s.Filters) < MaxRecordedFilters {
+		s.Filters = append(s.Filters, search)
+	} else {
+		s.MoreFilters++
+	}
+	return nil
+}
+
+func scopeName(scope int) string {
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return "base"
+	case ldap.ScopeSingleLevel:
+		return "one level"
+	}
+	return "subtree"
+}
+
+func (w *LDAPSession) countPage(entries int) {
+	w.stats.add(func(s *SearchStats) {
+		s.Pages++
+		s.Entries += entries
+	})
+}
+
+func (w *LDAPSession) warnIncomplete(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	w.stats.add(func(s *SearchStats) { s.Warnings = append(s.Warnings, msg) })
+}
+
+// truncated is true for the errors AD returns when it stops sending results before the search is done
+func truncated(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultTimeLimitExceeded) ||
+		ldap.IsErrorWithCode(err, ldap.LDAPResultAdminLimitExceeded)
+}
@@ -0,0 +1,160 @@
+package ldapsession
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// WriteMode controls whether the session is allowed to change the directory
+type WriteMode int
+
+const (
+	// WritesDisabled refuses every change (default)
+	WritesDisabled WriteMode = iota
+	// WritesDryRun prints the changes that would be made without sending them
+	WritesDryRun
+	// WritesEnabled sends changes to the server
+	WritesEnabled
+)
+
+// ErrWritesDisabled is returned when a change is attempted on a read-only session
+var ErrWritesDisabled = fmt.Errorf("writes are disabled (re-run with --write)")
+
+// DryRun is true if changes are only previewed
+func (w *LDAPSession) DryRun() bool {
+	return w.options.Writes == WritesDryRun
+}
+
+// Modify sends a modify request to the server if writes are enabled. On a dry run the change is printed as LDIF to
+// STDERR instead, and applied is false. Applied changes are recorded in the journal, if there is one
+func (w *LDAPSession) Modify(req *ldap.ModifyRequest) (applied bool, err error) {
+	return w.write(req.DN, FormatModify(req), func() error {
+		var entry JournalEntry
+		if w.options.Journal != nil {
+			if entry, err = w.journalModify(req); err != nil {
+				return fmt.Errorf("unable to read the original values for the journal: %s", err)
+			}
+		}
+		if err := w.conn().Modify(req); err != nil {
+			return err
+		}
+		w.saveJournal(entry)
+		return nil
+	})
+}
+
+// Add creates an object, the same way Modify changes one
+func (w *LDAPSession) Add(req *ldap.AddRequest) (applied bool, err error) {
+	ldif := FormatAdd(req)
+	return w.write(req.DN, ldif, func() error {
+		if err := w.conn().Add(req); err != nil {
+			return err
+		}
+		w.saveJournal(JournalEntry{Time: time.Now(), Operation: "add", DN: req.DN, Change: ldif})
+		return nil
+	})
+}
+
+// Delete removes an object, the same way Modify changes one. Deleted objects can't be restored from the journal
+func (w *LDAPSession) Delete(req *ldap.DelRequest) (applied bool, err error) {
+	ldif := fmt.Sprintf("%schangetype: delete\n", ldifLine("dn", req.DN))
+	return w.write(req.DN, ldif, func() error {
+		if err := w.conn().Del(req); err != nil {
+			return err
+		}
+		w.saveJournal(JournalEntry{Time: time.Now(), Operation: "delete", DN: req.DN, Change: ldif})
+		return nil
+	})
+}
+
+// write runs send if writes are enabled, or prints the LDIF preview of the change on a dry run
+func (w *LDAPSession) write(dn, ldif string, send func() error) (applied bool, err error) {
+	switch w.options.Writes {
+	case WritesDryRun:
+		fmt.Fprintf(os.Stderr, "[*] Dry run, not applying (add --confirm to apply):\n%s\n", ldif)
+		return false, nil
+	case WritesEnabled:
+		w.Log.Infof("writing %q", dn)
+		w.Log.Debugf("change:\n%s", ldif)
+		if err = send(); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, ErrWritesDisabled
+}
+
+var modifyOperations = map[uint]string{
+	ldap.AddAttribute:     "add",
+	ldap.DeleteAttribute:  "delete",
+	ldap.ReplaceAttribute: "replace",
+}
+
+// secretAttributes have their values hidden when changes are printed
+var secretAttributes = map[string]bool{
+	"unicodepwd":   true,
+	"userpassword": true,
+}
+
+// Encrypted is true if the session's connection is protected by TLS (LDAPS or StartTLS)
+func (w *LDAPSession) Encrypted() bool {
+	_, ok := w.conn().TLSConnectionState()
+	return ok
+}
+
+// FormatModify renders a modify request as an LDIF change record. Password values are redacted
+func FormatModify(req *ldap.ModifyRequest) string {
+	var sb strings.Builder
+	sb.WriteString(ldifLine("dn", req.DN))
+	sb.WriteString("changetype: modify\n")
+	for _, change := range req.Changes {
+		attr := change.Modification.Type
+		fmt.Fprintf(&sb, "%s: %s\n", modifyOperations[change.Operation], attr)
+		for _, v := range change.Modification.Vals {
+			if secretAttributes[strings.ToLower(attr)] {
+				v = "<redacted>"
+			}
+			sb.WriteString(ldifLine(attr, v))
+		}
+		sb.WriteString("-\n")
+	}
+	return sb.String()
+}
+
+// FormatAdd renders an add request as an LDIF change record. Password values are redacted
+func FormatAdd(req *ldap.AddRequest) string {
+	var sb strings.Builder
+	sb.WriteString(ldifLine("dn", req.DN))
+	sb.WriteString("changetype: add\n")
+	for _, attr := range req.Attributes {
+		for _, v := range attr.Vals {
+			if secretAttributes[strings.ToLower(attr.Type)] {
+				v = "<redacted>"
+			}
+			sb.WriteString(ldifLine(attr.Type, v))
+		}
+	}
+	return sb.String()
+}
+
+// ldifLine formats an attribute value, base64 encoding it if it isn't printable text
+func ldifLine(attr, value string) string {
+	printable := utf8.ValidString(value) && !strings.HasPrefix(value, " ") && !strings.HasPrefix(value, ":") && !strings.HasPrefix(value, "<")
+	for _, r := range value {
+		if !printable || !unicode.IsPrint(r) {
+			printable = false
+			break
+		}
+	}
+	if !printable {
+		return fmt.Sprintf("%s:: %s\n", attr, base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+	return fmt.Sprintf("%s: %s\n", attr, value)
+}
@@ -0,0 +1,202 @@
+package modules
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+
+	uac "github.com/audibleblink/msldapuac"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type AccessMatrixModule struct {
+	Groups      []string
+	Matrix      string
+	MembersOnly bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(AccessMatrixModule))
+	adschema.RegisterAttribute("highValueGroups", "String(Unicode)", false)
+}
+
+func (a *AccessMatrixModule) Name() string {
+	return "access-matrix"
+}
+
+func (a *AccessMatrixModule) Description() string {
+	return "Check every enabled user's transitive membership (from tokenGroups) of high value groups, optionally as a user by group CSV matrix"
+}
+
+func (a *AccessMatrixModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(a.Name(), pflag.ExitOnError)
+	flags.StringSliceVar(&a.Groups, "groups", nil, "Comma separated groups to check, by sAMAccountName or DN (default: the privileged-users groups)")
+	flags.StringVar(&a.Matrix, "matrix", "", "Also write the matrix to this CSV file, one row per user and a yes/no column per group")
+	flags.BoolVar(&a.MembersOnly, "members-only", false, "Leave out users who aren't in any of the groups")
+	return flags
+}
+
+func (a *AccessMatrixModule) DefaultAttrs() []string {
+	return []string{"sAMAccountName", "highValueGroups"}
+}
+
+func (a *AccessMatrixModule) IsReportModule() bool {
+	return true
+}
+
+// matrixGroup is a group a column of the matrix is for
+type matrixGroup struct {
+	name, sid string
+}
+
+func (a *AccessMatrixModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	groups, err := a.findGroups(session)
+	if err != nil {
+		return err
+	}
+
+	filter := fmt.Sprintf("(&(objectCategory=person)(objectClass=user)(!(userAccountControl:1.2.840.113556.1.4.803:=%d)))", uac.Accountdisable)
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter, []string{"sAMAccountName"}))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "[+] Reading tokenGroups of %d enabled users\n", len(res.Entries))
+
+	var entries []*ldap.Entry
+	var rows [][]string
+	failed := 0
+	for _, user := range res.Entries {
+		// tokenGroups is computed by the DC, with nesting and the primary group resolved, but only for a base search
+		sids, err := tokenGroups(session, user.DN)
+		if err != nil {
+			session.Log.Infof("unable to read tokenGroups of %s: %s", user.DN, err)
+			failed++
+			continue
+		}
+		var in []string
+		row := []string{user.DN, user.GetAttributeValue("sAMAccountName")}
+		for _, g := range groups {
+			if sids[g.sid] {
+				in = append(in, g.name)
+				row = append(row, "yes")
+			} else {
+				row = append(row, "no")
+			}
+		}
+		if a.MembersOnly && len(in) == 0 {
+			continue
+		}
+		rows = append(rows, row)
+		values := map[string][]string{"sAMAccountName": {user.GetAttributeValue("sAMAccountName")}}
+		if len(in) > 0 {
+			values["highValueGroups"] = in
+		}
+		entries = append(entries, ldap.NewEntry(user.DN, values))
+	}
+	if failed > 0 {
+		session.Log.Warnf("unable to read tokenGroups of %d users, they're left out of the results", failed)
+	}
+
+	if a.Matrix != "" {
+		if err := writeAccessMatrix(a.Matrix, groups, rows); err != nil {
+			return fmt.Errorf("unable to write matrix: %s", err)
+		}
+		fmt.Fprintf(os.Stderr, "[+] Access matrix of %d users and %d groups written to %s\n", len(rows), len(groups), a.Matrix)
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// findGroups looks up the groups to check, in the order they were given. The default list has names in several
+// languages, so only groups that were asked for explicitly are warned about when they don't exist
+func (a *AccessMatrixModule) findGroups(session *ldapsession.LDAPSession) ([]matrixGroup, error) {
+	names := a.Groups
+	if len(names) == 0 {
+		names = PrivilegedGroups
+	}
+	var sb strings.Builder
+	sb.WriteString("(&(objectCategory=group)(|")
+	for _, name := range names {
+		attr := "sAMAccountName"
+		if strings.Contains(name, "=") {
+			attr = "distinguishedName"
+		}
+		sb.WriteString(fmt.Sprintf("(%s=%s)", attr, ldap.EscapeFilter(name)))
+	}
+	sb.WriteString("))")
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(sb.String(), []string{"sAMAccountName", "objectSid"}))
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []matrixGroup
+	seen := make(map[string]bool)
+	for _, name := range names {
+		found := false
+		for _, entry := range res.Entries {
+			if !strings.EqualFold(name, entry.GetAttributeValue("sAMAccountName")) && !ldapsession.EqualDN(name, entry.DN) {
+				continue
+			}
+			found = true
+			sid, _, err := secdesc.DecodeSID(entry.GetRawAttributeValue("objectSid"))
+			if err != nil || seen[sid.String()] {
+				continue
+			}
+			seen[sid.String()] = true
+			groups = append(groups, matrixGroup{entry.GetAttributeValue("sAMAccountName"), sid.String()})
+		}
+		if !found && len(a.Groups) > 0 {
+			session.Log.Warnf("group %s not found", name)
+		}
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("none of the groups were found")
+	}
+	return groups, nil
+}
+
+// tokenGroups returns the SIDs of every security group an object is a member of, directly or not
+func tokenGroups(session *ldapsession.LDAPSession, dn string) (map[string]bool, error) {
+	sr := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"tokenGroups"}, nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) == 0 {
+		return nil, fmt.Errorf("object not found")
+	}
+	sids := make(map[string]bool)
+	for _, raw := range res.Entries[0].GetRawAttributeValues("tokenGroups") {
+		if sid, _, err := secdesc.DecodeSID(raw); err == nil {
+			sids[sid.String()] = true
+		}
+	}
+	return sids, nil
+}
+
+// writeAccessMatrix writes the rows (DN, sAMAccountName, then yes or no for each group) as CSV, with a header
+func writeAccessMatrix(path string, groups []matrixGroup, rows [][]string) error {
+	fp, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	w := csv.NewWriter(fp)
+	header := []string{"dn", "sAMAccountName"}
+	for _, g := range groups {
+		header = append(header, g.name)
+	}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return err
+	}
+	return fp.Close()
+}
@@ -0,0 +1,266 @@
+package modules
+
+import (
+	"fmt"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type ACLModule struct {
+	Filter    string
+	Principal string
+	All       bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(ACLModule))
+	adschema.RegisterAttribute("rights", "String(Unicode)", false)
+}
+
+// aclDefaultFilter is what the acl module checks unless --filter is given: the objects BloodHound collects ACLs of
+const aclDefaultFilter = "(|(objectCategory=person)(objectCategory=group)(objectCategory=computer)(objectClass=domainDNS)" +
+	"(objectCategory=organizationalUnit)(objectCategory=groupPolicyContainer)(objectCategory=msDS-GroupManagedServiceAccount))"
+
+// aclDefaultRIDs are the domain groups, besides the ones that control OUs, that have rights on objects out of the box:
+// DCs and read-only DCs replicate the domain, and Cert Publishers write userCertificate
+var aclDefaultRIDs = map[uint32]bool{
+	498: true, // Enterprise Read-only Domain Controllers
+	516: true, // Domain Controllers
+	517: true, // Cert Publishers
+	521: true, // Read-only Domain Controllers
+}
+
+// aclDefaultPrincipals are the built in principals, besides the ones that control OUs, that have rights on objects
+// out of the box
+var aclDefaultPrincipals = map[string]bool{
+	"S-1-5-32-561": true, // Terminal Server License Servers, which write the Terminal-Server property set
+}
+
+// userChangePassword needs the current password, so everyone has it without it meaning anything
+var userChangePassword = secdesc.MustParseGUID("ab721a53-1e2f-11d0-9819-00aa0040529b")
+
+func (a *ACLModule) Name() string {
+	return "acl"
+}
+
+func (a *ACLModule) Description() string {
+	return "Parse object DACLs and report who has control rights (GenericAll, WriteDACL, WriteOwner, DCSync, ...) on each object"
+}
+
+func (a *ACLModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(a.Name(), pflag.ExitOnError)
+	flags.StringVar(&a.Filter, "filter", "", "LDAP filter of the objects to check (default: users, groups, computers, gMSAs, OUs, GPOs and the domain)")
+	flags.StringVar(&a.Principal, "principal", "", "Only report the rights of this principal (SID, DN or sAMAccountName)")
+	flags.BoolVar(&a.All, "all", false, "Also report the principals that have these rights by default (admins, DCs, Account Operators, ...)")
+	return flags
+}
+
+func (a *ACLModule) DefaultAttrs() []string {
+	return []string{"principal", "rights"}
+}
+
+func (a *ACLModule) IsReportModule() bool {
+	return true
+}
+
+// aclGrant is what a principal can do to an object
+type aclGrant struct {
+	sid    string
+	rights []string
+	seen   map[string]bool
+}
+
+func (g *aclGrant) add(right string) {
+	if !g.seen[right] {
+		g.seen[right] = true
+		g.rights = append(g.rights, right)
+	}
+}
+
+// Run reads the security descriptors a page at a time, since they're large, and outputs an entry per object and
+// principal with control rights on it. Only allow ACEs that apply to the object itself are taken into account, so an
+// ACE that's denied, or only inherited by the object's children, doesn't show
+func (a *ACLModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	filter := a.Filter
+	if filter == "" {
+		filter = aclDefaultFilter
+	}
+	var principal string
+	if a.Principal != "" {
+		sid, err := secdesc.ParseSID(a.Principal)
+		if err != nil {
+			if sid, err = lookupSID(session, a.Principal); err != nil {
+				return fmt.Errorf("unable to find --principal: %s", err)
+			}
+		}
+		principal = sid.String()
+	}
+
+	// without the SD flags control, AD returns the SACL too, and leaves the attribute out for anyone who can't read it
+	controls := []ldap.Control{ldapsession.NewSDFlagsControl(ldapsession.OwnerSecurityInformation | ldapsession.GroupSecurityInformation | ldapsession.DACLSecurityInformation)}
+	sr := ldap.NewSearchRequest(session.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter, []string{"nTSecurityDescriptor"}, controls)
+	search := session.NewPagedSearch(sr)
+	for !search.Done() {
+		res, err := search.Next()
+		if err != nil {
+			return err
+		}
+		type object struct {
+			dn     string
+			grants []*aclGrant
+		}
+		var objects []object
+		var sids []string
+		for _, entry := range res.Entries {
+			raw := entry.GetRawAttributeValue("nTSecurityDescriptor")
+			if len(raw) == 0 {
+				session.Log.Warnf("no nTSecurityDescriptor returned for %s", entry.DN)
+				continue
+			}
+			sd, err := secdesc.Parse(raw)
+			if err != nil {
+				session.Log.Warnf("unable to parse the security descriptor of %s: %s", entry.DN, err)
+				continue
+			}
+			var grants []*aclGrant
+			for _, g := range a.grants(sd) {
+				if principal == "" || g.sid == principal {
+					grants = append(grants, g)
+					sids = append(sids, g.sid)
+				}
+			}
+			if len(grants) > 0 {
+				objects = append(objects, object{entry.DN, grants})
+			}
+		}
+
+		names := session.SIDResolver().Resolve(sids)
+		var entries []*ldap.Entry
+		for _, o := range objects {
+			for _, g := range o.grants {
+				name := g.sid
+				if n := names[g.sid]; n != "" && n != g.sid {
+					name = fmt.Sprintf("%s (%s)", g.sid, n)
+				}
+				entries = append(entries, ldap.NewEntry(o.dn, map[string][]string{
+					"principal": {name},
+					"rights":    g.rights,
+				}))
+			}
+		}
+		// ManualWriteSearchResultsToChan would close the channels after the first page
+		session.WriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	}
+	return nil
+}
+
+// grants works out who has control rights on the object a security descriptor is for: its owner, and the principals
+// its DACL gives control rights to, in the order they first appear
+func (a *ACLModule) grants(sd *secdesc.SecurityDescriptor) []*aclGrant {
+	bySID := make(map[string]*aclGrant)
+	var grants []*aclGrant
+	grant := func(sid secdesc.SID) *aclGrant {
+		s := sid.String()
+		if g, ok := bySID[s]; ok {
+			return g
+		}
+		g := &aclGrant{sid: s, seen: make(map[string]bool)}
+		bySID[s] = g
+		grants = append(grants, g)
+		return g
+	}
+	if sd.Owner != nil && (a.All || !isDefaultACLPrincipal(sd.Owner.String())) {
+		grant(*sd.Owner).add("Owns")
+	}
+	if sd.DACL != nil {
+		for _, ace := range sd.DACL.ACEs {
+			if (ace.Type != secdesc.AccessAllowedACEType && ace.Type != secdesc.AccessAllowedObjectACEType) ||
+				ace.Flags&secdesc.InheritOnlyACE != 0 || (!a.All && isDefaultACLPrincipal(ace.SID.String())) {
+				continue
+			}
+			rights := aceControlRights(ace)
+			if len(rights) == 0 {
+				continue
+			}
+			g := grant(ace.SID)
+			for _, r := range rights {
+				g.add(r)
+			}
+		}
+	}
+	var out []*aclGrant
+	for _, g := range grants {
+		if len(g.rights) == 0 {
+			continue
+		}
+		// the two rights DCSync needs, which are granted by separate ACEs
+		if g.seen["DS-Replication-Get-Changes"] && g.seen["DS-Replication-Get-Changes-All"] {
+			g.add("DCSync")
+		}
+		out = append(out, g)
+	}
+	return out
+}
+
+// aceControlRights names the rights an ACE grants that give some control of the object: GenericAll, GenericWrite,
+// WriteDACL and WriteOwner, writing all its properties or named ones, validated writes (e.g. Self-Membership),
+// and extended rights (e.g. User-Force-Change-Password, or AllExtendedRights). Read rights aren't named
+func aceControlRights(ace secdesc.ACE) []string {
+	mask := ace.Mask
+	if mask&secdesc.RightGenericAll == secdesc.RightGenericAll {
+		return []string{"GenericAll"}
+	}
+	var rights []string
+	objectType := ace.ObjectTypeName()
+	if mask&secdesc.RightGenericWrite == secdesc.RightGenericWrite && objectType == "" {
+		rights = append(rights, "GenericWrite")
+		mask &^= secdesc.RightGenericWrite
+	}
+	if mask&secdesc.RightWriteDACL != 0 {
+		rights = append(rights, "WriteDACL")
+	}
+	if mask&secdesc.RightWriteOwner != 0 {
+		rights = append(rights, "WriteOwner")
+	}
+	switch {
+	case mask&secdesc.RightWriteProperty == 0:
+	case objectType == "":
+		rights = append(rights, "WriteAllProperties")
+	default:
+		rights = append(rights, "WriteProperty "+objectType)
+	}
+	switch {
+	case mask&secdesc.RightSelf == 0:
+	case objectType == "":
+		rights = append(rights, "AllValidatedWrites")
+	default:
+		rights = append(rights, objectType)
+	}
+	switch {
+	case mask&secdesc.RightControlAccess == 0:
+	case objectType == "":
+		rights = append(rights, "AllExtendedRights")
+	case ace.ObjectType == userChangePassword:
+	default:
+		rights = append(rights, objectType)
+	}
+	return rights
+}
+
+// isDefaultACLPrincipal is true for the SIDs that have control rights on objects by default
+func isDefaultACLPrincipal(s string) bool {
+	if isDefaultOUPrincipal(s) || aclDefaultPrincipals[s] {
+		return true
+	}
+	sid, err := secdesc.ParseSID(s)
+	if err != nil {
+		return false
+	}
+	_, inDomain := sid.DomainSID()
+	return inDomain && aclDefaultRIDs[sid.RID()]
+}
@@ -0,0 +1,55 @@
+package modules
+
+import (
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+func TestACLOutputsEveryPage(t *testing.T) {
+	// each object is owned by a user, which is a control right the defaults don't hide
+	sd := string(secdesc.NewSecurityDescriptor(secdesc.MustParseSID("S-1-5-21-1-2-3-1105")).Bytes())
+	object := func(cn string) fakeEntry {
+		return fakeEntry{"CN=" + cn + ",CN=Users," + fakeBaseDN, [][2]string{{"nTSecurityDescriptor", sd}}}
+	}
+	session := fakeDC(t, ldapsession.LDAPSessionOptions{PageSize: 2}, func(id int64, req *ber.Packet) []*ber.Packet {
+		if req.Children[1].Tag != ldap.ApplicationSearchRequest {
+			return nil
+		}
+		attrs := requestAttrs(req)
+		if len(attrs) != 1 || attrs[0] != "nTSecurityDescriptor" {
+			return nil
+		}
+		if requestCookie(req) == nil {
+			page := ldap.NewControlPaging(2)
+			page.SetCookie([]byte("page2"))
+			return []*ber.Packet{
+				response(id, searchEntry(object("alice"))),
+				response(id, searchEntry(object("bob"))),
+				response(id, resultCode(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, ""), page),
+			}
+		}
+		return []*ber.Packet{
+			response(id, searchEntry(object("carol"))),
+			response(id, resultCode(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, ""), ldap.NewControlPaging(0)),
+		}
+	})
+
+	entries, err := collect(session, &ACLModule{}, []string{"principal", "rights"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.DN)
+		if rights := e.GetAttributeValue("rights"); rights != "Owns" {
+			t.Errorf("%s: got rights %q, want Owns", e.DN, rights)
+		}
+	}
+	if len(got) != 3 {
+		t.Fatalf("got results for %v, want alice, bob and carol from both pages", got)
+	}
+}
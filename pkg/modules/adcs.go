@@ -0,0 +1,277 @@
+package modules
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type ADCSModule struct {
+	LowPriv    bool
+	Published  bool
+	CAs        bool
+	ProbeWeb   bool
+	NTAuth     bool
+	Vulnerable bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(ADCSModule))
+	adschema.RegisterAttribute("enrollees", "String(Unicode)", false)
+	adschema.RegisterAttribute("autoEnrollees", "String(Unicode)", false)
+	adschema.RegisterAttribute("lowPrivilegeEnroll", "Boolean", true)
+	adschema.RegisterAttribute("publishedBy", "String(Unicode)", false)
+	adschema.RegisterAttribute("ekus", "String(Unicode)", false)
+	adschema.RegisterAttribute("writers", "String(Unicode)", false)
+	adschema.RegisterAttribute("vulnerabilities", "String(Unicode)", false)
+}
+
+var (
+	certificateEnrollment     = secdesc.MustParseGUID("0e10c968-78fb-11d2-90d4-00c04f79dc55")
+	certificateAutoEnrollment = secdesc.MustParseGUID("a05b8cc2-17bc-4802-a710-e7c15ab866a2")
+)
+
+// lowPrivilegeSIDs are the principals that (nearly) anyone who can authenticate to the domain is in. A template
+// they can enroll in is the first thing to look at for ESC1 style abuse
+var lowPrivilegeSIDs = map[string]bool{
+	"S-1-1-0":      true, // Everyone
+	"S-1-5-7":      true, // Anonymous Logon
+	"S-1-5-11":     true, // Authenticated Users
+	"S-1-5-32-545": true, // BUILTIN\Users
+	"S-1-5-32-546": true, // BUILTIN\Guests
+}
+
+// lowPrivilegeRIDs are the domain groups every user or computer account is in
+var lowPrivilegeRIDs = map[uint32]bool{
+	513: true, // Domain Users
+	514: true, // Domain Guests
+	515: true, // Domain Computers
+}
+
+// publicKeyServices is where AD CS keeps its objects, relative to the Configuration partition
+const publicKeyServices = "CN=Public Key Services,CN=Services,"
+
+func (a *ADCSModule) Name() string {
+	return "adcs"
+}
+
+func (a *ADCSModule) Description() string {
+	return "Enumerate AD CS certificate templates, who can enroll in them and their ESC1-4 misconfigurations, CAs and their web enrollment endpoints (ESC8), or the NTAuth store"
+}
+
+func (a *ADCSModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(a.Name(), pflag.ExitOnError)
+	flags.BoolVar(&a.LowPriv, "low-priv", false, "Only show templates that low privileged principals (Authenticated Users, Domain Users, ...) can enroll in")
+	flags.BoolVar(&a.Published, "published", false, "Only show templates a CA publishes (the only ones that can be enrolled in)")
+	flags.BoolVar(&a.Vulnerable, "vulnerable", false, "Only show templates with an ESC1-4 misconfiguration")
+	flags.BoolVar(&a.CAs, "cas", false, "List the CAs instead, with their web enrollment endpoints and whether NTLM can be relayed to them (ESC8)")
+	flags.BoolVar(&a.ProbeWeb, "probe-web", false, "With --cas, also check each CA for web enrollment (/certsrv) over HTTP and HTTPS")
+	flags.BoolVar(&a.NTAuth, "ntauth", false, "List the CA certificates in the NTAuth store instead, the CAs trusted for certificate logons")
+	return flags
+}
+
+func (a *ADCSModule) DefaultAttrs() []string {
+	return []string{"cn", "displayName", "msPKI-Certificate-Name-Flag", "msPKI-Enrollment-Flag", "ekus",
+		"publishedBy", "enrollees", "autoEnrollees", "lowPrivilegeEnroll", "vulnerabilities"}
+}
+
+func (a *ADCSModule) Partition() ldapsession.Partition {
+	return ldapsession.ConfigurationPartition
+}
+
+func (a *ADCSModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	if a.CAs && a.NTAuth {
+		return fmt.Errorf("--cas and --ntauth can't be used together")
+	}
+	if a.CAs {
+		return a.runCAs(session, attrs)
+	}
+	if a.NTAuth {
+		return a.runNTAuth(session, attrs)
+	}
+	publishers, err := a.templatePublishers(session)
+	if err != nil {
+		session.Log.Warnf("unable to read enrollment services, publishedBy won't be set: %s", err)
+	}
+
+	searchAttrs := append(append([]string(nil), attrs...), templateAttrs...)
+	sr := session.MakeSimpleSearchRequest("(objectClass=pKICertificateTemplate)", searchAttrs)
+	sr.BaseDN = "CN=Certificate Templates," + publicKeyServices + session.BaseDN
+	sr.Scope = ldap.ScopeSingleLevel
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+
+	resolver := session.SIDResolver()
+	var templates []*ldap.Entry
+	rank := make(map[*ldap.Entry]int)
+	for _, entry := range res.Entries {
+		raw := entry.GetRawAttributeValue("nTSecurityDescriptor")
+		enroll, autoEnroll := enrollmentRights(session, raw, entry.DN)
+		writers := templateWriters(raw)
+		published := publishers[strings.ToLower(entry.GetAttributeValue("cn"))]
+		low, lowWrite := false, false
+		for _, sid := range enroll {
+			low = low || isLowPrivilege(sid)
+		}
+		for _, sid := range writers {
+			lowWrite = lowWrite || isLowPrivilege(sid)
+		}
+		var escs []string
+		if len(published) > 0 {
+			escs = templateESCs(entry, low, lowWrite)
+		}
+		if (a.LowPriv && !low) || (a.Published && len(published) == 0) || (a.Vulnerable && len(escs) == 0) {
+			continue
+		}
+		names := resolver.Resolve(append(append(append([]string(nil), enroll...), autoEnroll...), writers...))
+		var vulnerabilities []string
+		for _, esc := range escs {
+			vulnerabilities = append(vulnerabilities, fmt.Sprintf("%s: %s", esc, escDescriptions[esc]))
+		}
+		entry.Attributes = append(entry.Attributes,
+			ldap.NewEntryAttribute("enrollees", principalNames(enroll, names)),
+			ldap.NewEntryAttribute("autoEnrollees", principalNames(autoEnroll, names)),
+			ldap.NewEntryAttribute("writers", principalNames(writers, names)),
+			ldap.NewEntryAttribute("lowPrivilegeEnroll", []string{strings.ToUpper(fmt.Sprint(low))}),
+			ldap.NewEntryAttribute("ekus", describeEKUs(templateEKUs(entry))),
+			ldap.NewEntryAttribute("vulnerabilities", vulnerabilities),
+		)
+		if len(published) > 0 {
+			entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute("publishedBy", published))
+		}
+		switch {
+		case len(escs) > 0:
+			rank[entry] = 2
+		case low && len(published) > 0:
+			rank[entry] = 1
+		}
+		templates = append(templates, entry)
+	}
+
+	// templates with an ESC first, then the other published templates low privileged principals can enroll in,
+	// they're the ones worth looking at
+	sort.SliceStable(templates, func(i, j int) bool { return rank[templates[i]] > rank[templates[j]] })
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(templates, attrs)})
+	return nil
+}
+
+// templatePublishers maps the lower case name of every template a CA publishes to the CAs that publish it, from the
+// certificateTemplates of the enrollment services
+func (a *ADCSModule) templatePublishers(session *ldapsession.LDAPSession) (map[string][]string, error) {
+	sr := session.MakeSimpleSearchRequest("(objectClass=pKIEnrollmentService)", []string{"cn", "certificateTemplates"})
+	sr.BaseDN = "CN=Enrollment Services," + publicKeyServices + session.NamingContexts.Configuration
+	sr.Scope = ldap.ScopeSingleLevel
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return nil, err
+	}
+	publishers := make(map[string][]string)
+	for _, ca := range res.Entries {
+		for _, t := range ca.GetAttributeValues("certificateTemplates") {
+			publishers[strings.ToLower(t)] = append(publishers[strings.ToLower(t)], ca.GetAttributeValue("cn"))
+		}
+	}
+	return publishers, nil
+}
+
+// enrollmentRights reads which SIDs the DACL lets enroll and auto-enroll, in the order the ACEs grant them. Enroll
+// is the Certificate-Enrollment extended right, auto-enroll Certificate-AutoEnrollment. ControlAccess on every
+// extended right or GenericAll grants both. A deny ACE takes the right away from its SID only: denies through group
+// membership would need every principal's groups, so they aren't taken into account
+func enrollmentRights(session *ldapsession.LDAPSession, raw []byte, dn string) (enroll, autoEnroll []string) {
+	if len(raw) == 0 {
+		session.Log.Warnf("no nTSecurityDescriptor returned for %s, unable to tell who can enroll", dn)
+		return nil, nil
+	}
+	sd, err := secdesc.Parse(raw)
+	if err != nil || sd.DACL == nil {
+		session.Log.Warnf("unable to parse the security descriptor of %s: %v", dn, err)
+		return nil, nil
+	}
+
+	allowed := [2]map[string]bool{{}, {}}
+	denied := [2]map[string]bool{{}, {}}
+	var order []string
+	for _, ace := range sd.DACL.ACEs {
+		if ace.Flags&secdesc.InheritOnlyACE != 0 {
+			continue
+		}
+		var deny bool
+		switch ace.Type {
+		case secdesc.AccessAllowedACEType, secdesc.AccessAllowedObjectACEType:
+		case secdesc.AccessDeniedACEType, secdesc.AccessDeniedObjectACEType:
+			deny = true
+		default:
+			continue
+		}
+		// enroll, auto-enroll
+		var grants [2]bool
+		switch {
+		case ace.Mask&secdesc.RightGenericAll == secdesc.RightGenericAll:
+			grants = [2]bool{true, true}
+		case ace.Mask&secdesc.RightControlAccess == 0:
+		case !ace.IsObjectACE() || ace.ObjectType.IsZero():
+			grants = [2]bool{true, true}
+		case ace.ObjectType == certificateEnrollment:
+			grants[0] = true
+		case ace.ObjectType == certificateAutoEnrollment:
+			grants[1] = true
+		}
+		sid := ace.SID.String()
+		for i, granted := range grants {
+			if !granted {
+				continue
+			}
+			if deny {
+				denied[i][sid] = true
+				continue
+			}
+			if !allowed[0][sid] && !allowed[1][sid] {
+				order = append(order, sid)
+			}
+			allowed[i][sid] = true
+		}
+	}
+	for _, sid := range order {
+		if allowed[0][sid] && !denied[0][sid] {
+			enroll = append(enroll, sid)
+		}
+		if allowed[1][sid] && !denied[1][sid] {
+			autoEnroll = append(autoEnroll, sid)
+		}
+	}
+	return enroll, autoEnroll
+}
+
+// isLowPrivilege is true for the SIDs of principals (nearly) every account is in
+func isLowPrivilege(s string) bool {
+	if lowPrivilegeSIDs[s] {
+		return true
+	}
+	sid, err := secdesc.ParseSID(s)
+	if err != nil {
+		return false
+	}
+	_, inDomain := sid.DomainSID()
+	return inDomain && lowPrivilegeRIDs[sid.RID()]
+}
+
+// principalNames formats SIDs as "SID (DOMAIN\name)" where the name is known
+func principalNames(sids []string, names map[string]string) []string {
+	out := make([]string, len(sids))
+	for i, sid := range sids {
+		out[i] = sid
+		if name := names[sid]; name != "" && name != sid {
+			out[i] = fmt.Sprintf("%s (%s)", sid, name)
+		}
+	}
+	return out
+}
@@ -0,0 +1,205 @@
+package modules
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+func init() {
+	adschema.RegisterAttribute("webEnrollment", "String(Unicode)", false)
+	adschema.RegisterAttribute("esc8", "String(Unicode)", true)
+}
+
+// webProbeTimeout is how long a CA's web server has to answer a probe
+const webProbeTimeout = 5 * time.Second
+
+// cesAuthentication are the authentication flags of an msPKI-Enrollment-Servers value (MS-CAESO)
+var cesAuthentication = []struct {
+	flag int
+	name string
+}{
+	{0x1, "Anonymous"},
+	{0x2, "Kerberos"},
+	{0x4, "UsernamePassword"},
+	{0x8, "ClientCertificate"},
+}
+
+// webEndpoint is a URL certificates can be requested from, and whether NTLM can be relayed to it
+type webEndpoint struct {
+	url   string
+	note  string
+	relay bool
+	maybe bool
+}
+
+func (e webEndpoint) String() string {
+	return fmt.Sprintf("%s (%s)", e.url, e.note)
+}
+
+// caAttrs are read from every enrollment service, whatever was asked for, to find its web endpoints
+var caAttrs = []string{"cn", "dNSHostName", "msPKI-Enrollment-Servers", "cACertificate"}
+
+// caDefaultAttrs are output for CAs when --attrs isn't given, in place of the template defaults
+var caDefaultAttrs = []string{"cn", "dNSHostName", "certificateTemplates", "ntAuthTrusted", "webEnrollment", "esc8"}
+
+// runCAs lists the CAs (enrollment services) with the web enrollment endpoints found for them. Web enrollment
+// (/certsrv) isn't registered in the directory, so it's only found with --probe-web. Certificate Enrollment Web
+// Services are, in msPKI-Enrollment-Servers. ntAuthTrusted is whether the CA's certificate is in the NTAuth store,
+// without which DCs don't accept the certificates it issues for logons
+func (a *ADCSModule) runCAs(session *ldapsession.LDAPSession, attrs []string) error {
+	if strings.Join(attrs, ",") == strings.Join(a.DefaultAttrs(), ",") {
+		attrs = caDefaultAttrs
+	}
+	searchAttrs := append(append([]string(nil), attrs...), caAttrs...)
+	sr := session.MakeSimpleSearchRequest("(objectClass=pKIEnrollmentService)", searchAttrs)
+	sr.BaseDN = "CN=Enrollment Services," + publicKeyServices + session.BaseDN
+	sr.Scope = ldap.ScopeSingleLevel
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+	ntAuth, err := ntAuthThumbprints(session)
+	if err != nil {
+		session.Log.Warnf("unable to read the NTAuth store, ntAuthTrusted won't be set: %s", err)
+	}
+
+	for _, ca := range res.Entries {
+		if ntAuth != nil {
+			trusted := false
+			for _, raw := range ca.GetRawAttributeValues("cACertificate") {
+				trusted = trusted || ntAuth[certThumbprint(raw)]
+			}
+			ca.Attributes = append(ca.Attributes, ldap.NewEntryAttribute("ntAuthTrusted", []string{strings.ToUpper(fmt.Sprint(trusted))}))
+		}
+		endpoints := enrollmentServers(ca.GetAttributeValues("msPKI-Enrollment-Servers"))
+		host := ca.GetAttributeValue("dNSHostName")
+		if a.ProbeWeb && host != "" {
+			endpoints = append(endpoints, probeWebEnrollment(session, host)...)
+		}
+		var values []string
+		for _, e := range endpoints {
+			values = append(values, e.String())
+		}
+		if len(values) > 0 {
+			ca.Attributes = append(ca.Attributes, ldap.NewEntryAttribute("webEnrollment", values))
+		}
+		ca.Attributes = append(ca.Attributes, ldap.NewEntryAttribute("esc8", []string{a.esc8(endpoints)}))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(res.Entries, attrs)})
+	return nil
+}
+
+// esc8 sums up whether NTLM can be relayed to the CA's web endpoints
+func (a *ADCSModule) esc8(endpoints []webEndpoint) string {
+	var relay, maybe []string
+	for _, e := range endpoints {
+		if e.relay {
+			relay = append(relay, e.url)
+		} else if e.maybe {
+			maybe = append(maybe, e.url)
+		}
+	}
+	switch {
+	case len(relay) > 0:
+		return "VULNERABLE: NTLM over HTTP at " + strings.Join(relay, ", ")
+	case len(maybe) > 0:
+		return "possible if Extended Protection is off: " + strings.Join(maybe, ", ")
+	case !a.ProbeWeb:
+		return "unknown, /certsrv wasn't probed (--probe-web)"
+	}
+	return "no web enrollment found"
+}
+
+// enrollmentServers parses msPKI-Enrollment-Servers values, which are the priority, authentication flags,
+// renewal-only flag and URL of a Certificate Enrollment Web Service, separated by newlines
+func enrollmentServers(values []string) []webEndpoint {
+	var endpoints []webEndpoint
+	for _, v := range values {
+		parts := strings.Split(strings.TrimSpace(strings.Replace(v, "\r\n", "\n", -1)), "\n")
+		if len(parts) < 4 {
+			continue
+		}
+		url := parts[len(parts)-1]
+		auth, _ := strconv.Atoi(parts[1])
+		var names []string
+		for _, a := range cesAuthentication {
+			if auth&a.flag != 0 {
+				names = append(names, a.name)
+			}
+		}
+		e := webEndpoint{url: url, note: "CES, " + strings.Join(names, "|")}
+		// Kerberos and user name authentication are done through Negotiate, which falls back to NTLM
+		if auth&0x6 != 0 {
+			e.relay = strings.HasPrefix(strings.ToLower(url), "http://")
+			e.maybe = !e.relay
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints
+}
+
+// probeWebEnrollment asks the CA's web server for /certsrv/ over HTTP and HTTPS, through the session's proxy if it
+// has one. An endpoint that asks for NTLM or Negotiate can be relayed to: over HTTP always, over HTTPS unless
+// Extended Protection for Authentication is required, which can't be seen without authenticating
+func probeWebEnrollment(session *ldapsession.LDAPSession, host string) []webEndpoint {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			h, p, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			port, _ := strconv.Atoi(p)
+			return session.DialTCP(h, port, webProbeTimeout)
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   webProbeTimeout,
+		// a redirect to a login page still shows web enrollment is there, so look at the first response
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	defer transport.CloseIdleConnections()
+
+	var endpoints []webEndpoint
+	for _, scheme := range []string{"http", "https"} {
+		url := fmt.Sprintf("%s://%s/certsrv/", scheme, host)
+		resp, err := client.Get(url)
+		if err != nil {
+			session.Log.Infof("no web enrollment at %s: %s", url, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			continue
+		}
+		var schemes []string
+		for _, h := range resp.Header["Www-Authenticate"] {
+			schemes = append(schemes, strings.SplitN(h, " ", 2)[0])
+		}
+		e := webEndpoint{url: url, note: fmt.Sprintf("web enrollment, HTTP %d", resp.StatusCode)}
+		if len(schemes) > 0 {
+			e.note += ", " + strings.Join(schemes, "|")
+		}
+		ntlm := false
+		for _, s := range schemes {
+			ntlm = ntlm || strings.EqualFold(s, "NTLM") || strings.EqualFold(s, "Negotiate")
+		}
+		if ntlm {
+			e.relay = scheme == "http"
+			e.maybe = scheme == "https"
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints
+}
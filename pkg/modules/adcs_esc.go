@@ -0,0 +1,142 @@
+package modules
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+)
+
+// ekuNames are the names of the EKUs (application policies) templates commonly have
+var ekuNames = map[string]string{
+	"1.3.6.1.5.5.7.3.1":        "Server Authentication",
+	"1.3.6.1.5.5.7.3.2":        "Client Authentication",
+	"1.3.6.1.5.5.7.3.3":        "Code Signing",
+	"1.3.6.1.5.5.7.3.4":        "Secure Email",
+	"1.3.6.1.5.5.7.3.8":        "Time Stamping",
+	"1.3.6.1.5.5.7.3.9":        "OCSP Signing",
+	"1.3.6.1.5.5.8.2.2":        "IP security IKE intermediate",
+	"1.3.6.1.5.2.3.4":          "PKINIT Client Authentication",
+	"1.3.6.1.5.2.3.5":          "KDC Authentication",
+	"1.3.6.1.4.1.311.10.3.1":   "Microsoft Trust List Signing",
+	"1.3.6.1.4.1.311.10.3.4":   "Encrypting File System",
+	"1.3.6.1.4.1.311.10.3.4.1": "File Recovery",
+	"1.3.6.1.4.1.311.10.3.12":  "Document Signing",
+	"1.3.6.1.4.1.311.10.3.13":  "Lifetime Signing",
+	"1.3.6.1.4.1.311.20.2.1":   "Certificate Request Agent",
+	"1.3.6.1.4.1.311.20.2.2":   "Smart Card Logon",
+	"1.3.6.1.4.1.311.21.5":     "Private Key Archival",
+	"1.3.6.1.4.1.311.21.6":     "Key Recovery Agent",
+	"1.3.6.1.4.1.311.21.19":    "Directory Service Email Replication",
+	"1.3.6.1.4.1.311.54.1.2":   "Remote Desktop Authentication",
+	"2.5.29.37.0":              "Any Purpose",
+}
+
+// templateAttrs are read from every template, whatever was asked for, to tell which ESCs it has
+var templateAttrs = []string{"cn", "nTSecurityDescriptor", "msPKI-Certificate-Name-Flag", "msPKI-Enrollment-Flag",
+	"msPKI-RA-Signature", "pKIExtendedKeyUsage", "msPKI-Certificate-Application-Policy"}
+
+// escDescriptions say what each ESC found in a template is
+var escDescriptions = map[string]string{
+	"ESC1": "enrollee supplies the subject of authentication certificates",
+	"ESC2": "any purpose certificates",
+	"ESC3": "enrollment agent certificates",
+	"ESC4": "low privileged principals can modify the template",
+}
+
+// templateEKUs are the EKUs of the certificates a template issues: its application policies, which schema version 2
+// and later templates have and CAs use instead, or else its pKIExtendedKeyUsage
+func templateEKUs(entry *ldap.Entry) []string {
+	if policies := entry.GetAttributeValues("msPKI-Certificate-Application-Policy"); len(policies) > 0 {
+		return policies
+	}
+	return entry.GetAttributeValues("pKIExtendedKeyUsage")
+}
+
+// describeEKUs formats EKUs as "name (OID)" where the name is known. A template without any issues certificates
+// for any purpose
+func describeEKUs(ekus []string) []string {
+	if len(ekus) == 0 {
+		return []string{"Any Purpose (no EKUs)"}
+	}
+	out := make([]string, len(ekus))
+	for i, eku := range ekus {
+		out[i] = eku
+		if name, ok := ekuNames[eku]; ok {
+			out[i] = fmt.Sprintf("%s (%s)", name, eku)
+		}
+	}
+	return out
+}
+
+// templateESCs are the misconfigurations (as named by Certified Pre-Owned) that let low privileged principals abuse
+// a published template, given whether they can enroll in it and whether they can modify it. ESC1 to ESC3 need the
+// requester to get the certificate on their own, without manager approval or authorized signatures
+func templateESCs(entry *ldap.Entry, lowEnroll, lowWrite bool) []string {
+	var escs []string
+	nameFlags, _ := strconv.ParseInt(entry.GetAttributeValue("msPKI-Certificate-Name-Flag"), 10, 64)
+	enrollFlags, _ := strconv.ParseInt(entry.GetAttributeValue("msPKI-Enrollment-Flag"), 10, 64)
+	signatures, _ := strconv.Atoi(entry.GetAttributeValue("msPKI-RA-Signature"))
+	if lowEnroll && enrollFlags&ctPendAllRequests == 0 && signatures == 0 {
+		ekus := templateEKUs(entry)
+		authentication, anyPurpose, agent := len(ekus) == 0, len(ekus) == 0, false
+		for _, eku := range ekus {
+			authentication = authentication || authenticationEKUs[eku]
+			anyPurpose = anyPurpose || eku == anyPurposeEKU
+			agent = agent || eku == enrollmentAgentEKU
+		}
+		if nameFlags&ctEnrolleeSuppliesSubject != 0 && authentication {
+			escs = append(escs, "ESC1")
+		}
+		if anyPurpose {
+			escs = append(escs, "ESC2")
+		}
+		if agent {
+			escs = append(escs, "ESC3")
+		}
+	}
+	if lowWrite {
+		escs = append(escs, "ESC4")
+	}
+	return escs
+}
+
+// templateWriters reads which SIDs can change a template from its security descriptor: the owner, and those the
+// DACL allows to write its properties, DACL or owner. Deny ACEs aren't taken into account
+func templateWriters(raw []byte) []string {
+	sd, err := secdesc.Parse(raw)
+	if err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var writers []string
+	add := func(sid string) {
+		if !seen[sid] {
+			seen[sid] = true
+			writers = append(writers, sid)
+		}
+	}
+	if sd.Owner != nil {
+		add(sd.Owner.String())
+	}
+	if sd.DACL == nil {
+		return writers
+	}
+	for _, ace := range sd.DACL.ACEs {
+		if ace.Flags&secdesc.InheritOnlyACE != 0 {
+			continue
+		}
+		if ace.Type != secdesc.AccessAllowedACEType && ace.Type != secdesc.AccessAllowedObjectACEType {
+			continue
+		}
+		switch {
+		case ace.Mask&(secdesc.RightWriteDACL|secdesc.RightWriteOwner) != 0:
+		case ace.Mask&secdesc.RightWriteProperty != 0 && (!ace.IsObjectACE() || ace.ObjectType.IsZero()):
+		default:
+			continue
+		}
+		add(ace.SID.String())
+	}
+	return writers
+}
@@ -0,0 +1,127 @@
+package modules
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+func init() {
+	adschema.RegisterAttribute("subject", "String(Unicode)", true)
+	adschema.RegisterAttribute("issuer", "String(Unicode)", true)
+	adschema.RegisterAttribute("thumbprint", "String(Unicode)", true)
+	adschema.RegisterAttribute("notBefore", "String(Unicode)", true)
+	adschema.RegisterAttribute("notAfter", "String(Unicode)", true)
+	adschema.RegisterAttribute("enrollmentService", "String(Unicode)", false)
+	adschema.RegisterAttribute("ntAuthTrusted", "Boolean", true)
+}
+
+// ntAuthCertificates is the object whose cACertificate holds the CAs trusted to issue logon certificates (smart card
+// logon, PKINIT, Schannel), relative to the Configuration partition. A CA that isn't in it can issue ESC1 style
+// certificates all it likes, DCs won't accept them for authentication
+const ntAuthCertificates = "CN=NTAuthCertificates," + publicKeyServices
+
+// ntAuthDefaultAttrs are output for --ntauth when --attrs isn't given, in place of the template defaults
+var ntAuthDefaultAttrs = []string{"subject", "issuer", "serialNumber", "notBefore", "notAfter", "thumbprint", "enrollmentService"}
+
+// runNTAuth lists the certificates in the NTAuth store, one entry each, with the enrollment services whose
+// certificate it is
+func (a *ADCSModule) runNTAuth(session *ldapsession.LDAPSession, attrs []string) error {
+	if strings.Join(attrs, ",") == strings.Join(a.DefaultAttrs(), ",") {
+		attrs = ntAuthDefaultAttrs
+	}
+	dn := ntAuthCertificates + session.BaseDN
+	certs, err := readNTAuth(session, dn)
+	if err != nil {
+		return err
+	}
+	services, err := enrollmentServiceCerts(session)
+	if err != nil {
+		session.Log.Warnf("unable to read enrollment services, enrollmentService won't be set: %s", err)
+	}
+
+	var entries []*ldap.Entry
+	for _, cert := range certs {
+		values := map[string][]string{
+			"subject":      {cert.Subject.String()},
+			"issuer":       {cert.Issuer.String()},
+			"serialNumber": {fmt.Sprintf("%X", cert.SerialNumber)},
+			"notBefore":    {cert.NotBefore.UTC().Format("2006-01-02 15:04 UTC")},
+			"notAfter":     {cert.NotAfter.UTC().Format("2006-01-02 15:04 UTC")},
+			"thumbprint":   {certThumbprint(cert.Raw)},
+		}
+		if cas := services[certThumbprint(cert.Raw)]; len(cas) > 0 {
+			values["enrollmentService"] = cas
+		}
+		entries = append(entries, ldap.NewEntry(dn, values))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// readNTAuth parses the certificates in the NTAuth store. A forest without AD CS doesn't have one
+func readNTAuth(session *ldapsession.LDAPSession, dn string) ([]*x509.Certificate, error) {
+	sr := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=certificationAuthority)", []string{"cACertificate"}, nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			session.Log.Warnf("no NTAuth store (%s), no CA is trusted for certificate logons", dn)
+			return nil, nil
+		}
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for _, entry := range res.Entries {
+		for _, raw := range entry.GetRawAttributeValues("cACertificate") {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				session.Log.Warnf("unable to parse a certificate in the NTAuth store: %s", err)
+				continue
+			}
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+// enrollmentServiceCerts maps the thumbprints of the enrollment services' certificates to their names
+func enrollmentServiceCerts(session *ldapsession.LDAPSession) (map[string][]string, error) {
+	sr := session.MakeSimpleSearchRequest("(objectClass=pKIEnrollmentService)", []string{"cn", "cACertificate"})
+	sr.BaseDN = "CN=Enrollment Services," + publicKeyServices + session.NamingContexts.Configuration
+	sr.Scope = ldap.ScopeSingleLevel
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return nil, err
+	}
+	services := make(map[string][]string)
+	for _, ca := range res.Entries {
+		for _, raw := range ca.GetRawAttributeValues("cACertificate") {
+			services[certThumbprint(raw)] = append(services[certThumbprint(raw)], ca.GetAttributeValue("cn"))
+		}
+	}
+	return services, nil
+}
+
+// ntAuthThumbprints are the thumbprints of the certificates in the NTAuth store
+func ntAuthThumbprints(session *ldapsession.LDAPSession) (map[string]bool, error) {
+	certs, err := readNTAuth(session, ntAuthCertificates+session.NamingContexts.Configuration)
+	if err != nil {
+		return nil, err
+	}
+	thumbprints := make(map[string]bool)
+	for _, cert := range certs {
+		thumbprints[certThumbprint(cert.Raw)] = true
+	}
+	return thumbprints, nil
+}
+
+// certThumbprint is the SHA1 hash of a DER certificate in hex, as Windows shows it
+func certThumbprint(der []byte) string {
+	return fmt.Sprintf("%X", sha1.Sum(der))
+}
@@ -0,0 +1,264 @@
+package modules
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+// Control access rights and properties the add-ace module knows how to grant
+var (
+	dsReplicationGetChanges    = secdesc.MustParseGUID("1131f6aa-9c07-11d1-f79f-00c04fc2dcd2")
+	dsReplicationGetChangesAll = secdesc.MustParseGUID("1131f6ad-9c07-11d1-f79f-00c04fc2dcd2")
+	userForceChangePassword    = secdesc.MustParseGUID("00299570-246d-11d0-a768-00aa006e0529")
+	memberAttribute            = secdesc.MustParseGUID("bf9679c0-0de6-11d0-a285-00aa003049e2")
+)
+
+// aceRights builds the ACEs for each right that can be granted
+var aceRights = map[string]func(sid secdesc.SID) []secdesc.ACE{
+	"genericall": func(sid secdesc.SID) []secdesc.ACE {
+		return []secdesc.ACE{{Type: secdesc.AccessAllowedACEType, Mask: secdesc.RightGenericAll, SID: sid}}
+	},
+	"genericwrite": func(sid secdesc.SID) []secdesc.ACE {
+		return []secdesc.ACE{{Type: secdesc.AccessAllowedACEType, Mask: secdesc.RightGenericWrite, SID: sid}}
+	},
+	"writedacl": func(sid secdesc.SID) []secdesc.ACE {
+		return []secdesc.ACE{{Type: secdesc.AccessAllowedACEType, Mask: secdesc.RightWriteDACL, SID: sid}}
+	},
+	"writeowner": func(sid secdesc.SID) []secdesc.ACE {
+		return []secdesc.ACE{{Type: secdesc.AccessAllowedACEType, Mask: secdesc.RightWriteOwner, SID: sid}}
+	},
+	"dcsync": func(sid secdesc.SID) []secdesc.ACE {
+		return []secdesc.ACE{
+			{Type: secdesc.AccessAllowedObjectACEType, Mask: secdesc.RightControlAccess, ObjectType: dsReplicationGetChanges, SID: sid},
+			{Type: secdesc.AccessAllowedObjectACEType, Mask: secdesc.RightControlAccess, ObjectType: dsReplicationGetChangesAll, SID: sid},
+		}
+	},
+	"resetpassword": func(sid secdesc.SID) []secdesc.ACE {
+		return []secdesc.ACE{{Type: secdesc.AccessAllowedObjectACEType, Mask: secdesc.RightControlAccess, ObjectType: userForceChangePassword, SID: sid}}
+	},
+	"writemembers": func(sid secdesc.SID) []secdesc.ACE {
+		return []secdesc.ACE{{Type: secdesc.AccessAllowedObjectACEType, Mask: secdesc.RightWriteProperty, ObjectType: memberAttribute, SID: sid}}
+	},
+}
+
+// descriptorBackup is the original descriptor saved before an ACE is added, so it can be put back
+type descriptorBackup struct {
+	DN         string `json:"dn"`
+	SDDL       string `json:"sddl"`
+	Descriptor string `json:"descriptor"`
+}
+
+type AddACEModule struct {
+	Target    string
+	Principal string
+	SID       string
+	Rights    string
+	Inherit   bool
+	Action    string
+	Backup    string
+}
+
+func init() {
+	AllModules = append(AllModules, new(AddACEModule))
+	adschema.RegisterAttribute("aces", "String(Unicode)", false)
+	adschema.RegisterAttribute("backupFile", "String(Unicode)", true)
+}
+
+func (a *AddACEModule) Name() string {
+	return "add-ace"
+}
+
+func (a *AddACEModule) Description() string {
+	return "Grant a principal rights (GenericAll, DCSync, ...) on an object by adding ACEs to its DACL, or revert to a saved DACL"
+}
+
+func (a *AddACEModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(a.Name(), pflag.ExitOnError)
+	flags.StringVar(&a.Target, "target", "", "DN or sAMAccountName of the object to modify (default: the domain object)")
+	flags.StringVar(&a.Principal, "principal", "", "sAMAccountName (or DN) of the principal to grant the rights to")
+	flags.StringVar(&a.SID, "sid", "", "SID of the principal to grant the rights to, instead of --principal")
+	flags.StringVar(&a.Rights, "rights", "genericall", "Rights to grant: genericall, genericwrite, writedacl, writeowner, dcsync, resetpassword, writemembers")
+	flags.BoolVar(&a.Inherit, "inherit", false, "Make the ACEs inheritable by child objects (container inherit)")
+	flags.StringVar(&a.Action, "action", "add", "Whether to add the ACEs or restore a saved DACL: add, revert")
+	flags.StringVar(&a.Backup, "backup", "", "File to save the original DACL to when adding, or to restore it from when reverting (default when adding: <target>_<timestamp>.sd.json)")
+	return flags
+}
+
+func (a *AddACEModule) DefaultAttrs() []string {
+	return []string{"action", "aces", "backupFile", "status"}
+}
+
+func (a *AddACEModule) IsWriteModule() bool {
+	return true
+}
+
+func (a *AddACEModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	switch strings.ToLower(a.Action) {
+	case "add":
+		return a.add(session, attrs)
+	case "revert":
+		return a.revert(session, attrs)
+	}
+	return fmt.Errorf("invalid action %q (must be one of add, revert)", a.Action)
+}
+
+func (a *AddACEModule) add(session *ldapsession.LDAPSession, attrs []string) error {
+	build, ok := aceRights[strings.ToLower(a.Rights)]
+	if !ok {
+		return fmt.Errorf("unknown rights %q", a.Rights)
+	}
+	if a.Principal == "" && a.SID == "" {
+		return fmt.Errorf("must provide a --principal or a --sid")
+	}
+	dn := session.NamingContexts.Default
+	var err error
+	if a.Target != "" {
+		if dn, err = resolveDN(session, a.Target, ""); err != nil {
+			return err
+		}
+	}
+	var sid secdesc.SID
+	if a.SID != "" {
+		sid, err = secdesc.ParseSID(a.SID)
+	} else {
+		sid, err = lookupSID(session, a.Principal)
+	}
+	if err != nil {
+		return err
+	}
+
+	raw, sd, err := readDACL(session, dn)
+	if err != nil {
+		return err
+	}
+	original := sd.SDDL()
+	aces := build(sid)
+	var added, described []string
+	principal := session.SIDResolver().Name(sid.String())
+	for i := range aces {
+		if a.Inherit {
+			aces[i].Flags |= secdesc.ContainerInheritACE
+		}
+		added = append(added, aces[i].SDDL())
+		described = append(described, fmt.Sprintf("%s\n      %s to %s", aces[i].SDDL(), aces[i].Describe(), principal))
+	}
+	// explicit ACEs go before inherited ones, which is where Windows keeps them
+	pos := 0
+	for pos < len(sd.DACL.ACEs) && sd.DACL.ACEs[pos].Flags&secdesc.InheritedACE == 0 {
+		pos++
+	}
+	merged := append(append([]secdesc.ACE(nil), sd.DACL.ACEs[:pos]...), aces...)
+	sd.DACL.ACEs = append(merged, sd.DACL.ACEs[pos:]...)
+
+	fmt.Fprintf(os.Stderr, "[*] Adding to %s:\n    %s\n[*] Original DACL:\n    %s\n[*] New DACL:\n    %s\n", dn, strings.Join(described, "\n    "), original, sd.SDDL())
+	values := map[string][]string{"action": {"add"}, "aces": added}
+	if !session.DryRun() {
+		backup, err := a.saveBackup(dn, raw, original)
+		if err != nil {
+			return fmt.Errorf("unable to save the original DACL, not changing anything: %s", err)
+		}
+		values["backupFile"] = []string{backup}
+	}
+	applied, err := writeDACL(session, dn, sd.Bytes())
+	if err != nil {
+		return fmt.Errorf("unable to write DACL: %s", err)
+	}
+	values["status"] = []string{writeStatus(session, applied)}
+	writeResult(session, dn, values, attrs)
+	return nil
+}
+
+func (a *AddACEModule) saveBackup(dn string, raw []byte, sddl string) (string, error) {
+	path := a.Backup
+	if path == "" {
+		name := strings.TrimPrefix(strings.SplitN(dn, ",", 2)[0], "CN=")
+		name = strings.NewReplacer("=", "_", " ", "_", "$", "").Replace(name)
+		path = fmt.Sprintf("%s_%d.sd.json", name, time.Now().Unix())
+	}
+	b, err := json.MarshalIndent(descriptorBackup{DN: dn, SDDL: sddl, Descriptor: base64.StdEncoding.EncodeToString(raw)}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err = ioutil.WriteFile(path, b, 0600); err != nil {
+		return "", err
+	}
+	fmt.Fprintf(os.Stderr, "[+] Saved original DACL to %s\n", path)
+	return path, nil
+}
+
+func (a *AddACEModule) revert(session *ldapsession.LDAPSession, attrs []string) error {
+	if a.Backup == "" {
+		return fmt.Errorf("must provide the --backup file to restore")
+	}
+	b, err := ioutil.ReadFile(a.Backup)
+	if err != nil {
+		return err
+	}
+	var backup descriptorBackup
+	if err = json.Unmarshal(b, &backup); err != nil {
+		return fmt.Errorf("invalid backup file %q: %s", a.Backup, err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(backup.Descriptor)
+	if err != nil {
+		return fmt.Errorf("invalid backup file %q: %s", a.Backup, err)
+	}
+	if _, err = secdesc.Parse(raw); err != nil {
+		return fmt.Errorf("invalid descriptor in %q: %s", a.Backup, err)
+	}
+	_, current, err := readDACL(session, backup.DN)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "[*] Restoring DACL of %s\n[*] Current DACL:\n    %s\n[*] Restored DACL:\n    %s\n", backup.DN, current.SDDL(), backup.SDDL)
+	applied, err := writeDACL(session, backup.DN, raw)
+	if err != nil {
+		return fmt.Errorf("unable to restore DACL: %s", err)
+	}
+	writeResult(session, backup.DN, map[string][]string{
+		"action":     {"revert"},
+		"backupFile": {a.Backup},
+		"status":     {writeStatus(session, applied)},
+	}, attrs)
+	return nil
+}
+
+// readDACL reads the owner, group and DACL of an object's nTSecurityDescriptor
+func readDACL(session *ldapsession.LDAPSession, dn string) ([]byte, *secdesc.SecurityDescriptor, error) {
+	controls := []ldap.Control{ldapsession.NewSDFlagsControl(ldapsession.OwnerSecurityInformation | ldapsession.GroupSecurityInformation | ldapsession.DACLSecurityInformation)}
+	sr := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"nTSecurityDescriptor"}, controls)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(res.Entries) == 0 || len(res.Entries[0].GetRawAttributeValue("nTSecurityDescriptor")) == 0 {
+		return nil, nil, fmt.Errorf("unable to read the security descriptor of %q", dn)
+	}
+	raw := res.Entries[0].GetRawAttributeValue("nTSecurityDescriptor")
+	sd, err := secdesc.Parse(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse the security descriptor of %q: %s", dn, err)
+	}
+	if sd.DACL == nil {
+		sd.DACL = &secdesc.ACL{Revision: 4}
+	}
+	return raw, sd, nil
+}
+
+// writeDACL replaces only the DACL part of an object's nTSecurityDescriptor
+func writeDACL(session *ldapsession.LDAPSession, dn string, descriptor []byte) (bool, error) {
+	req := ldap.NewModifyRequest(dn, []ldap.Control{ldapsession.NewSDFlagsControl(ldapsession.DACLSecurityInformation)})
+	req.Replace("nTSecurityDescriptor", []string{string(descriptor)})
+	return session.Modify(req)
+}
@@ -0,0 +1,182 @@
+package modules
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+// the only userAccountControl bit a computer created through the quota may have
+const workstationTrustAccount = 0x1000
+
+type AddComputerModule struct {
+	ComputerName string
+	Password     string
+	SPNs         []string
+	DNSHostName  string
+	Container    string
+	IgnoreQuota  bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(AddComputerModule))
+}
+
+func (a *AddComputerModule) Name() string {
+	return "add-computer"
+}
+
+func (a *AddComputerModule) Description() string {
+	return "Create a computer account (within ms-DS-MachineAccountQuota) with a chosen password"
+}
+
+func (a *AddComputerModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(a.Name(), pflag.ExitOnError)
+	flags.StringVar(&a.ComputerName, "computer-name", "", "Name of the computer to create (the trailing $ is optional)")
+	flags.StringVar(&a.Password, "computer-pass", "", "Password for the computer account (default: random)")
+	flags.StringSliceVar(&a.SPNs, "spns", nil, "Comma separated servicePrincipalNames (default: HOST and RestrictedKrbHost for the name and dNSHostName)")
+	flags.StringVar(&a.DNSHostName, "dns-hostname", "", "dNSHostName for the computer (default: <name>.<domain>)")
+	flags.StringVar(&a.Container, "container", "", "DN of the container or OU to create the computer in (default: CN=Computers)")
+	flags.BoolVar(&a.IgnoreQuota, "ignore-quota", false, "Don't check ms-DS-MachineAccountQuota first (e.g. when the bound account can create computers itself)")
+	return flags
+}
+
+func (a *AddComputerModule) DefaultAttrs() []string {
+	return []string{"sAMAccountName", "dNSHostName", "servicePrincipalName", "status"}
+}
+
+func (a *AddComputerModule) IsWriteModule() bool {
+	return true
+}
+
+func (a *AddComputerModule) Run(session *ldapsession.LDAPSession, attrs []string) (err error) {
+	name := strings.TrimSuffix(a.ComputerName, "$")
+	if name == "" {
+		return fmt.Errorf("must provide a --computer-name")
+	}
+	if strings.ContainsAny(name, `,+"\<>;=/`) {
+		return fmt.Errorf("invalid computer name %q", name)
+	}
+	if !session.Encrypted() {
+		return fmt.Errorf("computer accounts need a password, which can only be set over an encrypted connection, re-run with --secure")
+	}
+	if !a.IgnoreQuota {
+		if err = a.checkQuota(session); err != nil {
+			return err
+		}
+	}
+
+	domain := ldapsession.DNToDomain(session.NamingContexts.Default)
+	hostname := a.DNSHostName
+	if hostname == "" {
+		hostname = strings.ToLower(fmt.Sprintf("%s.%s", name, domain))
+	}
+	spns := a.SPNs
+	if len(spns) == 0 {
+		for _, service := range []string{"HOST", "RestrictedKrbHost"} {
+			spns = append(spns, fmt.Sprintf("%s/%s", service, name), fmt.Sprintf("%s/%s", service, hostname))
+		}
+	}
+	password := a.Password
+	if password == "" {
+		if password, err = randomPassword(20); err != nil {
+			return err
+		}
+	}
+	container := a.Container
+	if container == "" {
+		container = "CN=Computers," + session.NamingContexts.Default
+	}
+
+	dn := fmt.Sprintf("CN=%s,%s", name, container)
+	sam := name + "$"
+	req := ldap.NewAddRequest(dn, nil)
+	req.Attribute("objectClass", []string{"computer"})
+	req.Attribute("sAMAccountName", []string{sam})
+	req.Attribute("userAccountControl", []string{strconv.Itoa(workstationTrustAccount)})
+	req.Attribute("dNSHostName", []string{hostname})
+	req.Attribute("servicePrincipalName", spns)
+	req.Attribute("unicodePwd", []string{encodePassword(password)})
+	applied, err := session.Add(req)
+	if err != nil {
+		return fmt.Errorf("unable to create computer: %s", err)
+	}
+	if applied && a.Password == "" {
+		fmt.Fprintf(os.Stderr, "[+] Created %s with password: %s\n", sam, password)
+	}
+	writeResult(session, dn, map[string][]string{
+		"sAMAccountName":       {sam},
+		"dNSHostName":          {hostname},
+		"servicePrincipalName": spns,
+		"status":               {writeStatus(session, applied)},
+	}, attrs)
+	return nil
+}
+
+// checkQuota makes sure the bound account hasn't used up its machine account quota
+func (a *AddComputerModule) checkQuota(session *ldapsession.LDAPSession) error {
+	sr := ldap.NewSearchRequest(session.NamingContexts.Default, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"ms-DS-MachineAccountQuota"}, nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		return err
+	}
+	if len(res.Entries) == 0 {
+		return fmt.Errorf("unable to read ms-DS-MachineAccountQuota")
+	}
+	quota, err := strconv.Atoi(res.Entries[0].GetAttributeValue("ms-DS-MachineAccountQuota"))
+	if err != nil {
+		return fmt.Errorf("unable to read ms-DS-MachineAccountQuota, use --ignore-quota to try anyway")
+	}
+	if quota == 0 {
+		return fmt.Errorf("ms-DS-MachineAccountQuota is 0, so only accounts with rights to create computers can add one (use --ignore-quota to try anyway)")
+	}
+
+	options := session.Options()
+	_, user := splitUsername(options.Username, options.Domain)
+	sid, err := lookupSID(session, user)
+	if err != nil {
+		session.Log.Warnf("unable to find the bound account's SID, not counting computers it already created: %s", err)
+		return nil
+	}
+	sr = session.MakeSimpleSearchRequest(fmt.Sprintf("(&(objectCategory=computer)(ms-DS-CreatorSID=%s))", escapeBinary(sid.Bytes())), []string{"sAMAccountName"})
+	res, err = session.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+	session.Log.Infof("ms-DS-MachineAccountQuota is %d, %s has created %d computer(s)", quota, user, len(res.Entries))
+	if len(res.Entries) >= quota {
+		return fmt.Errorf("%s has already created %d computer(s), reaching the ms-DS-MachineAccountQuota of %d (use --ignore-quota to try anyway)", user, len(res.Entries), quota)
+	}
+	return nil
+}
+
+// escapeBinary escapes every byte of a binary value for use in a search filter
+func escapeBinary(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		fmt.Fprintf(&sb, "\\%02x", c)
+	}
+	return sb.String()
+}
+
+// randomPassword generates a password of printable characters
+func randomPassword(length int) (string, error) {
+	const chars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!@#%^&*()-_=+"
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = chars[n.Int64()]
+	}
+	return string(b), nil
+}
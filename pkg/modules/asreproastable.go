@@ -0,0 +1,48 @@
+package modules
+
+import (
+	"fmt"
+
+	uac "github.com/audibleblink/msldapuac"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type ASREPRoastableModule struct {
+	Enabled bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(ASREPRoastableModule))
+}
+
+func (a *ASREPRoastableModule) Name() string {
+	return "asreproastable-users"
+}
+
+func (a *ASREPRoastableModule) Description() string {
+	return "Enumerate accounts that don't require Kerberos pre-authentication (DONT_REQ_PREAUTH, for AS-REP roasting)"
+}
+
+func (a *ASREPRoastableModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(a.Name(), pflag.ExitOnError)
+	flags.BoolVar(&a.Enabled, "enabled", false, "Only show enabled accounts")
+	return flags
+}
+
+func (a *ASREPRoastableModule) DefaultAttrs() []string {
+	return []string{"cn", "sAMAccountName", "userAccountControl", "pwdLastSet"}
+}
+
+func (a *ASREPRoastableModule) Filter() string {
+	filter := fmt.Sprintf("(userAccountControl:1.2.840.113556.1.4.803:=%d)", uac.DontReqPreauth)
+	if a.Enabled {
+		filter = fmt.Sprintf("(&%s(!(userAccountControl:1.2.840.113556.1.4.803:=%d)))", filter, uac.Accountdisable)
+	}
+	return filter
+}
+
+func (a *ASREPRoastableModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	sr := session.MakeSimpleSearchRequest(a.Filter(), attrs)
+	return session.ExecuteSearchRequest(sr)
+}
@@ -0,0 +1,573 @@
+package modules
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	uac "github.com/audibleblink/msldapuac"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type AuditModule struct {
+	Checks    []string
+	StaleDays int
+}
+
+func init() {
+	AllModules = append(AllModules, new(AuditModule))
+	adschema.RegisterAttribute("check", "String(Unicode)", true)
+	adschema.RegisterAttribute("severity", "String(Unicode)", true)
+	adschema.RegisterAttribute("finding", "String(Unicode)", true)
+	adschema.RegisterAttribute("objects", "String(Unicode)", false)
+}
+
+// Severities of audit findings, with what each one takes off the score
+var auditSeverities = []struct {
+	name   string
+	weight int
+}{
+	{"high", 10},
+	{"medium", 4},
+	{"low", 1},
+	{"info", 0},
+}
+
+// auditFinding is one thing an audit check found, with the objects it's about
+type auditFinding struct {
+	check, severity, finding string
+	objects                  []string
+}
+
+// auditAdmin is an account SDProp protects (or did, adminCount stays set after it leaves the groups)
+type auditAdmin struct {
+	dn                  string
+	flags               int
+	protected, inPUsers bool
+}
+
+// auditChecks are the checks the audit runs, in the order they're reported
+var auditChecks = []struct {
+	name string
+	run  func(a *AuditModule, session *ldapsession.LDAPSession, admins *auditAdmins) ([]auditFinding, error)
+}{
+	{"password-policy", (*AuditModule).checkPasswordPolicy},
+	{"stale", (*AuditModule).checkStale},
+	{"admincount", (*AuditModule).checkAdminCount},
+	{"delegation", (*AuditModule).checkDelegation},
+	{"adcs", (*AuditModule).checkADCS},
+	{"laps", (*AuditModule).checkLAPS},
+	{"dsheuristics", (*AuditModule).checkDSHeuristics},
+	{"trusts", (*AuditModule).checkTrusts},
+}
+
+// protectedRIDs are the domain accounts and groups AdminSDHolder protects, protectedBuiltins the builtin groups
+var (
+	protectedRIDs     = map[uint32]bool{500: true, 502: true, 512: true, 516: true, 518: true, 519: true, 521: true, 526: true, 527: true}
+	protectedBuiltins = map[string]bool{"S-1-5-32-544": true, "S-1-5-32-548": true, "S-1-5-32-549": true, "S-1-5-32-550": true, "S-1-5-32-551": true, "S-1-5-32-552": true}
+)
+
+// protectedUsersRID is the RID of the Protected Users group
+const protectedUsersRID = 525
+
+// trustedDomain trustAttributes
+const (
+	trustQuarantinedDomain   = 0x4
+	trustForestTransitive    = 0x8
+	trustWithinForest        = 0x20
+	trustTreatAsExternal     = 0x40
+	trustEnableTGTDelegation = 0x800
+)
+
+// Certificate template flags and EKUs the ADCS check looks at
+const (
+	ctEnrolleeSuppliesSubject = 0x1
+	ctPendAllRequests         = 0x2
+)
+
+var (
+	authenticationEKUs = map[string]bool{"1.3.6.1.5.5.7.3.2": true, "1.3.6.1.4.1.311.20.2.2": true, "1.3.6.1.5.2.3.4": true, "2.5.29.37.0": true}
+	anyPurposeEKU      = "2.5.29.37.0"
+	enrollmentAgentEKU = "1.3.6.1.4.1.311.20.2.1"
+)
+
+func (a *AuditModule) Name() string {
+	return "audit"
+}
+
+func (a *AuditModule) Description() string {
+	return "Run the defensive checks (password policy, stale and admin accounts, delegation, AD CS, LAPS, dsHeuristics, trusts) as one scored report"
+}
+
+func (a *AuditModule) FlagSet() *pflag.FlagSet {
+	var names []string
+	for _, c := range auditChecks {
+		names = append(names, c.name)
+	}
+	flags := pflag.NewFlagSet(a.Name(), pflag.ExitOnError)
+	flags.StringSliceVar(&a.Checks, "checks", names, "Comma separated checks to run")
+	flags.IntVar(&a.StaleDays, "stale-days", 90, "Days without a logon after which an enabled account is stale")
+	return flags
+}
+
+func (a *AuditModule) DefaultAttrs() []string {
+	return []string{"check", "severity", "finding", "objects"}
+}
+
+func (a *AuditModule) IsReportModule() bool {
+	return true
+}
+
+func (a *AuditModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	if a.StaleDays < 1 {
+		return fmt.Errorf("--stale-days must be at least 1")
+	}
+	run := make(map[string]bool)
+	for _, name := range a.Checks {
+		name = strings.ToLower(strings.TrimSpace(name))
+		found := false
+		for _, c := range auditChecks {
+			found = found || c.name == name
+		}
+		if !found {
+			return fmt.Errorf("unknown check %q", name)
+		}
+		run[name] = true
+	}
+
+	var findings []auditFinding
+	admins := &auditAdmins{}
+	for _, c := range auditChecks {
+		if !run[c.name] {
+			continue
+		}
+		found, err := c.run(a, session, admins)
+		if err != nil {
+			// one check failing, usually for lack of rights, still leaves the rest of the report
+			session.Log.Warnf("%s check failed: %s", c.name, err)
+			continue
+		}
+		findings = append(findings, found...)
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return severityRank(findings[i].severity) < severityRank(findings[j].severity)
+	})
+	score := 100
+	counts := make(map[string]int)
+	var entries []*ldap.Entry
+	for _, f := range findings {
+		counts[f.severity]++
+		score -= auditSeverities[severityRank(f.severity)].weight
+		values := map[string][]string{"check": {f.check}, "severity": {f.severity}, "finding": {f.finding}}
+		if len(f.objects) > 0 {
+			values["objects"] = f.objects
+		}
+		entries = append(entries, ldap.NewEntry("", values))
+	}
+	if score < 0 {
+		score = 0
+	}
+	var summary []string
+	for _, s := range auditSeverities {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[s.name], s.name))
+	}
+	fmt.Fprintf(os.Stderr, "[+] Audit score: %d/100 (%s)\n", score, strings.Join(summary, ", "))
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+func severityRank(severity string) int {
+	for i, s := range auditSeverities {
+		if s.name == severity {
+			return i
+		}
+	}
+	return len(auditSeverities) - 1
+}
+
+// readDomainObject reads attributes of the domain object
+func readDomainObject(session *ldapsession.LDAPSession, attrs []string) (*ldap.Entry, error) {
+	sr := ldap.NewSearchRequest(session.NamingContexts.Default, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", attrs, nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) == 0 {
+		return nil, fmt.Errorf("domain object not found")
+	}
+	return res.Entries[0], nil
+}
+
+func (a *AuditModule) checkPasswordPolicy(session *ldapsession.LDAPSession, admins *auditAdmins) ([]auditFinding, error) {
+	domain, err := readDomainObject(session, []string{"minPwdLength", "pwdHistoryLength", "pwdProperties", "lockoutThreshold"})
+	if err != nil {
+		return nil, err
+	}
+	var findings []auditFinding
+	add := func(severity, format string, args ...interface{}) {
+		findings = append(findings, auditFinding{check: "password-policy", severity: severity, finding: fmt.Sprintf(format, args...)})
+	}
+	minLength, _ := strconv.Atoi(domain.GetAttributeValue("minPwdLength"))
+	switch {
+	case minLength < 8:
+		add("high", "minimum password length is %d", minLength)
+	case minLength < 12:
+		add("medium", "minimum password length is %d", minLength)
+	}
+	properties, _ := strconv.Atoi(domain.GetAttributeValue("pwdProperties"))
+	// DOMAIN_PASSWORD_COMPLEX and DOMAIN_PASSWORD_STORE_CLEARTEXT
+	if properties&0x1 == 0 {
+		add("medium", "password complexity isn't required")
+	}
+	if properties&0x10 != 0 {
+		add("high", "passwords are stored with reversible encryption")
+	}
+	if threshold, _ := strconv.Atoi(domain.GetAttributeValue("lockoutThreshold")); threshold == 0 {
+		add("medium", "accounts are never locked out (lockoutThreshold is 0)")
+	}
+	if history, _ := strconv.Atoi(domain.GetAttributeValue("pwdHistoryLength")); history < 12 {
+		add("low", "only the last %d passwords are remembered", history)
+	}
+
+	filter := fmt.Sprintf("(&(objectCategory=person)(objectClass=user)(!(userAccountControl:1.2.840.113556.1.4.803:=%d))(userAccountControl:1.2.840.113556.1.4.803:=%d))",
+		uac.Accountdisable, uac.EncryptedTextPwdAllowed)
+	reversible, err := a.searchDNs(session, filter)
+	if err != nil {
+		return findings, err
+	}
+	if len(reversible) > 0 {
+		findings = append(findings, auditFinding{"password-policy", "high",
+			fmt.Sprintf("%d enabled accounts store their password with reversible encryption", len(reversible)), reversible})
+	}
+	return findings, nil
+}
+
+func (a *AuditModule) checkStale(session *ldapsession.LDAPSession, admins *auditAdmins) ([]auditFinding, error) {
+	cutoff := session.ServerTime().Add(-time.Duration(a.StaleDays) * 24 * time.Hour).UTC()
+	// lastLogonTimestamp only replicates every 9 to 14 days, which is close enough for months. Accounts that never
+	// logged on are stale once they're as old as the cutoff
+	stale := fmt.Sprintf("(!(userAccountControl:1.2.840.113556.1.4.803:=%d))(|(lastLogonTimestamp<=%d)(&(!(lastLogonTimestamp=*))(whenCreated<=%s)))",
+		uac.Accountdisable, cutoff.UnixNano()/100+116444736000000000, cutoff.Format("20060102150405.0Z"))
+	var findings []auditFinding
+	for _, kind := range []struct{ filter, severity, what string }{
+		{"(objectCategory=person)(objectClass=user)(adminCount=1)", "high", "privileged accounts"},
+		{"(objectCategory=person)(objectClass=user)(!(adminCount=1))", "medium", "user accounts"},
+		{"(objectCategory=computer)", "low", "computer accounts"},
+	} {
+		dns, err := a.searchDNs(session, "(&"+kind.filter+stale+")")
+		if err != nil {
+			return findings, err
+		}
+		if len(dns) > 0 {
+			findings = append(findings, auditFinding{"stale", kind.severity,
+				fmt.Sprintf("%d enabled %s haven't logged on in %d days", len(dns), kind.what, a.StaleDays), dns})
+		}
+	}
+	return findings, nil
+}
+
+func (a *AuditModule) checkAdminCount(session *ldapsession.LDAPSession, admins *auditAdmins) ([]auditFinding, error) {
+	accounts, err := admins.read(session)
+	if err != nil {
+		return nil, err
+	}
+	var orphaned []string
+	for _, admin := range accounts {
+		if !admin.protected {
+			orphaned = append(orphaned, admin.dn)
+		}
+	}
+	var findings []auditFinding
+	if len(orphaned) > 0 {
+		// SDProp stops updating them, but leaves their ACL without inheritance
+		findings = append(findings, auditFinding{"admincount", "low",
+			fmt.Sprintf("%d enabled accounts have adminCount=1 but aren't in a protected group anymore", len(orphaned)), orphaned})
+	}
+	findings = append(findings, auditFinding{"admincount", "info",
+		fmt.Sprintf("%d enabled accounts are in protected groups", len(accounts)-len(orphaned)), nil})
+	return findings, nil
+}
+
+func (a *AuditModule) checkDelegation(session *ldapsession.LDAPSession, admins *auditAdmins) ([]auditFinding, error) {
+	var findings []auditFinding
+	for _, kind := range []struct{ filter, severity, finding string }{
+		{fmt.Sprintf("(&(userAccountControl:1.2.840.113556.1.4.803:=%d)(!(userAccountControl:1.2.840.113556.1.4.803:=%d)))", uac.TrustedForDelegation, uac.ServerTrustAccount),
+			"high", "%d accounts other than DCs have unconstrained delegation"},
+		{fmt.Sprintf("(userAccountControl:1.2.840.113556.1.4.803:=%d)", uac.TrustedToAuthForDelegation),
+			"medium", "%d accounts have constrained delegation with protocol transition (any user, without their credentials)"},
+		{fmt.Sprintf("(&(msDS-AllowedToDelegateTo=*)(!(userAccountControl:1.2.840.113556.1.4.803:=%d)))", uac.TrustedToAuthForDelegation),
+			"low", "%d accounts have constrained delegation"},
+		{"(" + rbcdAttribute + "=*)", "info", "%d accounts allow resource-based constrained delegation to them"},
+	} {
+		dns, err := a.searchDNs(session, kind.filter)
+		if err != nil {
+			return findings, err
+		}
+		if len(dns) > 0 {
+			findings = append(findings, auditFinding{"delegation", kind.severity, fmt.Sprintf(kind.finding, len(dns)), dns})
+		}
+	}
+
+	accounts, err := admins.read(session)
+	if err != nil {
+		return findings, err
+	}
+	var delegable []string
+	for _, admin := range accounts {
+		if admin.protected && admin.flags&uac.NotDelegated == 0 && !admin.inPUsers {
+			delegable = append(delegable, admin.dn)
+		}
+	}
+	if len(delegable) > 0 {
+		findings = append(findings, auditFinding{"delegation", "medium",
+			fmt.Sprintf("%d privileged accounts can be delegated (not sensitive, not in Protected Users)", len(delegable)), delegable})
+	}
+	return findings, nil
+}
+
+func (a *AuditModule) checkADCS(session *ldapsession.LDAPSession, admins *auditAdmins) ([]auditFinding, error) {
+	publishers, err := new(ADCSModule).templatePublishers(session)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	sr := session.MakeSimpleSearchRequest("(objectClass=pKICertificateTemplate)", templateAttrs)
+	sr.BaseDN = "CN=Certificate Templates," + publicKeyServices + session.NamingContexts.Configuration
+	sr.Scope = ldap.ScopeSingleLevel
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	found := make(map[string][]string)
+	for _, entry := range res.Entries {
+		if len(publishers[strings.ToLower(entry.GetAttributeValue("cn"))]) == 0 {
+			continue
+		}
+		raw := entry.GetRawAttributeValue("nTSecurityDescriptor")
+		enroll, _ := enrollmentRights(session, raw, entry.DN)
+		low, lowWrite := false, false
+		for _, sid := range enroll {
+			low = low || isLowPrivilege(sid)
+		}
+		for _, sid := range templateWriters(raw) {
+			lowWrite = lowWrite || isLowPrivilege(sid)
+		}
+		for _, esc := range templateESCs(entry, low, lowWrite) {
+			found[esc] = append(found[esc], entry.DN)
+		}
+	}
+	var findings []auditFinding
+	for _, kind := range []struct {
+		esc               string
+		severity, finding string
+	}{
+		{"ESC1", "high", "%d published templates let low privileged users enroll for authentication certificates with a subject of their choosing (ESC1)"},
+		{"ESC4", "high", "%d published templates can be modified by low privileged users (ESC4)"},
+		{"ESC2", "medium", "%d published templates let low privileged users enroll for any purpose certificates (ESC2)"},
+		{"ESC3", "medium", "%d published templates let low privileged users enroll as enrollment agents (ESC3)"},
+	} {
+		if dns := found[kind.esc]; len(dns) > 0 {
+			findings = append(findings, auditFinding{"adcs", kind.severity, fmt.Sprintf(kind.finding, len(dns)), dns})
+		}
+	}
+	return findings, nil
+}
+
+func (a *AuditModule) checkLAPS(session *ldapsession.LDAPSession, admins *auditAdmins) ([]auditFinding, error) {
+	// legacy LAPS and Windows LAPS each add their password expiration attribute to the schema
+	var expirations []string
+	for _, attr := range []string{"ms-Mcs-AdmPwdExpirationTime", "msLAPS-PasswordExpirationTime"} {
+		sr := session.MakeSimpleSearchRequest(fmt.Sprintf("(&(objectClass=attributeSchema)(lDAPDisplayName=%s))", attr), []string{"cn"})
+		sr.BaseDN = session.NamingContexts.Schema
+		res, err := session.GetSearchResults(sr)
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Entries) > 0 {
+			expirations = append(expirations, attr)
+		}
+	}
+	if len(expirations) == 0 {
+		return []auditFinding{{"laps", "high", "LAPS isn't deployed (neither the legacy nor the Windows LAPS schema is there)", nil}}, nil
+	}
+
+	computers := fmt.Sprintf("(objectCategory=computer)(!(userAccountControl:1.2.840.113556.1.4.803:=%d))(!(userAccountControl:1.2.840.113556.1.4.803:=%d))",
+		uac.Accountdisable, uac.ServerTrustAccount)
+	all, err := a.searchDNs(session, "(&"+computers+")")
+	if err != nil {
+		return nil, err
+	}
+	var without strings.Builder
+	for _, attr := range expirations {
+		without.WriteString("(!(" + attr + "=*))")
+	}
+	uncovered, err := a.searchDNs(session, "(&"+computers+without.String()+")")
+	if err != nil {
+		return nil, err
+	}
+	if len(uncovered) == 0 {
+		return nil, nil
+	}
+	return []auditFinding{{"laps", "medium",
+		fmt.Sprintf("%d of %d enabled computers (%d%%) have no LAPS password", len(uncovered), len(all), len(uncovered)*100/len(all)), uncovered}}, nil
+}
+
+func (a *AuditModule) checkDSHeuristics(session *ldapsession.LDAPSession, admins *auditAdmins) ([]auditFinding, error) {
+	var findings []auditFinding
+	sr := ldap.NewSearchRequest("CN=Directory Service,CN=Windows NT,CN=Services,"+session.NamingContexts.Configuration,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"dSHeuristics"}, nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) > 0 {
+		// each character of dSHeuristics is a setting (MS-ADTS 6.1.1.2.4.1.2)
+		heuristics := res.Entries[0].GetAttributeValue("dSHeuristics")
+		at := func(i int) byte {
+			if i < len(heuristics) {
+				return heuristics[i]
+			}
+			return '0'
+		}
+		if at(6) == '2' {
+			findings = append(findings, auditFinding{"dsheuristics", "high", "anonymous LDAP operations are allowed (fLDAPBlockAnonOps)", nil})
+		}
+		if at(15) != '0' {
+			findings = append(findings, auditFinding{"dsheuristics", "medium", "operator groups are left out of AdminSDHolder protection (dwAdminSDExMask)", nil})
+		}
+		if at(2) == '1' {
+			findings = append(findings, auditFinding{"dsheuristics", "info", "List Object mode is on (fDoListObject)", nil})
+		}
+	}
+
+	// anonymous binds can read most of the directory when Pre-Windows 2000 Compatible Access has Anonymous Logon or Everyone
+	sr = ldap.NewSearchRequest("CN=Pre-Windows 2000 Compatible Access,CN=Builtin,"+session.NamingContexts.Default,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"member"}, nil)
+	if res, err := session.GetSearchResults(sr); err == nil && len(res.Entries) > 0 {
+		for _, member := range res.Entries[0].GetAttributeValues("member") {
+			if rdn := strings.ToUpper(strings.SplitN(member, ",", 2)[0]); rdn == "CN=S-1-5-7" || rdn == "CN=S-1-1-0" {
+				findings = append(findings, auditFinding{"dsheuristics", "medium",
+					"Pre-Windows 2000 Compatible Access has Anonymous Logon or Everyone as a member", []string{member}})
+			}
+		}
+	}
+
+	domain, err := readDomainObject(session, []string{"ms-DS-MachineAccountQuota"})
+	if err != nil {
+		return findings, err
+	}
+	if quota, _ := strconv.Atoi(domain.GetAttributeValue("ms-DS-MachineAccountQuota")); quota > 0 {
+		findings = append(findings, auditFinding{"dsheuristics", "medium", fmt.Sprintf("any user can join %d computers to the domain (ms-DS-MachineAccountQuota)", quota), nil})
+	}
+	return findings, nil
+}
+
+func (a *AuditModule) checkTrusts(session *ldapsession.LDAPSession, admins *auditAdmins) ([]auditFinding, error) {
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest("(objectClass=trustedDomain)",
+		[]string{"trustPartner", "trustDirection", "trustAttributes", "msDS-SupportedEncryptionTypes"}))
+	if err != nil {
+		return nil, err
+	}
+	var findings []auditFinding
+	for _, trust := range res.Entries {
+		partner := trust.GetAttributeValue("trustPartner")
+		direction, _ := strconv.Atoi(trust.GetAttributeValue("trustDirection"))
+		attributes, _ := strconv.Atoi(trust.GetAttributeValue("trustAttributes"))
+		add := func(severity, finding string) {
+			findings = append(findings, auditFinding{"trusts", severity, fmt.Sprintf(finding, partner), []string{trust.DN}})
+		}
+		// SID filtering protects the trusting side, so it matters for outbound trusts to other forests
+		if direction&0x2 != 0 && attributes&trustWithinForest == 0 {
+			switch {
+			case attributes&trustForestTransitive == 0 && attributes&trustQuarantinedDomain == 0:
+				add("high", "SID filtering is disabled on the external trust with %s")
+			case attributes&trustForestTransitive != 0 && attributes&trustTreatAsExternal != 0:
+				add("medium", "SID history from %s is allowed (the forest trust is treated as external)")
+			}
+		}
+		if attributes&trustEnableTGTDelegation != 0 {
+			add("high", "TGTs can be delegated across the forest trust with %s (unconstrained delegation)")
+		}
+		if types, _ := strconv.Atoi(trust.GetAttributeValue("msDS-SupportedEncryptionTypes")); types&0x18 == 0 {
+			add("low", "the trust with %s only uses RC4")
+		}
+	}
+	return findings, nil
+}
+
+// auditAdmins is the enabled accounts with adminCount=1 and their groups, read during a run for the checks that need
+// them, the first time one does
+type auditAdmins struct {
+	accounts []auditAdmin
+}
+
+// read reads the enabled accounts with adminCount=1, and whether their groups still make them protected
+func (l *auditAdmins) read(session *ldapsession.LDAPSession) ([]auditAdmin, error) {
+	if l.accounts != nil {
+		return l.accounts, nil
+	}
+	filter := fmt.Sprintf("(&(objectCategory=person)(objectClass=user)(adminCount=1)(!(userAccountControl:1.2.840.113556.1.4.803:=%d)))", uac.Accountdisable)
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter, []string{"userAccountControl", "objectSid"}))
+	if err != nil {
+		return nil, err
+	}
+	domainSID := session.SIDResolver().DomainSID()
+	admins := []auditAdmin{}
+	for _, entry := range res.Entries {
+		admin := auditAdmin{dn: entry.DN}
+		admin.flags, _ = strconv.Atoi(entry.GetAttributeValue("userAccountControl"))
+		// the built in Administrator and krbtgt are protected themselves
+		if sid, _, err := secdesc.DecodeSID(entry.GetRawAttributeValue("objectSid")); err == nil {
+			admin.protected = protectedRID(sid.String(), domainSID)
+		}
+		groups, err := tokenGroups(session, entry.DN)
+		if err != nil {
+			session.Log.Warnf("unable to read the groups of %s: %s", entry.DN, err)
+			admin.protected = true
+		}
+		for sid := range groups {
+			admin.protected = admin.protected || protectedBuiltins[sid] || protectedRID(sid, domainSID)
+			admin.inPUsers = admin.inPUsers || sid == fmt.Sprintf("%s-%d", domainSID, protectedUsersRID)
+		}
+		admins = append(admins, admin)
+	}
+	l.accounts = admins
+	return admins, nil
+}
+
+// protectedRID is true for a SID in the domain with the RID of a protected account or group
+func protectedRID(sid, domainSID string) bool {
+	if domainSID == "" || !strings.HasPrefix(sid, domainSID+"-") {
+		return false
+	}
+	rid, err := strconv.ParseUint(strings.TrimPrefix(sid, domainSID+"-"), 10, 32)
+	return err == nil && protectedRIDs[uint32(rid)]
+}
+
+// searchDNs returns the DNs of the objects in the domain matching a filter
+func (a *AuditModule) searchDNs(session *ldapsession.LDAPSession, filter string) ([]string, error) {
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter, []string{"distinguishedName"}))
+	if err != nil {
+		return nil, err
+	}
+	var dns []string
+	for _, entry := range res.Entries {
+		dns = append(dns, entry.DN)
+	}
+	return dns, nil
+}
@@ -0,0 +1,201 @@
+package modules
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type AuthNPoliciesModule struct{}
+
+func init() {
+	AllModules = append(AllModules, new(AuthNPoliciesModule))
+	adschema.RegisterAttribute("msDS-AuthNPolicyEnforced", "Boolean", true)
+	adschema.RegisterAttribute("msDS-AuthNPolicySiloEnforced", "Boolean", true)
+	adschema.RegisterAttribute("msDS-AuthNPolicySiloMembers", "Object(DS-DN)", false)
+	adschema.RegisterAttribute("tgtLifetimes", "String(Unicode)", false)
+	adschema.RegisterAttribute("conditions", "String(Unicode)", false)
+	adschema.RegisterAttribute("policies", "String(Unicode)", false)
+	adschema.RegisterAttribute("assignedAccounts", "Object(DS-DN)", false)
+}
+
+// authNPolicyConfig is the container (under CN=Services in the Configuration partition) with the AuthN Policies and
+// AuthN Silos containers
+const authNPolicyConfig = "CN=AuthN Policy Configuration,CN=Services,"
+
+// authNAccountTypes are the kinds of account a policy has settings for, with the attribute prefix of each
+var authNAccountTypes = []struct{ name, prefix string }{
+	{"user", "msDS-User"},
+	{"computer", "msDS-Computer"},
+	{"service", "msDS-Service"},
+}
+
+var authNPolicyAttrs = []string{"cn", "msDS-AuthNPolicyEnforced", "msDS-AssignedAuthNPolicyBL",
+	"msDS-UserTGTLifetime", "msDS-ComputerTGTLifetime", "msDS-ServiceTGTLifetime",
+	"msDS-UserAllowedToAuthenticateFrom", "msDS-UserAllowedToAuthenticateTo", "msDS-ComputerAllowedToAuthenticateTo",
+	"msDS-ServiceAllowedToAuthenticateFrom", "msDS-ServiceAllowedToAuthenticateTo"}
+
+var authNSiloAttrs = []string{"cn", "msDS-AuthNPolicySiloEnforced", "msDS-AuthNPolicySiloMembers", "msDS-AssignedAuthNPolicySiloBL",
+	"msDS-UserAuthNPolicy", "msDS-ComputerAuthNPolicy", "msDS-ServiceAuthNPolicy"}
+
+func (a *AuthNPoliciesModule) Name() string {
+	return "authn-policies"
+}
+
+func (a *AuthNPoliciesModule) Description() string {
+	return "List authentication policies (TGT lifetimes, access conditions) and silos, with the accounts assigned to them"
+}
+
+func (a *AuthNPoliciesModule) FlagSet() *pflag.FlagSet {
+	return pflag.NewFlagSet(a.Name(), pflag.ExitOnError)
+}
+
+func (a *AuthNPoliciesModule) DefaultAttrs() []string {
+	return []string{"cn", "msDS-AuthNPolicyEnforced", "msDS-AuthNPolicySiloEnforced", "tgtLifetimes", "conditions", "policies",
+		"msDS-AuthNPolicySiloMembers", "assignedAccounts", "findings"}
+}
+
+func (a *AuthNPoliciesModule) Partition() ldapsession.Partition {
+	return ldapsession.ConfigurationPartition
+}
+
+func (a *AuthNPoliciesModule) IsReportModule() bool {
+	return true
+}
+
+func (a *AuthNPoliciesModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	base := authNPolicyConfig + session.BaseDN
+	sr := session.MakeSimpleSearchRequest("(objectClass=msDS-AuthNPolicy)", authNPolicyAttrs)
+	sr.BaseDN = "CN=AuthN Policies," + base
+	policies, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		// the containers only exist from the Windows Server 2012 R2 schema on
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return fmt.Errorf("no AuthN Policy Configuration container, the schema is older than Windows Server 2012 R2")
+		}
+		return err
+	}
+	sr = session.MakeSimpleSearchRequest("(objectClass=msDS-AuthNPolicySilo)", authNSiloAttrs)
+	sr.BaseDN = "CN=AuthN Silos," + base
+	silos, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+
+	policyNames := make(map[string]string)
+	for _, p := range policies.Entries {
+		policyNames[strings.ToLower(p.DN)] = p.GetAttributeValue("cn")
+	}
+
+	var entries []*ldap.Entry
+	for _, p := range policies.Entries {
+		values := authNEnforcement(p, "msDS-AuthNPolicyEnforced")
+		var lifetimes, conditions []string
+		for _, t := range authNAccountTypes {
+			if v := p.GetAttributeValue(t.prefix + "TGTLifetime"); v != "" {
+				lifetimes = append(lifetimes, fmt.Sprintf("%s: %.0f minutes", t.name, intervalDuration(v).Minutes()))
+			}
+			for _, dir := range []string{"From", "To"} {
+				attr := t.prefix + "AllowedToAuthenticate" + dir
+				raw := p.GetRawAttributeValue(attr)
+				if len(raw) == 0 {
+					continue
+				}
+				sd, err := secdesc.Parse(raw)
+				if err != nil {
+					session.Log.Warnf("unable to parse %s of %s: %s", attr, p.DN, err)
+					continue
+				}
+				conditions = append(conditions, fmt.Sprintf("%s allowed to authenticate %s: %s", t.name, strings.ToLower(dir), sd.SDDL()))
+			}
+		}
+		if len(lifetimes) > 0 {
+			values["tgtLifetimes"] = lifetimes
+		}
+		if len(conditions) > 0 {
+			values["conditions"] = conditions
+		}
+		if assigned := p.GetAttributeValues("msDS-AssignedAuthNPolicyBL"); len(assigned) > 0 {
+			values["assignedAccounts"] = assigned
+		}
+		entries = append(entries, ldap.NewEntry(p.DN, values))
+	}
+
+	for _, s := range silos.Entries {
+		values := authNEnforcement(s, "msDS-AuthNPolicySiloEnforced")
+		var names []string
+		for _, t := range authNAccountTypes {
+			if dn := s.GetAttributeValue(t.prefix + "AuthNPolicy"); dn != "" {
+				name := policyNames[strings.ToLower(dn)]
+				if name == "" {
+					name = dn
+				}
+				names = append(names, fmt.Sprintf("%s: %s", t.name, name))
+			}
+		}
+		if len(names) > 0 {
+			values["policies"] = names
+		}
+		members := s.GetAttributeValues("msDS-AuthNPolicySiloMembers")
+		assigned := s.GetAttributeValues("msDS-AssignedAuthNPolicySiloBL")
+		if len(members) > 0 {
+			values["msDS-AuthNPolicySiloMembers"] = members
+		}
+		if len(assigned) > 0 {
+			values["assignedAccounts"] = assigned
+		}
+		// an account is only in a silo when it's both a member and assigned to it
+		if findings := siloMismatches(members, assigned); len(findings) > 0 {
+			values["findings"] = append(values["findings"], findings...)
+		}
+		entries = append(entries, ldap.NewEntry(s.DN, values))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// authNEnforcement starts the values of a policy or silo with its name and whether it's enforced. One that isn't
+// only audits, which is noted as a finding
+func authNEnforcement(entry *ldap.Entry, attr string) map[string][]string {
+	values := map[string][]string{"cn": {entry.GetAttributeValue("cn")}}
+	enforced := entry.GetAttributeValue(attr)
+	if enforced != "" {
+		values[attr] = []string{enforced}
+	}
+	if !strings.EqualFold(enforced, "TRUE") {
+		values["findings"] = []string{"not enforced (audit only)"}
+	}
+	return values
+}
+
+// siloMismatches reports the accounts that are only half in a silo: members that aren't assigned to it, or assigned
+// accounts that aren't members, which the silo doesn't apply to
+func siloMismatches(members, assigned []string) []string {
+	isMember := make(map[string]bool)
+	for _, m := range members {
+		isMember[strings.ToLower(m)] = true
+	}
+	isAssigned := make(map[string]bool)
+	for _, a := range assigned {
+		isAssigned[strings.ToLower(a)] = true
+	}
+	var findings []string
+	for _, m := range members {
+		if !isAssigned[strings.ToLower(m)] {
+			findings = append(findings, "member but not assigned to the silo: "+m)
+		}
+	}
+	for _, a := range assigned {
+		if !isMember[strings.ToLower(a)] {
+			findings = append(findings, "assigned to the silo but not a member: "+a)
+		}
+	}
+	sort.Strings(findings)
+	return findings
+}
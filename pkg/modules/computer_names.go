@@ -0,0 +1,174 @@
+package modules
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	uac "github.com/audibleblink/msldapuac"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type ComputerNamesModule struct{}
+
+func init() {
+	AllModules = append(AllModules, new(ComputerNamesModule))
+}
+
+// hostSPNServices are the SPN services every computer registers for its own names
+var hostSPNServices = map[string]bool{"host": true, "restrictedkrbhost": true}
+
+func (c *ComputerNamesModule) Name() string {
+	return "computer-names"
+}
+
+func (c *ComputerNamesModule) Description() string {
+	return "Find computers whose sAMAccountName, dNSHostName and HOST SPNs don't agree (noPac, Certifried), and who created them"
+}
+
+func (c *ComputerNamesModule) FlagSet() *pflag.FlagSet {
+	return pflag.NewFlagSet(c.Name(), pflag.ExitOnError)
+}
+
+func (c *ComputerNamesModule) DefaultAttrs() []string {
+	return []string{"sAMAccountName", "dNSHostName", "findings"}
+}
+
+func (c *ComputerNamesModule) IsReportModule() bool {
+	return true
+}
+
+func (c *ComputerNamesModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest("(objectCategory=computer)",
+		[]string{"cn", "sAMAccountName", "dNSHostName", "msDS-AdditionalDnsHostName", "servicePrincipalName", "userAccountControl", "mS-DS-CreatorSID"}))
+	if err != nil {
+		return err
+	}
+
+	// computers may only have a dNSHostName in the domain or one of its allowed suffixes
+	suffixes := []string{strings.ToLower(ldapsession.DNToDomain(session.BaseDN))}
+	sr := ldap.NewSearchRequest(session.BaseDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"msDS-AllowedDNSSuffixes"}, nil)
+	if domain, err := session.GetSearchResults(sr); err == nil && len(domain.Entries) > 0 {
+		for _, s := range domain.Entries[0].GetAttributeValues("msDS-AllowedDNSSuffixes") {
+			suffixes = append(suffixes, strings.ToLower(s))
+		}
+	}
+
+	// lower case dNSHostName to the computers it's set on, and the sAMAccountNames of the DCs
+	hostOwners := make(map[string][]string)
+	dcNames := make(map[string]string)
+	for _, entry := range res.Entries {
+		if host := strings.ToLower(entry.GetAttributeValue("dNSHostName")); host != "" {
+			hostOwners[host] = append(hostOwners[host], entry.GetAttributeValue("sAMAccountName"))
+		}
+		flags, _ := strconv.Atoi(entry.GetAttributeValue("userAccountControl"))
+		if flags&uac.ServerTrustAccount != 0 {
+			dcNames[strings.ToLower(strings.TrimSuffix(entry.GetAttributeValue("sAMAccountName"), "$"))] = entry.DN
+		}
+	}
+
+	type flagged struct {
+		entry    *ldap.Entry
+		findings []string
+		creator  string
+	}
+	var results []flagged
+	var creators []string
+	for _, entry := range res.Entries {
+		sam := entry.GetAttributeValue("sAMAccountName")
+		name := strings.ToLower(strings.TrimSuffix(sam, "$"))
+		host := strings.ToLower(entry.GetAttributeValue("dNSHostName"))
+		var findings []string
+
+		if !strings.HasSuffix(sam, "$") {
+			findings = append(findings, "sAMAccountName doesn't end with $")
+		}
+		if dn, ok := dcNames[name]; ok && !ldapsession.EqualDN(dn, entry.DN) {
+			findings = append(findings, fmt.Sprintf("sAMAccountName is the name of DC %s", dn))
+		}
+		// the sAMAccountName of a computer with a name over 15 characters is cut short
+		if cn := strings.ToLower(entry.GetAttributeValue("cn")); cn != name && !(len(name) == 15 && strings.HasPrefix(cn, name)) {
+			findings = append(findings, fmt.Sprintf("cn %s doesn't match the sAMAccountName", entry.GetAttributeValue("cn")))
+		}
+		if host != "" {
+			if label := strings.SplitN(host, ".", 2)[0]; label != name {
+				findings = append(findings, fmt.Sprintf("dNSHostName is for %s, not %s", label, name))
+			}
+			inSuffix := false
+			for _, s := range suffixes {
+				inSuffix = inSuffix || (host != s && underSuffix(host, s))
+			}
+			if !inSuffix {
+				findings = append(findings, "dNSHostName isn't in the domain or an allowed DNS suffix")
+			}
+			if owners := hostOwners[host]; len(owners) > 1 {
+				var others []string
+				for _, o := range owners {
+					if o != sam {
+						others = append(others, o)
+					}
+				}
+				findings = append(findings, fmt.Sprintf("dNSHostName is also set on %s", strings.Join(others, ", ")))
+			}
+		}
+
+		// the computer's own SPNs should only name the computer
+		own := map[string]bool{name: true}
+		for _, h := range append(entry.GetAttributeValues("dNSHostName"), entry.GetAttributeValues("msDS-AdditionalDnsHostName")...) {
+			own[strings.ToLower(h)] = true
+			own[strings.ToLower(strings.SplitN(h, ".", 2)[0])] = true
+		}
+		var spns []string
+		for _, spn := range entry.GetAttributeValues("servicePrincipalName") {
+			service := strings.ToLower(strings.SplitN(spn, "/", 2)[0])
+			if hostSPNServices[service] && !own[strings.ToLower(spnHost(spn))] {
+				spns = append(spns, spn)
+			}
+		}
+		sort.Strings(spns)
+		for _, spn := range spns {
+			findings = append(findings, fmt.Sprintf("SPN %s names another host", spn))
+		}
+		if len(findings) == 0 {
+			continue
+		}
+
+		f := flagged{entry: entry, findings: findings}
+		if raw := entry.GetRawAttributeValue("mS-DS-CreatorSID"); len(raw) > 0 {
+			if sid, _, err := secdesc.DecodeSID(raw); err == nil {
+				f.creator = sid.String()
+				creators = append(creators, f.creator)
+			}
+		}
+		results = append(results, f)
+	}
+
+	names := session.SIDResolver().Resolve(creators)
+	var entries []*ldap.Entry
+	for _, f := range results {
+		findings := f.findings
+		if f.creator != "" {
+			// whoever joins a computer through the machine account quota owns it, and can rewrite its names
+			creator := names[f.creator]
+			if creator == "" {
+				creator = f.creator
+			}
+			findings = append(findings, fmt.Sprintf("created by %s through the machine account quota, who can edit its dNSHostName and SPNs", creator))
+		}
+		values := map[string][]string{
+			"sAMAccountName": {f.entry.GetAttributeValue("sAMAccountName")},
+			"findings":       findings,
+		}
+		if host := f.entry.GetAttributeValue("dNSHostName"); host != "" {
+			values["dNSHostName"] = []string{host}
+		}
+		entries = append(entries, ldap.NewEntry(f.entry.DN, values))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
@@ -5,31 +5,37 @@ import (
 	"github.com/spf13/pflag"
 )
 
-type ComputersModule struct{}
+type ComputersModule struct {
+	last lastFilter
+}
 
 func init() {
 	AllModules = append(AllModules, new(ComputersModule))
 }
 
-func (c ComputersModule) Name() string {
+func (c *ComputersModule) Name() string {
 	return "computers"
 }
 
-func (c ComputersModule) Description() string {
+func (c *ComputersModule) Description() string {
 	return "Enumerate AD Computers"
 }
 
-func (c ComputersModule) FlagSet() *pflag.FlagSet {
+func (c *ComputersModule) FlagSet() *pflag.FlagSet {
 	flags := pflag.NewFlagSet("computers-module", pflag.ExitOnError)
+	c.last.addFlags(flags)
 	return flags
 }
 
-func (c ComputersModule) DefaultAttrs() []string {
+func (c *ComputersModule) DefaultAttrs() []string {
 	return []string{"cn", "dNSHostName", "operatingSystem", "operatingSystemVersion", "operatingSystemServicePack"}
 }
 
-func (c ComputersModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
-	filter := "(objectClass=Computer)"
+func (c *ComputersModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	filter, err := c.last.apply(session, "(objectClass=Computer)")
+	if err != nil {
+		return err
+	}
 	searchReq := session.MakeSimpleSearchRequest(filter, attrs)
 	return session.ExecuteSearchRequest(searchReq)
 }
@@ -0,0 +1,143 @@
+package modules
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type ConfidentialAttrsModule struct {
+	Samples      int
+	ReadableOnly bool
+	ReadValues   bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(ConfidentialAttrsModule))
+	adschema.RegisterAttribute("readableOn", "Enumeration", true)
+	adschema.RegisterAttribute("samples", "String(Unicode)", false)
+}
+
+// searchFlagConfidential is the searchFlags bit that makes an attribute readable only with CONTROL_ACCESS on it
+const searchFlagConfidential = 0x80
+
+// attrIsConstructed is the systemFlags bit of constructed attributes, which can't be searched for
+const attrIsConstructed = 0x4
+
+// Whether a confidential attribute is readable
+const (
+	confidentialReadable   = "readable"
+	confidentialUnreadable = "no readable values"
+)
+
+func (c *ConfidentialAttrsModule) Name() string {
+	return "confidential-attrs"
+}
+
+func (c *ConfidentialAttrsModule) Description() string {
+	return "List the schema's confidential attributes, and how many objects the bind can actually read each of them on"
+}
+
+func (c *ConfidentialAttrsModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(c.Name(), pflag.ExitOnError)
+	flags.IntVar(&c.Samples, "samples", 3, "Number of objects to list as samples of each readable attribute")
+	flags.BoolVar(&c.ReadableOnly, "readable-only", false, "Only list the attributes that are readable on at least one object")
+	flags.BoolVar(&c.ReadValues, "read-values", false, "Also read the attributes' values to make sure they came back, rather than only which objects match them. The values themselves aren't output")
+	return flags
+}
+
+func (c *ConfidentialAttrsModule) DefaultAttrs() []string {
+	return []string{"lDAPDisplayName", "status", "readableOn", "samples"}
+}
+
+func (c *ConfidentialAttrsModule) IsReportModule() bool {
+	return true
+}
+
+// confidentialAttr is a confidential attribute, with the objects it could be read on
+type confidentialAttr struct {
+	entry    *ldap.Entry
+	name     string
+	readable []string
+}
+
+func (c *ConfidentialAttrsModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	if c.Samples < 0 {
+		return fmt.Errorf("invalid --samples %d", c.Samples)
+	}
+	if session.NamingContexts.Schema == "" {
+		return fmt.Errorf("the schema partition is unknown")
+	}
+	filter := fmt.Sprintf("(&(objectClass=attributeSchema)(searchFlags:1.2.840.113556.1.4.803:=%d))", searchFlagConfidential)
+	sr := session.MakeSimpleSearchRequest(filter, []string{"lDAPDisplayName", "systemFlags"})
+	sr.BaseDN = session.NamingContexts.Schema
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "[+] Found %d confidential attributes, checking which are readable\n", len(res.Entries))
+
+	var found []*confidentialAttr
+	for _, entry := range res.Entries {
+		name := entry.GetAttributeValue("lDAPDisplayName")
+		if flags, _ := strconv.Atoi(entry.GetAttributeValue("systemFlags")); flags&attrIsConstructed != 0 {
+			continue
+		}
+		// the DC leaves attributes the bind can't read out of filters, so only readable values match, and the objects
+		// can be found without pulling the values (secrets, for some of these) over the wire. 1.1 asks for no attributes
+		requested := []string{"1.1"}
+		if c.ReadValues {
+			requested = []string{name}
+		}
+		res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(fmt.Sprintf("(%s=*)", name), requested))
+		if err != nil {
+			session.Log.Warnf("unable to search for %s: %s", name, err)
+			continue
+		}
+		a := &confidentialAttr{entry: entry, name: name}
+		for _, e := range res.Entries {
+			if !c.ReadValues || len(e.GetRawAttributeValues(name)) > 0 {
+				a.readable = append(a.readable, e.DN)
+			}
+		}
+		if c.ReadableOnly && len(a.readable) == 0 {
+			continue
+		}
+		found = append(found, a)
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		if len(found[i].readable) != len(found[j].readable) {
+			return len(found[i].readable) > len(found[j].readable)
+		}
+		return strings.ToLower(found[i].name) < strings.ToLower(found[j].name)
+	})
+	var entries []*ldap.Entry
+	for _, a := range found {
+		values := map[string][]string{
+			"lDAPDisplayName": {a.name},
+			"status":          {confidentialUnreadable},
+			"readableOn":      {strconv.Itoa(len(a.readable))},
+		}
+		if len(a.readable) > 0 {
+			values["status"] = []string{confidentialReadable}
+			samples := a.readable
+			if len(samples) > c.Samples {
+				samples = samples[:c.Samples]
+			}
+			if len(samples) > 0 {
+				values["samples"] = samples
+			}
+		}
+		entries = append(entries, ldap.NewEntry(a.entry.DN, values))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
@@ -7,7 +7,9 @@ import (
 )
 
 type CustomSearch struct {
-	CustomFilter string
+	CustomFilter  string
+	PartitionName string
+	last          lastFilter
 }
 
 func init() {
@@ -29,9 +31,17 @@ func (c *CustomSearch) Filter() string {
 func (c *CustomSearch) FlagSet() *pflag.FlagSet {
 	flags := pflag.NewFlagSet("custom", pflag.ExitOnError)
 	flags.StringVar(&c.CustomFilter, "filter", "", "LDAP syntax filter")
+	flags.StringVar(&c.PartitionName, "partition", "domain", "Naming context to search: domain, configuration, schema, domaindns, forestdns")
+	c.last.addFlags(flags)
 	return flags
 }
 
+func (c *CustomSearch) Partition() ldapsession.Partition {
+	// invalid names are caught in Run, so fall back to the domain partition here
+	p, _ := ldapsession.ParsePartition(c.PartitionName)
+	return p
+}
+
 func (c *CustomSearch) DefaultAttrs() []string {
 	return []string{"*"}
 }
@@ -40,6 +50,13 @@ func (c *CustomSearch) Run(lSession *ldapsession.LDAPSession, attrs []string) er
 	if c.Filter() == "" {
 		return fmt.Errorf("must provide a filter to run")
 	}
-	searchReq := lSession.MakeSimpleSearchRequest(c.Filter(), attrs)
+	if _, err := ldapsession.ParsePartition(c.PartitionName); err != nil {
+		return err
+	}
+	filter, err := c.last.apply(lSession, c.Filter())
+	if err != nil {
+		return err
+	}
+	searchReq := lSession.MakeSimpleSearchRequest(filter, attrs)
 	return lSession.ExecuteSearchRequest(searchReq)
 }
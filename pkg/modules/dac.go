@@ -0,0 +1,114 @@
+package modules
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type DACModule struct {
+	EnabledOnly bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(DACModule))
+}
+
+// claimsConfig is the container (under CN=Services in the Configuration partition) Dynamic Access Control is
+// configured in
+const claimsConfig = "CN=Claims Configuration,CN=Services,"
+
+// dacObjects are the kinds of Dynamic Access Control object, with the container and attributes of each
+var dacObjects = []struct {
+	category, plural, container, class string
+	attrs                              []string
+}{
+	{"claim type", "claim types", "CN=Claim Types", "msDS-ClaimType",
+		[]string{"msDS-ClaimSourceType", "msDS-ClaimAttributeSource", "msDS-ClaimTypeAppliesToClass"}},
+	{"resource property", "resource properties", "CN=Resource Properties", "msDS-ResourceProperty",
+		[]string{"msDS-IsUsedAsResourceSecurityAttribute"}},
+	{"central access policy", "central access policies", "CN=Central Access Policies", "msAuthz-CentralAccessPolicy",
+		[]string{"msAuthz-MemberRulesInCentralAccessPolicy"}},
+	{"central access rule", "central access rules", "CN=Central Access Rules", "msAuthz-CentralAccessRule",
+		[]string{"msAuthz-ResourceCondition", "msAuthz-EffectiveSecurityPolicy", "msAuthz-ProposedSecurityPolicy"}},
+}
+
+func (d *DACModule) Name() string {
+	return "dac"
+}
+
+func (d *DACModule) Description() string {
+	return "Enumerate Dynamic Access Control: claim types, resource properties, central access policies and their rules"
+}
+
+func (d *DACModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(d.Name(), pflag.ExitOnError)
+	flags.BoolVar(&d.EnabledOnly, "enabled-only", false, "Leave out disabled claim types, resource properties and rules")
+	return flags
+}
+
+func (d *DACModule) DefaultAttrs() []string {
+	attrs := []string{"displayName", "category", "Enabled"}
+	for _, o := range dacObjects {
+		attrs = append(attrs, o.attrs...)
+	}
+	return attrs
+}
+
+func (d *DACModule) Partition() ldapsession.Partition {
+	return ldapsession.ConfigurationPartition
+}
+
+func (d *DACModule) IsReportModule() bool {
+	return true
+}
+
+func (d *DACModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	var entries []*ldap.Entry
+	var counts []string
+	for _, o := range dacObjects {
+		sr := session.MakeSimpleSearchRequest(fmt.Sprintf("(objectClass=%s)", o.class), append([]string{"displayName", "Enabled"}, o.attrs...))
+		sr.BaseDN = o.container + "," + claimsConfig + session.BaseDN
+		sr.Scope = ldap.ScopeSingleLevel
+		res, err := session.GetPagedSearchResults(sr)
+		if err != nil {
+			// the containers only exist from the Windows Server 2012 schema on
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+				return fmt.Errorf("no Claims Configuration container, the schema is older than Windows Server 2012")
+			}
+			return err
+		}
+		disabled := 0
+		for _, entry := range res.Entries {
+			// policies have no Enabled attribute, they're in effect wherever a GPO applies them
+			if strings.EqualFold(entry.GetAttributeValue("Enabled"), "FALSE") {
+				disabled++
+				if d.EnabledOnly {
+					continue
+				}
+			}
+			entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute("category", []string{o.category}))
+			entries = append(entries, entry)
+		}
+		count := fmt.Sprintf("%d %s", len(res.Entries), o.plural)
+		if len(res.Entries) == 1 {
+			count = "1 " + o.category
+		}
+		if disabled > 0 {
+			count += fmt.Sprintf(" (%d disabled)", disabled)
+		}
+		counts = append(counts, count)
+	}
+
+	if len(entries) == 0 {
+		fmt.Fprintf(os.Stderr, "[*] Dynamic Access Control isn't in use: no claim types, resource properties or central access policies\n")
+	} else {
+		fmt.Fprintf(os.Stderr, "[+] Dynamic Access Control: %s\n", strings.Join(counts, ", "))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
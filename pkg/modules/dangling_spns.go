@@ -0,0 +1,153 @@
+package modules
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type DanglingSPNsModule struct {
+	DomainOnly bool
+	DNS        bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(DanglingSPNsModule))
+}
+
+// spnNonHost matches the host part of SPNs that don't name a host: the DRS replication SPNs use the DSA's GUID, and
+// krbtgt has kadmin/changepw
+var spnNonHost = regexp.MustCompile(`(?i)^(\{?[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\}?|changepw)$`)
+
+func (d *DanglingSPNsModule) Name() string {
+	return "dangling-spns"
+}
+
+func (d *DanglingSPNsModule) Description() string {
+	return "Find SPNs and constrained delegation targets naming hosts with no computer object (decommissioned hosts, takeover targets)"
+}
+
+func (d *DanglingSPNsModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(d.Name(), pflag.ExitOnError)
+	flags.BoolVar(&d.DomainOnly, "domain-only", false, "Only search the domain, instead of the whole forest through the global catalog")
+	flags.BoolVar(&d.DNS, "dns", false, "Also look up the dangling hosts in DNS, to tell aliases and non-Windows hosts from hosts that are gone")
+	return flags
+}
+
+func (d *DanglingSPNsModule) DefaultAttrs() []string {
+	return []string{"sAMAccountName", "source", "service", "findings"}
+}
+
+func (d *DanglingSPNsModule) IsReportModule() bool {
+	return true
+}
+
+func (d *DanglingSPNsModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	search, baseDN := session, session.BaseDN
+	if !d.DomainOnly {
+		if gc, err := session.GlobalCatalog(); err != nil {
+			session.Log.Warnf("unable to connect to the global catalog, only searching the domain: %s", err)
+		} else {
+			defer gc.Close()
+			search, baseDN = gc, ""
+		}
+	}
+
+	filter := "(|(objectCategory=computer)(servicePrincipalName=*))"
+	sr := search.MakeSimpleSearchRequest(filter, []string{"objectCategory", "sAMAccountName", "dNSHostName",
+		"msDS-AdditionalDnsHostName", "servicePrincipalName"})
+	sr.BaseDN = baseDN
+	res, err := search.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+	// msDS-AllowedToDelegateTo isn't replicated to the GC, so delegation targets come from the domain
+	delegation, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest("(msDS-AllowedToDelegateTo=*)",
+		[]string{"sAMAccountName", "msDS-AllowedToDelegateTo"}))
+	if err != nil {
+		return err
+	}
+
+	// full names of the hosts that exist, and the short names of the computers
+	hosts, shortNames := make(map[string]bool), make(map[string]bool)
+	domains, err := session.GetForestDomains()
+	if err != nil {
+		session.Log.Warnf("unable to list the domains of the forest: %s", err)
+	}
+	for _, dom := range domains {
+		hosts[strings.ToLower(dom.DNSName)] = true
+	}
+	hosts[strings.ToLower(ldapsession.DNToDomain(session.NamingContexts.Default))] = true
+	for _, entry := range res.Entries {
+		if !strings.HasPrefix(strings.ToLower(entry.GetAttributeValue("objectCategory")), "cn=computer,") {
+			continue
+		}
+		shortNames[strings.ToLower(strings.TrimSuffix(entry.GetAttributeValue("sAMAccountName"), "$"))] = true
+		for _, h := range append(entry.GetAttributeValues("dNSHostName"), entry.GetAttributeValues("msDS-AdditionalDnsHostName")...) {
+			hosts[strings.ToLower(h)] = true
+			shortNames[strings.ToLower(strings.SplitN(h, ".", 2)[0])] = true
+		}
+	}
+	exists := func(host string) bool {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		// hosts the directory only knows the short name of (like computers without a dNSHostName) are given the benefit
+		// of the doubt
+		return hosts[host] || shortNames[strings.SplitN(host, ".", 2)[0]]
+	}
+
+	domain := ldapsession.DNToDomain(session.NamingContexts.Default)
+	lookups := make(map[string]string)
+	lookup := func(host string) string {
+		if result, ok := lookups[host]; ok {
+			return result
+		}
+		name := host
+		if !strings.Contains(name, ".") {
+			name += "." + domain
+		}
+		result := "doesn't resolve either"
+		if addrs, err := session.Resolver().LookupHost(name); err == nil && len(addrs) > 0 {
+			result = "but resolves to " + strings.Join(addrs, ", ")
+		}
+		lookups[host] = result
+		return result
+	}
+
+	var entries []*ldap.Entry
+	check := func(entry *ldap.Entry, source string) {
+		spns := entry.GetAttributeValues(source)
+		sort.Strings(spns)
+		for _, spn := range spns {
+			host := spnHost(spn)
+			if host == "" || spnNonHost.MatchString(host) || exists(host) {
+				continue
+			}
+			finding := fmt.Sprintf("no computer object for %s", host)
+			if source == "msDS-AllowedToDelegateTo" {
+				finding = fmt.Sprintf("delegates to %s, which has no computer object", host)
+			}
+			if d.DNS {
+				finding += ", " + lookup(host)
+			}
+			entries = append(entries, ldap.NewEntry(entry.DN, map[string][]string{
+				"sAMAccountName": {entry.GetAttributeValue("sAMAccountName")},
+				"source":         {source},
+				"service":        {spn},
+				"findings":       {finding},
+			}))
+		}
+	}
+	for _, entry := range res.Entries {
+		check(entry, "servicePrincipalName")
+	}
+	for _, entry := range delegation.Entries {
+		check(entry, "msDS-AllowedToDelegateTo")
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
@@ -0,0 +1,284 @@
+package modules
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+// dcPorts are the directory service ports checked on every DC
+var dcPorts = []struct {
+	Port   int
+	Name   string
+	Secure bool
+}{
+	{389, "LDAP", false},
+	{636, "LDAPS", true},
+	{3268, "GC", false},
+	{3269, "GC-SSL", true},
+}
+
+// probeUser is a (non-existent) account the probes bind as, so the session's credentials are never sent to a DC over
+// an unprotected connection, and probing doesn't count towards anyone's lockout
+const probeUser = "windapsearch-probe"
+
+// mdiFilter matches the objects Microsoft Defender for Identity (and ATA before it) leaves in the directory: its
+// service connection points, sensor accounts and gMSAs, admin groups and audit policy GPOs
+const mdiFilter = "(|" +
+	"(&(objectClass=serviceConnectionPoint)(|(cn=*Advanced Threat*)(cn=*AATP*)(cn=*Azure ATP*)(cn=*Defender for Identity*)(serviceClassName=*ATP*)))" +
+	"(&(objectCategory=person)(|(sAMAccountName=*aatp*)(sAMAccountName=*azureatp*)(description=*Defender for Identity*)(description=*Azure ATP*)(description=*Advanced Threat Analytics*)))" +
+	"(&(objectClass=msDS-GroupManagedServiceAccount)(|(sAMAccountName=*mdi*)(sAMAccountName=*aatp*)))" +
+	"(&(objectCategory=group)(|(cn=*Azure ATP*)(cn=*Advanced Threat Analytics*)(cn=*Defender for Identity*)))" +
+	"(&(objectClass=groupPolicyContainer)(|(displayName=*Defender for Identity*)(displayName=*MDI*)(displayName=*Azure ATP*))))"
+
+type DCProbeModule struct {
+	Timeout int
+	NoMDI   bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(DCProbeModule))
+	adschema.RegisterAttribute("openPorts", "String(Unicode)", false)
+	adschema.RegisterAttribute("closedPorts", "String(Unicode)", false)
+	adschema.RegisterAttribute("anonymousRootDSE", "Boolean", true)
+	adschema.RegisterAttribute("ldapSigning", "String(Unicode)", true)
+	adschema.RegisterAttribute("channelBinding", "String(Unicode)", true)
+	adschema.RegisterAttribute("mdiIndicators", "String(Unicode)", false)
+}
+
+func (d *DCProbeModule) Name() string {
+	return "dc-probe"
+}
+
+func (d *DCProbeModule) Description() string {
+	return "Probe every DC for open LDAP/GC ports, anonymous rootDSE access, LDAP signing and channel binding enforcement, and look for Defender for Identity"
+}
+
+func (d *DCProbeModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(d.Name(), pflag.ExitOnError)
+	flags.IntVar(&d.Timeout, "timeout", 5, "Seconds to wait for each port to connect")
+	flags.BoolVar(&d.NoMDI, "no-mdi", false, "Don't look for Defender for Identity/ATA objects")
+	return flags
+}
+
+func (d *DCProbeModule) DefaultAttrs() []string {
+	return []string{"dNSHostName", "addresses", "openPorts", "closedPorts", "anonymousRootDSE", "ldapSigning", "channelBinding", "operatingSystem", "operatingSystemVersion", "mdiIndicators"}
+}
+
+func (d *DCProbeModule) IsReportModule() bool {
+	return true
+}
+
+// dcProbe holds what was learnt about a single DC
+type dcProbe struct {
+	addresses      []string
+	open           []string
+	closed         []string
+	anonymous      string
+	signing        string
+	channelBinding string
+}
+
+func (d *DCProbeModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	// RODCs don't have SERVER_TRUST_ACCOUNT set, so pick them up by their primary group instead
+	filter := "(&(objectCategory=computer)(|(userAccountControl:1.2.840.113556.1.4.803:=8192)(primaryGroupID=521)))"
+	sr := session.MakeSimpleSearchRequest(filter, []string{"dNSHostName", "operatingSystem", "operatingSystemVersion", "operatingSystemServicePack"})
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+	if len(res.Entries) == 0 {
+		return fmt.Errorf("no domain controller computer objects found")
+	}
+
+	timeout := time.Duration(d.Timeout) * time.Second
+	probes := make([]dcProbe, len(res.Entries))
+	var wg sync.WaitGroup
+	for i, entry := range res.Entries {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			probes[i] = d.probe(session, host, timeout)
+		}(i, entry.GetAttributeValue("dNSHostName"))
+	}
+	wg.Wait()
+
+	var entries []*ldap.Entry
+	for i, dc := range res.Entries {
+		p := probes[i]
+		values := map[string][]string{
+			"dNSHostName":                {dc.GetAttributeValue("dNSHostName")},
+			"addresses":                  p.addresses,
+			"openPorts":                  p.open,
+			"closedPorts":                p.closed,
+			"anonymousRootDSE":           {p.anonymous},
+			"ldapSigning":                {p.signing},
+			"channelBinding":             {p.channelBinding},
+			"operatingSystem":            {dc.GetAttributeValue("operatingSystem")},
+			"operatingSystemVersion":     {dc.GetAttributeValue("operatingSystemVersion")},
+			"operatingSystemServicePack": {dc.GetAttributeValue("operatingSystemServicePack")},
+		}
+		entries = append(entries, ldap.NewEntry(dc.DN, values))
+	}
+	if !d.NoMDI {
+		indicators, err := mdiIndicators(session)
+		if err != nil {
+			session.Log.Warnf("unable to look for Defender for Identity objects: %s", err)
+		} else {
+			entries = append(entries, ldap.NewEntry(session.NamingContexts.Default, map[string][]string{"mdiIndicators": indicators}))
+		}
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// probe checks every port on a DC and, where the ports are open, what the DC enforces
+func (d *DCProbeModule) probe(session *ldapsession.LDAPSession, host string, timeout time.Duration) (p dcProbe) {
+	p.anonymous, p.signing, p.channelBinding = "false", "unknown", "unknown"
+	if host == "" {
+		p.signing, p.channelBinding = "unknown (no dNSHostName)", "unknown (no dNSHostName)"
+		return
+	}
+
+	// through a proxy the name is resolved on the other side
+	address := host
+	options := session.Options()
+	options.Domain = ldapsession.DNToDomain(session.NamingContexts.Default)
+	if options.Proxy == "" {
+		addrs, err := session.Resolver().LookupHost(host)
+		if err == nil {
+			addrs, err = session.Resolver().SelectAddresses(addrs, options.IPVersion)
+		}
+		if err != nil {
+			session.Log.Warnf("unable to resolve DC %s: %s", host, err)
+			p.signing, p.channelBinding = "unknown (unresolvable)", "unknown (unresolvable)"
+			return
+		}
+		p.addresses = addrs
+		address = addrs[0]
+	}
+
+	conns := make(map[int]*ldap.Conn)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for _, port := range dcPorts {
+		conn, err := session.DialServer(address, port.Port, port.Secure, timeout)
+		if err != nil {
+			session.Log.Debugf("%s port %d: %s", host, port.Port, err)
+			p.closed = append(p.closed, fmt.Sprintf("%d/%s", port.Port, port.Name))
+			continue
+		}
+		p.open = append(p.open, fmt.Sprintf("%d/%s", port.Port, port.Name))
+		conns[port.Port] = conn
+	}
+
+	for _, port := range []int{389, 3268} {
+		if conn, ok := conns[port]; ok {
+			p.anonymous = strconv.FormatBool(anonymousRootDSE(conn))
+			break
+		}
+	}
+	if conn, ok := conns[389]; ok {
+		p.signing = ldapSigning(conn, options)
+	} else {
+		p.signing = "unknown (389 closed)"
+	}
+	if conn, ok := conns[636]; ok {
+		p.channelBinding = channelBinding(conn, options)
+	} else {
+		p.channelBinding = "unknown (636 closed)"
+	}
+	return
+}
+
+// mdiIndicators lists the Defender for Identity/ATA objects in the domain. Their presence means sensors are likely
+// installed on the DCs, watching LDAP queries for reconnaissance
+func mdiIndicators(session *ldapsession.LDAPSession) ([]string, error) {
+	sr := session.MakeSimpleSearchRequest(mdiFilter, []string{"objectClass", "displayName"})
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) == 0 {
+		return []string{"none found"}, nil
+	}
+	var indicators []string
+	for _, entry := range res.Entries {
+		classes := entry.GetAttributeValues("objectClass")
+		kind := "account"
+		switch {
+		case containsFold(classes, "serviceConnectionPoint"):
+			kind = "service connection point"
+		case containsFold(classes, "msDS-GroupManagedServiceAccount"):
+			kind = "gMSA"
+		case containsFold(classes, "group"):
+			kind = "group"
+		case containsFold(classes, "groupPolicyContainer"):
+			kind = fmt.Sprintf("GPO %q", entry.GetAttributeValue("displayName"))
+		}
+		indicators = append(indicators, fmt.Sprintf("%s: %s", kind, entry.DN))
+	}
+	fmt.Fprintf(os.Stderr, "[!] Found %d Defender for Identity/ATA object(s), LDAP queries are likely being monitored\n", len(indicators))
+	return indicators, nil
+}
+
+// anonymousRootDSE is true if the rootDSE can be read without binding
+func anonymousRootDSE(conn *ldap.Conn) bool {
+	sr := ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"defaultNamingContext"}, nil)
+	res, err := conn.Search(sr)
+	return err == nil && len(res.Entries) > 0 && res.Entries[0].GetAttributeValue("defaultNamingContext") != ""
+}
+
+// ldapSigning binds over plain LDAP without signing. A DC that requires signing rejects the bind with
+// strongerAuthRequired before looking at the credentials, so the bind is as the probe account rather than with the
+// session's credentials, which plain LDAP would send in the clear
+func ldapSigning(conn *ldap.Conn, options ldapsession.LDAPSessionOptions) string {
+	err := conn.Bind(fmt.Sprintf("%s@%s", probeUser, options.Domain), probeUser)
+	switch {
+	case err == nil, ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials):
+		return "not required"
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultStrongAuthRequired):
+		return "required"
+	}
+	return fmt.Sprintf("unknown (%s)", err)
+}
+
+// channelBinding does an NTLM bind over LDAPS without a channel binding token. The bind error data tells whether the
+// DC refused it for the missing token (80090346) or got as far as checking the credentials (52e). NTLM checks use a
+// non-existent account so no real credentials are sent
+func channelBinding(conn *ldap.Conn, options ldapsession.LDAPSessionOptions) string {
+	domain, _ := splitUsername(options.Username, options.Domain)
+	err := conn.NTLMBind(domain, probeUser, probeUser)
+	switch {
+	case err == nil:
+		return "not required"
+	case strings.Contains(err.Error(), "data 80090346"):
+		return "required"
+	case strings.Contains(err.Error(), "data 52e"):
+		return "not required"
+	}
+	return fmt.Sprintf("unknown (%s)", err)
+}
+
+// splitUsername splits user@domain or DOMAIN\user into its domain and user parts
+func splitUsername(username, defaultDomain string) (domain, user string) {
+	if parts := strings.SplitN(username, "\\", 2); len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	if parts := strings.SplitN(username, "@", 2); len(parts) == 2 {
+		return parts[1], parts[0]
+	}
+	return defaultDomain, username
+}
@@ -0,0 +1,285 @@
+package modules
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	uac "github.com/audibleblink/msldapuac"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type DelegationGraphModule struct {
+	DOT        string
+	IncludeDCs bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(DelegationGraphModule))
+	adschema.RegisterAttribute("source", "String(Unicode)", true)
+	adschema.RegisterAttribute("delegation", "String(Unicode)", true)
+	adschema.RegisterAttribute("service", "String(Unicode)", true)
+}
+
+// Kinds of delegation edge
+const (
+	delegationUnconstrained = "unconstrained"
+	// constrained delegation to the service, which only works with the user's service ticket to the account
+	delegationConstrained = "constrained"
+	// constrained delegation with protocol transition, which can impersonate anyone without their ticket
+	delegationProtocolTransition = "constrained (protocol transition)"
+	delegationRBCD               = "resource-based"
+)
+
+// anyService is the target of unconstrained delegation: the account gets the TGT of everyone authenticating to it,
+// which works for any service
+const anyService = "*"
+
+var delegationAttrs = []string{"objectSid", "sAMAccountName", "dNSHostName", "userAccountControl", "msDS-AllowedToDelegateTo", rbcdAttribute}
+
+func (d *DelegationGraphModule) Name() string {
+	return "delegation-graph"
+}
+
+func (d *DelegationGraphModule) Description() string {
+	return "Map unconstrained, constrained and resource-based delegation as account to service edges (optionally as a Graphviz DOT file)"
+}
+
+func (d *DelegationGraphModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(d.Name(), pflag.ExitOnError)
+	flags.StringVar(&d.DOT, "dot", "", "Also write the graph to this Graphviz DOT file (render with e.g. 'dot -Tsvg')")
+	flags.BoolVar(&d.IncludeDCs, "include-dcs", false, "Include domain controllers, which always have unconstrained delegation")
+	return flags
+}
+
+func (d *DelegationGraphModule) DefaultAttrs() []string {
+	return []string{"source", "delegation", "target", "service"}
+}
+
+func (d *DelegationGraphModule) IsReportModule() bool {
+	return true
+}
+
+// delegationEdge is an account that can impersonate users to a service. The ends are node IDs, see delegationNodes
+type delegationEdge struct {
+	sourceDN, source, kind, target, service string
+}
+
+// delegationNodes are the accounts in the graph, by ID: the objectSid where it's known, so an account is one node
+// whether it's found by name, by host or by SID, or else the lowercased name it was found by
+type delegationNodes struct {
+	labels map[string]string
+	// hosts are the IDs of the accounts a service's host (or SPN) was looked up to
+	hosts map[string]string
+}
+
+// add names a node, keeping the name read from its own object over ones it was found by
+func (n *delegationNodes) add(id, label string, own bool) {
+	if _, ok := n.labels[id]; !ok || own {
+		n.labels[id] = label
+	}
+}
+
+// label is what a node is shown as
+func (n *delegationNodes) label(id string) string {
+	if l := n.labels[id]; l != "" {
+		return l
+	}
+	return id
+}
+
+// entryNode is the node of an account read from the directory
+func (n *delegationNodes) entryNode(entry *ldap.Entry) string {
+	label := entry.GetAttributeValue("dNSHostName")
+	if label == "" {
+		label = entry.GetAttributeValue("sAMAccountName")
+	}
+	id := strings.ToLower(label)
+	if sid, _, err := secdesc.DecodeSID(entry.GetRawAttributeValue("objectSid")); err == nil {
+		id = sid.String()
+	}
+	n.add(id, label, true)
+	return id
+}
+
+// serviceNode is the node of the account a delegated service runs as: the one with the SPN registered, or else the
+// computer of its host. Services no account can be found for are a node of their host name
+func (d *DelegationGraphModule) serviceNode(session *ldapsession.LDAPSession, nodes *delegationNodes, spn string) string {
+	host := spnHost(spn)
+	key := strings.ToLower(spn)
+	if id, ok := nodes.hosts[key]; ok {
+		return id
+	}
+	short := strings.SplitN(host, ".", 2)[0]
+	filter := fmt.Sprintf("(|(servicePrincipalName=%s)(dNSHostName=%s)(sAMAccountName=%s$))",
+		ldap.EscapeFilter(spn), ldap.EscapeFilter(host), ldap.EscapeFilter(short))
+	id := strings.ToLower(host)
+	res, err := session.GetSearchResults(session.MakeSimpleSearchRequest(filter, []string{"objectSid", "sAMAccountName", "dNSHostName", "servicePrincipalName"}))
+	switch {
+	case err != nil:
+		session.Log.Warnf("unable to find the account of %s: %s", spn, err)
+		nodes.add(id, host, false)
+	case len(res.Entries) == 0:
+		nodes.add(id, host, false)
+	default:
+		found := res.Entries[0]
+		for _, e := range res.Entries {
+			for _, s := range e.GetAttributeValues("servicePrincipalName") {
+				if strings.EqualFold(s, spn) {
+					found = e
+				}
+			}
+		}
+		id = nodes.entryNode(found)
+	}
+	nodes.hosts[key] = id
+	return id
+}
+
+func (d *DelegationGraphModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	filter := fmt.Sprintf("(|(userAccountControl:1.2.840.113556.1.4.803:=%d)(msDS-AllowedToDelegateTo=*)(%s=*))", uac.TrustedForDelegation, rbcdAttribute)
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter, delegationAttrs))
+	if err != nil {
+		return err
+	}
+
+	nodes := &delegationNodes{labels: map[string]string{anyService: "any service"}, hosts: make(map[string]string)}
+	var edges []delegationEdge
+	var rbcd []*ldap.Entry
+	var sids []string
+	allowed := make(map[*ldap.Entry][]string)
+	for _, entry := range res.Entries {
+		nodes.entryNode(entry)
+	}
+	for _, entry := range res.Entries {
+		flags, _ := strconv.Atoi(entry.GetAttributeValue("userAccountControl"))
+		id := nodes.entryNode(entry)
+		if flags&uac.TrustedForDelegation != 0 && (d.IncludeDCs || flags&uac.ServerTrustAccount == 0) {
+			edges = append(edges, delegationEdge{entry.DN, id, delegationUnconstrained, anyService, anyService})
+		}
+		kind := delegationConstrained
+		if flags&uac.TrustedToAuthForDelegation != 0 {
+			kind = delegationProtocolTransition
+		}
+		for _, spn := range entry.GetAttributeValues("msDS-AllowedToDelegateTo") {
+			edges = append(edges, delegationEdge{entry.DN, id, kind, d.serviceNode(session, nodes, spn), spn})
+		}
+		if raw := entry.GetRawAttributeValue(rbcdAttribute); len(raw) > 0 {
+			rbcd = append(rbcd, entry)
+			allowed[entry] = rbcdSIDs(session, entry.DN, raw)
+			sids = append(sids, allowed[entry]...)
+		}
+	}
+
+	// resource-based delegation is set on the target, naming the accounts that can delegate to it by SID
+	names := session.SIDResolver().Resolve(sids)
+	for _, entry := range rbcd {
+		target := nodes.entryNode(entry)
+		for _, sid := range allowed[entry] {
+			if name := names[sid]; name != "" && name != sid {
+				nodes.add(sid, name, false)
+			}
+			// the source's own DN isn't known from its SID, so the edge is kept with the target's
+			edges = append(edges, delegationEdge{entry.DN, sid, delegationRBCD, target, anyService})
+		}
+	}
+
+	sort.SliceStable(edges, func(i, j int) bool {
+		if si, sj := strings.ToLower(nodes.label(edges[i].source)), strings.ToLower(nodes.label(edges[j].source)); si != sj {
+			return si < sj
+		}
+		return nodes.label(edges[i].target) < nodes.label(edges[j].target)
+	})
+	if d.DOT != "" {
+		if err := ioutil.WriteFile(d.DOT, []byte(delegationDOT(edges, nodes)), 0644); err != nil {
+			return fmt.Errorf("unable to write DOT file: %s", err)
+		}
+		fmt.Fprintf(os.Stderr, "[+] Delegation graph written to %s\n", d.DOT)
+	}
+
+	var entries []*ldap.Entry
+	for _, e := range edges {
+		target := e.target
+		if target != anyService {
+			target = nodes.label(target)
+		}
+		entries = append(entries, ldap.NewEntry(e.sourceDN, map[string][]string{
+			"source":     {nodes.label(e.source)},
+			"delegation": {e.kind},
+			"target":     {target},
+			"service":    {e.service},
+		}))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// rbcdSIDs returns the SIDs msDS-AllowedToActOnBehalfOfOtherIdentity allows to delegate to the object
+func rbcdSIDs(session *ldapsession.LDAPSession, dn string, raw []byte) []string {
+	sd, err := secdesc.Parse(raw)
+	if err != nil || sd.DACL == nil {
+		session.Log.Warnf("unable to parse %s of %s: %v", rbcdAttribute, dn, err)
+		return nil
+	}
+	var sids []string
+	for _, ace := range sd.DACL.ACEs {
+		if ace.Type == secdesc.AccessAllowedACEType {
+			sids = append(sids, ace.SID.String())
+		}
+	}
+	return sids
+}
+
+// spnHost returns the host of a service principal name (service/host[:port][/name])
+func spnHost(spn string) string {
+	parts := strings.SplitN(spn, "/", 3)
+	if len(parts) < 2 {
+		return spn
+	}
+	return strings.SplitN(parts[1], ":", 2)[0]
+}
+
+// delegationDOT renders the edges as a Graphviz digraph, with an edge from each account to each account it can
+// impersonate users to, labeled with the kind of delegation and the service. Nodes are named by their IDs, so an
+// account is drawn once however it was found, and labeled with its name
+func delegationDOT(edges []delegationEdge, nodes *delegationNodes) string {
+	colors := map[string]string{
+		delegationUnconstrained:      "red",
+		delegationProtocolTransition: "orange",
+		delegationConstrained:        "blue",
+		delegationRBCD:               "purple",
+	}
+	var sb strings.Builder
+	sb.WriteString("digraph delegation {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	drawn := make(map[string]bool)
+	for _, e := range edges {
+		for _, id := range []string{e.source, e.target} {
+			if !drawn[id] {
+				drawn[id] = true
+				fmt.Fprintf(&sb, "\t\"%s\" [label=\"%s\"];\n", dotEscape(id), dotEscape(nodes.label(id)))
+			}
+		}
+	}
+	for _, e := range edges {
+		label := dotEscape(e.kind)
+		if e.service != anyService {
+			label += `\n` + dotEscape(e.service)
+		}
+		fmt.Fprintf(&sb, "\t\"%s\" -> \"%s\" [label=\"%s\", color=%s];\n", dotEscape(e.source), dotEscape(e.target), label, colors[e.kind])
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// dotEscape escapes a string for a quoted DOT ID. Backslashes (e.g. in DOMAIN\name) would otherwise be read as
+// escapes like \N
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
@@ -0,0 +1,122 @@
+package modules
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type DisplaySpecifiersModule struct {
+	All bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(DisplaySpecifiersModule))
+}
+
+// displayMenuAttrs are the attributes of a displaySpecifier that make the admin tools and the shell load or run
+// something for objects of its class
+var displayMenuAttrs = []string{"adminContextMenu", "shellContextMenu", "adminPropertyPages", "shellPropertyPages"}
+
+// comHandler matches a handler given by CLSID, which is how every default menu item and property page is registered
+var comHandler = regexp.MustCompile(`^\{[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\}$`)
+
+var scriptExtensions = map[string]bool{".bat": true, ".cmd": true, ".js": true, ".jse": true, ".vbs": true, ".vbe": true, ".wsf": true, ".ps1": true, ".hta": true}
+
+func (d *DisplaySpecifiersModule) Name() string {
+	return "display-specifiers"
+}
+
+func (d *DisplaySpecifiersModule) Description() string {
+	return "Find displaySpecifier context menus and property pages that run a program or script instead of a COM handler (persistence)"
+}
+
+func (d *DisplaySpecifiersModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(d.Name(), pflag.ExitOnError)
+	flags.BoolVar(&d.All, "all", false, "List every context menu and property page entry, including the COM handlers")
+	return flags
+}
+
+func (d *DisplaySpecifiersModule) DefaultAttrs() []string {
+	return []string{"cn", "findings", "whenChanged"}
+}
+
+func (d *DisplaySpecifiersModule) Partition() ldapsession.Partition {
+	return ldapsession.ConfigurationPartition
+}
+
+func (d *DisplaySpecifiersModule) IsReportModule() bool {
+	return true
+}
+
+func (d *DisplaySpecifiersModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	var filter strings.Builder
+	filter.WriteString("(&(objectClass=displaySpecifier)(|")
+	for _, a := range displayMenuAttrs {
+		filter.WriteString("(" + a + "=*)")
+	}
+	filter.WriteString("))")
+	sr := session.MakeSimpleSearchRequest(filter.String(), append([]string{"cn", "whenChanged"}, displayMenuAttrs...))
+	sr.BaseDN = "CN=DisplaySpecifiers," + session.BaseDN
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+
+	var entries []*ldap.Entry
+	for _, entry := range res.Entries {
+		var findings []string
+		for _, attr := range displayMenuAttrs {
+			for _, v := range entry.GetAttributeValues(attr) {
+				kind := displayHandlerKind(v)
+				if kind == "" && !d.All {
+					continue
+				}
+				if kind == "" {
+					kind = "COM handler"
+				}
+				findings = append(findings, fmt.Sprintf("%s %s: %s", attr, kind, v))
+			}
+		}
+		if len(findings) == 0 {
+			continue
+		}
+		entries = append(entries, ldap.NewEntry(entry.DN, map[string][]string{
+			"cn":          {entry.GetAttributeValue("cn")},
+			"findings":    findings,
+			"whenChanged": {entry.GetAttributeValue("whenChanged")},
+		}))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// displayHandlerKind describes what a context menu or property page value runs when it isn't a COM handler, or is ""
+// when it is. Values are "order,{CLSID}" for COM handlers, and "order,menu text,command" for programs
+func displayHandlerKind(v string) string {
+	parts := strings.SplitN(v, ",", 3)
+	handler := strings.TrimSpace(parts[len(parts)-1])
+	if len(parts) == 2 && comHandler.MatchString(handler) {
+		return ""
+	}
+	// the program is quoted when its path has spaces, and can be followed by arguments
+	program := handler
+	if strings.HasPrefix(program, `"`) {
+		program = strings.SplitN(program[1:], `"`, 2)[0]
+	} else if i := strings.IndexByte(program, ' '); i >= 0 {
+		program = program[:i]
+	}
+	kind := "runs a program"
+	if scriptExtensions[strings.ToLower(path.Ext(strings.Replace(program, `\`, "/", -1)))] {
+		kind = "runs a script"
+	}
+	if strings.HasPrefix(program, `\\`) {
+		kind += " from a network path"
+	}
+	return kind
+}
@@ -0,0 +1,110 @@
+package modules
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/dns"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type DNSDiscoveryModule struct {
+	Sites   []string
+	NoSites bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(DNSDiscoveryModule))
+	adschema.RegisterAttribute("target", "String(Unicode)", true)
+	adschema.RegisterAttribute("port", "Enumeration", true)
+	adschema.RegisterAttribute("weight", "Enumeration", true)
+	adschema.RegisterAttribute("addresses", "String(Unicode)", false)
+}
+
+func (d *DNSDiscoveryModule) Name() string {
+	return "dns-discovery"
+}
+
+func (d *DNSDiscoveryModule) Description() string {
+	return "Resolve the LDAP, GC, Kerberos and kpasswd SRV records for the domain (including per-site records)"
+}
+
+func (d *DNSDiscoveryModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(d.Name(), pflag.ExitOnError)
+	flags.StringSliceVar(&d.Sites, "sites", nil, "Comma separated AD sites to look up site records for (default: every site in the Configuration partition)")
+	flags.BoolVar(&d.NoSites, "no-sites", false, "Don't look up site specific records")
+	return flags
+}
+
+func (d *DNSDiscoveryModule) DefaultAttrs() []string {
+	return []string{"name", "target", "port", "priority", "weight", "addresses"}
+}
+
+func (d *DNSDiscoveryModule) IsReportModule() bool {
+	return true
+}
+
+// siteNames lists the AD sites from the Configuration partition
+func (d *DNSDiscoveryModule) siteNames(session *ldapsession.LDAPSession) ([]string, error) {
+	if session.NamingContexts.Configuration == "" {
+		return nil, fmt.Errorf("configuration naming context unknown")
+	}
+	sr := ldap.NewSearchRequest(
+		"CN=Sites,"+session.NamingContexts.Configuration,
+		ldap.ScopeSingleLevel,
+		ldap.NeverDerefAliases,
+		0, 0, false,
+		"(objectClass=site)",
+		[]string{"cn"},
+		nil)
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return nil, err
+	}
+	var sites []string
+	for _, entry := range res.Entries {
+		sites = append(sites, entry.GetAttributeValue("cn"))
+	}
+	return sites, nil
+}
+
+func (d *DNSDiscoveryModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	domain := ldapsession.DNToDomain(session.NamingContexts.Default)
+	forest := ldapsession.DNToDomain(session.NamingContexts.RootDomain)
+
+	sites := d.Sites
+	if len(sites) == 0 && !d.NoSites {
+		var err error
+		sites, err = d.siteNames(session)
+		if err != nil {
+			session.Log.Warnf("unable to list AD sites, skipping site records: %s", err)
+		}
+	}
+
+	resolver := session.Resolver()
+	records, err := resolver.FindServiceRecords(dns.DomainServiceNames(domain, forest, sites))
+	if err != nil {
+		return fmt.Errorf("%s for %s", err, domain)
+	}
+
+	var entries []*ldap.Entry
+	addresses := make(map[string][]string)
+	for _, r := range records {
+		if _, ok := addresses[r.Target]; !ok {
+			addresses[r.Target], _ = resolver.LookupHost(r.Target)
+		}
+		entries = append(entries, ldap.NewEntry("", map[string][]string{
+			"name":      {r.Name},
+			"target":    {r.Target},
+			"port":      {strconv.Itoa(int(r.Port))},
+			"priority":  {strconv.Itoa(int(r.Priority))},
+			"weight":    {strconv.Itoa(int(r.Weight))},
+			"addresses": addresses[r.Target],
+		}))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
@@ -0,0 +1,211 @@
+package modules
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type DNSRecordModule struct {
+	RecordName string
+	IP         string
+	Zone       string
+	TTL        uint32
+	Action     string
+}
+
+func init() {
+	AllModules = append(AllModules, new(DNSRecordModule))
+	adschema.RegisterAttribute("record", "String(Unicode)", true)
+}
+
+func (d *DNSRecordModule) Name() string {
+	return "dns-record"
+}
+
+func (d *DNSRecordModule) Description() string {
+	return "Add or remove an A/AAAA record (including wildcards) in an AD integrated DNS zone"
+}
+
+func (d *DNSRecordModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(d.Name(), pflag.ExitOnError)
+	flags.StringVar(&d.RecordName, "record", "", "Name of the record relative to the zone (e.g. 'wpad', or '*' for a wildcard)")
+	flags.StringVar(&d.IP, "ip", "", "IPv4 or IPv6 address the record points to")
+	flags.StringVar(&d.Zone, "zone", "", "DNS zone to add the record to (default: the domain)")
+	flags.Uint32Var(&d.TTL, "ttl", 180, "TTL of the record in seconds")
+	flags.StringVar(&d.Action, "action", "add", "Whether to add or remove the record: add, remove")
+	return flags
+}
+
+func (d *DNSRecordModule) DefaultAttrs() []string {
+	return []string{"action", "record", "addresses", "status"}
+}
+
+func (d *DNSRecordModule) IsWriteModule() bool {
+	return true
+}
+
+func (d *DNSRecordModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	ip := net.ParseIP(d.IP)
+	if d.RecordName == "" || ip == nil {
+		return fmt.Errorf("must provide a --record and a valid --ip")
+	}
+	action := strings.ToLower(d.Action)
+	if action != "add" && action != "remove" {
+		return fmt.Errorf("invalid action %q (must be one of add, remove)", d.Action)
+	}
+	zone := strings.TrimSuffix(d.Zone, ".")
+	if zone == "" {
+		zone = ldapsession.DNToDomain(session.NamingContexts.Default)
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(d.RecordName, "."), "."+zone)
+
+	zoneDN, err := d.findZone(session, zone)
+	if err != nil {
+		return err
+	}
+	serial := d.zoneSerial(session, zoneDN)
+	record, err := adschema.NewAddressRecord(ip, d.TTL, serial)
+	if err != nil {
+		return err
+	}
+
+	nodeDN := fmt.Sprintf("DC=%s,%s", name, zoneDN)
+	existing, tombstoned, exists, err := d.readNode(session, nodeDN)
+	if err != nil {
+		return err
+	}
+	has := false
+	for _, r := range existing {
+		if r.IP().Equal(ip) {
+			has = true
+		}
+	}
+	values := map[string][]string{"action": {action}, "record": {name + "." + zone}, "addresses": {ip.String()}}
+	if has == (action == "add") {
+		values["status"] = []string{"unchanged (already done)"}
+		writeResult(session, nodeDN, values, attrs)
+		return nil
+	}
+
+	var applied bool
+	switch {
+	case action == "add" && !exists:
+		req := ldap.NewAddRequest(nodeDN, nil)
+		req.Attribute("objectClass", []string{"top", "dnsNode"})
+		req.Attribute("dnsRecord", []string{string(record.Bytes())})
+		req.Attribute("dNSTombstoned", []string{"FALSE"})
+		applied, err = session.Add(req)
+	case action == "add" && tombstoned:
+		// a deleted node keeps its object around, so bring it back with only the new record
+		req := ldap.NewModifyRequest(nodeDN, nil)
+		req.Replace("dnsRecord", []string{string(record.Bytes())})
+		req.Replace("dNSTombstoned", []string{"FALSE"})
+		applied, err = session.Modify(req)
+	case action == "add":
+		req := ldap.NewModifyRequest(nodeDN, nil)
+		req.Add("dnsRecord", []string{string(record.Bytes())})
+		applied, err = session.Modify(req)
+	default:
+		applied, err = d.remove(session, nodeDN, existing, ip, serial)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to %s record: %s", action, err)
+	}
+	values["status"] = []string{writeStatus(session, applied)}
+	writeResult(session, nodeDN, values, attrs)
+	return nil
+}
+
+// remove deletes the record for the IP. If it's the node's last record the node is tombstoned the same way the DNS
+// server does it, since the account that created a node usually isn't allowed to delete it
+func (d *DNSRecordModule) remove(session *ldapsession.LDAPSession, nodeDN string, existing []*adschema.DNSRecord, ip net.IP, serial uint32) (bool, error) {
+	var matching [][]byte
+	for _, r := range existing {
+		if r.IP().Equal(ip) {
+			// a delete only matches the value exactly as stored
+			matching = append(matching, r.Raw)
+		}
+	}
+	req := ldap.NewModifyRequest(nodeDN, nil)
+	if len(matching) == len(existing) {
+		req.Replace("dnsRecord", []string{string(adschema.NewTombstoneRecord(serial, time.Now()).Bytes())})
+		req.Replace("dNSTombstoned", []string{"TRUE"})
+	} else {
+		for _, b := range matching {
+			req.Delete("dnsRecord", []string{string(b)})
+		}
+	}
+	return session.Modify(req)
+}
+
+// findZone looks for the zone in the DNS application partitions, and the legacy location in the domain partition
+func (d *DNSRecordModule) findZone(session *ldapsession.LDAPSession, zone string) (string, error) {
+	nc := session.NamingContexts
+	var bases []string
+	for _, partition := range []string{nc.DomainDNS, nc.ForestDNS} {
+		if partition != "" {
+			bases = append(bases, "CN=MicrosoftDNS,"+partition)
+		}
+	}
+	bases = append(bases, "CN=MicrosoftDNS,CN=System,"+nc.Default)
+	for _, base := range bases {
+		sr := ldap.NewSearchRequest(base, ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
+			fmt.Sprintf("(&(objectClass=dnsZone)(name=%s))", ldap.EscapeFilter(zone)), []string{"name"}, nil)
+		res, err := session.GetSearchResults(sr)
+		if err != nil {
+			session.Log.Debugf("unable to search for zone in %s: %s", base, err)
+			continue
+		}
+		if len(res.Entries) > 0 {
+			return res.Entries[0].DN, nil
+		}
+	}
+	return "", fmt.Errorf("zone %q not found in AD", zone)
+}
+
+// zoneSerial reads the serial number from the zone's SOA record, which new records are stamped with
+func (d *DNSRecordModule) zoneSerial(session *ldapsession.LDAPSession, zoneDN string) uint32 {
+	records, _, _, err := d.readNode(session, "DC=@,"+zoneDN)
+	if err == nil {
+		for _, r := range records {
+			if serial, ok := r.SOASerial(); ok {
+				return serial
+			}
+		}
+	}
+	session.Log.Warnf("unable to read the SOA serial of %s, using 1", zoneDN)
+	return 1
+}
+
+// readNode returns a dnsNode's records and whether it is tombstoned. exists is false if there is no such node
+func (d *DNSRecordModule) readNode(session *ldapsession.LDAPSession, dn string) (records []*adschema.DNSRecord, tombstoned, exists bool, err error) {
+	sr := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"dnsRecord", "dNSTombstoned"}, nil)
+	res, err := session.GetSearchResults(sr)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, false, false, nil
+	}
+	if err != nil || len(res.Entries) == 0 {
+		return nil, false, false, err
+	}
+	entry := res.Entries[0]
+	tombstoned = strings.EqualFold(entry.GetAttributeValue("dNSTombstoned"), "TRUE")
+	for _, b := range entry.GetRawAttributeValues("dnsRecord") {
+		r, err := adschema.ParseDNSRecord(b)
+		if err != nil {
+			session.Log.Warnf("unable to parse dnsRecord on %s: %s", dn, err)
+			continue
+		}
+		if !tombstoned {
+			records = append(records, r)
+		}
+	}
+	return records, tombstoned, true, nil
+}
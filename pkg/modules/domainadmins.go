@@ -2,6 +2,7 @@ package modules
 
 import (
 	"fmt"
+	"github.com/go-ldap/ldap/v3"
 	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
 	"github.com/spf13/pflag"
 	"strings"
@@ -38,7 +39,7 @@ func (DAModule) Filter(baseDN string) string {
 	var sb strings.Builder
 	sb.WriteString("(&(objectClass=user)(|")
 	for _, group := range DomainAdminGroups {
-		filter := fmt.Sprintf("(memberof:1.2.840.113556.1.4.1941:=CN=%s,CN=Users,%s)", group, baseDN)
+		filter := fmt.Sprintf("(memberof:1.2.840.113556.1.4.1941:=%s)", ldap.EscapeFilter("CN="+group+",CN=Users,"+baseDN))
 		sb.WriteString(filter)
 	}
 	sb.WriteString("))")
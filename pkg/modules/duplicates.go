@@ -0,0 +1,161 @@
+package modules
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type DuplicatesModule struct {
+	DomainOnly bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(DuplicatesModule))
+	adschema.RegisterAttribute("conflict", "String(Unicode)", true)
+	adschema.RegisterAttribute("value", "String(Unicode)", true)
+	adschema.RegisterAttribute("conflictsWith", "String(Unicode)", false)
+}
+
+// Kinds of conflict
+const (
+	conflictCNF            = "CNF object"
+	conflictDuplicateSAM   = "$DUPLICATE sAMAccountName"
+	conflictSAMAccountName = "sAMAccountName"
+	conflictUPN            = "userPrincipalName"
+	conflictSPN            = "servicePrincipalName"
+)
+
+// cnfRDN matches the mangling AD adds to the RDN of the loser of a naming conflict: a line feed, then "CNF:" and its
+// objectGUID. It's escaped as \0A in DNs
+var cnfRDN = regexp.MustCompile(`(?i)(\\0A|\n)CNF:[0-9a-f-]+`)
+
+// duplicateSAMPrefix is what AD renames the sAMAccountName of the loser of a sAMAccountName conflict to
+const duplicateSAMPrefix = "$DUPLICATE-"
+
+func (d *DuplicatesModule) Name() string {
+	return "duplicates"
+}
+
+func (d *DuplicatesModule) Description() string {
+	return "Find CNF conflict objects, and sAMAccountNames, UPNs and SPNs used by more than one object in the forest (via the GC)"
+}
+
+func (d *DuplicatesModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(d.Name(), pflag.ExitOnError)
+	flags.BoolVar(&d.DomainOnly, "domain-only", false, "Only search the domain, instead of the whole forest through the global catalog")
+	return flags
+}
+
+func (d *DuplicatesModule) DefaultAttrs() []string {
+	return []string{"conflict", "value", "conflictsWith"}
+}
+
+func (d *DuplicatesModule) IsReportModule() bool {
+	return true
+}
+
+// duplicateFinding is an object whose value of an attribute conflicts with other objects
+type duplicateFinding struct {
+	dn, kind, value string
+	others          []string
+}
+
+func (d *DuplicatesModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	search, baseDN := session, session.BaseDN
+	if !d.DomainOnly {
+		if gc, err := session.GlobalCatalog(); err != nil {
+			session.Log.Warnf("unable to connect to the global catalog, only searching the domain: %s", err)
+		} else {
+			defer gc.Close()
+			// the GC searched from the root covers every domain of the forest
+			search, baseDN = gc, ""
+		}
+	}
+
+	filter := `(|(sAMAccountName=*)(userPrincipalName=*)(servicePrincipalName=*)(name=*\0ACNF:*))`
+	sr := search.MakeSimpleSearchRequest(filter, []string{"name", "sAMAccountName", "userPrincipalName", "servicePrincipalName"})
+	sr.BaseDN = baseDN
+	res, err := search.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+
+	var findings []duplicateFinding
+	// lower case value to the DNs it's set on, per attribute
+	owners := map[string]map[string][]string{conflictSAMAccountName: {}, conflictUPN: {}, conflictSPN: {}}
+	// each kind and value, in the order (and case) they were first seen
+	var order [][2]string
+	for _, entry := range res.Entries {
+		if cnfRDN.MatchString(entry.DN) {
+			original := cnfRDN.ReplaceAllString(entry.DN, "")
+			name := strings.SplitN(entry.GetAttributeValue("name"), "\n", 2)[0]
+			findings = append(findings, duplicateFinding{entry.DN, conflictCNF, name, []string{original}})
+		}
+		if sam := entry.GetAttributeValue("sAMAccountName"); strings.HasPrefix(strings.ToUpper(sam), duplicateSAMPrefix) {
+			findings = append(findings, duplicateFinding{entry.DN, conflictDuplicateSAM, sam, nil})
+		}
+		values := map[string][]string{
+			conflictSAMAccountName: entry.GetAttributeValues("sAMAccountName"),
+			conflictUPN:            entry.GetAttributeValues("userPrincipalName"),
+			conflictSPN:            entry.GetAttributeValues("servicePrincipalName"),
+		}
+		for kind, vals := range values {
+			for _, v := range vals {
+				key := strings.ToLower(v)
+				if owners[kind][key] == nil {
+					order = append(order, [2]string{kind, v})
+				}
+				owners[kind][key] = append(owners[kind][key], entry.DN)
+			}
+		}
+	}
+
+	for _, o := range order {
+		kind, value := o[0], o[1]
+		dns := owners[kind][strings.ToLower(value)]
+		if len(dns) < 2 {
+			continue
+		}
+		for i, dn := range dns {
+			others := append(append([]string(nil), dns[:i]...), dns[i+1:]...)
+			findings = append(findings, duplicateFinding{dn, kind, value, others})
+		}
+	}
+
+	// conflicts of the same kind and value together
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].kind != findings[j].kind {
+			return conflictRank(findings[i].kind) < conflictRank(findings[j].kind)
+		}
+		return strings.ToLower(findings[i].value) < strings.ToLower(findings[j].value)
+	})
+	var entries []*ldap.Entry
+	for _, f := range findings {
+		values := map[string][]string{
+			"conflict": {f.kind},
+			"value":    {f.value},
+		}
+		if len(f.others) > 0 {
+			values["conflictsWith"] = f.others
+		}
+		entries = append(entries, ldap.NewEntry(f.dn, values))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// conflictRank orders conflicts left behind by replication before values that are merely reused
+func conflictRank(kind string) int {
+	for i, k := range []string{conflictCNF, conflictDuplicateSAM, conflictSPN, conflictUPN, conflictSAMAccountName} {
+		if k == kind {
+			return i
+		}
+	}
+	return -1
+}
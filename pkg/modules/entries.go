@@ -0,0 +1,32 @@
+package modules
+
+import (
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// filterEntryAttributes trims entries built by a module (rather than returned by the server) down to the requested
+// attributes, the same way the server would. An empty list or "*" keeps every attribute
+func filterEntryAttributes(entries []*ldap.Entry, attrs []string) []*ldap.Entry {
+	wanted := make(map[string]bool)
+	for _, a := range attrs {
+		if a == "*" {
+			return entries
+		}
+		wanted[strings.ToLower(a)] = true
+	}
+	if len(wanted) == 0 {
+		return entries
+	}
+	for _, entry := range entries {
+		var kept []*ldap.EntryAttribute
+		for _, attr := range entry.Attributes {
+			if wanted[strings.ToLower(attr.Name)] {
+				kept = append(kept, attr)
+			}
+		}
+		entry.Attributes = kept
+	}
+	return entries
+}
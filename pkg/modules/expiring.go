@@ -0,0 +1,152 @@
+package modules
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	uac "github.com/audibleblink/msldapuac"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type ExpiringModule struct {
+	Days            int
+	IncludeExpired  bool
+	IncludeDisabled bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(ExpiringModule))
+	adschema.RegisterAttribute("expiry", "String(Unicode)", true)
+	adschema.RegisterAttribute("expiresOn", "String(Unicode)", true)
+	adschema.RegisterAttribute("daysLeft", "Enumeration", true)
+}
+
+// Things that expire
+const (
+	expiryAccount  = "account"
+	expiryPassword = "password"
+)
+
+// neverExpires is the value of accountExpires and msDS-UserPasswordExpiryTimeComputed that means never
+const neverExpires = "9223372036854775807"
+
+var expiringAttrs = []string{"sAMAccountName", "accountExpires", "pwdLastSet", "userAccountControl", "msDS-ResultantPSO", "msDS-UserPasswordExpiryTimeComputed"}
+
+func (e *ExpiringModule) Name() string {
+	return "expiring"
+}
+
+func (e *ExpiringModule) Description() string {
+	return "List accounts, and passwords (per the domain policy or PSO), that expire within the next N days"
+}
+
+func (e *ExpiringModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(e.Name(), pflag.ExitOnError)
+	flags.IntVar(&e.Days, "days", 14, "List what expires within this many days")
+	flags.BoolVar(&e.IncludeExpired, "include-expired", false, "Also list accounts and passwords that have already expired")
+	flags.BoolVar(&e.IncludeDisabled, "include-disabled", false, "Include disabled accounts")
+	return flags
+}
+
+func (e *ExpiringModule) DefaultAttrs() []string {
+	return []string{"sAMAccountName", "expiry", "expiresOn", "daysLeft"}
+}
+
+func (e *ExpiringModule) IsReportModule() bool {
+	return true
+}
+
+// expiringAccount is an account, or its password, and when it expires
+type expiringAccount struct {
+	entry   *ldap.Entry
+	expiry  string
+	expires time.Time
+}
+
+func (e *ExpiringModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	if e.Days < 0 {
+		return fmt.Errorf("invalid --days %d", e.Days)
+	}
+	maxAge, psoAges := readMaxPasswordAges(session)
+
+	filter := "(&(objectCategory=person)(objectClass=user)"
+	if !e.IncludeDisabled {
+		filter += fmt.Sprintf("(!(userAccountControl:1.2.840.113556.1.4.803:=%d))", uac.Accountdisable)
+	}
+	filter += ")"
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter, expiringAttrs))
+	if err != nil {
+		return err
+	}
+
+	now := session.ServerTime()
+	until := now.Add(time.Duration(e.Days) * 24 * time.Hour)
+	var found []expiringAccount
+	for _, entry := range res.Entries {
+		if t, ok := expiryTime(entry.GetAttributeValue("accountExpires")); ok {
+			found = append(found, expiringAccount{entry, expiryAccount, t})
+		}
+		if t, ok := passwordExpiry(entry, maxAge, psoAges); ok {
+			found = append(found, expiringAccount{entry, expiryPassword, t})
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool { return found[i].expires.Before(found[j].expires) })
+	var entries []*ldap.Entry
+	for _, f := range found {
+		if f.expires.After(until) || (!e.IncludeExpired && f.expires.Before(now)) {
+			continue
+		}
+		entries = append(entries, ldap.NewEntry(f.entry.DN, map[string][]string{
+			"sAMAccountName": {f.entry.GetAttributeValue("sAMAccountName")},
+			"expiry":         {f.expiry},
+			"expiresOn":      {f.expires.UTC().Format("2006-01-02 15:04 UTC")},
+			"daysLeft":       {strconv.Itoa(int(math.Floor(f.expires.Sub(now).Hours() / 24)))},
+		}))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// passwordExpiry is when the account's password expires. The DC computes it with the PSO that applies in
+// msDS-UserPasswordExpiryTimeComputed, and older DCs without it fall back to pwdLastSet and the readable policies.
+// It's false when the password doesn't expire, or has to be changed at next logon anyway
+func passwordExpiry(entry *ldap.Entry, maxAge time.Duration, psoAges map[string]time.Duration) (time.Time, bool) {
+	flags, _ := strconv.Atoi(entry.GetAttributeValue("userAccountControl"))
+	if flags&uac.DontExpirePassword != 0 {
+		return time.Time{}, false
+	}
+	if computed := entry.GetAttributeValue("msDS-UserPasswordExpiryTimeComputed"); computed != "" {
+		return expiryTime(computed)
+	}
+	set, ok := pwdLastSet(entry)
+	if !ok {
+		return time.Time{}, false
+	}
+	limit := maxAge
+	if pso := strings.ToLower(entry.GetAttributeValue("msDS-ResultantPSO")); pso != "" {
+		if age, ok := psoAges[pso]; ok {
+			limit = age
+		}
+	}
+	if limit <= 0 {
+		return time.Time{}, false
+	}
+	return set.Add(limit), true
+}
+
+// expiryTime parses an accountExpires style file time, which is false when it's unset or never
+func expiryTime(v string) (time.Time, bool) {
+	if v == "" || v == "0" || v == neverExpires {
+		return time.Time{}, false
+	}
+	t, err := adschema.NTFileTimeToTimestamp(v)
+	return t, err == nil
+}
@@ -0,0 +1,186 @@
+package modules
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/sirupsen/logrus"
+)
+
+const fakeBaseDN = "DC=lab,DC=local"
+
+// fakeEntry is an entry a fake DC returns, with its attributes in order
+type fakeEntry struct {
+	dn    string
+	attrs [][2]string
+}
+
+// fakeHandler answers the request with message ID id with the responses to send back, or nil for an empty success
+type fakeHandler func(id int64, req *ber.Packet) []*ber.Packet
+
+// fakeDC returns a session connected to a DC on localhost that answers every request with handle, except reads of
+// the rootDSE, which it answers itself
+func fakeDC(t *testing.T, options ldapsession.LDAPSessionOptions, handle fakeHandler) *ldapsession.LDAPSession {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFake(conn, handle)
+		}
+	}()
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	options.DomainController = "127.0.0.1"
+	options.Port = l.Addr().(*net.TCPAddr).Port
+	options.SkipCLDAP = true
+	options.Logger = logger
+	if options.PageSize == 0 {
+		options.PageSize = 1000
+	}
+	session, err := ldapsession.NewLDAPSession(&options, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(session.Close)
+	return session
+}
+
+func serveFake(conn net.Conn, handle fakeHandler) {
+	defer conn.Close()
+	for {
+		req, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		id := req.Children[0].Value.(int64)
+		op := req.Children[1].Tag
+		var responses []*ber.Packet
+		switch {
+		case op == ldap.ApplicationUnbindRequest || op == ldap.ApplicationAbandonRequest:
+			continue
+		case op == ldap.ApplicationSearchRequest && requestBase(req) == "":
+			responses = []*ber.Packet{
+				response(id, searchEntry(fakeEntry{"", [][2]string{{"defaultNamingContext", fakeBaseDN}}})),
+				response(id, resultCode(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, "")),
+			}
+		default:
+			responses = handle(id, req)
+		}
+		if responses == nil {
+			done := op + 1
+			if op == ldap.ApplicationSearchRequest {
+				done = ldap.ApplicationSearchResultDone
+			}
+			responses = []*ber.Packet{response(id, resultCode(done, ldap.LDAPResultSuccess, ""))}
+		}
+		for _, r := range responses {
+			conn.Write(r.Bytes())
+		}
+	}
+}
+
+// collect runs a module on the session the way windapsearch does, returning the entries it outputs
+func collect(session *ldapsession.LDAPSession, mod Module, attrs []string) ([]*ldap.Entry, error) {
+	var entries []*ldap.Entry
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range session.Channels.Entries {
+			entries = append(entries, e)
+		}
+	}()
+	go func() {
+		for range session.Channels.Referrals {
+		}
+	}()
+	go func() {
+		for range session.Channels.Controls {
+		}
+	}()
+	err := mod.Run(session, attrs)
+	session.CloseChannels()
+	<-done
+	return entries, err
+}
+
+// response wraps a protocol op in an LDAP message answering the request with message ID id
+func response(id int64, op *ber.Packet, controls ...ldap.Control) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	if len(controls) > 0 {
+		c := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "")
+		for _, control := range controls {
+			c.AppendChild(control.Encode())
+		}
+		p.AppendChild(c)
+	}
+	return p
+}
+
+func requestBase(req *ber.Packet) string {
+	base, _ := req.Children[1].Children[0].Value.(string)
+	return base
+}
+
+// requestAttrs are the attributes a search request asks for
+func requestAttrs(req *ber.Packet) []string {
+	var attrs []string
+	for _, a := range req.Children[1].Children[7].Children {
+		attrs = append(attrs, a.Data.String())
+	}
+	return attrs
+}
+
+// requestCookie is the paging cookie a search request carries, if any
+func requestCookie(req *ber.Packet) []byte {
+	if len(req.Children) < 3 {
+		return nil
+	}
+	for _, child := range req.Children[2].Children {
+		if c, err := ldap.DecodeControl(child); err == nil {
+			if paging, ok := c.(*ldap.ControlPaging); ok {
+				return paging.Cookie
+			}
+		}
+	}
+	return nil
+}
+
+func searchEntry(e fakeEntry) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for _, a := range e.attrs {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, a[0], ""))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, a[1], ""))
+		attr.AppendChild(values)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return op
+}
+
+func resultCode(tag ber.Tag, code uint16, message string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, message, ""))
+	return op
+}
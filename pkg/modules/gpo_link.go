@@ -0,0 +1,185 @@
+package modules
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+// gPLink link options
+const (
+	gpLinkDisabled = 0x1
+	gpLinkEnforced = 0x2
+)
+
+var gpLinkRegex = regexp.MustCompile(`\[LDAP://([^;\]]+);(\d+)\]`)
+
+// gpLink is a single link in a gPLink value
+type gpLink struct {
+	DN      string
+	Options int
+}
+
+func (l gpLink) String() string {
+	return fmt.Sprintf("[LDAP://%s;%d]", l.DN, l.Options)
+}
+
+func parseGPLink(value string) []gpLink {
+	var links []gpLink
+	for _, m := range gpLinkRegex.FindAllStringSubmatch(value, -1) {
+		options, _ := strconv.Atoi(m[2])
+		links = append(links, gpLink{DN: m[1], Options: options})
+	}
+	return links
+}
+
+func formatGPLink(links []gpLink) string {
+	var sb strings.Builder
+	for _, l := range links {
+		sb.WriteString(l.String())
+	}
+	return sb.String()
+}
+
+type GPOLinkModule struct {
+	GPO      string
+	Target   string
+	Action   string
+	Enforced bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(GPOLinkModule))
+	adschema.RegisterAttribute("gpo", "String(Unicode)", true)
+}
+
+func (g *GPOLinkModule) Name() string {
+	return "gpo-link"
+}
+
+func (g *GPOLinkModule) Description() string {
+	return "Link or unlink a GPO to an OU, domain or site by editing its gPLink"
+}
+
+func (g *GPOLinkModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(g.Name(), pflag.ExitOnError)
+	flags.StringVar(&g.GPO, "gpo", "", "DN, {GUID} or displayName of the GPO")
+	flags.StringVar(&g.Target, "target", "", "DN of the OU, domain or site to link the GPO to (default: the domain)")
+	flags.StringVar(&g.Action, "action", "link", "Whether to link or unlink the GPO: link, unlink")
+	flags.BoolVar(&g.Enforced, "enforced", false, "Enforce the link, so it can't be blocked by inheritance settings lower down")
+	return flags
+}
+
+func (g *GPOLinkModule) DefaultAttrs() []string {
+	return []string{"action", "gpo", "gPLink", "status"}
+}
+
+func (g *GPOLinkModule) IsWriteModule() bool {
+	return true
+}
+
+func (g *GPOLinkModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	if g.GPO == "" {
+		return fmt.Errorf("must provide a --gpo")
+	}
+	action := strings.ToLower(g.Action)
+	if action != "link" && action != "unlink" {
+		return fmt.Errorf("invalid action %q (must be one of link, unlink)", g.Action)
+	}
+	gpoDN, err := g.resolveGPO(session)
+	if err != nil {
+		return err
+	}
+	target := g.Target
+	if target == "" {
+		target = session.NamingContexts.Default
+	}
+
+	sr := ldap.NewSearchRequest(target, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"gPLink"}, nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		return err
+	}
+	if len(res.Entries) == 0 {
+		return fmt.Errorf("target %q not found", target)
+	}
+	current := res.Entries[0].GetAttributeValue("gPLink")
+	links := parseGPLink(current)
+
+	var updated []gpLink
+	found := false
+	for _, l := range links {
+		if ldapsession.EqualDN(l.DN, gpoDN) {
+			found = true
+			if action == "unlink" {
+				continue
+			}
+		}
+		updated = append(updated, l)
+	}
+	values := map[string][]string{"action": {action}, "gpo": {gpoDN}}
+	if found == (action == "link") {
+		values["gPLink"] = []string{current}
+		values["status"] = []string{"unchanged (already done)"}
+		writeResult(session, target, values, attrs)
+		return nil
+	}
+	if action == "link" {
+		options := 0
+		if g.Enforced {
+			options |= gpLinkEnforced
+		}
+		// new links go first, which gives them the lowest precedence (the highest link order), like GPMC does
+		updated = append([]gpLink{{DN: gpoDN, Options: options}}, updated...)
+	}
+
+	// swapping the exact value read for the new one fails instead of losing a concurrent change
+	newValue := formatGPLink(updated)
+	req := ldap.NewModifyRequest(target, nil)
+	switch {
+	case current == "":
+		req.Add("gPLink", []string{newValue})
+	case newValue == "":
+		req.Delete("gPLink", []string{current})
+	default:
+		req.Delete("gPLink", []string{current})
+		req.Add("gPLink", []string{newValue})
+	}
+	applied, err := session.Modify(req)
+	if err != nil {
+		return fmt.Errorf("unable to %s GPO: %s", action, err)
+	}
+	values["gPLink"] = []string{newValue}
+	values["status"] = []string{writeStatus(session, applied)}
+	writeResult(session, target, values, attrs)
+	return nil
+}
+
+// resolveGPO finds the DN of the GPO from a DN, its {GUID} name, or its display name
+func (g *GPOLinkModule) resolveGPO(session *ldapsession.LDAPSession) (string, error) {
+	if strings.Contains(g.GPO, "=") {
+		return g.GPO, nil
+	}
+	filter := fmt.Sprintf("(&(objectClass=groupPolicyContainer)(displayName=%s))", ldap.EscapeFilter(g.GPO))
+	if strings.HasPrefix(g.GPO, "{") {
+		filter = fmt.Sprintf("(&(objectClass=groupPolicyContainer)(cn=%s))", ldap.EscapeFilter(g.GPO))
+	}
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter, []string{"displayName"}))
+	if err != nil {
+		return "", err
+	}
+	switch len(res.Entries) {
+	case 0:
+		return "", fmt.Errorf("no GPO found matching %q", g.GPO)
+	case 1:
+		return res.Entries[0].DN, nil
+	}
+	return "", fmt.Errorf("more than one GPO found matching %q, use the DN or {GUID}", g.GPO)
+}
@@ -0,0 +1,244 @@
+package modules
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type GPOPermissionsModule struct {
+	Sysvol string
+	All    bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(GPOPermissionsModule))
+}
+
+// gpoWriteRights are the rights on a GPC that let a principal change what the GPO does, or give themselves that.
+// GenericAll and GenericWrite include them
+const gpoWriteRights = secdesc.RightWriteProperty | secdesc.RightWriteDACL | secdesc.RightWriteOwner
+
+// File rights of a SYSVOL folder ACE (MS-DTYP 2.4.3)
+const (
+	fileWriteData    uint32 = 0x00000002
+	fileAppendData   uint32 = 0x00000004
+	fileGenericAll   uint32 = 0x10000000
+	fileGenericWrite uint32 = 0x40000000
+	fileFullControl  uint32 = 0x001f01ff
+	fileModify       uint32 = 0x001301bf
+	fileWrite        uint32 = 0x00100116
+)
+
+// gpoFileWriteRights are the rights on a GPO's SYSVOL folder that let a principal change its files (the scripts and
+// settings clients apply), or its ACL
+const gpoFileWriteRights = fileWriteData | fileAppendData | secdesc.RightWriteDACL | secdesc.RightWriteOwner | fileGenericAll | fileGenericWrite
+
+// fileRights names the rights of a file ACE, the combined ones first
+var fileRights = []struct {
+	mask uint32
+	name string
+}{
+	{fileFullControl, "FullControl"},
+	{fileModify, "Modify"},
+	{fileGenericAll, "GenericAll"},
+	{fileGenericWrite, "GenericWrite"},
+	{fileWrite, "Write"},
+	{fileWriteData, "WriteData"},
+	{fileAppendData, "AppendData"},
+	{secdesc.RightDelete, "Delete"},
+	{secdesc.RightWriteDACL, "WriteDAC"},
+	{secdesc.RightWriteOwner, "WriteOwner"},
+}
+
+// defaultGPOPrincipals are the SIDs a new GPO grants edit rights to, on the GPC and its SYSVOL folder
+var defaultGPOPrincipals = map[string]bool{
+	"S-1-3-0":      true, // Creator Owner
+	"S-1-5-9":      true, // Enterprise Domain Controllers
+	"S-1-5-18":     true, // Local System
+	"S-1-5-32-544": true, // Administrators
+}
+
+// defaultGPORIDs are the domain groups a new GPO grants edit rights to
+var defaultGPORIDs = map[uint32]bool{
+	512: true, // Domain Admins
+	519: true, // Enterprise Admins
+}
+
+func (g *GPOPermissionsModule) Name() string {
+	return "gpo-permissions"
+}
+
+func (g *GPOPermissionsModule) Description() string {
+	return "Find GPOs that non-default principals can edit, through the GPC's DACL (and optionally the SYSVOL folder's ACL)"
+}
+
+func (g *GPOPermissionsModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(g.Name(), pflag.ExitOnError)
+	flags.StringVar(&g.Sysvol, "sysvol", "", "Also check the ACL of each GPO's folder under this SYSVOL path (a cifs mount, on Linux only)")
+	flags.BoolVar(&g.All, "all", false, "Also report the principals that can edit GPOs by default (Domain Admins, Enterprise Admins, SYSTEM, ...)")
+	return flags
+}
+
+func (g *GPOPermissionsModule) DefaultAttrs() []string {
+	return []string{"displayName", "principal", "aces"}
+}
+
+func (g *GPOPermissionsModule) IsReportModule() bool {
+	return true
+}
+
+func (g *GPOPermissionsModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	if g.Sysvol != "" {
+		if _, err := os.Stat(g.Sysvol); err != nil {
+			return fmt.Errorf("unable to read SYSVOL: %s", err)
+		}
+		// a copy of SYSVOL, or a mount that doesn't expose ACLs, would fail for every GPO
+		if _, err := readFileSecurityDescriptor(g.Sysvol); err != nil {
+			return fmt.Errorf("unable to read ACLs under %s (is it a cifs mount?): %s", g.Sysvol, err)
+		}
+	}
+	sr := session.MakeSimpleSearchRequest("(objectClass=groupPolicyContainer)", []string{"cn", "displayName", "gPCFileSysPath", "nTSecurityDescriptor"})
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+
+	type grant struct {
+		gpo  *ldap.Entry
+		sid  string
+		aces []string
+	}
+	var grants []*grant
+	var sids []string
+	domain := ldapsession.DNToDomain(session.NamingContexts.Default)
+	for _, gpo := range res.Entries {
+		bySID := make(map[string]*grant)
+		add := func(sid, ace string) {
+			if !g.All && isDefaultGPOPrincipal(sid) {
+				return
+			}
+			gr, ok := bySID[sid]
+			if !ok {
+				gr = &grant{gpo: gpo, sid: sid}
+				bySID[sid] = gr
+				grants = append(grants, gr)
+				sids = append(sids, sid)
+			}
+			gr.aces = append(gr.aces, ace)
+		}
+
+		if sd := parseGPOSecurityDescriptor(session, gpo); sd != nil {
+			if sd.Owner != nil {
+				add(sd.Owner.String(), "GPC: Owner")
+			}
+			for _, ace := range gpcWriteACEs(sd) {
+				add(ace.SID.String(), "GPC: "+ace.Describe())
+			}
+		}
+
+		if g.Sysvol == "" {
+			continue
+		}
+		dir := gpoSysvolDir(g.Sysvol, domain, gpo)
+		if dir == "" {
+			session.Log.Infof("no SYSVOL folder found for GPO %s", gpo.DN)
+			continue
+		}
+		raw, err := readFileSecurityDescriptor(dir)
+		if err != nil {
+			session.Log.Warnf("unable to read the ACL of %s: %s", dir, err)
+			continue
+		}
+		sd, err := secdesc.Parse(raw)
+		if err != nil || sd.DACL == nil {
+			session.Log.Warnf("unable to parse the ACL of %s: %v", dir, err)
+			continue
+		}
+		for _, ace := range sd.DACL.ACEs {
+			if ace.Type != secdesc.AccessAllowedACEType || ace.Flags&secdesc.InheritOnlyACE != 0 || ace.Mask&gpoFileWriteRights == 0 {
+				continue
+			}
+			add(ace.SID.String(), "SYSVOL: Allow "+strings.Join(fileRightNames(ace.Mask), "|"))
+		}
+	}
+
+	sort.SliceStable(grants, func(i, j int) bool {
+		return strings.ToLower(grants[i].gpo.GetAttributeValue("displayName")) < strings.ToLower(grants[j].gpo.GetAttributeValue("displayName"))
+	})
+	names := session.SIDResolver().Resolve(sids)
+	var entries []*ldap.Entry
+	for _, gr := range grants {
+		entries = append(entries, ldap.NewEntry(gr.gpo.DN, map[string][]string{
+			"displayName": {gr.gpo.GetAttributeValue("displayName")},
+			"principal":   principalNames([]string{gr.sid}, names),
+			"aces":        gr.aces,
+		}))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// parseGPOSecurityDescriptor parses the GPC's nTSecurityDescriptor, warning when it can't be read
+func parseGPOSecurityDescriptor(session *ldapsession.LDAPSession, gpo *ldap.Entry) *secdesc.SecurityDescriptor {
+	raw := gpo.GetRawAttributeValue("nTSecurityDescriptor")
+	if len(raw) == 0 {
+		session.Log.Warnf("no nTSecurityDescriptor returned for %s", gpo.DN)
+		return nil
+	}
+	sd, err := secdesc.Parse(raw)
+	if err != nil || sd.DACL == nil {
+		session.Log.Warnf("unable to parse the security descriptor of %s: %v", gpo.DN, err)
+		return nil
+	}
+	return sd
+}
+
+// gpcWriteACEs are the allow ACEs that apply to the GPC itself (not only to objects below it) and grant a write right
+func gpcWriteACEs(sd *secdesc.SecurityDescriptor) []secdesc.ACE {
+	var aces []secdesc.ACE
+	for _, ace := range sd.DACL.ACEs {
+		if ace.Type != secdesc.AccessAllowedACEType && ace.Type != secdesc.AccessAllowedObjectACEType {
+			continue
+		}
+		if ace.Flags&secdesc.InheritOnlyACE != 0 || ace.Mask&gpoWriteRights == 0 {
+			continue
+		}
+		aces = append(aces, ace)
+	}
+	return aces
+}
+
+// isDefaultGPOPrincipal is true for the SIDs that can edit every GPO by default
+func isDefaultGPOPrincipal(s string) bool {
+	if defaultGPOPrincipals[s] {
+		return true
+	}
+	sid, err := secdesc.ParseSID(s)
+	if err != nil {
+		return false
+	}
+	_, inDomain := sid.DomainSID()
+	return inDomain && defaultGPORIDs[sid.RID()]
+}
+
+// fileRightNames lists the rights of a file ACE by name, with any left over in hex
+func fileRightNames(mask uint32) []string {
+	var names []string
+	for _, r := range fileRights {
+		if mask&r.mask == r.mask {
+			names = append(names, r.name)
+			mask &^= r.mask
+		}
+	}
+	if mask != 0 {
+		names = append(names, fmt.Sprintf("0x%x", mask))
+	}
+	return names
+}
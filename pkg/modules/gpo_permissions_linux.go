@@ -0,0 +1,23 @@
+//go:build linux
+// +build linux
+
+package modules
+
+import "syscall"
+
+// cifsACLAttr is the extended attribute a cifs mount exposes a file's Windows security descriptor as
+const cifsACLAttr = "system.cifs_acl"
+
+// readFileSecurityDescriptor reads the Windows security descriptor of a file or folder on a cifs mount
+func readFileSecurityDescriptor(path string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, cifsACLAttr, nil)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Getxattr(path, cifsACLAttr, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package modules
+
+import "fmt"
+
+// readFileSecurityDescriptor is only implemented for cifs mounts on Linux
+func readFileSecurityDescriptor(path string) ([]byte, error) {
+	return nil, fmt.Errorf("reading SYSVOL ACLs is only supported on a Linux cifs mount")
+}
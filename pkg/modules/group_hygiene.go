@@ -0,0 +1,251 @@
+package modules
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type GroupHygieneModule struct {
+	AllACLs        bool
+	IncludeBuiltin bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(GroupHygieneModule))
+}
+
+// aclHolders are the objects whose ACLs are read to find the groups that are used, unless --all-acls is given: the
+// places access is normally delegated, and GPOs (whose DACLs do security filtering)
+const aclHolders = "(|(objectClass=domainDNS)(objectClass=organizationalUnit)(objectClass=container)(objectClass=groupPolicyContainer))"
+
+func (g *GroupHygieneModule) Name() string {
+	return "group-hygiene"
+}
+
+func (g *GroupHygieneModule) Description() string {
+	return "Find groups with no members, groups no ACL or GPO refers to, and circularly nested groups"
+}
+
+func (g *GroupHygieneModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(g.Name(), pflag.ExitOnError)
+	flags.BoolVar(&g.AllACLs, "all-acls", false, "Read the ACL of every object to find the groups that are used, not only of the domain, OUs, containers and GPOs (slow)")
+	flags.BoolVar(&g.IncludeBuiltin, "include-builtin", false, "Also report built in and default groups (RIDs below 1000), which are used by Windows itself")
+	return flags
+}
+
+func (g *GroupHygieneModule) DefaultAttrs() []string {
+	return []string{"sAMAccountName", "findings"}
+}
+
+func (g *GroupHygieneModule) IsReportModule() bool {
+	return true
+}
+
+// hygieneGroup is a group, with the groups it's directly a member of (lower case DNs)
+type hygieneGroup struct {
+	entry    *ldap.Entry
+	sid      string
+	rid      uint32
+	empty    bool
+	parents  []string
+	findings []string
+}
+
+func (g *GroupHygieneModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	// a range of one value is enough to tell whether a group has members, without reading them
+	sr := session.MakeSimpleSearchRequest("(objectCategory=group)", []string{"sAMAccountName", "objectSid", "memberOf", "member;range=0-0"})
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string]*hygieneGroup)
+	var order []*hygieneGroup
+	var empty []string
+	for _, entry := range res.Entries {
+		hg := &hygieneGroup{entry: entry, empty: true}
+		for _, attr := range entry.Attributes {
+			if strings.EqualFold(strings.SplitN(attr.Name, ";", 2)[0], "member") && len(attr.Values) > 0 {
+				hg.empty = false
+			}
+		}
+		for _, parent := range entry.GetAttributeValues("memberOf") {
+			hg.parents = append(hg.parents, strings.ToLower(parent))
+		}
+		if sid, _, err := secdesc.DecodeSID(entry.GetRawAttributeValue("objectSid")); err == nil {
+			hg.sid, hg.rid = sid.String(), sid.RID()
+		}
+		if hg.empty && hg.sid != "" {
+			empty = append(empty, strconv.Itoa(int(hg.rid)))
+		}
+		groups[strings.ToLower(entry.DN)] = hg
+		order = append(order, hg)
+	}
+
+	// accounts aren't in their primary group's member, so a group that looks empty may be someone's primary group
+	if len(empty) > 0 {
+		res, err := session.BulkSearch(session.BaseDN, "primaryGroupID", empty, "", []string{"primaryGroupID"})
+		if err != nil {
+			session.Log.Warnf("unable to check primary groups, groups only used as one will be reported as empty: %s", err)
+		}
+		primary := make(map[string]bool)
+		for _, entry := range res.Entries {
+			primary[entry.GetAttributeValue("primaryGroupID")] = true
+		}
+		for _, hg := range order {
+			if hg.empty && primary[strconv.Itoa(int(hg.rid))] {
+				hg.empty = false
+			}
+		}
+	}
+
+	referenced, read, err := g.aclTrustees(session)
+	if err != nil {
+		return err
+	}
+	parents := make(map[string][]string)
+	children := make(map[string][]string)
+	for dn, hg := range groups {
+		parents[dn] = hg.parents
+		for _, p := range hg.parents {
+			children[p] = append(children[p], dn)
+		}
+	}
+	// a group nested in a group an ACL refers to is used through it
+	used := make(map[string]bool)
+	var markUsed func(dn string)
+	markUsed = func(dn string) {
+		if used[dn] {
+			return
+		}
+		used[dn] = true
+		for _, child := range children[dn] {
+			markUsed(child)
+		}
+	}
+	for dn, hg := range groups {
+		if referenced[hg.sid] {
+			markUsed(dn)
+		}
+	}
+
+	var entries []*ldap.Entry
+	for _, hg := range order {
+		dn := strings.ToLower(hg.entry.DN)
+		if cycle := findCycle(dn, parents); cycle != nil {
+			names := make([]string, len(cycle))
+			for i, c := range cycle {
+				names[i] = groupName(groups, c)
+			}
+			hg.findings = append(hg.findings, "circular nesting: "+strings.Join(names, " > "))
+		}
+		if g.IncludeBuiltin || !isDefaultGroup(hg) {
+			if hg.empty {
+				hg.findings = append(hg.findings, "no members")
+			}
+			if !used[dn] && hg.sid != "" {
+				hg.findings = append(hg.findings, fmt.Sprintf("not referenced in the ACLs of %d objects read", read))
+			}
+		}
+		if len(hg.findings) == 0 {
+			continue
+		}
+		sort.Strings(hg.findings)
+		entries = append(entries, ldap.NewEntry(hg.entry.DN, map[string][]string{
+			"sAMAccountName": {hg.entry.GetAttributeValue("sAMAccountName")},
+			"findings":       hg.findings,
+		}))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// aclTrustees reads the security descriptors of the ACL holders (or every object with --all-acls), and returns the
+// SIDs that own one or are the trustee of an ACE, with the number of security descriptors read
+func (g *GroupHygieneModule) aclTrustees(session *ldapsession.LDAPSession) (map[string]bool, int, error) {
+	filter := aclHolders
+	if g.AllACLs {
+		filter = "(objectClass=*)"
+	}
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter, []string{"nTSecurityDescriptor"}))
+	if err != nil {
+		return nil, 0, err
+	}
+	trustees := make(map[string]bool)
+	read := 0
+	for _, entry := range res.Entries {
+		raw := entry.GetRawAttributeValue("nTSecurityDescriptor")
+		if len(raw) == 0 {
+			continue
+		}
+		sd, err := secdesc.Parse(raw)
+		if err != nil {
+			session.Log.Infof("unable to parse the security descriptor of %s: %s", entry.DN, err)
+			continue
+		}
+		read++
+		if sd.Owner != nil {
+			trustees[sd.Owner.String()] = true
+		}
+		if sd.DACL != nil {
+			for _, ace := range sd.DACL.ACEs {
+				trustees[ace.SID.String()] = true
+			}
+		}
+	}
+	if read == 0 {
+		return nil, 0, fmt.Errorf("no security descriptors could be read, unable to tell which groups are used")
+	}
+	return trustees, read, nil
+}
+
+// isDefaultGroup is true for the groups Windows creates and uses itself: BUILTIN groups, and domain groups with a
+// RID below 1000 (e.g. Domain Admins, Cert Publishers)
+func isDefaultGroup(hg *hygieneGroup) bool {
+	return strings.HasPrefix(hg.sid, "S-1-5-32-") || (hg.sid != "" && hg.rid < 1000)
+}
+
+// groupName is the sAMAccountName of a group by lower case DN, or its DN if it wasn't read
+func groupName(groups map[string]*hygieneGroup, dn string) string {
+	if hg, ok := groups[dn]; ok {
+		return hg.entry.GetAttributeValue("sAMAccountName")
+	}
+	return dn
+}
+
+// findCycle returns the shortest chain of edges from start back to itself, starting and ending with start, or nil if
+// there isn't one. For group nesting, edges are memberOf, so each group is a member of the next
+func findCycle(start string, edges map[string][]string) []string {
+	prev := map[string]string{}
+	queue := []string{start}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, next := range edges[node] {
+			if next == start {
+				cycle := []string{start}
+				for n := node; n != start; n = prev[n] {
+					cycle = append(cycle, n)
+				}
+				cycle = append(cycle, start)
+				// built backwards from the end
+				for i, j := 1, len(cycle)-2; i < j; i, j = i+1, j-1 {
+					cycle[i], cycle[j] = cycle[j], cycle[i]
+				}
+				return cycle
+			}
+			if _, seen := prev[next]; !seen {
+				prev[next] = node
+				queue = append(queue, next)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type GroupModifyModule struct {
+	Group  string
+	Member string
+	Action string
+}
+
+func init() {
+	AllModules = append(AllModules, new(GroupModifyModule))
+}
+
+func (g *GroupModifyModule) Name() string {
+	return "group-modify"
+}
+
+func (g *GroupModifyModule) Description() string {
+	return "Add or remove a member of a group"
+}
+
+func (g *GroupModifyModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(g.Name(), pflag.ExitOnError)
+	flags.StringVarP(&g.Group, "group", "g", "", "DN or sAMAccountName of the group to modify")
+	flags.StringVar(&g.Member, "member", "", "DN or sAMAccountName of the object to add or remove")
+	flags.StringVar(&g.Action, "action", "add", "Whether to add or remove the member: add, remove")
+	return flags
+}
+
+func (g *GroupModifyModule) DefaultAttrs() []string {
+	return []string{"action", "member", "status"}
+}
+
+func (g *GroupModifyModule) IsWriteModule() bool {
+	return true
+}
+
+func (g *GroupModifyModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	if g.Group == "" || g.Member == "" {
+		return fmt.Errorf("must provide a --group and a --member")
+	}
+	action := strings.ToLower(g.Action)
+	if action != "add" && action != "remove" {
+		return fmt.Errorf("invalid action %q (must be one of add, remove)", g.Action)
+	}
+	groupDN, err := resolveDN(session, g.Group, "(objectCategory=group)")
+	if err != nil {
+		return err
+	}
+	memberDN, err := resolveDN(session, g.Member, "")
+	if err != nil {
+		return err
+	}
+
+	isMember, err := g.isMember(session, groupDN, memberDN)
+	if err != nil {
+		return err
+	}
+	values := map[string][]string{"action": {action}, "member": {memberDN}}
+	if isMember == (action == "add") {
+		values["status"] = []string{"unchanged (already done)"}
+		writeResult(session, groupDN, values, attrs)
+		return nil
+	}
+
+	req := ldap.NewModifyRequest(groupDN, nil)
+	if action == "add" {
+		req.Add("member", []string{memberDN})
+	} else {
+		req.Delete("member", []string{memberDN})
+	}
+	applied, err := session.Modify(req)
+	if err != nil {
+		return fmt.Errorf("unable to %s member: %s", action, err)
+	}
+	values["status"] = []string{writeStatus(session, applied)}
+	writeResult(session, groupDN, values, attrs)
+	return nil
+}
+
+// isMember checks the group's direct members for the DN
+func (g *GroupModifyModule) isMember(session *ldapsession.LDAPSession, groupDN, memberDN string) (bool, error) {
+	sr := ldap.NewSearchRequest(
+		groupDN,
+		ldap.ScopeBaseObject,
+		ldap.NeverDerefAliases,
+		0, 0, false,
+		fmt.Sprintf("(member=%s)", ldap.EscapeFilter(memberDN)),
+		[]string{"distinguishedName"},
+		nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return false, fmt.Errorf("group %q does not exist", groupDN)
+		}
+		return false, err
+	}
+	return len(res.Entries) > 0, nil
+}
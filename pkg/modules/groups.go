@@ -8,6 +8,7 @@ import (
 
 type GroupsModule struct {
 	SearchTerm string
+	last       lastFilter
 }
 
 func init() {
@@ -33,6 +34,7 @@ func (g *GroupsModule) Filter() string {
 func (g *GroupsModule) FlagSet() *pflag.FlagSet {
 	flags := pflag.NewFlagSet(g.Name(), pflag.ExitOnError)
 	flags.StringVarP(&g.SearchTerm, "search", "s", "", "Search term to filter on")
+	g.last.addFlags(flags)
 	return flags
 }
 
@@ -41,6 +43,10 @@ func (g *GroupsModule) DefaultAttrs() []string {
 }
 
 func (g *GroupsModule) Run(lSession *ldapsession.LDAPSession, attrs []string) error {
-	searchReq := lSession.MakeSimpleSearchRequest(g.Filter(), attrs)
+	filter, err := g.last.apply(lSession, g.Filter())
+	if err != nil {
+		return err
+	}
+	searchReq := lSession.MakeSimpleSearchRequest(filter, attrs)
 	return lSession.ExecuteSearchRequest(searchReq)
 }
@@ -0,0 +1,73 @@
+package modules
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	uac "github.com/audibleblink/msldapuac"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type KerberoastableModule struct {
+	Hashcat string
+}
+
+func init() {
+	AllModules = append(AllModules, new(KerberoastableModule))
+}
+
+func (k *KerberoastableModule) Name() string {
+	return "kerberoastable-users"
+}
+
+func (k *KerberoastableModule) Description() string {
+	return "Enumerate enabled user accounts with Service Principal Names that are worth kerberoasting (not krbtgt or machine accounts)"
+}
+
+func (k *KerberoastableModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(k.Name(), pflag.ExitOnError)
+	flags.StringVar(&k.Hashcat, "hashcat", "", "Also write the accounts to this file as sAMAccountName:SPN[,SPN...] lines, for roasting and cracking tools")
+	return flags
+}
+
+func (k *KerberoastableModule) DefaultAttrs() []string {
+	return []string{"cn", "sAMAccountName", "servicePrincipalName", "pwdLastSet", "msDS-SupportedEncryptionTypes"}
+}
+
+// Filter matches user accounts (sAMAccountType SAM_NORMAL_USER_ACCOUNT, which computers, gMSAs and trust accounts
+// aren't) with an SPN, except krbtgt and disabled accounts, which can't be roasted
+func (k *KerberoastableModule) Filter() string {
+	return fmt.Sprintf("(&(sAMAccountType=805306368)(servicePrincipalName=*)(!(sAMAccountName=krbtgt))(!(userAccountControl:1.2.840.113556.1.4.803:=%d)))",
+		uac.Accountdisable)
+}
+
+func (k *KerberoastableModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	if k.Hashcat == "" {
+		return session.ExecuteSearchRequest(session.MakeSimpleSearchRequest(k.Filter(), attrs))
+	}
+	searchAttrs := append(append([]string(nil), attrs...), "sAMAccountName", "servicePrincipalName")
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(k.Filter(), searchAttrs))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(k.Hashcat, []byte(roastTargets(res.Entries)), 0644); err != nil {
+		return fmt.Errorf("unable to write hashcat file: %s", err)
+	}
+	fmt.Fprintf(os.Stderr, "[+] %d kerberoastable account(s) written to %s\n", len(res.Entries), k.Hashcat)
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(res.Entries, attrs)})
+	return nil
+}
+
+// roastTargets formats accounts one per line as sAMAccountName:SPN,SPN. SPNs can have a colon themselves
+// (MSSQLSvc/host:1433), but never before the account name, so lines split on the first one
+func roastTargets(entries []*ldap.Entry) string {
+	var sb strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&sb, "%s:%s\n", entry.GetAttributeValue("sAMAccountName"), strings.Join(entry.GetAttributeValues("servicePrincipalName"), ","))
+	}
+	return sb.String()
+}
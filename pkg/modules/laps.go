@@ -0,0 +1,168 @@
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/ropnop/go-windapsearch/pkg/redact"
+	"github.com/spf13/pflag"
+)
+
+type LAPSModule struct {
+	Readable bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(LAPSModule))
+	// the LAPS attributes come from schema extensions, so they aren't in the built in schema
+	adschema.RegisterAttribute("ms-Mcs-AdmPwd", "String(Unicode)", true)
+	adschema.RegisterAttribute("ms-Mcs-AdmPwdExpirationTime", "Interval", true)
+	adschema.RegisterAttribute("msLAPS-Password", "String(Unicode)", true)
+	adschema.RegisterAttribute("msLAPS-PasswordExpirationTime", "Interval", true)
+	adschema.RegisterAttribute("msLAPS-EncryptedPassword", "Object(Replica-Link)", true)
+	adschema.RegisterAttribute("lapsType", "String(Unicode)", false)
+	adschema.RegisterAttribute("lapsReadable", "Boolean", true)
+	adschema.RegisterAttribute("lapsAccount", "String(Unicode)", true)
+	adschema.RegisterAttribute("lapsPassword", "String(Unicode)", true)
+	adschema.RegisterAttribute("lapsUpdated", "String(Unicode)", true)
+	adschema.RegisterAttribute("lapsExpiration", "String(Unicode)", true)
+}
+
+// lapsAttrs are read from every computer, whatever was asked for: the passwords, which are only returned to
+// principals allowed to read them, and the expiration times, which usually anyone can read
+var lapsAttrs = []string{"ms-Mcs-AdmPwd", "ms-Mcs-AdmPwdExpirationTime", "msLAPS-Password", "msLAPS-PasswordExpirationTime",
+	"msLAPS-EncryptedPassword"}
+
+// lapsValueNames are the attributes lapsValues works out, in the order they're added to entries
+var lapsValueNames = []string{"lapsType", "lapsReadable", "lapsAccount", "lapsPassword", "lapsUpdated", "lapsExpiration"}
+
+// windowsLAPSPassword is the JSON Windows LAPS keeps a cleartext password in: the account name, when the password
+// was set as a hex FILETIME, and the password
+type windowsLAPSPassword struct {
+	Account  string `json:"n"`
+	Updated  string `json:"t"`
+	Password string `json:"p"`
+}
+
+func (l *LAPSModule) Name() string {
+	return "laps"
+}
+
+func (l *LAPSModule) Description() string {
+	return "List computers managed by legacy or Windows LAPS, with the passwords the bind can read and when they expire"
+}
+
+func (l *LAPSModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(l.Name(), pflag.ExitOnError)
+	flags.BoolVar(&l.Readable, "readable", false, "Only list computers whose LAPS password the bind can read in cleartext")
+	return flags
+}
+
+func (l *LAPSModule) DefaultAttrs() []string {
+	return []string{"sAMAccountName", "dNSHostName", "lapsType", "lapsReadable", "lapsAccount", "lapsPassword", "lapsExpiration"}
+}
+
+// Run finds the computers with a LAPS expiration time or password. Passwords the bind can't read are left out of
+// the results, so a computer with an expiration time but no password is one whose password can't be read
+func (l *LAPSModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	var filter strings.Builder
+	filter.WriteString("(&(objectCategory=computer)(|")
+	for _, attr := range lapsAttrs {
+		filter.WriteString("(" + attr + "=*)")
+	}
+	filter.WriteString("))")
+	searchAttrs := append(append([]string(nil), attrs...), lapsAttrs...)
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter.String(), searchAttrs))
+	if err != nil {
+		return err
+	}
+
+	var computers []*ldap.Entry
+	readable := make(map[*ldap.Entry]bool)
+	for _, entry := range res.Entries {
+		values := lapsValues(session, entry)
+		readable[entry] = values["lapsReadable"][0] == "TRUE"
+		if l.Readable && !readable[entry] {
+			continue
+		}
+		for _, name := range lapsValueNames {
+			if v, ok := values[name]; ok {
+				entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute(name, v))
+			}
+		}
+		computers = append(computers, entry)
+	}
+
+	// the passwords that can be read first
+	sort.SliceStable(computers, func(i, j int) bool { return readable[computers[i]] && !readable[computers[j]] })
+	n := 0
+	for _, r := range readable {
+		if r {
+			n++
+		}
+	}
+	session.Log.Infof("%d of %d LAPS managed computers' passwords can be read", n, len(res.Entries))
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(computers, attrs)})
+	return nil
+}
+
+// lapsValues works out the LAPS attributes of a computer. Windows LAPS takes precedence when a computer has both,
+// since that's what it's moved on to. Encrypted Windows LAPS passwords are returned to anyone allowed to read the
+// attribute, but only the principals the password was encrypted to can decrypt it (with DPAPI-NG and the domain's KDS
+// root key), so getting the blob back doesn't mean the password can be read: lapsReadable is only set for cleartext
+// passwords, and an encrypted one is shown as such
+func lapsValues(session *ldapsession.LDAPSession, entry *ldap.Entry) map[string][]string {
+	var types []string
+	values := map[string][]string{}
+	readable := false
+	if v := entry.GetAttributeValue("ms-Mcs-AdmPwdExpirationTime"); v != "" || entry.GetAttributeValue("ms-Mcs-AdmPwd") != "" {
+		types = append(types, "legacy")
+		if t, ok := expiryTime(v); ok {
+			values["lapsExpiration"] = []string{t.UTC().Format("2006-01-02 15:04 UTC")}
+		}
+		if pw := entry.GetAttributeValue("ms-Mcs-AdmPwd"); pw != "" {
+			readable = true
+			redact.Add(pw)
+			values["lapsPassword"] = []string{pw}
+		}
+	}
+	if v := entry.GetAttributeValue("msLAPS-PasswordExpirationTime"); v != "" || entry.GetAttributeValue("msLAPS-Password") != "" ||
+		len(entry.GetRawAttributeValue("msLAPS-EncryptedPassword")) > 0 {
+		types = append(types, "windows")
+		if t, ok := expiryTime(v); ok {
+			values["lapsExpiration"] = []string{t.UTC().Format("2006-01-02 15:04 UTC")}
+		}
+		if raw := entry.GetAttributeValue("msLAPS-Password"); raw != "" {
+			readable = true
+			// the raw JSON too, in case it can't be parsed for the password alone
+			redact.Add(raw)
+			var pw windowsLAPSPassword
+			if err := json.Unmarshal([]byte(raw), &pw); err != nil {
+				session.Log.Warnf("unable to parse msLAPS-Password of %s: %s", entry.DN, err)
+			} else {
+				redact.Add(pw.Password)
+				values["lapsAccount"] = []string{pw.Account}
+				values["lapsPassword"] = []string{pw.Password}
+				if ticks, err := strconv.ParseInt(pw.Updated, 16, 64); err == nil {
+					if t, ok := expiryTime(strconv.FormatInt(ticks, 10)); ok {
+						values["lapsUpdated"] = []string{t.UTC().Format("2006-01-02 15:04 UTC")}
+					}
+				}
+			}
+		}
+		if len(entry.GetRawAttributeValue("msLAPS-EncryptedPassword")) > 0 {
+			if _, ok := values["lapsPassword"]; !ok {
+				values["lapsPassword"] = []string{"(encrypted, not decrypted)"}
+			}
+		}
+	}
+	values["lapsType"] = types
+	values["lapsReadable"] = []string{strings.ToUpper(fmt.Sprint(readable))}
+	return values
+}
@@ -0,0 +1,74 @@
+package modules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+// lastFilter is the --last option of modules that list objects, keeping only those with a time attribute (whenChanged
+// by default) in the last 30 days, 12 hours, ... The cutoff is worked out on the DC's clock, so a local clock in
+// another time zone or just wrong doesn't move the window
+type lastFilter struct {
+	Last string
+	Attr string
+}
+
+func (l *lastFilter) addFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&l.Last, "last", "", "Only objects whose --last-attr is less than this long ago on the DC's clock (e.g. 30d, 2w, 12h)")
+	flags.StringVar(&l.Attr, "last-attr", "whenChanged", "Time attribute --last looks at, e.g. whenChanged, whenCreated, lastLogonTimestamp, pwdLastSet")
+}
+
+// apply adds the --last condition to a filter
+func (l *lastFilter) apply(session *ldapsession.LDAPSession, filter string) (string, error) {
+	if l.Last == "" {
+		return filter, nil
+	}
+	age, err := parseAge(l.Last)
+	if err != nil {
+		return "", err
+	}
+	name, syntax := "", ""
+	for n, info := range adschema.AttributeMap {
+		if strings.EqualFold(n, l.Attr) {
+			name, syntax = n, info.Syntax
+			break
+		}
+	}
+	cutoff := session.ServerTime().Add(-age).UTC().Truncate(time.Second)
+	var since string
+	switch {
+	case adschema.NTFiletimeAttributes[name]:
+		since = fmt.Sprintf("(%s>=%d)", name, cutoff.UnixNano()/100+116444736000000000)
+	case syntax == "String(Generalized-Time)":
+		since = fmt.Sprintf("(%s>=%s)", name, cutoff.Format("20060102150405.0Z"))
+	default:
+		return "", fmt.Errorf("--last-attr %q isn't a time attribute", l.Attr)
+	}
+	session.Log.Infof("only including objects with %s since %s (DC time)", name, cutoff.Format(time.RFC3339))
+	return fmt.Sprintf("(&%s%s)", filter, since), nil
+}
+
+// parseAge parses a length of time like 30d or 2w, or anything time.ParseDuration does (e.g. 12h)
+func parseAge(s string) (time.Duration, error) {
+	day := 24 * time.Hour
+	units := map[string]time.Duration{"d": day, "w": 7 * day}
+	var age time.Duration
+	var err error
+	if unit, ok := units[strings.ToLower(s[len(s)-1:])]; ok {
+		var n float64
+		n, err = strconv.ParseFloat(s[:len(s)-1], 64)
+		age = time.Duration(n * float64(unit))
+	} else {
+		age, err = time.ParseDuration(s)
+	}
+	if err != nil || age <= 0 {
+		return 0, fmt.Errorf("invalid --last %q (e.g. 30d, 2w, 12h)", s)
+	}
+	return age, nil
+}
@@ -0,0 +1,92 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type LogonRestrictionsModule struct {
+	UTCOffset int
+}
+
+func init() {
+	AllModules = append(AllModules, new(LogonRestrictionsModule))
+	adschema.RegisterAttribute("restrictions", "String(Unicode)", false)
+	adschema.RegisterAttribute("allowedLogonHours", "String(Unicode)", false)
+}
+
+func (l *LogonRestrictionsModule) Name() string {
+	return "logon-restrictions"
+}
+
+func (l *LogonRestrictionsModule) Description() string {
+	return "List accounts restricted by logon hours (decoded) or to the workstations in userWorkstations"
+}
+
+func (l *LogonRestrictionsModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(l.Name(), pflag.ExitOnError)
+	flags.IntVar(&l.UTCOffset, "utc-offset", 0, "Show logon hours in this time zone, as hours from UTC (e.g. -5), instead of UTC")
+	return flags
+}
+
+func (l *LogonRestrictionsModule) DefaultAttrs() []string {
+	return []string{"sAMAccountName", "restrictions", "allowedLogonHours", "userWorkstations"}
+}
+
+func (l *LogonRestrictionsModule) IsReportModule() bool {
+	return true
+}
+
+func (l *LogonRestrictionsModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	if l.UTCOffset < -12 || l.UTCOffset > 14 {
+		return fmt.Errorf("invalid --utc-offset %d, expected -12 to 14", l.UTCOffset)
+	}
+	searchAttrs := append(append([]string(nil), attrs...), "sAMAccountName", "logonHours", "userWorkstations")
+	sr := session.MakeSimpleSearchRequest("(&(objectClass=user)(|(logonHours=*)(userWorkstations=*)))", searchAttrs)
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+
+	zone := "UTC"
+	if l.UTCOffset != 0 {
+		zone = fmt.Sprintf("UTC%+d", l.UTCOffset)
+	}
+	var entries []*ldap.Entry
+	for _, entry := range res.Entries {
+		var restrictions []string
+		if raw := entry.GetRawAttributeValue("logonHours"); len(raw) > 0 {
+			hours, err := adschema.ParseLogonHours(raw)
+			if err != nil {
+				session.Log.Warnf("unable to decode logonHours of %s: %s", entry.DN, err)
+			} else if allowed := hours.Allowed(); allowed < adschema.HoursPerWeek {
+				// every hour allowed is what ADUC writes when Logon Hours is opened, so it isn't a restriction
+				if allowed == 0 {
+					restrictions = append(restrictions, "logon denied at all hours")
+				} else {
+					restrictions = append(restrictions, fmt.Sprintf("logon hours (%d of %d hours a week)", allowed, adschema.HoursPerWeek))
+				}
+				var days []string
+				for _, day := range hours.Shift(l.UTCOffset).Days() {
+					days = append(days, day+" "+zone)
+				}
+				entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute("allowedLogonHours", days))
+			}
+		}
+		if workstations := entry.GetAttributeValue("userWorkstations"); workstations != "" {
+			restrictions = append(restrictions, fmt.Sprintf("workstations (%d)", len(strings.Split(workstations, ","))))
+		}
+		if len(restrictions) == 0 {
+			continue
+		}
+		entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute("restrictions", restrictions))
+		entries = append(entries, entry)
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
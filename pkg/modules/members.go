@@ -2,10 +2,13 @@ package modules
 
 import (
 	"fmt"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
 	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
 	"github.com/ropnop/go-windapsearch/pkg/utils"
 	"github.com/spf13/pflag"
 	"os"
+	"strings"
 )
 
 type MembersModule struct {
@@ -13,6 +16,9 @@ type MembersModule struct {
 	Search    string
 	DN        string
 	OnlyUsers bool
+	// primaryRIDs are the RIDs of the group (and with Recursive, the groups nested in it), whose accounts with it as
+	// their primaryGroupID aren't in member
+	primaryRIDs []string
 }
 
 func init() {
@@ -54,9 +60,18 @@ func (m *MembersModule) ChooseGroup(session *ldapsession.LDAPSession) (dn string
 func (m MembersModule) Filter() string {
 	var filter string
 	if m.Recursive {
-		filter = fmt.Sprintf("(memberof:1.2.840.113556.1.4.1941:=%s)", m.DN)
+		filter = fmt.Sprintf("(memberof:1.2.840.113556.1.4.1941:=%s)", ldap.EscapeFilter(m.DN))
 	} else {
-		filter = fmt.Sprintf("(memberOf=%s)", m.DN)
+		filter = fmt.Sprintf("(memberOf=%s)", ldap.EscapeFilter(m.DN))
+	}
+	if len(m.primaryRIDs) > 0 {
+		var sb strings.Builder
+		sb.WriteString("(|" + filter)
+		for _, rid := range m.primaryRIDs {
+			sb.WriteString(fmt.Sprintf("(primaryGroupID=%s)", rid))
+		}
+		sb.WriteString(")")
+		filter = sb.String()
 	}
 	if m.OnlyUsers {
 		filter = utils.AddAndFilter(filter, "(objectcategory=user)")
@@ -76,7 +91,93 @@ func (m *MembersModule) Run(session *ldapsession.LDAPSession, attrs []string) er
 		m.DN = dn
 		fmt.Fprintf(os.Stderr, "[+] Using group: %s\n\n", m.DN)
 	}
+	var nested []*ldap.Entry
+	if m.Recursive {
+		nested = m.nestedGroups(session)
+		reportCycles(m.DN, nested)
+	}
+	if !session.Options().IgnorePrimaryGroup {
+		m.primaryRIDs = m.groupRIDs(session, nested)
+	}
 	sr := session.MakeSimpleSearchRequest(m.Filter(), attrs)
 	return session.ExecuteSearchRequest(sr)
 
 }
+
+// nestedGroups returns the groups nested in the group, at any depth
+func (m *MembersModule) nestedGroups(session *ldapsession.LDAPSession) []*ldap.Entry {
+	filter := fmt.Sprintf("(&(objectCategory=group)(memberof:1.2.840.113556.1.4.1941:=%s))", ldap.EscapeFilter(m.DN))
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter, []string{"sAMAccountName", "memberOf", "objectSid"}))
+	if err != nil {
+		session.Log.Warnf("unable to read the groups nested in %s, circular nesting and their primary group members won't be found: %s", m.DN, err)
+		return nil
+	}
+	return res.Entries
+}
+
+// groupRIDs returns the RIDs of the group and the nested groups, to find the accounts that have one of them as their
+// primary group. Only groups of the session's domain can be a primary group there
+func (m *MembersModule) groupRIDs(session *ldapsession.LDAPSession, nested []*ldap.Entry) []string {
+	sr := ldap.NewSearchRequest(m.DN, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{"objectSid"}, nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		session.Log.Warnf("unable to read the SID of %s, accounts with it as their primary group won't be listed: %s", m.DN, err)
+		return nil
+	}
+	domainSID := session.SIDResolver().DomainSID()
+	var rids []string
+	for _, entry := range append(res.Entries, nested...) {
+		sid, _, err := secdesc.DecodeSID(entry.GetRawAttributeValue("objectSid"))
+		if err != nil {
+			continue
+		}
+		if domain, ok := sid.DomainSID(); ok && domain.String() == domainSID {
+			rids = append(rids, fmt.Sprint(sid.RID()))
+		}
+	}
+	return rids
+}
+
+// reportCycles warns about circular nesting among the group and the groups nested in it. The DC resolves the
+// nesting itself (LDAP_MATCHING_RULE_IN_CHAIN) and silently returns each member once, so cycles would otherwise go
+// unnoticed
+func reportCycles(group string, nested []*ldap.Entry) {
+	names := map[string]string{strings.ToLower(group): group}
+	parents := make(map[string][]string)
+	for _, entry := range nested {
+		dn := strings.ToLower(entry.DN)
+		names[dn] = entry.GetAttributeValue("sAMAccountName")
+		for _, parent := range entry.GetAttributeValues("memberOf") {
+			parents[dn] = append(parents[dn], strings.ToLower(parent))
+		}
+	}
+	seen := make(map[string]bool)
+	for _, entry := range nested {
+		cycle := findCycle(strings.ToLower(entry.DN), parents)
+		if cycle == nil {
+			continue
+		}
+		// each group in a cycle finds it, starting from itself
+		key := cycleKey(cycle)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		for i, dn := range cycle {
+			cycle[i] = names[dn]
+		}
+		fmt.Fprintf(os.Stderr, "[!] Circular group nesting (each is a member of the next): %s\n", strings.Join(cycle, " > "))
+	}
+}
+
+// cycleKey identifies a cycle (starting and ending with the same node) whichever node it starts from
+func cycleKey(cycle []string) string {
+	nodes := append([]string(nil), cycle[:len(cycle)-1]...)
+	first := 0
+	for i, n := range nodes {
+		if n < nodes[first] {
+			first = i
+		}
+	}
+	return strings.Join(append(nodes[first:], nodes[:first]...), "\x00")
+}
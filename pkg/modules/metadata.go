@@ -1,6 +1,10 @@
 package modules
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
 	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
 	"github.com/go-ldap/ldap/v3"
 	"github.com/spf13/pflag"
@@ -10,6 +14,9 @@ type FunctionalityModule struct{}
 
 func init() {
 	AllModules = append(AllModules, new(FunctionalityModule))
+	adschema.RegisterAttribute("schemaVersion", "String(Unicode)", true)
+	adschema.RegisterAttribute("exchangeSchemaVersion", "String(Unicode)", true)
+	adschema.RegisterAttribute("behaviorVersions", "String(Unicode)", false)
 }
 
 func (FunctionalityModule) Name() string {
@@ -31,9 +38,16 @@ func (FunctionalityModule) DefaultAttrs() []string {
 		"forestFunctionality",
 		"domainControllerFunctionality",
 		"dnsHostName",
+		"schemaVersion",
+		"exchangeSchemaVersion",
+		"behaviorVersions",
 	}
 }
 
+func (FunctionalityModule) IsReportModule() bool {
+	return true
+}
+
 func (FunctionalityModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
 	sr := ldap.NewSearchRequest(
 		"",
@@ -48,6 +62,70 @@ func (FunctionalityModule) Run(session *ldapsession.LDAPSession, attrs []string)
 	if err != nil {
 		return err
 	}
+	if len(res.Entries) > 0 {
+		addVersions(session, res.Entries[0], attrs)
+	}
 	session.ManualWriteSearchResultsToChan(res)
 	return nil
 }
+
+// addVersions adds the versions that aren't in the rootDSE to it, named after the product that set them: the schema
+// version, the Exchange schema version if Exchange was ever installed, and the functional level of the forest and
+// each of its domains. They're read from the Schema and Configuration partitions, so they're left out when those
+// can't be read (e.g. without credentials)
+func addVersions(session *ldapsession.LDAPSession, rootDSE *ldap.Entry, attrs []string) {
+	wanted := func(name string) bool {
+		for _, a := range attrs {
+			if a == "*" || strings.EqualFold(a, name) {
+				return true
+			}
+		}
+		return false
+	}
+	add := func(name string, values ...string) {
+		rootDSE.Attributes = append(rootDSE.Attributes, ldap.NewEntryAttribute(name, values))
+	}
+	read := func(dn, attr string) string {
+		sr := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", []string{attr}, nil)
+		res, err := session.GetSearchResults(sr)
+		if err != nil || len(res.Entries) == 0 {
+			session.Log.Infof("unable to read %s of %s: %v", attr, dn, err)
+			return ""
+		}
+		return res.Entries[0].GetAttributeValue(attr)
+	}
+	schema, config := session.NamingContexts.Schema, session.NamingContexts.Configuration
+
+	if wanted("schemaVersion") && schema != "" {
+		if v := read(schema, "objectVersion"); v != "" {
+			add("schemaVersion", adschema.SchemaVersionName(v))
+		}
+	}
+	if wanted("exchangeSchemaVersion") && schema != "" {
+		if v := read("CN=ms-Exch-Schema-Version-Pt,"+schema, "rangeUpper"); v != "" {
+			add("exchangeSchemaVersion", adschema.ExchangeSchemaVersionName(v))
+		}
+	}
+	if wanted("behaviorVersions") && config != "" {
+		partitions := "CN=Partitions," + config
+		var levels []string
+		if v := read(partitions, "msDS-Behavior-Version"); v != "" {
+			levels = append(levels, fmt.Sprintf("forest: %s", adschema.BehaviorVersionName(v, "forest")))
+		}
+		sr := ldap.NewSearchRequest(partitions, ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
+			"(&(objectClass=crossRef)(systemFlags:1.2.840.113556.1.4.803:=2))", // FLAG_CR_NTDS_DOMAIN
+			[]string{"dnsRoot", "msDS-Behavior-Version"}, nil)
+		if res, err := session.GetSearchResults(sr); err != nil {
+			session.Log.Infof("unable to read the domains' functional levels: %s", err)
+		} else {
+			for _, entry := range res.Entries {
+				if v := entry.GetAttributeValue("msDS-Behavior-Version"); v != "" {
+					levels = append(levels, fmt.Sprintf("%s: %s", entry.GetAttributeValue("dnsRoot"), adschema.BehaviorVersionName(v, "domain")))
+				}
+			}
+		}
+		if len(levels) > 0 {
+			add("behaviorVersions", levels...)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package modules
 
 import (
+	"reflect"
+
 	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
 	"github.com/spf13/pflag"
 )
@@ -13,4 +15,43 @@ type Module interface {
 	Run(session *ldapsession.LDAPSession, attrs []string) error
 }
 
+// PartitionModule is implemented by modules that need to search a naming context other than the default domain
+// partition (e.g. the Configuration or Schema partitions). The session's BaseDN is set to the partition before Run
+type PartitionModule interface {
+	Module
+	Partition() ldapsession.Partition
+}
+
+// WriteModule is implemented by modules that change the directory. They only run when writes are enabled with --write,
+// and only preview their changes unless --confirm is given too
+type WriteModule interface {
+	Module
+	IsWriteModule() bool
+}
+
+// IsWrite reports whether a module changes the directory, and so needs --write (and --confirm to make its changes)
+func IsWrite(mod Module) bool {
+	w, ok := mod.(WriteModule)
+	return ok && w.IsWriteModule()
+}
+
+// ReportModule is implemented by modules that build their own result entries (e.g. probe results) rather than
+// returning directory objects, so attribute profiles don't apply to them
+type ReportModule interface {
+	Module
+	IsReportModule() bool
+}
+
 var AllModules []Module
+
+// Copy returns a new instance of a module with the same flag values, for running it on several domains at the same
+// time. The fields a module keeps while running are only shared until a run sets them
+func Copy(mod Module) Module {
+	v := reflect.ValueOf(mod)
+	if v.Kind() != reflect.Ptr {
+		return mod
+	}
+	c := reflect.New(v.Elem().Type())
+	c.Elem().Set(v.Elem())
+	return c.Interface().(Module)
+}
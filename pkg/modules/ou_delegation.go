@@ -0,0 +1,180 @@
+package modules
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type OUDelegationModule struct {
+	Inherited bool
+	All       bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(OUDelegationModule))
+	adschema.RegisterAttribute("principal", "String(Unicode)", true)
+}
+
+// ouControlRights are the rights on an OU that give control of it or what's in it: creating objects (e.g. users
+// that are then owned), writing its properties (e.g. gPLink), or rewriting the DACL or owner. Full control is
+// GenericAll, which is checked separately since it includes read rights every ACE has
+const ouControlRights = secdesc.RightCreateChild | secdesc.RightWriteProperty | secdesc.RightWriteDACL | secdesc.RightWriteOwner
+
+// ouControl is true if an access mask has any of the ouControlRights, or all of GenericAll
+func ouControl(mask uint32) bool {
+	return mask&ouControlRights != 0 || mask&secdesc.RightGenericAll == secdesc.RightGenericAll
+}
+
+// defaultOUPrincipals are the SIDs an OU's DACL grants these rights to out of the box
+var defaultOUPrincipals = map[string]bool{
+	"S-1-3-0":      true, // Creator Owner
+	"S-1-5-9":      true, // Enterprise Domain Controllers
+	"S-1-5-10":     true, // Self
+	"S-1-5-18":     true, // Local System
+	"S-1-5-32-544": true, // Administrators
+	"S-1-5-32-548": true, // Account Operators
+	"S-1-5-32-550": true, // Print Operators
+}
+
+// defaultOURIDs are the domain groups an OU's DACL grants these rights to out of the box
+var defaultOURIDs = map[uint32]bool{
+	512: true, // Domain Admins
+	518: true, // Schema Admins
+	519: true, // Enterprise Admins
+	526: true, // Key Admins
+	527: true, // Enterprise Key Admins
+}
+
+func (o *OUDelegationModule) Name() string {
+	return "ou-delegation"
+}
+
+func (o *OUDelegationModule) Description() string {
+	return "Audit OU DACLs for non-default principals with CreateChild, WriteProperty, WriteDACL, WriteOwner or GenericAll rights"
+}
+
+func (o *OUDelegationModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(o.Name(), pflag.ExitOnError)
+	flags.BoolVar(&o.Inherited, "inherited", false, "Also report ACEs inherited from a parent OU (by default they're only reported on the OU they're set on)")
+	flags.BoolVar(&o.All, "all", false, "Also report the principals that have these rights by default (admins, Account Operators, ...)")
+	return flags
+}
+
+func (o *OUDelegationModule) DefaultAttrs() []string {
+	return []string{"principal", "aces"}
+}
+
+func (o *OUDelegationModule) IsReportModule() bool {
+	return true
+}
+
+func (o *OUDelegationModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	sr := session.MakeSimpleSearchRequest("(objectCategory=organizationalUnit)", []string{"nTSecurityDescriptor"})
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+
+	type grant struct {
+		dn, sid string
+		aces    []string
+	}
+	var grants []*grant
+	var sids []string
+	for _, ou := range res.Entries {
+		raw := ou.GetRawAttributeValue("nTSecurityDescriptor")
+		if len(raw) == 0 {
+			session.Log.Warnf("no nTSecurityDescriptor returned for %s", ou.DN)
+			continue
+		}
+		sd, err := secdesc.Parse(raw)
+		if err != nil || sd.DACL == nil {
+			session.Log.Warnf("unable to parse the security descriptor of %s: %v", ou.DN, err)
+			continue
+		}
+		bySID := make(map[string]*grant)
+		for _, ace := range sd.DACL.ACEs {
+			if ace.Type != secdesc.AccessAllowedACEType && ace.Type != secdesc.AccessAllowedObjectACEType {
+				continue
+			}
+			if !ouControl(ace.Mask) || (!o.Inherited && ace.Flags&secdesc.InheritedACE != 0) {
+				continue
+			}
+			sid := ace.SID.String()
+			if !o.All && isDefaultOUPrincipal(sid) {
+				continue
+			}
+			g, ok := bySID[sid]
+			if !ok {
+				g = &grant{dn: ou.DN, sid: sid}
+				bySID[sid] = g
+				grants = append(grants, g)
+				sids = append(sids, sid)
+			}
+			g.aces = append(g.aces, describeScope(ace))
+		}
+	}
+
+	// parents before their children, so each subtree's delegations are together
+	sort.SliceStable(grants, func(i, j int) bool { return subtreeKey(grants[i].dn) < subtreeKey(grants[j].dn) })
+	names := session.SIDResolver().Resolve(sids)
+	var entries []*ldap.Entry
+	for _, g := range grants {
+		principal := g.sid
+		if name := names[g.sid]; name != "" && name != g.sid {
+			principal = fmt.Sprintf("%s (%s)", g.sid, name)
+		}
+		entries = append(entries, ldap.NewEntry(g.dn, map[string][]string{
+			"principal": {principal},
+			"aces":      g.aces,
+		}))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// isDefaultOUPrincipal is true for the SIDs that have control of OUs by default
+func isDefaultOUPrincipal(s string) bool {
+	if defaultOUPrincipals[s] {
+		return true
+	}
+	sid, err := secdesc.ParseSID(s)
+	if err != nil {
+		return false
+	}
+	_, inDomain := sid.DomainSID()
+	return inDomain && defaultOURIDs[sid.RID()]
+}
+
+// describeScope describes an ACE along with where it applies: the OU, the objects in it, or only those below it
+func describeScope(ace secdesc.ACE) string {
+	var scope string
+	switch {
+	case ace.Flags&secdesc.InheritOnlyACE != 0:
+		scope = "descendants only"
+	case ace.Flags&secdesc.ContainerInheritACE != 0:
+		scope = "this OU and descendants"
+	default:
+		scope = "this OU only"
+	}
+	if ace.Flags&secdesc.InheritedACE != 0 {
+		scope += ", inherited"
+	}
+	return fmt.Sprintf("%s [%s]", ace.Describe(), scope)
+}
+
+// subtreeKey orders DNs so a parent comes right before the objects under it: the RDNs from the root down, lower case
+func subtreeKey(dn string) string {
+	rdns := strings.Split(strings.ToLower(dn), ",")
+	for i, j := 0, len(rdns)-1; i < j; i, j = i+1, j-1 {
+		rdns[i], rdns[j] = rdns[j], rdns[i]
+	}
+	return strings.Join(rdns, "\x00")
+}
@@ -0,0 +1,216 @@
+package modules
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	uac "github.com/audibleblink/msldapuac"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type PasswordAgeModule struct {
+	All             bool
+	Top             int
+	IncludeDisabled bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(PasswordAgeModule))
+	adschema.RegisterAttribute("rank", "Enumeration", true)
+	adschema.RegisterAttribute("passwordAge", "String(Unicode)", true)
+	adschema.RegisterAttribute("category", "String(Unicode)", false)
+	adschema.RegisterAttribute("findings", "String(Unicode)", false)
+}
+
+// Kinds of account whose password age is audited
+const (
+	categoryPrivileged = "privileged"
+	categoryService    = "service"
+	categoryKrbtgt     = "krbtgt"
+)
+
+// privilegedWeight is how much more a privileged account's password age counts when ranking: an old Domain Admin
+// password is worth rotating before an equally old service account's
+const privilegedWeight = 2
+
+var passwordAgeAttrs = []string{"sAMAccountName", "pwdLastSet", "userAccountControl", "adminCount", "servicePrincipalName", "msDS-ResultantPSO"}
+
+func (p *PasswordAgeModule) Name() string {
+	return "password-age"
+}
+
+func (p *PasswordAgeModule) Description() string {
+	return "Rank privileged and service accounts by password age, against maxPwdAge and the krbtgt password"
+}
+
+func (p *PasswordAgeModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(p.Name(), pflag.ExitOnError)
+	flags.BoolVar(&p.All, "all", false, "List every privileged and service account, not only those with findings")
+	flags.IntVar(&p.Top, "top", 0, "Only list the first N accounts of the ranking (0 for all)")
+	flags.BoolVar(&p.IncludeDisabled, "include-disabled", false, "Include disabled accounts")
+	return flags
+}
+
+func (p *PasswordAgeModule) DefaultAttrs() []string {
+	return []string{"sAMAccountName", "rank", "passwordAge", "pwdLastSet", "category", "findings"}
+}
+
+func (p *PasswordAgeModule) IsReportModule() bool {
+	return true
+}
+
+// passwordAccount is an account with the age of its password and what's wrong with it
+type passwordAccount struct {
+	entry      *ldap.Entry
+	categories []string
+	findings   []string
+	age        time.Duration
+	score      float64
+}
+
+func (p *PasswordAgeModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	maxAge, psoAges := readMaxPasswordAges(session)
+
+	// krbtgt is disabled, so it's looked up on its own
+	filter := fmt.Sprintf("(|(&(objectCategory=person)(objectClass=user)(|(adminCount=1)(servicePrincipalName=*))%s)(sAMAccountName=krbtgt))",
+		p.disabledFilter())
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter, passwordAgeAttrs))
+	if err != nil {
+		return err
+	}
+
+	var krbtgtSet time.Time
+	for _, entry := range res.Entries {
+		if strings.EqualFold(entry.GetAttributeValue("sAMAccountName"), "krbtgt") {
+			krbtgtSet, _ = pwdLastSet(entry)
+		}
+	}
+
+	now := session.ServerTime()
+	var accounts []*passwordAccount
+	for _, entry := range res.Entries {
+		set, ok := pwdLastSet(entry)
+		if !ok {
+			session.Log.Infof("%s has no password set (or must change it at next logon), skipping", entry.DN)
+			continue
+		}
+		a := &passwordAccount{entry: entry, age: now.Sub(set)}
+		krbtgt := strings.EqualFold(entry.GetAttributeValue("sAMAccountName"), "krbtgt")
+		switch {
+		case krbtgt:
+			a.categories = []string{categoryKrbtgt}
+		default:
+			// adminCount is set on every account SDProp protects, i.e. members of the protected groups
+			if entry.GetAttributeValue("adminCount") == "1" {
+				a.categories = append(a.categories, categoryPrivileged)
+			}
+			if len(entry.GetAttributeValues("servicePrincipalName")) > 0 {
+				a.categories = append(a.categories, categoryService)
+			}
+		}
+
+		limit := maxAge
+		if pso := strings.ToLower(entry.GetAttributeValue("msDS-ResultantPSO")); pso != "" {
+			if age, ok := psoAges[pso]; ok {
+				limit = age
+			}
+		}
+		if limit > 0 && a.age > limit {
+			a.findings = append(a.findings, fmt.Sprintf("older than the maximum password age (%s)", formatDays(limit)))
+		}
+		flags, _ := strconv.Atoi(entry.GetAttributeValue("userAccountControl"))
+		if flags&uac.DontExpirePassword != 0 && !krbtgt {
+			a.findings = append(a.findings, "password never expires")
+		}
+		if !krbtgt && !krbtgtSet.IsZero() && set.Before(krbtgtSet) {
+			a.findings = append(a.findings, fmt.Sprintf("set before the krbtgt password (%s)", krbtgtSet.Format("2006-01-02")))
+		}
+		if !p.All && len(a.findings) == 0 {
+			continue
+		}
+
+		a.score = a.age.Hours()
+		if krbtgt || a.categories[0] == categoryPrivileged {
+			a.score *= privilegedWeight
+		}
+		accounts = append(accounts, a)
+	}
+
+	sort.SliceStable(accounts, func(i, j int) bool { return accounts[i].score > accounts[j].score })
+	if p.Top > 0 && len(accounts) > p.Top {
+		accounts = accounts[:p.Top]
+	}
+	var entries []*ldap.Entry
+	for i, a := range accounts {
+		entries = append(entries, ldap.NewEntry(a.entry.DN, map[string][]string{
+			"sAMAccountName": {a.entry.GetAttributeValue("sAMAccountName")},
+			"rank":           {strconv.Itoa(i + 1)},
+			"passwordAge":    {formatDays(a.age)},
+			"pwdLastSet":     {a.entry.GetAttributeValue("pwdLastSet")},
+			"category":       a.categories,
+			"findings":       a.findings,
+		}))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+func (p *PasswordAgeModule) disabledFilter() string {
+	if p.IncludeDisabled {
+		return ""
+	}
+	return fmt.Sprintf("(!(userAccountControl:1.2.840.113556.1.4.803:=%d))", uac.Accountdisable)
+}
+
+// readMaxPasswordAges reads the domain's maxPwdAge, and that of each fine-grained password policy keyed by lower case
+// DN, if they're readable (normally they are only readable by admins). A duration of 0 means passwords don't expire
+func readMaxPasswordAges(session *ldapsession.LDAPSession) (time.Duration, map[string]time.Duration) {
+	var maxAge time.Duration
+	sr := ldap.NewSearchRequest(session.NamingContexts.Default, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"maxPwdAge"}, nil)
+	if res, err := session.GetSearchResults(sr); err != nil || len(res.Entries) == 0 {
+		session.Log.Warnf("unable to read the domain maxPwdAge: %v", err)
+	} else {
+		maxAge = intervalDuration(res.Entries[0].GetAttributeValue("maxPwdAge"))
+	}
+
+	psoAges := make(map[string]time.Duration)
+	sr = ldap.NewSearchRequest("CN=Password Settings Container,CN=System,"+session.NamingContexts.Default,
+		ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=msDS-PasswordSettings)",
+		[]string{"msDS-MaximumPasswordAge"}, nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		session.Log.Infof("unable to read fine-grained password policies: %s", err)
+		return maxAge, psoAges
+	}
+	for _, pso := range res.Entries {
+		psoAges[strings.ToLower(pso.DN)] = intervalDuration(pso.GetAttributeValue("msDS-MaximumPasswordAge"))
+	}
+	return maxAge, psoAges
+}
+
+// pwdLastSet is when the account's password was last set. It's false when it never was, or the account has to change
+// it at next logon (pwdLastSet is 0)
+func pwdLastSet(entry *ldap.Entry) (time.Time, bool) {
+	v := entry.GetAttributeValue("pwdLastSet")
+	if v == "" || v == "0" {
+		return time.Time{}, false
+	}
+	t, err := adschema.NTFileTimeToTimestamp(v)
+	return t, err == nil
+}
+
+// formatDays formats a duration in whole days
+func formatDays(d time.Duration) string {
+	days := int(d.Hours() / 24)
+	if days == 1 {
+		return "1 day"
+	}
+	return fmt.Sprintf("%d days", days)
+}
@@ -0,0 +1,242 @@
+package modules
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type ProfileModule struct {
+	Objects    string
+	Filter     string
+	Sample     int
+	Attributes []string
+	Top        int
+}
+
+func init() {
+	AllModules = append(AllModules, new(ProfileModule))
+	adschema.RegisterAttribute("attribute", "String(Unicode)", true)
+	adschema.RegisterAttribute("filled", "String(Unicode)", true)
+	adschema.RegisterAttribute("distinct", "Enumeration", true)
+	adschema.RegisterAttribute("topValues", "String(Unicode)", false)
+	adschema.RegisterAttribute("anomalies", "String(Unicode)", false)
+}
+
+// profileObjectFilters are the object sets --objects can pick
+var profileObjectFilters = map[string]string{
+	"users":     "(&(objectCategory=person)(objectClass=user))",
+	"computers": "(objectCategory=computer)",
+	"groups":    "(objectCategory=group)",
+	"all":       "(objectClass=*)",
+}
+
+// profileUniqueAttrs are attributes every object should have its own value of, so values shared by several objects
+// are anomalies (copied accounts, HR sync mistakes)
+var profileUniqueAttrs = map[string]bool{"employeeid": true, "employeenumber": true, "mail": true, "userprincipalname": true}
+
+// profileSparse is the fill rate below which an attribute is called out as rarely set
+const profileSparse = 0.05
+
+func (p *ProfileModule) Name() string {
+	return "profile"
+}
+
+func (p *ProfileModule) Description() string {
+	return "Profile the attributes of users (or other objects): how many have each one set, distinct and most common values, and anomalies"
+}
+
+func (p *ProfileModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(p.Name(), pflag.ExitOnError)
+	flags.StringVar(&p.Objects, "objects", "users", "Objects to profile: users, computers, groups, or all")
+	flags.StringVar(&p.Filter, "filter", "", "Extra LDAP syntax filter for the objects to profile")
+	flags.IntVar(&p.Sample, "sample", 0, "Only profile the first N objects (0 profiles every one)")
+	flags.StringSliceVar(&p.Attributes, "profile-attrs", nil, "Comma separated attributes to profile (default: every attribute the objects have)")
+	flags.IntVar(&p.Top, "top", 3, "Number of most common values to list for each attribute")
+	return flags
+}
+
+func (p *ProfileModule) DefaultAttrs() []string {
+	return []string{"attribute", "filled", "distinct", "topValues", "anomalies"}
+}
+
+func (p *ProfileModule) IsReportModule() bool {
+	return true
+}
+
+// attrProfile is what's known about one attribute across the objects
+type attrProfile struct {
+	name   string
+	filled int
+	binary bool
+	// counts are how many objects have each value
+	counts map[string]int
+	// spaced are values with leading or trailing whitespace
+	spaced int
+}
+
+func (p *ProfileModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	objects, ok := profileObjectFilters[strings.ToLower(p.Objects)]
+	if !ok {
+		return fmt.Errorf("invalid --objects %q (users, computers, groups, or all)", p.Objects)
+	}
+	if p.Sample < 0 || p.Top < 0 {
+		return fmt.Errorf("--sample and --top can't be negative")
+	}
+	filter := objects
+	if p.Filter != "" {
+		filter = fmt.Sprintf("(&%s%s)", objects, p.Filter)
+	}
+	searchAttrs := p.Attributes
+	if len(searchAttrs) == 0 {
+		searchAttrs = []string{"*"}
+	}
+	sr := session.MakeSimpleSearchRequest(filter, searchAttrs)
+	var res *ldap.SearchResult
+	var err error
+	if p.Sample > 0 {
+		res, err = session.GetSampledSearchResults(sr, p.Sample)
+	} else {
+		res, err = session.GetPagedSearchResults(sr)
+	}
+	if err != nil {
+		return err
+	}
+	total := len(res.Entries)
+	fmt.Fprintf(os.Stderr, "[+] Profiling the attributes of %d %s\n", total, strings.ToLower(p.Objects))
+
+	profiles := make(map[string]*attrProfile)
+	// attributes asked for by name are profiled even if no object has them, which is itself worth knowing
+	for _, name := range p.Attributes {
+		profiles[strings.ToLower(name)] = &attrProfile{name: name, counts: make(map[string]int)}
+	}
+	for _, entry := range res.Entries {
+		for _, attr := range entry.Attributes {
+			if len(attr.Values) == 0 {
+				continue
+			}
+			a := profiles[strings.ToLower(attr.Name)]
+			if a == nil {
+				a = &attrProfile{name: attr.Name, counts: make(map[string]int)}
+				profiles[strings.ToLower(attr.Name)] = a
+			}
+			a.filled++
+			for _, v := range attr.Values {
+				if !utf8.ValidString(v) {
+					a.binary = true
+				} else if strings.TrimSpace(v) != v {
+					a.spaced++
+				}
+				a.counts[v]++
+			}
+		}
+	}
+
+	var sorted []*attrProfile
+	for _, a := range profiles {
+		sorted = append(sorted, a)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].filled != sorted[j].filled {
+			return sorted[i].filled > sorted[j].filled
+		}
+		return strings.ToLower(sorted[i].name) < strings.ToLower(sorted[j].name)
+	})
+	var entries []*ldap.Entry
+	for _, a := range sorted {
+		entries = append(entries, p.profileEntry(a, total))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// profileEntry makes the result for one attribute
+func (p *ProfileModule) profileEntry(a *attrProfile, total int) *ldap.Entry {
+	rate := 0.0
+	if total > 0 {
+		rate = float64(a.filled) / float64(total)
+	}
+	values := map[string][]string{
+		"attribute": {a.name},
+		"filled":    {fmt.Sprintf("%d of %d (%.1f%%)", a.filled, total, rate*100)},
+		"distinct":  {strconv.Itoa(len(a.counts))},
+	}
+	var anomalies []string
+	switch {
+	case a.filled == 0:
+		anomalies = append(anomalies, "not set on any object")
+	case rate < profileSparse:
+		anomalies = append(anomalies, fmt.Sprintf("rarely set (%d objects)", a.filled))
+	}
+	if a.binary {
+		// binary values can't be shown, and matching them up as spellings means nothing
+		if len(anomalies) > 0 {
+			values["anomalies"] = anomalies
+		}
+		return ldap.NewEntry("", values)
+	}
+
+	type valueCount struct {
+		value string
+		count int
+	}
+	var common []valueCount
+	shared := 0
+	for v, n := range a.counts {
+		common = append(common, valueCount{v, n})
+		if n > 1 {
+			shared++
+		}
+	}
+	sort.Slice(common, func(i, j int) bool {
+		if common[i].count != common[j].count {
+			return common[i].count > common[j].count
+		}
+		return common[i].value < common[j].value
+	})
+	// values every object has its own of (GUIDs, SIDs, names) have no common values to show
+	if shared > 0 {
+		for i := 0; i < len(common) && i < p.Top && common[i].count > 1; i++ {
+			values["topValues"] = append(values["topValues"], fmt.Sprintf("%s (%d)", common[i].value, common[i].count))
+		}
+	}
+
+	if profileUniqueAttrs[strings.ToLower(a.name)] && shared > 0 {
+		anomalies = append(anomalies, fmt.Sprintf("%d values shared by more than one object, e.g. %q", shared, common[0].value))
+	}
+	if a.spaced > 0 {
+		anomalies = append(anomalies, fmt.Sprintf("%d values with leading or trailing whitespace", a.spaced))
+	}
+	// values that only differ in case or spacing are usually the same thing typed differently (e.g. departments)
+	spellings := make(map[string][]string)
+	for _, c := range common {
+		key := strings.ToLower(strings.Join(strings.Fields(c.value), " "))
+		spellings[key] = append(spellings[key], c.value)
+	}
+	var inconsistent []string
+	for _, s := range spellings {
+		if len(s) > 1 {
+			inconsistent = append(inconsistent, strings.Join(s, " / "))
+		}
+	}
+	sort.Strings(inconsistent)
+	for i, s := range inconsistent {
+		if i == p.Top {
+			anomalies = append(anomalies, fmt.Sprintf("... and %d more values spelled more than one way", len(inconsistent)-i))
+			break
+		}
+		anomalies = append(anomalies, "spelled more than one way: "+s)
+	}
+	if len(anomalies) > 0 {
+		values["anomalies"] = anomalies
+	}
+	return ldap.NewEntry("", values)
+}
@@ -0,0 +1,71 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ProfileNames are the attribute profiles that can be picked with --profile, smallest first
+var ProfileNames = []string{"minimal", "standard", "full", "bloodhound"}
+
+// profiles are the attributes each profile adds to a module's defaults ("minimal" replaces them). Attributes an
+// object doesn't have just aren't returned, so one list covers users, groups and computers alike
+var profiles = map[string][]string{
+	"minimal": {"cn", "sAMAccountName", "objectSid"},
+	"full": {
+		"cn", "name", "displayName", "description", "sAMAccountName", "userPrincipalName", "objectClass", "objectSid",
+		"objectGUID", "whenCreated", "whenChanged", "memberOf", "member", "primaryGroupID", "managedBy",
+		"userAccountControl", "adminCount", "pwdLastSet", "lastLogonTimestamp", "logonCount", "badPwdCount",
+		"accountExpires", "servicePrincipalName", "mail", "title", "department", "manager", "dNSHostName",
+		"operatingSystem", "operatingSystemVersion", "operatingSystemServicePack", "msDS-AllowedToDelegateTo",
+		"msDS-SupportedEncryptionTypes", "gPLink", "gPCFileSysPath",
+	},
+	// what the BloodHound collectors read, including the DACL (read with the SD flags control)
+	"bloodhound": {
+		"name", "displayName", "description", "sAMAccountName", "sAMAccountType", "userPrincipalName", "objectClass",
+		"objectSid", "objectGUID", "sIDHistory", "whenCreated", "primaryGroupID", "member", "userAccountControl",
+		"adminCount", "pwdLastSet", "lastLogon", "lastLogonTimestamp", "servicePrincipalName", "mail", "title",
+		"homeDirectory", "scriptPath", "userPassword", "unixUserPassword", "dNSHostName", "operatingSystem",
+		"operatingSystemServicePack", "msDS-AllowedToDelegateTo", "msDS-AllowedToActOnBehalfOfOtherIdentity",
+		"msDS-GroupMSAMembership", "ms-Mcs-AdmPwdExpirationTime", "gPLink", "gPOptions", "gPCFileSysPath",
+		"trustAttributes", "trustDirection", "securityIdentifier", "nTSecurityDescriptor",
+	},
+}
+
+// ParseProfile validates a profile name from the command line
+func ParseProfile(s string) (string, error) {
+	for _, name := range ProfileNames {
+		if strings.EqualFold(s, name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown profile %q (must be one of %s)", s, strings.Join(ProfileNames, ", "))
+}
+
+// ProfileAttrs returns the attributes a module should request under a profile. "standard" is the module's defaults.
+// Modules that build their own results rather than returning directory objects always get their defaults
+func ProfileAttrs(mod Module, profile string) []string {
+	if IsWrite(mod) {
+		return mod.DefaultAttrs()
+	}
+	if _, ok := mod.(ReportModule); ok {
+		return mod.DefaultAttrs()
+	}
+	switch profile {
+	case "standard", "":
+		return mod.DefaultAttrs()
+	case "minimal":
+		return profiles[profile]
+	}
+	attrs := mod.DefaultAttrs()
+	seen := make(map[string]bool)
+	for _, a := range attrs {
+		seen[strings.ToLower(a)] = true
+	}
+	for _, a := range profiles[profile] {
+		if !seen[strings.ToLower(a)] {
+			attrs = append(attrs, a)
+		}
+	}
+	return attrs
+}
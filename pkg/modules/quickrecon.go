@@ -0,0 +1,227 @@
+package modules
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	uac "github.com/audibleblink/msldapuac"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type QuickReconModule struct{}
+
+func init() {
+	AllModules = append(AllModules, new(QuickReconModule))
+}
+
+// reconGroupRIDs are the privileged domain groups quick recon lists the members of, reconBuiltinGroups the builtin
+// ones. They're found by SID, so they're the same in every language
+var (
+	reconGroupRIDs     = []uint32{512, 519, 518}
+	reconBuiltinGroups = []string{"S-1-5-32-544", "S-1-5-32-548", "S-1-5-32-549", "S-1-5-32-551"}
+)
+
+// lapsPasswordAttrs are the attributes legacy and Windows LAPS keep passwords in
+var lapsPasswordAttrs = []string{"ms-Mcs-AdmPwd", "msLAPS-Password", "msLAPS-EncryptedPassword"}
+
+func (q *QuickReconModule) Name() string {
+	return "quickrecon"
+}
+
+func (q *QuickReconModule) Description() string {
+	return "Quick, quiet recon: DCs, password policy, privileged groups, kerberoastable and AS-REP roastable users, MAQ, readable LAPS passwords"
+}
+
+func (q *QuickReconModule) FlagSet() *pflag.FlagSet {
+	return pflag.NewFlagSet(q.Name(), pflag.ExitOnError)
+}
+
+func (q *QuickReconModule) DefaultAttrs() []string {
+	return []string{"check", "finding", "objects"}
+}
+
+func (q *QuickReconModule) IsReportModule() bool {
+	return true
+}
+
+// reconStep is one part of the quick recon, adding its entries
+type reconStep struct {
+	name string
+	run  func(session *ldapsession.LDAPSession) ([]*ldap.Entry, error)
+}
+
+func (q *QuickReconModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	start := time.Now()
+	// every step is a handful of indexed searches, with no lookups per object, to stay quick and look like normal
+	// LDAP traffic
+	steps := []reconStep{
+		{"dcs", reconDCs},
+		{"policy", reconPolicy},
+		{"privileged", reconPrivileged},
+		{"kerberoastable", reconRoastable("kerberoastable", "enabled users with an SPN",
+			fmt.Sprintf("(&(objectCategory=person)(objectClass=user)(servicePrincipalName=*)(!(sAMAccountName=krbtgt))(!(userAccountControl:1.2.840.113556.1.4.803:=%d)))", uac.Accountdisable))},
+		{"asreproast", reconRoastable("asreproast", "enabled users without Kerberos pre-authentication",
+			fmt.Sprintf("(&(objectCategory=person)(objectClass=user)(userAccountControl:1.2.840.113556.1.4.803:=%d)(!(userAccountControl:1.2.840.113556.1.4.803:=%d)))", uac.DontReqPreauth, uac.Accountdisable))},
+		{"laps", reconLAPS},
+	}
+	var entries []*ldap.Entry
+	for _, step := range steps {
+		found, err := step.run(session)
+		if err != nil {
+			session.Log.Warnf("%s failed: %s", step.name, err)
+			continue
+		}
+		entries = append(entries, found...)
+	}
+	fmt.Fprintf(os.Stderr, "[+] Quick recon finished in %s\n", time.Since(start).Round(100*time.Millisecond))
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// reconEntry makes an entry for a recon result
+func reconEntry(check, finding string, objects []string) *ldap.Entry {
+	values := map[string][]string{"check": {check}, "finding": {finding}}
+	if len(objects) > 0 {
+		values["objects"] = objects
+	}
+	return ldap.NewEntry("", values)
+}
+
+func reconDCs(session *ldapsession.LDAPSession) ([]*ldap.Entry, error) {
+	filter := fmt.Sprintf("(userAccountControl:1.2.840.113556.1.4.803:=%d)", uac.ServerTrustAccount)
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter, []string{"dNSHostName", "sAMAccountName", "operatingSystem", "userAccountControl"}))
+	if err != nil {
+		return nil, err
+	}
+	var dcs []string
+	for _, entry := range res.Entries {
+		name := entry.GetAttributeValue("dNSHostName")
+		if name == "" {
+			name = strings.TrimSuffix(entry.GetAttributeValue("sAMAccountName"), "$")
+		}
+		var details []string
+		if system := entry.GetAttributeValue("operatingSystem"); system != "" {
+			details = append(details, system)
+		}
+		// RODCs are also server trust accounts, with only some secrets
+		if flags, _ := strconv.Atoi(entry.GetAttributeValue("userAccountControl")); flags&uac.PartialSecretsAccount != 0 {
+			details = append(details, "RODC")
+		}
+		if len(details) > 0 {
+			name += " (" + strings.Join(details, ", ") + ")"
+		}
+		dcs = append(dcs, name)
+	}
+	sort.Strings(dcs)
+	return []*ldap.Entry{reconEntry("dcs", fmt.Sprintf("%d domain controllers", len(dcs)), dcs)}, nil
+}
+
+func reconPolicy(session *ldapsession.LDAPSession) ([]*ldap.Entry, error) {
+	domain, err := readDomainObject(session, []string{"minPwdLength", "pwdProperties", "maxPwdAge", "lockoutThreshold",
+		"lockOutObservationWindow", "lockoutDuration", "ms-DS-MachineAccountQuota"})
+	if err != nil {
+		return nil, err
+	}
+	policy := []string{fmt.Sprintf("minimum length %s", domain.GetAttributeValue("minPwdLength"))}
+	if properties, _ := strconv.Atoi(domain.GetAttributeValue("pwdProperties")); properties&0x1 != 0 {
+		policy = append(policy, "complexity required")
+	}
+	if maxAge := intervalDuration(domain.GetAttributeValue("maxPwdAge")); maxAge > 0 {
+		policy = append(policy, "expires after "+formatDays(maxAge))
+	}
+	threshold := domain.GetAttributeValue("lockoutThreshold")
+	if threshold == "" || threshold == "0" {
+		policy = append(policy, "no lockout")
+	} else {
+		policy = append(policy, fmt.Sprintf("locked out after %s bad passwords in %.0f minutes, for %.0f minutes", threshold,
+			intervalDuration(domain.GetAttributeValue("lockOutObservationWindow")).Minutes(),
+			intervalDuration(domain.GetAttributeValue("lockoutDuration")).Minutes()))
+	}
+	entries := []*ldap.Entry{reconEntry("policy", "password policy: "+strings.Join(policy, ", "), nil)}
+	if quota := domain.GetAttributeValue("ms-DS-MachineAccountQuota"); quota != "" {
+		entries = append(entries, reconEntry("maq", fmt.Sprintf("any user can join %s computers (ms-DS-MachineAccountQuota)", quota), nil))
+	}
+	return entries, nil
+}
+
+func reconPrivileged(session *ldapsession.LDAPSession) ([]*ldap.Entry, error) {
+	sids := append([]string(nil), reconBuiltinGroups...)
+	if domainSID := session.SIDResolver().DomainSID(); domainSID != "" {
+		for _, rid := range reconGroupRIDs {
+			sids = append(sids, fmt.Sprintf("%s-%d", domainSID, rid))
+		}
+	}
+	var filter strings.Builder
+	filter.WriteString("(&(objectCategory=group)(|")
+	for _, sid := range sids {
+		filter.WriteString("(objectSid=" + sid + ")")
+	}
+	filter.WriteString("))")
+	groups, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter.String(), []string{"sAMAccountName"}))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*ldap.Entry
+	for _, group := range groups.Entries {
+		filter := fmt.Sprintf("(&(objectCategory=person)(objectClass=user)(memberOf:1.2.840.113556.1.4.1941:=%s))", ldap.EscapeFilter(group.DN))
+		members, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter, []string{"sAMAccountName", "userAccountControl"}))
+		if err != nil {
+			return entries, err
+		}
+		var names []string
+		for _, m := range members.Entries {
+			name := m.GetAttributeValue("sAMAccountName")
+			if flags, _ := strconv.Atoi(m.GetAttributeValue("userAccountControl")); flags&uac.Accountdisable != 0 {
+				name += " (disabled)"
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		entries = append(entries, reconEntry("privileged", fmt.Sprintf("%s: %d users", group.GetAttributeValue("sAMAccountName"), len(names)), names))
+	}
+	return entries, nil
+}
+
+// reconRoastable lists the sAMAccountNames of the users matching a filter
+func reconRoastable(check, what, filter string) func(*ldapsession.LDAPSession) ([]*ldap.Entry, error) {
+	return func(session *ldapsession.LDAPSession) ([]*ldap.Entry, error) {
+		res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter, []string{"sAMAccountName"}))
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, entry := range res.Entries {
+			names = append(names, entry.GetAttributeValue("sAMAccountName"))
+		}
+		sort.Strings(names)
+		return []*ldap.Entry{reconEntry(check, fmt.Sprintf("%d %s", len(names), what), names)}, nil
+	}
+}
+
+// reconLAPS finds the computers whose LAPS password the bind can read. Passwords it can't read are left out of the
+// results, so the presence filter only matches readable ones
+func reconLAPS(session *ldapsession.LDAPSession) ([]*ldap.Entry, error) {
+	var filter strings.Builder
+	filter.WriteString("(&(objectCategory=computer)(|")
+	for _, attr := range lapsPasswordAttrs {
+		filter.WriteString("(" + attr + "=*)")
+	}
+	filter.WriteString("))")
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter.String(), []string{"sAMAccountName"}))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range res.Entries {
+		names = append(names, entry.GetAttributeValue("sAMAccountName"))
+	}
+	sort.Strings(names)
+	return []*ldap.Entry{reconEntry("laps", fmt.Sprintf("%d computers' LAPS passwords can be read", len(names)), names)}, nil
+}
@@ -0,0 +1,126 @@
+package modules
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type SearchFlagsModule struct {
+	Flags []string
+}
+
+func init() {
+	AllModules = append(AllModules, new(SearchFlagsModule))
+	adschema.RegisterAttribute("searchFlagNames", "String(Unicode)", false)
+}
+
+// searchFlagBits are the bits of an attribute's searchFlags (MS-ADTS 2.2.10), in bit order
+var searchFlagBits = []struct {
+	name string
+	bit  int
+}{
+	{"index", 0x1},
+	{"container-index", 0x2},
+	{"anr", 0x4},
+	{"preserve-on-delete", 0x8},
+	{"copy", 0x10},
+	{"tuple-index", 0x20},
+	{"subtree-index", 0x40},
+	{"confidential", searchFlagConfidential},
+	{"never-audit-value", 0x100},
+	{"rodc-filtered", 0x200},
+	{"extended-link-tracking", 0x400},
+	{"base-only", 0x800},
+	{"partition-secret", 0x1000},
+}
+
+var defaultSearchFlags = []string{"rodc-filtered", "index", "preserve-on-delete"}
+
+func (s *SearchFlagsModule) Name() string {
+	return "search-flags"
+}
+
+func (s *SearchFlagsModule) Description() string {
+	return "List schema attributes by searchFlags: in the RODC filtered attribute set, indexed, preserved on delete, ..."
+}
+
+func (s *SearchFlagsModule) FlagSet() *pflag.FlagSet {
+	var names []string
+	for _, f := range searchFlagBits {
+		names = append(names, f.name)
+	}
+	flags := pflag.NewFlagSet(s.Name(), pflag.ExitOnError)
+	flags.StringSliceVar(&s.Flags, "flags", defaultSearchFlags, "Comma separated searchFlags to list the attributes with any of ("+strings.Join(names, ", ")+")")
+	return flags
+}
+
+func (s *SearchFlagsModule) DefaultAttrs() []string {
+	return []string{"lDAPDisplayName", "searchFlags", "searchFlagNames"}
+}
+
+func (s *SearchFlagsModule) IsReportModule() bool {
+	return true
+}
+
+func (s *SearchFlagsModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	if session.NamingContexts.Schema == "" {
+		return fmt.Errorf("the schema partition is unknown")
+	}
+	mask := 0
+	for _, name := range s.Flags {
+		bit := searchFlagBit(name)
+		if bit == 0 {
+			return fmt.Errorf("unknown searchFlags flag %q", name)
+		}
+		mask |= bit
+	}
+	if mask == 0 {
+		return fmt.Errorf("no --flags given")
+	}
+
+	filter := fmt.Sprintf("(&(objectClass=attributeSchema)(searchFlags:1.2.840.113556.1.4.804:=%d))", mask)
+	sr := session.MakeSimpleSearchRequest(filter, []string{"lDAPDisplayName", "searchFlags"})
+	sr.BaseDN = session.NamingContexts.Schema
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(res.Entries, func(i, j int) bool {
+		return strings.ToLower(res.Entries[i].GetAttributeValue("lDAPDisplayName")) < strings.ToLower(res.Entries[j].GetAttributeValue("lDAPDisplayName"))
+	})
+	var entries []*ldap.Entry
+	for _, entry := range res.Entries {
+		flags, _ := strconv.Atoi(entry.GetAttributeValue("searchFlags"))
+		var names []string
+		for _, f := range searchFlagBits {
+			if flags&f.bit != 0 {
+				names = append(names, f.name)
+			}
+		}
+		entries = append(entries, ldap.NewEntry(entry.DN, map[string][]string{
+			"lDAPDisplayName": {entry.GetAttributeValue("lDAPDisplayName")},
+			"searchFlags":     {entry.GetAttributeValue("searchFlags")},
+			"searchFlagNames": names,
+		}))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// searchFlagBit returns the bit of a searchFlags flag by name, or 0 if there's no such flag
+func searchFlagBit(name string) int {
+	for _, f := range searchFlagBits {
+		if strings.EqualFold(f.name, strings.TrimSpace(name)) {
+			return f.bit
+		}
+	}
+	return 0
+}
@@ -0,0 +1,169 @@
+package modules
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type SessionHintsModule struct {
+	Host string
+}
+
+func init() {
+	AllModules = append(AllModules, new(SessionHintsModule))
+	adschema.RegisterAttribute("user", "String(Unicode)", true)
+	adschema.RegisterAttribute("hostname", "String(Unicode)", true)
+	adschema.RegisterAttribute("hint", "String(Unicode)", true)
+	adschema.RegisterAttribute("evidence", "String(Unicode)", true)
+}
+
+// sessionHintAttrs are the user attributes that point at hosts the user is likely to be logged on to, or to have
+// been recently. msDS-LastSuccessfulInteractiveLogonTime (only kept when the domain records interactive logons)
+// doesn't name a host, but shows the user actually logs on interactively, so users with only that are listed too
+var sessionHintAttrs = []string{"sAMAccountName", "homeDirectory", "profilePath", "managedObjects", "msDS-LastSuccessfulInteractiveLogonTime"}
+
+func (s *SessionHintsModule) Name() string {
+	return "session-hints"
+}
+
+func (s *SessionHintsModule) Description() string {
+	return "List user to host hints (home directory and profile servers, managed computers) for planning lateral movement"
+}
+
+func (s *SessionHintsModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(s.Name(), pflag.ExitOnError)
+	flags.StringVar(&s.Host, "host", "", "Only show hints pointing at this host (short name or FQDN)")
+	return flags
+}
+
+func (s *SessionHintsModule) DefaultAttrs() []string {
+	return []string{"user", "hostname", "hint", "evidence", "msDS-LastSuccessfulInteractiveLogonTime"}
+}
+
+func (s *SessionHintsModule) IsReportModule() bool {
+	return true
+}
+
+// sessionHint is one user to host edge and where it came from
+type sessionHint struct {
+	userDN, user, host, hint, evidence string
+	lastInteractive                    []string
+}
+
+func (s *SessionHintsModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	filter := "(&(objectCategory=person)(objectClass=user)(|(homeDirectory=*)(profilePath=*)(managedObjects=*)(msDS-LastSuccessfulInteractiveLogonTime=*)))"
+	res, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter, sessionHintAttrs))
+	if err != nil {
+		return err
+	}
+
+	// managedObjects are DNs, so look up the hostnames of the ones that are computers in one go
+	var managed []string
+	for _, entry := range res.Entries {
+		managed = append(managed, entry.GetAttributeValues("managedObjects")...)
+	}
+	hostnames := make(map[string]string)
+	if len(managed) > 0 {
+		computers, err := session.BulkSearch(session.BaseDN, "distinguishedName", managed, "(objectCategory=computer)", []string{"dNSHostName", "sAMAccountName"})
+		if err != nil {
+			session.Log.Warnf("unable to look up managed computers: %s", err)
+		}
+		if computers != nil {
+			for _, c := range computers.Entries {
+				host := c.GetAttributeValue("dNSHostName")
+				if host == "" {
+					host = strings.TrimSuffix(c.GetAttributeValue("sAMAccountName"), "$")
+				}
+				hostnames[strings.ToLower(c.DN)] = host
+			}
+		}
+	}
+
+	var hints []sessionHint
+	for _, entry := range res.Entries {
+		found := len(hints)
+		base := sessionHint{
+			userDN:          entry.DN,
+			user:            entry.GetAttributeValue("sAMAccountName"),
+			lastInteractive: entry.GetAttributeValues("msDS-LastSuccessfulInteractiveLogonTime"),
+		}
+		for _, attr := range []string{"homeDirectory", "profilePath"} {
+			path := entry.GetAttributeValue(attr)
+			if host := uncHost(path); host != "" {
+				h := base
+				h.host, h.hint, h.evidence = host, attr, path
+				hints = append(hints, h)
+			}
+		}
+		for _, dn := range entry.GetAttributeValues("managedObjects") {
+			if host, ok := hostnames[strings.ToLower(dn)]; ok {
+				h := base
+				h.host, h.hint, h.evidence = host, "managedObjects", dn
+				hints = append(hints, h)
+			}
+		}
+		// a user who logs on interactively, but with nothing pointing at where, is still worth knowing about
+		if len(hints) == found && len(base.lastInteractive) > 0 {
+			h := base
+			h.hint, h.evidence = "interactiveLogon", "logs on interactively, host unknown"
+			hints = append(hints, h)
+		}
+	}
+
+	sort.SliceStable(hints, func(i, j int) bool {
+		if !strings.EqualFold(hints[i].host, hints[j].host) {
+			return strings.ToLower(hints[i].host) < strings.ToLower(hints[j].host)
+		}
+		return strings.ToLower(hints[i].user) < strings.ToLower(hints[j].user)
+	})
+	var entries []*ldap.Entry
+	for _, h := range hints {
+		if s.Host != "" && !sameHost(h.host, s.Host) {
+			continue
+		}
+		e := ldap.NewEntry(h.userDN, map[string][]string{
+			"user":     {h.user},
+			"hint":     {h.hint},
+			"evidence": {h.evidence},
+		})
+		if h.host != "" {
+			e.Attributes = append(e.Attributes, ldap.NewEntryAttribute("hostname", []string{h.host}))
+		}
+		if len(h.lastInteractive) > 0 {
+			e.Attributes = append(e.Attributes, ldap.NewEntryAttribute("msDS-LastSuccessfulInteractiveLogonTime", h.lastInteractive))
+		}
+		entries = append(entries, e)
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// uncHost returns the server of a UNC path (\\server\share\...), or "" if the path isn't one
+func uncHost(path string) string {
+	if !strings.HasPrefix(path, `\\`) {
+		return ""
+	}
+	host := strings.TrimPrefix(path, `\\`)
+	if i := strings.IndexAny(host, `\/`); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// sameHost compares hostnames, treating a short name as the same host as an FQDN that starts with it
+func sameHost(a, b string) bool {
+	a, b = strings.ToLower(strings.TrimSuffix(a, ".")), strings.ToLower(strings.TrimSuffix(b, "."))
+	short := func(h string) string { return strings.SplitN(h, ".", 2)[0] }
+	if a == b {
+		return true
+	}
+	if !strings.Contains(a, ".") || !strings.Contains(b, ".") {
+		return short(a) == short(b)
+	}
+	return false
+}
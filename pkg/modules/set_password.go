@@ -0,0 +1,95 @@
+package modules
+
+import (
+	"fmt"
+	"unicode/utf16"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/ropnop/go-windapsearch/pkg/redact"
+	"github.com/ropnop/go-windapsearch/pkg/utils"
+	"github.com/spf13/pflag"
+)
+
+type SetPasswordModule struct {
+	User        string
+	NewPassword string
+	OldPassword string
+}
+
+func init() {
+	AllModules = append(AllModules, new(SetPasswordModule))
+}
+
+func (s *SetPasswordModule) Name() string {
+	return "set-password"
+}
+
+func (s *SetPasswordModule) Description() string {
+	return "Reset (or change, given the old password) an account's password through unicodePwd"
+}
+
+func (s *SetPasswordModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(s.Name(), pflag.ExitOnError)
+	flags.StringVar(&s.User, "user", "", "DN or sAMAccountName of the account")
+	flags.StringVar(&s.NewPassword, "new-password", "", "Password to set. If not specified, will be prompted for")
+	flags.StringVar(&s.OldPassword, "old-password", "", "Current password. If given, the password is changed instead of reset")
+	return flags
+}
+
+func (s *SetPasswordModule) DefaultAttrs() []string {
+	return []string{"action", "status"}
+}
+
+func (s *SetPasswordModule) IsWriteModule() bool {
+	return true
+}
+
+func (s *SetPasswordModule) Run(session *ldapsession.LDAPSession, attrs []string) (err error) {
+	if s.User == "" {
+		return fmt.Errorf("must provide a --user")
+	}
+	// AD refuses to set unicodePwd on an unencrypted connection, so don't let a dry run suggest it will work
+	if !session.Encrypted() {
+		return fmt.Errorf("passwords can only be set over an encrypted connection, re-run with --secure")
+	}
+	dn, err := resolveDN(session, s.User, "")
+	if err != nil {
+		return err
+	}
+	if s.NewPassword == "" {
+		if s.NewPassword, err = utils.SecurePrompt(fmt.Sprintf("New password for [%s]", dn)); err != nil {
+			return err
+		}
+	}
+
+	// a reset needs the ForceChangePassword right (or GenericAll etc), a change only needs the old password
+	action := "reset"
+	req := ldap.NewModifyRequest(dn, nil)
+	if s.OldPassword != "" {
+		action = "change"
+		req.Delete("unicodePwd", []string{encodePassword(s.OldPassword)})
+		req.Add("unicodePwd", []string{encodePassword(s.NewPassword)})
+	} else {
+		req.Replace("unicodePwd", []string{encodePassword(s.NewPassword)})
+	}
+	applied, err := session.Modify(req)
+	if err != nil {
+		return fmt.Errorf("unable to %s password: %s", action, err)
+	}
+	writeResult(session, dn, map[string][]string{"action": {action}, "status": {writeStatus(session, applied)}}, attrs)
+	return nil
+}
+
+// encodePassword converts a password to the format unicodePwd expects: quoted and UTF-16LE encoded. Both the
+// password and its encoding are kept out of the logs, including --wire-debug's packet dumps
+func encodePassword(password string) string {
+	units := utf16.Encode([]rune(`"` + password + `"`))
+	b := make([]byte, len(units)*2)
+	for i, u := range units {
+		b[i*2] = byte(u)
+		b[i*2+1] = byte(u >> 8)
+	}
+	redact.Add(password, string(b))
+	return string(b)
+}
@@ -0,0 +1,179 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+const rbcdAttribute = "msDS-AllowedToActOnBehalfOfOtherIdentity"
+
+// rbcdOwner is the owner impacket and the AD tools put on the descriptor (BUILTIN\Administrators)
+var rbcdOwner = secdesc.MustParseSID("S-1-5-32-544")
+
+// rbcdMask grants full control, which is what the KDC checks for when allowing S4U2Proxy
+const rbcdMask = 0x000f01ff
+
+type SetRBCDModule struct {
+	Target  string
+	SID     string
+	Account string
+	Action  string
+}
+
+func init() {
+	AllModules = append(AllModules, new(SetRBCDModule))
+	adschema.RegisterAttribute("sid", "String(Unicode)", true)
+	adschema.RegisterAttribute("allowedSids", "String(Unicode)", false)
+}
+
+func (r *SetRBCDModule) Name() string {
+	return "set-rbcd"
+}
+
+func (r *SetRBCDModule) Description() string {
+	return "Add or remove an account in a computer's resource-based constrained delegation (msDS-AllowedToActOnBehalfOfOtherIdentity)"
+}
+
+func (r *SetRBCDModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(r.Name(), pflag.ExitOnError)
+	flags.StringVar(&r.Target, "target", "", "DN or sAMAccountName of the computer to modify")
+	flags.StringVar(&r.SID, "sid", "", "SID of the account allowed to delegate to the target")
+	flags.StringVar(&r.Account, "account", "", "sAMAccountName (or DN) of the account allowed to delegate, instead of --sid")
+	flags.StringVar(&r.Action, "action", "add", "Whether to add or remove the account: add, remove")
+	return flags
+}
+
+func (r *SetRBCDModule) DefaultAttrs() []string {
+	return []string{"action", "sid", "allowedSids", "status"}
+}
+
+func (r *SetRBCDModule) IsWriteModule() bool {
+	return true
+}
+
+func (r *SetRBCDModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	if r.Target == "" || (r.SID == "" && r.Account == "") {
+		return fmt.Errorf("must provide a --target and either a --sid or an --account")
+	}
+	action := strings.ToLower(r.Action)
+	if action != "add" && action != "remove" {
+		return fmt.Errorf("invalid action %q (must be one of add, remove)", r.Action)
+	}
+	targetDN, err := resolveDN(session, r.Target, "(objectCategory=computer)")
+	if err != nil {
+		return err
+	}
+	var sid secdesc.SID
+	if r.SID != "" {
+		sid, err = secdesc.ParseSID(r.SID)
+	} else {
+		sid, err = lookupSID(session, r.Account)
+	}
+	if err != nil {
+		return err
+	}
+
+	sd, err := r.current(session, targetDN)
+	if err != nil {
+		return err
+	}
+	changed := false
+	switch action {
+	case "add":
+		if !containsSID(sd.DACL.ACEs, sid) {
+			sd.DACL.ACEs = append(sd.DACL.ACEs, secdesc.ACE{Type: secdesc.AccessAllowedACEType, Mask: rbcdMask, SID: sid})
+			changed = true
+		}
+	case "remove":
+		var kept []secdesc.ACE
+		for _, ace := range sd.DACL.ACEs {
+			if !ace.SID.Equal(sid) {
+				kept = append(kept, ace)
+			}
+		}
+		changed = len(kept) != len(sd.DACL.ACEs)
+		sd.DACL.ACEs = kept
+	}
+
+	values := map[string][]string{
+		"action":      {action},
+		"sid":         {sid.String()},
+		"allowedSids": allowedSIDs(session, sd),
+		"status":      {"unchanged (already done)"},
+	}
+	if !changed {
+		writeResult(session, targetDN, values, attrs)
+		return nil
+	}
+
+	req := ldap.NewModifyRequest(targetDN, nil)
+	if len(sd.DACL.ACEs) == 0 {
+		// nobody left, so clean up the attribute entirely rather than leaving an empty descriptor behind
+		req.Delete(rbcdAttribute, nil)
+	} else {
+		req.Replace(rbcdAttribute, []string{string(sd.Bytes())})
+	}
+	applied, err := session.Modify(req)
+	if err != nil {
+		return fmt.Errorf("unable to write %s: %s", rbcdAttribute, err)
+	}
+	values["status"] = []string{writeStatus(session, applied)}
+	writeResult(session, targetDN, values, attrs)
+	return nil
+}
+
+// current reads the target's existing descriptor, or returns a new empty one if it isn't set
+func (r *SetRBCDModule) current(session *ldapsession.LDAPSession, dn string) (*secdesc.SecurityDescriptor, error) {
+	sr := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{rbcdAttribute}, nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) == 0 {
+		return nil, fmt.Errorf("computer %q not found", dn)
+	}
+	raw := res.Entries[0].GetRawAttributeValue(rbcdAttribute)
+	if len(raw) == 0 {
+		return secdesc.NewSecurityDescriptor(rbcdOwner), nil
+	}
+	sd, err := secdesc.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse existing %s: %s", rbcdAttribute, err)
+	}
+	if sd.DACL == nil {
+		sd.DACL = &secdesc.ACL{Revision: 2}
+	}
+	return sd, nil
+}
+
+func containsSID(aces []secdesc.ACE, sid secdesc.SID) bool {
+	for _, ace := range aces {
+		if ace.SID.Equal(sid) {
+			return true
+		}
+	}
+	return false
+}
+
+func allowedSIDs(session *ldapsession.LDAPSession, sd *secdesc.SecurityDescriptor) []string {
+	var sids []string
+	for _, ace := range sd.DACL.ACEs {
+		if ace.Type == secdesc.AccessAllowedACEType {
+			sids = append(sids, ace.SID.String())
+		}
+	}
+	names := session.SIDResolver().Resolve(sids)
+	for i, sid := range sids {
+		if name := names[sid]; name != sid {
+			sids[i] = fmt.Sprintf("%s (%s)", sid, name)
+		}
+	}
+	return sids
+}
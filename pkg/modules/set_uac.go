@@ -0,0 +1,119 @@
+package modules
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	uac "github.com/audibleblink/msldapuac"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/enums"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+// uacActions maps each action to the userAccountControl bit it changes, and whether it sets or clears it
+var uacActions = map[string]struct {
+	Flag int
+	Set  bool
+}{
+	"enable":          {uac.Accountdisable, false},
+	"disable":         {uac.Accountdisable, true},
+	"no-preauth":      {uac.DontReqPreauth, true},
+	"require-preauth": {uac.DontReqPreauth, false},
+}
+
+type SetUACModule struct {
+	Target string
+	Action string
+}
+
+func init() {
+	AllModules = append(AllModules, new(SetUACModule))
+	// shown as flag names in JSON, like userAccountControl itself
+	for _, name := range []string{"uacBefore", "uacAfter"} {
+		adschema.RegisterAttribute(name, "Enumeration", true)
+		enums.EnumFuncs[name] = enums.ConvertUAC
+	}
+}
+
+func (u *SetUACModule) Name() string {
+	return "set-uac"
+}
+
+func (u *SetUACModule) Description() string {
+	return "Enable/disable an account or set/clear DONT_REQ_PREAUTH in its userAccountControl"
+}
+
+func (u *SetUACModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(u.Name(), pflag.ExitOnError)
+	flags.StringVar(&u.Target, "target", "", "DN or sAMAccountName of the account to modify")
+	flags.StringVar(&u.Action, "action", "", "Change to make: enable, disable, no-preauth, require-preauth")
+	return flags
+}
+
+func (u *SetUACModule) DefaultAttrs() []string {
+	return []string{"action", "uacBefore", "uacAfter", "status"}
+}
+
+func (u *SetUACModule) IsWriteModule() bool {
+	return true
+}
+
+func (u *SetUACModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	action, ok := uacActions[strings.ToLower(u.Action)]
+	if u.Target == "" || !ok {
+		return fmt.Errorf("must provide a --target and an --action (one of enable, disable, no-preauth, require-preauth)")
+	}
+	dn, err := resolveDN(session, u.Target, "")
+	if err != nil {
+		return err
+	}
+	sr := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"userAccountControl"}, nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		return err
+	}
+	if len(res.Entries) == 0 {
+		return fmt.Errorf("object %q not found", dn)
+	}
+	current := res.Entries[0].GetAttributeValue("userAccountControl")
+	before, err := strconv.ParseInt(current, 10, 64)
+	if err != nil {
+		return fmt.Errorf("unable to read userAccountControl of %q", dn)
+	}
+
+	after := before &^ int64(action.Flag)
+	if action.Set {
+		after = before | int64(action.Flag)
+	}
+	values := map[string][]string{
+		"action":    {strings.ToLower(u.Action)},
+		"uacBefore": {current},
+		"uacAfter":  {strconv.FormatInt(after, 10)},
+	}
+	if after == before {
+		values["status"] = []string{"unchanged (already done)"}
+		writeResult(session, dn, values, attrs)
+		return nil
+	}
+
+	// deleting the value we read and adding the new one fails if something else changed userAccountControl in the
+	// meantime, instead of silently overwriting its change
+	req := ldap.NewModifyRequest(dn, nil)
+	req.Delete("userAccountControl", []string{current})
+	req.Add("userAccountControl", []string{strconv.FormatInt(after, 10)})
+	applied, err := session.Modify(req)
+	if err != nil {
+		return fmt.Errorf("unable to update userAccountControl: %s", err)
+	}
+	if applied {
+		fmt.Fprintf(os.Stderr, "[+] userAccountControl of %s changed from %d to %d (restore with a replace to %d)\n", dn, before, after, before)
+	}
+	values["status"] = []string{writeStatus(session, applied)}
+	writeResult(session, dn, values, attrs)
+	return nil
+}
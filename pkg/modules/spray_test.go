@@ -0,0 +1,50 @@
+package modules
+
+import (
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+func TestSprayOutputsEveryHit(t *testing.T) {
+	session := fakeDC(t, ldapsession.LDAPSessionOptions{Writes: ldapsession.WritesEnabled}, func(id int64, req *ber.Packet) []*ber.Packet {
+		switch req.Children[1].Tag {
+		case ldap.ApplicationBindRequest:
+			name, _ := req.Children[1].Children[1].Value.(string)
+			if name == "" || name == "alice@lab.local" || name == "bob@lab.local" {
+				return nil
+			}
+			return []*ber.Packet{response(id, resultCode(ldap.ApplicationBindResponse, ldap.LDAPResultInvalidCredentials,
+				"80090308: LdapErr: DSID-0C09044E, comment: AcceptSecurityContext error, data 52e, v4563"))}
+		case ldap.ApplicationSearchRequest:
+			done := response(id, resultCode(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess, ""))
+			attrs := requestAttrs(req)
+			switch {
+			case requestBase(req) == fakeBaseDN && attrs[0] == "lockoutThreshold":
+				return []*ber.Packet{response(id, searchEntry(fakeEntry{fakeBaseDN, [][2]string{{"lockoutThreshold", "0"}}})), done}
+			case attrs[0] == "sAMAccountName" && len(attrs) == 3:
+				var responses []*ber.Packet
+				for _, name := range []string{"alice", "bob", "carol"} {
+					responses = append(responses, response(id, searchEntry(fakeEntry{"CN=" + name + ",CN=Users," + fakeBaseDN,
+						[][2]string{{"sAMAccountName", name}, {"badPwdCount", "0"}}})))
+				}
+				return append(responses, done)
+			}
+		}
+		return nil
+	})
+
+	entries, err := collect(session, &SprayModule{Passwords: []string{"Winter2026!"}, Timeout: 5}, []string{"sAMAccountName", "status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.GetAttributeValue("sAMAccountName"))
+	}
+	if len(got) != 2 || got[0] != "alice" || got[1] != "bob" {
+		t.Fatalf("got hits %v, want alice and bob", got)
+	}
+}
@@ -0,0 +1,261 @@
+package modules
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type UPNSuffixesModule struct {
+	DomainOnly bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(UPNSuffixesModule))
+	adschema.RegisterAttribute("suffix", "String(Unicode)", true)
+	adschema.RegisterAttribute("accounts", "Enumeration", true)
+}
+
+// Where a UPN suffix comes from
+const (
+	suffixForestDomain  = "forest domain"
+	suffixConfigured    = "uPNSuffixes"
+	suffixTrustedForest = "trusted forest"
+	suffixAccountsOnly  = "accounts only"
+)
+
+func (u *UPNSuffixesModule) Name() string {
+	return "upn-suffixes"
+}
+
+func (u *UPNSuffixesModule) Description() string {
+	return "Compare the UPN suffixes configured in the forest to those in use on accounts, and to the name suffixes routed to trusted forests"
+}
+
+func (u *UPNSuffixesModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(u.Name(), pflag.ExitOnError)
+	flags.BoolVar(&u.DomainOnly, "domain-only", false, "Only count the UPNs of accounts in the domain, instead of the whole forest through the global catalog")
+	return flags
+}
+
+func (u *UPNSuffixesModule) DefaultAttrs() []string {
+	return []string{"suffix", "source", "accounts", "findings"}
+}
+
+func (u *UPNSuffixesModule) IsReportModule() bool {
+	return true
+}
+
+// upnSuffix is a name suffix the forest has or uses, or a trusted forest claims
+type upnSuffix struct {
+	dn, name, source string
+	// trust is the trusted forest of a trusted forest's name suffix, and disabled why it isn't routed there
+	trust, disabled string
+	accounts        int
+	findings        []string
+}
+
+func (u *UPNSuffixesModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	partitions := "CN=Partitions," + session.NamingContexts.Configuration
+	var suffixes []*upnSuffix
+	byName := make(map[string]*upnSuffix)
+	add := func(s *upnSuffix) {
+		key := strings.ToLower(s.name)
+		if key == "" || byName[key] != nil {
+			return
+		}
+		byName[key] = s
+		suffixes = append(suffixes, s)
+	}
+
+	// every domain's DNS name can be used as a UPN suffix without being configured
+	domains, err := session.GetForestDomains()
+	if err != nil {
+		return err
+	}
+	for _, d := range domains {
+		add(&upnSuffix{dn: partitions, name: d.DNSName, source: suffixForestDomain})
+	}
+	sr := ldap.NewSearchRequest(partitions, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"uPNSuffixes"}, nil)
+	if res, err := session.GetSearchResults(sr); err != nil {
+		session.Log.Warnf("unable to read the UPN suffixes of the Partitions container: %s", err)
+	} else if len(res.Entries) > 0 {
+		for _, name := range res.Entries[0].GetAttributeValues("uPNSuffixes") {
+			add(&upnSuffix{dn: partitions, name: name, source: suffixConfigured})
+		}
+	}
+	ours := len(suffixes)
+	trusted := u.trustedSuffixes(session)
+	for _, s := range trusted {
+		add(s)
+	}
+
+	used, err := u.usedSuffixes(session)
+	if err != nil {
+		return err
+	}
+	var accountsOnly []*upnSuffix
+	for key, s := range used {
+		if existing := byName[key]; existing != nil {
+			existing.accounts = s.accounts
+		} else if routed := coveringSuffix(suffixes[:ours], s.name); routed != nil {
+			// names under a suffix are routed with it, so they're only worth a count on it
+			routed.accounts += s.accounts
+		} else {
+			accountsOnly = append(accountsOnly, s)
+		}
+	}
+	sort.Slice(accountsOnly, func(i, j int) bool {
+		if accountsOnly[i].accounts != accountsOnly[j].accounts {
+			return accountsOnly[i].accounts > accountsOnly[j].accounts
+		}
+		return strings.ToLower(accountsOnly[i].name) < strings.ToLower(accountsOnly[j].name)
+	})
+	for _, s := range accountsOnly {
+		s.findings = append(s.findings, "in use but not a forest domain or configured UPN suffix, so it isn't routed over forest trusts")
+		add(s)
+	}
+
+	for _, s := range suffixes {
+		if s.source == suffixConfigured && s.accounts == 0 {
+			s.findings = append(s.findings, "not used by any account")
+		}
+		if s.source == suffixTrustedForest {
+			if s.disabled != "" {
+				s.findings = append(s.findings, "not routed to "+s.trust+": "+s.disabled)
+			}
+			if s.accounts > 0 {
+				s.findings = append(s.findings, fmt.Sprintf("used by %d accounts here, but claimed by trusted forest %s", s.accounts, s.trust))
+			}
+			continue
+		}
+		for _, t := range trusted {
+			if !underSuffix(s.name, t.name) && !underSuffix(t.name, s.name) {
+				continue
+			}
+			finding := fmt.Sprintf("overlaps the name suffix %s routed to trusted forest %s", t.name, t.trust)
+			if t.disabled != "" {
+				finding += " (" + t.disabled + " there)"
+			}
+			s.findings = append(s.findings, finding)
+		}
+	}
+
+	var entries []*ldap.Entry
+	for _, s := range suffixes {
+		values := map[string][]string{
+			"suffix":   {s.name},
+			"source":   {s.source},
+			"accounts": {strconv.Itoa(s.accounts)},
+		}
+		if s.trust != "" {
+			values["source"] = []string{s.source + " " + s.trust}
+		}
+		if len(s.findings) > 0 {
+			values["findings"] = s.findings
+		}
+		entries = append(entries, ldap.NewEntry(s.dn, values))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// trustedSuffixes reads the top level names of each forest trust: the name suffixes routed to the trusted forest,
+// with why they aren't if they're disabled. A trust without forest trust info only routes its own name
+func (u *UPNSuffixesModule) trustedSuffixes(session *ldapsession.LDAPSession) []*upnSuffix {
+	sr := session.MakeSimpleSearchRequest("(&(objectClass=trustedDomain)(trustAttributes:1.2.840.113556.1.4.803:=8))", // TRUST_ATTRIBUTE_FOREST_TRANSITIVE
+		[]string{"trustPartner", "msDS-TrustForestTrustInfo"})
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		session.Log.Warnf("unable to read forest trusts: %s", err)
+		return nil
+	}
+	var suffixes []*upnSuffix
+	for _, entry := range res.Entries {
+		partner := entry.GetAttributeValue("trustPartner")
+		raw := entry.GetRawAttributeValue("msDS-TrustForestTrustInfo")
+		if len(raw) == 0 {
+			suffixes = append(suffixes, &upnSuffix{dn: entry.DN, name: partner, source: suffixTrustedForest, trust: partner})
+			continue
+		}
+		records, err := adschema.ParseForestTrustInfo(raw)
+		if err != nil {
+			session.Log.Warnf("unable to decode the forest trust info of %s: %s", partner, err)
+			continue
+		}
+		for _, r := range records {
+			if r.Type != adschema.ForestTrustTopLevelName {
+				continue
+			}
+			s := &upnSuffix{dn: entry.DN, name: r.Name, source: suffixTrustedForest, trust: partner}
+			switch {
+			case r.Flags&adschema.ForestTrustTLNDisabledConflict != 0:
+				s.disabled = "disabled because of a conflict"
+			case r.Flags&adschema.ForestTrustTLNDisabledAdmin != 0:
+				s.disabled = "disabled by an admin"
+			case r.Flags&adschema.ForestTrustTLNDisabledNew != 0:
+				s.disabled = "new, not enabled yet"
+			}
+			suffixes = append(suffixes, s)
+		}
+	}
+	return suffixes
+}
+
+// usedSuffixes counts the accounts using each UPN suffix, keyed by lower case suffix, from the global catalog unless
+// --domain-only is given
+func (u *UPNSuffixesModule) usedSuffixes(session *ldapsession.LDAPSession) (map[string]*upnSuffix, error) {
+	search, baseDN := session, session.BaseDN
+	if !u.DomainOnly {
+		if gc, err := session.GlobalCatalog(); err != nil {
+			session.Log.Warnf("unable to connect to the global catalog, only counting the domain's accounts: %s", err)
+		} else {
+			defer gc.Close()
+			search, baseDN = gc, ""
+		}
+	}
+	sr := search.MakeSimpleSearchRequest("(userPrincipalName=*)", []string{"userPrincipalName"})
+	sr.BaseDN = baseDN
+	res, err := search.GetPagedSearchResults(sr)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]*upnSuffix)
+	for _, entry := range res.Entries {
+		upn := entry.GetAttributeValue("userPrincipalName")
+		at := strings.LastIndex(upn, "@")
+		if at < 0 {
+			continue
+		}
+		name := upn[at+1:]
+		key := strings.ToLower(name)
+		if used[key] == nil {
+			used[key] = &upnSuffix{name: name, source: suffixAccountsOnly}
+		}
+		used[key].accounts++
+	}
+	return used, nil
+}
+
+// coveringSuffix returns the suffix name is under, if any
+func coveringSuffix(suffixes []*upnSuffix, name string) *upnSuffix {
+	for _, s := range suffixes {
+		if underSuffix(name, s.name) {
+			return s
+		}
+	}
+	return nil
+}
+
+// underSuffix is true if name is the suffix or a subdomain of it
+func underSuffix(name, suffix string) bool {
+	name, suffix = strings.ToLower(name), strings.ToLower(suffix)
+	return name == suffix || strings.HasSuffix(name, "."+suffix)
+}
@@ -9,6 +9,7 @@ import (
 type UsersModule struct {
 	ExtraFilter string
 	SearchTerm  string
+	last        lastFilter
 }
 
 func init() {
@@ -40,6 +41,7 @@ func (u *UsersModule) FlagSet() *pflag.FlagSet {
 	flags := pflag.NewFlagSet(u.Name(), pflag.ExitOnError)
 	flags.StringVar(&u.ExtraFilter, "filter", "", "Extra LDAP syntax filter to use")
 	flags.StringVarP(&u.SearchTerm, "search", "s", "", "Search term to filter on")
+	u.last.addFlags(flags)
 	return flags
 }
 
@@ -48,7 +50,11 @@ func (u *UsersModule) DefaultAttrs() []string {
 }
 
 func (u *UsersModule) Run(lSession *ldapsession.LDAPSession, attrs []string) error {
-	searchReq := lSession.MakeSimpleSearchRequest(u.Filter(), attrs)
+	filter, err := u.last.apply(lSession, u.Filter())
+	if err != nil {
+		return err
+	}
+	searchReq := lSession.MakeSimpleSearchRequest(filter, attrs)
 	return lSession.ExecuteSearchRequest(searchReq)
 
 }
@@ -0,0 +1,137 @@
+package modules
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/cldap"
+	"github.com/ropnop/go-windapsearch/pkg/dns"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type ValidateUsersModule struct {
+	UsersFile string
+	Usernames []string
+	Workers   int
+	Timeout   int
+	All       bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(ValidateUsersModule))
+}
+
+func (v *ValidateUsersModule) Name() string {
+	return "validate-users"
+}
+
+func (v *ValidateUsersModule) Description() string {
+	return "Check which usernames exist with CLDAP pings (no credentials needed, doesn't touch badPwdCount)"
+}
+
+func (v *ValidateUsersModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(v.Name(), pflag.ExitOnError)
+	flags.StringVar(&v.UsersFile, "users", "", "File of usernames to check, one per line")
+	flags.StringSliceVar(&v.Usernames, "usernames", nil, "Comma separated usernames to check")
+	flags.IntVar(&v.Workers, "workers", 10, "Number of pings to have in flight at once")
+	flags.IntVar(&v.Timeout, "timeout", 2, "Seconds to wait for each ping")
+	flags.BoolVar(&v.All, "all", false, "Also output usernames that don't exist")
+	return flags
+}
+
+func (v *ValidateUsersModule) DefaultAttrs() []string {
+	return []string{"sAMAccountName", "status"}
+}
+
+func (v *ValidateUsersModule) IsReportModule() bool {
+	return true
+}
+
+// Run pings the session's DC over CLDAP for every username. AD answers an LDAP bind with the same "data 52e" error
+// whether the account is unknown or the password is wrong, so binds can't be used to tell the two apart
+func (v *ValidateUsersModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	names := v.Usernames
+	if v.UsersFile != "" {
+		lines, err := readLines(v.UsersFile)
+		if err != nil {
+			return err
+		}
+		names = append(names, lines...)
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("must provide --users or --usernames")
+	}
+	if session.Options().Proxy != "" {
+		return fmt.Errorf("CLDAP pings are sent over UDP, which can't go through the SOCKS proxy")
+	}
+
+	domain := ldapsession.DNToDomain(session.NamingContexts.Default)
+	host, _ := session.Server()
+	timeout := time.Duration(v.Timeout) * time.Second
+	workers := v.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	statuses := make([]string, len(names))
+	users := make([]string, len(names))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, name := range names {
+		_, users[i] = splitUsername(name, "")
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			statuses[i] = pingUser(session.Resolver(), host, domain, users[i], timeout)
+		}(i)
+	}
+	wg.Wait()
+
+	var entries []*ldap.Entry
+	var valid int
+	for i, user := range users {
+		if statuses[i] == "exists" {
+			valid++
+		} else if !v.All {
+			if statuses[i] != "unknown" {
+				session.Log.Warnf("unable to check %s: %s", user, statuses[i])
+			}
+			continue
+		}
+		entries = append(entries, ldap.NewEntry("", map[string][]string{
+			"sAMAccountName": {user},
+			"status":         {statuses[i]},
+		}))
+	}
+	fmt.Fprintf(os.Stderr, "[+] %d of %d username(s) exist in %s\n", valid, len(users), domain)
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// pingUser returns "exists", "unknown", or what went wrong. Names ending in $ are looked up as computer accounts
+func pingUser(resolver *dns.Resolver, host, domain, user string, timeout time.Duration) string {
+	aac := cldap.AccountNormal
+	if strings.HasSuffix(user, "$") {
+		aac = cldap.AccountWorkstation | cldap.AccountServer
+	}
+	r, err := cldap.PingUser(resolver, host, domain, user, aac, timeout)
+	if err != nil {
+		return fmt.Sprintf("error (%s)", err)
+	}
+	switch {
+	case r.UserExists():
+		return "exists"
+	case r.Opcode == cldap.LogonSAMUserUnknownEx:
+		return "unknown"
+	}
+	return fmt.Sprintf("error (DC answered with opcode %d)", r.Opcode)
+}
@@ -0,0 +1,182 @@
+package modules
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/spf13/pflag"
+)
+
+type WMIFiltersModule struct {
+	UnusedOnly bool
+}
+
+func init() {
+	AllModules = append(AllModules, new(WMIFiltersModule))
+	adschema.RegisterAttribute("queries", "String(Unicode)", false)
+	adschema.RegisterAttribute("gpos", "String(Unicode)", false)
+}
+
+// gpcWQLFilterRegex matches a GPO's gPCWQLFilter, [domain;{filter ID};0]
+var gpcWQLFilterRegex = regexp.MustCompile(`^\[([^;\]]*);(\{[^}]+\});\d+\]$`)
+
+func (w *WMIFiltersModule) Name() string {
+	return "wmi-filters"
+}
+
+func (w *WMIFiltersModule) Description() string {
+	return "List WMI filters with their WQL queries and the GPOs they decide the targets of"
+}
+
+func (w *WMIFiltersModule) FlagSet() *pflag.FlagSet {
+	flags := pflag.NewFlagSet(w.Name(), pflag.ExitOnError)
+	flags.BoolVar(&w.UnusedOnly, "unused-only", false, "Only list the filters no GPO uses")
+	return flags
+}
+
+func (w *WMIFiltersModule) DefaultAttrs() []string {
+	return []string{"msWMI-Name", "msWMI-Parm1", "queries", "gpos", "msWMI-Author", "msWMI-ChangeDate"}
+}
+
+func (w *WMIFiltersModule) IsReportModule() bool {
+	return true
+}
+
+func (w *WMIFiltersModule) Run(session *ldapsession.LDAPSession, attrs []string) error {
+	sr := session.MakeSimpleSearchRequest("(objectClass=msWMI-Som)",
+		[]string{"cn", "msWMI-ID", "msWMI-Name", "msWMI-Parm1", "msWMI-Parm2", "msWMI-Author", "msWMI-ChangeDate"})
+	sr.BaseDN = "CN=SOM,CN=WMIPolicy,CN=System," + session.BaseDN
+	filters, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			filters = &ldap.SearchResult{}
+		} else {
+			return err
+		}
+	}
+	gpos, err := session.GetPagedSearchResults(session.MakeSimpleSearchRequest(
+		"(&(objectClass=groupPolicyContainer)(gPCWQLFilter=*))", []string{"cn", "displayName", "gPCWQLFilter"}))
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, f := range filters.Entries {
+		known[strings.ToLower(wmiFilterID(f))] = true
+	}
+	usedBy := make(map[string][]string)
+	for _, g := range gpos.Entries {
+		value := g.GetAttributeValue("gPCWQLFilter")
+		m := gpcWQLFilterRegex.FindStringSubmatch(value)
+		if m == nil {
+			session.Log.Warnf("unable to parse gPCWQLFilter %q of %s", value, g.DN)
+			continue
+		}
+		name := g.GetAttributeValue("displayName")
+		if name == "" {
+			name = g.GetAttributeValue("cn")
+		}
+		id := strings.ToLower(m[2])
+		if !known[id] {
+			// the GPO still applies, just without a filter, so it reaches more systems than intended
+			session.Log.Warnf("GPO %q uses WMI filter %s, which doesn't exist", name, m[2])
+			continue
+		}
+		usedBy[id] = append(usedBy[id], name)
+	}
+
+	var entries []*ldap.Entry
+	for _, f := range filters.Entries {
+		used := usedBy[strings.ToLower(wmiFilterID(f))]
+		if w.UnusedOnly && len(used) > 0 {
+			continue
+		}
+		values := map[string][]string{"msWMI-Name": {f.GetAttributeValue("msWMI-Name")}}
+		for _, attr := range []string{"msWMI-Parm1", "msWMI-Author", "msWMI-ChangeDate"} {
+			if v := f.GetAttributeValue(attr); v != "" {
+				values[attr] = []string{v}
+			}
+		}
+		queries, err := parseWMIQueries(f.GetAttributeValue("msWMI-Parm2"))
+		if err != nil {
+			session.Log.Warnf("unable to parse the queries of WMI filter %s: %s", f.DN, err)
+		}
+		if len(queries) > 0 {
+			values["queries"] = queries
+		}
+		if len(used) > 0 {
+			sort.Strings(used)
+			values["gpos"] = used
+		}
+		entries = append(entries, ldap.NewEntry(f.DN, values))
+	}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+	return nil
+}
+
+// wmiFilterID is the {GUID} GPOs refer to a filter by, which is also its cn
+func wmiFilterID(entry *ldap.Entry) string {
+	if id := entry.GetAttributeValue("msWMI-ID"); id != "" {
+		return id
+	}
+	return entry.GetAttributeValue("cn")
+}
+
+// parseWMIQueries splits the msWMI-Parm2 of a filter into "namespace: query" strings. The value is the number of
+// queries, then for each the lengths of its language, namespace and query followed by the three of them, all separated
+// by semicolons: 1;3;10;45;WQL;root\CIMv2;SELECT * FROM Win32_OperatingSystem WHERE ...;
+func parseWMIQueries(parm2 string) ([]string, error) {
+	if parm2 == "" {
+		return nil, nil
+	}
+	rest := parm2
+	next := func() (int, error) {
+		i := strings.IndexByte(rest, ';')
+		if i < 0 {
+			return 0, fmt.Errorf("value is truncated")
+		}
+		n, err := strconv.Atoi(rest[:i])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid length %q", rest[:i])
+		}
+		rest = rest[i+1:]
+		return n, nil
+	}
+	field := func(n int) (string, error) {
+		// lengths count UTF-16 code units, which is the same as runes outside of emoji and the like
+		runes := []rune(rest)
+		if len(runes) < n+1 || runes[n] != ';' {
+			return "", fmt.Errorf("value is truncated")
+		}
+		rest = string(runes[n+1:])
+		return string(runes[:n]), nil
+	}
+
+	count, err := next()
+	if err != nil {
+		return nil, err
+	}
+	var queries []string
+	for i := 0; i < count; i++ {
+		var lengths [3]int
+		for j := range lengths {
+			if lengths[j], err = next(); err != nil {
+				return queries, err
+			}
+		}
+		var parts [3]string
+		for j := range parts {
+			if parts[j], err = field(lengths[j]); err != nil {
+				return queries, err
+			}
+		}
+		queries = append(queries, fmt.Sprintf("%s: %s", parts[1], parts[2]))
+	}
+	return queries, nil
+}
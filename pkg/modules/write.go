@@ -0,0 +1,72 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+func init() {
+	adschema.RegisterAttribute("action", "String(Unicode)", true)
+	adschema.RegisterAttribute("status", "String(Unicode)", true)
+}
+
+// resolveDN returns the DN of an object given either its DN or its sAMAccountName. filter restricts which objects
+// a sAMAccountName can match (e.g. "(objectCategory=group)")
+func resolveDN(session *ldapsession.LDAPSession, name, filter string) (string, error) {
+	if strings.Contains(name, "=") {
+		return name, nil
+	}
+	sr := session.MakeSimpleSearchRequest(fmt.Sprintf("(&%s(sAMAccountName=%s))", filter, ldap.EscapeFilter(name)), []string{"distinguishedName"})
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return "", err
+	}
+	switch len(res.Entries) {
+	case 0:
+		return "", fmt.Errorf("no object found with sAMAccountName %q", name)
+	case 1:
+		return res.Entries[0].DN, nil
+	}
+	return "", fmt.Errorf("more than one object found with sAMAccountName %q, use the full DN", name)
+}
+
+// lookupSID returns the objectSid of an object given its DN or sAMAccountName
+func lookupSID(session *ldapsession.LDAPSession, name string) (secdesc.SID, error) {
+	dn, err := resolveDN(session, name, "")
+	if err != nil {
+		return secdesc.SID{}, err
+	}
+	sr := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"objectSid"}, nil)
+	res, err := session.GetSearchResults(sr)
+	if err != nil {
+		return secdesc.SID{}, err
+	}
+	if len(res.Entries) == 0 || len(res.Entries[0].GetRawAttributeValue("objectSid")) == 0 {
+		return secdesc.SID{}, fmt.Errorf("no objectSid found for %q", dn)
+	}
+	sid, _, err := secdesc.DecodeSID(res.Entries[0].GetRawAttributeValue("objectSid"))
+	return sid, err
+}
+
+// writeStatus describes the outcome of a change for module output
+func writeStatus(session *ldapsession.LDAPSession, applied bool) string {
+	if applied {
+		return "applied"
+	}
+	if session.DryRun() {
+		return "dry run"
+	}
+	return "unchanged"
+}
+
+// writeResult sends a single entry describing a change to the results channel
+func writeResult(session *ldapsession.LDAPSession, dn string, values map[string][]string, attrs []string) {
+	entries := []*ldap.Entry{ldap.NewEntry(dn, values)}
+	session.ManualWriteSearchResultsToChan(&ldap.SearchResult{Entries: filterEntryAttributes(entries, attrs)})
+}
@@ -0,0 +1,165 @@
+// Package redact keeps credentials out of logs and error messages. Secrets (passwords, hashes, LAPS passwords, ...)
+// are registered with Add as soon as they're known, and everything that's logged, or printed as an error, goes
+// through String first, which replaces every secret registered so far
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Mask is what secrets are replaced with
+const Mask = "[REDACTED]"
+
+var (
+	mu      sync.RWMutex
+	secrets = make(map[string]bool)
+	// sorted is secrets longest first, so a secret that contains another is replaced whole
+	sorted []string
+)
+
+// Add registers secrets to redact. Besides the secret itself, the forms it's printed in are covered too: escaped
+// as by %q (which is how LDAP packets are dumped) or in JSON, and for hex (e.g. NT hashes) in either case and each
+// half of LM:NT. Empty secrets are ignored, but short ones aren't, so a one character password makes for hard to
+// read logs
+func Add(values ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		forms := []string{v}
+		if isHex(v) {
+			// LM:NT hashes are also used one half at a time
+			for _, h := range append(strings.Split(v, ":"), v) {
+				forms = append(forms, h, strings.ToLower(h), strings.ToUpper(h))
+			}
+		}
+		if q := strconv.Quote(v); q[1:len(q)-1] != v {
+			forms = append(forms, q[1:len(q)-1])
+		}
+		if j, err := json.Marshal(v); err == nil && string(j[1:len(j)-1]) != v {
+			forms = append(forms, string(j[1:len(j)-1]))
+		}
+		for _, f := range forms {
+			if f != "" {
+				secrets[f] = true
+			}
+		}
+	}
+	sorted = sorted[:0]
+	for s := range secrets {
+		sorted = append(sorted, s)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+}
+
+// String replaces the registered secrets in s
+func String(s string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, secret := range sorted {
+		if strings.Contains(s, secret) {
+			s = strings.Replace(s, secret, Mask, -1)
+		}
+	}
+	return s
+}
+
+// Error is err with the registered secrets replaced in its message. It's nil if err is
+func Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := String(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return redactedError{msg: msg, err: err}
+}
+
+// redactedError keeps the original error, so callers can still check what kind it was
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e redactedError) Error() string { return e.msg }
+func (e redactedError) Unwrap() error { return e.err }
+
+// Formatter redacts log entries: the message and field values before they're formatted, and what the wrapped
+// formatter makes of them, in case it escapes a secret in a way the fields didn't show
+type Formatter struct {
+	logrus.Formatter
+}
+
+func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
+	e := *entry
+	e.Message = String(entry.Message)
+	e.Data = make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		switch value := v.(type) {
+		case string:
+			v = String(value)
+		case error:
+			v = Error(value)
+		case []string:
+			redacted := make([]string, len(value))
+			for i, s := range value {
+				redacted[i] = String(s)
+			}
+			v = redacted
+		}
+		e.Data[k] = v
+	}
+	b, err := f.Formatter.Format(&e)
+	if err != nil {
+		return b, err
+	}
+	return []byte(String(string(b))), nil
+}
+
+// Writer redacts everything written to w a line at a time, for output that doesn't go through logrus (e.g. the LDAP
+// library's packet dumps). Lines are held until their newline, so a secret isn't split across two writes
+func Writer(w io.Writer) io.Writer {
+	return &writer{out: w}
+}
+
+type writer struct {
+	mu  sync.Mutex
+	out io.Writer
+	buf bytes.Buffer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := w.buf.Next(i + 1)
+		if _, err := io.WriteString(w.out, String(string(line))); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+func isHex(s string) bool {
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF:", r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,203 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ropnop/go-windapsearch/pkg/redact"
+)
+
+// awsCredentials are the keys AWS requests are signed with
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// awsSecret reads a secret from AWS Secrets Manager, by name or ARN. The region comes from ?region=, the ARN,
+// AWS_REGION or AWS_DEFAULT_REGION, and the credentials from the AWS_ACCESS_KEY_ID environment variables or the
+// shared credentials file's AWS_PROFILE (default) profile. Instance and container roles aren't looked up, so on
+// AWS export them first (e.g. with `aws configure export-credentials --format env`)
+func awsSecret(id, field string) (string, error) {
+	region := ""
+	if i := strings.Index(id, "?"); i >= 0 {
+		query, err := url.ParseQuery(id[i+1:])
+		if err != nil {
+			return "", fmt.Errorf("invalid query in secret URI: %s", err)
+		}
+		id, region = id[:i], query.Get("region")
+	}
+	if region == "" && strings.HasPrefix(id, "arn:") {
+		// arn:aws:secretsmanager:REGION:ACCOUNT:secret:NAME
+		if parts := strings.SplitN(id, ":", 5); len(parts) == 5 {
+			region = parts[3]
+		}
+	}
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return "", fmt.Errorf("no region, add ?region= or set AWS_REGION")
+	}
+	creds, err := awsEnvCredentials()
+	if err != nil {
+		return "", err
+	}
+
+	body, _ := json.Marshal(map[string]string{"SecretId": id})
+	host := "secretsmanager." + region + ".amazonaws.com"
+	req, err := http.NewRequest("POST", "https://"+host+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSRequest(req, body, creds, region, "secretsmanager", time.Now().UTC())
+	res, err := httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var secret struct {
+		SecretString string `json:"SecretString"`
+		SecretBinary string `json:"SecretBinary"`
+		Type         string `json:"__type"`
+		Message      string `json:"message"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&secret); err != nil {
+		return "", fmt.Errorf("unable to parse the response (%d): %s", res.StatusCode, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		// error types are sometimes prefixed with a namespace, e.g. "com.amazon.coral.service#ExpiredTokenException"
+		kind := secret.Type[strings.LastIndex(secret.Type, "#")+1:]
+		return "", fmt.Errorf("unable to read %s (%d): %s %s", id, res.StatusCode, kind, secret.Message)
+	}
+	if secret.SecretString == "" && secret.SecretBinary != "" {
+		b, err := base64.StdEncoding.DecodeString(secret.SecretBinary)
+		if err != nil {
+			return "", fmt.Errorf("unable to decode SecretBinary: %s", err)
+		}
+		secret.SecretString = string(b)
+	}
+	// the whole JSON too, in case the password can't be picked out of it
+	redact.Add(secret.SecretString)
+	return jsonField(secret.SecretString, field)
+}
+
+// awsEnvCredentials finds credentials the way the AWS CLI does, short of the instance and container roles
+func awsEnvCredentials() (awsCredentials, error) {
+	creds := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" {
+		path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+		if path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return creds, err
+			}
+			path = filepath.Join(home, ".aws", "credentials")
+		}
+		profile := os.Getenv("AWS_PROFILE")
+		if profile == "" {
+			profile = "default"
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return creds, fmt.Errorf("no credentials, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or add them to %s", path)
+		}
+		values := iniSection(b, profile)
+		creds = awsCredentials{
+			AccessKeyID:     values["aws_access_key_id"],
+			SecretAccessKey: values["aws_secret_access_key"],
+			SessionToken:    values["aws_session_token"],
+		}
+		if creds.AccessKeyID == "" {
+			return creds, fmt.Errorf("no credentials for profile %q in %s", profile, path)
+		}
+	}
+	if creds.SecretAccessKey == "" {
+		return creds, fmt.Errorf("no secret access key for %s", creds.AccessKeyID)
+	}
+	redact.Add(creds.SecretAccessKey, creds.SessionToken)
+	return creds, nil
+}
+
+// iniSection returns the key = value pairs of a section of an INI file, like the AWS shared credentials file
+func iniSection(b []byte, section string) map[string]string {
+	values := make(map[string]string)
+	current := ""
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			current = strings.TrimSpace(line[1 : len(line)-1])
+		case current == section:
+			if i := strings.Index(line, "="); i >= 0 {
+				values[strings.ToLower(strings.TrimSpace(line[:i]))] = strings.TrimSpace(line[i+1:])
+			}
+		}
+	}
+	return values
+}
+
+// signAWSRequest adds a Signature Version 4 Authorization header to a request to the root path of a service, signing
+// every header set on it
+func signAWSRequest(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	bodyHash := sha256.Sum256(body)
+	canonical := strings.Join([]string{req.Method, "/", "", canonicalHeaders.String(), signedHeaders, hex.EncodeToString(bodyHash[:])}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := mac(mac(mac(mac([]byte("AWS4"+creds.SecretAccessKey), date), region), service), "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, hex.EncodeToString(mac(key, toSign))))
+}
@@ -0,0 +1,107 @@
+package secrets
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the credentials, region, service and time of AWS's Signature Version 4 test suite
+var (
+	sigV4TestCreds = awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	sigV4TestTime  = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+)
+
+const sigV4TestToken = "AQoDYXdzEPT//////////wEXAMPLEtc764bNrC9SAPBSM22wDOk4x4HIZ8j4FZTwdQWLWsKWHGBuFqwAeMicRXmxfpSPfIeoIYRqTflfKD8YUuwthAx7mSEI/qkPpKPi/kMcGdQrmGdeehM4IC1NtBmUpp2wUE8phUZampKsburEDy0KPkyQDYwT7WZ0wq5VSXDvp75YU9HFvlRd8Tx6q6fE8YQcHNVXAkiY9q6d+xo0rKwT38xVqr7ZD0u0iPPkUL64lIZbqBAz+scqKmlzm8FDrypNC9Yjc8fPOLn9FX9KSYvKTr4rvx3iSIlTJabIQwj2ICCR/oLxBA=="
+
+func TestSignAWSRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name, method, body string
+		headers            map[string]string
+		token              string
+		want               string
+	}{
+		{
+			name:   "get-vanilla",
+			method: "GET",
+			want:   "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			name:   "post-vanilla",
+			method: "POST",
+			want:   "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		{
+			name:    "post-x-www-form-urlencoded",
+			method:  "POST",
+			body:    "Param1=value1",
+			headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			want:    "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		},
+		{
+			name:   "post-sts-header-before",
+			method: "POST",
+			token:  sigV4TestToken,
+			want:   "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date;x-amz-security-token, Signature=85d96828115b5dc0cfc3bd16ad9e210dd772bbebba041836c64533a82be05ead",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, "https://example.amazonaws.com/", strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			creds := sigV4TestCreds
+			creds.SessionToken = tc.token
+			signAWSRequest(req, []byte(tc.body), creds, "us-east-1", "service", sigV4TestTime)
+			if got := req.Header.Get("Authorization"); got != tc.want {
+				t.Errorf("got Authorization\n%s\nwant\n%s", got, tc.want)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+				t.Errorf("got X-Amz-Date %q", got)
+			}
+			if got := req.Header.Get("X-Amz-Security-Token"); got != tc.token {
+				t.Errorf("got X-Amz-Security-Token %q, want %q", got, tc.token)
+			}
+		})
+	}
+}
+
+func TestINISection(t *testing.T) {
+	file := []byte(`# a comment
+[default]
+aws_access_key_id = AKIDDEFAULT
+aws_secret_access_key=secret/with=equals
+
+; another comment
+[ work ]
+AWS_Access_Key_ID =  AKIDWORK
+aws_secret_access_key = work-secret
+aws_session_token = token==
+[profile other]
+aws_access_key_id = AKIDOTHER
+`)
+	for _, tc := range []struct {
+		section string
+		want    map[string]string
+	}{
+		{"default", map[string]string{"aws_access_key_id": "AKIDDEFAULT", "aws_secret_access_key": "secret/with=equals"}},
+		{"work", map[string]string{"aws_access_key_id": "AKIDWORK", "aws_secret_access_key": "work-secret", "aws_session_token": "token=="}},
+		{"profile other", map[string]string{"aws_access_key_id": "AKIDOTHER"}},
+		{"missing", map[string]string{}},
+	} {
+		got := iniSection(file, tc.section)
+		if len(got) != len(tc.want) {
+			t.Errorf("section %q: got %v, want %v", tc.section, got, tc.want)
+			continue
+		}
+		for k, v := range tc.want {
+			if got[k] != v {
+				t.Errorf("section %q: got %s = %q, want %q", tc.section, k, got[k], v)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package secrets
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// keyringSecret reads a password from the OS keyring with its own tool: the login keychain on macOS (security), or
+// the Secret Service (GNOME Keyring, KWallet) through secret-tool elsewhere, looked up by the service and account
+// attributes secret-tool store is given
+func keyringSecret(name string) (string, error) {
+	service, account := splitKeyringName(name)
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		args := []string{"find-generic-password", "-w", "-s", service}
+		if account != "" {
+			args = append(args, "-a", account)
+		}
+		cmd = exec.Command("security", args...)
+	} else {
+		args := []string{"lookup", "service", service}
+		if account != "" {
+			args = append(args, "account", account)
+		}
+		cmd = exec.Command("secret-tool", args...)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s failed: %s", cmd.Args[0], msg)
+		}
+		if _, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("no password for %s in the keyring", name)
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
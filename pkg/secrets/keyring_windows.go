@@ -0,0 +1,79 @@
+//go:build windows
+// +build windows
+
+package secrets
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"unicode/utf16"
+	"unsafe"
+)
+
+var (
+	advapi32     = syscall.NewLazyDLL("advapi32.dll")
+	procCredRead = advapi32.NewProc("CredReadW")
+	procCredFree = advapi32.NewProc("CredFree")
+)
+
+// credGeneric is CRED_TYPE_GENERIC, the credentials cmdkey /generic adds
+const credGeneric = 1
+
+// credential is the start of a CREDENTIALW, up to the fields read here
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// keyringSecret reads a password from the Windows Credential Manager: the generic credential named after the
+// service (as added with cmdkey /generic:SERVICE /user:ACCOUNT /pass), which must be for the account if one is given
+func keyringSecret(name string) (string, error) {
+	service, account := splitKeyringName(name)
+	target, err := syscall.UTF16PtrFromString(service)
+	if err != nil {
+		return "", err
+	}
+	var cred *credential
+	if r, _, err := procCredRead.Call(uintptr(unsafe.Pointer(target)), credGeneric, 0, uintptr(unsafe.Pointer(&cred))); r == 0 {
+		if err == syscall.Errno(1168) { // ERROR_NOT_FOUND
+			return "", fmt.Errorf("no generic credential named %s in the Credential Manager", service)
+		}
+		return "", fmt.Errorf("CredRead failed: %s", err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	if user := utf16PtrToString(cred.UserName); account != "" && !strings.EqualFold(user, account) {
+		return "", fmt.Errorf("the %s credential is for %s, not %s", service, user, account)
+	}
+	if cred.CredentialBlobSize == 0 || cred.CredentialBlob == nil {
+		return "", nil
+	}
+	// passwords added by cmdkey and the control panel are UTF-16LE
+	blob := (*[1 << 20]byte)(unsafe.Pointer(cred.CredentialBlob))[:cred.CredentialBlobSize:cred.CredentialBlobSize]
+	u := make([]uint16, len(blob)/2)
+	for i := range u {
+		u[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+	}
+	return string(utf16.Decode(u)), nil
+}
+
+func utf16PtrToString(p *uint16) string {
+	if p == nil {
+		return ""
+	}
+	var u []uint16
+	for ptr := unsafe.Pointer(p); *(*uint16)(ptr) != 0; ptr = unsafe.Pointer(uintptr(ptr) + 2) {
+		u = append(u, *(*uint16)(ptr))
+	}
+	return string(utf16.Decode(u))
+}
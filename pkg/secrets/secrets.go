@@ -0,0 +1,126 @@
+// Package secrets fetches credentials from external secret stores, for runs (e.g. scheduled collections) that
+// shouldn't have a password on the command line or in a file. A secret is named by a URI whose scheme picks the
+// store: vault:// for HashiCorp Vault, aws-sm:// for AWS Secrets Manager, and keyring:// for the OS keyring
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ropnop/go-windapsearch/pkg/redact"
+)
+
+// DefaultTimeout is how long to wait for a secret store to answer
+const DefaultTimeout = 30 * time.Second
+
+// DefaultField is the key a secret's password is read from when it holds more than one value
+const DefaultField = "password"
+
+// Schemes are the URI schemes Fetch understands, with the form they take
+var Schemes = []string{"vault://PATH[#FIELD]", "aws-sm://SECRET-ID[?region=REGION][#FIELD]", "keyring://SERVICE[/ACCOUNT]"}
+
+// Fetch reads the secret a URI names. The secret is registered with redact before it's returned, so it never
+// shows in logs
+func Fetch(uri string) (string, error) {
+	scheme, rest, field, err := splitURI(uri)
+	if err != nil {
+		return "", err
+	}
+	var secret string
+	switch scheme {
+	case "vault":
+		secret, err = vaultSecret(rest, field)
+	case "aws-sm":
+		secret, err = awsSecret(rest, field)
+	case "keyring":
+		if field != "" {
+			return "", fmt.Errorf("keyring secrets have no fields, remove #%s", field)
+		}
+		secret, err = keyringSecret(rest)
+	default:
+		return "", fmt.Errorf("unknown secret store %q (must be one of %s)", scheme, strings.Join(Schemes, ", "))
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", scheme, err)
+	}
+	if secret == "" {
+		return "", fmt.Errorf("%s: the secret is empty", scheme)
+	}
+	redact.Add(secret)
+	return secret, nil
+}
+
+// splitURI splits a secret URI into its scheme, what follows it, and the #field. It's split by hand rather than
+// with net/url, since AWS ARNs (arn:aws:secretsmanager:...) don't parse as a host
+func splitURI(uri string) (scheme, rest, field string, err error) {
+	i := strings.Index(uri, "://")
+	if i <= 0 {
+		return "", "", "", fmt.Errorf("invalid secret URI %q, expected one of %s", uri, strings.Join(Schemes, ", "))
+	}
+	scheme, rest = strings.ToLower(uri[:i]), uri[i+3:]
+	if j := strings.LastIndex(rest, "#"); j >= 0 {
+		rest, field = rest[:j], rest[j+1:]
+	}
+	if rest == "" {
+		return "", "", "", fmt.Errorf("invalid secret URI %q, nothing after %s://", uri, scheme)
+	}
+	return scheme, rest, field, nil
+}
+
+// secretField picks the password out of a secret holding several values: field if one was asked for, otherwise
+// DefaultField, or the only value there is
+func secretField(values map[string]interface{}, field string) (string, error) {
+	name := field
+	if name == "" {
+		name = DefaultField
+		if _, ok := values[name]; !ok && len(values) == 1 {
+			for k := range values {
+				name = k
+			}
+		}
+	}
+	v, ok := values[name]
+	if !ok {
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return "", fmt.Errorf("the secret has no %q field (it has %s), pick one with #FIELD", name, strings.Join(keys, ", "))
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("the secret's %q field isn't a string", name)
+	}
+	return s, nil
+}
+
+// jsonField picks a field out of a secret stored as a string, which may be a JSON object of values (as the AWS
+// console stores key/value secrets) or the password itself
+func jsonField(secret, field string) (string, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &values); err != nil {
+		if field != "" {
+			return "", fmt.Errorf("the secret isn't a JSON object, so it has no %q field", field)
+		}
+		return secret, nil
+	}
+	return secretField(values, field)
+}
+
+// httpClient is for talking to secret stores, through the proxy in HTTPS_PROXY if there is one
+func httpClient() *http.Client {
+	return &http.Client{Timeout: DefaultTimeout, Transport: http.DefaultTransport.(*http.Transport).Clone()}
+}
+
+// splitKeyringName splits a keyring:// name into the service and, if there is one, account
+func splitKeyringName(name string) (service, account string) {
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
@@ -0,0 +1,101 @@
+package secrets
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitURI(t *testing.T) {
+	for _, tc := range []struct {
+		uri                 string
+		scheme, rest, field string
+		err                 bool
+	}{
+		{uri: "vault://secret/windapsearch", scheme: "vault", rest: "secret/windapsearch"},
+		{uri: "vault://secret/windapsearch#bind", scheme: "vault", rest: "secret/windapsearch", field: "bind"},
+		{uri: "AWS-SM://prod/ldap?region=eu-west-1#password", scheme: "aws-sm", rest: "prod/ldap?region=eu-west-1", field: "password"},
+		{
+			uri:    "aws-sm://arn:aws:secretsmanager:us-east-1:123456789012:secret:prod/ldap-AbCdEf#svc_ldap",
+			scheme: "aws-sm",
+			rest:   "arn:aws:secretsmanager:us-east-1:123456789012:secret:prod/ldap-AbCdEf",
+			field:  "svc_ldap",
+		},
+		{uri: "keyring://windapsearch/svc_ldap", scheme: "keyring", rest: "windapsearch/svc_ldap"},
+		// only the last # starts the field
+		{uri: "vault://secret/a#b#c", scheme: "vault", rest: "secret/a#b", field: "c"},
+		{uri: "secret/windapsearch", err: true},
+		{uri: "://secret", err: true},
+		{uri: "vault://", err: true},
+		{uri: "vault://#password", err: true},
+	} {
+		scheme, rest, field, err := splitURI(tc.uri)
+		if tc.err {
+			if err == nil {
+				t.Errorf("splitURI(%q) should fail, got %q %q %q", tc.uri, scheme, rest, field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitURI(%q): %s", tc.uri, err)
+			continue
+		}
+		if scheme != tc.scheme || rest != tc.rest || field != tc.field {
+			t.Errorf("splitURI(%q) = %q %q %q, want %q %q %q", tc.uri, scheme, rest, field, tc.scheme, tc.rest, tc.field)
+		}
+	}
+}
+
+func TestSecretField(t *testing.T) {
+	values := map[string]interface{}{"username": "svc_ldap", "password": "Winter2024!", "port": 389.0}
+	for _, tc := range []struct {
+		values  map[string]interface{}
+		field   string
+		want    string
+		wantErr string
+	}{
+		{values: values, want: "Winter2024!"},
+		{values: values, field: "username", want: "svc_ldap"},
+		{values: map[string]interface{}{"bind": "only-value"}, want: "only-value"},
+		{values: values, field: "port", wantErr: `"port" field isn't a string`},
+		{values: values, field: "missing", wantErr: "has no \"missing\" field (it has password, port, username)"},
+		{values: map[string]interface{}{"a": "1", "b": "2"}, wantErr: "has no \"password\" field (it has a, b)"},
+	} {
+		got, err := secretField(tc.values, tc.field)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("secretField(%v, %q): got error %v, want one containing %q", tc.values, tc.field, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("secretField(%v, %q) = %q, %v, want %q", tc.values, tc.field, got, err, tc.want)
+		}
+	}
+}
+
+func TestJSONField(t *testing.T) {
+	for _, tc := range []struct {
+		secret, field, want string
+		err                 bool
+	}{
+		{secret: `{"username":"svc_ldap","password":"Winter2024!"}`, want: "Winter2024!"},
+		{secret: `{"username":"svc_ldap","password":"Winter2024!"}`, field: "username", want: "svc_ldap"},
+		{secret: `{"ldap":"p@ss{word}"}`, want: "p@ss{word}"},
+		// a plain string is the password itself
+		{secret: "Winter2024!", want: "Winter2024!"},
+		{secret: `{not json`, want: `{not json`},
+		{secret: "Winter2024!", field: "password", err: true},
+		{secret: `["a","b"]`, field: "password", err: true},
+	} {
+		got, err := jsonField(tc.secret, tc.field)
+		if tc.err {
+			if err == nil {
+				t.Errorf("jsonField(%q, %q) should fail, got %q", tc.secret, tc.field, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("jsonField(%q, %q) = %q, %v, want %q", tc.secret, tc.field, got, err, tc.want)
+		}
+	}
+}
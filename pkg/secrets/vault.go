@@ -0,0 +1,120 @@
+package secrets
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ropnop/go-windapsearch/pkg/redact"
+)
+
+// defaultVaultAddr is where the vault CLI looks for a server when VAULT_ADDR isn't set
+const defaultVaultAddr = "https://127.0.0.1:8200"
+
+// vaultResponse is the part of a Vault API response that matters here
+type vaultResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []string               `json:"errors"`
+}
+
+// vaultSecret reads a secret from a KV secrets engine, configured the way the vault CLI is: VAULT_ADDR, VAULT_TOKEN
+// (or the token `vault login` saved in ~/.vault-token), VAULT_NAMESPACE, VAULT_CACERT and VAULT_SKIP_VERIFY. Paths
+// are given as to `vault kv get`, so secret/windapsearch rather than secret/data/windapsearch for KV version 2
+func vaultSecret(path, field string) (string, error) {
+	addr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		addr = defaultVaultAddr
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			if b, err := ioutil.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+				token = strings.TrimSpace(string(b))
+			}
+		}
+	}
+	if token == "" {
+		return "", fmt.Errorf("no token, set VAULT_TOKEN or run vault login")
+	}
+	redact.Add(token)
+	// parsed the way the vault CLI does, so VAULT_SKIP_VERIFY=false still verifies
+	skipVerify := false
+	if v := os.Getenv("VAULT_SKIP_VERIFY"); v != "" {
+		var err error
+		if skipVerify, err = strconv.ParseBool(v); err != nil {
+			return "", fmt.Errorf("unable to parse VAULT_SKIP_VERIFY %q: %s", v, err)
+		}
+	}
+	client := httpClient()
+	transport := client.Transport.(*http.Transport)
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: skipVerify}
+	if ca := os.Getenv("VAULT_CACERT"); ca != "" {
+		b, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return "", err
+		}
+		transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+		if !transport.TLSClientConfig.RootCAs.AppendCertsFromPEM(b) {
+			return "", fmt.Errorf("no PEM certificates found in VAULT_CACERT %q", ca)
+		}
+	}
+	get := func(p string) (*vaultResponse, int, error) {
+		req, err := http.NewRequest("GET", addr+"/v1/"+p, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		req.Header.Set("X-Vault-Token", token)
+		if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+			req.Header.Set("X-Vault-Namespace", ns)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer res.Body.Close()
+		var body vaultResponse
+		if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body); err != nil && res.StatusCode == http.StatusOK {
+			return nil, res.StatusCode, fmt.Errorf("unable to parse the response from %s: %s", addr, err)
+		}
+		return &body, res.StatusCode, nil
+	}
+
+	path = strings.Trim(path, "/")
+	// KV version 2 keeps secrets under data/ in the mount, which the CLI hides by asking which mount a path is in
+	// and what version it is first. Tokens only allowed to read the secret can't always ask, and then the path is
+	// read as given
+	apiPath := path
+	if mount, status, err := get("sys/internal/ui/mounts/" + path); err == nil && status == http.StatusOK {
+		prefix, _ := mount.Data["path"].(string)
+		options, _ := mount.Data["options"].(map[string]interface{})
+		if version, _ := options["version"].(string); version == "2" && strings.HasPrefix(path+"/", prefix) {
+			apiPath = strings.TrimSuffix(prefix, "/") + "/data/" + strings.TrimPrefix(path, prefix)
+		}
+	}
+	secret, status, err := get(apiPath)
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK {
+		if len(secret.Errors) > 0 {
+			return "", fmt.Errorf("unable to read %s (%d): %s", path, status, strings.Join(secret.Errors, ", "))
+		}
+		return "", fmt.Errorf("unable to read %s (%d)", path, status)
+	}
+	values := secret.Data
+	// KV version 2 wraps the values with their metadata
+	if inner, ok := values["data"].(map[string]interface{}); ok {
+		if _, ok := values["metadata"]; ok {
+			values = inner
+		}
+	}
+	return secretField(values, field)
+}
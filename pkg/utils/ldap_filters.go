@@ -1,6 +1,11 @@
 package utils
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
 
 func AddAndFilter(filter, extra string) string {
 	return fmt.Sprintf("(&(%s)(%s))", filter, extra)
@@ -10,6 +15,12 @@ func AddOrFilter(filter, extra string) string {
 	return fmt.Sprintf("(|(%s)(%s)", filter, extra)
 }
 
+// CreateANRSearch returns an ANR filter (without the outer parentheses) for a search term. The term is escaped so
+// names with parentheses or backslashes (e.g. "Müller (IT)") can be searched for, but * is kept as a wildcard
 func CreateANRSearch(search string) string {
-	return fmt.Sprintf("anr=%s", search)
+	parts := strings.Split(search, "*")
+	for i, part := range parts {
+		parts[i] = ldap.EscapeFilter(part)
+	}
+	return fmt.Sprintf("anr=%s", strings.Join(parts, "*"))
 }
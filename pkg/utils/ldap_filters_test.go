@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestCreateANRSearch(t *testing.T) {
+	for _, tc := range []struct {
+		search, want string
+	}{
+		{"jörg", `anr=j\c3\b6rg`},
+		{"Müller (IT)", `anr=M\c3\bcller \28IT\29`},
+		{"渡辺*", `anr=\e6\b8\a1\e8\be\ba*`},
+		{"*Пётр*", `anr=*\d0\9f\d1\91\d1\82\d1\80*`},
+		{`LAB\svc_sql`, `anr=LAB\5csvc_sql`},
+		{"a*b", "anr=a*b"},
+		{"admin", "anr=admin"},
+		{"", "anr="},
+	} {
+		got := CreateANRSearch(tc.search)
+		if got != tc.want {
+			t.Errorf("CreateANRSearch(%q) = %q, want %q", tc.search, got, tc.want)
+		}
+		if _, err := ldap.CompileFilter("(" + got + ")"); err != nil {
+			t.Errorf("CreateANRSearch(%q) = %q doesn't compile: %s", tc.search, got, err)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package windapsearch
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+// the attributes --anonymize knows how to pseudonymize, by the kind of value they hold (lower case). Attributes with
+// DN or SID syntax are found from the schema
+var (
+	anonymizeNameAttrs = map[string]bool{"cn": true, "name": true, "samaccountname": true, "displayname": true,
+		"givenname": true, "sn": true, "initials": true, "displaynameprintable": true, "ou": true}
+	anonymizePrincipalAttrs = map[string]bool{"userprincipalname": true, "mail": true}
+	anonymizeHostAttrs      = map[string]bool{"dnshostname": true, "msds-additionaldnshostname": true}
+	anonymizeDomainAttrs    = map[string]bool{"dc": true, "dnsroot": true, "trustpartner": true, "flatname": true,
+		"netbiosname": true}
+	anonymizeSPNAttrs  = map[string]bool{"serviceprincipalname": true, "msds-allowedtodelegateto": true}
+	anonymizeTextAttrs = map[string]bool{"description": true, "info": true, "comment": true, "title": true,
+		"department": true, "company": true, "physicaldeliveryofficename": true, "telephonenumber": true, "mobile": true,
+		"homephone": true, "streetaddress": true, "l": true, "st": true, "postalcode": true, "co": true,
+		"homedirectory": true, "profilepath": true, "scriptpath": true, "userworkstations": true, "employeeid": true,
+		"employeenumber": true, "admindescription": true, "wwwhomepage": true, "url": true, "proxyaddresses": true}
+	// anonymizeKeepAttrs hold schema names, not anything about the environment
+	anonymizeKeepAttrs = map[string]bool{"objectclass": true}
+)
+
+var (
+	anonymizeDomainSIDRegex = regexp.MustCompile(`S-1-5-21-\d+-\d+-\d+`)
+	anonymizeIPv4Regex      = regexp.MustCompile(`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b`)
+	anonymizeDNRegex        = regexp.MustCompile(`(?i)\b(?:CN|OU)=[^;"\n]*?DC=[A-Za-z0-9-]+(?:,DC=[A-Za-z0-9-]+)*`)
+	anonymizeAccountRegex   = regexp.MustCompile(`\b([A-Za-z0-9-]+)\\([^\s\\,;:()"']+)`)
+	anonymizeWordRegex      = regexp.MustCompile(`[A-Za-z0-9][A-Za-z0-9_.$-]*`)
+)
+
+// anonymizedAuthorities are the DOMAIN parts of DOMAIN\name that aren't a domain
+var anonymizedAuthorities = map[string]bool{"builtin": true, "authority": true, "service": true, "label": true}
+
+// anonymizer replaces the names, SIDs, hostnames and addresses in results with pseudonyms for --anonymize. Every
+// pseudonym is a keyed hash of what it replaces, so the same name gets the same one everywhere in the run (and in
+// other runs with the same --anonymize-key), keeping the results linkable. Without the key, the pseudonyms can't be
+// reversed by hashing a list of likely names. Well-known names (Domain Admins, Users, krbtgt...) are kept, so the
+// results still mean something
+type anonymizer struct {
+	key  []byte
+	keep map[string]bool
+
+	// mu guards seen, the lower case values replaced so far with their pseudonyms, which are replaced wherever else
+	// they turn up in free text, and domainSIDs, the binary form of the domain SIDs seen with their replacement, for
+	// SIDs inside binary values (security descriptors, tokenGroups)
+	mu         sync.Mutex
+	seen       map[string]string
+	domains    []string
+	domainSIDs map[string][]byte
+}
+
+func newAnonymizer(key string) (*anonymizer, error) {
+	a := &anonymizer{
+		key:        []byte(key),
+		keep:       anonymizeKeepNames(),
+		seen:       make(map[string]string),
+		domainSIDs: make(map[string][]byte),
+	}
+	if key == "" {
+		a.key = make([]byte, 32)
+		if _, err := rand.Read(a.key); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// anonymizeKeepNames are the lower case names every domain has, which say nothing about the environment
+func anonymizeKeepNames() map[string]bool {
+	keep := map[string]bool{"configuration": true, "schema": true, "domaindnszones": true, "forestdnszones": true}
+	for _, name := range secdesc.DomainRIDs {
+		keep[strings.ToLower(name)] = true
+	}
+	for rid := uint32(544); rid <= 582; rid++ {
+		if name, ok := secdesc.WellKnownName(secdesc.MustParseSID(fmt.Sprintf("S-1-5-32-%d", rid))); ok {
+			keep[strings.ToLower(strings.TrimPrefix(name, `BUILTIN\`))] = true
+		}
+	}
+	for _, objects := range []map[string]string{wellKnownDomainObjects, wellKnownConfigObjects} {
+		for rel := range objects {
+			for _, rdn := range strings.Split(rel, ",") {
+				if parts := strings.SplitN(rdn, "=", 2); len(parts) == 2 {
+					keep[parts[1]] = true
+				}
+			}
+		}
+	}
+	return keep
+}
+
+// addSession makes sure the session's domain and domain SID are replaced wherever they turn up, even in results
+// that are only free text
+func (a *anonymizer) addSession(session *ldapsession.LDAPSession) {
+	domain := strings.ToLower(ldapsession.DNToDomain(session.NamingContexts.Default))
+	if domain != "" {
+		a.domain(domain)
+		a.mu.Lock()
+		known := false
+		for _, d := range a.domains {
+			known = known || d == domain
+		}
+		if !known {
+			a.domains = append(a.domains, domain)
+		}
+		a.mu.Unlock()
+	}
+	if sid, err := secdesc.ParseSID(session.SIDResolver().DomainSID()); err == nil {
+		a.sid(sid)
+	}
+}
+
+// token is the pseudonym for value, prefixed with what kind of value it is
+func (a *anonymizer) token(kind, value string) string {
+	lower := strings.ToLower(value)
+	if lower == "" || a.keep[lower] {
+		return value
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(kind + ":" + lower))
+	t := kind + "-" + hex.EncodeToString(mac.Sum(nil)[:4])
+	a.mu.Lock()
+	a.seen[lower] = t
+	a.mu.Unlock()
+	return t
+}
+
+// name replaces an account or object name, keeping the $ of computer accounts
+func (a *anonymizer) name(value string) string {
+	if strings.HasSuffix(value, "$") {
+		return a.token("obj", strings.TrimSuffix(value, "$")) + "$"
+	}
+	return a.token("obj", value)
+}
+
+// domain replaces each label of a DNS domain name, so subdomains still look like subdomains
+func (a *anonymizer) domain(value string) string {
+	labels := strings.Split(value, ".")
+	for i, l := range labels {
+		labels[i] = a.token("dom", l)
+	}
+	return strings.Join(labels, ".")
+}
+
+// host replaces a hostname. The first label is a name like a computer's sAMAccountName, so they match
+func (a *anonymizer) host(value string) string {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) == 1 {
+		return a.name(value)
+	}
+	return a.name(parts[0]) + "." + a.domain(parts[1])
+}
+
+// dn replaces every RDN value of a DN. The names of schema objects (e.g. in objectCategory) are kept
+func (a *anonymizer) dn(value string) string {
+	parsed, err := ldap.ParseDN(value)
+	if err != nil || len(parsed.RDNs) == 0 {
+		return a.token("text", value)
+	}
+	schema := strings.Contains(strings.ToLower(value), "cn=schema,cn=configuration,")
+	var rdns []string
+	for _, rdn := range parsed.RDNs {
+		var parts []string
+		for _, attr := range rdn.Attributes {
+			v := attr.Value
+			switch {
+			case strings.EqualFold(attr.Type, "dc"):
+				v = a.token("dom", v)
+			case !schema:
+				v = a.name(v)
+			}
+			parts = append(parts, attr.Type+"="+escapeRDNValue(v))
+		}
+		rdns = append(rdns, strings.Join(parts, "+"))
+	}
+	return strings.Join(rdns, ",")
+}
+
+// escapeRDNValue escapes the characters RFC 4514 requires in a DN attribute value
+func escapeRDNValue(v string) string {
+	var b strings.Builder
+	for i, r := range v {
+		if strings.ContainsRune(`,+"\<>;=`, r) || (i == 0 && (r == ' ' || r == '#')) || (i == len(v)-1 && r == ' ') {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// sid replaces the domain part of a domain SID, keeping the RID so well-known accounts and groups can still be told
+// apart. Other SIDs (BUILTIN, NT AUTHORITY...) are the same everywhere, and are kept
+func (a *anonymizer) sid(sid secdesc.SID) secdesc.SID {
+	if sid.Authority != 5 || len(sid.SubAuthorities) < 4 || sid.SubAuthorities[0] != 21 {
+		return sid
+	}
+	domain := secdesc.SID{Revision: sid.Revision, Authority: 5, SubAuthorities: sid.SubAuthorities[:4]}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte("sid:" + domain.String()))
+	sum := mac.Sum(nil)
+	replaced := secdesc.SID{Revision: sid.Revision, Authority: 5, SubAuthorities: []uint32{21,
+		binary.LittleEndian.Uint32(sum[0:]), binary.LittleEndian.Uint32(sum[4:]), binary.LittleEndian.Uint32(sum[8:])}}
+	a.mu.Lock()
+	// the sub authorities of the domain part, as they appear inside binary values
+	a.domainSIDs[string(domain.Bytes()[8:])] = replaced.Bytes()[8:]
+	a.mu.Unlock()
+	replaced.SubAuthorities = append(replaced.SubAuthorities, sid.SubAuthorities[4:]...)
+	return replaced
+}
+
+// ipv4 replaces an address with one in 10.0.0.0/8
+func (a *anonymizer) ipv4(value string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte("ip:" + value))
+	sum := mac.Sum(nil)
+	return fmt.Sprintf("10.%d.%d.%d", sum[0], sum[1], sum[2])
+}
+
+// spn replaces the host (and service name, if there is one) of an SPN, keeping the service class and port
+func (a *anonymizer) spn(value string) string {
+	parts := strings.SplitN(value, "/", 3)
+	if len(parts) < 2 {
+		return a.text(value)
+	}
+	hostPort := strings.SplitN(parts[1], ":", 2)
+	hostPort[0] = a.host(hostPort[0])
+	parts[1] = strings.Join(hostPort, ":")
+	if len(parts) == 3 {
+		parts[2] = a.host(parts[2])
+	}
+	return strings.Join(parts, "/")
+}
+
+// principal replaces both halves of a name@domain
+func (a *anonymizer) principal(value string) string {
+	i := strings.LastIndex(value, "@")
+	if i < 0 {
+		return a.name(value)
+	}
+	return a.name(value[:i]) + "@" + a.domain(value[i+1:])
+}
+
+// text replaces what it can recognize in free text: DNs, domain SIDs, DOMAIN\name accounts, IPv4 addresses, names
+// already replaced elsewhere, and hostnames in the domains being searched. Other names (like a person's full name in
+// a sentence) can't be told apart from the rest of the text, and are left
+func (a *anonymizer) text(value string) string {
+	value = anonymizeDNRegex.ReplaceAllStringFunc(value, a.dn)
+	value = anonymizeDomainSIDRegex.ReplaceAllStringFunc(value, func(s string) string {
+		sid, err := secdesc.ParseSID(s)
+		if err != nil {
+			return s
+		}
+		return a.sid(sid).String()
+	})
+	value = anonymizeAccountRegex.ReplaceAllStringFunc(value, func(s string) string {
+		m := anonymizeAccountRegex.FindStringSubmatch(s)
+		if anonymizedAuthorities[strings.ToLower(m[1])] {
+			return s
+		}
+		return a.token("dom", m[1]) + `\` + a.name(m[2])
+	})
+	value = anonymizeIPv4Regex.ReplaceAllStringFunc(value, a.ipv4)
+	a.mu.Lock()
+	domains := append([]string(nil), a.domains...)
+	a.mu.Unlock()
+	return anonymizeWordRegex.ReplaceAllStringFunc(value, func(word string) string {
+		lower := strings.ToLower(word)
+		if strings.HasPrefix(lower, "obj-") || strings.HasPrefix(lower, "dom-") || strings.HasPrefix(lower, "text-") {
+			return word
+		}
+		a.mu.Lock()
+		t, ok := a.seen[lower]
+		if !ok && strings.HasSuffix(lower, "$") {
+			if t, ok = a.seen[strings.TrimSuffix(lower, "$")]; ok {
+				t += "$"
+			}
+		}
+		a.mu.Unlock()
+		if ok {
+			return t
+		}
+		for _, d := range domains {
+			if lower == d {
+				return a.domain(word)
+			}
+			if strings.HasSuffix(lower, "."+d) {
+				return a.host(word)
+			}
+		}
+		return word
+	})
+}
+
+// binary replaces the domain SIDs seen so far inside a binary value
+func (a *anonymizer) binary(b []byte) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for real, replaced := range a.domainSIDs {
+		b = bytes.ReplaceAll(b, []byte(real), replaced)
+	}
+	return b
+}
+
+// value replaces one value of an attribute
+func (a *anonymizer) value(attr string, b []byte) []byte {
+	lower := strings.ToLower(attr)
+	syntax := ""
+	if info, ok := adschema.AttributeMap[attr]; ok {
+		syntax = info.Syntax
+	}
+	switch {
+	case anonymizeKeepAttrs[lower]:
+		return b
+	case syntax == "String(Sid)":
+		if sid, _, err := secdesc.DecodeSID(b); err == nil {
+			return a.sid(sid).Bytes()
+		}
+		return b
+	case !utf8.Valid(b):
+		return a.binary(b)
+	}
+	s := string(b)
+	switch {
+	case syntax == "Object(DS-DN)":
+		s = a.dn(s)
+	case syntax == "Object(DN-Binary)":
+		// B:<length>:<hex>:<DN>
+		if parts := strings.SplitN(s, ":", 4); len(parts) == 4 {
+			s = strings.Join(parts[:3], ":") + ":" + a.dn(parts[3])
+		}
+	case anonymizeNameAttrs[lower]:
+		s = a.name(s)
+	case anonymizePrincipalAttrs[lower]:
+		s = a.principal(s)
+	case anonymizeHostAttrs[lower]:
+		s = a.host(s)
+	case anonymizeDomainAttrs[lower]:
+		s = a.domain(s)
+	case anonymizeSPNAttrs[lower]:
+		s = a.spn(s)
+	case anonymizeTextAttrs[lower]:
+		s = a.token("text", s)
+	default:
+		s = a.text(s)
+	}
+	return []byte(s)
+}
+
+// tag anonymizes an entry's DN and values in place
+func (a *anonymizer) tag(entry *ldap.Entry) {
+	if entry.DN != "" {
+		entry.DN = a.dn(entry.DN)
+	}
+	for _, attr := range entry.Attributes {
+		for i, v := range attr.ByteValues {
+			attr.ByteValues[i] = a.value(attr.Name, v)
+			if i < len(attr.Values) {
+				attr.Values[i] = string(attr.ByteValues[i])
+			}
+		}
+	}
+}
+
+// provenance anonymizes where results came from and who read them, the same way as the results
+func (a *anonymizer) provenance(p *provenance) {
+	for i, arg := range p.Command {
+		p.Command[i] = a.text(arg)
+	}
+	if p.Host != "" {
+		p.Host = a.host(p.Host)
+	}
+	for i := range p.Targets {
+		t := &p.Targets[i]
+		t.Domain = a.domain(t.Domain)
+		if hostPort := strings.SplitN(t.Server, ":", 2); len(hostPort) == 2 {
+			if anonymizeIPv4Regex.MatchString(hostPort[0]) {
+				hostPort[0] = a.ipv4(hostPort[0])
+			} else {
+				hostPort[0] = a.host(hostPort[0])
+			}
+			t.Server = strings.Join(hostPort, ":")
+		}
+		if t.Bind != "anonymous" {
+			t.Bind = a.bind(t.Bind)
+		}
+		t.BaseDN = a.dn(t.BaseDN)
+	}
+}
+
+// bind anonymizes a bind username, which is a UPN, DOMAIN\name or DN
+func (a *anonymizer) bind(username string) string {
+	switch {
+	case strings.Contains(username, `\`):
+		parts := strings.SplitN(username, `\`, 2)
+		return a.token("dom", parts[0]) + `\` + a.name(parts[1])
+	case strings.Contains(username, "="):
+		return a.dn(username)
+	}
+	return a.principal(username)
+}
@@ -0,0 +1,248 @@
+package windapsearch
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/ropnop/go-windapsearch/pkg/modules"
+)
+
+// archiveRecord is one run of a module kept in the --archive directory. The output itself is stored once per
+// distinct content, under its SHA-256, so runs that found nothing new take no space
+type archiveRecord struct {
+	Time    time.Time `json:"time"`
+	Domain  string    `json:"domain"`
+	Domains []string  `json:"domains,omitempty"`
+	Module  string    `json:"module"`
+	Format  string    `json:"format"`
+	Hash    string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	Entries int64     `json:"entries"`
+	Status  string    `json:"status"`
+}
+
+// ID is the short form of the hash that history shows and takes
+func (r archiveRecord) ID() string {
+	return r.Hash[:12]
+}
+
+// archiveObjectPath is where the output with a SHA-256 is stored in an archive
+func archiveObjectPath(dir, sum string) string {
+	return filepath.Join(dir, "objects", sum[:2], sum)
+}
+
+// archiveIndexPath is the append-only list of the runs of a module against a domain on one day
+func archiveIndexPath(dir string, r archiveRecord) string {
+	return filepath.Join(dir, r.Domain, r.Module, r.Time.Format("2006-01-02")+".jsonl")
+}
+
+// snapshotWriter copies a module's output into the archive as it's written, hashing it on the way
+type snapshotWriter struct {
+	dir    string
+	tmp    *os.File
+	sum    hash.Hash
+	size   int64
+	record archiveRecord
+}
+
+// newSnapshot starts archiving a module's output. The domain is the first target's, with the others listed when
+// results from a forest are combined
+func (w *WindapSearchSession) newSnapshot(mod modules.Module, targets []moduleTarget) (*snapshotWriter, error) {
+	dir := w.Options.Archive
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(dir, "objects"), "incoming-")
+	if err != nil {
+		return nil, err
+	}
+	r := archiveRecord{Time: time.Now().UTC(), Module: mod.Name(), Format: strings.TrimPrefix(w.outputExt(), ".")}
+	for _, t := range targets {
+		domain := strings.ToLower(ldapsession.DNToDomain(t.session.NamingContexts.Default))
+		if w.anonymizer != nil {
+			domain = w.anonymizer.domain(domain)
+		}
+		if r.Domain == "" {
+			r.Domain = domain
+		}
+		if len(targets) > 1 {
+			r.Domains = append(r.Domains, domain)
+		}
+	}
+	if r.Domain == "" {
+		r.Domain = "unknown"
+	}
+	return &snapshotWriter{dir: dir, tmp: tmp, sum: sha256.New(), record: r}, nil
+}
+
+func (s *snapshotWriter) Write(b []byte) (int, error) {
+	n, err := s.tmp.Write(b)
+	s.sum.Write(b[:n])
+	s.size += int64(n)
+	return n, err
+}
+
+// commit stores the output under its hash, unless the same output is already stored, and records the run in the
+// index. Runs that stopped part way are kept too, marked with their status
+func (s *snapshotWriter) commit(runs []*moduleStats) error {
+	tmpName := s.tmp.Name()
+	defer os.Remove(tmpName)
+	if err := s.tmp.Close(); err != nil {
+		return err
+	}
+	s.record.Hash = hex.EncodeToString(s.sum.Sum(nil))
+	s.record.Size = s.size
+	s.record.Status = "ok"
+	for _, r := range runs {
+		s.record.Entries += r.Entries
+		if status := r.status(); status != "ok" && s.record.Status == "ok" {
+			s.record.Status = status
+		}
+	}
+
+	object := archiveObjectPath(s.dir, s.record.Hash)
+	if _, err := os.Stat(object); os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+			return err
+		}
+		if err = os.Rename(tmpName, object); err != nil {
+			return err
+		}
+		// stored objects are never changed
+		os.Chmod(object, 0444)
+	}
+
+	index := archiveIndexPath(s.dir, s.record)
+	if err := os.MkdirAll(filepath.Dir(index), 0755); err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(index, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(s.record)
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	if _, err = fp.Write(append(b, '\n')); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
+
+// loadArchive reads every run recorded in an archive, oldest first
+func loadArchive(dir string) ([]archiveRecord, error) {
+	indexes, err := filepath.Glob(filepath.Join(dir, "*", "*", "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	var records []archiveRecord
+	for _, index := range indexes {
+		fp, err := os.Open(index)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(fp)
+		for line := 1; scanner.Scan(); line++ {
+			var r archiveRecord
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || len(r.Hash) < 12 {
+				fp.Close()
+				return nil, fmt.Errorf("%s line %d: not an archive record", index, line)
+			}
+			records = append(records, r)
+		}
+		err = scanner.Err()
+		fp.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, nil
+}
+
+// runHistory runs the history command: listing the runs in the archive (optionally of one domain and module), or
+// writing out the results of one of them
+func (w *WindapSearchSession) runHistory() error {
+	records, err := loadArchive(w.Options.Archive)
+	if err != nil {
+		return err
+	}
+	args := w.history
+	if len(args) > 0 && args[0] == "show" {
+		if len(args) != 2 {
+			return fmt.Errorf("usage: windapsearch --archive <dir> history show <id>")
+		}
+		r, err := findSnapshot(records, args[1])
+		if err != nil {
+			return err
+		}
+		fp, err := os.Open(archiveObjectPath(w.Options.Archive, r.Hash))
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		_, err = io.Copy(w.OutputWriter, fp)
+		return err
+	}
+	if len(args) > 2 {
+		return fmt.Errorf("usage: windapsearch --archive <dir> history [domain [module]]")
+	}
+
+	tw := tabwriter.NewWriter(w.OutputWriter, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tDOMAIN\tMODULE\tFORMAT\tENTRIES\tSTATUS")
+	shown := 0
+	for _, r := range records {
+		if len(args) > 0 && !strings.EqualFold(args[0], r.Domain) {
+			continue
+		}
+		if len(args) > 1 && !strings.EqualFold(args[1], r.Module) {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", r.ID(), r.Time.Local().Format("2006-01-02 15:04:05"), r.Domain,
+			r.Module, r.Format, r.Entries, r.Status)
+		shown++
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if shown == 0 {
+		fmt.Fprintf(os.Stderr, "[*] No runs archived in %q yet\n", w.Options.Archive)
+	}
+	return nil
+}
+
+// findSnapshot finds the run a history ID (or any unambiguous prefix of the hash) refers to. The same output can be
+// recorded by many runs, so their latest is returned
+func findSnapshot(records []archiveRecord, id string) (archiveRecord, error) {
+	id = strings.ToLower(id)
+	var found archiveRecord
+	for _, r := range records {
+		if !strings.HasPrefix(r.Hash, id) {
+			continue
+		}
+		if found.Hash != "" && found.Hash != r.Hash {
+			return archiveRecord{}, fmt.Errorf("%q matches more than one snapshot, give more of its ID", id)
+		}
+		found = r
+	}
+	if found.Hash == "" {
+		return archiveRecord{}, fmt.Errorf("no snapshot %q in the archive", id)
+	}
+	return found, nil
+}
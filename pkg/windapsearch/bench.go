@@ -0,0 +1,185 @@
+package windapsearch
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+const (
+	// benchRounds is how many times each latency is measured, the median is reported
+	benchRounds = 3
+	// benchPages is how many pages are fetched at each page size
+	benchPages = 10
+)
+
+// benchPageSizes are the page sizes compared. AD caps pages at MaxPageSize (1000 by default), so larger sizes
+// wouldn't show anything
+var benchPageSizes = []uint32{100, 250, 500, 1000}
+
+// benchConnections are the numbers of sessions searching at the same time that are compared
+var benchConnections = []int{1, 2, 4, 8}
+
+// benchFilter is a representative search. Attributes are kept to the DN so the time is the DC's evaluating the
+// filter, not transferring attributes
+type benchFilter struct {
+	name   string
+	filter string
+	scope  int
+}
+
+var benchFilters = []benchFilter{
+	{"base (domain object)", "(objectClass=*)", ldap.ScopeBaseObject},
+	{"indexed equality", "(sAMAccountName=krbtgt)", ldap.ScopeWholeSubtree},
+	{"indexed AND", "(&(objectCategory=group)(adminCount=1))", ldap.ScopeWholeSubtree},
+	{"bitwise (unindexed)", "(userAccountControl:1.2.840.113556.1.4.803:=8192)", ldap.ScopeWholeSubtree},
+	{"substring (unindexed)", "(description=*admin*)", ldap.ScopeWholeSubtree},
+}
+
+// benchPageFilter is what's paged through to compare page sizes and connection counts. Every domain has at least a
+// few pages of users in a real environment
+const benchPageFilter = "(objectCategory=person)"
+
+// runBench measures how the DC and the link to it perform (session setup, filter latency, paging throughput at
+// different page sizes and connection counts) to help choose --page-size and worker counts. Searches skip the lookup
+// cache so every number is a real round trip
+func (w *WindapSearchSession) runBench() error {
+	session := w.LDAPSession
+	server, port := session.Server()
+	fmt.Printf("[*] Benchmarking %s:%d (median of %d rounds)\n\n", server, port, benchRounds)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "TEST\tLATENCY\tENTRIES\n")
+	var setup []time.Duration
+	for i := 0; i < benchRounds; i++ {
+		start := time.Now()
+		s, err := session.NewSessionForServer(server, port, session.Options().Secure)
+		if err != nil {
+			return fmt.Errorf("unable to open a new session: %s", err)
+		}
+		setup = append(setup, time.Since(start))
+		s.Close()
+	}
+	fmt.Fprintf(tw, "new session (connect, bind, read rootDSE)\t%s\t-\n", median(setup))
+
+	for _, f := range benchFilters {
+		var times []time.Duration
+		entries := 0
+		for i := 0; i < benchRounds; i++ {
+			sr := ldap.NewSearchRequest(session.NamingContexts.Default, f.scope, ldap.NeverDerefAliases, 0, 0, false,
+				f.filter, []string{"distinguishedName"}, nil)
+			elapsed, n, err := session.TimeSearch(sr)
+			if err != nil {
+				w.Log.Warnf("%s search failed: %s", f.name, err)
+				break
+			}
+			times = append(times, elapsed)
+			entries = n
+		}
+		if len(times) > 0 {
+			fmt.Fprintf(tw, "%s %s\t%s\t%d\n", f.name, f.filter, median(times), entries)
+		}
+	}
+	tw.Flush()
+
+	fmt.Println()
+	fmt.Fprintf(tw, "PAGE SIZE\tPAGES\tENTRIES\tPAGES/SEC\tENTRIES/SEC\n")
+	var best ldapsession.PageTiming
+	for _, size := range benchPageSizes {
+		timing, err := session.TimePages(benchPageFilter, []string{"distinguishedName", "sAMAccountName"}, size, benchPages)
+		if err != nil {
+			w.Log.Warnf("paging with page size %d failed: %s", size, err)
+			continue
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%.1f\t%.0f\n", size, timing.Pages, timing.Entries, timing.PagesPerSecond(), timing.EntriesPerSecond())
+		if timing.EntriesPerSecond() > best.EntriesPerSecond() {
+			best = timing
+		}
+		if timing.Pages < benchPages {
+			// everything fit in fewer pages, so bigger pages won't tell us more
+			break
+		}
+	}
+	tw.Flush()
+
+	fmt.Println()
+	fmt.Fprintf(tw, "CONNECTIONS\tENTRIES/SEC\n")
+	pageSize := best.PageSize
+	if pageSize == 0 {
+		pageSize = uint32(w.Options.PageSize)
+	}
+	bestConns, bestRate := 1, 0.0
+	for _, n := range benchConnections {
+		rate, err := w.benchConnections(session, n, pageSize)
+		if err != nil {
+			w.Log.Warnf("benchmark with %d connections failed: %s", n, err)
+			break
+		}
+		fmt.Fprintf(tw, "%d\t%.0f\n", n, rate)
+		// more connections are only worth it if they're noticeably faster
+		if rate > bestRate*1.1 {
+			bestConns, bestRate = n, rate
+		}
+	}
+	tw.Flush()
+
+	fmt.Printf("\n[+] Suggested: --page-size %d, and up to %d connection(s) at a time (--parallel)\n", pageSize, bestConns)
+	return nil
+}
+
+// benchConnections pages through users on n sessions at once and returns the combined entries per second
+func (w *WindapSearchSession) benchConnections(session *ldapsession.LDAPSession, n int, pageSize uint32) (float64, error) {
+	server, port := session.Server()
+	sessions := make([]*ldapsession.LDAPSession, n)
+	defer func() {
+		for _, s := range sessions {
+			if s != nil {
+				s.Close()
+			}
+		}
+	}()
+	for i := range sessions {
+		s, err := session.NewSessionForServer(server, port, session.Options().Secure)
+		if err != nil {
+			return 0, err
+		}
+		sessions[i] = s
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	entries := 0
+	start := time.Now()
+	for _, s := range sessions {
+		wg.Add(1)
+		go func(s *ldapsession.LDAPSession) {
+			defer wg.Done()
+			timing, err := s.TimePages(benchPageFilter, []string{"distinguishedName", "sAMAccountName"}, pageSize, benchPages)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			entries += timing.Entries
+		}(s)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return 0, firstErr
+	}
+	return float64(entries) / time.Since(start).Seconds(), nil
+}
+
+// median returns the middle of a set of timings, which is less thrown by one slow round trip than the mean
+func median(times []time.Duration) time.Duration {
+	sorted := append([]time.Duration(nil), times...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2].Round(time.Microsecond * 100)
+}
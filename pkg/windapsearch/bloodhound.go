@@ -0,0 +1,685 @@
+package windapsearch
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	uac "github.com/audibleblink/msldapuac"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/sirupsen/logrus"
+)
+
+// bloodhoundVersion is the version of the ingest format written, the one SharpHound 4 and BloodHound 4.x use
+const bloodhoundVersion = 4
+
+// bloodhoundAttrs are the attributes users, groups, computers and domains are mapped to BloodHound from. ACEs are
+// only written if nTSecurityDescriptor is requested as well (e.g. with --profile bloodhound)
+var bloodhoundAttrs = []string{"objectClass", "objectSid", "sAMAccountName", "name", "displayName", "description",
+	"dNSHostName", "userAccountControl", "adminCount", "servicePrincipalName", "mail", "title", "homeDirectory",
+	"operatingSystem", "whenCreated", "lastLogon", "lastLogonTimestamp", "pwdLastSet", "primaryGroupID", "member",
+	"sIDHistory", "msDS-AllowedToDelegateTo", "msDS-AllowedToActOnBehalfOfOtherIdentity", "ms-Mcs-AdmPwdExpirationTime",
+	"msDS-Behavior-Version"}
+
+// bloodhoundFiles are the files of the zip, in the order they're written, by the kind of object they hold
+var bloodhoundFiles = []struct {
+	kind, name string
+}{
+	{"Domain", "domains"},
+	{"User", "users"},
+	{"Group", "groups"},
+	{"Computer", "computers"},
+}
+
+// bloodhoundSkipped are the principals whose ACEs aren't written, as SharpHound leaves them out too
+var bloodhoundSkipped = map[string]bool{"S-1-3-0": true, "S-1-5-10": true, "S-1-5-18": true}
+
+// bloodhoundHighValue are the groups BloodHound marks as high value targets, by RID in their domain or SID
+var bloodhoundHighValue = map[string]bool{"512": true, "516": true, "518": true, "519": true, "S-1-5-32-544": true,
+	"S-1-5-32-548": true, "S-1-5-32-549": true, "S-1-5-32-551": true}
+
+// attribute and property set GUIDs write ACEs are checked for
+var (
+	bloodhoundMemberGUID        = secdesc.MustParseGUID("bf9679c0-0de6-11d0-a285-00aa003049e2")
+	bloodhoundAllowedToActGUID  = secdesc.MustParseGUID("3f78c3e5-f79a-46bd-a0b8-9d18116ddc79")
+	bloodhoundKeyCredentialGUID = secdesc.MustParseGUID("5b47d60f-6090-40b2-9f37-2a4de88f3063")
+	bloodhoundForceChangeGUID   = secdesc.MustParseGUID("00299570-246d-11d0-a768-00aa006e0529")
+	bloodhoundGetChangesGUID    = secdesc.MustParseGUID("1131f6aa-9c07-11d1-f79f-00c04fc2dcd2")
+	bloodhoundGetChangesAllGUID = secdesc.MustParseGUID("1131f6ad-9c07-11d1-f79f-00c04fc2dcd2")
+)
+
+// domainFunctionalLevels name the values of msDS-Behavior-Version
+var domainFunctionalLevels = map[string]string{"0": "2000 Mixed/Native", "1": "2003 Interim", "2": "2003", "3": "2008",
+	"4": "2008 R2", "5": "2012", "6": "2012 R2", "7": "2016"}
+
+// bloodhoundPrincipal is a reference to another object, as group members, delegation targets and so on are written
+type bloodhoundPrincipal struct {
+	ObjectIdentifier string `json:"ObjectIdentifier"`
+	ObjectType       string `json:"ObjectType"`
+}
+
+type bloodhoundACE struct {
+	PrincipalSID  string `json:"PrincipalSID"`
+	PrincipalType string `json:"PrincipalType"`
+	RightName     string `json:"RightName"`
+	IsInherited   bool   `json:"IsInherited"`
+}
+
+// bloodhoundFragment is what one entry adds to the zip: an object for one of its files
+type bloodhoundFragment struct {
+	Kind   string          `json:"kind"`
+	ID     string          `json:"id"`
+	Object json.RawMessage `json:"object"`
+	// Unresolved counts the DNs and hostnames the object refers to that couldn't be found
+	Unresolved int `json:"unresolved"`
+}
+
+// bloodhoundWriter writes the results as a zip of BloodHound ingest files (users.json, groups.json, computers.json
+// and domains.json), which BloodHound's upload takes like a SharpHound zip. Group members, delegation targets and
+// ACE principals are resolved to SIDs and object types with lookups in the entry's domain. Objects are spooled to a
+// temporary file per kind as they arrive, and the zip is written from them at the end, so results aren't held in
+// memory. Only what LDAP can tell is collected: sessions, local groups and GPO links are left to SharpHound
+type bloodhoundWriter struct {
+	log *logrus.Entry
+	// resolvers are the targets' lookups, by the domain their entries are tagged with ("" with a single target)
+	resolvers map[string]*bloodhoundResolver
+
+	spools     map[string]*os.File
+	counts     map[string]int
+	seen       map[string]bool
+	skipped    int
+	unresolved int
+}
+
+func (w *WindapSearchSession) newBloodHoundWriter(targets []moduleTarget) *bloodhoundWriter {
+	b := &bloodhoundWriter{
+		log:       w.Log,
+		resolvers: make(map[string]*bloodhoundResolver),
+		spools:    make(map[string]*os.File),
+		counts:    make(map[string]int),
+		seen:      make(map[string]bool),
+	}
+	for _, t := range targets {
+		b.resolvers[strings.ToLower(t.domain)] = newBloodHoundResolver(t.session)
+	}
+	return b
+}
+
+func (b *bloodhoundWriter) marshal(e *adschema.ADEntry) ([]byte, error) {
+	sid, err := adschema.WindowsSIDFromBytes(e.GetRawAttributeValue("objectSid"))
+	if err != nil {
+		// everything BloodHound takes from LDAP is identified by its SID
+		return nil, nil
+	}
+	r := b.resolvers[strings.ToLower(e.Domain)]
+	if r == nil {
+		return nil, nil
+	}
+	kind := bloodhoundKind(e.GetAttributeValues("objectClass"))
+	domain := strings.ToUpper(ldapsession.DNToDomain(e.DN))
+	flags, _ := strconv.Atoi(e.GetAttributeValue("userAccountControl"))
+	f := bloodhoundFragment{Kind: kind, ID: sid}
+
+	props := map[string]interface{}{
+		"domain":            domain,
+		"objectid":          sid,
+		"distinguishedname": strings.ToUpper(e.DN),
+		"highvalue":         false,
+		"description":       nullable(e.GetAttributeValue("description")),
+		"whencreated":       bloodhoundTime(e.GetAttributeValue("whenCreated"), false),
+	}
+	obj := map[string]interface{}{"ObjectIdentifier": sid, "Properties": props, "IsDeleted": false,
+		"IsACLProtected": false, "Aces": []bloodhoundACE{}}
+	if raw := e.GetRawAttributeValue("nTSecurityDescriptor"); len(raw) > 0 {
+		if sd, err := secdesc.Parse(raw); err == nil {
+			obj["IsACLProtected"] = sd.Control&secdesc.ControlDACLProtected != 0
+			obj["Aces"] = r.aces(sd, kind)
+		}
+	}
+
+	switch kind {
+	case "User", "Computer":
+		props["enabled"] = flags&uac.Accountdisable == 0
+		props["unconstraineddelegation"] = flags&uac.TrustedForDelegation != 0
+		props["trustedtoauth"] = flags&uac.TrustedToAuthForDelegation != 0
+		props["lastlogon"] = bloodhoundTime(e.GetAttributeValue("lastLogon"), true)
+		props["lastlogontimestamp"] = bloodhoundTime(e.GetAttributeValue("lastLogonTimestamp"), true)
+		props["pwdlastset"] = bloodhoundTime(e.GetAttributeValue("pwdLastSet"), true)
+		props["serviceprincipalnames"] = nonNil(e.GetAttributeValues("servicePrincipalName"))
+		props["samaccountname"] = e.GetAttributeValue("sAMAccountName")
+		var history []string
+		for _, raw := range e.GetRawAttributeValues("sIDHistory") {
+			if s, err := adschema.WindowsSIDFromBytes(raw); err == nil {
+				history = append(history, s)
+			}
+		}
+		props["sidhistory"] = nonNil(history)
+		obj["HasSIDHistory"] = r.sids(history)
+		if rid := e.GetAttributeValue("primaryGroupID"); rid != "" {
+			if s, err := secdesc.ParseSID(sid); err == nil {
+				if d, ok := s.DomainSID(); ok {
+					obj["PrimaryGroupSID"] = d.String() + "-" + rid
+				}
+			}
+		}
+		var hosts []string
+		for _, spn := range e.GetAttributeValues("msDS-AllowedToDelegateTo") {
+			hosts = append(hosts, strings.ToLower(strings.SplitN(strings.SplitN(spn+"/", "/", 3)[1], ":", 2)[0]))
+		}
+		var targets []bloodhoundPrincipal
+		targets, f.Unresolved = r.hosts(hosts)
+		obj["AllowedToDelegate"] = targets
+		props["allowedtodelegate"] = nonNil(e.GetAttributeValues("msDS-AllowedToDelegateTo"))
+	}
+	switch kind {
+	case "User":
+		props["name"] = strings.ToUpper(e.GetAttributeValue("sAMAccountName")) + "@" + domain
+		props["passwordnotreqd"] = flags&uac.PasswdNotReqd != 0
+		props["dontreqpreauth"] = flags&uac.DontReqPreauth != 0
+		props["pwdneverexpires"] = flags&uac.DontExpirePassword != 0
+		props["sensitive"] = flags&uac.NotDelegated != 0
+		props["hasspn"] = len(e.GetAttributeValues("servicePrincipalName")) > 0
+		props["admincount"] = e.GetAttributeValue("adminCount") == "1"
+		props["displayname"] = nullable(e.GetAttributeValue("displayName"))
+		props["email"] = nullable(e.GetAttributeValue("mail"))
+		props["title"] = nullable(e.GetAttributeValue("title"))
+		props["homedirectory"] = nullable(e.GetAttributeValue("homeDirectory"))
+		obj["SPNTargets"] = []bloodhoundPrincipal{}
+	case "Computer":
+		name := strings.ToUpper(e.GetAttributeValue("dNSHostName"))
+		if name == "" {
+			name = strings.ToUpper(strings.TrimSuffix(e.GetAttributeValue("sAMAccountName"), "$")) + "." + domain
+		}
+		props["name"] = name
+		props["operatingsystem"] = nullable(e.GetAttributeValue("operatingSystem"))
+		props["haslaps"] = e.GetAttributeValue("ms-Mcs-AdmPwdExpirationTime") != ""
+		var actors []bloodhoundPrincipal
+		if raw := e.GetRawAttributeValue("msDS-AllowedToActOnBehalfOfOtherIdentity"); len(raw) > 0 {
+			if sd, err := secdesc.Parse(raw); err == nil && sd.DACL != nil {
+				var sids []string
+				for _, ace := range sd.DACL.ACEs {
+					if ace.Type == secdesc.AccessAllowedACEType {
+						sids = append(sids, ace.SID.String())
+					}
+				}
+				actors = r.sids(sids)
+			}
+		}
+		obj["AllowedToAct"] = nonNilPrincipals(actors)
+		// local data only SharpHound can collect
+		for _, name := range []string{"Sessions", "PrivilegedSessions", "RegistrySessions", "LocalAdmins",
+			"RemoteDesktopUsers", "DcomUsers", "PSRemoteUsers"} {
+			obj[name] = map[string]interface{}{"Collected": false, "FailureReason": nil, "Results": []interface{}{}}
+		}
+		obj["Status"] = nil
+	case "Group":
+		name := e.GetAttributeValue("sAMAccountName")
+		if name == "" {
+			name = e.GetAttributeValue("name")
+		}
+		props["name"] = strings.ToUpper(name) + "@" + domain
+		props["admincount"] = e.GetAttributeValue("adminCount") == "1"
+		if s, err := secdesc.ParseSID(sid); err == nil {
+			props["highvalue"] = bloodhoundHighValue[sid] || bloodhoundHighValue[strconv.FormatUint(uint64(s.RID()), 10)]
+		}
+		if strings.HasPrefix(sid, "S-1-5-32-") {
+			// BUILTIN groups have the same SID in every domain, so BloodHound tells them apart by domain
+			f.ID = domain + "-" + sid
+			obj["ObjectIdentifier"], props["objectid"] = f.ID, f.ID
+		}
+		var members []bloodhoundPrincipal
+		var missing int
+		members, missing = r.members(e.GetAttributeValues("member"))
+		f.Unresolved += missing
+		obj["Members"] = members
+	case "Domain":
+		props["name"] = domain
+		props["highvalue"] = true
+		props["functionallevel"] = nullable(domainFunctionalLevels[e.GetAttributeValue("msDS-Behavior-Version")])
+		// trusts, GPO links and child objects come from objects this writer doesn't map
+		obj["Trusts"], obj["Links"], obj["ChildObjects"] = []interface{}{}, []interface{}{}, []interface{}{}
+		obj["GPOChanges"] = map[string]interface{}{"AffectedComputers": []interface{}{}, "DcomUsers": []interface{}{},
+			"LocalAdmins": []interface{}{}, "PSRemoteUsers": []interface{}{}, "RemoteDesktopUsers": []interface{}{}}
+	default:
+		return nil, nil
+	}
+	if f.Object, err = json.Marshal(obj); err != nil {
+		return nil, err
+	}
+	return json.Marshal(f)
+}
+
+// bloodhoundKind is the kind of object BloodHound makes of an entry, from its object classes
+func bloodhoundKind(classes []string) string {
+	has := make(map[string]bool)
+	for _, c := range classes {
+		has[strings.ToLower(c)] = true
+	}
+	switch {
+	case has["computer"]:
+		return "Computer"
+	case has["user"]:
+		return "User"
+	case has["group"]:
+		return "Group"
+	case has["domaindns"]:
+		return "Domain"
+	case has["organizationalunit"]:
+		return "OU"
+	case has["grouppolicycontainer"]:
+		return "GPO"
+	case has["container"]:
+		return "Container"
+	}
+	return "Base"
+}
+
+// bloodhoundTime converts a FILETIME (if filetime is set) or generalized time to the Unix time BloodHound uses,
+// with -1 for never
+func bloodhoundTime(value string, filetime bool) int64 {
+	if value == "" || value == "0" || value == "9223372036854775807" {
+		return -1
+	}
+	var t time.Time
+	var err error
+	if filetime {
+		t, err = adschema.NTFileTimeToTimestamp(value)
+	} else {
+		t, err = adschema.ADLdapTimeToTimestamp(value)
+	}
+	if err != nil {
+		return -1
+	}
+	return t.Unix()
+}
+
+// nullable is nil for an empty string, which BloodHound shows as no value
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nonNil keeps a missing list from being written as null
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func nonNilPrincipals(p []bloodhoundPrincipal) []bloodhoundPrincipal {
+	if p == nil {
+		return []bloodhoundPrincipal{}
+	}
+	return p
+}
+
+func (b *bloodhoundWriter) write(out io.Writer, data []byte) error {
+	if len(data) == 0 {
+		b.skipped++
+		return nil
+	}
+	var f bloodhoundFragment
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	b.unresolved += f.Unresolved
+	// an object returned by more than one target or search is only written once
+	if b.seen[f.ID] {
+		return nil
+	}
+	b.seen[f.ID] = true
+	spool, ok := b.spools[f.Kind]
+	if !ok {
+		var err error
+		if spool, err = ioutil.TempFile("", "windapsearch-bloodhound-"); err != nil {
+			return err
+		}
+		b.spools[f.Kind] = spool
+	}
+	if b.counts[f.Kind] > 0 {
+		if _, err := io.WriteString(spool, ","); err != nil {
+			return err
+		}
+	}
+	b.counts[f.Kind]++
+	_, err := spool.Write(f.Object)
+	return err
+}
+
+// close writes the zip, with a file for every kind of object there were results of
+func (b *bloodhoundWriter) close(out io.Writer) error {
+	defer func() {
+		for _, spool := range b.spools {
+			spool.Close()
+			os.Remove(spool.Name())
+		}
+	}()
+	if b.skipped > 0 {
+		b.log.Warnf("%d results aren't users, groups, computers or domains, and were left out of the BloodHound data", b.skipped)
+	}
+	if b.unresolved > 0 {
+		b.log.Warnf("%d group members and delegation targets couldn't be found in their domain, and were left out of the BloodHound data", b.unresolved)
+	}
+	stamp := time.Now().Format("20060102150405")
+	z := zip.NewWriter(out)
+	for _, file := range bloodhoundFiles {
+		spool, ok := b.spools[file.kind]
+		if !ok {
+			continue
+		}
+		fw, err := z.Create(fmt.Sprintf("%s_%s.json", stamp, file.name))
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(fw, `{"data":[`); err != nil {
+			return err
+		}
+		if _, err = spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err = io.Copy(fw, spool); err != nil {
+			return err
+		}
+		// BloodHound reads the meta tag from the end of the file
+		meta, _ := json.Marshal(map[string]interface{}{"methods": 0, "type": file.name, "count": b.counts[file.kind], "version": bloodhoundVersion})
+		if _, err = fmt.Fprintf(fw, `],"meta":%s}`, meta); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+// bloodhoundResolver finds the SIDs and kinds of the objects results refer to by DN, hostname or SID, in the
+// session's domain. Every answer is remembered for the rest of the run
+type bloodhoundResolver struct {
+	session *ldapsession.LDAPSession
+	// domain is what well-known SIDs are prefixed with, as SharpHound does
+	domain string
+
+	mu        sync.Mutex
+	byDN      map[string]*bloodhoundPrincipal
+	byHost    map[string]*bloodhoundPrincipal
+	byAccount map[string]*bloodhoundPrincipal
+	bySID     map[string]*bloodhoundPrincipal
+}
+
+func newBloodHoundResolver(session *ldapsession.LDAPSession) *bloodhoundResolver {
+	return &bloodhoundResolver{
+		session:   session,
+		domain:    strings.ToUpper(ldapsession.DNToDomain(session.NamingContexts.Default)),
+		byDN:      make(map[string]*bloodhoundPrincipal),
+		byHost:    make(map[string]*bloodhoundPrincipal),
+		byAccount: make(map[string]*bloodhoundPrincipal),
+		bySID:     make(map[string]*bloodhoundPrincipal),
+	}
+}
+
+// bloodhoundLookupAttrs are what's read about the objects looked up
+var bloodhoundLookupAttrs = []string{"objectSid", "objectClass", "dNSHostName", "sAMAccountName"}
+
+// lookup searches for the values of attr that aren't in cache yet, remembering what's found in every cache, and the
+// values that weren't as nil
+func (r *bloodhoundResolver) lookup(attr string, values []string, cache map[string]*bloodhoundPrincipal) {
+	var pending []string
+	for _, v := range values {
+		if _, ok := cache[strings.ToLower(v)]; !ok {
+			pending = append(pending, v)
+			cache[strings.ToLower(v)] = nil
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+	res, err := r.session.BulkSearch(r.session.NamingContexts.Default, attr, pending, "", bloodhoundLookupAttrs)
+	if err != nil {
+		r.session.Log.Infof("unable to look up %d objects by %s for BloodHound: %s", len(pending), attr, err)
+	}
+	if res == nil {
+		return
+	}
+	for _, entry := range res.Entries {
+		sid, err := adschema.WindowsSIDFromBytes(entry.GetRawAttributeValue("objectSid"))
+		if err != nil {
+			continue
+		}
+		p := &bloodhoundPrincipal{ObjectIdentifier: r.identifier(sid), ObjectType: bloodhoundKind(entry.GetAttributeValues("objectClass"))}
+		if p.ObjectType == "Base" && p.ObjectIdentifier != sid {
+			// well-known principals, e.g. Authenticated Users as a foreign security principal
+			p.ObjectType = "Group"
+		}
+		r.byDN[strings.ToLower(entry.DN)] = p
+		r.bySID[strings.ToLower(sid)] = p
+		if host := entry.GetAttributeValue("dNSHostName"); host != "" {
+			r.byHost[strings.ToLower(host)] = p
+		}
+		if name := entry.GetAttributeValue("sAMAccountName"); name != "" && attr == "sAMAccountName" {
+			cache[strings.ToLower(name)] = p
+		}
+	}
+}
+
+// identifier is the ObjectIdentifier of a SID, prefixed with the domain if it's the same in every domain
+func (r *bloodhoundResolver) identifier(sid string) string {
+	s, err := secdesc.ParseSID(sid)
+	if err != nil {
+		return sid
+	}
+	if _, ok := s.DomainSID(); !ok {
+		return r.domain + "-" + sid
+	}
+	return sid
+}
+
+func validSID(sid string) bool {
+	_, err := secdesc.ParseSID(sid)
+	return err == nil
+}
+
+// members resolves a group's member DNs, also returning how many couldn't be found. Foreign security principals
+// stand for SIDs from other domains, so their SID is taken from their name
+func (r *bloodhoundResolver) members(dns []string) ([]bloodhoundPrincipal, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var lookup []string
+	for _, dn := range dns {
+		if !strings.Contains(strings.ToLower(dn), ",cn=foreignsecurityprincipals,") {
+			lookup = append(lookup, dn)
+		}
+	}
+	r.lookup("distinguishedName", lookup, r.byDN)
+	members := []bloodhoundPrincipal{}
+	missing := 0
+	for _, dn := range dns {
+		if strings.Contains(strings.ToLower(dn), ",cn=foreignsecurityprincipals,") {
+			if sid := rdnValue(dn); validSID(sid) {
+				members = append(members, r.principal(sid))
+				continue
+			}
+		}
+		if p := r.byDN[strings.ToLower(dn)]; p != nil {
+			members = append(members, *p)
+		} else {
+			missing++
+		}
+	}
+	return members, missing
+}
+
+// hosts resolves delegation targets to computers by their DNS name, or the first label of it, also returning how
+// many couldn't be found
+func (r *bloodhoundResolver) hosts(hosts []string) ([]bloodhoundPrincipal, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var full []string
+	for _, h := range hosts {
+		if strings.Contains(h, ".") {
+			full = append(full, h)
+		}
+	}
+	r.lookup("dNSHostName", full, r.byHost)
+	var short []string
+	for _, h := range hosts {
+		if !strings.Contains(h, ".") {
+			short = append(short, h+"$")
+		}
+	}
+	r.lookup("sAMAccountName", short, r.byAccount)
+	targets := []bloodhoundPrincipal{}
+	missing := 0
+	seen := make(map[string]bool)
+	for _, h := range hosts {
+		p := r.byHost[h]
+		if !strings.Contains(h, ".") {
+			p = r.byAccount[h+"$"]
+		}
+		if p == nil {
+			missing++
+			continue
+		}
+		if !seen[p.ObjectIdentifier] {
+			seen[p.ObjectIdentifier] = true
+			targets = append(targets, *p)
+		}
+	}
+	return targets, missing
+}
+
+// sids resolves SIDs to their kind of object. SIDs that aren't found are still written (BloodHound adds a node
+// for them), as groups if they're well-known and otherwise of an unknown kind
+func (r *bloodhoundResolver) sids(sids []string) []bloodhoundPrincipal {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.resolveSIDs(sids)
+}
+
+func (r *bloodhoundResolver) resolveSIDs(sids []string) []bloodhoundPrincipal {
+	var lookup []string
+	for _, s := range sids {
+		if validSID(s) {
+			lookup = append(lookup, s)
+		}
+	}
+	r.lookup("objectSid", lookup, r.bySID)
+	principals := []bloodhoundPrincipal{}
+	for _, s := range lookup {
+		principals = append(principals, r.principal(s))
+	}
+	return principals
+}
+
+// principal is the resolved SID, or a stand in for one that wasn't found. The caller holds r.mu
+func (r *bloodhoundResolver) principal(sid string) bloodhoundPrincipal {
+	if p := r.bySID[strings.ToLower(sid)]; p != nil {
+		return *p
+	}
+	kind := "Base"
+	if s, err := secdesc.ParseSID(sid); err == nil {
+		if _, ok := s.DomainSID(); !ok {
+			kind = "Group"
+		}
+	}
+	return bloodhoundPrincipal{ObjectIdentifier: r.identifier(sid), ObjectType: kind}
+}
+
+// aces maps a security descriptor to the edges BloodHound draws from it, the way SharpHound does. Deny ACEs aren't
+// weighed against the allows, and ACEs only passed on to child objects aren't counted
+func (r *bloodhoundResolver) aces(sd *secdesc.SecurityDescriptor, kind string) []bloodhoundACE {
+	type grant struct {
+		sid, right string
+		inherited  bool
+	}
+	var grants []grant
+	if sd.Owner != nil && !bloodhoundSkipped[sd.Owner.String()] {
+		grants = append(grants, grant{sd.Owner.String(), "Owns", false})
+	}
+	if sd.DACL != nil {
+		for _, ace := range sd.DACL.ACEs {
+			if (ace.Type != secdesc.AccessAllowedACEType && ace.Type != secdesc.AccessAllowedObjectACEType) ||
+				ace.Flags&secdesc.InheritOnlyACE != 0 || bloodhoundSkipped[ace.SID.String()] {
+				continue
+			}
+			inherited := ace.Flags&secdesc.InheritedACE != 0
+			for _, right := range bloodhoundRights(ace, kind) {
+				grants = append(grants, grant{ace.SID.String(), right, inherited})
+			}
+		}
+	}
+	var sids []string
+	for _, g := range grants {
+		sids = append(sids, g.sid)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resolveSIDs(sids)
+	aces := []bloodhoundACE{}
+	seen := make(map[grant]bool)
+	for _, g := range grants {
+		if seen[g] {
+			continue
+		}
+		seen[g] = true
+		p := r.principal(g.sid)
+		aces = append(aces, bloodhoundACE{PrincipalSID: p.ObjectIdentifier, PrincipalType: p.ObjectType, RightName: g.right, IsInherited: g.inherited})
+	}
+	sort.SliceStable(aces, func(i, j int) bool { return aces[i].RightName < aces[j].RightName })
+	return aces
+}
+
+// bloodhoundRights are the edges an allow ACE gives on an object of the kind
+func bloodhoundRights(ace secdesc.ACE, kind string) []string {
+	mask := ace.Mask
+	all := ace.ObjectType.IsZero()
+	if mask&secdesc.RightGenericAll == secdesc.RightGenericAll {
+		return []string{"GenericAll"}
+	}
+	var rights []string
+	if mask&secdesc.RightWriteDACL != 0 {
+		rights = append(rights, "WriteDacl")
+	}
+	if mask&secdesc.RightWriteOwner != 0 {
+		rights = append(rights, "WriteOwner")
+	}
+	if mask&secdesc.RightWriteProperty != 0 {
+		switch {
+		case all && (kind == "User" || kind == "Group" || kind == "Computer"):
+			rights = append(rights, "GenericWrite")
+		case kind == "Group" && ace.ObjectType == bloodhoundMemberGUID:
+			rights = append(rights, "AddMember")
+		case kind == "Computer" && ace.ObjectType == bloodhoundAllowedToActGUID:
+			rights = append(rights, "AddAllowedToAct")
+		case (kind == "User" || kind == "Computer") && ace.ObjectType == bloodhoundKeyCredentialGUID:
+			rights = append(rights, "AddKeyCredentialLink")
+		}
+	}
+	if mask&secdesc.RightSelf != 0 && kind == "Group" && (all || ace.ObjectType == bloodhoundMemberGUID) {
+		rights = append(rights, "AddSelf")
+	}
+	if mask&secdesc.RightControlAccess != 0 {
+		switch {
+		case all && (kind == "User" || kind == "Domain" || kind == "Computer"):
+			rights = append(rights, "AllExtendedRights")
+		case kind == "User" && ace.ObjectType == bloodhoundForceChangeGUID:
+			rights = append(rights, "ForceChangePassword")
+		case kind == "Domain" && ace.ObjectType == bloodhoundGetChangesGUID:
+			rights = append(rights, "GetChanges")
+		case kind == "Domain" && ace.ObjectType == bloodhoundGetChangesAllGUID:
+			rights = append(rights, "GetChangesAll")
+		case kind == "Computer" && ace.ObjectTypeName() == "ms-Mcs-AdmPwd":
+			rights = append(rights, "ReadLAPSPassword")
+		}
+	}
+	return rights
+}
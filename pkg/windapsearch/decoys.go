@@ -0,0 +1,205 @@
+package windapsearch
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+const (
+	// decoyClusterSize unused accounts created within decoyClusterWindow of each other look like a scripted deployment
+	decoyClusterSize   = 5
+	decoyClusterWindow = time.Minute
+
+	uacDontRequirePreauth = 0x400000
+)
+
+// decoyTrustees are the principals a deny-all ACE on a decoy is usually aimed at
+var decoyTrustees = map[string]string{
+	"S-1-1-0":  "Everyone",
+	"S-1-5-11": "Authenticated Users",
+	"S-1-5-7":  "Anonymous Logon",
+}
+
+func init() {
+	adschema.RegisterAttribute("decoyIndicators", "String(Unicode)", false)
+}
+
+// decoyCandidate is an account read by the decoy pass
+type decoyCandidate struct {
+	dn      string
+	created time.Time
+	unused  bool
+}
+
+// decoyCache holds the decoy pass results for each session, so forest and targets runs only look once per domain
+type decoyCache struct {
+	mu      sync.Mutex
+	results map[*ldapsession.LDAPSession]map[string][]string
+}
+
+// get returns the likely decoys for a session, keyed by lower case DN. The decoy pass runs (and its findings are
+// printed) the first time a session is seen
+func (c *decoyCache) get(session *ldapsession.LDAPSession) map[string][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if decoys, ok := c.results[session]; ok {
+		return decoys
+	}
+	if c.results == nil {
+		c.results = make(map[*ldapsession.LDAPSession]map[string][]string)
+	}
+	domain := ldapsession.DNToDomain(session.NamingContexts.Default)
+	decoys, err := findDecoys(session)
+	if err != nil {
+		session.Log.Warnf("unable to look for decoy objects in %s: %s", domain, err)
+	}
+	if len(decoys) > 0 {
+		fmt.Fprintf(os.Stderr, "[!] %d likely decoy account(s) in %s, tagged with decoyIndicators in the results:\n", len(decoys), domain)
+		for _, dn := range sortedKeys(decoys) {
+			fmt.Fprintf(os.Stderr, "    %s (%s)\n", dn, strings.Join(decoys[dn], "; "))
+		}
+	}
+
+	// key by lower case DN so entries from any module match, whatever case their DN is in
+	keyed := make(map[string][]string, len(decoys))
+	for dn, reasons := range decoys {
+		keyed[strings.ToLower(dn)] = reasons
+	}
+	c.results[session] = keyed
+	return keyed
+}
+
+// findDecoys looks for user accounts that are more likely to be honeytokens than real accounts: roastable accounts
+// that have never logged on, batches of unused accounts created together, and accounts whose DACL denies everyone
+// access. None of these prove an account is a decoy, they just mark it as one to leave alone
+func findDecoys(session *ldapsession.LDAPSession) (map[string][]string, error) {
+	sr := session.MakeSimpleSearchRequest("(&(objectCategory=person)(objectClass=user))",
+		[]string{"servicePrincipalName", "userAccountControl", "logonCount", "lastLogonTimestamp", "whenCreated", "nTSecurityDescriptor"})
+	res, err := session.GetPagedSearchResults(sr)
+	if err != nil {
+		return nil, err
+	}
+
+	decoys := make(map[string][]string)
+	flag := func(dn, reason string) {
+		decoys[dn] = append(decoys[dn], reason)
+	}
+	var candidates []decoyCandidate
+	for _, entry := range res.Entries {
+		unused := neverLoggedOn(entry)
+		if unused {
+			if len(entry.GetAttributeValues("servicePrincipalName")) > 0 {
+				flag(entry.DN, "kerberoastable but has never logged on")
+			}
+			uac, _ := strconv.ParseInt(entry.GetAttributeValue("userAccountControl"), 10, 64)
+			if uac&uacDontRequirePreauth != 0 {
+				flag(entry.DN, "AS-REP roastable but has never logged on")
+			}
+		}
+		if trustee := denyAllTrustee(entry.GetRawAttributeValue("nTSecurityDescriptor")); trustee != "" {
+			flag(entry.DN, fmt.Sprintf("DACL denies %s all access", trustee))
+		}
+		if created, err := adschema.ADLdapTimeToTimestamp(entry.GetAttributeValue("whenCreated")); err == nil {
+			candidates = append(candidates, decoyCandidate{dn: entry.DN, created: created, unused: unused})
+		}
+	}
+	for dn, size := range unusedClusters(candidates) {
+		flag(dn, fmt.Sprintf("one of %d never used accounts created within %d seconds of each other", size, int(decoyClusterWindow.Seconds())))
+	}
+	return decoys, nil
+}
+
+// neverLoggedOn is true if neither the replicated lastLogonTimestamp nor this DC's logonCount show a logon
+func neverLoggedOn(entry *ldap.Entry) bool {
+	last := entry.GetAttributeValue("lastLogonTimestamp")
+	count := entry.GetAttributeValue("logonCount")
+	return (last == "" || last == "0") && (count == "" || count == "0")
+}
+
+// denyAllTrustee returns the name of the broad principal a security descriptor denies full (or read) access to, if any
+func denyAllTrustee(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	sd, err := secdesc.Parse(b)
+	if err != nil || sd.DACL == nil {
+		return ""
+	}
+	for _, ace := range sd.DACL.ACEs {
+		if ace.Type != secdesc.AccessDeniedACEType && !(ace.Type == secdesc.AccessDeniedObjectACEType && ace.ObjectType.IsZero()) {
+			continue
+		}
+		if ace.Mask&secdesc.RightGenericAll != secdesc.RightGenericAll && ace.Mask&secdesc.RightGenericRead != secdesc.RightGenericRead {
+			continue
+		}
+		if name, ok := decoyTrustees[ace.SID.String()]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// unusedClusters finds runs of at least decoyClusterSize never used accounts created within decoyClusterWindow,
+// returning the size of the largest run each account is part of
+func unusedClusters(candidates []decoyCandidate) map[string]int {
+	var unused []decoyCandidate
+	for _, c := range candidates {
+		if c.unused {
+			unused = append(unused, c)
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool { return unused[i].created.Before(unused[j].created) })
+
+	clusters := make(map[string]int)
+	end := 0
+	for start := range unused {
+		if end < start {
+			end = start
+		}
+		for end+1 < len(unused) && unused[end+1].created.Sub(unused[start].created) <= decoyClusterWindow {
+			end++
+		}
+		size := end - start + 1
+		if size < decoyClusterSize {
+			continue
+		}
+		for _, c := range unused[start : end+1] {
+			if size > clusters[c.dn] {
+				clusters[c.dn] = size
+			}
+		}
+	}
+	return clusters
+}
+
+// tagDecoy adds the decoyIndicators attribute to an entry that the decoy pass flagged
+func tagDecoy(entry *ldap.Entry, decoys map[string][]string) {
+	reasons, ok := decoys[strings.ToLower(entry.DN)]
+	if !ok || entry.GetAttributeValue("decoyIndicators") != "" {
+		return
+	}
+	attr := &ldap.EntryAttribute{Name: "decoyIndicators", Values: reasons}
+	for _, r := range reasons {
+		attr.ByteValues = append(attr.ByteValues, []byte(r))
+	}
+	entry.Attributes = append(entry.Attributes, attr)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
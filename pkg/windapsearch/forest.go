@@ -0,0 +1,52 @@
+package windapsearch
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+// forestTargets discovers every domain in the forest and opens a session to a DC of each one. The given session is
+// re-used for its own domain. Other domains use the current credentials, unless credentials for them are given in the
+// --forest-creds file. Domains that can't be reached are logged and skipped
+func (w *WindapSearchSession) forestTargets(session *ldapsession.LDAPSession) ([]moduleTarget, error) {
+	domains, err := session.GetForestDomains()
+	if err != nil {
+		return nil, err
+	}
+
+	var creds []Target
+	if w.Options.ForestCreds != "" {
+		creds, err = LoadTargets(w.Options.ForestCreds)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	current := ldapsession.DNToDomain(session.BaseDN)
+	var targets []moduleTarget
+	for _, d := range domains {
+		fmt.Fprintf(os.Stderr, "[+] Found domain in forest: %s\n", d.DNSName)
+		if strings.EqualFold(d.DNSName, current) {
+			targets = append(targets, moduleTarget{session: session, domain: d.DNSName})
+			continue
+		}
+		options := session.Options()
+		t, ok := findTarget(creds, d.DNSName)
+		if !ok {
+			t = Target{Domain: d.DNSName}
+		}
+		if err = t.apply(&options); err != nil {
+			return targets, err
+		}
+		sess, err := ldapsession.NewLDAPSession(&options, w.ctx)
+		if err != nil {
+			w.Log.WithField("domain", d.DNSName).Errorf("unable to connect to domain, skipping: %s", wrap(err))
+			continue
+		}
+		targets = append(targets, moduleTarget{session: sess, domain: d.DNSName})
+	}
+	return targets, nil
+}
@@ -0,0 +1,408 @@
+package windapsearch
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	uac "github.com/audibleblink/msldapuac"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+// Graph formats for --graph
+const (
+	graphDOT     = "dot"
+	graphGraphML = "graphml"
+)
+
+// graphEdgeAttrs are the relationships --graph-edges can draw, with the attributes each one is read from
+var graphEdgeAttrs = map[string][]string{
+	"memberOf":   {"memberOf"},
+	"member":     {"member"},
+	"manager":    {"manager"},
+	"delegation": {"userAccountControl", "msDS-AllowedToDelegateTo", "msDS-AllowedToActOnBehalfOfOtherIdentity"},
+	"acl":        {"nTSecurityDescriptor"},
+}
+
+// DefaultGraphEdges are the relationships drawn unless --graph-edges is given. ACL edges take reading every
+// security descriptor, so they're only drawn when asked for
+var DefaultGraphEdges = []string{"memberOf", "manager", "delegation"}
+
+// graphControlRights are the rights an ACL edge is drawn for: the ones that give control of the object. GenericAll
+// and GenericWrite count too, but only whole, since they include read rights every ACE has
+const graphControlRights = secdesc.RightWriteDACL | secdesc.RightWriteOwner | secdesc.RightWriteProperty |
+	secdesc.RightControlAccess | secdesc.RightSelf
+
+// graphControl returns the rights in mask that an ACL edge is drawn for
+func graphControl(mask uint32) uint32 {
+	control := mask & graphControlRights
+	for _, generic := range []uint32{secdesc.RightGenericAll, secdesc.RightGenericWrite} {
+		if mask&generic == generic {
+			control |= generic
+		}
+	}
+	return control
+}
+
+// defaultGraphTrustees are the SIDs that control objects out of the box, whose ACL edges would only hide the rest
+var defaultGraphTrustees = map[string]bool{
+	"S-1-3-0":      true, // Creator Owner
+	"S-1-5-9":      true, // Enterprise Domain Controllers
+	"S-1-5-10":     true, // Self
+	"S-1-5-18":     true, // Local System
+	"S-1-5-32-544": true, // Administrators
+	"S-1-5-32-548": true, // Account Operators
+	"S-1-5-32-550": true, // Print Operators
+}
+
+// defaultGraphRIDs are the domain groups that control objects out of the box
+var defaultGraphRIDs = map[uint32]bool{
+	512: true, // Domain Admins
+	518: true, // Schema Admins
+	519: true, // Enterprise Admins
+	526: true, // Key Admins
+	527: true, // Enterprise Key Admins
+}
+
+// parseGraphEdges checks the --graph-edges names, returning them as graphEdgeAttrs has them
+func parseGraphEdges(names []string) ([]string, error) {
+	var edges []string
+	for _, n := range names {
+		found := ""
+		for kind := range graphEdgeAttrs {
+			if strings.EqualFold(kind, strings.TrimSpace(n)) {
+				found = kind
+			}
+		}
+		if found == "" {
+			return nil, fmt.Errorf("unknown graph edge %q (memberOf, member, manager, delegation, or acl)", n)
+		}
+		edges = append(edges, found)
+	}
+	return edges, nil
+}
+
+// graphNode is an object in the graph, identified by its DN. Principals only known by SID and delegation targets
+// only known by hostname are identified by those instead
+type graphNode struct {
+	ID            string `json:"id"`
+	Label         string `json:"label"`
+	Unconstrained bool   `json:"unconstrained,omitempty"`
+}
+
+// graphEdge is a relationship from one node to another
+type graphEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Kind  string `json:"kind"`
+	Label string `json:"label,omitempty"`
+}
+
+// graphFragment is what one entry adds to the graph: its own node, its edges, and the nodes they lead to
+type graphFragment struct {
+	Node  graphNode   `json:"node"`
+	Edges []graphEdge `json:"edges"`
+	Stubs []graphNode `json:"stubs"`
+}
+
+// graphWriter writes the relationships of the results as a DOT or GraphML graph. Edges are written as entries arrive;
+// nodes they lead to that aren't results themselves are only labeled at the end, from their DN, SID name or hostname
+type graphWriter struct {
+	format string
+	edges  map[string]bool
+	// sids finds the DNs of the principals in security descriptors, so they're the same node as the object
+	sids *ldapsession.SIDResolver
+
+	started bool
+	written map[string]bool
+	stubs   map[string]graphNode
+	drawn   map[graphEdge]bool
+}
+
+func (w *WindapSearchSession) newGraphWriter(targets []moduleTarget) *graphWriter {
+	g := &graphWriter{
+		format:  w.Options.Graph,
+		edges:   make(map[string]bool),
+		written: make(map[string]bool),
+		stubs:   make(map[string]graphNode),
+		drawn:   make(map[graphEdge]bool),
+	}
+	for _, e := range w.graphEdges {
+		g.edges[e] = true
+	}
+	// anonymized SIDs can't be looked up, and the DNs found wouldn't be anonymized
+	if len(targets) > 0 && w.anonymizer == nil {
+		g.sids = targets[0].session.SIDResolver()
+	}
+	return g
+}
+
+func (g *graphWriter) marshal(e *adschema.ADEntry) ([]byte, error) {
+	f := graphFragment{Node: graphNode{ID: e.DN, Label: graphLabel(e)}}
+	stub := func(id, label string) {
+		f.Stubs = append(f.Stubs, graphNode{ID: id, Label: label})
+	}
+	link := func(attr, kind string, reverse bool) {
+		for _, dn := range e.GetAttributeValues(attr) {
+			edge := graphEdge{From: e.DN, To: dn, Kind: kind}
+			if reverse {
+				edge.From, edge.To = dn, e.DN
+			}
+			f.Edges = append(f.Edges, edge)
+			stub(dn, rdnValue(dn))
+		}
+	}
+	if g.edges["memberOf"] {
+		link("memberOf", "MemberOf", false)
+	}
+	if g.edges["member"] {
+		link("member", "MemberOf", true)
+	}
+	if g.edges["manager"] {
+		link("manager", "Manages", true)
+	}
+
+	var trustees []graphEdge
+	if g.edges["delegation"] {
+		flags, _ := strconv.Atoi(e.GetAttributeValue("userAccountControl"))
+		f.Node.Unconstrained = flags&uac.TrustedForDelegation != 0
+		transition := ""
+		if flags&uac.TrustedToAuthForDelegation != 0 {
+			transition = " (protocol transition)"
+		}
+		for _, spn := range e.GetAttributeValues("msDS-AllowedToDelegateTo") {
+			host := strings.ToLower(strings.SplitN(strings.SplitN(spn+"/", "/", 3)[1], ":", 2)[0])
+			f.Edges = append(f.Edges, graphEdge{From: e.DN, To: host, Kind: "AllowedToDelegate", Label: spn + transition})
+			stub(host, host)
+		}
+		if raw := e.GetRawAttributeValue("msDS-AllowedToActOnBehalfOfOtherIdentity"); len(raw) > 0 {
+			if sd, err := secdesc.Parse(raw); err == nil && sd.DACL != nil {
+				for _, ace := range sd.DACL.ACEs {
+					if ace.Type == secdesc.AccessAllowedACEType {
+						trustees = append(trustees, graphEdge{From: ace.SID.String(), To: e.DN, Kind: "AllowedToAct"})
+					}
+				}
+			}
+		}
+	}
+	if g.edges["acl"] {
+		trustees = append(trustees, aclEdges(e)...)
+	}
+	if len(trustees) > 0 {
+		var sids []string
+		for _, t := range trustees {
+			sids = append(sids, t.From)
+		}
+		var dns, names map[string]string
+		if g.sids != nil {
+			dns, names = g.sids.DNs(sids), g.sids.Resolve(sids)
+		}
+		for _, t := range trustees {
+			sid := t.From
+			if dn := dns[sid]; dn != "" {
+				t.From = dn
+				stub(dn, rdnValue(dn))
+			} else if name := names[sid]; name != "" {
+				stub(sid, name)
+			} else {
+				stub(sid, sid)
+			}
+			f.Edges = append(f.Edges, t)
+		}
+	}
+	return json.Marshal(f)
+}
+
+// aclEdges are the edges from the principals a security descriptor gives control of the object to, by SID. Rights
+// the object's DACL only passes on to its children, and the defaults every object has, aren't drawn
+func aclEdges(e *adschema.ADEntry) []graphEdge {
+	raw := e.GetRawAttributeValue("nTSecurityDescriptor")
+	if len(raw) == 0 {
+		return nil
+	}
+	sd, err := secdesc.Parse(raw)
+	if err != nil {
+		return nil
+	}
+	var edges []graphEdge
+	if sd.Owner != nil && !defaultGraphTrustee(*sd.Owner) {
+		edges = append(edges, graphEdge{From: sd.Owner.String(), To: e.DN, Kind: "Owns"})
+	}
+	if sd.DACL == nil {
+		return edges
+	}
+	for _, ace := range sd.DACL.ACEs {
+		if (ace.Type != secdesc.AccessAllowedACEType && ace.Type != secdesc.AccessAllowedObjectACEType) ||
+			ace.Flags&secdesc.InheritOnlyACE != 0 || graphControl(ace.Mask) == 0 || defaultGraphTrustee(ace.SID) {
+			continue
+		}
+		label := strings.Join(secdesc.RightNames(graphControl(ace.Mask)), "|")
+		if name := ace.ObjectTypeName(); name != "" {
+			label += " " + name
+		}
+		edges = append(edges, graphEdge{From: ace.SID.String(), To: e.DN, Kind: "ACL", Label: label})
+	}
+	return edges
+}
+
+func defaultGraphTrustee(sid secdesc.SID) bool {
+	if defaultGraphTrustees[sid.String()] {
+		return true
+	}
+	_, inDomain := sid.DomainSID()
+	return inDomain && defaultGraphRIDs[sid.RID()]
+}
+
+// graphLabel is what a result's node is labeled with: its sAMAccountName, or name, or the value of its RDN
+func graphLabel(e *adschema.ADEntry) string {
+	for _, attr := range []string{"sAMAccountName", "name", "cn"} {
+		if v := e.GetAttributeValue(attr); v != "" {
+			return v
+		}
+	}
+	return rdnValue(e.DN)
+}
+
+// rdnValue returns the value of the first RDN of a DN, e.g. Domain Admins for CN=Domain Admins,CN=Users,...
+func rdnValue(dn string) string {
+	first := dn
+	for i := 0; i < len(dn); i++ {
+		if dn[i] == '\\' {
+			i++
+		} else if dn[i] == ',' {
+			first = dn[:i]
+			break
+		}
+	}
+	if parts := strings.SplitN(first, "=", 2); len(parts) == 2 {
+		return strings.NewReplacer(`\,`, ",", `\+`, "+", `\"`, `"`, `\\`, `\`).Replace(parts[1])
+	}
+	return dn
+}
+
+func joinLabel(parts ...string) string {
+	var nonEmpty []string
+	for _, p := range parts {
+		if p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	return strings.Join(nonEmpty, ": ")
+}
+
+func (g *graphWriter) write(out io.Writer, b []byte) error {
+	var f graphFragment
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	var sb strings.Builder
+	if !g.started {
+		g.started = true
+		sb.WriteString(g.header())
+	}
+	if f.Node.ID != "" && !g.written[f.Node.ID] {
+		g.written[f.Node.ID] = true
+		delete(g.stubs, f.Node.ID)
+		sb.WriteString(g.node(f.Node))
+	}
+	for _, s := range f.Stubs {
+		if _, ok := g.stubs[s.ID]; !ok && !g.written[s.ID] {
+			g.stubs[s.ID] = s
+		}
+	}
+	for _, e := range f.Edges {
+		if !g.drawn[e] {
+			g.drawn[e] = true
+			sb.WriteString(g.edge(e))
+		}
+	}
+	_, err := io.WriteString(out, sb.String())
+	return err
+}
+
+func (g *graphWriter) close(out io.Writer) error {
+	var sb strings.Builder
+	if !g.started {
+		sb.WriteString(g.header())
+	}
+	var ids []string
+	for id := range g.stubs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		sb.WriteString(g.node(g.stubs[id]))
+	}
+	if g.format == graphGraphML {
+		sb.WriteString("  </graph>\n</graphml>\n")
+	} else {
+		sb.WriteString("}\n")
+	}
+	_, err := io.WriteString(out, sb.String())
+	return err
+}
+
+// graphEdgeColors tell the kinds of edge apart in DOT output
+var graphEdgeColors = map[string]string{
+	"MemberOf":          "black",
+	"Manages":           "gray",
+	"AllowedToDelegate": "blue",
+	"AllowedToAct":      "purple",
+	"Owns":              "orange",
+	"ACL":               "red",
+}
+
+func (g *graphWriter) header() string {
+	if g.format == graphGraphML {
+		return xml.Header + `<graphml xmlns="http://graphml.graphdrawing.org/xmlns">
+  <key id="label" for="node" attr.name="label" attr.type="string"/>
+  <key id="unconstrained" for="node" attr.name="unconstrained delegation" attr.type="boolean"/>
+  <key id="kind" for="edge" attr.name="kind" attr.type="string"/>
+  <key id="elabel" for="edge" attr.name="label" attr.type="string"/>
+  <graph id="windapsearch" edgedefault="directed">
+`
+	}
+	return "digraph windapsearch {\n\tnode [shape=box];\n"
+}
+
+func (g *graphWriter) node(n graphNode) string {
+	if g.format == graphGraphML {
+		s := fmt.Sprintf("    <node id=\"%s\"><data key=\"label\">%s</data>", xmlEscape(n.ID), xmlEscape(n.Label))
+		if n.Unconstrained {
+			s += `<data key="unconstrained">true</data>`
+		}
+		return s + "</node>\n"
+	}
+	extra := ""
+	if n.Unconstrained {
+		extra = ", color=red, xlabel=\"unconstrained\""
+	}
+	return fmt.Sprintf("\t\"%s\" [label=\"%s\"%s];\n", dotQuote(n.ID), dotQuote(n.Label), extra)
+}
+
+func (g *graphWriter) edge(e graphEdge) string {
+	label := joinLabel(e.Kind, e.Label)
+	if g.format == graphGraphML {
+		return fmt.Sprintf("    <edge source=\"%s\" target=\"%s\"><data key=\"kind\">%s</data><data key=\"elabel\">%s</data></edge>\n",
+			xmlEscape(e.From), xmlEscape(e.To), xmlEscape(e.Kind), xmlEscape(label))
+	}
+	return fmt.Sprintf("\t\"%s\" -> \"%s\" [label=\"%s\", color=%s];\n", dotQuote(e.From), dotQuote(e.To), dotQuote(label), graphEdgeColors[e.Kind])
+}
+
+// dotQuote escapes a string for a quoted DOT ID. Backslashes (e.g. in DN escapes or DOMAIN\name) would otherwise be
+// read as escapes like \N
+func dotQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func xmlEscape(s string) string {
+	var sb strings.Builder
+	xml.EscapeText(&sb, []byte(s))
+	return sb.String()
+}
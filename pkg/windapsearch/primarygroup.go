@@ -0,0 +1,78 @@
+package windapsearch
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+// primaryGroupCache remembers the DNs of the groups primaryGroupIDs refer to. Nearly every account has Domain Users
+// or Domain Computers as its primary group, so there's only a handful to look up
+type primaryGroupCache struct {
+	mu  sync.Mutex
+	dns map[string]string
+}
+
+// lookup returns the DN of the group with the RID in the session's domain, or "" if it isn't found
+func (c *primaryGroupCache) lookup(session *ldapsession.LDAPSession, rid string) string {
+	domainSID := session.SIDResolver().DomainSID()
+	if domainSID == "" {
+		return ""
+	}
+	sid := fmt.Sprintf("%s-%s", domainSID, rid)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if dn, ok := c.dns[sid]; ok {
+		return dn
+	}
+	if c.dns == nil {
+		c.dns = make(map[string]string)
+	}
+	res, err := session.BulkSearch(session.NamingContexts.Default, "objectSid", []string{sid}, "(objectCategory=group)", []string{"objectSid"})
+	if err != nil {
+		session.Log.Infof("unable to look up primary group %s: %s", sid, err)
+	}
+	c.dns[sid] = ""
+	if res != nil && len(res.Entries) > 0 {
+		c.dns[sid] = res.Entries[0].DN
+	}
+	return c.dns[sid]
+}
+
+// tagPrimaryGroup adds an account's primary group to its memberOf, which AD leaves it out of. With drop,
+// primaryGroupID is removed from the entry afterwards, for when it was only read to do this
+func (c *primaryGroupCache) tagPrimaryGroup(session *ldapsession.LDAPSession, entry *ldap.Entry, drop bool) {
+	rid := entry.GetAttributeValue("primaryGroupID")
+	if drop {
+		var kept []*ldap.EntryAttribute
+		for _, attr := range entry.Attributes {
+			if !strings.EqualFold(attr.Name, "primaryGroupID") {
+				kept = append(kept, attr)
+			}
+		}
+		entry.Attributes = kept
+	}
+	if rid == "" {
+		return
+	}
+	dn := c.lookup(session, rid)
+	if dn == "" {
+		return
+	}
+	for _, attr := range entry.Attributes {
+		if strings.EqualFold(attr.Name, "memberOf") {
+			for _, v := range attr.Values {
+				if strings.EqualFold(v, dn) {
+					return
+				}
+			}
+			attr.Values = append(attr.Values, dn)
+			attr.ByteValues = append(attr.ByteValues, []byte(dn))
+			return
+		}
+	}
+	entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute("memberOf", []string{dn}))
+}
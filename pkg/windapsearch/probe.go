@@ -0,0 +1,139 @@
+package windapsearch
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+func init() {
+	adschema.RegisterAttribute("reachable", "String(Unicode)", true)
+	adschema.RegisterAttribute("openPorts", "String(Unicode)", false)
+}
+
+const (
+	// DefaultProbeTimeout is how long a port is given to accept a connection before it's counted as closed
+	DefaultProbeTimeout = 2 * time.Second
+	// DefaultProbeConcurrency is how many hosts are probed at the same time
+	DefaultProbeConcurrency = 20
+)
+
+// probePorts are the ports checked on every host: SMB and WinRM, the usual ways onto a Windows host
+var probePorts = []struct {
+	port int
+	name string
+}{
+	{445, "smb"},
+	{5985, "winrm"},
+	{5986, "winrm-https"},
+}
+
+// probeCache remembers which ports were open on each host, so hosts in the results of several modules are only
+// probed once
+type probeCache struct {
+	mu    sync.Mutex
+	ports map[string][]string
+}
+
+// tagReachable checks an entry's dNSHostName for open SMB and WinRM ports, adding reachable (alive if any port
+// accepted a connection, dead if none did) and the openPorts that did
+func (w *WindapSearchSession) tagReachable(session *ldapsession.LDAPSession, entry *ldap.Entry) {
+	host := entry.GetAttributeValue("dNSHostName")
+	if host == "" {
+		return
+	}
+	open := w.probes.probe(w, session, host)
+	state := "dead"
+	if len(open) > 0 {
+		state = "alive"
+		entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute("openPorts", open))
+	}
+	entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute("reachable", []string{state}))
+}
+
+func (c *probeCache) probe(w *WindapSearchSession, session *ldapsession.LDAPSession, host string) []string {
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	c.mu.Lock()
+	open, ok := c.ports[key]
+	c.mu.Unlock()
+	if ok {
+		return open
+	}
+
+	// through a proxy the name is resolved on the other side, otherwise use the session's resolver
+	address := key
+	if session.Options().Proxy == "" {
+		addrs := w.hosts.lookup(session, key)
+		if len(addrs) == 0 {
+			return c.remember(key, nil)
+		}
+		address = addrs[0]
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	found := make(map[int]bool)
+	for _, p := range probePorts {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			if portOpen(session, address, port, w.Options.ProbeTimeout) {
+				mu.Lock()
+				found[port] = true
+				mu.Unlock()
+			}
+		}(p.port)
+	}
+	wg.Wait()
+	for _, p := range probePorts {
+		if found[p.port] {
+			open = append(open, fmt.Sprintf("%d/%s", p.port, p.name))
+		}
+	}
+	return c.remember(key, open)
+}
+
+func (c *probeCache) remember(host string, open []string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ports == nil {
+		c.ports = make(map[string][]string)
+	}
+	c.ports[host] = open
+	return open
+}
+
+// portOpen is true if port on address accepts a TCP connection within timeout. The SOCKS handshake isn't covered by
+// the dialer's timeout, so the whole dial is raced against it
+func portOpen(session *ldapsession.LDAPSession, address string, port int, timeout time.Duration) bool {
+	result := make(chan net.Conn, 1)
+	go func() {
+		conn, err := session.DialTCP(address, port, timeout)
+		if err != nil {
+			conn = nil
+		}
+		result <- conn
+	}()
+	select {
+	case conn := <-result:
+		if conn == nil {
+			return false
+		}
+		conn.Close()
+		return true
+	case <-time.After(timeout):
+		// close the connection if it's made after all
+		go func() {
+			if conn := <-result; conn != nil {
+				conn.Close()
+			}
+		}()
+		return false
+	}
+}
@@ -0,0 +1,238 @@
+package windapsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ropnop/go-windapsearch/pkg/buildinfo"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/ropnop/go-windapsearch/pkg/modules"
+)
+
+// provenance is how a module's results were collected, written before them with --provenance
+type provenance struct {
+	Tool       string             `json:"tool"`
+	Command    []string           `json:"command"`
+	Host       string             `json:"host,omitempty"`
+	Module     string             `json:"module"`
+	Attributes []string           `json:"attributes"`
+	Targets    []provenanceTarget `json:"targets"`
+	Started    time.Time          `json:"started"`
+}
+
+// provenanceTarget is where one target's results came from, and who they were read as
+type provenanceTarget struct {
+	Domain    string `json:"domain"`
+	Server    string `json:"server"`
+	Transport string `json:"transport"`
+	Bind      string `json:"bind"`
+	Auth      string `json:"auth,omitempty"`
+	BaseDN    string `json:"baseDN"`
+	Partition string `json:"partition,omitempty"`
+}
+
+// provenanceSummary is written after the results: when the collection finished, and what every target's searches
+// returned
+type provenanceSummary struct {
+	Finished time.Time      `json:"finished"`
+	Runs     []*moduleStats `json:"runs"`
+}
+
+// provenanceWriter wraps a result writer to add the collection's provenance before the results, and a summary of the
+// searches after them, so a dataset says how it was made. Text and CSV get them as # comment lines; JSON output
+// becomes an object holding the provenance, the results array and the summary
+type provenanceWriter struct {
+	resultWriter
+	info    provenance
+	runs    *[]*moduleStats
+	json    bool
+	started bool
+}
+
+// newProvenanceWriter wraps rw. The runs of every target are added to runs while the module runs, and are read once
+// the results are done
+func (w *WindapSearchSession) newProvenanceWriter(rw resultWriter, mod modules.Module, attrs []string, targets []moduleTarget, runs *[]*moduleStats) *provenanceWriter {
+	info := provenance{
+		Tool:       fmt.Sprintf("windapsearch %s (%s, built %s)", buildinfo.Version, buildinfo.GitSHA, buildinfo.BuildDate),
+		Command:    redactArgs(os.Args),
+		Module:     mod.Name(),
+		Attributes: attrs,
+		Started:    time.Now().UTC(),
+	}
+	info.Host, _ = os.Hostname()
+	for _, t := range targets {
+		info.Targets = append(info.Targets, newProvenanceTarget(t.session, mod))
+	}
+	if w.anonymizer != nil {
+		for _, t := range targets {
+			w.anonymizer.addSession(t.session)
+		}
+		w.anonymizer.provenance(&info)
+	}
+	return &provenanceWriter{resultWriter: rw, info: info, runs: runs, json: w.Options.JSON}
+}
+
+func newProvenanceTarget(session *ldapsession.LDAPSession, mod modules.Module) provenanceTarget {
+	options := session.Options()
+	server, port := session.Server()
+	t := provenanceTarget{
+		Domain:    ldapsession.DNToDomain(session.NamingContexts.Default),
+		Server:    fmt.Sprintf("%s:%d", server, port),
+		Transport: "ldap",
+		Bind:      options.Username,
+		BaseDN:    session.BaseDN,
+	}
+	if options.Secure {
+		t.Transport = "ldaps"
+	} else if options.StartTLS {
+		t.Transport = "ldap+starttls"
+	}
+	switch {
+	case t.Bind == "":
+		t.Bind = "anonymous"
+	case options.UseKerberos:
+		t.Auth = "kerberos"
+	case options.ClientCert != "" && options.Password == "":
+		t.Auth = "certificate"
+	case options.Hash != "":
+		t.Auth = "ntlm (hash)"
+	case options.UseNTLM:
+		t.Auth = "ntlm"
+	default:
+		t.Auth = "simple"
+	}
+	if pm, ok := mod.(modules.PartitionModule); ok {
+		t.Partition = pm.Partition().String()
+		if dn, err := session.PartitionDN(pm.Partition()); err == nil {
+			t.BaseDN = dn
+		}
+	}
+	return t
+}
+
+func (p *provenanceWriter) write(out io.Writer, b []byte) error {
+	if err := p.writeHeader(out); err != nil {
+		return err
+	}
+	return p.resultWriter.write(out, b)
+}
+
+func (p *provenanceWriter) close(out io.Writer) error {
+	if err := p.writeHeader(out); err != nil {
+		return err
+	}
+	if err := p.resultWriter.close(out); err != nil {
+		return err
+	}
+	summary := provenanceSummary{Finished: time.Now().UTC(), Runs: *p.runs}
+	if p.json {
+		b, err := json.Marshal(summary)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, `,"summary":%s}`, b)
+		return err
+	}
+	lines := []string{"finished: " + summary.Finished.Format(time.RFC3339)}
+	for i, s := range summary.Runs {
+		domain := s.Domain
+		if domain == "" && i < len(p.info.Targets) {
+			domain = p.info.Targets[i].Domain
+		}
+		lines = append(lines, fmt.Sprintf("run: %s on %s: %d entries from %d searches (%d pages) in %s, %s", s.Module, domain,
+			s.Entries, s.Searches, s.Pages, s.Duration.Round(time.Millisecond), s.status()))
+		for _, f := range s.Filters {
+			lines = append(lines, "search: "+f)
+		}
+		if s.MoreFilters > 0 {
+			lines = append(lines, fmt.Sprintf("search: ... and %d more", s.MoreFilters))
+		}
+		for _, msg := range s.Warnings {
+			lines = append(lines, "warning: "+msg)
+		}
+		for _, msg := range s.Errors {
+			lines = append(lines, "error: "+msg)
+		}
+	}
+	// the text format doesn't end entries with a blank line, so the trailer needs one before it
+	prefix := ""
+	if t, ok := p.resultWriter.(*textWriter); ok && t.started {
+		prefix = "\n"
+	}
+	_, err := io.WriteString(out, prefix+commentLines(lines))
+	return err
+}
+
+// writeHeader writes the provenance the first time the output is written to
+func (p *provenanceWriter) writeHeader(out io.Writer) error {
+	if p.started {
+		return nil
+	}
+	p.started = true
+	if p.json {
+		b, err := json.Marshal(p.info)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(out, `{"provenance":%s,"results":`, b)
+		return err
+	}
+	lines := []string{
+		"tool: " + p.info.Tool,
+		"command: " + strings.Join(p.info.Command, " "),
+	}
+	if p.info.Host != "" {
+		lines = append(lines, "host: "+p.info.Host)
+	}
+	lines = append(lines,
+		"module: "+p.info.Module,
+		"attributes: "+strings.Join(p.info.Attributes, ", "),
+		"started: "+p.info.Started.Format(time.RFC3339))
+	for _, t := range p.info.Targets {
+		bind := t.Bind
+		if t.Auth != "" {
+			bind += " (" + t.Auth + ")"
+		}
+		lines = append(lines, fmt.Sprintf("target: %s via %s (%s) as %s, base %q", t.Domain, t.Server, t.Transport, bind, t.BaseDN))
+	}
+	header := commentLines(lines)
+	if _, ok := p.resultWriter.(*textWriter); ok {
+		header += "\n"
+	}
+	_, err := io.WriteString(out, header)
+	return err
+}
+
+// commentLines makes lines into # comments
+func commentLines(lines []string) string {
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString("# " + l + "\n")
+	}
+	return b.String()
+}
+
+// redactArgs returns the command line with the values of the credential flags replaced, so it can be recorded
+func redactArgs(args []string) []string {
+	secret := map[string]bool{"-p": true, "--password": true, "--hash": true}
+	out := make([]string, len(args))
+	copy(out, args)
+	for i := 0; i < len(out); i++ {
+		arg := out[i]
+		name := strings.SplitN(arg, "=", 2)[0]
+		switch {
+		case secret[arg] && i+1 < len(out):
+			out[i+1] = "REDACTED"
+			i++
+		case strings.Contains(arg, "=") && secret[name]:
+			out[i] = name + "=REDACTED"
+		case strings.HasPrefix(arg, "-p") && !strings.HasPrefix(arg, "--") && len(arg) > 2:
+			out[i] = "-pREDACTED"
+		}
+	}
+	return out
+}
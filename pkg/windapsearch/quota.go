@@ -0,0 +1,87 @@
+package windapsearch
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// moduleQuotas are the limits of --max-entries or --max-searches: one for every module, and ones for a module by
+// name that take its place
+type moduleQuotas struct {
+	all      int
+	byModule map[string]int
+}
+
+// parseModuleQuotas parses quotas given as N for every module, or module=N for one, e.g. 100000,acl=50000
+func (w *WindapSearchSession) parseModuleQuotas(values []string) (moduleQuotas, error) {
+	q := moduleQuotas{byModule: make(map[string]int)}
+	for _, v := range values {
+		name, limit := "", v
+		if i := strings.Index(v, "="); i >= 0 {
+			name, limit = strings.ToLower(strings.TrimSpace(v[:i])), v[i+1:]
+			if w.GetModuleByName(name) == nil {
+				return q, fmt.Errorf("unknown module %q", name)
+			}
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(limit))
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("invalid quota %q, expected N or module=N with N at least 1", v)
+		}
+		if name == "" {
+			q.all = n
+		} else {
+			q.byModule[name] = n
+		}
+	}
+	return q, nil
+}
+
+// limit is the quota for a module, 0 for none
+func (q moduleQuotas) limit(module string) int {
+	if n, ok := q.byModule[strings.ToLower(module)]; ok {
+		return n
+	}
+	return q.all
+}
+
+// entryQuota stops a module run once it has output max entries: the result workers drop the rest, and the run's
+// searches are cancelled so it doesn't carry on collecting what won't be output
+type entryQuota struct {
+	max    int64
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	n       int64
+	reached bool
+}
+
+// take is called by the result workers for every entry, and is false once the quota is used up
+func (q *entryQuota) take() bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.n < q.max {
+		q.n++
+		return true
+	}
+	if !q.reached {
+		q.reached = true
+		q.cancel()
+	}
+	return false
+}
+
+// hit is true if entries were dropped
+func (q *entryQuota) hit() bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.reached
+}
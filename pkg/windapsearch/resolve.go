@@ -0,0 +1,63 @@
+package windapsearch
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+func init() {
+	adschema.RegisterAttribute("ipAddresses", "String(Unicode)", false)
+}
+
+// hostCache remembers the addresses dNSHostNames resolved to, so a host that's in the results of several modules
+// (or several times in one) is only looked up once
+type hostCache struct {
+	mu    sync.Mutex
+	addrs map[string][]string
+}
+
+// lookup resolves host with the session's resolver (the --dns-server, --dns-tcp and --proxy-dns settings), keeping
+// only addresses of the --ip-version asked for. Names that don't resolve are remembered too, with no addresses
+func (c *hostCache) lookup(session *ldapsession.LDAPSession, host string) []string {
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	c.mu.Lock()
+	addrs, ok := c.addrs[key]
+	c.mu.Unlock()
+	if ok {
+		return addrs
+	}
+
+	resolver := session.Resolver()
+	addrs, err := resolver.LookupHost(key)
+	if err == nil {
+		addrs, err = resolver.SelectAddresses(addrs, session.Options().IPVersion)
+	}
+	if err != nil {
+		session.Log.Infof("unable to resolve %s: %s", host, err)
+		addrs = nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.addrs == nil {
+		c.addrs = make(map[string][]string)
+	}
+	c.addrs[key] = addrs
+	return addrs
+}
+
+// tagAddresses adds the addresses an entry's dNSHostName resolves to as ipAddresses, so computer results can be fed
+// straight to a scanner
+func (c *hostCache) tagAddresses(session *ldapsession.LDAPSession, entry *ldap.Entry) {
+	host := entry.GetAttributeValue("dNSHostName")
+	if host == "" {
+		return
+	}
+	if addrs := c.lookup(session, host); len(addrs) > 0 {
+		entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute("ipAddresses", addrs))
+	}
+}
@@ -1,44 +1,51 @@
 package windapsearch
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-ldap/ldap/v3"
 	"github.com/ropnop/go-windapsearch/pkg/adschema"
 	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/ropnop/go-windapsearch/pkg/modules"
+	"github.com/sirupsen/logrus"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 )
 
-func (w *WindapSearchSession) outputWorker(input chan []byte, done chan struct{}) {
+func (w *WindapSearchSession) outputWorker(output io.Writer, rw resultWriter, input chan []byte, done chan struct{}) {
 	w.Log.Debugf("outputWorker started")
 	defer func() {
-		if w.Options.JSON {
-			io.WriteString(w.OutputWriter, "]")
-		}
 		// notify we're done writing by closing channel
 		close(done)
 		w.Log.Debugf("outputWorker closing, finished writing")
 	}()
 
-	entryDelimiter := "\n"
-	if w.Options.JSON {
-		entryDelimiter = ","
-		io.WriteString(w.OutputWriter, "[")
+	var writeErr error
+	for b := range input {
+		// keep draining the channel after a failed write, so the result workers don't block
+		if writeErr == nil {
+			writeErr = rw.write(output, b)
+		}
 	}
-	firstEntry, ok := <-input
-	if !ok {
-		return
+	if writeErr == nil {
+		writeErr = rw.close(output)
 	}
-	w.OutputWriter.Write(firstEntry)
-	for b := range input {
-		io.WriteString(w.OutputWriter, entryDelimiter)
-		w.OutputWriter.Write(b)
+	if writeErr != nil {
+		w.Log.Errorf("error writing results: %s", writeErr)
 	}
 }
 
-func (w *WindapSearchSession) searchResultWorker(chans *ldapsession.ResultChannels, out chan []byte, wg *sync.WaitGroup) {
-	w.Log.Debugf("searchResultsWorker started")
+// searchResultWorker marshals entries from chans and sends them to out, after each of tags has had a chance to add
+// attributes to them
+func (w *WindapSearchSession) searchResultWorker(log *logrus.Entry, chans *ldapsession.ResultChannels, domain string, tags []func(*ldap.Entry), rw resultWriter, stats *moduleStats, quota *entryQuota, out chan []byte, wg *sync.WaitGroup) {
+	log.Debugf("searchResultsWorker started")
 	defer func() {
-		w.Log.Debugf("searchResultsWorker closing")
+		log.Debugf("searchResultsWorker closing")
 		wg.Done()
 	}()
 	for {
@@ -47,61 +54,366 @@ func (w *WindapSearchSession) searchResultWorker(chans *ldapsession.ResultChanne
 			if !ok {
 				return
 			}
-			w.Log.WithField("DN", entry.DN).Debug("parsing entry")
-			e := &adschema.ADEntry{entry}
-			if !w.Options.JSON {
-				out <- []byte(e.LDAPFormat())
-			} else {
-				b, err := json.Marshal(e)
-				if err != nil {
-					w.Log.WithField("DN", e.DN).Warn("error marshaling entry")
-				}
-				out <- b
+			// past the quota, entries are still taken off the channel so the module isn't blocked sending them
+			if !quota.take() {
+				continue
+			}
+			log.WithField("DN", entry.DN).Debug("parsing entry")
+			for _, tag := range tags {
+				tag(entry)
+			}
+			e := &adschema.ADEntry{Entry: entry, Domain: domain}
+			b, err := rw.marshal(e)
+			if err != nil {
+				log.WithField("DN", e.DN).Warnf("error marshaling entry: %s", err)
+				continue
 			}
-		// these do nothing, but we need have something receiving these channels, or else the program will freeze
-		case <-chans.Referrals:
+			stats.countEntry(len(b))
+			out <- b
+		case referral, ok := <-chans.Referrals:
+			if ok && w.Options.Referrals == string(ldapsession.ReferralsReport) {
+				fmt.Fprintf(os.Stderr, "[*] Referral: %s\n", referral)
+			}
+		// this does nothing, but we need have something receiving this channel, or else the program will freeze
 		case <-chans.Controls:
 			continue
 		}
 	}
 }
 
-func (w *WindapSearchSession) runModule() error {
-	var attrs []string
-	if w.Options.FullAttributes {
-		attrs = []string{"*"}
-	} else {
-		attrs = w.Options.Attributes
+// moduleTarget is a session to run the module against. When results from more than one session are combined, domain
+// is set so every entry is tagged with where it came from
+type moduleTarget struct {
+	session *ldapsession.LDAPSession
+	domain  string
+}
+
+// runModules runs modules against the targets, one after another. subdir is the directory inside the
+// -o directory to write results to when there is more than one module or target
+func (w *WindapSearchSession) runModules(mods []modules.Module, targets []moduleTarget, subdir string) error {
+	for _, mod := range mods {
+		output, closeOutput, err := w.moduleOutput(mod, subdir)
+		if err != nil {
+			return err
+		}
+		err = w.runModule(mod, targets, output)
+		closeOutput()
+		if err != nil {
+			if len(mods) == 1 {
+				return err
+			}
+			w.Log.WithField("module", mod.Name()).Errorf("error running module: %s", wrap(err))
+			continue
+		}
+		if f, ok := output.(*os.File); ok && f != os.Stdout {
+			fmt.Printf("[+] %s written\n", f.Name())
+		}
+	}
+	return nil
+}
+
+// moduleOutput returns where a module's results should be written. With one module and no targets file, that's
+// the -o file (or STDOUT). Otherwise -o is a directory, and each module gets its own file in it
+func (w *WindapSearchSession) moduleOutput(mod modules.Module, subdir string) (io.Writer, func() error, error) {
+	if !w.multiOutput() || w.Options.Output == "" {
+		return w.OutputWriter, func() error { return nil }, nil
+	}
+	dir := filepath.Join(w.Options.Output, subdir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
 	}
+	fp, err := os.Create(filepath.Join(dir, mod.Name()+w.outputExt()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return fp, fp.Close, nil
+}
+
+// outputExt is the file extension for the output format
+func (w *WindapSearchSession) outputExt() string {
+	switch {
+	case w.Options.JSON || w.Options.STIX:
+		return ".json"
+	case w.Options.CSV:
+		return ".csv"
+	case w.Options.Graph != "":
+		return "." + w.Options.Graph
+	case w.Options.SQL:
+		return ".sql"
+	case w.Options.BloodHound:
+		return ".zip"
+	}
+	return ".txt"
+}
+
+// moduleAttrs returns the attributes to request for a module: the ones to output, and primaryGroupID if it's only
+// needed to add the primary group to memberOf
+func (w *WindapSearchSession) moduleAttrs(mod modules.Module) []string {
+	attrs := w.outputAttrs(mod)
+	if w.readsPrimaryGroup(attrs) {
+		attrs = append(append([]string(nil), attrs...), "primaryGroupID")
+	}
+	return attrs
+}
+
+// readsPrimaryGroup reports whether primaryGroupID has to be read as well as attrs, to add the primary group to
+// memberOf. It's left out of the results again, since it wasn't asked for
+func (w *WindapSearchSession) readsPrimaryGroup(attrs []string) bool {
+	return !w.Options.NoPrimaryGroup && hasAttr(attrs, "memberOf") && !hasAttr(attrs, "primaryGroupID")
+}
+
+// outputAttrs returns the attributes a module's results have. --attrs is bound to the first module's defaults, so
+// other modules use their own defaults (or --profile) unless --attrs was given explicitly
+func (w *WindapSearchSession) outputAttrs(mod modules.Module) []string {
+	attrs := w.Options.Attributes
+	switch {
+	case w.Options.FullAttributes:
+		return []string{"*"}
+	case w.Options.Profile != "" && !w.Options.FlagSet.Changed("attrs"):
+		attrs = modules.ProfileAttrs(mod, w.Options.Profile)
+	case mod.Name() != w.Module.Name() && !w.Options.FlagSet.Changed("attrs"):
+		attrs = mod.DefaultAttrs()
+	}
+	// --resolve and --probe need the hostname to look up
+	if (w.Options.ResolveHosts || w.Options.Probe) && !hasAttr(attrs, "dNSHostName") {
+		attrs = append(append([]string(nil), attrs...), "dNSHostName")
+	}
+	// --explode writes a row per value of an attribute, so it has to be one of the columns
+	if w.Options.Explode != "" && !hasAttr(attrs, w.Options.Explode) {
+		attrs = append(append([]string(nil), attrs...), w.Options.Explode)
+	}
+	// --graph draws its edges from these, whatever else is asked for
+	if w.Options.Graph != "" && !hasAttr(attrs, "*") {
+		for _, kind := range w.graphEdges {
+			for _, a := range graphEdgeAttrs[kind] {
+				if !hasAttr(attrs, a) {
+					attrs = append(append([]string(nil), attrs...), a)
+				}
+			}
+		}
+	}
+	// --sql keys objects by their GUID
+	if w.Options.SQL && !hasAttr(attrs, "objectGUID") {
+		attrs = append(append([]string(nil), attrs...), "objectGUID")
+	}
+	// --stix maps users, computers and trusts from these
+	if w.Options.STIX {
+		for _, a := range stixAttrs {
+			if !hasAttr(attrs, a) {
+				attrs = append(append([]string(nil), attrs...), a)
+			}
+		}
+	}
+	// --bloodhound maps users, groups, computers and domains from these
+	if w.Options.BloodHound {
+		for _, a := range bloodhoundAttrs {
+			if !hasAttr(attrs, a) {
+				attrs = append(append([]string(nil), attrs...), a)
+			}
+		}
+	}
+	return attrs
+}
+
+// hasAttr is true if name (or every attribute) is in attrs
+func hasAttr(attrs []string, name string) bool {
+	for _, a := range attrs {
+		if a == "*" || strings.EqualFold(a, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *WindapSearchSession) runModule(mod modules.Module, targets []moduleTarget, output io.Writer) error {
+	attrs := w.moduleAttrs(mod)
 
 	// Set up our write worker, used to write stuff to stdout or file
 	// doneChan is used to indicate the module is completely done and results are written
 	doneWriting := make(chan struct{})
 	outputChan := make(chan []byte)
 
-	go w.outputWorker(outputChan, doneWriting)
+	var snapshot *snapshotWriter
+	if w.Options.Archive != "" {
+		var err error
+		if snapshot, err = w.newSnapshot(mod, targets); err != nil {
+			return fmt.Errorf("archiving results: %s", err)
+		}
+		output = io.MultiWriter(output, snapshot)
+	}
+
+	rw := w.newResultWriter(mod, attrs, targets)
+	var runs []*moduleStats
+	if s, ok := rw.(*sqlWriter); ok {
+		// objects missing from the results are only closed if the runs got all of them
+		s.runs = &runs
+	}
+	if w.Options.Provenance {
+		rw = w.newProvenanceWriter(rw, mod, attrs, targets, &runs)
+	}
+	go w.outputWorker(output, rw, outputChan, doneWriting)
+
+	var moduleErr error
+	for _, t := range targets {
+		stats := &moduleStats{Module: mod.Name(), Domain: t.domain}
+		w.stats.add(stats)
+		runs = append(runs, stats)
+		err := w.runModuleOnSession(mod, t, attrs, stats, rw, outputChan)
+		if err != nil {
+			if len(targets) == 1 {
+				moduleErr = err
+				break
+			}
+			// don't let one unreachable or locked down domain stop the rest
+			w.Log.WithField("domain", t.domain).Errorf("error running module: %s", wrap(err))
+		}
+	}
+
+	// when all targets are done, nothing left to write. Whatever the module output before an error or timeout is
+	// still written out
+	close(outputChan)
+	w.Log.Debug("output channel closed. waiting for writer to finish")
+
+	<-doneWriting
+
+	if snapshot != nil {
+		if err := snapshot.commit(runs); err != nil {
+			w.Log.Errorf("error archiving results: %s", err)
+		}
+	}
+	return moduleErr
+}
+
+// runModuleOnSession runs the module against a single session, sending marshaled entries to out and recording how
+// it went in stats
+func (w *WindapSearchSession) runModuleOnSession(mod modules.Module, t moduleTarget, attrs []string, stats *moduleStats, rw resultWriter, out chan []byte) (err error) {
+	session := t.session
+	stats.Started = time.Now()
+	// modules run on more than one session at a time in targets mode, so everything logged for the run says which
+	fields := logrus.Fields{"module": mod.Name()}
+	if t.domain != "" {
+		fields["domain"] = t.domain
+	}
+	dc, _ := session.Server()
+	log := w.Log.WithFields(fields).WithField("dc", dc)
+	session.SetLogFields(fields)
+	var quota *entryQuota
+	defer func() {
+		session.SetLogFields(nil)
+		stats.Duration = time.Since(stats.Started)
+		stats.Seconds = stats.Duration.Seconds()
+		searches := session.TakeSearchStats()
+		session.SetSearchQuota(0)
+		if quota.hit() {
+			searches.Warnings = append(searches.Warnings, fmt.Sprintf("entry quota of %d reached, the rest of the results were dropped", quota.max))
+		}
+		// the module failing because it was stopped by a quota is what the quota is for, the warning says so
+		if quotaStopped(err, quota) {
+			err = nil
+		}
+		stats.finish(searches, err)
+	}()
+	var tags []func(*ldap.Entry)
+	if w.Options.DetectDecoys {
+		decoys := w.decoys.get(session)
+		tags = append(tags, func(entry *ldap.Entry) { tagDecoy(entry, decoys) })
+	}
+	if w.Options.Annotate {
+		tags = append(tags, newWellKnownTagger(session.NamingContexts).tag)
+	}
+	if w.Options.ResolveHosts {
+		tags = append(tags, func(entry *ldap.Entry) { w.hosts.tagAddresses(session, entry) })
+	}
+	if !w.Options.NoPrimaryGroup && hasAttr(attrs, "memberOf") {
+		drop := w.readsPrimaryGroup(w.outputAttrs(mod))
+		tags = append(tags, func(entry *ldap.Entry) { w.primaryGroups.tagPrimaryGroup(session, entry, drop) })
+	}
+	workers := w.workers
+	if w.Options.Probe {
+		tags = append(tags, func(entry *ldap.Entry) { w.tagReachable(session, entry) })
+		// probing happens in the result workers, so there's one for every host probed at a time
+		workers = w.Options.ProbeConcurrency
+	}
+	domain := t.domain
+	if w.anonymizer != nil {
+		// last, so it also covers what the other tags added
+		w.anonymizer.addSession(session)
+		tags = append(tags, w.anonymizer.tag)
+		if domain != "" {
+			domain = w.anonymizer.domain(domain)
+		}
+	}
+	if w.Options.SchemaGUIDs {
+		w.schemaGUIDs.load(session, log)
+	}
+	// channels are closed at the end of every run, so each module needs a fresh set. With --module-timeout, the
+	// module's searches get a context of their own that cancels them at the deadline, and with --max-entries one
+	// that's cancelled once the quota is used up
+	parent := session.Context()
+	ctx := parent
+	if w.Options.ModuleTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, w.Options.ModuleTimeout)
+		defer cancel()
+	}
+	if max := w.entryQuotas.limit(mod.Name()); max > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		quota = &entryQuota{max: int64(max), cancel: cancel}
+	}
+	session.NewChannels(ctx)
+
+	// modules can ask to search a different naming context than the default domain partition
+	if pm, ok := mod.(modules.PartitionModule); ok {
+		baseDN, err := session.PartitionDN(pm.Partition())
+		if err != nil {
+			return err
+		}
+		defaultDN := session.BaseDN
+		session.BaseDN = baseDN
+		defer func() { session.BaseDN = defaultDN }()
+		log.Infof("searching %s partition: %q", pm.Partition(), baseDN)
+	}
 
 	// set up our result workers, used to translate/marshal entries
 	var wg sync.WaitGroup
-	for i := 0; i < w.workers; i++ {
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go w.searchResultWorker(w.LDAPSession.Channels, outputChan, &wg)
+		go w.searchResultWorker(log.WithField("worker", i), session.Channels, domain, tags, rw, stats, quota, out, &wg)
 	}
 
-	err := w.Module.Run(w.LDAPSession, attrs)
-	if err != nil {
-		return err
-	}
+	// only count the module's own searches
+	session.TakeSearchStats()
+	session.SetSearchQuota(w.searchQuotas.limit(mod.Name()))
+	err = mod.Run(session, attrs)
+
+	// the module may have failed before it started searching, so make sure the workers can finish
+	session.CloseChannels()
 
 	// wait for the search to be done and workers to finish
 	wg.Wait()
-	w.Log.Debug("waitgroup finished, all entry workers done")
+	log.Debug("waitgroup finished, all entry workers done")
 
-	// when workers are done, nothing left to write
-	close(outputChan)
-	w.Log.Debug("output channel closed. waiting for writer to finish")
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", w.Options.ModuleTimeout)
+	}
+	// put the session back for the next module, reconnecting if a search was cut off mid-request
+	session.SetChannels(session.Channels, parent)
+	if parent.Err() == nil {
+		if rerr := session.Reconnect(); rerr != nil {
+			log.Warnf("unable to reconnect after the module was cancelled: %s", rerr)
+		}
+	}
 
-	<-doneWriting
+	return err
+}
 
-	return nil
+// quotaStopped is true for an error a quota stopped a module with: a search the search quota refused, or one cancelled
+// when the entry quota was used up. Modules mostly pass errors on as text, so the cancellation is told by its message
+func quotaStopped(err error, quota *entryQuota) bool {
+	if err == nil {
+		return false
+	}
+	return ldapsession.IsQuotaError(err) || quota.hit() && (errors.Is(err, context.Canceled) || strings.Contains(err.Error(), context.Canceled.Error()))
 }
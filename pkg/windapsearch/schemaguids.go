@@ -0,0 +1,41 @@
+package windapsearch
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/sirupsen/logrus"
+)
+
+// schemaGUIDCache remembers the forests whose schema GUIDs (--schema-guids) have been read. The schema is shared by
+// a whole forest, so one read is enough for every domain in it, but targets in other forests have schema extensions
+// of their own to read. Forests are told apart by their schema partition's DN
+type schemaGUIDCache struct {
+	mu    sync.Mutex
+	reads map[string]*sync.Once
+}
+
+// load reads the schema GUIDs of the session's forest, unless they've been read already
+func (c *schemaGUIDCache) load(session *ldapsession.LDAPSession, log *logrus.Entry) {
+	key := strings.ToLower(session.NamingContexts.Schema)
+	c.mu.Lock()
+	if c.reads == nil {
+		c.reads = make(map[string]*sync.Once)
+	}
+	once, ok := c.reads[key]
+	if !ok {
+		once = new(sync.Once)
+		c.reads[key] = once
+	}
+	c.mu.Unlock()
+
+	once.Do(func() {
+		n, err := session.LoadSchemaGUIDs()
+		if err != nil {
+			log.Warnf("unable to read schema GUIDs, using the built in list: %s", err)
+			return
+		}
+		log.Infof("read %d schema and extended right names", n)
+	})
+}
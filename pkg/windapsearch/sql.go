@@ -0,0 +1,126 @@
+package windapsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/ropnop/go-windapsearch/pkg/modules"
+)
+
+// sqlSchema is the table --sql keeps objects in. Every version of an object is a row, valid from when a run first
+// saw it until a run saw it change or disappear, so the table is a history of the directory rather than a pile of
+// snapshots. Objects are keyed by objectGUID, which survives renames and moves
+const sqlSchema = `CREATE TABLE IF NOT EXISTS objects (
+  guid TEXT NOT NULL,
+  module TEXT NOT NULL,
+  domain TEXT NOT NULL,
+  dn TEXT NOT NULL,
+  attributes TEXT NOT NULL,
+  valid_from TEXT NOT NULL,
+  valid_to TEXT
+);
+CREATE UNIQUE INDEX IF NOT EXISTS objects_current ON objects (module, domain, guid) WHERE valid_to IS NULL;
+CREATE INDEX IF NOT EXISTS objects_history ON objects (guid, valid_from);
+CREATE TEMP TABLE IF NOT EXISTS seen (domain TEXT NOT NULL, guid TEXT NOT NULL, PRIMARY KEY (domain, guid));
+DELETE FROM temp.seen;
+`
+
+// sqlWriter writes the results as SQLite statements that bring the objects table up to date: new and changed
+// objects get a new current row, the row they replace is closed, and objects the module no longer returns are
+// closed too. There's no SQLite driver in windapsearch, so the statements are piped into the sqlite3 shell
+type sqlWriter struct {
+	module string
+	now    string
+	// domains are the targets' domains, in the order of runs
+	domains []string
+	runs    *[]*moduleStats
+	started bool
+}
+
+func (w *WindapSearchSession) newSQLWriter(mod modules.Module, targets []moduleTarget) *sqlWriter {
+	s := &sqlWriter{module: mod.Name(), now: time.Now().UTC().Format(time.RFC3339)}
+	for _, t := range targets {
+		// the same name entries are tagged with when more than one domain is combined
+		domain := t.domain
+		if domain == "" {
+			domain = ldapsession.DNToDomain(t.session.NamingContexts.Default)
+		}
+		if w.anonymizer != nil {
+			domain = w.anonymizer.domain(domain)
+		}
+		s.domains = append(s.domains, strings.ToLower(domain))
+	}
+	return s
+}
+
+func (s *sqlWriter) marshal(e *adschema.ADEntry) ([]byte, error) {
+	attributes, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	// results modules make up (e.g. report rows) have no GUID, so they're keyed by their DN
+	guid, err := adschema.WindowsGuidFromBytes(e.GetRawAttributeValue("objectGUID"))
+	if err != nil {
+		guid = "dn:" + strings.ToLower(e.DN)
+	}
+	// entries are only tagged with their domain when more than one is combined
+	domain := strings.ToLower(e.Domain)
+	if domain == "" && len(s.domains) > 0 {
+		domain = s.domains[0]
+	}
+	current := fmt.Sprintf("module = %s AND domain = %s AND guid = %s AND valid_to IS NULL", sqlQuote(s.module), sqlQuote(domain), sqlQuote(guid))
+	var b strings.Builder
+	fmt.Fprintf(&b, "INSERT OR IGNORE INTO temp.seen VALUES (%s, %s);\n", sqlQuote(domain), sqlQuote(guid))
+	fmt.Fprintf(&b, "UPDATE objects SET valid_to = %s WHERE %s AND (dn <> %s OR attributes <> %s);\n", sqlQuote(s.now), current,
+		sqlQuote(e.DN), sqlQuote(string(attributes)))
+	fmt.Fprintf(&b, "INSERT INTO objects (guid, module, domain, dn, attributes, valid_from) SELECT %s, %s, %s, %s, %s, %s WHERE NOT EXISTS (SELECT 1 FROM objects WHERE %s);\n",
+		sqlQuote(guid), sqlQuote(s.module), sqlQuote(domain), sqlQuote(e.DN), sqlQuote(string(attributes)), sqlQuote(s.now), current)
+	return []byte(b.String()), nil
+}
+
+func (s *sqlWriter) write(out io.Writer, b []byte) error {
+	if err := s.start(out); err != nil {
+		return err
+	}
+	_, err := out.Write(b)
+	return err
+}
+
+func (s *sqlWriter) close(out io.Writer) error {
+	if err := s.start(out); err != nil {
+		return err
+	}
+	var b strings.Builder
+	// objects missing from a run are gone, unless the run didn't get every result
+	for i, domain := range s.domains {
+		if s.runs == nil || i >= len(*s.runs) || (*s.runs)[i].status() != "ok" {
+			fmt.Fprintf(&b, "-- %s wasn't read completely, so objects it didn't return are kept\n", domain)
+			continue
+		}
+		fmt.Fprintf(&b, "UPDATE objects SET valid_to = %s WHERE module = %s AND domain = %s AND valid_to IS NULL AND guid NOT IN (SELECT guid FROM temp.seen WHERE domain = %s);\n",
+			sqlQuote(s.now), sqlQuote(s.module), sqlQuote(domain), sqlQuote(domain))
+	}
+	b.WriteString("COMMIT;\n")
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+// start begins the transaction, creating the table the first time
+func (s *sqlWriter) start(out io.Writer) error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	_, err := io.WriteString(out, "BEGIN;\n"+sqlSchema)
+	return err
+}
+
+// sqlQuote makes a string into an SQL string literal
+func sqlQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
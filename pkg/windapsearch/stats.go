@@ -0,0 +1,144 @@
+package windapsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/ropnop/go-windapsearch/pkg/redact"
+)
+
+// moduleStats summarizes one module's run against one domain
+type moduleStats struct {
+	Module      string        `json:"module"`
+	Domain      string        `json:"domain,omitempty"`
+	Entries     int64         `json:"entries"`
+	Searches    int           `json:"searches"`
+	Pages       int           `json:"pages"`
+	Bytes       int64         `json:"bytes"`
+	Started     time.Time     `json:"started"`
+	Duration    time.Duration `json:"-"`
+	Seconds     float64       `json:"seconds"`
+	Partial     bool          `json:"partial"`
+	Errors      []string      `json:"errors,omitempty"`
+	Warnings    []string      `json:"warnings,omitempty"`
+	Filters     []string      `json:"filters,omitempty"`
+	MoreFilters int           `json:"moreFilters,omitempty"`
+	mu          sync.Mutex
+}
+
+// finish records how the module run ended. A run is partial when it output results but something stopped it from
+// getting all of them: a size or time limit, a cancelled search, a failed page or referral, or an error part way
+// through. That's called out on STDERR straight away, since the results look like a complete dataset otherwise
+func (s *moduleStats) finish(searches ldapsession.SearchStats, err error) {
+	s.Searches = searches.Searches
+	s.Pages = searches.Pages
+	s.Warnings = make([]string, len(searches.Warnings))
+	for i, warning := range searches.Warnings {
+		s.Warnings[i] = redact.String(warning)
+	}
+	s.Filters = searches.Filters
+	s.MoreFilters = searches.MoreFilters
+	if err != nil {
+		s.Errors = append(s.Errors, redact.String(err.Error()))
+	}
+	s.Partial = len(s.Warnings) > 0 || (err != nil && s.Entries > 0)
+	if !s.Partial {
+		return
+	}
+	where := ""
+	if s.Domain != "" {
+		where = " from " + s.Domain
+	}
+	reasons := append(append([]string(nil), s.Warnings...), s.Errors...)
+	fmt.Fprintf(os.Stderr, "[!] %s results%s are PARTIAL (%d entries): %s\n", s.Module, where, s.Entries, strings.Join(reasons, "; "))
+}
+
+// status is how the run ended, for the summary
+func (s *moduleStats) status() string {
+	switch {
+	case s.Partial:
+		return "PARTIAL"
+	case len(s.Errors) > 0:
+		return fmt.Sprintf("%d error(s)", len(s.Errors))
+	}
+	return "ok"
+}
+
+// countEntry is called by the result workers for every entry they output
+func (s *moduleStats) countEntry(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Entries++
+	s.Bytes += int64(size)
+}
+
+// runStats collects the summary of every module run, which targets runs add to in parallel
+type runStats struct {
+	mu   sync.Mutex
+	runs []*moduleStats
+}
+
+func (r *runStats) add(s *moduleStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runs = append(r.runs, s)
+}
+
+// Incomplete is true if any module run failed or returned partial results, so callers can exit non-zero even
+// though the run as a whole carried on
+func (w *WindapSearchSession) Incomplete() bool {
+	w.stats.mu.Lock()
+	defer w.stats.mu.Unlock()
+	for _, s := range w.stats.runs {
+		if s.Partial || len(s.Errors) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// reportStats prints the summary of every module run to STDERR when the run is done, and writes it to --stats-file.
+// Large collections can stop early without failing (size limits, cancelled searches, unreachable referrals), so
+// anything that may have left the results incomplete is called out
+func (w *WindapSearchSession) reportStats() {
+	if len(w.stats.runs) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "[*] Summary:\n\tMODULE\tDOMAIN\tENTRIES\tPAGES\tBYTES\tDURATION\tSTATUS\n")
+	var problems []string
+	for _, s := range w.stats.runs {
+		domain := s.Domain
+		if domain == "" {
+			domain = "-"
+		}
+		fmt.Fprintf(tw, "\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n", s.Module, domain, s.Entries, s.Pages, s.Bytes, s.Duration.Round(time.Millisecond), s.status())
+		for _, msg := range append(append([]string(nil), s.Errors...), s.Warnings...) {
+			problems = append(problems, fmt.Sprintf("%s: %s", s.Module, msg))
+		}
+	}
+	tw.Flush()
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "[!] Results may be incomplete:\n    %s\n", strings.Join(problems, "\n    "))
+	}
+
+	if w.Options.StatsFile == "" {
+		return
+	}
+	b, err := json.MarshalIndent(w.stats.runs, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(w.Options.StatsFile, b, 0644)
+	}
+	if err != nil {
+		w.Log.Warnf("unable to write stats file: %s", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[+] Summary written to %s\n", w.Options.StatsFile)
+}
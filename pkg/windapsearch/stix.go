@@ -0,0 +1,317 @@
+package windapsearch
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	uac "github.com/audibleblink/msldapuac"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/sirupsen/logrus"
+)
+
+// stixAttrs are the attributes users, computers and trusts are mapped to STIX from
+var stixAttrs = []string{"objectClass", "objectSid", "sAMAccountName", "displayName", "dNSHostName", "userAccountControl",
+	"adminCount", "servicePrincipalName", "operatingSystem", "operatingSystemVersion", "whenCreated", "whenChanged",
+	"lastLogonTimestamp", "pwdLastSet", "accountExpires", "trustPartner", "trustDirection", "trustAttributes"}
+
+// stixNamespace is the namespace STIX 2.1 derives the IDs of cyber observables from. The IDs of the other objects
+// are derived from it too, so exporting the same domain twice gives the same objects
+var stixNamespace = [16]byte{0x00, 0xab, 0xed, 0xb4, 0xaa, 0x42, 0x46, 0x6c, 0x9c, 0x01, 0xfe, 0xd2, 0x33, 0x15, 0xa9, 0xb7}
+
+const stixTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// trustAttributes flags named in trust relationships
+const (
+	stixTrustQuarantined      = 0x4
+	stixTrustForestTransitive = 0x8
+	stixTrustWithinForest     = 0x20
+	stixTrustTreatAsExternal  = 0x40
+)
+
+// stixFragment is what one entry adds to the bundle: its objects, and the domains they refer to
+type stixFragment struct {
+	Objects []map[string]interface{} `json:"objects"`
+	Domains []string                 `json:"domains"`
+}
+
+// stixWriter writes the results as a STIX 2.1 bundle: users as user-account observables, computers as system
+// identities, and trusts as relationships between the identities of their domains. Other objects are left out
+type stixWriter struct {
+	log     *logrus.Entry
+	now     string
+	started bool
+	domains map[string]bool
+	skipped int
+}
+
+func (w *WindapSearchSession) newSTIXWriter() *stixWriter {
+	return &stixWriter{log: w.Log, now: time.Now().UTC().Format(stixTimeFormat), domains: make(map[string]bool)}
+}
+
+func (s *stixWriter) marshal(e *adschema.ADEntry) ([]byte, error) {
+	classes := make(map[string]bool)
+	for _, c := range e.GetAttributeValues("objectClass") {
+		classes[strings.ToLower(c)] = true
+	}
+	domain := strings.ToLower(ldapsession.DNToDomain(e.DN))
+	var f stixFragment
+	switch {
+	case classes["trusteddomain"]:
+		f = s.trust(e, domain)
+	case classes["computer"]:
+		f.Objects = []map[string]interface{}{s.computer(e, domain)}
+	case classes["user"]:
+		f.Objects = []map[string]interface{}{s.user(e, domain)}
+	default:
+		return nil, nil
+	}
+	return json.Marshal(f)
+}
+
+// user maps a user to a user-account observable, whose ID comes from its SID and sAMAccountName
+func (s *stixWriter) user(e *adschema.ADEntry, domain string) map[string]interface{} {
+	obj := map[string]interface{}{
+		"account_type":  "windows-domain",
+		"account_login": e.GetAttributeValue("sAMAccountName"),
+	}
+	if sid, err := adschema.WindowsSIDFromBytes(e.GetRawAttributeValue("objectSid")); err == nil {
+		obj["user_id"] = sid
+	}
+	obj["type"], obj["spec_version"] = "user-account", "2.1"
+	obj["id"] = stixObservableID("user-account", obj, "account_type", "user_id", "account_login")
+	if name := e.GetAttributeValue("displayName"); name != "" {
+		obj["display_name"] = name
+	}
+	flags, _ := strconv.Atoi(e.GetAttributeValue("userAccountControl"))
+	obj["is_disabled"] = flags&uac.Accountdisable != 0
+	obj["is_privileged"] = e.GetAttributeValue("adminCount") == "1"
+	obj["is_service_account"] = len(e.GetAttributeValues("servicePrincipalName")) > 0
+	setSTIXTime(obj, "account_created", e.GetAttributeValue("whenCreated"), false)
+	setSTIXTime(obj, "account_last_login", e.GetAttributeValue("lastLogonTimestamp"), true)
+	setSTIXTime(obj, "credential_last_changed", e.GetAttributeValue("pwdLastSet"), true)
+	setSTIXTime(obj, "account_expires", e.GetAttributeValue("accountExpires"), true)
+	obj["x_ad_distinguished_name"] = e.DN
+	obj["x_ad_domain"] = domain
+	return obj
+}
+
+// computer maps a computer to a system identity, named by its hostname
+func (s *stixWriter) computer(e *adschema.ADEntry, domain string) map[string]interface{} {
+	name := strings.ToLower(e.GetAttributeValue("dNSHostName"))
+	if name == "" {
+		name = strings.TrimSuffix(e.GetAttributeValue("sAMAccountName"), "$")
+	}
+	obj := s.sdo("identity", "computer:"+strings.ToLower(e.DN), e)
+	obj["name"] = name
+	obj["identity_class"] = "system"
+	var system []string
+	for _, attr := range []string{"operatingSystem", "operatingSystemVersion"} {
+		if v := e.GetAttributeValue(attr); v != "" {
+			system = append(system, v)
+		}
+	}
+	if len(system) > 0 {
+		obj["description"] = strings.Join(system, " ")
+	}
+	if sid, err := adschema.WindowsSIDFromBytes(e.GetRawAttributeValue("objectSid")); err == nil {
+		obj["x_ad_object_sid"] = sid
+	}
+	obj["x_ad_distinguished_name"] = e.DN
+	obj["x_ad_domain"] = domain
+	return obj
+}
+
+// trust maps a trust to a relationship from each trusting domain to the domain it trusts
+func (s *stixWriter) trust(e *adschema.ADEntry, domain string) stixFragment {
+	partner := strings.ToLower(e.GetAttributeValue("trustPartner"))
+	if partner == "" || domain == "" {
+		return stixFragment{}
+	}
+	direction, _ := strconv.Atoi(e.GetAttributeValue("trustDirection"))
+	attributes, _ := strconv.Atoi(e.GetAttributeValue("trustAttributes"))
+	var kind []string
+	switch {
+	case attributes&stixTrustWithinForest != 0:
+		kind = append(kind, "within the forest")
+	case attributes&stixTrustForestTransitive != 0:
+		kind = append(kind, "forest")
+	default:
+		kind = append(kind, "external")
+	}
+	if attributes&stixTrustQuarantined != 0 {
+		kind = append(kind, "SID filtering")
+	}
+	if attributes&stixTrustTreatAsExternal != 0 {
+		kind = append(kind, "treated as external")
+	}
+
+	f := stixFragment{Domains: []string{domain, partner}}
+	add := func(trusting, trusted string) {
+		rel := s.sdo("relationship", "trust:"+trusting+">"+trusted, e)
+		rel["relationship_type"] = "related-to"
+		rel["source_ref"] = stixDomainID(trusting)
+		rel["target_ref"] = stixDomainID(trusted)
+		rel["description"] = fmt.Sprintf("%s trusts %s (%s)", trusting, trusted, strings.Join(kind, ", "))
+		f.Objects = append(f.Objects, rel)
+	}
+	// an outbound trust is this domain trusting the partner, an inbound one the partner trusting this domain
+	if direction&0x2 != 0 {
+		add(domain, partner)
+	}
+	if direction&0x1 != 0 {
+		add(partner, domain)
+	}
+	return f
+}
+
+// sdo starts a STIX domain object for an entry, created and modified when the entry was
+func (s *stixWriter) sdo(kind, name string, e *adschema.ADEntry) map[string]interface{} {
+	obj := map[string]interface{}{
+		"type":         kind,
+		"spec_version": "2.1",
+		"id":           kind + "--" + uuid5(stixNamespace, "windapsearch:"+name),
+		"created":      s.now,
+		"modified":     s.now,
+	}
+	setSTIXTime(obj, "created", e.GetAttributeValue("whenCreated"), false)
+	setSTIXTime(obj, "modified", e.GetAttributeValue("whenChanged"), false)
+	return obj
+}
+
+// stixDomainID is the ID of a domain's identity
+func stixDomainID(domain string) string {
+	return "identity--" + uuid5(stixNamespace, "windapsearch:domain:"+domain)
+}
+
+// stixObservableID derives a cyber observable's ID from its ID contributing properties, as STIX 2.1 specifies
+func stixObservableID(kind string, obj map[string]interface{}, properties ...string) string {
+	contributing := make(map[string]interface{})
+	for _, p := range properties {
+		if v, ok := obj[p]; ok && v != "" {
+			contributing[p] = v
+		}
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(contributing)
+	return kind + "--" + uuid5(stixNamespace, strings.TrimSuffix(b.String(), "\n"))
+}
+
+// setSTIXTime sets a timestamp property from an AD generalized time, or a FILETIME if filetime is set. Times that
+// mean never (0 and the maximum FILETIME) are left out
+func setSTIXTime(obj map[string]interface{}, property, value string, filetime bool) {
+	if value == "" || value == "0" || value == "9223372036854775807" {
+		return
+	}
+	var t time.Time
+	var err error
+	if filetime {
+		t, err = adschema.NTFileTimeToTimestamp(value)
+	} else {
+		t, err = adschema.ADLdapTimeToTimestamp(value)
+	}
+	if err == nil {
+		obj[property] = t.UTC().Format(stixTimeFormat)
+	}
+}
+
+// uuid5 returns the version 5 (SHA-1) UUID of name in a namespace
+func uuid5(namespace [16]byte, name string) string {
+	h := sha1.New()
+	h.Write(namespace[:])
+	h.Write([]byte(name))
+	var u [16]byte
+	copy(u[:], h.Sum(nil))
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return formatUUID(u)
+}
+
+func formatUUID(u [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+func (s *stixWriter) write(out io.Writer, b []byte) error {
+	if len(b) == 0 {
+		s.skipped++
+		return nil
+	}
+	var f stixFragment
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	objects := f.Objects
+	for _, d := range f.Domains {
+		if !s.domains[d] {
+			s.domains[d] = true
+			objects = append([]map[string]interface{}{{
+				"type": "identity", "spec_version": "2.1", "id": stixDomainID(d), "created": s.now, "modified": s.now,
+				"name": d, "identity_class": "organization", "description": "Active Directory domain",
+			}}, objects...)
+		}
+	}
+	for _, obj := range objects {
+		if err := s.writeObject(out, obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeObject writes one object to the bundle's objects array, starting the bundle if it's the first
+func (s *stixWriter) writeObject(out io.Writer, obj map[string]interface{}) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	delimiter := ","
+	if !s.started {
+		s.started = true
+		if delimiter, err = bundleStart(); err != nil {
+			return err
+		}
+		delimiter += `,"objects":[`
+	}
+	if _, err := io.WriteString(out, delimiter); err != nil {
+		return err
+	}
+	_, err = out.Write(b)
+	return err
+}
+
+func (s *stixWriter) close(out io.Writer) error {
+	if s.skipped > 0 {
+		s.log.Warnf("%d results aren't users, computers or trusts, and were left out of the STIX bundle", s.skipped)
+	}
+	end := "]}"
+	if !s.started {
+		// a bundle's objects can't be an empty array, so an empty bundle has none
+		start, err := bundleStart()
+		if err != nil {
+			return err
+		}
+		end = start + "}"
+	}
+	_, err := io.WriteString(out, end)
+	return err
+}
+
+// bundleStart starts a bundle's JSON object, with a random ID for the bundle
+func bundleStart() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf(`{"type":"bundle","id":"bundle--%s"`, formatUUID(id)), nil
+}
@@ -0,0 +1,165 @@
+package windapsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+	"github.com/ropnop/go-windapsearch/pkg/modules"
+	"github.com/ropnop/go-windapsearch/pkg/secrets"
+	"github.com/ropnop/go-windapsearch/pkg/utils"
+)
+
+// Target is a domain to enumerate, along with the credentials and DC to use for it. Empty fields fall back to the
+// values given on the command line
+type Target struct {
+	Domain           string `json:"domain"`
+	DomainController string `json:"dc,omitempty"`
+	Username         string `json:"username,omitempty"`
+	Password         string `json:"password,omitempty"`
+	PasswordFrom     string `json:"password_from,omitempty"`
+	NTLMHash         string `json:"hash,omitempty"`
+}
+
+// LoadTargets reads a JSON array of targets from a file, e.g.:
+//
+//	[{"domain": "child.lab.example.com", "dc": "10.0.1.5", "username": "admin@child.lab.example.com", "password": "..."}]
+//
+// A target's password can be read from a secret store instead, with password_from (see secrets.Fetch)
+func LoadTargets(path string) ([]Target, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var targets []Target
+	if err = json.Unmarshal(b, &targets); err != nil {
+		return nil, fmt.Errorf("error parsing targets file %q: %s", path, err)
+	}
+	for i, t := range targets {
+		if t.Domain == "" {
+			return nil, fmt.Errorf("target %d in %q is missing a domain", i+1, path)
+		}
+	}
+	return targets, nil
+}
+
+// findTarget returns the target for a domain (case insensitive), if there is one
+func findTarget(targets []Target, domain string) (Target, bool) {
+	for _, t := range targets {
+		if strings.EqualFold(t.Domain, domain) {
+			return t, true
+		}
+	}
+	return Target{}, false
+}
+
+// apply overrides session options with any values set on the target. Changing the domain also resets the DC, so it
+// is discovered through DNS unless the target specifies one
+func (t Target) apply(options *ldapsession.LDAPSessionOptions) (err error) {
+	if !strings.EqualFold(options.Domain, t.Domain) {
+		options.Domain = t.Domain
+		options.DomainController = ""
+		options.KDC = ""
+	}
+	if t.DomainController != "" {
+		options.DomainController = t.DomainController
+	}
+	if t.Username == "" {
+		return nil
+	}
+	options.Username = t.Username
+	if !strings.Contains(t.Username, "@") {
+		options.Username = fmt.Sprintf("%s@%s", t.Username, t.Domain)
+	}
+	options.Password = t.Password
+	options.Hash = t.NTLMHash
+	// a ccache or keytab given on the command line is for the command line's user
+	options.CCachePath, options.Keytab, options.Realm = "", "", ""
+	if t.PasswordFrom != "" {
+		if options.Password != "" || options.Hash != "" {
+			return fmt.Errorf("target %s has password_from and a password or hash, only one can be used", t.Domain)
+		}
+		if options.Password, err = secrets.Fetch(t.PasswordFrom); err != nil {
+			return fmt.Errorf("target %s: %s", t.Domain, err)
+		}
+	}
+	if options.Password == "" && options.Hash == "" {
+		options.Password, err = utils.SecurePrompt(fmt.Sprintf("Password for [%s]", options.Username))
+	}
+	return
+}
+
+// runTargets connects to every target in the --targets file and runs the selected modules against each one, writing
+// results to a sub directory of the -o directory per target. base holds the options given on the command line
+func (w *WindapSearchSession) runTargets(base ldapsession.LDAPSessionOptions) error {
+	if err := w.checkModules(); err != nil || w.Module == nil {
+		return err
+	}
+	if w.Options.Output == "" {
+		return fmt.Errorf("--targets requires an output directory (-o)")
+	}
+	targets, err := LoadTargets(w.Options.Targets)
+	if err != nil {
+		return err
+	}
+
+	// work out every target's options first, so any password prompts happen one at a time
+	targetOptions := make([]ldapsession.LDAPSessionOptions, len(targets))
+	for i, t := range targets {
+		targetOptions[i] = base
+		if err = t.apply(&targetOptions[i]); err != nil {
+			return err
+		}
+	}
+
+	parallel := w.Options.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(t Target, options ldapsession.LDAPSessionOptions) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			log := w.Log.WithField("target", t.Domain)
+			sess, err := ldapsession.NewLDAPSession(&options, w.ctx)
+			if err != nil {
+				log.Errorf("unable to connect to target, skipping: %s", wrap(err))
+				return
+			}
+			defer sess.Close()
+
+			moduleTargets := []moduleTarget{{session: sess}}
+			if w.Options.Forest {
+				moduleTargets, err = w.forestTargets(sess)
+				defer closeTargets(moduleTargets, sess)
+				if err != nil {
+					log.Errorf("unable to enumerate forest: %s", wrap(err))
+					return
+				}
+			}
+			subdir := t.Domain
+			if w.anonymizer != nil {
+				subdir = w.anonymizer.domain(subdir)
+			}
+			// modules keep state while they run, so targets running at the same time each get their own
+			mods := make([]modules.Module, len(w.Modules))
+			for i, mod := range w.Modules {
+				mods[i] = modules.Copy(mod)
+			}
+			if err = w.runModules(mods, moduleTargets, subdir); err != nil {
+				log.Errorf("error running modules: %s", wrap(err))
+			}
+		}(t, targetOptions[i])
+	}
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,71 @@
+package windapsearch
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+// parseCommand handles the positional arguments. The commands are "undo <journal>", which reverts the changes
+// recorded by an earlier run instead of running a module, and "history", which lists or shows the runs in --archive
+func (w *WindapSearchSession) parseCommand() error {
+	// the flag set is parsed with os.Args, so the first argument is the program itself
+	args := w.Options.FlagSet.Args()
+	if len(args) < 2 {
+		return nil
+	}
+	if args[1] == "history" {
+		if w.Options.Archive == "" {
+			return fmt.Errorf("history requires --archive")
+		}
+		if w.Module != nil {
+			return fmt.Errorf("history can't be combined with a module")
+		}
+		w.history = append([]string{}, args[2:]...)
+		return nil
+	}
+	if args[1] != "undo" {
+		return fmt.Errorf("unknown command %q", args[1])
+	}
+	if len(args) != 3 {
+		return fmt.Errorf("usage: windapsearch [options] undo <journal>")
+	}
+	if w.Module != nil {
+		return fmt.Errorf("undo can't be combined with a module")
+	}
+	journal, err := ldapsession.LoadJournal(args[2])
+	if err != nil {
+		return err
+	}
+	if len(journal.Entries) == 0 {
+		return fmt.Errorf("journal %q has no changes to undo", args[2])
+	}
+	w.undo = journal
+	if !w.Options.Confirm {
+		fmt.Fprintf(os.Stderr, "[*] Previewing undo of %d change(s), add --confirm to apply\n", len(journal.Entries))
+	}
+	return nil
+}
+
+// newJournal returns the journal to record changes in when write modules will really change things
+func (w *WindapSearchSession) newJournal() *ldapsession.Journal {
+	if w.undo != nil || w.writeMode() != ldapsession.WritesEnabled {
+		return nil
+	}
+	path := w.Options.Journal
+	if path == "" {
+		path = fmt.Sprintf("windapsearch-journal-%s.json", time.Now().Format("20060102-150405"))
+	}
+	w.journal = ldapsession.NewJournal(path)
+	return w.journal
+}
+
+// reportJournal tells the user where the journal was written, if any changes were made
+func (w *WindapSearchSession) reportJournal() {
+	if w.journal == nil || w.journal.Len() == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[+] %d change(s) recorded in %s (revert with: %s [options] undo %s)\n", w.journal.Len(), w.journal.Path, os.Args[0], w.journal.Path)
+}
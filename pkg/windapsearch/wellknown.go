@@ -0,0 +1,157 @@
+package windapsearch
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/adschema/secdesc"
+	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
+)
+
+func init() {
+	adschema.RegisterAttribute("wellKnownObject", "String(Unicode)", true)
+}
+
+// wellKnownDomainObjects are the objects every domain is created with, by their lower case DN relative to the domain
+var wellKnownDomainObjects = map[string]string{
+	"":                             "domain root",
+	"cn=users":                     "default container",
+	"cn=computers":                 "default container",
+	"cn=builtin":                   "default container",
+	"cn=system":                    "default container",
+	"cn=program data":              "default container",
+	"cn=foreignsecurityprincipals": "default container",
+	"cn=managed service accounts":  "default container",
+	"cn=keys":                      "default container",
+	"cn=lostandfound":              "default container",
+	"cn=infrastructure":            "default container",
+	"cn=ntds quotas":               "default container",
+	"cn=tpm devices":               "default container",
+	"ou=domain controllers":        "default OU",
+	"cn=adminsdholder,cn=system":   "AdminSDHolder",
+	"cn=policies,cn=system":        "default container",
+	"cn=password settings container,cn=system":                        "default container",
+	"cn=rid manager$,cn=system":                                       "default object: RID Manager$",
+	"cn=microsoftdns,cn=system":                                       "default container",
+	"cn={31b2f340-016d-11d2-945f-00c04fb984f9},cn=policies,cn=system": "default GPO: Default Domain Policy",
+	"cn={6ac1786c-016f-11d2-945f-00c04fb984f9},cn=policies,cn=system": "default GPO: Default Domain Controllers Policy",
+}
+
+// wellKnownConfigObjects are the default containers in the configuration partition, relative to it
+var wellKnownConfigObjects = map[string]string{
+	"":                                   "configuration partition",
+	"cn=partitions":                      "default container",
+	"cn=sites":                           "default container",
+	"cn=services":                        "default container",
+	"cn=extended-rights":                 "default container",
+	"cn=displayspecifiers":               "default container",
+	"cn=wellknown security principals":   "default container",
+	"cn=public key services,cn=services": "default container",
+	"cn=windows nt,cn=services":          "default container",
+	"cn=directory service,cn=windows nt,cn=services": "default object: Directory Service",
+}
+
+// rodcKrbtgt matches the krbtgt accounts created for each RODC
+var rodcKrbtgt = regexp.MustCompile(`^cn=krbtgt_\d+,cn=users$`)
+
+// wellKnownTagger labels entries that are default AD objects with wellKnownObject, so reports can tell the defaults
+// apart from what an admin created
+type wellKnownTagger struct {
+	domainDN string
+	configDN string
+	// accounts maps relative DNs of the default accounts and groups to their labels, for entries without an objectSid
+	accounts map[string]string
+}
+
+func newWellKnownTagger(contexts ldapsession.NamingContexts) *wellKnownTagger {
+	t := &wellKnownTagger{
+		domainDN: strings.ToLower(contexts.Default),
+		configDN: strings.ToLower(contexts.Configuration),
+		accounts: make(map[string]string),
+	}
+	for rid, name := range secdesc.DomainRIDs {
+		t.accounts[fmt.Sprintf("cn=%s,cn=users", strings.ToLower(name))] = ridLabel(rid, name)
+	}
+	for rid := uint32(544); rid <= 582; rid++ {
+		if name, ok := secdesc.WellKnownName(secdesc.MustParseSID(fmt.Sprintf("S-1-5-32-%d", rid))); ok {
+			name = strings.TrimPrefix(name, `BUILTIN\`)
+			t.accounts[fmt.Sprintf("cn=%s,cn=builtin", strings.ToLower(name))] = "built-in group: " + name
+		}
+	}
+	return t
+}
+
+// ridLabel labels a default domain account or group
+func ridLabel(rid uint32, name string) string {
+	if rid < 512 && rid != 498 {
+		return "default account: " + name
+	}
+	return "default group: " + name
+}
+
+// label returns the wellKnownObject label for an entry, or "" if it isn't a default object. Accounts and groups are
+// matched by objectSid when it was requested, since they can be renamed or moved, and by DN otherwise
+func (t *wellKnownTagger) label(entry *ldap.Entry) string {
+	hasSID := false
+	if b := entry.GetRawAttributeValue("objectSid"); len(b) > 0 {
+		hasSID = true
+		if sid, _, err := secdesc.DecodeSID(b); err == nil {
+			if _, ok := sid.DomainSID(); ok {
+				if name, ok := secdesc.DomainRIDs[sid.RID()]; ok {
+					return ridLabel(sid.RID(), name)
+				}
+			} else if name, ok := secdesc.WellKnownName(sid); ok && strings.HasPrefix(name, `BUILTIN\`) {
+				return "built-in group: " + strings.TrimPrefix(name, `BUILTIN\`)
+			}
+		}
+	}
+	dn := strings.ToLower(entry.DN)
+	if rel, ok := relativeDN(dn, t.configDN); ok && t.configDN != "" {
+		return wellKnownConfigObjects[rel]
+	}
+	rel, ok := relativeDN(dn, t.domainDN)
+	if !ok {
+		return ""
+	}
+	if label, ok := wellKnownDomainObjects[rel]; ok {
+		return label
+	}
+	if rodcKrbtgt.MatchString(rel) {
+		return "default account: RODC krbtgt"
+	}
+	if hasSID {
+		// a default account that was renamed or moved, or a new one in a default account's place, was settled above
+		return ""
+	}
+	if label, ok := t.accounts[rel]; ok {
+		return label
+	}
+	return ""
+}
+
+// tag adds the wellKnownObject attribute to an entry that is a default object
+func (t *wellKnownTagger) tag(entry *ldap.Entry) {
+	label := t.label(entry)
+	if label == "" || entry.GetAttributeValue("wellKnownObject") != "" {
+		return
+	}
+	entry.Attributes = append(entry.Attributes, &ldap.EntryAttribute{
+		Name:       "wellKnownObject",
+		Values:     []string{label},
+		ByteValues: [][]byte{[]byte(label)},
+	})
+}
+
+// relativeDN strips base from the end of dn, returning "" for base itself. Both must be lower case
+func relativeDN(dn, base string) (string, bool) {
+	if dn == base {
+		return "", true
+	}
+	if strings.HasSuffix(dn, ","+base) {
+		return strings.TrimSuffix(dn, ","+base), true
+	}
+	return "", false
+}
@@ -9,10 +9,15 @@ import (
 	"os/signal"
 	"strings"
 	"text/tabwriter"
+	"time"
 
+	"github.com/go-ldap/ldap/v3"
 	"github.com/ropnop/go-windapsearch/pkg/buildinfo"
+	"github.com/ropnop/go-windapsearch/pkg/dns"
 	"github.com/ropnop/go-windapsearch/pkg/ldapsession"
 	"github.com/ropnop/go-windapsearch/pkg/modules"
+	"github.com/ropnop/go-windapsearch/pkg/redact"
+	"github.com/ropnop/go-windapsearch/pkg/secrets"
 	"github.com/ropnop/go-windapsearch/pkg/utils"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
@@ -22,12 +27,30 @@ type WindapSearchSession struct {
 	Options      CommandLineOptions
 	LDAPSession  *ldapsession.LDAPSession
 	Module       modules.Module
+	Modules      []modules.Module
 	AllModules   []modules.Module
 	Log          *logrus.Entry
 	OutputWriter io.Writer
 	workers      int
+	maxMemory    int64
 	ctx          context.Context
-	cancel       context.CancelFunc
+
+	unknownModules   []string
+	extraModuleFlags []*pflag.FlagSet
+	cancel           context.CancelFunc
+	journal          *ldapsession.Journal
+	undo             *ldapsession.Journal
+	decoys           decoyCache
+	hosts            hostCache
+	probes           probeCache
+	primaryGroups    primaryGroupCache
+	schemaGUIDs      schemaGUIDCache
+	stats            runStats
+	anonymizer       *anonymizer
+	graphEdges       []string
+	history          []string
+	entryQuotas      moduleQuotas
+	searchQuotas     moduleQuotas
 }
 
 type CommandLineOptions struct {
@@ -37,22 +60,86 @@ type CommandLineOptions struct {
 	DomainController string
 	Username         string
 	Password         string
+	PasswordFrom     string
 	NTLMHash         string
+	HashesFile       string
+	HashesAccount    string
 	UseNTLM          bool
+	Kerberos         bool
+	Anonymous        bool
+	CurrentUser      bool
+	CCache           string
+	Keytab           string
+	Realm            string
+	KDC              string
+	KRB5Config       string
 	Port             int
 	Proxy            string
 	Secure           bool
+	StartTLS         bool
+	TLSVerify        bool
+	CACert           string
+	TLSServerName    string
+	TLSCert          string
+	TLSKey           string
 	ResolveHosts     bool
+	Probe            bool
+	ProbeTimeout     time.Duration
+	ProbeConcurrency int
 	Attributes       []string
 	FullAttributes   bool
+	Profile          string
 	Output           string
 	JSON             bool
+	Decode           bool
+	CSV              bool
+	Explode          string
+	Graph            string
+	GraphEdges       []string
+	STIX             bool
+	BloodHound       bool
+	SQL              bool
+	Archive          string
+	MaxMemory        string
 	Module           string
 	Interactive      bool
 	Version          bool
 	Verbose          bool
 	Debug            bool
+	WireDebug        bool
+	LogFormat        string
 	PageSize         int
+	AdaptivePaging   bool
+	Retries          int
+	Reconnect        bool
+	Controls         []string
+	ModuleTimeout    time.Duration
+	MaxEntries       []string
+	MaxSearches      []string
+	Referrals        string
+	Forest           bool
+	ForestCreds      string
+	Targets          string
+	Parallel         int
+	DNSServer        string
+	DNSTCP           bool
+	ProxyDNS         bool
+	IPVersion        string
+	NoCLDAP          bool
+	Write            bool
+	Confirm          bool
+	Journal          string
+	StatsFile        string
+	Provenance       bool
+	Anonymize        bool
+	AnonymizeKey     string
+	DetectDecoys     bool
+	Bench            bool
+	Annotate         bool
+	SchemaGUIDs      bool
+	NoPrimaryGroup   bool
+	Cache            bool
+	CacheTTL         time.Duration
 	ModuleFlags      *pflag.FlagSet
 }
 
@@ -63,21 +150,88 @@ func NewSession() *WindapSearchSession {
 	wFlags.SortFlags = false
 	wFlags.StringVarP(&w.Options.Domain, "domain", "d", "", "The FQDN of the domain (e.g. 'lab.example.com'). Only needed if dc not provided")
 	wFlags.StringVar(&w.Options.DomainController, "dc", "", "The Domain Controller to query against")
-	wFlags.StringVarP(&w.Options.Username, "username", "u", "", "The full username with domain to bind with (e.g. 'ropnop@lab.example.com' or 'LAB\\ropnop')\n If not specified, will attempt anonymous bind")
+	wFlags.StringVarP(&w.Options.Username, "username", "u", "", "The full username with domain to bind with (e.g. 'ropnop@lab.example.com' or 'LAB\\ropnop')\n If not specified, binds with the Kerberos tickets in the default ccache if there are any (Linux), or anonymously")
 	wFlags.StringVarP(&w.Options.Password, "password", "p", "", "Password to use. If not specified, will be prompted for")
-	wFlags.StringVar(&w.Options.NTLMHash, "hash", "", "NTLM Hash to use instead of password (i.e. pass-the-hash)")
-	wFlags.BoolVar(&w.Options.UseNTLM, "ntlm", false, "Use NTLM auth (automatic if hash is set)")
+	wFlags.StringVar(&w.Options.PasswordFrom, "password-from", "", "Read the password from a secret store instead: vault://PATH[#FIELD], aws-sm://SECRET-ID[#FIELD] or keyring://SERVICE[/ACCOUNT]")
+	wFlags.BoolVar(&w.Options.Anonymous, "anonymous", false, "Bind anonymously, even if there are Kerberos tickets in the default ccache to bind with")
+	wFlags.StringVar(&w.Options.NTLMHash, "hash", "", "NTLM Hash to use instead of password (i.e. pass-the-hash), as NT or LM:NT")
+	wFlags.StringVar(&w.Options.HashesFile, "hashes-file", "", "Pass-the-hash with an account's hashes from this secretsdump style dump (DOMAIN\\user:RID:LM:NT::: lines)")
+	wFlags.StringVar(&w.Options.HashesAccount, "hashes-account", "", "Account to take from --hashes-file, by name (e.g. 'LAB\\DC01$', or DC01 for the machine account) or RID (default: the username)")
+	wFlags.BoolVar(&w.Options.UseNTLM, "ntlm", false, "Use NTLM auth (automatic if hash is set). With a password, binds with its NT hash, derived locally")
+	wFlags.BoolVarP(&w.Options.Kerberos, "kerberos", "k", false, "Use Kerberos auth, e.g. for domains with NTLM disabled. Without a password or keytab, uses the ccache in KRB5CCNAME")
+	wFlags.StringVar(&w.Options.CCache, "ccache", "", "Kerberos ccache to take the TGT from (implies --kerberos)")
+	wFlags.StringVar(&w.Options.Keytab, "keytab", "", "Kerberos keytab to request a TGT with instead of a password (implies --kerberos)")
+	wFlags.StringVar(&w.Options.Realm, "realm", "", "Kerberos realm of the user (default: the domain of the username)")
+	wFlags.StringVar(&w.Options.KDC, "kdc", "", "KDC to request tickets from (default: the DC)")
+	wFlags.StringVar(&w.Options.KRB5Config, "krb5-conf", "", "krb5.conf to use instead of --realm and --kdc")
+	if ldapsession.SSPISupported {
+		wFlags.BoolVar(&w.Options.CurrentUser, "current-user", false, "Bind as the logged on user through SSPI (Kerberos), without any credentials. Defaults the domain to the user's")
+	}
 	wFlags.IntVar(&w.Options.Port, "port", 0, "Port to connect to (if non standard)")
-	wFlags.BoolVar(&w.Options.Secure, "secure", false, "Use LDAPS. This will not verify TLS certs, however. (default: false)")
+	wFlags.BoolVar(&w.Options.Secure, "secure", false, "Use LDAPS. The DC's certificate isn't verified unless --tls-verify or --ca-cert is given")
+	wFlags.BoolVar(&w.Options.StartTLS, "start-tls", false, "Connect to the LDAP port and upgrade to TLS with StartTLS before binding, for DCs that require it but don't expose LDAPS")
+	wFlags.BoolVar(&w.Options.TLSVerify, "tls-verify", false, "Verify the DC's TLS certificate against the system's CAs")
+	wFlags.StringVar(&w.Options.CACert, "ca-cert", "", "PEM bundle of CAs to verify the DC's TLS certificate against instead of the system's (implies --tls-verify)")
+	wFlags.StringVar(&w.Options.TLSServerName, "tls-server-name", "", "Name the DC's TLS certificate must be for (default: the DC's name or address)")
+	wFlags.StringVar(&w.Options.TLSCert, "tls-cert", "", "PEM client certificate to present (mutual TLS). Without a username, binds as the account it maps to")
+	wFlags.StringVar(&w.Options.TLSKey, "tls-key", "", "PEM private key of --tls-cert")
 	wFlags.StringVar(&w.Options.Proxy, "proxy", "", "SOCKS5 Proxy to use (e.g. 127.0.0.1:9050)")
+	wFlags.StringVar(&w.Options.DNSServer, "dns-server", "", "Nameserver to use to discover DCs and resolve their hostnames instead of the system resolver (e.g. 10.0.0.5:53)")
+	wFlags.BoolVar(&w.Options.DNSTCP, "dns-tcp", false, "Send DNS queries over TCP")
+	wFlags.BoolVar(&w.Options.ProxyDNS, "proxy-dns", false, "Also send DNS queries through the SOCKS proxy (over TCP)")
+	wFlags.StringVar(&w.Options.IPVersion, "ip-version", "auto", "IP version to prefer when connecting to DCs: 4, 6, or auto")
+	wFlags.BoolVar(&w.Options.NoCLDAP, "no-cldap", false, "Don't validate DCs discovered through DNS with CLDAP pings before connecting")
 	wFlags.BoolVar(&w.Options.FullAttributes, "full", false, "Output all attributes from LDAP")
+	wFlags.StringVar(&w.Options.Profile, "profile", "", "Attribute profile to request instead of the module defaults: minimal, standard, full, or bloodhound")
 	wFlags.StringVarP(&w.Options.Output, "output", "o", "", "Save results to file")
 	wFlags.BoolVarP(&w.Options.JSON, "json", "j", false, "Convert LDAP output to JSON")
+	wFlags.BoolVar(&w.Options.Decode, "decode", false, "Convert values in text output as JSON output does: SIDs, GUIDs, timestamps, flag names, and security descriptors as SDDL")
+	wFlags.BoolVar(&w.Options.CSV, "csv", false, "Write results as CSV, one column per requested attribute")
+	wFlags.StringVar(&w.Options.Explode, "explode", "", "With --csv, write a row for each value of this multi-valued attribute (e.g. member for group to member edges), repeating the other columns")
+	wFlags.StringVar(&w.Options.Graph, "graph", "", "Write the results' relationships as a graph for Gephi or yEd instead: dot or graphml")
+	wFlags.StringSliceVar(&w.Options.GraphEdges, "graph-edges", DefaultGraphEdges, "Relationships to draw with --graph: memberOf, member, manager, delegation, acl")
+	wFlags.BoolVar(&w.Options.STIX, "stix", false, "Write users, computers and trusts as a STIX 2.1 bundle for CTI platforms (e.g. OpenCTI) instead")
+	wFlags.BoolVar(&w.Options.BloodHound, "bloodhound", false, "Write users, groups, computers and domains as a zip of BloodHound (v4) JSON files to upload instead, with group members and delegation targets resolved to SIDs. Requires -o")
+	wFlags.BoolVar(&w.Options.SQL, "sql", false, "Write SQLite statements that update a table of objects by objectGUID, keeping every version with when it was valid (pipe into sqlite3)")
+	wFlags.StringVar(&w.Options.Archive, "archive", "", "Also keep every module's results in this archive directory, by domain, module and date (see the history command)")
+	wFlags.StringVar(&w.Options.MaxMemory, "max-memory", DefaultMaxMemory, "Most results to hold in memory when an output format can't stream them (CSV with --full), e.g. 512MB")
 	wFlags.IntVar(&w.Options.PageSize, "page-size", 1000, "LDAP page size to use")
+	wFlags.BoolVar(&w.Options.AdaptivePaging, "adaptive-paging", false, "Start with small pages and grow them up to --page-size while the DC answers quickly, shrinking them if it slows down or refuses")
+	wFlags.IntVar(&w.Options.Retries, "retries", ldapsession.DefaultRetries, "Times to retry a search or page that fails because the DC is busy, unavailable or timed out, backing off between tries. Also how many times every DC found is tried when none can be reached")
+	wFlags.BoolVar(&w.Options.Reconnect, "reconnect", false, "If the connection to the DC drops during a search, reconnect (to another DC if needed) and carry on without repeating entries (up to --retries times)")
+	wFlags.StringArrayVar(&w.Options.Controls, "control", nil, "Attach a server control to every search, as OID[:critical[:base64value]] (e.g. 1.2.840.113556.1.4.417 to see deleted objects). Can be given more than once")
+	wFlags.DurationVar(&w.Options.ModuleTimeout, "module-timeout", 0, "Stop a module that runs longer than this (e.g. 10m) and move on to the next one (default: no limit)")
+	wFlags.StringSliceVar(&w.Options.MaxEntries, "max-entries", nil, "Stop a module once it has output this many entries, as N for every module or module=N (e.g. access-matrix=50000), comma separated")
+	wFlags.StringSliceVar(&w.Options.MaxSearches, "max-searches", nil, "Stop a module from sending more than this many searches, as N for every module or module=N, comma separated")
+	wFlags.StringVar(&w.Options.Referrals, "referrals", "ignore", "What to do with LDAP referrals: follow, ignore, or report")
+	wFlags.BoolVar(&w.Options.Forest, "forest", false, "Run the module against every domain in the forest")
+	wFlags.StringVar(&w.Options.StatsFile, "stats-file", "", "Also write the end of run summary (entries, pages, bytes, duration, errors per module) to this JSON file")
+	wFlags.BoolVar(&w.Options.Provenance, "provenance", false, "Record how results were collected (tool version, command, bind identity, DC, times, searches and page counts) at the start and end of every output file")
+	wFlags.BoolVar(&w.Options.Anonymize, "anonymize", false, "Replace names, SIDs, hostnames and addresses in the results with pseudonyms that are the same everywhere in the run, for sharing datasets")
+	wFlags.StringVar(&w.Options.AnonymizeKey, "anonymize-key", "", "Secret to derive --anonymize pseudonyms from, so they're the same across runs (default: a random one per run)")
+	wFlags.StringVar(&w.Options.ForestCreds, "forest-creds", "", "JSON file with per-domain credentials/DCs to use in forest mode")
+	wFlags.StringVar(&w.Options.Targets, "targets", "", "JSON file of domains/forests to enumerate, each with their own credentials and DC. Requires -o")
+	wFlags.IntVar(&w.Options.Parallel, "parallel", 1, "Number of targets to enumerate at the same time when using --targets")
+	wFlags.BoolVar(&w.Options.Cache, "cache", false, "Cache lookup results on disk (~/.cache/windapsearch) for --cache-ttl, to reuse across modules and runs")
+	wFlags.DurationVar(&w.Options.CacheTTL, "cache-ttl", ldapsession.DefaultCacheTTL, "How long cached lookup results are used for")
+	wFlags.BoolVar(&w.Options.DetectDecoys, "detect-decoys", false, "First look for likely honeytoken accounts, listing them and tagging them with decoyIndicators in the results")
+	wFlags.BoolVar(&w.Options.ResolveHosts, "resolve", false, "Resolve the dNSHostName of results (e.g. computers) and add their addresses as ipAddresses, using the --dns-server/--proxy-dns settings")
+	wFlags.BoolVar(&w.Options.Probe, "probe", false, "Check the dNSHostName of results for open SMB (445) and WinRM (5985/5986) ports, tagging them reachable alive or dead")
+	wFlags.DurationVar(&w.Options.ProbeTimeout, "probe-timeout", DefaultProbeTimeout, "How long a port has to accept a connection with --probe")
+	wFlags.IntVar(&w.Options.ProbeConcurrency, "probe-concurrency", DefaultProbeConcurrency, "Number of hosts to probe at the same time with --probe")
+	wFlags.BoolVar(&w.Options.Annotate, "annotate", false, "Label default objects (built-in groups, default containers, AdminSDHolder, krbtgt, ...) with wellKnownObject in the results")
+	wFlags.BoolVar(&w.Options.SchemaGUIDs, "schema-guids", false, "Read the names of ACE object types from the schema and extended rights, instead of only using the built in list")
+	wFlags.BoolVar(&w.Options.NoPrimaryGroup, "no-primary-group", false, "Don't count accounts' primary group (primaryGroupID) as a membership: leave it out of memberOf, and its accounts out of group members")
+	wFlags.BoolVar(&w.Options.Write, "write", false, "Allow modules that change the directory to run. Changes are only previewed unless --confirm is also given")
+	wFlags.BoolVar(&w.Options.Confirm, "confirm", false, "Apply the changes made by write modules (requires --write)")
+	wFlags.StringVar(&w.Options.Journal, "journal", "", "File to record applied changes in, for 'windapsearch undo' (default: windapsearch-journal-<time>.json)")
+	wFlags.BoolVar(&w.Options.Bench, "bench", false, "Instead of running a module, measure bind and search latency and paging throughput to help choose --page-size and worker counts")
 	//wFlags.BoolVarP(&w.Options.Interactive, "interactive", "i", false, "Start in interactive mode") //TODO
 	wFlags.BoolVar(&w.Options.Version, "version", false, "Show version info and exit")
 	wFlags.BoolVarP(&w.Options.Verbose, "verbose", "v", false, "Show info logs")
 	wFlags.BoolVar(&w.Options.Debug, "debug", false, "Show debug logs")
+	wFlags.BoolVar(&w.Options.WireDebug, "wire-debug", false, "Dump every LDAP packet sent and received to STDERR, with credentials redacted (implies --debug)")
+	wFlags.StringVar(&w.Options.LogFormat, "log-format", "text", "Format of the logs on STDERR: text, or json for one object per line with the module, dc, worker and page as fields")
 	wFlags.BoolVarP(&w.Options.Help, "help", "h", false, "Show this help")
 
 	pflag.ErrHelp = errors.New("")
@@ -87,7 +241,7 @@ func NewSession() *WindapSearchSession {
 		w.RegisterModule(m)
 	}
 
-	wFlags.StringVarP(&w.Options.Module, "module", "m", "", "Module to use")
+	wFlags.StringVarP(&w.Options.Module, "module", "m", "", "Module to use. Multiple comma separated modules are written to separate files in the -o directory")
 
 	w.Options.FlagSet = wFlags
 
@@ -98,15 +252,109 @@ func NewSession() *WindapSearchSession {
 
 	logger.Out = os.Stderr // default log to stderr
 	logger.SetLevel(logrus.ErrorLevel)
-	logger.SetFormatter(&logrus.TextFormatter{
+	// passwords, hashes and the like never make it into the logs, whatever's logged
+	logger.SetFormatter(&redact.Formatter{Formatter: &logrus.TextFormatter{
 		FullTimestamp:          true,
 		DisableLevelTruncation: true,
-	})
+	}})
 	w.Log = logger.WithFields(logrus.Fields{"package": "windapsearch"})
 
 	return &w
 }
 
+// usePasswordFrom reads the password from the secret store --password-from names, so it doesn't have to be on the
+// command line or typed in, e.g. for scheduled runs
+func (w *WindapSearchSession) usePasswordFrom() (err error) {
+	o := w.Options
+	if o.PasswordFrom == "" {
+		return nil
+	}
+	if o.Password != "" || o.NTLMHash != "" || o.HashesFile != "" || o.CCache != "" || o.Keytab != "" || o.Anonymous || o.CurrentUser {
+		return fmt.Errorf("--password-from can't be used with another password, hash, ccache or keytab, or --anonymous")
+	}
+	if o.Username == "" {
+		return fmt.Errorf("--password-from needs a username (-u) to bind as")
+	}
+	if w.Options.Password, err = secrets.Fetch(o.PasswordFrom); err != nil {
+		return fmt.Errorf("--password-from: %s", err)
+	}
+	w.Log.Infof("read the password from %s", o.PasswordFrom)
+	return nil
+}
+
+// useHashesFile takes the hash to bind with from --hashes-file, for the account --hashes-account (or the username)
+// picks. Without a username, or when the username picked it, it binds as the account picked
+func (w *WindapSearchSession) useHashesFile() error {
+	o := w.Options
+	if o.HashesFile == "" {
+		if o.HashesAccount != "" {
+			return fmt.Errorf("--hashes-account requires --hashes-file")
+		}
+		return nil
+	}
+	if o.Password != "" || o.NTLMHash != "" || o.Kerberos || o.CCache != "" || o.Keytab != "" || o.Anonymous || o.CurrentUser {
+		return fmt.Errorf("--hashes-file can't be used with a password, --hash, Kerberos or --anonymous")
+	}
+	selector := o.HashesAccount
+	if selector == "" {
+		selector = o.Username
+	}
+	if selector == "" {
+		return fmt.Errorf("--hashes-file needs an account to take the hash of, with --hashes-account or -u")
+	}
+	hashes, err := ldapsession.ReadHashesFile(o.HashesFile)
+	if err != nil {
+		return fmt.Errorf("--hashes-file: %s", err)
+	}
+	if len(hashes) == 0 {
+		return fmt.Errorf("--hashes-file: no account hashes found in %s", o.HashesFile)
+	}
+	dumped, err := ldapsession.SelectHash(hashes, selector)
+	if err != nil {
+		return fmt.Errorf("--hashes-file: %s", err)
+	}
+	redact.Add(dumped.Hash)
+	w.Options.NTLMHash = dumped.Hash
+	switch {
+	case o.Username == "":
+		w.Options.Username = dumped.Account
+	case o.HashesAccount == "":
+		// the username picked the account, but maybe by its hostname, so it's bound as the account's name
+		if i := strings.LastIndex(o.Username, "@"); i >= 0 {
+			w.Options.Username = dumped.Account + o.Username[i:]
+		} else if i := strings.LastIndex(o.Username, `\`); i >= 0 {
+			w.Options.Username = o.Username[:i+1] + dumped.Account
+		} else {
+			w.Options.Username = dumped.Account
+		}
+	}
+	fmt.Fprintf(os.Stderr, "[*] Using the hash of %s (RID %d) from %s\n", dumped.Name(), dumped.RID, o.HashesFile)
+	return nil
+}
+
+// useSSOCCache binds with the tickets in the default ccache when no credentials are given, as ldapsearch -Y GSSAPI
+// does, if there's a TGT in it that hasn't expired. The domain defaults to the tickets' realm
+func (w *WindapSearchSession) useSSOCCache() {
+	o := w.Options
+	if o.Anonymous || o.Targets != "" || o.Username != "" || o.Password != "" || o.NTLMHash != "" || o.UseNTLM || o.Kerberos ||
+		o.CCache != "" || o.Keytab != "" || o.TLSCert != "" || o.CurrentUser {
+		return
+	}
+	path := ldapsession.SSOCCache()
+	if path == "" {
+		return
+	}
+	principal, ok := ldapsession.CCacheTGT(path)
+	if !ok {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[*] No credentials given, binding as %s with the Kerberos tickets in %s (--anonymous to bind anonymously)\n", principal, path)
+	w.Options.CCache = path
+	if w.Options.Domain == "" && w.Options.DomainController == "" {
+		w.Options.Domain = strings.ToLower(principal[strings.LastIndex(principal, "@")+1:])
+	}
+}
+
 func (w *WindapSearchSession) handleInterrupt() {
 	// set up cancelling, catch SIGINT
 	w.ctx, w.cancel = context.WithCancel(context.Background())
@@ -123,14 +371,58 @@ func (w *WindapSearchSession) RegisterModule(mod modules.Module) {
 }
 
 func (w *WindapSearchSession) LoadModule() {
-	mod := w.GetModuleByName(w.Options.Module)
-	if mod != nil {
-		w.Module = mod
-		w.Options.ModuleFlags = mod.FlagSet()
-		w.Options.ModuleFlags.StringSliceVar(&w.Options.Attributes, "attrs", mod.DefaultAttrs(), "Comma separated custom atrributes to display")
+	for _, name := range strings.Split(w.Options.Module, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		mod := w.GetModuleByName(name)
+		if mod == nil {
+			w.unknownModules = append(w.unknownModules, name)
+			continue
+		}
+		w.Modules = append(w.Modules, mod)
+		flags := mod.FlagSet()
+		if w.Module == nil {
+			w.Module = mod
+			w.Options.ModuleFlags = flags
+			w.Options.ModuleFlags.StringSliceVar(&w.Options.Attributes, "attrs", mod.DefaultAttrs(), "Comma separated custom atrributes to display")
+			continue
+		}
+		// flags with the same name as one already defined are shared, see syncModuleFlags
+		w.Options.ModuleFlags.AddFlagSet(flags)
+		w.extraModuleFlags = append(w.extraModuleFlags, flags)
 	}
 }
 
+// syncModuleFlags copies flag values set on the command line to the other modules when more than one module is
+// selected and they define a flag with the same name (e.g. --search)
+func (w *WindapSearchSession) syncModuleFlags() {
+	for _, flags := range w.extraModuleFlags {
+		flags.VisitAll(func(f *pflag.Flag) {
+			main := w.Options.FlagSet.Lookup(f.Name)
+			if main == nil || main == f || !main.Changed || strings.HasSuffix(f.Value.Type(), "Slice") {
+				return
+			}
+			flags.Set(f.Name, main.Value.String())
+		})
+	}
+}
+
+// moduleNames returns the names of the selected modules, comma separated
+func (w *WindapSearchSession) moduleNames() string {
+	var names []string
+	for _, mod := range w.Modules {
+		names = append(names, mod.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// multiOutput is true when results are written to a directory of files instead of a single file or STDOUT
+func (w *WindapSearchSession) multiOutput() bool {
+	return len(w.Modules) > 1 || w.Options.Targets != ""
+}
+
 func (w *WindapSearchSession) ModuleListString() string {
 	var sb strings.Builder
 	for _, mod := range w.AllModules {
@@ -145,7 +437,11 @@ func (w *WindapSearchSession) ModuleDescriptionString() string {
 	sb := &strings.Builder{}
 	tw := tabwriter.NewWriter(sb, 0, 0, 4, ' ', 0)
 	for _, mod := range w.AllModules {
-		fmt.Fprintf(tw, "\t%s\t%s\n", mod.Name(), mod.Description())
+		description := mod.Description()
+		if modules.IsWrite(mod) {
+			description += " (write)"
+		}
+		fmt.Fprintf(tw, "\t%s\t%s\n", mod.Name(), description)
 	}
 	tw.Flush()
 	return sb.String()
@@ -162,12 +458,12 @@ func (w *WindapSearchSession) GetModuleByName(name string) modules.Module {
 }
 
 func (w *WindapSearchSession) ShowUsage() {
-	fmt.Fprintf(os.Stderr, "windapsearch: a tool to perform Windows domain enumeration through LDAP queries\n%s\nUsage: %s [options] -m [module] [module options]\n\nOptions:\n", buildinfo.FormatVersionString(), os.Args[0])
+	fmt.Fprintf(os.Stderr, "windapsearch: a tool to perform Windows domain enumeration through LDAP queries\n%s\nUsage: %s [options] -m [module] [module options]\n       %s [options] undo <journal>\n       %s --archive <dir> history [domain [module] | show <id>]\n\nOptions:\n", buildinfo.FormatVersionString(), os.Args[0], os.Args[0], os.Args[0])
 	w.Options.FlagSet.PrintDefaults()
 	if w.Module == nil {
 		fmt.Fprintf(os.Stderr, "\nAvailable modules:\n%s", w.ModuleDescriptionString())
 	} else {
-		fmt.Fprintf(os.Stderr, "\nOptions for %q module:\n", w.Module.Name())
+		fmt.Fprintf(os.Stderr, "\nOptions for %q module:\n", w.moduleNames())
 		w.Options.ModuleFlags.PrintDefaults()
 	}
 }
@@ -182,8 +478,11 @@ func (w *WindapSearchSession) Run() (err error) {
 	w.LoadModule()
 
 	//w.Options.ModuleFlags.AddFlagSet(w.Options.FlagSet)
-	w.Options.FlagSet.AddFlagSet(w.Options.ModuleFlags)
+	if w.Options.ModuleFlags != nil {
+		w.Options.FlagSet.AddFlagSet(w.Options.ModuleFlags)
+	}
 	w.Options.FlagSet.Parse(os.Args[:])
+	w.syncModuleFlags()
 
 	if w.Options.Help {
 		w.ShowUsage()
@@ -195,14 +494,102 @@ func (w *WindapSearchSession) Run() (err error) {
 		return
 	}
 
+	if len(w.unknownModules) > 0 {
+		return fmt.Errorf("unknown module(s): %s", strings.Join(w.unknownModules, ", "))
+	}
+	if err = w.parseCommand(); err != nil {
+		return
+	}
+	if err = w.checkWriteModules(); err != nil {
+		return
+	}
+	if w.Options.Bench && w.Options.Targets != "" {
+		return fmt.Errorf("--bench can't be used with --targets")
+	}
+	if w.Options.JSON && w.Options.CSV {
+		return fmt.Errorf("--json and --csv can't be used together")
+	}
+	if w.maxMemory, err = parseByteSize(w.Options.MaxMemory); err != nil {
+		return fmt.Errorf("--max-memory: %s", err)
+	}
+	if w.entryQuotas, err = w.parseModuleQuotas(w.Options.MaxEntries); err != nil {
+		return fmt.Errorf("--max-entries: %s", err)
+	}
+	if w.searchQuotas, err = w.parseModuleQuotas(w.Options.MaxSearches); err != nil {
+		return fmt.Errorf("--max-searches: %s", err)
+	}
+	if w.Options.Decode && (w.Options.JSON || w.Options.CSV || w.Options.Graph != "" || w.Options.STIX || w.Options.SQL || w.Options.BloodHound) {
+		return fmt.Errorf("--decode only applies to text output, the other formats convert values themselves")
+	}
+	if w.Options.Explode != "" && !w.Options.CSV {
+		return fmt.Errorf("--explode requires --csv")
+	}
+	if w.Options.STIX && (w.Options.JSON || w.Options.CSV || w.Options.Graph != "") {
+		return fmt.Errorf("--stix can't be used with --json, --csv or --graph")
+	}
+	if w.Options.SQL && (w.Options.JSON || w.Options.CSV || w.Options.Graph != "" || w.Options.STIX) {
+		return fmt.Errorf("--sql can't be used with --json, --csv, --graph or --stix")
+	}
+	if w.Options.BloodHound {
+		if w.Options.JSON || w.Options.CSV || w.Options.Graph != "" || w.Options.STIX || w.Options.SQL {
+			return fmt.Errorf("--bloodhound can't be used with --json, --csv, --graph, --stix or --sql")
+		}
+		if w.Options.Output == "" {
+			return fmt.Errorf("--bloodhound writes a zip file, it needs -o")
+		}
+		// member DNs and SIDs are looked up in the domain, which anonymized values can't be
+		if w.Options.Anonymize {
+			return fmt.Errorf("--bloodhound can't be used with --anonymize")
+		}
+	}
+	if w.Options.Graph != "" {
+		if w.Options.JSON || w.Options.CSV {
+			return fmt.Errorf("--graph can't be used with --json or --csv")
+		}
+		if w.Options.Graph = strings.ToLower(w.Options.Graph); w.Options.Graph != graphDOT && w.Options.Graph != graphGraphML {
+			return fmt.Errorf("--graph must be dot or graphml")
+		}
+		if w.graphEdges, err = parseGraphEdges(w.Options.GraphEdges); err != nil {
+			return fmt.Errorf("--graph-edges: %s", err)
+		}
+	} else if w.Options.FlagSet.Changed("graph-edges") {
+		return fmt.Errorf("--graph-edges requires --graph")
+	}
+	// the provenance comments would make these files invalid
+	if w.Options.Provenance && (w.Options.STIX || w.Options.SQL || w.Options.BloodHound || w.Options.Graph == graphGraphML) {
+		return fmt.Errorf("--provenance can't be used with --stix, --sql, --bloodhound or --graph graphml")
+	}
+	if w.Options.AnonymizeKey != "" && !w.Options.Anonymize {
+		return fmt.Errorf("--anonymize-key requires --anonymize")
+	}
+	if w.Options.Anonymize {
+		if w.anonymizer, err = newAnonymizer(w.Options.AnonymizeKey); err != nil {
+			return err
+		}
+	}
+	if w.Options.Profile != "" {
+		if w.Options.Profile, err = modules.ParseProfile(w.Options.Profile); err != nil {
+			return
+		}
+	}
+
 	if w.Options.Verbose {
 		w.Log.Logger.SetLevel(logrus.InfoLevel)
 	}
-	if w.Options.Debug {
+	if w.Options.Debug || w.Options.WireDebug {
 		w.Log.Logger.SetLevel(logrus.DebugLevel)
 	}
+	switch strings.ToLower(w.Options.LogFormat) {
+	case "text":
+	case "json":
+		w.Log.Logger.SetFormatter(&redact.Formatter{Formatter: &logrus.JSONFormatter{}})
+	default:
+		return fmt.Errorf("--log-format must be text or json")
+	}
 
-	if w.Options.Output != "" {
+	if w.Options.Output != "" && w.multiOutput() {
+		w.Log.Infof("Saving output to directory %q", w.Options.Output)
+	} else if w.Options.Output != "" {
 		fp, err2 := os.Create(w.Options.Output)
 		if err2 != nil {
 			err = err2
@@ -215,17 +602,112 @@ func (w *WindapSearchSession) Run() (err error) {
 		w.Log.Infof("Saving output to STDOUT")
 	}
 
-	if w.Options.Domain == "" && w.Options.DomainController == "" {
+	if w.history != nil {
+		return w.runHistory()
+	}
+	if w.undo != nil && w.Options.Domain == "" && w.Options.DomainController == "" {
+		w.Options.Domain = w.undo.Domain
+	}
+	if err = w.usePasswordFrom(); err != nil {
+		return
+	}
+	if err = w.useHashesFile(); err != nil {
+		return
+	}
+	w.useSSOCCache()
+	if w.Options.CurrentUser && w.Options.Domain == "" && w.Options.DomainController == "" {
+		w.Options.Domain = ldapsession.CurrentUserDomain()
+	}
+	if w.Options.Domain == "" && w.Options.DomainController == "" && w.Options.Targets == "" {
 		w.ShowUsage()
 		fmt.Fprintf(os.Stderr, "\n[!] You must specify either a domain or an IP address of a domain controller\n")
 		return
 	}
+	referrals, err := ldapsession.ParseReferralPolicy(w.Options.Referrals)
+	if err != nil {
+		return
+	}
+	w.Options.Referrals = string(referrals)
+
+	ipVersion, err := ldapsession.ParseIPVersion(w.Options.IPVersion)
+	if err != nil {
+		return
+	}
+
+	resolver := &dns.Resolver{Server: w.Options.DNSServer, TCP: w.Options.DNSTCP}
+	if w.Options.ProxyDNS {
+		if w.Options.Proxy == "" {
+			return fmt.Errorf("--proxy-dns requires --proxy")
+		}
+		resolver.Proxy = w.Options.Proxy
+		if resolver.Server == "" {
+			// the system nameservers are usually local, so they won't mean anything on the other side of the proxy
+			if w.Options.DomainController == "" {
+				return fmt.Errorf("--proxy-dns requires a nameserver (--dns-server) or DC (--dc) to send queries to")
+			}
+			resolver.Server = w.Options.DomainController
+		}
+	}
+
+	if w.Options.ResolveHosts && w.Options.Proxy != "" && !w.Options.ProxyDNS {
+		w.Log.Warn("--resolve looks up hostnames from this machine, add --proxy-dns to send the lookups through the proxy")
+	}
+	if w.Options.Probe && w.Options.ProbeConcurrency < 1 {
+		return fmt.Errorf("--probe-concurrency must be at least 1")
+	}
+
 	password := w.Options.Password
 	username := w.Options.Username
 
+	if w.Options.Secure && w.Options.StartTLS {
+		return fmt.Errorf("--start-tls can't be used with --secure, LDAPS connections are already encrypted")
+	}
+	if (w.Options.TLSCert == "") != (w.Options.TLSKey == "") {
+		return fmt.Errorf("--tls-cert and --tls-key must be given together")
+	}
+	if (w.Options.TLSVerify || w.Options.CACert != "" || w.Options.TLSServerName != "" || w.Options.TLSCert != "") && !w.Options.Secure && !w.Options.StartTLS {
+		return fmt.Errorf("--tls-verify, --ca-cert, --tls-server-name and --tls-cert need a TLS connection (--secure or --start-tls)")
+	}
+	var controls []ldap.Control
+	for _, c := range w.Options.Controls {
+		control, err := ldapsession.ParseControl(c)
+		if err != nil {
+			return fmt.Errorf("--control: %s", err)
+		}
+		if control.GetControlType() == ldap.ControlTypePaging {
+			return fmt.Errorf("--control: searches are already paged, use --page-size to change the page size")
+		}
+		controls = append(controls, control)
+	}
+	if w.Options.Anonymous && (username != "" || password != "" || w.Options.NTLMHash != "" || w.Options.Kerberos ||
+		w.Options.CCache != "" || w.Options.Keytab != "" || w.Options.TLSCert != "" || w.Options.CurrentUser) {
+		return fmt.Errorf("--anonymous can't be used with credentials or auth options")
+	}
+	if w.Options.CurrentUser && (username != "" || password != "" || w.Options.NTLMHash != "" || w.Options.UseNTLM ||
+		w.Options.Kerberos || w.Options.CCache != "" || w.Options.Keytab != "" || w.Options.TLSCert != "") {
+		return fmt.Errorf("--current-user can't be used with other credentials or auth options")
+	}
+	if w.Options.NTLMHash != "" {
+		if w.Options.NTLMHash, err = ldapsession.NormalizeHash(w.Options.NTLMHash); err != nil {
+			return fmt.Errorf("--hash: %s", err)
+		}
+	}
 	if w.Options.UseNTLM && username == "" {
 		return fmt.Errorf("must provide username for NTLM authentication")
 	}
+	kerberos := w.Options.Kerberos || w.Options.CCache != "" || w.Options.Keytab != ""
+	ccache := w.Options.CCache
+	if kerberos {
+		if w.Options.UseNTLM || w.Options.NTLMHash != "" {
+			return fmt.Errorf("--kerberos can't be used with --ntlm or --hash")
+		}
+		if ccache == "" && w.Options.Keytab == "" && password == "" {
+			ccache = ldapsession.DefaultCCache()
+		}
+		if ccache == "" && username == "" {
+			return fmt.Errorf("must provide a username, --ccache or KRB5CCNAME for Kerberos authentication")
+		}
+	}
 
 	if username != "" { // only prompt for password if username is provided
 		if len(strings.Split(w.Options.Username, "@")) == 1 {
@@ -233,7 +715,7 @@ func (w *WindapSearchSession) Run() (err error) {
 		} else {
 			username = w.Options.Username
 		}
-		if username != "" && password == "" && w.Options.NTLMHash == "" {
+		if username != "" && password == "" && w.Options.NTLMHash == "" && w.Options.Keytab == "" && ccache == "" {
 			password, err = utils.SecurePrompt(fmt.Sprintf("Password for [%s]", username))
 			if err != nil {
 				return err
@@ -245,17 +727,49 @@ func (w *WindapSearchSession) Run() (err error) {
 	w.handleInterrupt()
 
 	ldapOptions := ldapsession.LDAPSessionOptions{
-		Domain:           w.Options.Domain,
-		DomainController: w.Options.DomainController,
-		Username:         username,
-		Password:         password,
-		Hash:             w.Options.NTLMHash,
-		UseNTLM:          w.Options.UseNTLM,
-		Port:             w.Options.Port,
-		Proxy:            w.Options.Proxy,
-		Secure:           w.Options.Secure,
-		PageSize:         w.Options.PageSize,
-		Logger:           w.Log.Logger,
+		Domain:             w.Options.Domain,
+		DomainController:   w.Options.DomainController,
+		Username:           username,
+		Password:           password,
+		Hash:               w.Options.NTLMHash,
+		UseNTLM:            w.Options.UseNTLM,
+		CurrentUser:        w.Options.CurrentUser,
+		UseKerberos:        kerberos,
+		CCachePath:         ccache,
+		Keytab:             w.Options.Keytab,
+		Realm:              w.Options.Realm,
+		KDC:                w.Options.KDC,
+		KRB5Config:         w.Options.KRB5Config,
+		Port:               w.Options.Port,
+		Proxy:              w.Options.Proxy,
+		Secure:             w.Options.Secure,
+		StartTLS:           w.Options.StartTLS,
+		TLSVerify:          w.Options.TLSVerify,
+		CACert:             w.Options.CACert,
+		TLSServerName:      w.Options.TLSServerName,
+		ClientCert:         w.Options.TLSCert,
+		ClientKey:          w.Options.TLSKey,
+		PageSize:           w.Options.PageSize,
+		Referrals:          referrals,
+		Resolver:           resolver,
+		IPVersion:          ipVersion,
+		SkipCLDAP:          w.Options.NoCLDAP,
+		Writes:             w.writeMode(),
+		Journal:            w.newJournal(),
+		Cache:              w.newCache(),
+		AdaptivePaging:     w.Options.AdaptivePaging,
+		Retries:            w.Options.Retries,
+		Reconnect:          w.Options.Reconnect,
+		Controls:           controls,
+		IgnorePrimaryGroup: w.Options.NoPrimaryGroup,
+		WireDebug:          w.Options.WireDebug,
+		Logger:             w.Log.Logger,
+	}
+	defer w.reportJournal()
+	defer w.reportStats()
+
+	if w.Options.Targets != "" {
+		return w.runTargets(ldapOptions)
 	}
 
 	w.LDAPSession, err = ldapsession.NewLDAPSession(&ldapOptions, w.ctx)
@@ -264,6 +778,12 @@ func (w *WindapSearchSession) Run() (err error) {
 	}
 	defer w.LDAPSession.Close()
 
+	if w.undo != nil {
+		return w.LDAPSession.Undo(w.undo)
+	}
+	if w.Options.Bench {
+		return w.runBench()
+	}
 	if w.Options.Interactive {
 		return w.StartTUI()
 	} else {
@@ -272,21 +792,94 @@ func (w *WindapSearchSession) Run() (err error) {
 }
 
 func (w *WindapSearchSession) StartCLI() error {
-	if w.Module == nil {
-		fmt.Fprintf(os.Stderr, "[!] You must specify a valid module to use\n")
-		fmt.Fprintf(os.Stderr, " Available modules: \n%s", w.ModuleDescriptionString())
-		return nil
+	if err := w.checkModules(); err != nil || w.Module == nil {
+		return err
+	}
+	targets := []moduleTarget{{session: w.LDAPSession}}
+	if w.Options.Forest {
+		var err error
+		targets, err = w.forestTargets(w.LDAPSession)
+		defer closeTargets(targets, w.LDAPSession)
+		if err != nil {
+			return err
+		}
 	}
-	err := w.runModule()
+	err := w.runModules(w.Modules, targets, "")
 	if err != nil {
 		return err
 	}
-	if w.Options.Output != "" {
+	if w.Options.Output != "" && !w.multiOutput() {
 		fmt.Printf("[+] %s written\n", w.Options.Output)
 	}
 	return nil
 }
 
+// checkModules makes sure valid modules were selected, printing the available ones if not
+func (w *WindapSearchSession) checkModules() error {
+	if len(w.unknownModules) > 0 {
+		return fmt.Errorf("unknown module(s): %s", strings.Join(w.unknownModules, ", "))
+	}
+	if w.Module == nil {
+		fmt.Fprintf(os.Stderr, "[!] You must specify a valid module to use\n")
+		fmt.Fprintf(os.Stderr, " Available modules: \n%s", w.ModuleDescriptionString())
+	}
+	return nil
+}
+
+// checkWriteModules refuses to run modules that change the directory unless --write was given
+func (w *WindapSearchSession) checkWriteModules() error {
+	if w.Options.Confirm && !w.Options.Write && w.undo == nil {
+		return fmt.Errorf("--confirm requires --write")
+	}
+	for _, mod := range w.Modules {
+		if modules.IsWrite(mod) && !w.Options.Write {
+			return fmt.Errorf("module %q changes the directory, re-run with --write to preview its changes", mod.Name())
+		}
+	}
+	return nil
+}
+
+// writeMode converts the --write and --confirm flags to the session's write mode
+func (w *WindapSearchSession) writeMode() ldapsession.WriteMode {
+	switch {
+	case w.undo != nil && w.Options.Confirm:
+		return ldapsession.WritesEnabled
+	case w.undo != nil:
+		return ldapsession.WritesDryRun
+	case w.Options.Write && w.Options.Confirm:
+		return ldapsession.WritesEnabled
+	case w.Options.Write:
+		return ldapsession.WritesDryRun
+	}
+	return ldapsession.WritesDisabled
+}
+
+// newCache returns the lookup cache to use if --cache was given. Writes make cached results stale (and spray needs
+// fresh bad password counts), so nothing is cached when write modules can run
+func (w *WindapSearchSession) newCache() *ldapsession.Cache {
+	if !w.Options.Cache || w.Options.Write || w.undo != nil {
+		return nil
+	}
+	dir, err := ldapsession.DefaultCacheDir()
+	if err == nil {
+		var cache *ldapsession.Cache
+		if cache, err = ldapsession.NewCache(dir, w.Options.CacheTTL); err == nil {
+			return cache
+		}
+	}
+	w.Log.Warnf("unable to use the lookup cache: %s", err)
+	return nil
+}
+
+// closeTargets closes every target session except the main one, which is closed by Run
+func closeTargets(targets []moduleTarget, main *ldapsession.LDAPSession) {
+	for _, t := range targets {
+		if t.session != main {
+			t.session.Close()
+		}
+	}
+}
+
 func (w *WindapSearchSession) StartTUI() error {
 	return nil
 }
@@ -0,0 +1,384 @@
+package windapsearch
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ropnop/go-windapsearch/pkg/adschema"
+	"github.com/ropnop/go-windapsearch/pkg/modules"
+)
+
+// DefaultMaxMemory is how much output a writer may hold before it has to start writing, for the formats that can't
+// always be streamed (CSV of --full results)
+const DefaultMaxMemory = "256MB"
+
+// resultWriter formats a module's results. Every format writes entries as they arrive, JSON arrays included, so
+// memory use doesn't grow with the number of results
+type resultWriter interface {
+	// marshal formats an entry. It's called by the result workers at the same time
+	marshal(e *adschema.ADEntry) ([]byte, error)
+	// write outputs a marshaled entry. It's only called by the output worker
+	write(out io.Writer, b []byte) error
+	// close finishes the output once every entry is written
+	close(out io.Writer) error
+}
+
+// newResultWriter returns the writer for the output format. attrs are the attributes requested, and targets are the
+// sessions the results come from. CSV needs to know up front if more than one domain is combined, for its header
+func (w *WindapSearchSession) newResultWriter(mod modules.Module, attrs []string, targets []moduleTarget) resultWriter {
+	multiDomain := false
+	for _, t := range targets {
+		multiDomain = multiDomain || t.domain != ""
+	}
+	switch {
+	case w.Options.SQL:
+		return w.newSQLWriter(mod, targets)
+	case w.Options.STIX:
+		return w.newSTIXWriter()
+	case w.Options.BloodHound:
+		return w.newBloodHoundWriter(targets)
+	case w.Options.Graph != "":
+		return w.newGraphWriter(targets)
+	case w.Options.JSON:
+		return &jsonWriter{}
+	case w.Options.CSV:
+		return w.newCSVWriter(attrs, multiDomain)
+	}
+	return &textWriter{decode: w.Options.Decode}
+}
+
+// textWriter writes entries in LDIF-like text separated by blank lines, with the values as the DC returned them, or
+// converted to readable forms with decode
+type textWriter struct {
+	decode  bool
+	started bool
+}
+
+func (t *textWriter) marshal(e *adschema.ADEntry) ([]byte, error) {
+	if t.decode {
+		return []byte(e.DecodedFormat()), nil
+	}
+	return []byte(e.LDAPFormat()), nil
+}
+
+func (t *textWriter) write(out io.Writer, b []byte) error {
+	if t.started {
+		if _, err := io.WriteString(out, "\n"); err != nil {
+			return err
+		}
+	}
+	t.started = true
+	_, err := out.Write(b)
+	return err
+}
+
+func (t *textWriter) close(out io.Writer) error {
+	return nil
+}
+
+// jsonWriter writes a JSON array one element at a time
+type jsonWriter struct {
+	started bool
+}
+
+func (j *jsonWriter) marshal(e *adschema.ADEntry) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+func (j *jsonWriter) write(out io.Writer, b []byte) error {
+	delimiter := ","
+	if !j.started {
+		delimiter = "["
+	}
+	j.started = true
+	if _, err := io.WriteString(out, delimiter); err != nil {
+		return err
+	}
+	_, err := out.Write(b)
+	return err
+}
+
+func (j *jsonWriter) close(out io.Writer) error {
+	end := "]"
+	if !j.started {
+		end = "[]"
+	}
+	_, err := io.WriteString(out, end)
+	return err
+}
+
+// csvWriter writes one row per entry, with multiple values joined by adschema.CSVValueSeparator (or one row per value
+// of the --explode attribute). The header comes from the requested attributes, so rows are written straight away.
+// Only when every attribute is requested (--full, or *) can the columns not be known before the results are: entries
+// are then held until maxMemory worth have been seen (or there are no more), the header is made from every attribute
+// they had, and the rest are streamed with it
+type csvWriter struct {
+	// columns is the header. It's nil when the columns are found from the results
+	columns   []string
+	maxMemory int64
+	// explode is the attribute to write a row for each value of, with --explode
+	explode string
+
+	// while the columns are being found, buffered holds the entries seen so far (each marshaled as a header row of
+	// their own attributes, then their values), and seen the columns they had in the order they were first seen
+	buffered    [][]byte
+	bufferedLen int64
+	seen        map[string]bool
+	order       []string
+	// header is what the rows written so far have been written with
+	header []string
+
+	// mu guards left, the attributes entries had that aren't in the header, which are warned about at the end
+	mu   sync.Mutex
+	left map[string]bool
+}
+
+func (w *WindapSearchSession) newCSVWriter(attrs []string, multiDomain bool) *csvWriter {
+	c := &csvWriter{maxMemory: w.maxMemory, explode: w.Options.Explode, left: make(map[string]bool)}
+	for _, a := range attrs {
+		if a == "*" || a == "+" {
+			fmt.Fprintf(os.Stderr, "[!] CSV columns can't be known before the results with all attributes requested, holding up to %s of results (--max-memory) to find them\n",
+				formatByteSize(w.maxMemory))
+			c.seen = make(map[string]bool)
+			return c
+		}
+	}
+	c.columns = []string{"dn"}
+	if multiDomain {
+		c.columns = append(c.columns, "domain")
+	}
+	c.columns = append(c.columns, attrs...)
+	// attributes added to the results, not requested from the DC
+	if w.Options.DetectDecoys {
+		c.columns = append(c.columns, "decoyIndicators")
+	}
+	if w.Options.Annotate {
+		c.columns = append(c.columns, "wellKnownObject")
+	}
+	if w.Options.ResolveHosts {
+		c.columns = append(c.columns, "ipAddresses")
+	}
+	if w.Options.Probe {
+		c.columns = append(c.columns, "reachable", "openPorts")
+	}
+	c.columns = dedupeFold(c.columns)
+	return c
+}
+
+func (c *csvWriter) marshal(e *adschema.ADEntry) ([]byte, error) {
+	if c.columns == nil {
+		// the header isn't known yet, so keep the entry's own column names with it
+		columns := e.CSVColumns()
+		records, err := e.CSVRecords(columns, c.explode)
+		if err != nil {
+			return nil, err
+		}
+		return csvRows(append([][]string{columns}, records...)...)
+	}
+	c.notInHeader(e.CSVColumns(), c.columns)
+	records, err := e.CSVRecords(c.columns, c.explode)
+	if err != nil {
+		return nil, err
+	}
+	return csvRows(records...)
+}
+
+func (c *csvWriter) write(out io.Writer, b []byte) error {
+	if c.columns != nil {
+		if !c.started() {
+			if err := c.writeHeader(out, c.columns); err != nil {
+				return err
+			}
+		}
+		_, err := out.Write(b)
+		return err
+	}
+	if c.started() {
+		return c.writeBuffered(out, b)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil || len(rows) < 2 {
+		return fmt.Errorf("malformed CSV row: %v", err)
+	}
+	for _, col := range rows[0] {
+		if !c.seen[strings.ToLower(col)] {
+			c.seen[strings.ToLower(col)] = true
+			c.order = append(c.order, col)
+		}
+	}
+	c.buffered = append(c.buffered, b)
+	c.bufferedLen += int64(len(b))
+	if c.bufferedLen > c.maxMemory {
+		fmt.Fprintf(os.Stderr, "[!] Over --max-memory (%s) looking for CSV columns, using the %d found in the first %d entries. Attributes only later entries have are left out\n",
+			formatByteSize(c.maxMemory), len(c.order), len(c.buffered))
+		return c.flush(out)
+	}
+	return nil
+}
+
+func (c *csvWriter) close(out io.Writer) error {
+	if !c.started() {
+		var err error
+		if c.columns == nil {
+			err = c.flush(out)
+		} else {
+			err = c.writeHeader(out, c.columns)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(c.left) > 0 {
+		var left []string
+		for name := range c.left {
+			left = append(left, name)
+		}
+		sort.Strings(left)
+		fmt.Fprintf(os.Stderr, "[!] Attributes not in the CSV header were left out: %s\n", strings.Join(left, ", "))
+	}
+	return nil
+}
+
+func (c *csvWriter) started() bool {
+	return c.header != nil
+}
+
+func (c *csvWriter) writeHeader(out io.Writer, columns []string) error {
+	c.header = columns
+	b, err := csvRows(columns)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(b)
+	return err
+}
+
+// flush writes the header made from the columns seen, then every buffered entry
+func (c *csvWriter) flush(out io.Writer) error {
+	order := c.order
+	if len(order) == 0 {
+		order = []string{"dn"}
+	}
+	if err := c.writeHeader(out, order); err != nil {
+		return err
+	}
+	buffered := c.buffered
+	c.buffered, c.bufferedLen, c.seen = nil, 0, nil
+	for _, b := range buffered {
+		if err := c.writeBuffered(out, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBuffered writes an entry marshaled with its own columns as a row with the header's
+func (c *csvWriter) writeBuffered(out io.Writer, b []byte) error {
+	rows, err := csv.NewReader(bytes.NewReader(b)).ReadAll()
+	if err != nil || len(rows) < 2 {
+		return fmt.Errorf("malformed CSV row: %v", err)
+	}
+	c.notInHeader(rows[0], c.header)
+	// with --explode, an entry can be more than one row
+	records := make([][]string, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		values := make(map[string]string, len(rows[0]))
+		for i, col := range rows[0] {
+			values[strings.ToLower(col)] = row[i]
+		}
+		record := make([]string, len(c.header))
+		for i, col := range c.header {
+			record[i] = values[strings.ToLower(col)]
+		}
+		records = append(records, record)
+	}
+	b, err = csvRows(records...)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(b)
+	return err
+}
+
+// notInHeader records the columns an entry has that the header doesn't
+func (c *csvWriter) notInHeader(columns, header []string) {
+	in := make(map[string]bool, len(header))
+	for _, col := range header {
+		in[strings.ToLower(col)] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, col := range columns {
+		if !in[strings.ToLower(col)] {
+			c.left[col] = true
+		}
+	}
+}
+
+// csvRows encodes records as CSV
+func csvRows(records ...[]string) ([]byte, error) {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	if err := cw.WriteAll(records); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// dedupeFold removes names that are repeated, ignoring case
+func dedupeFold(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	var out []string
+	for _, n := range names {
+		if !seen[strings.ToLower(n)] {
+			seen[strings.ToLower(n)] = true
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// byteUnits are the suffixes --max-memory understands
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseByteSize parses a size like 512MB, 2GB or 1048576 (bytes)
+func parseByteSize(s string) (int64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(upper, u.suffix) {
+			upper, unit = strings.TrimSpace(strings.TrimSuffix(upper, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q (e.g. 256MB, 1GB)", s)
+	}
+	return n * unit, nil
+}
+
+func formatByteSize(n int64) string {
+	for _, u := range byteUnits {
+		if n >= u.size && n%u.size == 0 {
+			return fmt.Sprintf("%d%s", n/u.size, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}